@@ -1,5 +1,14 @@
 module github.com/go-nfs/nfsv3
 
-go 1.15
+go 1.18
 
-require github.com/rasky/go-xdr v0.0.0-20170124162913-1a41d1a06c93 // indirect
+require (
+	github.com/pkg/sftp v1.13.7
+	github.com/rasky/go-xdr v0.0.0-20170124162913-1a41d1a06c93
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/crypto v0.17.0 // indirect
+	golang.org/x/sys v0.15.0 // indirect
+)
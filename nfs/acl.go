@@ -0,0 +1,228 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/util"
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+// the NFSACL sideband protocol, which Linux and Solaris servers serve next to
+// NFS, on its port
+const (
+	NFSACLProg = 100227
+	NFSACLVers = 3
+
+	NFSACLProc3GetACL = 1
+	NFSACLProc3SetACL = 2
+)
+
+// what GETACL and SETACL are about
+const (
+	aclMaskACL        = 0x01
+	aclMaskACLCount   = 0x02
+	aclMaskDefault    = 0x04
+	aclMaskDefaultCnt = 0x08
+	aclMaskAll        = aclMaskACL | aclMaskACLCount | aclMaskDefault | aclMaskDefaultCnt
+)
+
+// Tags of POSIX ACL entries
+const (
+	ACLUserObj  = 0x01
+	ACLUser     = 0x02
+	ACLGroupObj = 0x04
+	ACLGroup    = 0x08
+	ACLMask     = 0x10
+	ACLOther    = 0x20
+
+	// set on the tags of the entries of a default ACL on the wire
+	aclDefault = 0x1000
+)
+
+// ACLEntry is an entry of a POSIX ACL.  ID is the uid or gid of ACLUser and
+// ACLGroup entries, Perm the rwx bits, 4, 2 and 1.
+type ACLEntry struct {
+	Tag  uint32
+	ID   uint32
+	Perm uint32
+}
+
+// POSIXACL is the access ACL of a file and, for a directory, the default ACL
+// its new entries inherit
+type POSIXACL struct {
+	Access  []ACLEntry
+	Default []ACLEntry
+}
+
+// Equal reports whether a and b have the same entries, in the same order
+func (a *POSIXACL) Equal(b *POSIXACL) bool {
+	return len(a.Access) == len(b.Access) && len(a.Default) == len(b.Default) &&
+		(len(a.Access) == 0 || reflect.DeepEqual(a.Access, b.Access)) &&
+		(len(a.Default) == 0 || reflect.DeepEqual(a.Default, b.Default))
+}
+
+// aclList is an ACL on the wire, the count of entries ahead of them
+type aclList struct {
+	Count   uint32
+	Entries []ACLEntry
+}
+
+func encodeACL(entries []ACLEntry, flag uint32) aclList {
+	l := aclList{Count: uint32(len(entries)), Entries: make([]ACLEntry, len(entries))}
+	for i, e := range entries {
+		e.Tag |= flag
+		l.Entries[i] = e
+	}
+
+	return l
+}
+
+func decodeACL(l aclList) []ACLEntry {
+	if len(l.Entries) == 0 {
+		return nil
+	}
+
+	entries := make([]ACLEntry, len(l.Entries))
+	for i, e := range l.Entries {
+		e.Tag &^= aclDefault
+		entries[i] = e
+	}
+
+	return entries
+}
+
+// IsACLUnsupportedError reports whether err says the server has no NFSACL
+// sideband, or no ACLs on the filesystem
+func IsACLUnsupportedError(err error) bool {
+	var acceptErr *rpc.AcceptError
+	if errors.As(err, &acceptErr) {
+		return acceptErr.Status == rpc.ProgUnavail || acceptErr.Status == rpc.ProgMismatch
+	}
+
+	var nfsErr *Error
+	return errors.As(err, &nfsErr) && nfsErr.ErrorNum == NFS3ErrNotSupp
+}
+
+// GetACL returns the POSIX ACLs of path, through the NFSACL sideband
+func (v *Target) GetACL(path string) (*POSIXACL, error) {
+	_, fh, err := v.Lookup(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.GetACLByFh(fh)
+}
+
+// GetACLByFh returns the POSIX ACLs of fh, through the NFSACL sideband
+func (v *Target) GetACLByFh(fh []byte) (*POSIXACL, error) {
+	type GetACLArgs struct {
+		rpc.Header
+		FH   []byte
+		Mask uint32
+	}
+
+	type GetACLRes struct {
+		Attr    PostOpAttr
+		Mask    uint32
+		Access  aclList
+		Default aclList
+	}
+
+	res, err := v.aclCall(&GetACLArgs{
+		Header: v.aclHeader(NFSACLProc3GetACL),
+		FH:     fh,
+		Mask:   aclMaskAll,
+	})
+	if err != nil {
+		util.Debugf("getacl(%x): %s", fh, err)
+		return nil, err
+	}
+
+	acl := new(GetACLRes)
+	if err = xdr.Read(res, acl); err != nil {
+		return nil, err
+	}
+
+	return &POSIXACL{Access: decodeACL(acl.Access), Default: decodeACL(acl.Default)}, nil
+}
+
+// SetACL sets the POSIX ACLs of path, through the NFSACL sideband
+func (v *Target) SetACL(path string, acl *POSIXACL) error {
+	_, fh, err := v.Lookup(path)
+	if err != nil {
+		return err
+	}
+
+	return v.SetACLByFh(fh, acl)
+}
+
+// SetACLByFh sets the POSIX ACLs of fh, through the NFSACL sideband.  The
+// default ACL is set only on directories.
+func (v *Target) SetACLByFh(fh []byte, acl *POSIXACL) error {
+	type SetACLArgs struct {
+		rpc.Header
+		FH      []byte
+		Mask    uint32
+		Access  aclList
+		Default aclList
+	}
+
+	mask := uint32(aclMaskACL | aclMaskACLCount)
+	if len(acl.Default) > 0 {
+		mask |= aclMaskDefault | aclMaskDefaultCnt
+	}
+
+	_, err := v.aclCall(&SetACLArgs{
+		Header:  v.aclHeader(NFSACLProc3SetACL),
+		FH:      fh,
+		Mask:    mask,
+		Access:  encodeACL(acl.Access, 0),
+		Default: encodeACL(acl.Default, aclDefault),
+	})
+	if err != nil {
+		util.Debugf("setacl(%x): %s", fh, err)
+		return err
+	}
+
+	// the mode follows the ACL
+	v.cache.invalidate(fh)
+
+	return nil
+}
+
+func (v *Target) aclHeader(proc uint32) rpc.Header {
+	return rpc.Header{
+		Rpcvers: 2,
+		Prog:    NFSACLProg,
+		Vers:    NFSACLVers,
+		Proc:    proc,
+		Cred:    v.auth,
+		Verf:    rpc.AuthNull,
+	}
+}
+
+// aclCall sends an NFSACL call on the NFS connection, and checks the status
+// of the reply
+func (v *Target) aclCall(c interface{}) (io.ReadSeeker, error) {
+	res, err := v.Client.Call(c)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := xdr.ReadUint32(res)
+	if err != nil {
+		return nil, err
+	}
+	if err = NFS3Error(status); err != nil {
+		return nil, fmt.Errorf("nfsacl: %w", err)
+	}
+
+	return res, nil
+}
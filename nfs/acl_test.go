@@ -0,0 +1,147 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+// fakeACL answers NFSACL calls with a table of ACLs by handle.  Files without
+// one have the minimal ACL of mode 0644.  Users in refuse are unknown to it.
+type fakeACL struct {
+	sync.Mutex
+	acls   map[string]*POSIXACL
+	refuse uint32
+}
+
+var minimalACL = []ACLEntry{{ACLUserObj, 0, 6}, {ACLGroupObj, 0, 4}, {ACLOther, 0, 4}}
+
+func (st *fakeACL) serve(call *rpc.ServerCall, w io.Writer) error {
+	st.Lock()
+	defer st.Unlock()
+
+	switch call.Proc {
+	case NFSACLProc3GetACL:
+		var args struct {
+			FH   []byte
+			Mask uint32
+		}
+		if err := xdr.Read(call.Args, &args); err != nil {
+			return rpc.ErrGarbageArgs
+		}
+		acl, ok := st.acls[string(args.FH)]
+		if !ok {
+			acl = &POSIXACL{Access: minimalACL}
+		}
+		return xdr.Write(w, struct {
+			Status  uint32
+			Attr    PostOpAttr
+			Mask    uint32
+			Access  aclList
+			Default aclList
+		}{NFS3Ok, PostOpAttr{}, args.Mask, encodeACL(acl.Access, 0), encodeACL(acl.Default, aclDefault)})
+
+	case NFSACLProc3SetACL:
+		var args struct {
+			FH      []byte
+			Mask    uint32
+			Access  aclList
+			Default aclList
+		}
+		if err := xdr.Read(call.Args, &args); err != nil {
+			return rpc.ErrGarbageArgs
+		}
+		status := uint32(NFS3Ok)
+		for _, e := range args.Access.Entries {
+			if e.Tag == ACLUser && e.ID == st.refuse {
+				status = NFS3ErrInval
+			}
+		}
+		if status == NFS3Ok {
+			st.acls[string(args.FH)] = &POSIXACL{Access: decodeACL(args.Access), Default: decodeACL(args.Default)}
+		}
+		return xdr.Write(w, struct {
+			Status uint32
+			Attr   PostOpAttr
+		}{status, PostOpAttr{}})
+	}
+
+	return rpc.ErrProcUnavail
+}
+
+// aclTarget mounts a server with the NFSACL sideband, if acls is set
+func aclTarget(t *testing.T, acls *fakeACL) *Target {
+	s := NewServer(NewMemFS())
+	if acls != nil {
+		acls.acls = make(map[string]*POSIXACL)
+		s.Register(NFSACLProg, NFSACLVers, acls.serve)
+	}
+
+	v, err := DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+
+	return v
+}
+
+func TestSyncACLs(t *testing.T) {
+	src := aclTarget(t, &fakeACL{})
+	defer src.Close()
+	dst := aclTarget(t, &fakeACL{refuse: 666})
+	defer dst.Close()
+
+	if _, err := src.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, src, "/dir/shared", "data")
+	writeFile(t, src, "/dir/odd", "data")
+
+	inherit := &POSIXACL{
+		Access:  []ACLEntry{{ACLUserObj, 0, 7}, {ACLGroupObj, 0, 5}, {ACLOther, 0, 5}},
+		Default: []ACLEntry{{ACLUserObj, 0, 7}, {ACLUser, 1000, 7}, {ACLGroupObj, 0, 5}, {ACLMask, 0, 7}, {ACLOther, 0, 5}},
+	}
+	shared := &POSIXACL{Access: []ACLEntry{{ACLUserObj, 0, 6}, {ACLUser, 1000, 6}, {ACLGroupObj, 0, 4}, {ACLMask, 0, 6}, {ACLOther, 0, 4}}}
+	odd := &POSIXACL{Access: []ACLEntry{{ACLUserObj, 0, 6}, {ACLUser, 666, 6}, {ACLGroupObj, 0, 4}, {ACLMask, 0, 6}, {ACLOther, 0, 4}}}
+	for path, acl := range map[string]*POSIXACL{"/dir": inherit, "/dir/shared": shared, "/dir/odd": odd} {
+		if err := src.SetACL(path, acl); err != nil {
+			t.Fatalf("setacl %s: %s", path, err)
+		}
+	}
+	if got, err := src.GetACL("/dir"); err != nil || !got.Equal(inherit) {
+		t.Fatalf("getacl: %+v, %v", got, err)
+	}
+
+	opts := SyncOptions{ACLs: true}
+	res, err := SyncTreeWithOptions(&TreeRef{src, "/"}, &TreeRef{dst, "/"}, nil, opts)
+	if err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if res.ACLs != 2 || len(res.ACLErrors) != 1 || res.ACLErrors[0].Path != "dir/odd" || res.ACLsSkipped {
+		t.Errorf("sync: %+v", res)
+	}
+	for path, want := range map[string]*POSIXACL{"/dir": inherit, "/dir/shared": shared} {
+		if got, err := dst.GetACL(path); err != nil || !got.Equal(want) {
+			t.Errorf("acl of %s: %+v, %v", path, got, err)
+		}
+	}
+
+	// a server without the sideband
+	plain := aclTarget(t, nil)
+	defer plain.Close()
+	if _, err = plain.GetACL("/"); !IsACLUnsupportedError(err) {
+		t.Errorf("getacl without the sideband: %v", err)
+	}
+	if res, err = SyncTreeWithOptions(&TreeRef{src, "/"}, &TreeRef{plain, "/"}, nil, opts); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if !res.ACLsSkipped || res.Files != 2 {
+		t.Errorf("sync without the sideband: %+v", res)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"io"
+	"os"
+
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// AppendRecord appends record to file path, creating it if need be.  NFSv3
+// has no append mode, writing at the end of a file takes finding where it
+// is first, and two clients doing so at once write over each other.  The
+// file is locked through the lock manager of the server for the time it
+// takes, so records appended by clients on any number of hosts, as long as
+// they all lock, land whole and one after the other, as in a shared log or
+// journal.  The record is written to stable storage before the lock is
+// released.
+func (v *Target) AppendRecord(path string, record []byte) error {
+	_, fh, err := v.Lookup(path)
+	if os.IsNotExist(err) {
+		fh, err = v.Create(path, 0644)
+		if os.IsExist(err) {
+			// created by another client meanwhile
+			_, fh, err = v.Lookup(path)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return v.AppendRecordByFh(fh, record)
+}
+
+// AppendRecordByFh appends record to file fh, see AppendRecord
+func (v *Target) AppendRecordByFh(fh []byte, record []byte) error {
+	l, err := v.LockManager()
+	if err != nil {
+		return err
+	}
+
+	// the whole file, as far as it grows
+	lock, err := l.LockByFh(fh, 0, 0, true, true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.Unlock(); err != nil {
+			util.Errorf("append(%x): unlock: %s", fh, err)
+		}
+	}()
+
+	// the size as the server has it now that no one else appends, cached
+	// attributes may well predate the last record
+	attr, err := v.getAttr(fh)
+	if err != nil {
+		return err
+	}
+
+	f, err := v.OpenByFh(fh, attr)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekEnd); err == nil {
+		// FILE_SYNC writes, stable by the time they return
+		_, err = f.Write(record)
+	}
+	f.handles.untrack(f)
+
+	return err
+}
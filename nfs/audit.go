@@ -0,0 +1,67 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+// AuditEvent describes a single mutating operation issued through a Target.
+//
+// For namespace operations (CREATE, MKDIR, SYMLINK, REMOVE, RMDIR, RENAME) FH
+// is the handle of the parent directory and Name the entry within it.  For
+// RENAME, ToFH and ToName describe the destination.  For SETATTR, WRITE and
+// COMMIT FH is the handle of the object itself, and for LINK the file linked
+// to, with ToFH and ToName the new entry.
+type AuditEvent struct {
+	Time time.Time
+	Proc uint32
+	Op   string
+
+	// Principal the call was made as, the credential a CredentialProvider
+	// chose for it if the target has one.  Flavor is the rpc auth flavor; UID
+	// and GID are only meaningful for AUTH_UNIX, and User and Group name them
+	// if the target has an IDResolver that knows them.
+	Flavor uint32
+	UID    uint32
+	GID    uint32
+	User   string
+	Group  string
+
+	FH     []byte
+	Name   string
+	ToFH   []byte
+	ToName string
+
+	// Count is the number of bytes written, for WRITE.
+	Count uint64
+
+	// Err is the result of the operation, nil on success.
+	Err error
+}
+
+// AuditHook is called once for each mutating operation after it completes,
+// with the event the after hook of SetOpHooks sees.  It is called
+// synchronously, so it must not block for long.
+type AuditHook func(ev *AuditEvent)
+
+// SetAuditHook installs h as the audit hook.  A nil h disables auditing.
+func (v *Target) SetAuditHook(h AuditHook) {
+	v.auditHook = h
+}
+
+// principal fills in the principal of ev, that of credential auth
+func (v *Target) principal(ev *AuditEvent, auth rpc.Auth) {
+	ev.Flavor = auth.Flavor
+	if au, err := rpc.ParseAuthUnix(auth); err == nil {
+		ev.UID = au.Uid
+		ev.GID = au.Gid
+		if v.ids != nil {
+			ev.User, _ = v.ids.User(au.Uid)
+			ev.Group, _ = v.ids.Group(au.Gid)
+		}
+	}
+}
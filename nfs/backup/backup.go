@@ -0,0 +1,234 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package backup
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	_path "path"
+	"sort"
+
+	"github.com/go-nfs/nfsv3/nfs"
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// Options tune a backup run
+type Options struct {
+	// Checksum records the SHA-256 of every file written to the archive
+	Checksum bool
+
+	// OneFilesystem keeps the backup to the filesystem of root, as tar
+	// --one-file-system does: directories on another one, nested exports
+	// of the server, are recorded but not descended into
+	OneFilesystem bool
+
+	// Ordered walks the entries of every directory sorted by name, rather
+	// than in the order the server lists them, which may change from one
+	// listing to the next, so that backups of the same tree are the same
+	// archive byte for byte
+	Ordered bool
+}
+
+// Result is the outcome of a backup run
+type Result struct {
+	// Manifest is the state of the tree as of the run, to be saved and
+	// handed to the next run
+	Manifest *Manifest
+
+	// Files and Bytes count what was written to the archive, Unchanged the
+	// files left out as they are the same as in the previous manifest
+	Files     int
+	Bytes     uint64
+	Unchanged int
+
+	// Removed lists the paths of the previous manifest that are gone.  An
+	// archive can't express a removal, restoring needs this list.
+	Removed []string
+}
+
+// Run backs the tree at root of v up to w as a tar archive.  With a manifest
+// from a previous run only files that changed since are written, a file
+// counting as changed when its fileid, size, mtime or ctime moved.  prev may
+// be nil for a full backup.  Paths in the archive and the manifest are
+// relative to root.
+func Run(v *nfs.Target, root string, prev *Manifest, w io.Writer, opts Options) (*Result, error) {
+	attr, fh, err := v.GetAttr(root)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &backup{
+		v:    v,
+		fsid: attr.FSID,
+		prev: prev,
+		tw:   tar.NewWriter(w),
+		opts: opts,
+		res:  &Result{Manifest: NewManifest(root)},
+	}
+	if b.prev == nil {
+		b.prev = NewManifest(root)
+	}
+
+	if err = b.walk(fh, root, ""); err != nil {
+		return nil, err
+	}
+	if err = b.tw.Close(); err != nil {
+		return nil, err
+	}
+
+	for path := range b.prev.Entries {
+		if _, ok := b.res.Manifest.Entries[path]; !ok {
+			b.res.Removed = append(b.res.Removed, path)
+		}
+	}
+	sort.Strings(b.res.Removed)
+
+	return b.res, nil
+}
+
+type backup struct {
+	v    *nfs.Target
+	fsid uint64
+	prev *Manifest
+	tw   *tar.Writer
+	opts Options
+	res  *Result
+}
+
+// walk backs up the entries of directory fh, at path on the target and rel
+// in the archive
+func (b *backup) walk(fh []byte, path, rel string) error {
+	entries, err := b.v.ReadDirPlusByFh(fh)
+	if err != nil {
+		return fmt.Errorf("backup: readdir %s: %w", path, err)
+	}
+	if b.opts.Ordered {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].FileName < entries[j].FileName })
+	}
+
+	for _, e := range entries {
+		if e.FileName == "." || e.FileName == ".." {
+			continue
+		}
+
+		epath := _path.Join(path, e.FileName)
+		erel := _path.Join(rel, e.FileName)
+
+		attr, efh := &e.Attr.Attr, e.Handle.FH
+		if !e.Attr.IsSet || !e.Handle.IsSet {
+			fi, lfh, err := b.v.Lookup(epath)
+			if err != nil {
+				return fmt.Errorf("backup: lookup %s: %w", epath, err)
+			}
+			attr, efh = fi.(*nfs.Fattr), lfh
+		}
+
+		if err = b.entry(efh, attr, epath, erel); err != nil {
+			return err
+		}
+
+		if attr.Type == nfs.NF3Dir {
+			if b.opts.OneFilesystem && attr.FSID != b.fsid {
+				util.Debugf("backup: %s is on another filesystem, not descending", epath)
+				continue
+			}
+			if err = b.walk(efh, epath, erel); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// entry records an entry in the manifest, and writes it to the archive if it
+// changed
+func (b *backup) entry(fh []byte, attr *nfs.Fattr, path, rel string) error {
+	e := NewEntry(rel, attr)
+	b.res.Manifest.Entries[rel] = e
+
+	if old, ok := b.prev.Entries[rel]; ok && !old.Changed(attr) {
+		e.Checksum = old.Checksum
+		if attr.Type == nfs.NF3Reg {
+			b.res.Unchanged++
+		}
+		return nil
+	}
+
+	hdr := &tar.Header{
+		Name:    rel,
+		Mode:    int64(attr.FileMode & nfs.ModeMask),
+		Uid:     int(attr.UID),
+		Gid:     int(attr.GID),
+		ModTime: e.Mtime,
+		Format:  tar.FormatPAX,
+	}
+
+	switch attr.Type {
+	case nfs.NF3Dir:
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+		return b.tw.WriteHeader(hdr)
+
+	case nfs.NF3Lnk:
+		target, err := b.v.Readlink(path)
+		if err != nil {
+			return fmt.Errorf("backup: readlink %s: %w", path, err)
+		}
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = target
+		return b.tw.WriteHeader(hdr)
+
+	case nfs.NF3Reg:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(attr.Filesize)
+		if err := b.tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		return b.copyFile(fh, attr, path, e)
+
+	default:
+		util.Debugf("backup: skipping special file %s", path)
+		return nil
+	}
+}
+
+// copyFile streams the data of a regular file into the archive
+func (b *backup) copyFile(fh []byte, attr *nfs.Fattr, path string, e *Entry) error {
+	f, err := b.v.OpenByFh(fh, attr)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var w io.Writer = b.tw
+	var h hash.Hash
+	if b.opts.Checksum {
+		h = sha256.New()
+		w = io.MultiWriter(b.tw, h)
+	}
+
+	// the archive header promised attr.Filesize bytes, a file that changed
+	// size under us can't be archived consistently
+	n, err := io.CopyN(w, f, int64(attr.Filesize))
+	if err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("file shrank to %d bytes: %w", n, os.ErrInvalid)
+		}
+		return fmt.Errorf("backup: %s: %w", path, err)
+	}
+
+	if h != nil {
+		e.Checksum = hex.EncodeToString(h.Sum(nil))
+	}
+	b.res.Files++
+	b.res.Bytes += uint64(n)
+
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs"
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+func writeFile(t *testing.T, v *nfs.Target, path, data string) {
+	f, err := v.OpenFile(path, 0644)
+	if err != nil {
+		t.Fatalf("create %s: %s", path, err)
+	}
+	if _, err = f.Write([]byte(data)); err != nil {
+		t.Fatalf("write %s: %s", path, err)
+	}
+	f.Close()
+}
+
+// archived returns the names and contents in a tar archive
+func archived(t *testing.T, buf *bytes.Buffer) map[string]string {
+	files := make(map[string]string)
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatalf("archive: %s", err)
+		}
+		data, _ := io.ReadAll(tr)
+		files[hdr.Name] = string(data)
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	v, err := nfs.DialLoopback(nfs.NewServer(nfs.NewMemFS())).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	if _, err = v.Mkdir("/data", 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	if _, err = v.Mkdir("/data/sub", 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	writeFile(t, v, "/data/a", "alpha")
+	writeFile(t, v, "/data/sub/b", "bravo")
+	writeFile(t, v, "/data/c", "charlie")
+
+	full := new(bytes.Buffer)
+	res, err := Run(v, "/data", nil, full, Options{Checksum: true})
+	if err != nil {
+		t.Fatalf("full backup: %s", err)
+	}
+	want := map[string]string{"a": "alpha", "c": "charlie", "sub/": "", "sub/b": "bravo"}
+	if got := archived(t, full); !reflect.DeepEqual(got, want) {
+		t.Fatalf("full backup archived %v", got)
+	}
+	if res.Files != 3 || res.Manifest.Entries["a"].Checksum == "" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	// the manifest survives being saved
+	saved := new(bytes.Buffer)
+	if err = res.Manifest.Save(saved); err != nil {
+		t.Fatalf("save: %s", err)
+	}
+	prev, err := LoadManifest(saved)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if !reflect.DeepEqual(prev.Entries, res.Manifest.Entries) {
+		t.Fatal("manifest did not round trip")
+	}
+
+	writeFile(t, v, "/data/a", "ALPHA!")
+	writeFile(t, v, "/data/d", "delta")
+	if err = v.Remove("/data/c"); err != nil {
+		t.Fatalf("remove: %s", err)
+	}
+
+	incr := new(bytes.Buffer)
+	if res, err = Run(v, "/data", prev, incr, Options{Checksum: true}); err != nil {
+		t.Fatalf("incremental backup: %s", err)
+	}
+	want = map[string]string{"a": "ALPHA!", "d": "delta"}
+	if got := archived(t, incr); !reflect.DeepEqual(got, want) {
+		t.Fatalf("incremental backup archived %v", got)
+	}
+	if res.Unchanged != 1 || !reflect.DeepEqual(res.Removed, []string{"c"}) {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if res.Manifest.Entries["sub/b"].Checksum != prev.Entries["sub/b"].Checksum {
+		t.Fatal("checksum of an unchanged file was not carried over")
+	}
+}
+
+func TestOrderedBackup(t *testing.T) {
+	v, err := nfs.DialLoopback(nfs.NewServer(nfs.NewMemFS())).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	for _, name := range []string{"/z", "/m", "/a"} {
+		if _, err = v.Mkdir(name, 0755); err != nil {
+			t.Fatalf("mkdir: %s", err)
+		}
+		writeFile(t, v, name+"/y", name)
+		writeFile(t, v, name+"/b", name)
+	}
+
+	var archives [2]bytes.Buffer
+	for i := range archives {
+		if _, err = Run(v, "/", nil, &archives[i], Options{Ordered: true}); err != nil {
+			t.Fatalf("backup: %s", err)
+		}
+	}
+	if !bytes.Equal(archives[0].Bytes(), archives[1].Bytes()) {
+		t.Fatal("archives of the same tree differ")
+	}
+
+	var names []string
+	tr := tar.NewReader(&archives[0])
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("archive: %s", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	want := []string{"a/", "a/b", "a/y", "m/", "m/b", "m/y", "z/", "z/b", "z/y"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("archived %v, want %v", names, want)
+	}
+}
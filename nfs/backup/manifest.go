@@ -0,0 +1,114 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package backup
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs"
+)
+
+// ManifestVersion is the version of the manifest format written by Save
+const ManifestVersion = 1
+
+// Entry is what a manifest records of a file, enough to tell on the next run
+// whether it changed
+type Entry struct {
+	Path   string    `json:"path"`
+	Type   uint32    `json:"type"`
+	Mode   uint32    `json:"mode"`
+	FileID uint64    `json:"fileid"`
+	Size   uint64    `json:"size"`
+	Mtime  time.Time `json:"mtime"`
+	Ctime  time.Time `json:"ctime"`
+
+	// Checksum is the hex SHA-256 of the data of regular files, if asked
+	// for
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// Manifest is the state of a tree as of a backup run
+type Manifest struct {
+	Version int       `json:"version"`
+	Root    string    `json:"root"`
+	Created time.Time `json:"created"`
+
+	Entries map[string]*Entry `json:"-"`
+}
+
+// NewManifest returns an empty manifest for root
+func NewManifest(root string) *Manifest {
+	return &Manifest{
+		Version: ManifestVersion,
+		Root:    root,
+		Created: time.Now(),
+		Entries: make(map[string]*Entry),
+	}
+}
+
+// manifestFile is the encoding of a manifest, entries sorted by path so
+// that manifests diff well
+type manifestFile struct {
+	*Manifest
+	Entries []*Entry `json:"entries"`
+}
+
+// LoadManifest reads a manifest written by Save
+func LoadManifest(r io.Reader) (*Manifest, error) {
+	mf := manifestFile{Manifest: new(Manifest)}
+	if err := json.NewDecoder(r).Decode(&mf); err != nil {
+		return nil, err
+	}
+
+	m := mf.Manifest
+	m.Entries = make(map[string]*Entry, len(mf.Entries))
+	for _, e := range mf.Entries {
+		m.Entries[e.Path] = e
+	}
+
+	return m, nil
+}
+
+// Save writes m to w as JSON
+func (m *Manifest) Save(w io.Writer) error {
+	mf := manifestFile{Manifest: m, Entries: make([]*Entry, 0, len(m.Entries))}
+	for _, e := range m.Entries {
+		mf.Entries = append(mf.Entries, e)
+	}
+	sort.Slice(mf.Entries, func(i, j int) bool {
+		return mf.Entries[i].Path < mf.Entries[j].Path
+	})
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&mf)
+}
+
+// NewEntry returns the entry of the file at path with attributes attr,
+// without checksum
+func NewEntry(path string, attr *nfs.Fattr) *Entry {
+	return &Entry{
+		Path:   path,
+		Type:   attr.Type,
+		Mode:   attr.FileMode,
+		FileID: attr.Fileid,
+		Size:   attr.Filesize,
+		Mtime:  nfsTime(attr.Mtime),
+		Ctime:  nfsTime(attr.Ctime),
+	}
+}
+
+// Changed reports whether attr describes a different file from what e
+// recorded
+func (e *Entry) Changed(attr *nfs.Fattr) bool {
+	return e.Type != attr.Type || e.FileID != attr.Fileid || e.Size != attr.Filesize ||
+		!e.Mtime.Equal(nfsTime(attr.Mtime)) || !e.Ctime.Equal(nfsTime(attr.Ctime))
+}
+
+func nfsTime(t nfs.NFS3Time) time.Time {
+	return t.Time().UTC()
+}
@@ -0,0 +1,236 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"context"
+	"os"
+	_path "path"
+	"strings"
+	"sync"
+)
+
+// DefaultBatchInFlight is how many operations of a Batch run at once unless
+// set with InFlight
+const DefaultBatchInFlight = 16
+
+// BatchResult is the outcome of an operation of a Batch
+type BatchResult struct {
+	Op   string
+	Path string
+
+	// Attr and FH are those of the entry for Stat, FH that of the directory
+	// made for Mkdir
+	Attr *Fattr
+	FH   []byte
+
+	// Data is what ReadAt read, short of its length past the end of the
+	// file
+	Data []byte
+
+	Err error
+}
+
+// Batch is a list of operations, of any kind, run together by Run with many
+// of them in flight at once, so that orchestration scripts pay for a few
+// round trips rather than one per operation.  An operation on a path waits
+// for the operations queued before it on the same path, the directories
+// above it and the entries below it, so that a batch making a directory then
+// files in it does what it reads as; others run in any order.  A Batch is
+// not safe for concurrent use.
+type Batch struct {
+	v        *Target
+	ctx      context.Context
+	inFlight int
+	ops      []*batchOp
+}
+
+type batchOp struct {
+	res  BatchResult
+	to   string
+	run  func(op *batchOp) error
+	deps []*batchOp
+	done chan struct{}
+}
+
+// Batch returns an empty batch of operations on v, run within ctx: those
+// not started when ctx is done fail with its error
+func (v *Target) Batch(ctx context.Context) *Batch {
+	return &Batch{v: v, ctx: ctx, inFlight: DefaultBatchInFlight}
+}
+
+// InFlight sets how many operations run at once, at least one
+func (b *Batch) InFlight(n int) *Batch {
+	if n < 1 {
+		n = 1
+	}
+	b.inFlight = n
+	return b
+}
+
+// add queues an operation on path, and to for a rename, returning its index
+// in the results
+func (b *Batch) add(name, path, to string, run func(op *batchOp) error) int {
+	op := &batchOp{
+		res:  BatchResult{Op: name, Path: path},
+		to:   to,
+		run:  run,
+		done: make(chan struct{}),
+	}
+	for _, prev := range b.ops {
+		if prev.touches(path) || (to != "" && prev.touches(to)) {
+			op.deps = append(op.deps, prev)
+		}
+	}
+	b.ops = append(b.ops, op)
+
+	return len(b.ops) - 1
+}
+
+// touches reports whether op is on path, above or below it
+func (op *batchOp) touches(path string) bool {
+	for _, p := range []string{op.res.Path, op.to} {
+		if p != "" && pathsNested(p, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathsNested reports whether a and b are the same path, or one is below
+// the other
+func pathsNested(a, b string) bool {
+	a, b = _path.Clean("/"+a), _path.Clean("/"+b)
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+
+	return a == b || a == "/" || strings.HasPrefix(b, a+"/")
+}
+
+// Stat queues a lookup of path, returning the index of its result
+func (b *Batch) Stat(path string) int {
+	return b.add("stat", path, "", func(op *batchOp) error {
+		fi, fh, err := b.v.LookupContext(b.ctx, path)
+		if err != nil {
+			return err
+		}
+		if attr, _ := fi.(*Fattr); attr != nil {
+			op.res.Attr, op.res.FH = attr, fh
+			return nil
+		}
+
+		// the root has no attributes from the walk
+		op.res.Attr, op.res.FH, err = b.v.GetAttr(path)
+		return err
+	})
+}
+
+// Mkdir queues the making of directory path
+func (b *Batch) Mkdir(path string, perm os.FileMode) int {
+	return b.add("mkdir", path, "", func(op *batchOp) error {
+		fh, err := b.v.Mkdir(path, perm)
+		op.res.FH = fh
+		return err
+	})
+}
+
+// WriteFile queues the creation, or truncation, of file path with data
+func (b *Batch) WriteFile(path string, data []byte, perm os.FileMode) int {
+	return b.add("write", path, "", func(op *batchOp) error {
+		m := Mutation{Op: OpCreate, Path: path, Mode: perm, Data: data}
+		return m.Apply(b.v)
+	})
+}
+
+// ReadAt queues the read of n bytes at offset of file path
+func (b *Batch) ReadAt(path string, offset uint64, n int) int {
+	return b.add("read", path, "", func(op *batchOp) error {
+		_, fh, err := b.v.LookupContext(b.ctx, path)
+		if err != nil {
+			return err
+		}
+
+		data, err := b.v.ReadRanges(fh, []Range{{Offset: offset, Length: uint64(n)}})
+		if err != nil {
+			return err
+		}
+		op.res.Data = data[0]
+		return nil
+	})
+}
+
+// Remove queues the removal of file path
+func (b *Batch) Remove(path string) int {
+	return b.add("remove", path, "", func(*batchOp) error {
+		return b.v.Remove(path)
+	})
+}
+
+// RmDir queues the removal of empty directory path
+func (b *Batch) RmDir(path string) int {
+	return b.add("rmdir", path, "", func(*batchOp) error {
+		return b.v.RmDir(path)
+	})
+}
+
+// Rename queues the rename of from to to
+func (b *Batch) Rename(from, to string) int {
+	return b.add("rename", from, to, func(*batchOp) error {
+		return b.v.Rename(from, to)
+	})
+}
+
+// Symlink queues the making of symlink path pointing to target
+func (b *Batch) Symlink(target, path string) int {
+	return b.add("symlink", path, "", func(*batchOp) error {
+		_, err := b.v.Symlink(target, path)
+		return err
+	})
+}
+
+// Run runs the operations queued, and returns their results in the order
+// they were queued, with the first error among them, as errgroup does.
+// Operations are run whether those before them failed or not, and the batch
+// may be run once.
+func (b *Batch) Run() ([]BatchResult, error) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, b.inFlight)
+
+	for _, op := range b.ops {
+		wg.Add(1)
+		go func(op *batchOp) {
+			defer wg.Done()
+			defer close(op.done)
+
+			for _, dep := range op.deps {
+				<-dep.done
+			}
+
+			select {
+			case slots <- struct{}{}:
+			case <-b.ctx.Done():
+				op.res.Err = b.ctx.Err()
+				return
+			}
+			defer func() { <-slots }()
+
+			if op.res.Err = b.ctx.Err(); op.res.Err == nil {
+				op.res.Err = op.run(op)
+			}
+		}(op)
+	}
+	wg.Wait()
+
+	results := make([]BatchResult, len(b.ops))
+	var firstErr error
+	for i, op := range b.ops {
+		results[i] = op.res
+		if firstErr == nil {
+			firstErr = op.res.Err
+		}
+	}
+
+	return results, firstErr
+}
@@ -0,0 +1,77 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	v := loopbackTarget(t)
+	writeFile(t, v, "/data", "0123456789")
+
+	b := v.Batch(context.Background())
+	mkdir := b.Mkdir("/dir", 0755)
+	write := b.WriteFile("/dir/a", []byte("hello"), 0644)
+	stat := b.Stat("/dir/a")
+	read := b.ReadAt("/data", 2, 4)
+	root := b.Stat("/")
+	rename := b.Rename("/dir/a", "/dir/b")
+	missing := b.Stat("/nope")
+
+	res, err := b.Run()
+	if !os.IsNotExist(err) {
+		t.Fatalf("err = %v, want the missing stat's", err)
+	}
+	for _, i := range []int{mkdir, write, stat, read, root, rename} {
+		if res[i].Err != nil {
+			t.Fatalf("%s %s: %v", res[i].Op, res[i].Path, res[i].Err)
+		}
+	}
+	if res[missing].Err != err {
+		t.Errorf("missing: %v", res[missing].Err)
+	}
+
+	// ordered after the mkdir and write, before the rename
+	if attr := res[stat].Attr; attr == nil || attr.Filesize != 5 {
+		t.Errorf("stat: %+v", attr)
+	}
+	if string(res[read].Data) != "2345" {
+		t.Errorf("read %q", res[read].Data)
+	}
+	if attr := res[root].Attr; attr == nil || attr.Type != NF3Dir {
+		t.Errorf("root: %+v", attr)
+	}
+	if got := readAll(t, v, "/dir/b"); got != "hello" {
+		t.Errorf("/dir/b = %q", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b = v.Batch(ctx)
+	b.Mkdir("/later", 0755)
+	if _, err = b.Run(); err != context.Canceled {
+		t.Errorf("cancelled: %v", err)
+	}
+}
+
+func TestPathsNested(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want bool
+	}{
+		{"/a", "/a", true},
+		{"/a", "/a/b", true},
+		{"/a/b/", "/a", true},
+		{"/", "/x", true},
+		{"/a", "/ab", false},
+		{"/a/b", "/a/c", false},
+	} {
+		if got := pathsNested(c.a, c.b); got != c.want {
+			t.Errorf("pathsNested(%q, %q) = %v", c.a, c.b, got)
+		}
+	}
+}
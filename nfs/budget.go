@@ -0,0 +1,144 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import "sync"
+
+// MemoryBudget accounts for the memory a Target holds in data buffers and
+// caches.  Transfer buffers block in Acquire until enough of the budget is
+// free; caches only take what is available right away and give memory back
+// when transfers need it, so the total stays within the limit.
+//
+// A MemoryBudget may be shared by several Targets to cap a whole process.
+type MemoryBudget struct {
+	sync.Mutex
+	cond *sync.Cond
+
+	limit int64
+	used  int64
+
+	// caches that can give memory back on demand
+	shrinkers map[shrinker]struct{}
+}
+
+type shrinker interface {
+	// shrink frees about n bytes of accounted memory, if it can
+	shrink(n int64)
+}
+
+// NewMemoryBudget returns a budget of limit bytes
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	b := &MemoryBudget{
+		limit:     limit,
+		shrinkers: make(map[shrinker]struct{}),
+	}
+	b.cond = sync.NewCond(&b.Mutex)
+
+	return b
+}
+
+// SetMemoryBudget makes the Target account its buffers and caches against b.
+// A nil b removes the limit.
+func (v *Target) SetMemoryBudget(b *MemoryBudget) {
+	v.budget = b
+	if v.dataCache != nil {
+		v.dataCache.setBudget(b)
+	}
+}
+
+// Acquire reserves n bytes, blocking until they are available.  Caches are
+// asked to shrink first.  Requests larger than the whole budget are clamped to
+// it, so they wait for everything else to drain instead of forever.
+func (b *MemoryBudget) Acquire(n int64) int64 {
+	if n > b.limit {
+		n = b.limit
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	for b.used+n > b.limit {
+		need := b.used + n - b.limit
+		shrinkers := make([]shrinker, 0, len(b.shrinkers))
+		for s := range b.shrinkers {
+			shrinkers = append(shrinkers, s)
+		}
+
+		// caches take their own locks and call Release, so let go of ours
+		b.Unlock()
+		for _, s := range shrinkers {
+			s.shrink(need)
+		}
+		b.Lock()
+
+		if b.used+n > b.limit {
+			b.cond.Wait()
+		}
+	}
+
+	b.used += n
+	return n
+}
+
+// TryAcquire reserves n bytes only if they are available right away
+func (b *MemoryBudget) TryAcquire(n int64) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.used+n > b.limit {
+		return false
+	}
+
+	b.used += n
+	return true
+}
+
+// Release returns n bytes to the budget
+func (b *MemoryBudget) Release(n int64) {
+	b.Lock()
+	b.used -= n
+	b.Unlock()
+
+	b.cond.Broadcast()
+}
+
+// Used returns the number of bytes currently reserved
+func (b *MemoryBudget) Used() int64 {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.used
+}
+
+// Limit returns the size of the budget
+func (b *MemoryBudget) Limit() int64 {
+	return b.limit
+}
+
+func (b *MemoryBudget) addShrinker(s shrinker) {
+	b.Lock()
+	b.shrinkers[s] = struct{}{}
+	b.Unlock()
+}
+
+func (b *MemoryBudget) removeShrinker(s shrinker) {
+	b.Lock()
+	delete(b.shrinkers, s)
+	b.Unlock()
+}
+
+// acquire and release are no-ops on a Target without budget
+func (v *Target) acquire(n int) int64 {
+	if v.budget == nil {
+		return 0
+	}
+
+	return v.budget.Acquire(int64(n))
+}
+
+func (v *Target) release(n int64) {
+	if v.budget != nil && n > 0 {
+		v.budget.Release(n)
+	}
+}
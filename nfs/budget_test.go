@@ -0,0 +1,51 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryBudgetShrinksCache(t *testing.T) {
+	b := NewMemoryBudget(8)
+	c := NewDataCache(1024, 4)
+	c.setBudget(b)
+
+	for i := uint64(0); i < 3; i++ {
+		c.put(&cachedBlock{key: blockKey{"fh", i}, data: []byte{1, 2, 3, 4}})
+	}
+
+	// the cache sheds its oldest block to stay within the budget
+	if b.Used() != 8 || c.Stats().Bytes != 8 {
+		t.Fatalf("expected 8 bytes accounted, budget %d cache %d", b.Used(), c.Stats().Bytes)
+	}
+
+	// a transfer buffer takes precedence over cached data
+	if n := b.Acquire(6); n != 6 {
+		t.Fatalf("expected 6 bytes reserved, got %d", n)
+	}
+	if c.Stats().Bytes > 2 {
+		t.Fatalf("expected the cache to shrink, holds %d", c.Stats().Bytes)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		b.Acquire(4)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("acquire did not block on an exhausted budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.Release(6)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("acquire did not resume after release")
+	}
+}
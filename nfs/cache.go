@@ -0,0 +1,249 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"sync"
+	"time"
+)
+
+// Upper bound on the number of handles the attribute cache keeps before it
+// starts dropping state.
+const attrCacheMaxEntries = 1 << 16
+
+// attrCache is an optional client side cache of file attributes (keyed by
+// handle) and directory entries (keyed by parent handle and name).
+//
+// Entries expire after a TTL, but directories are also validated against the
+// post-op attributes the server hands back with most replies: whenever a
+// directory is seen with an mtime different from the one its entries were
+// cached under, the entries are dropped.  Mutations made through the Target
+// carry wcc data, which lets the cache tell its own changes apart from
+// changes made by other clients.
+//
+// All methods are safe to call on a nil *attrCache, which is a disabled
+// cache.
+type attrCache struct {
+	sync.Mutex
+	ttl   time.Duration
+	attrs map[string]cachedAttr
+	dirs  map[string]*cachedDir
+}
+
+type cachedAttr struct {
+	attr    Fattr
+	expires time.Time
+}
+
+type cachedDir struct {
+	// mtime of the directory the entries were cached under
+	mtime   NFS3Time
+	entries map[string]cachedDirent
+}
+
+type cachedDirent struct {
+	fh      []byte
+	expires time.Time
+}
+
+func newAttrCache(ttl time.Duration) *attrCache {
+	return &attrCache{
+		ttl:   ttl,
+		attrs: make(map[string]cachedAttr),
+		dirs:  make(map[string]*cachedDir),
+	}
+}
+
+// SetCacheTTL enables caching of attributes and directory entries for up to
+// ttl.  Cached directories are additionally revalidated against the directory
+// attributes returned by the server, so changes made through this Target, or
+// noticed in any reply, take effect immediately.  A zero ttl disables the
+// cache, which is the default.
+func (v *Target) SetCacheTTL(ttl time.Duration) {
+	if ttl <= 0 {
+		v.cache = nil
+		return
+	}
+
+	v.cache = newAttrCache(ttl)
+}
+
+func (c *attrCache) getAttr(fh []byte) (*Fattr, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	ca, ok := c.attrs[string(fh)]
+	if !ok || time.Now().After(ca.expires) {
+		return nil, false
+	}
+
+	attr := ca.attr
+	return &attr, true
+}
+
+// putAttr records fresh attributes of fh.  If fh is a directory whose mtime
+// moved on, its cached entries are dropped.
+func (c *attrCache) putAttr(fh []byte, attr *Fattr) {
+	if c == nil || attr == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.setAttr(fh, attr, true)
+}
+
+func (c *attrCache) setAttr(fh []byte, attr *Fattr, checkDir bool) {
+	if len(c.attrs) >= attrCacheMaxEntries {
+		c.prune()
+	}
+
+	c.attrs[string(fh)] = cachedAttr{attr: *attr, expires: time.Now().Add(c.ttl)}
+
+	if attr.Type != NF3Dir {
+		return
+	}
+
+	d, ok := c.dirs[string(fh)]
+	if !ok {
+		return
+	}
+
+	if checkDir && d.mtime != attr.Mtime {
+		d.entries = make(map[string]cachedDirent)
+	}
+	d.mtime = attr.Mtime
+}
+
+func (c *attrCache) getDirent(dirfh []byte, name string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	d, ok := c.dirs[string(dirfh)]
+	if !ok {
+		return nil, false
+	}
+
+	de, ok := d.entries[name]
+	if !ok || time.Now().After(de.expires) {
+		return nil, false
+	}
+
+	return de.fh, true
+}
+
+func (c *attrCache) putDirent(dirfh []byte, name string, fh []byte) {
+	if c == nil || len(fh) == 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.dirs) >= attrCacheMaxEntries {
+		c.prune()
+	}
+
+	d, ok := c.dirs[string(dirfh)]
+	if !ok {
+		d = &cachedDir{entries: make(map[string]cachedDirent)}
+		if ca, ok := c.attrs[string(dirfh)]; ok {
+			d.mtime = ca.attr.Mtime
+		}
+		c.dirs[string(dirfh)] = d
+	}
+
+	d.entries[name] = cachedDirent{fh: fh, expires: time.Now().Add(c.ttl)}
+}
+
+func (c *attrCache) removeDirent(dirfh []byte, name string) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if d, ok := c.dirs[string(dirfh)]; ok {
+		delete(d.entries, name)
+	}
+}
+
+// invalidate forgets everything known about fh
+func (c *attrCache) invalidate(fh []byte) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.attrs, string(fh))
+	delete(c.dirs, string(fh))
+}
+
+// purge drops everything cached
+func (c *attrCache) purge() {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.attrs = make(map[string]cachedAttr)
+	c.dirs = make(map[string]*cachedDir)
+}
+
+// wcc applies the weak cache consistency data returned by a mutation of fh.
+// If the pre-op attributes don't match what is cached, someone else modified
+// the object in between and its cached entries can't be trusted.
+func (c *attrCache) wcc(fh []byte, w *WccData) {
+	if c == nil || w == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if !w.After.IsSet {
+		delete(c.attrs, string(fh))
+		delete(c.dirs, string(fh))
+		return
+	}
+
+	if d, ok := c.dirs[string(fh)]; ok {
+		if !w.Before.IsSet || w.Before.MTime != d.mtime {
+			d.entries = make(map[string]cachedDirent)
+		}
+	}
+
+	c.setAttr(fh, &w.After.Attr, false)
+}
+
+// prune drops expired entries, or everything if that isn't enough.  The
+// caller holds the lock.
+func (c *attrCache) prune() {
+	now := time.Now()
+	for k, ca := range c.attrs {
+		if now.After(ca.expires) {
+			delete(c.attrs, k)
+			delete(c.dirs, k)
+		}
+	}
+
+	if len(c.attrs) >= attrCacheMaxEntries || len(c.dirs) >= attrCacheMaxEntries {
+		c.attrs = make(map[string]cachedAttr)
+		c.dirs = make(map[string]*cachedDir)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAttrCacheDirInvalidation(t *testing.T) {
+	c := newAttrCache(time.Minute)
+	dir := []byte("dir")
+	child := []byte("child")
+
+	c.putAttr(dir, &Fattr{Type: NF3Dir, Mtime: NFS3Time{Seconds: 1}})
+	c.putAttr(child, &Fattr{Type: NF3Reg})
+	c.putDirent(dir, "a", child)
+
+	if fh, ok := c.getDirent(dir, "a"); !ok || string(fh) != "child" {
+		t.Fatalf("expected cached dirent")
+	}
+
+	// seen again unchanged, entries survive
+	c.putAttr(dir, &Fattr{Type: NF3Dir, Mtime: NFS3Time{Seconds: 1}})
+	if _, ok := c.getDirent(dir, "a"); !ok {
+		t.Fatalf("dirent dropped on unchanged mtime")
+	}
+
+	// our own mutation, pre-op attrs match, entries survive
+	w := &WccData{}
+	w.Before.IsSet = true
+	w.Before.MTime = NFS3Time{Seconds: 1}
+	w.After.IsSet = true
+	w.After.Attr = Fattr{Type: NF3Dir, Mtime: NFS3Time{Seconds: 2}}
+	c.wcc(dir, w)
+	if _, ok := c.getDirent(dir, "a"); !ok {
+		t.Fatalf("dirent dropped on own mutation")
+	}
+
+	// someone else changed it in between
+	w.Before.MTime = NFS3Time{Seconds: 3}
+	w.After.Attr.Mtime = NFS3Time{Seconds: 4}
+	c.wcc(dir, w)
+	if _, ok := c.getDirent(dir, "a"); ok {
+		t.Fatalf("dirent survived foreign mutation")
+	}
+
+	// changed mtime seen in a reply
+	c.putDirent(dir, "a", child)
+	c.putAttr(dir, &Fattr{Type: NF3Dir, Mtime: NFS3Time{Seconds: 5}})
+	if _, ok := c.getDirent(dir, "a"); ok {
+		t.Fatalf("dirent survived mtime change")
+	}
+}
+
+func TestAttrCacheNil(t *testing.T) {
+	var c *attrCache
+	c.putAttr([]byte("x"), &Fattr{})
+	if _, ok := c.getAttr([]byte("x")); ok {
+		t.Fatalf("nil cache returned an entry")
+	}
+}
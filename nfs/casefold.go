@@ -0,0 +1,62 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	_path "path"
+	"sort"
+	"strings"
+)
+
+// CaseInsensitive reports whether the filesystem of directory path, as
+// PATHCONF tells, finds names regardless of case, as those shared with
+// Windows clients or on macOS servers do
+func (v *Target) CaseInsensitive(path string) (bool, error) {
+	_, fh, err := v.Lookup(path)
+	if err != nil {
+		return false, err
+	}
+
+	return v.pathConf(fh).CaseInsensitive, nil
+}
+
+// EqualFold reports whether path1 and path2 name the same entry on the
+// target: whether they are equal, or equal but for case on a case
+// insensitive filesystem.  The filesystem is that of the directory of path1,
+// or of the root if it does not exist yet.
+func (v *Target) EqualFold(path1, path2 string) bool {
+	path1, path2 = _path.Clean("/"+path1), _path.Clean("/"+path2)
+	if path1 == path2 {
+		return true
+	}
+
+	fh := v.root()
+	if _, dfh, err := v.Lookup(_path.Dir(path1)); err == nil {
+		fh = dfh
+	}
+
+	return v.pathConf(fh).CaseInsensitive && strings.EqualFold(path1, path2)
+}
+
+// CaseCollisions returns the groups of names that differ only by case, which
+// overwrite each other when copied into one directory of a case insensitive
+// filesystem.  Groups and their names are sorted.
+func CaseCollisions(names []string) [][]string {
+	byFold := make(map[string][]string)
+	for _, name := range names {
+		folded := strings.ToLower(name)
+		byFold[folded] = append(byFold[folded], name)
+	}
+
+	var collisions [][]string
+	for _, group := range byFold {
+		if len(group) > 1 {
+			sort.Strings(group)
+			collisions = append(collisions, group)
+		}
+	}
+	sort.Slice(collisions, func(i, j int) bool { return collisions[i][0] < collisions[j][0] })
+
+	return collisions
+}
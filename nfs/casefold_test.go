@@ -0,0 +1,66 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+func TestEqualFold(t *testing.T) {
+	for _, insensitive := range []bool{false, true} {
+		ns := newPathConfServer(PathConf{NameMax: 255, CaseInsensitive: insensitive, CasePreserving: true})
+		v, err := DialLoopback(ns.Server).Mount("/", rpc.AuthNull)
+		if err != nil {
+			t.Fatalf("mount: %s", err)
+		}
+		defer v.Close()
+
+		if got, err := v.CaseInsensitive("/"); err != nil || got != insensitive {
+			t.Errorf("case insensitive: %v, %v", got, err)
+		}
+		if !v.EqualFold("/dir/File", "dir/File/") {
+			t.Errorf("equal paths differ")
+		}
+		if got := v.EqualFold("/dir/File", "/DIR/file"); got != insensitive {
+			t.Errorf("case insensitive %v: EqualFold %v", insensitive, got)
+		}
+	}
+}
+
+func TestCaseCollisions(t *testing.T) {
+	got := CaseCollisions([]string{"b", "README", "a", "Readme", "B", "readme"})
+	want := [][]string{{"B", "b"}, {"README", "Readme", "readme"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("collisions %v, want %v", got, want)
+	}
+}
+
+func TestUploadCollisions(t *testing.T) {
+	local := t.TempDir()
+	for _, name := range []string{"Makefile", "makefile", "main.go"} {
+		if err := os.WriteFile(filepath.Join(local, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ns := newPathConfServer(PathConf{NameMax: 255, CaseInsensitive: true, CasePreserving: true})
+	v, err := DialLoopback(ns.Server).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	res, err := UploadTree(local, &TreeRef{Target: v, Path: "/"}, UploadOptions{})
+	if err != nil {
+		t.Fatalf("upload: %s", err)
+	}
+	if want := [][]string{{"Makefile", "makefile"}}; !reflect.DeepEqual(res.Collisions, want) {
+		t.Errorf("collisions %v, want %v", res.Collisions, want)
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"context"
+	_path "path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultScanWorkers is the number of directories ChangedSince lists at once
+const DefaultScanWorkers = 8
+
+// Defaults of ScanOptions for large directories
+const (
+	DefaultLargeDirEntries = 10000
+	DefaultLargeDirWorkers = 2
+)
+
+// ScanOptions tune ChangedSinceWithOptions
+type ScanOptions struct {
+	// Workers is the number of directories listed at once, at least one
+	Workers int
+
+	// PruneDirs skips the subtree of a directory whose mtime and ctime are
+	// older than the cutoff.  This is a heuristic: a file modified in place
+	// does not touch its directory, and is missed if its directory is
+	// pruned.  It suits trees where files are replaced rather than
+	// rewritten, such as those written by rsync or object gateways.
+	PruneDirs bool
+
+	// A directory is listed a page at a time, and once it has shown more
+	// than LargeDirEntries entries the rest of its listing moves to one of
+	// LargeDirWorkers workers kept for large directories, freeing one of
+	// Workers, so that a directory of millions of entries, which can only
+	// be listed serially, does not hold up the rest of the scan.  They are
+	// DefaultLargeDirEntries and DefaultLargeDirWorkers if zero, and a
+	// negative LargeDirEntries keeps all directories on Workers.
+	LargeDirEntries int
+	LargeDirWorkers int
+}
+
+// LargeDir is a directory found by LargeDirs
+type LargeDir struct {
+	Path    string
+	Entries int
+}
+
+// ChangedSince walks the tree at root and returns the paths, sorted, of the
+// entries whose ctime or mtime is after t.  Attributes come from READDIRPLUS,
+// and directories are listed in parallel.
+func (v *Target) ChangedSince(root string, t time.Time) ([]string, error) {
+	return v.ChangedSinceWithOptions(root, t, ScanOptions{Workers: DefaultScanWorkers})
+}
+
+// ChangedSinceWithOptions is ChangedSince, tuned by opts
+func (v *Target) ChangedSinceWithOptions(root string, t time.Time, opts ScanOptions) ([]string, error) {
+	s, err := v.scan(root, t, opts, true)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(s.changed)
+	return s.changed, nil
+}
+
+// LargeDirs walks the tree at root as ChangedSince does, and returns the
+// directories of more than opts.LargeDirEntries entries, the largest first,
+// as candidates for splitting: however many workers scan a tree, each
+// directory is listed serially, and many servers slow down on lookups in
+// huge ones.
+func (v *Target) LargeDirs(root string, opts ScanOptions) ([]LargeDir, error) {
+	s, err := v.scan(root, time.Time{}, opts, false)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(s.large, func(i, j int) bool {
+		if s.large[i].Entries != s.large[j].Entries {
+			return s.large[i].Entries > s.large[j].Entries
+		}
+		return s.large[i].Path < s.large[j].Path
+	})
+
+	return s.large, nil
+}
+
+// scan walks the tree at root, collecting what changed after t if collect is
+// set, and the large directories
+func (v *Target) scan(root string, t time.Time, opts ScanOptions, collect bool) (*scan, error) {
+	_, fh, err := v.Lookup(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	if opts.LargeDirEntries == 0 {
+		opts.LargeDirEntries = DefaultLargeDirEntries
+	}
+	if opts.LargeDirWorkers < 1 {
+		opts.LargeDirWorkers = DefaultLargeDirWorkers
+	}
+
+	s := &scan{
+		v:            v,
+		cutoff:       t,
+		prune:        opts.PruneDirs && collect,
+		collect:      collect,
+		largeEntries: opts.LargeDirEntries,
+		sem:          make(chan struct{}, opts.Workers),
+		largeSem:     make(chan struct{}, opts.LargeDirWorkers),
+	}
+	s.wg.Add(1)
+	go s.dir(fh, root)
+	s.wg.Wait()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return s, nil
+}
+
+type scan struct {
+	v            *Target
+	cutoff       time.Time
+	prune        bool
+	collect      bool
+	largeEntries int
+	sem          chan struct{}
+	largeSem     chan struct{}
+	wg           sync.WaitGroup
+
+	sync.Mutex
+	changed []string
+	large   []LargeDir
+	err     error
+}
+
+// dir lists directory fh at path, and scans its subdirectories concurrently,
+// as soon as the page they are on is read
+func (s *scan) dir(fh []byte, path string) {
+	defer s.wg.Done()
+
+	s.sem <- struct{}{}
+	held := s.sem
+	defer func() { <-held }()
+
+	var changed []string
+	n := 0
+	err := s.v.ReadDirPlusPagesByFh(fh, func(page []EntryPlus) error {
+		for i := range page {
+			e := &page[i]
+			if e.FileName == "." || e.FileName == ".." {
+				continue
+			}
+			n++
+
+			attr, efh := &e.Attr.Attr, e.Handle.FH
+			if !e.Attr.IsSet || !e.Handle.IsSet {
+				// find out with a lookup what the server left out
+				var err error
+				if attr, efh, _, err = s.v.lookup(context.Background(), fh, e.FileName); err != nil {
+					return err
+				}
+			}
+
+			epath := _path.Join(path, e.FileName)
+			newer := s.collect && s.newer(attr)
+			if newer {
+				changed = append(changed, epath)
+			}
+
+			if attr.Type == NF3Dir && (newer || !s.prune) {
+				s.wg.Add(1)
+				// pages are decoded into the same entries
+				go s.dir(append([]byte(nil), efh...), epath)
+			}
+		}
+
+		if held == s.sem && s.largeEntries > 0 && n > s.largeEntries {
+			<-s.sem
+			s.largeSem <- struct{}{}
+			held = s.largeSem
+		}
+
+		return nil
+	})
+	if err != nil {
+		s.fail(err)
+		return
+	}
+
+	s.Lock()
+	s.changed = append(s.changed, changed...)
+	if s.largeEntries > 0 && n > s.largeEntries {
+		s.large = append(s.large, LargeDir{Path: path, Entries: n})
+	}
+	s.Unlock()
+}
+
+// fail records the first error of the scan
+func (s *scan) fail(err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// newer reports whether attr changed after the cutoff
+func (s *scan) newer(attr *Fattr) bool {
+	return attr.ChangeTime().After(s.cutoff) || attr.ModTime().After(s.cutoff)
+}
@@ -0,0 +1,88 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChangedSince(t *testing.T) {
+	v := loopbackTarget(t)
+	defer v.Close()
+
+	for _, dir := range []string{"/old", "/old/deep", "/new"} {
+		if _, err := v.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("mkdir: %s", err)
+		}
+	}
+	writeFile(t, v, "/old/deep/kept", "x")
+	writeFile(t, v, "/old/deep/rewritten", "x")
+
+	time.Sleep(10 * time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	writeFile(t, v, "/new/file", "y")
+	writeFile(t, v, "/old/deep/rewritten", "z")
+
+	changed, err := v.ChangedSince("/", cutoff)
+	if err != nil {
+		t.Fatalf("changed since: %s", err)
+	}
+	want := []string{"/new", "/new/file", "/old/deep/rewritten"}
+	if !reflect.DeepEqual(changed, want) {
+		t.Fatalf("expected %v, got %v", want, changed)
+	}
+
+	// the file rewritten in place is missed once its directory is pruned
+	changed, err = v.ChangedSinceWithOptions("/", cutoff, ScanOptions{Workers: 2, PruneDirs: true})
+	if err != nil {
+		t.Fatalf("changed since: %s", err)
+	}
+	want = []string{"/new", "/new/file"}
+	if !reflect.DeepEqual(changed, want) {
+		t.Fatalf("expected %v, got %v", want, changed)
+	}
+}
+
+func TestLargeDirs(t *testing.T) {
+	v := loopbackTarget(t)
+	defer v.Close()
+
+	for _, dir := range []string{"/big", "/bigger", "/small"} {
+		if _, err := v.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("mkdir: %s", err)
+		}
+	}
+	for i := 0; i < 40; i++ {
+		writeFile(t, v, fmt.Sprintf("/bigger/%d", i), "x")
+		if i < 30 {
+			writeFile(t, v, fmt.Sprintf("/big/%d", i), "x")
+		}
+	}
+	writeFile(t, v, "/small/file", "x")
+
+	// the large directories move to the dedicated worker halfway through
+	// their listings
+	opts := ScanOptions{Workers: 1, LargeDirEntries: 20, LargeDirWorkers: 1}
+	large, err := v.LargeDirs("/", opts)
+	if err != nil {
+		t.Fatalf("large dirs: %s", err)
+	}
+	want := []LargeDir{{"/bigger", 40}, {"/big", 30}}
+	if !reflect.DeepEqual(large, want) {
+		t.Fatalf("expected %v, got %v", want, large)
+	}
+
+	changed, err := v.ChangedSinceWithOptions("/", time.Time{}, opts)
+	if err != nil {
+		t.Fatalf("changed since: %s", err)
+	}
+	if len(changed) != 3+30+40+1 {
+		t.Fatalf("changed since: %d entries", len(changed))
+	}
+}
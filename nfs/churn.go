@@ -0,0 +1,221 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	_path "path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileSample is what a TreeSample keeps of a regular file
+type FileSample struct {
+	Size  uint64    `json:"size"`
+	Mtime time.Time `json:"mtime"`
+}
+
+// TreeSample is the size and modification time of every regular file of a
+// tree at a point in time, by path relative to the tree, to be compared with
+// a later one by EstimateChurn
+type TreeSample struct {
+	Taken time.Time             `json:"taken"`
+	Files map[string]FileSample `json:"files"`
+}
+
+// SampleTree walks tree and returns a sample of it taken now.  For a
+// snapshot, set Taken to when the snapshot was taken.
+func SampleTree(tree *TreeRef) (*TreeSample, error) {
+	s := &TreeSample{Taken: time.Now(), Files: make(map[string]FileSample)}
+
+	_, fh, err := tree.Target.Lookup(tree.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.sampleDir(tree.Target, fh, "/"); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *TreeSample) sampleDir(v *Target, fh []byte, dir string) error {
+	entries, err := listDiffEntries(v, fh)
+	if err != nil {
+		return err
+	}
+
+	for name, e := range entries {
+		p := _path.Join(dir, name)
+		switch e.attr.Type {
+		case NF3Dir:
+			if err = s.sampleDir(v, e.fh, p); err != nil {
+				return err
+			}
+		case NF3Reg:
+			s.Files[p] = FileSample{Size: e.attr.Filesize, Mtime: e.attr.ModTime()}
+		}
+	}
+
+	return nil
+}
+
+// LoadTreeSample reads a sample written by Save
+func LoadTreeSample(r io.Reader) (*TreeSample, error) {
+	s := new(TreeSample)
+	if err := json.NewDecoder(r).Decode(s); err != nil {
+		return nil, err
+	}
+	if s.Files == nil {
+		s.Files = make(map[string]FileSample)
+	}
+
+	return s, nil
+}
+
+// Save writes s to w as JSON, to be compared with a sample taken later
+func (s *TreeSample) Save(w io.Writer) error {
+	return json.NewEncoder(w).Encode(s)
+}
+
+// ChurnOptions tune EstimateChurn
+type ChurnOptions struct {
+	// Depth is how many levels of directories the report is broken down
+	// into, 1 by default
+	Depth int
+}
+
+// ChurnStats is the change of a subtree between two samples, and the daily
+// rates it gives
+type ChurnStats struct {
+	Path string `json:"path"`
+
+	// Files and Bytes are what the subtree holds in the later sample
+	Files int    `json:"files"`
+	Bytes uint64 `json:"bytes"`
+
+	NewFiles      int `json:"new_files"`
+	ModifiedFiles int `json:"modified_files"`
+	RemovedFiles  int `json:"removed_files"`
+
+	// ChangedBytes is the size of the new and modified files, what an
+	// incremental backup copies, and GrowthBytes how much the subtree
+	// grew, negative if it shrank
+	ChangedBytes uint64 `json:"changed_bytes"`
+	GrowthBytes  int64  `json:"growth_bytes"`
+
+	// DailyFiles and DailyBytes are the new and modified files, and their
+	// size, per day
+	DailyFiles float64 `json:"daily_files"`
+	DailyBytes float64 `json:"daily_bytes"`
+}
+
+// ChurnReport is the outcome of EstimateChurn
+type ChurnReport struct {
+	From  time.Time `json:"from"`
+	To    time.Time `json:"to"`
+	Days  float64   `json:"days"`
+	Depth int       `json:"depth"`
+
+	Total    ChurnStats    `json:"total"`
+	Subtrees []*ChurnStats `json:"subtrees"`
+}
+
+// WriteJSON writes the report to w as indented JSON
+func (r *ChurnReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// EstimateChurn compares two samples of a tree, or of two snapshots of it,
+// and estimates the daily churn in files and bytes of the tree and of its
+// subtrees down to Depth, sorted by path, for capacity planning of backups.
+// A file is modified if its size or modification time changed; files
+// modified more than once between the samples count once, so rates are a
+// lower bound, closer to what daily incremental backups copy the closer the
+// samples are to a day apart.
+func EstimateChurn(before, after *TreeSample, opts ChurnOptions) (*ChurnReport, error) {
+	if !after.Taken.After(before.Taken) {
+		return nil, fmt.Errorf("churn: sample of %s is not later than sample of %s", after.Taken, before.Taken)
+	}
+	if opts.Depth <= 0 {
+		opts.Depth = 1
+	}
+
+	r := &ChurnReport{
+		From:  before.Taken,
+		To:    after.Taken,
+		Days:  after.Taken.Sub(before.Taken).Hours() / 24,
+		Depth: opts.Depth,
+		Total: ChurnStats{Path: "/"},
+	}
+
+	subtrees := make(map[string]*ChurnStats)
+	stats := func(p string) []*ChurnStats {
+		dir := subtreeOf(p, opts.Depth)
+		st, ok := subtrees[dir]
+		if !ok {
+			st = &ChurnStats{Path: dir}
+			subtrees[dir] = st
+		}
+		return []*ChurnStats{&r.Total, st}
+	}
+
+	for p, f := range after.Files {
+		old, existed := before.Files[p]
+		for _, st := range stats(p) {
+			st.Files++
+			st.Bytes += f.Size
+			st.GrowthBytes += int64(f.Size) - int64(old.Size)
+			switch {
+			case !existed:
+				st.NewFiles++
+				st.ChangedBytes += f.Size
+			case f.Size != old.Size || !f.Mtime.Equal(old.Mtime):
+				st.ModifiedFiles++
+				st.ChangedBytes += f.Size
+			}
+		}
+	}
+
+	for p, f := range before.Files {
+		if _, ok := after.Files[p]; ok {
+			continue
+		}
+		for _, st := range stats(p) {
+			st.RemovedFiles++
+			st.GrowthBytes -= int64(f.Size)
+		}
+	}
+
+	r.Subtrees = make([]*ChurnStats, 0, len(subtrees))
+	for _, st := range subtrees {
+		r.Subtrees = append(r.Subtrees, st)
+	}
+	sort.Slice(r.Subtrees, func(i, j int) bool { return r.Subtrees[i].Path < r.Subtrees[j].Path })
+
+	for _, st := range append(r.Subtrees, &r.Total) {
+		st.DailyFiles = float64(st.NewFiles+st.ModifiedFiles) / r.Days
+		st.DailyBytes = float64(st.ChangedBytes) / r.Days
+	}
+
+	return r, nil
+}
+
+// subtreeOf returns the directory of file p, cut depth levels below the root
+func subtreeOf(p string, depth int) string {
+	parts := strings.Split(strings.TrimPrefix(_path.Dir(p), "/"), "/")
+	if parts[0] == "" {
+		return "/"
+	}
+	if len(parts) > depth {
+		parts = parts[:depth]
+	}
+
+	return "/" + strings.Join(parts, "/")
+}
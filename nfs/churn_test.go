@@ -0,0 +1,79 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestEstimateChurn(t *testing.T) {
+	v := loopbackTarget(t)
+	for _, dir := range []string{"/home", "/home/alice", "/srv"} {
+		if _, err := v.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, v, "/home/alice/a", "aaaa")
+	writeFile(t, v, "/home/alice/b", "bb")
+	writeFile(t, v, "/srv/c", "cccccc")
+	writeFile(t, v, "/top", "t")
+
+	tree := &TreeRef{Target: v, Path: "/"}
+	before, err := SampleTree(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// round trip, as between two runs
+	var buf bytes.Buffer
+	if err = before.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if before, err = LoadTreeSample(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, v, "/home/alice/a", "aaaaaaaa")
+	writeFile(t, v, "/home/alice/new", "nnnn")
+	if err = v.Remove("/srv/c"); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := SampleTree(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after.Taken = before.Taken.Add(48 * time.Hour)
+
+	r, err := EstimateChurn(before, after, ChurnOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Days != 2 || r.Total.Files != 4 || r.Total.NewFiles != 1 || r.Total.ModifiedFiles != 1 || r.Total.RemovedFiles != 1 {
+		t.Fatalf("total: %+v over %v days", r.Total, r.Days)
+	}
+	if r.Total.ChangedBytes != 12 || r.Total.GrowthBytes != 2 || r.Total.DailyBytes != 6 || r.Total.DailyFiles != 1 {
+		t.Fatalf("total bytes: %+v", r.Total)
+	}
+
+	if len(r.Subtrees) != 3 {
+		t.Fatalf("subtrees: %+v", r.Subtrees)
+	}
+	for i, want := range []ChurnStats{
+		{Path: "/", Files: 1, Bytes: 1},
+		{Path: "/home", Files: 3, Bytes: 14, NewFiles: 1, ModifiedFiles: 1, ChangedBytes: 12, GrowthBytes: 8, DailyFiles: 1, DailyBytes: 6},
+		{Path: "/srv", RemovedFiles: 1, GrowthBytes: -6},
+	} {
+		if *r.Subtrees[i] != want {
+			t.Errorf("subtree %d: %+v, want %+v", i, *r.Subtrees[i], want)
+		}
+	}
+
+	if _, err = EstimateChurn(after, before, ChurnOptions{}); err == nil {
+		t.Fatal("estimated churn backwards in time")
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// ErrClosed is returned by calls on a Target that is closed or closing
+var ErrClosed = errors.New("nfs: target closed")
+
+// DefaultCloseTimeout bounds how long Close waits for calls in flight
+const DefaultCloseTimeout = 30 * time.Second
+
+// SetCloseTimeout sets how long Close waits for calls in flight before
+// closing the connections under them
+func (v *Target) SetCloseTimeout(d time.Duration) {
+	v.callMu.Lock()
+	defer v.callMu.Unlock()
+
+	v.closeTimeout = d
+}
+
+// begin registers a call in flight, unless the target is closed
+func (v *Target) begin() error {
+	v.callMu.Lock()
+	defer v.callMu.Unlock()
+
+	if v.closed {
+		return ErrClosed
+	}
+
+	v.inflight++
+	return nil
+}
+
+func (v *Target) end() {
+	v.callMu.Lock()
+	defer v.callMu.Unlock()
+
+	v.inflight--
+	if v.inflight == 0 && v.drained != nil {
+		close(v.drained)
+		v.drained = nil
+	}
+}
+
+// Close shuts the target down: the files left open with data written behind
+// are committed (see SetWriteBehind), new calls fail with ErrClosed, calls in
+// flight are waited for up to the close timeout, files left open are logged
+// as leaked (see OpenHandles), the export is unmounted if the target came
+// from Mount and was not unmounted already, and the connections are closed.
+// A commit failing, the data may be lost, and its error is returned unless
+// closing the connections fails.  Closing a closed target returns ErrClosed.
+func (v *Target) Close() error {
+	v.callMu.Lock()
+	closed := v.closed
+	v.callMu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	// committed while calls are still taken
+	flushErr := v.flush()
+
+	v.callMu.Lock()
+	if v.closed {
+		v.callMu.Unlock()
+		return ErrClosed
+	}
+	v.closed = true
+
+	var drained chan struct{}
+	if v.inflight > 0 {
+		drained = make(chan struct{})
+		v.drained = drained
+	}
+	timeout := v.closeTimeout
+	v.callMu.Unlock()
+
+	if drained != nil {
+		t := time.NewTimer(timeout)
+		select {
+		case <-drained:
+			t.Stop()
+		case <-t.C:
+			util.Errorf("close(%s): calls still in flight after %s", v.dirPath, timeout)
+		}
+	}
+
+	v.reportLeaks()
+
+	// the mount connection may well be closed already, in which case there
+	// is nothing to tell the server
+	if m := v.mount; m != nil && m.dirPath == v.dirPath {
+		if err := m.Unmount(); err != nil {
+			util.Debugf("close(%s): umnt: %s", v.dirPath, err)
+		}
+	}
+
+	if err := v.closeConns(); err != nil {
+		return err
+	}
+	return flushErr
+}
+
+// ForceClose closes the connections of the target right away, failing the
+// calls in flight, and without unmounting
+func (v *Target) ForceClose() error {
+	v.callMu.Lock()
+	v.closed = true
+	v.callMu.Unlock()
+
+	return v.closeConns()
+}
+
+// closeConns closes all connections of the target
+func (v *Target) closeConns() error {
+	err := v.Client.Close()
+
+	v.connsMu.Lock()
+	conns := v.conns
+	v.conns = nil
+	v.connsMu.Unlock()
+	for _, c := range conns {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	v.closeHedger()
+
+	v.nlmMu.Lock()
+	if v.nlm != nil {
+		if cerr := v.nlm.Close(); err == nil {
+			err = cerr
+		}
+		v.nlm = nil
+	}
+	v.nlmMu.Unlock()
+
+	return err
+}
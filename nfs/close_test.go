@@ -0,0 +1,127 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+// gatedFS holds GETATTR calls at gate while armed
+type gatedFS struct {
+	*MemFS
+	armed   int32
+	entered chan struct{}
+	gate    chan struct{}
+}
+
+func (fs *gatedFS) GetAttr(fh []byte) (*Fattr, error) {
+	if atomic.LoadInt32(&fs.armed) != 0 {
+		fs.entered <- struct{}{}
+		<-fs.gate
+	}
+	return fs.MemFS.GetAttr(fh)
+}
+
+func TestTargetCloseDrains(t *testing.T) {
+	fs := &gatedFS{MemFS: NewMemFS(), entered: make(chan struct{}), gate: make(chan struct{})}
+	v, err := DialLoopback(NewServer(fs)).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+
+	atomic.StoreInt32(&fs.armed, 1)
+	callErr := make(chan error)
+	go func() {
+		_, err := v.GetAttrByFh(v.fh)
+		callErr <- err
+	}()
+	<-fs.entered
+	atomic.StoreInt32(&fs.armed, 0)
+
+	closed := make(chan error)
+	go func() { closed <- v.Close() }()
+
+	select {
+	case err = <-closed:
+		t.Fatalf("close returned with a call in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err = v.GetAttrByFh(v.fh); err != ErrClosed {
+		t.Fatalf("expected a new call on a closing target to fail, got %v", err)
+	}
+
+	close(fs.gate)
+	if err = <-callErr; err != nil {
+		t.Fatalf("call in flight failed: %s", err)
+	}
+	if err = <-closed; err != nil {
+		t.Fatalf("close: %s", err)
+	}
+	if err = v.Close(); err != ErrClosed {
+		t.Fatalf("expected closing twice to fail, got %v", err)
+	}
+}
+
+func TestTargetCloseTimeout(t *testing.T) {
+	fs := &gatedFS{MemFS: NewMemFS(), entered: make(chan struct{}), gate: make(chan struct{})}
+	defer close(fs.gate)
+	v, err := DialLoopback(NewServer(fs)).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	v.SetCloseTimeout(10 * time.Millisecond)
+
+	atomic.StoreInt32(&fs.armed, 1)
+	callErr := make(chan error)
+	go func() {
+		_, err := v.GetAttrByFh(v.fh)
+		callErr <- err
+	}()
+	<-fs.entered
+	atomic.StoreInt32(&fs.armed, 0)
+
+	v.Close()
+	if err = <-callErr; err == nil {
+		t.Fatal("expected the stuck call to fail once its connection was closed")
+	}
+}
+
+func TestOpenHandles(t *testing.T) {
+	v := loopbackTarget(t)
+	defer v.Close()
+	v.SetHandleStacks(true)
+
+	f, err := v.OpenFile("/kept", 0644)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	g, err := v.OpenFile("/leaked", 0644)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+
+	stats := v.HandleStats()
+	if stats.Open != 1 || stats.Opened != 2 || stats.Closed != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	open := v.OpenHandles()
+	if len(open) != 1 || open[0].Path != "/leaked" || !strings.Contains(open[0].Stack, "TestOpenHandles") {
+		t.Fatalf("unexpected open handles %+v", open)
+	}
+
+	g.Close()
+	if stats = v.HandleStats(); stats.Open != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
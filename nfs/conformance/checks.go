@@ -0,0 +1,361 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package conformance
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/go-nfs/nfsv3/nfs"
+	"github.com/go-nfs/nfsv3/nfs/rawnfs"
+)
+
+// handle returns the handle of name made in dir, from res or, servers being
+// free to leave it out, looked up
+func handle(c *rawnfs.Client, dir []byte, name string, res *rawnfs.DiropRes3) ([]byte, error) {
+	if res.Object.IsSet {
+		return res.Object.FH, nil
+	}
+	lres, err := c.Lookup(&rawnfs.Lookup3Args{What: nfs.Diropargs3{FH: dir, Filename: name}})
+	if err != nil {
+		return nil, fmt.Errorf("lookup %s: %w", name, err)
+	}
+	return lres.Object, nil
+}
+
+// create makes a file name in dir holding data
+func create(c *rawnfs.Client, dir []byte, name string, data string) ([]byte, error) {
+	res, err := c.Create(&rawnfs.Create3Args{
+		Where: nfs.Diropargs3{FH: dir, Filename: name},
+		How:   rawnfs.CreateHow3{Mode: rawnfs.Unchecked, Attr: nfs.Sattr3{Mode: nfs.SetMode{SetIt: true, Mode: 0644}}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create %s: %w", name, err)
+	}
+	fh, err := handle(c, dir, name, res)
+	if err != nil || data == "" {
+		return fh, err
+	}
+
+	_, err = c.Write(&rawnfs.Write3Args{File: fh, Count: uint32(len(data)), Stable: rawnfs.FileSync, Data: []byte(data)})
+	if err != nil {
+		return nil, fmt.Errorf("write %s: %w", name, err)
+	}
+	return fh, nil
+}
+
+// mkdir makes a directory name in dir
+func mkdir(c *rawnfs.Client, dir []byte, name string) ([]byte, error) {
+	res, err := c.Mkdir(&rawnfs.Mkdir3Args{
+		Where: nfs.Diropargs3{FH: dir, Filename: name},
+		Attr:  nfs.Sattr3{Mode: nfs.SetMode{SetIt: true, Mode: 0755}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("mkdir %s: %w", name, err)
+	}
+	return handle(c, dir, name, res)
+}
+
+// read returns the content of name in dir
+func read(c *rawnfs.Client, dir []byte, name string) (string, error) {
+	lres, err := c.Lookup(&rawnfs.Lookup3Args{What: nfs.Diropargs3{FH: dir, Filename: name}})
+	if err != nil {
+		return "", fmt.Errorf("lookup %s: %w", name, err)
+	}
+	res, err := c.Read(&rawnfs.Read3Args{File: lres.Object, Count: 4096})
+	if err != nil {
+		return "", fmt.Errorf("read %s: %w", name, err)
+	}
+	return string(res.Data), nil
+}
+
+// checkCookies pages through a directory of many entries with small READDIR
+// replies, then resumes from a cookie of the middle as a client would after
+// evicting its cache
+func checkCookies(c *rawnfs.Client, dir []byte) error {
+	const n = 200
+	for i := 0; i < n; i++ {
+		if _, err := create(c, dir, fmt.Sprintf("entry-%03d", i), ""); err != nil {
+			return err
+		}
+	}
+
+	type page struct {
+		cookie uint64
+		names  []string
+	}
+	var pages []page
+	seen := make(map[string]bool)
+	var cookie, verf uint64
+	for {
+		res, err := c.ReadDir(&rawnfs.ReadDir3Args{Dir: dir, Cookie: cookie, CookieVerf: verf, Count: 1024})
+		if err != nil {
+			return fmt.Errorf("readdir from cookie %d: %w", cookie, err)
+		}
+		if len(res.Entries) == 0 && !res.EOF {
+			return fmt.Errorf("readdir from cookie %d: no entries, and not at the end", cookie)
+		}
+
+		p := page{cookie: cookie}
+		for _, e := range res.Entries {
+			if e.FileName == "." || e.FileName == ".." {
+				continue
+			}
+			if seen[e.FileName] {
+				return fmt.Errorf("readdir from cookie %d: %s listed twice", cookie, e.FileName)
+			}
+			seen[e.FileName] = true
+			p.names = append(p.names, e.FileName)
+		}
+		pages = append(pages, p)
+		if len(res.Entries) > 0 {
+			cookie = res.Entries[len(res.Entries)-1].Cookie
+		}
+		verf = res.CookieVerf
+		if res.EOF {
+			break
+		}
+	}
+
+	if len(seen) != n {
+		return fmt.Errorf("readdir listed %d entries of %d", len(seen), n)
+	}
+	if len(pages) < 3 {
+		return skipped(fmt.Sprintf("readdir listed %d entries in %d replies, too few to resume", n, len(pages)))
+	}
+
+	// the names past the cookie of a page are those of it and the pages after
+	mid := len(pages) / 2
+	var want []string
+	for _, p := range pages[mid:] {
+		want = append(want, p.names...)
+	}
+	var got []string
+	cookie = pages[mid].cookie
+	for {
+		res, err := c.ReadDir(&rawnfs.ReadDir3Args{Dir: dir, Cookie: cookie, CookieVerf: verf, Count: 8192})
+		if err != nil {
+			return fmt.Errorf("readdir resumed from cookie %d: %w", cookie, err)
+		}
+		for _, e := range res.Entries {
+			if e.FileName != "." && e.FileName != ".." {
+				got = append(got, e.FileName)
+			}
+			cookie = e.Cookie
+		}
+		if res.EOF || len(res.Entries) == 0 {
+			break
+		}
+	}
+	if strings.Join(got, "/") != strings.Join(want, "/") {
+		return fmt.Errorf("readdir resumed from cookie %d listed %d entries, %d were past it", pages[mid].cookie, len(got), len(want))
+	}
+
+	return nil
+}
+
+// checkExclusiveCreate retransmits an exclusive CREATE, as a client does
+// once the reply is lost, then sends one of another verifier
+func checkExclusiveCreate(c *rawnfs.Client, dir []byte) error {
+	const verf = 0x0123456789abcdef
+	excl := func(verf uint64) (*rawnfs.DiropRes3, error) {
+		return c.Create(&rawnfs.Create3Args{
+			Where: nfs.Diropargs3{FH: dir, Filename: "file"},
+			How:   rawnfs.CreateHow3{Mode: rawnfs.Exclusive, Verf: verf},
+		})
+	}
+
+	res, err := excl(verf)
+	if err != nil {
+		return fmt.Errorf("exclusive create: %w", err)
+	}
+	fh, err := handle(c, dir, "file", res)
+	if err != nil {
+		return err
+	}
+
+	if res, err = excl(verf); err != nil {
+		return fmt.Errorf("exclusive create retransmitted: %w", err)
+	}
+	again, err := handle(c, dir, "file", res)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(fh, again) {
+		return fmt.Errorf("exclusive create retransmitted returned another handle")
+	}
+
+	if _, err = excl(verf + 1); !isStatus(err, nfs.NFS3ErrExist) {
+		return fmt.Errorf("exclusive create of another verifier: %v, want NFS3ERR_EXIST", err)
+	}
+
+	return nil
+}
+
+// checkRenameOver renames over a file, an empty directory and a directory
+// holding an entry, RFC 1813 section 3.3.14
+func checkRenameOver(c *rawnfs.Client, dir []byte) error {
+	rename := func(from, to string) error {
+		_, err := c.Rename(&rawnfs.Rename3Args{
+			From: nfs.Diropargs3{FH: dir, Filename: from},
+			To:   nfs.Diropargs3{FH: dir, Filename: to},
+		})
+		return err
+	}
+
+	for name, data := range map[string]string{"a": "from", "b": "to"} {
+		if _, err := create(c, dir, name, data); err != nil {
+			return err
+		}
+	}
+	if err := rename("a", "b"); err != nil {
+		return fmt.Errorf("rename over a file: %w", err)
+	}
+	if data, err := read(c, dir, "b"); err != nil {
+		return err
+	} else if data != "from" {
+		return fmt.Errorf("file renamed over reads %q, not that of the file renamed", data)
+	}
+	if _, err := c.Lookup(&rawnfs.Lookup3Args{What: nfs.Diropargs3{FH: dir, Filename: "a"}}); !isStatus(err, nfs.NFS3ErrNoEnt) {
+		return fmt.Errorf("lookup of the file renamed: %v, want NFS3ERR_NOENT", err)
+	}
+
+	for _, name := range []string{"d", "empty", "full"} {
+		if _, err := mkdir(c, dir, name); err != nil {
+			return err
+		}
+	}
+	if err := rename("d", "empty"); err != nil {
+		return fmt.Errorf("rename over an empty directory: %w", err)
+	}
+
+	lres, err := c.Lookup(&rawnfs.Lookup3Args{What: nfs.Diropargs3{FH: dir, Filename: "full"}})
+	if err != nil {
+		return fmt.Errorf("lookup full: %w", err)
+	}
+	if _, err = create(c, lres.Object, "entry", ""); err != nil {
+		return err
+	}
+	if err = rename("empty", "full"); err == nil {
+		return fmt.Errorf("rename over a directory holding an entry succeeded")
+	} else if !nfs.IsNotEmptyError(err) && !isStatus(err, nfs.NFS3ErrExist) {
+		return fmt.Errorf("rename over a directory holding an entry: %v, want NFS3ERR_NOTEMPTY or NFS3ERR_EXIST", err)
+	}
+
+	return nil
+}
+
+// checkLinkSymlink hard links a symlink: the link is another symlink to the
+// same target, it is not resolved to the target
+func checkLinkSymlink(c *rawnfs.Client, dir []byte) error {
+	if _, err := create(c, dir, "target", "data"); err != nil {
+		return err
+	}
+	res, err := c.Symlink(&rawnfs.Symlink3Args{
+		Where: nfs.Diropargs3{FH: dir, Filename: "symlink"},
+		Attr:  nfs.Sattr3{Mode: nfs.SetMode{SetIt: true, Mode: 0777}},
+		Data:  "target",
+	})
+	if isStatus(err, nfs.NFS3ErrNotSupp) {
+		return skipped("symlinks not supported")
+	} else if err != nil {
+		return fmt.Errorf("symlink: %w", err)
+	}
+	symlink, err := handle(c, dir, "symlink", res)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Link(&rawnfs.Link3Args{File: symlink, Link: nfs.Diropargs3{FH: dir, Filename: "link"}})
+	if isStatus(err, nfs.NFS3ErrNotSupp) {
+		return skipped("hard links not supported")
+	} else if err != nil {
+		return fmt.Errorf("link of a symlink: %w", err)
+	}
+
+	lres, err := c.Lookup(&rawnfs.Lookup3Args{What: nfs.Diropargs3{FH: dir, Filename: "link"}})
+	if err != nil {
+		return fmt.Errorf("lookup link: %w", err)
+	}
+	ares, err := c.GetAttr(&rawnfs.GetAttr3Args{Object: lres.Object})
+	if err != nil {
+		return fmt.Errorf("getattr link: %w", err)
+	}
+	if ares.Attr.Type != nfs.NF3Lnk {
+		return fmt.Errorf("link of a symlink is of type %d, not a symlink", ares.Attr.Type)
+	}
+	rres, err := c.Readlink(&rawnfs.Readlink3Args{Symlink: lres.Object})
+	if err != nil {
+		return fmt.Errorf("readlink link: %w", err)
+	}
+	if rres.Data != "target" {
+		return fmt.Errorf("link of a symlink points to %q, not target", rres.Data)
+	}
+
+	return nil
+}
+
+// checkName255 makes files of the longest name RFC 1813 leaves to servers to
+// take, and one a byte longer
+func checkName255(c *rawnfs.Client, dir []byte) error {
+	name := strings.Repeat("n", 255)
+	if _, err := create(c, dir, name, ""); err != nil {
+		return fmt.Errorf("name of 255 bytes: %w", err)
+	}
+	if _, err := c.Lookup(&rawnfs.Lookup3Args{What: nfs.Diropargs3{FH: dir, Filename: name}}); err != nil {
+		return fmt.Errorf("lookup of a name of 255 bytes: %w", err)
+	}
+
+	_, err := create(c, dir, name+"n", "")
+	if err == nil {
+		return fmt.Errorf("name of 256 bytes taken")
+	} else if !nfs.IsNameTooLongError(err) {
+		return fmt.Errorf("name of 256 bytes: %v, want NFS3ERR_NAMETOOLONG", err)
+	}
+
+	return nil
+}
+
+// checkSparseWrite writes a byte a MiB into an empty file
+func checkSparseWrite(c *rawnfs.Client, dir []byte) error {
+	const off = 1 << 20
+	fh, err := create(c, dir, "sparse", "")
+	if err != nil {
+		return err
+	}
+	if _, err = c.Write(&rawnfs.Write3Args{File: fh, Offset: off, Count: 1, Stable: rawnfs.FileSync, Data: []byte{'x'}}); err != nil {
+		return fmt.Errorf("write past the end: %w", err)
+	}
+
+	ares, err := c.GetAttr(&rawnfs.GetAttr3Args{Object: fh})
+	if err != nil {
+		return fmt.Errorf("getattr: %w", err)
+	}
+	if ares.Attr.Filesize != off+1 {
+		return fmt.Errorf("size %d after a write at %d", ares.Attr.Filesize, off)
+	}
+
+	for _, at := range []uint64{0, off / 2, off - 4096} {
+		res, err := c.Read(&rawnfs.Read3Args{File: fh, Offset: at, Count: 4096})
+		if err != nil {
+			return fmt.Errorf("read of the hole at %d: %w", at, err)
+		}
+		if len(res.Data) == 0 {
+			return fmt.Errorf("read of the hole at %d returned no data", at)
+		}
+		if i := bytes.IndexFunc(res.Data, func(r rune) bool { return r != 0 }); i >= 0 {
+			return fmt.Errorf("hole reads %#x at %d", res.Data[i], at+uint64(i))
+		}
+	}
+	res, err := c.Read(&rawnfs.Read3Args{File: fh, Offset: off, Count: 4096})
+	if err != nil {
+		return fmt.Errorf("read at %d: %w", off, err)
+	}
+	if string(res.Data) != "x" || !res.EOF {
+		return fmt.Errorf("read at %d: %q, eof %v", off, res.Data, res.EOF)
+	}
+
+	return nil
+}
@@ -0,0 +1,227 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+// Package conformance runs a battery of checks of protocol behaviour that
+// clients rely on and servers get wrong, to qualify a new filer, and reports
+// how it fared.  Unlike nfstest it needs no testing.T, and goes straight to
+// the procedures with rawnfs, so that what is checked is the server, not the
+// caches and retries of a Target.
+//
+//	c := rawnfs.NewClient(client, rpc.AuthNull)
+//	report, err := conformance.Run(c, scratch)
+//	report.WriteText(os.Stdout)
+package conformance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs"
+	"github.com/go-nfs/nfsv3/nfs/rawnfs"
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// Outcome is how a server fared in a check
+type Outcome string
+
+const (
+	Pass Outcome = "pass"
+	Fail Outcome = "fail"
+
+	// Skip is a check of a feature the server does not offer, as hard
+	// links when it answers LINK with NFS3ERR_NOTSUPP
+	Skip Outcome = "skip"
+)
+
+// Check is a behaviour checked, in a directory of its own
+type Check struct {
+	Name        string
+	Description string
+
+	run func(c *rawnfs.Client, dir []byte) error
+}
+
+// Checks are the checks Run runs, in order
+var Checks = []Check{
+	{"readdir-cookies", "READDIR pages cover every entry once, and resume from any cookie", checkCookies},
+	{"exclusive-create", "a retransmitted exclusive CREATE succeeds, one of another verifier fails", checkExclusiveCreate},
+	{"rename-over-existing", "RENAME replaces files and empty directories, not directories holding entries", checkRenameOver},
+	{"hardlink-symlink", "LINK of a symlink makes another name of the symlink, not of its target", checkLinkSymlink},
+	{"name-255", "names of 255 bytes are taken, longer ones refused with NFS3ERR_NAMETOOLONG", checkName255},
+	{"sparse-write", "a WRITE past the end of a file extends it, reading zeros in the hole", checkSparseWrite},
+}
+
+// Result is the outcome of a check
+type Result struct {
+	Check   string        `json:"check"`
+	Outcome Outcome       `json:"outcome"`
+	Detail  string        `json:"detail,omitempty"`
+	Elapsed time.Duration `json:"elapsed"`
+}
+
+// Report is the outcome of a run
+type Report struct {
+	Results []Result `json:"results"`
+}
+
+// Passed tells whether no check failed, skipped ones aside
+func (r *Report) Passed() bool {
+	for _, res := range r.Results {
+		if res.Outcome == Fail {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteJSON writes the report as indented JSON
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteText writes the report as a table, a check a line
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, res := range r.Results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", res.Check, res.Outcome, res.Detail)
+	}
+	return tw.Flush()
+}
+
+// skipped is the error of a check skipped
+type skipped string
+
+func (s skipped) Error() string {
+	return string(s)
+}
+
+// Run runs the checks named, all of them if there are none, each in a
+// directory of its own made in directory dir and removed after it.  The
+// report tells how each fared, the run fails only for names of no check or
+// if the directory of a check cannot be made.
+func Run(c *rawnfs.Client, dir []byte, names ...string) (*Report, error) {
+	checks := Checks
+	if len(names) > 0 {
+		checks = nil
+		for _, name := range names {
+			found := false
+			for _, check := range Checks {
+				if check.Name == name {
+					checks, found = append(checks, check), true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("conformance: no check %q", name)
+			}
+		}
+	}
+
+	report := new(Report)
+	for _, check := range checks {
+		res, err := c.Mkdir(&rawnfs.Mkdir3Args{
+			Where: nfs.Diropargs3{FH: dir, Filename: check.Name},
+			Attr:  nfs.Sattr3{Mode: nfs.SetMode{SetIt: true, Mode: 0755}},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("conformance: %s: %w", check.Name, err)
+		}
+
+		start := time.Now()
+		err = check.run(c, res.Object.FH)
+		result := Result{Check: check.Name, Outcome: Pass, Elapsed: time.Since(start)}
+		var skip skipped
+		switch {
+		case errors.As(err, &skip):
+			result.Outcome, result.Detail = Skip, err.Error()
+		case err != nil:
+			result.Outcome, result.Detail = Fail, err.Error()
+		}
+		util.Debugf("conformance: %s: %s %s", check.Name, result.Outcome, result.Detail)
+		report.Results = append(report.Results, result)
+
+		if err = removeAll(c, dir, check.Name); err != nil {
+			util.Errorf("conformance: removing %s: %s", check.Name, err)
+		}
+	}
+
+	return report, nil
+}
+
+// removeAll removes name from directory dir, and all below it
+func removeAll(c *rawnfs.Client, dir []byte, name string) error {
+	err := remove(c, dir, name)
+	if !nfs.IsNotEmptyError(err) && !isStatus(err, nfs.NFS3ErrIsDir) && !isStatus(err, nfs.NFS3ErrExist) {
+		return err
+	}
+
+	res, err := c.Lookup(&rawnfs.Lookup3Args{What: nfs.Diropargs3{FH: dir, Filename: name}})
+	if err != nil {
+		return err
+	}
+	names, err := list(c, res.Object)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if err = removeAll(c, res.Object, n); err != nil {
+			return err
+		}
+	}
+
+	_, err = c.Rmdir(&rawnfs.Remove3Args{Object: nfs.Diropargs3{FH: dir, Filename: name}})
+	return err
+}
+
+// remove removes name, a file or an empty directory, from dir
+func remove(c *rawnfs.Client, dir []byte, name string) error {
+	_, err := c.Remove(&rawnfs.Remove3Args{Object: nfs.Diropargs3{FH: dir, Filename: name}})
+	if isStatus(err, nfs.NFS3ErrIsDir) || isStatus(err, nfs.NFS3ErrPerm) || isStatus(err, nfs.NFS3ErrAcces) {
+		_, err = c.Rmdir(&rawnfs.Remove3Args{Object: nfs.Diropargs3{FH: dir, Filename: name}})
+	}
+	return err
+}
+
+// list returns the names in dir, without . and ..
+func list(c *rawnfs.Client, dir []byte) ([]string, error) {
+	var names []string
+	var cookie, verf uint64
+	for {
+		res, err := c.ReadDir(&rawnfs.ReadDir3Args{Dir: dir, Cookie: cookie, CookieVerf: verf, Count: 8192})
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range res.Entries {
+			if e.FileName != "." && e.FileName != ".." {
+				names = append(names, e.FileName)
+			}
+			cookie = e.Cookie
+		}
+		if res.EOF || len(res.Entries) == 0 {
+			return names, nil
+		}
+		verf = res.CookieVerf
+	}
+}
+
+// isStatus tells whether err is an NFS error of status, those NFS3Error
+// maps to os errors included
+func isStatus(err error, status uint32) bool {
+	switch status {
+	case nfs.NFS3ErrPerm:
+		return errors.Is(err, os.ErrPermission)
+	case nfs.NFS3ErrExist:
+		return errors.Is(err, os.ErrExist)
+	case nfs.NFS3ErrNoEnt:
+		return errors.Is(err, os.ErrNotExist)
+	}
+
+	var nfsErr *nfs.Error
+	return errors.As(err, &nfsErr) && nfsErr.ErrorNum == status
+}
@@ -0,0 +1,57 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package conformance
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs"
+	"github.com/go-nfs/nfsv3/nfs/rawnfs"
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+func TestRun(t *testing.T) {
+	s := nfs.NewServer(nfs.NewMemFS())
+	v, err := nfs.DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	_, root, err := v.Lookup("/")
+	if err != nil {
+		t.Fatalf("lookup root: %s", err)
+	}
+
+	c := rawnfs.NewClient(s.Pipe(), rpc.AuthNull)
+	defer c.Close()
+
+	report, err := Run(c, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Results) != len(Checks) {
+		t.Errorf("%d results of %d checks", len(report.Results), len(Checks))
+	}
+	for _, res := range report.Results {
+		if res.Outcome == Fail {
+			t.Errorf("%s: %s", res.Check, res.Detail)
+		}
+	}
+
+	// the directories of the checks are gone
+	if names, err := list(c, root); err != nil || len(names) != 0 {
+		t.Errorf("left %v, %v", names, err)
+	}
+
+	var text bytes.Buffer
+	if err = report.WriteText(&text); err != nil || !bytes.Contains(text.Bytes(), []byte("sparse-write")) {
+		t.Errorf("text report %q, %v", text.String(), err)
+	}
+
+	if _, err = Run(c, root, "no-such-check"); err == nil {
+		t.Error("run of no check succeeded")
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	_path "path"
+	"sync"
+	"time"
+)
+
+// ErrViewExpired is returned by a ConsistentView used past its bound
+var ErrViewExpired = errors.New("consistent view expired")
+
+// ChangedError is returned when an object changed while it was being read:
+// its ctime moved, or the cookie verifier of a directory did
+type ChangedError struct {
+	// Path is the path of the object, when known
+	Path string
+	FH   []byte
+
+	// What changed, "ctime" or "cookieverf", and its values before and
+	// after
+	What     string
+	Old, New interface{}
+}
+
+func (e *ChangedError) Error() string {
+	name := e.Path
+	if name == "" {
+		name = fmt.Sprintf("%x", e.FH)
+	}
+
+	return fmt.Sprintf("%s changed while being read: %s %v, was %v", name, e.What, e.New, e.Old)
+}
+
+// IsChangedError reports whether err is a *ChangedError
+func IsChangedError(err error) bool {
+	var changed *ChangedError
+	return errors.As(err, &changed)
+}
+
+// ConsistentView is a read-only view of a target that notices objects
+// changing while they are read, for backups that must not copy a file
+// modified halfway through.  The ctime of every object and the cookie
+// verifier of every directory are recorded the first time the view sees
+// them, and any later call that sees another value fails with a
+// *ChangedError.  What the view has not looked at yet may still change.
+//
+// The guarantee only holds for as long as the traversal takes, and it may
+// be given a bound past which calls fail with ErrViewExpired, so that a
+// job that ran too long does not mistake an old view for a point-in-time
+// one.
+type ConsistentView struct {
+	v       *Target
+	started time.Time
+	bound   time.Duration
+
+	sync.Mutex
+	ctimes map[string]NFS3Time
+	verfs  map[string]uint64
+}
+
+// NewConsistentView returns a view of v valid for bound, zero for no bound
+func NewConsistentView(v *Target, bound time.Duration) *ConsistentView {
+	return &ConsistentView{
+		v:       v,
+		started: time.Now(),
+		bound:   bound,
+		ctimes:  make(map[string]NFS3Time),
+		verfs:   make(map[string]uint64),
+	}
+}
+
+func (cv *ConsistentView) expired() error {
+	if cv.bound > 0 && time.Since(cv.started) > cv.bound {
+		return ErrViewExpired
+	}
+
+	return nil
+}
+
+// see checks the ctime of fh against the one first seen
+func (cv *ConsistentView) see(path string, fh []byte, attr *Fattr) error {
+	if attr == nil {
+		return nil
+	}
+
+	cv.Lock()
+	defer cv.Unlock()
+
+	old, ok := cv.ctimes[string(fh)]
+	if !ok {
+		cv.ctimes[string(fh)] = attr.Ctime
+		return nil
+	}
+	if old != attr.Ctime {
+		return &ChangedError{Path: path, FH: fh, What: "ctime", Old: old.Time(), New: attr.ChangeTime()}
+	}
+
+	return nil
+}
+
+// seeVerf checks the cookie verifier of directory fh against the one first
+// seen
+func (cv *ConsistentView) seeVerf(path string, fh []byte, verf uint64) error {
+	cv.Lock()
+	defer cv.Unlock()
+
+	old, ok := cv.verfs[string(fh)]
+	if !ok {
+		cv.verfs[string(fh)] = verf
+		return nil
+	}
+	if old != verf {
+		return &ChangedError{Path: path, FH: fh, What: "cookieverf", Old: old, New: verf}
+	}
+
+	return nil
+}
+
+// Stat returns the attributes of path
+func (cv *ConsistentView) Stat(path string) (*Fattr, error) {
+	attr, _, err := cv.stat(path)
+	return attr, err
+}
+
+func (cv *ConsistentView) stat(path string) (*Fattr, []byte, error) {
+	if err := cv.expired(); err != nil {
+		return nil, nil, err
+	}
+
+	_, fh, err := cv.v.Lookup(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// from the server, the cache would hide changes
+	attr, err := cv.v.getAttr(fh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return attr, fh, cv.see(path, fh, attr)
+}
+
+// ReadDir lists directory path, checking the directory and the entries it
+// lists
+func (cv *ConsistentView) ReadDir(path string) ([]*EntryPlus, error) {
+	if err := cv.expired(); err != nil {
+		return nil, err
+	}
+
+	_, fh, err := cv.v.Lookup(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, verf, dirAttr, err := cv.v.readDirPlus(fh)
+	if err != nil {
+		var changed *ChangedError
+		if errors.As(err, &changed) {
+			changed.Path = path
+		}
+		return nil, err
+	}
+
+	if err = cv.seeVerf(path, fh, verf); err != nil {
+		return nil, err
+	}
+	if err = cv.see(path, fh, dirAttr); err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if e.FileName == "." || e.FileName == ".." || !e.Handle.IsSet {
+			continue
+		}
+		if err = cv.see(_path.Join(path, e.FileName), e.Handle.FH, e.Attr.attr()); err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+// Open opens file path for reading through the view
+func (cv *ConsistentView) Open(path string) (*ConsistentFile, error) {
+	attr, fh, err := cv.stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{Target: cv.v, fsinfo: cv.v.fsinfo, fattr: attr, fh: fh}
+	cv.v.handles.track(f, path)
+
+	return &ConsistentFile{cv: cv, f: f, path: path}, nil
+}
+
+// ConsistentFile is a file read through a ConsistentView.  Every READ
+// checks the ctime the server returns with the data.
+type ConsistentFile struct {
+	cv   *ConsistentView
+	f    *File
+	path string
+	off  uint64
+}
+
+func (cf *ConsistentFile) Read(p []byte) (int, error) {
+	if err := cf.cv.expired(); err != nil {
+		return 0, err
+	}
+
+	f := cf.f
+	size := min(f.fsinfo.RTPref, len32(p))
+	reserved := f.acquire(int(size))
+	n, eof, attr, err := f.readAt(p[:size], cf.off)
+	f.release(reserved)
+	if err != nil {
+		return n, err
+	}
+
+	if attr == nil {
+		// the server left the attributes out, ask for them
+		if attr, err = cf.cv.v.getAttr(f.fh); err != nil {
+			return 0, err
+		}
+	}
+	if err = cf.cv.see(cf.path, f.fh, attr); err != nil {
+		return 0, err
+	}
+
+	cf.off += uint64(n)
+	if eof {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Close releases the file
+func (cf *ConsistentFile) Close() error {
+	cf.f.handles.untrack(cf.f)
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestConsistentView(t *testing.T) {
+	v := loopbackTarget(t)
+	defer v.Close()
+
+	if _, err := v.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	writeFile(t, v, "/dir/file", "0123456789")
+
+	cv := NewConsistentView(v, 0)
+	if _, err := cv.ReadDir("/dir"); err != nil {
+		t.Fatalf("readdir: %s", err)
+	}
+
+	// an unchanged file reads through
+	f, err := cv.Open("/dir/file")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil || string(data) != "0123456789" {
+		t.Fatalf("read: %q, %v", data, err)
+	}
+	f.Close()
+
+	// one modified halfway through does not
+	f, err = cv.Open("/dir/file")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	buf := make([]byte, 4)
+	if _, err = f.Read(buf); err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	writeFile(t, v, "/dir/file", "changed")
+	if _, err = f.Read(buf); !IsChangedError(err) {
+		t.Fatalf("read after change: got %v, want a ChangedError", err)
+	}
+	f.Close()
+
+	// nor a directory that gained an entry
+	writeFile(t, v, "/dir/other", "")
+	if _, err = cv.ReadDir("/dir"); !IsChangedError(err) {
+		t.Fatalf("readdir after change: got %v, want a ChangedError", err)
+	}
+}
+
+func TestConsistentViewExpired(t *testing.T) {
+	v := loopbackTarget(t)
+	defer v.Close()
+
+	cv := NewConsistentView(v, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if _, err := cv.Stat("/"); err != ErrViewExpired {
+		t.Fatalf("stat: got %v, want ErrViewExpired", err)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"reflect"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+// CredentialRequest describes a call about to be sent, for a
+// CredentialProvider to pick its credential
+type CredentialRequest struct {
+	Proc uint32
+
+	// FH is the handle the call operates on, the parent directory for
+	// namespace operations, and Name the entry within it if any
+	FH   []byte
+	Name string
+
+	// Default is the credential the target was mounted with
+	Default rpc.Auth
+}
+
+// CredentialProvider supplies the credential of each call made through a
+// Target, e.g. to map the local user a gateway acts for to the uid and gid
+// that user has on the export.  It is consulted before every call and must
+// be safe for concurrent use.
+type CredentialProvider interface {
+	Credential(req *CredentialRequest) (rpc.Auth, error)
+}
+
+// CredentialFunc adapts a function to a CredentialProvider
+type CredentialFunc func(req *CredentialRequest) (rpc.Auth, error)
+
+func (f CredentialFunc) Credential(req *CredentialRequest) (rpc.Auth, error) {
+	return f(req)
+}
+
+// SetCredentialProvider has the credential of every call supplied by p, in
+// place of the one the target was mounted with.  An error from p fails the
+// call.  A nil p restores the mount credential.
+func (v *Target) SetCredentialProvider(p CredentialProvider) {
+	v.creds = p
+}
+
+// credential sets the credential of call c from the provider
+func (v *Target) credential(c interface{}) error {
+	h, ok := c.(interface{ RPCHeader() *rpc.Header })
+	if v.creds == nil || !ok {
+		return nil
+	}
+	hdr := h.RPCHeader()
+
+	req := &CredentialRequest{
+		Proc:    hdr.Proc,
+		FH:      callHandle(c),
+		Name:    callName(c),
+		Default: v.auth,
+	}
+
+	auth, err := v.creds.Credential(req)
+	if err != nil {
+		return err
+	}
+
+	hdr.Cred = auth
+	return nil
+}
+
+// callName finds the entry name of a directory operation call, see callHandle
+func callName(c interface{}) string {
+	val := reflect.Indirect(reflect.ValueOf(c))
+	if val.Kind() != reflect.Struct {
+		return ""
+	}
+
+	for i := 0; i < val.NumField(); i++ {
+		f := val.Field(i)
+		if !f.CanInterface() {
+			continue
+		}
+
+		if d, ok := f.Interface().(Diropargs3); ok {
+			return d.Filename
+		}
+	}
+
+	return ""
+}
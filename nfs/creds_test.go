@@ -0,0 +1,72 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+func TestCredentialProvider(t *testing.T) {
+	s := NewServer(NewMemFS())
+
+	// note the uid of every MKDIR reaching the server
+	var mu sync.Mutex
+	var uids []uint32
+	s.Register(Nfs3Prog, Nfs3Vers, func(call *rpc.ServerCall, w io.Writer) error {
+		if call.Proc == NFSProc3Mkdir {
+			au, err := rpc.ParseAuthUnix(call.Cred)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			uids = append(uids, au.Uid)
+			mu.Unlock()
+		}
+		return s.serveNFS(call, w)
+	})
+
+	v, err := DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	denied := errors.New("no mapping")
+	v.SetCredentialProvider(CredentialFunc(func(req *CredentialRequest) (rpc.Auth, error) {
+		switch req.Name {
+		case "alice":
+			return rpc.NewAuthUnix("gw", 1001, 1001).Auth(), nil
+		case "bob":
+			return rpc.NewAuthUnix("gw", 1002, 1002).Auth(), nil
+		case "mallory":
+			return rpc.Auth{}, denied
+		}
+		return req.Default, nil
+	}))
+
+	// audit events name the credential each call was sent with
+	var audited []uint32
+	v.SetAuditHook(func(ev *AuditEvent) { audited = append(audited, ev.UID) })
+
+	for _, name := range []string{"alice", "bob"} {
+		if _, err = v.Mkdir("/"+name, 0755); err != nil {
+			t.Fatalf("mkdir: %s", err)
+		}
+	}
+	if len(audited) != 2 || audited[0] != 1001 || audited[1] != 1002 {
+		t.Errorf("audited as %v", audited)
+	}
+	if _, err = v.Mkdir("/mallory", 0755); err != denied {
+		t.Fatalf("expected the provider's error, got %v", err)
+	}
+
+	if len(uids) != 2 || uids[0] != 1001 || uids[1] != 1002 {
+		t.Fatalf("unexpected credentials on the wire: %v", uids)
+	}
+}
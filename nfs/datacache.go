@@ -0,0 +1,367 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"container/list"
+	"io"
+	"sync"
+
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// DefaultDataCacheBlockSize is the block size used by NewDataCache when none
+// is given.
+const DefaultDataCacheBlockSize = 64 * 1024
+
+// DataCache is a bounded LRU cache of file data, keyed by file handle and
+// block number.  Blocks remember the mtime and ctime of the file they were
+// read from and are only served while the file's attributes still match,
+// so a changed file is re-read from the server.
+//
+// A DataCache is attached to a Target with SetDataCache and only caches
+// reads made through File.
+type DataCache struct {
+	sync.Mutex
+
+	blockSize int
+	maxBytes  int64
+	size      int64
+
+	lru    *list.List
+	blocks map[blockKey]*list.Element
+
+	// optional second tier, see SetSpillDir
+	disk *diskCache
+
+	// memory tier is accounted here, if set
+	budget *MemoryBudget
+
+	hits, misses, evictions, diskHits uint64
+}
+
+// DataCacheStats holds the counters of a DataCache
+type DataCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+
+	// DiskHits counts the hits served from the spill directory
+	DiskHits uint64
+
+	// Bytes is the amount of file data currently held in memory, DiskBytes
+	// the amount held in the spill directory
+	Bytes     int64
+	DiskBytes int64
+}
+
+// HitRate returns the fraction of block lookups that were served from cache
+func (s DataCacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type blockKey struct {
+	fh    string
+	block uint64
+}
+
+type cachedBlock struct {
+	key          blockKey
+	mtime, ctime NFS3Time
+	data         []byte
+
+	// eof is set when the block ends at the end of the file
+	eof bool
+}
+
+// NewDataCache returns a cache holding up to maxBytes of file data in blocks
+// of blockSize bytes.  A blockSize of 0 selects DefaultDataCacheBlockSize.
+func NewDataCache(maxBytes int64, blockSize int) *DataCache {
+	if blockSize <= 0 {
+		blockSize = DefaultDataCacheBlockSize
+	}
+
+	return &DataCache{
+		blockSize: blockSize,
+		maxBytes:  maxBytes,
+		lru:       list.New(),
+		blocks:    make(map[blockKey]*list.Element),
+	}
+}
+
+// SetDataCache attaches c to the Target, or detaches the current cache if c is
+// nil.  Caching is off by default.
+func (v *Target) SetDataCache(c *DataCache) {
+	if v.dataCache != nil {
+		v.dataCache.setBudget(nil)
+	}
+
+	v.dataCache = c
+	if c != nil && v.budget != nil {
+		c.setBudget(v.budget)
+	}
+}
+
+// setBudget moves the memory tier's accounting over to b.  Blocks that don't
+// fit the new budget are dropped.
+func (c *DataCache) setBudget(b *MemoryBudget) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.budget == b {
+		return
+	}
+
+	if c.budget != nil {
+		c.budget.removeShrinker(c)
+		c.budget.Release(c.size)
+	}
+
+	c.budget = b
+	if b == nil {
+		return
+	}
+
+	b.addShrinker(c)
+	for c.size > 0 && !b.TryAcquire(c.size) {
+		c.evict()
+	}
+}
+
+// shrink gives up least recently used blocks until n bytes are freed
+func (c *DataCache) shrink(n int64) {
+	c.Lock()
+	defer c.Unlock()
+
+	for freed := int64(0); freed < n && c.lru.Len() > 0; {
+		freed += int64(len(c.lru.Back().Value.(*cachedBlock).data))
+		c.evict()
+	}
+}
+
+// evict drops the least recently used block, the caller holds the lock
+func (c *DataCache) evict() {
+	c.remove(c.lru.Back())
+	c.evictions++
+}
+
+// Stats returns a snapshot of the cache counters
+func (c *DataCache) Stats() DataCacheStats {
+	c.Lock()
+	defer c.Unlock()
+
+	s := DataCacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		DiskHits:  c.diskHits,
+		Bytes:     c.size,
+	}
+	if c.disk != nil {
+		s.DiskBytes = c.disk.bytes()
+	}
+
+	return s
+}
+
+// get returns the block if it is cached and was read from a file with the
+// given attributes.  Stale blocks are dropped.
+func (c *DataCache) get(fh []byte, block uint64, attr *Fattr) (*cachedBlock, bool) {
+	key := blockKey{string(fh), block}
+	valid := func(b *cachedBlock) bool {
+		return attr != nil && b.mtime == attr.Mtime && b.ctime == attr.Ctime
+	}
+
+	c.Lock()
+	if e, ok := c.blocks[key]; ok {
+		b := e.Value.(*cachedBlock)
+		if valid(b) {
+			c.lru.MoveToFront(e)
+			c.hits++
+			c.Unlock()
+			return b, true
+		}
+		c.remove(e)
+	}
+	disk := c.disk
+	c.Unlock()
+
+	if disk != nil {
+		if b, ok := disk.get(key); ok && valid(b) {
+			c.Lock()
+			c.hits++
+			c.diskHits++
+			c.insert(b)
+			c.Unlock()
+			return b, true
+		}
+	}
+
+	c.Lock()
+	c.misses++
+	c.Unlock()
+	return nil, false
+}
+
+// put caches b in memory and, if configured, on disk
+func (c *DataCache) put(b *cachedBlock) {
+	c.Lock()
+	c.insert(b)
+	disk := c.disk
+	c.Unlock()
+
+	if disk != nil {
+		if err := disk.put(b); err != nil {
+			util.Debugf("datacache: spilling block %d of %x: %s", b.key.block, b.key.fh, err)
+		}
+	}
+}
+
+// insert adds b to the memory tier, the caller holds the lock
+func (c *DataCache) insert(b *cachedBlock) {
+	if e, ok := c.blocks[b.key]; ok {
+		c.remove(e)
+	}
+
+	n := int64(len(b.data))
+	if n > c.maxBytes {
+		return
+	}
+
+	for c.size+n > c.maxBytes {
+		c.evict()
+	}
+
+	// under memory pressure the cache sheds its own blocks first and, if
+	// that isn't enough, doesn't cache at all
+	if c.budget != nil {
+		for !c.budget.TryAcquire(n) {
+			if c.lru.Len() == 0 {
+				return
+			}
+			c.evict()
+		}
+	}
+
+	c.blocks[b.key] = c.lru.PushFront(b)
+	c.size += n
+}
+
+// invalidate drops all blocks of fh
+func (c *DataCache) invalidate(fh []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.disk != nil {
+		c.disk.invalidate(string(fh))
+	}
+
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*cachedBlock).key.fh == string(fh) {
+			c.remove(e)
+		}
+		e = next
+	}
+}
+
+// remove unlinks e, the caller holds the lock
+func (c *DataCache) remove(e *list.Element) {
+	b := c.lru.Remove(e).(*cachedBlock)
+	delete(c.blocks, b.key)
+	c.size -= int64(len(b.data))
+	if c.budget != nil {
+		c.budget.Release(int64(len(b.data)))
+	}
+}
+
+// readCached serves Read through the Target's data cache, filling whole
+// blocks from the server on a miss.
+func (f *File) readCached(p []byte) (int, error) {
+	c := f.dataCache
+	bs := uint64(c.blockSize)
+	block := f.curr / bs
+	off := f.curr % bs
+
+	b, ok := c.get(f.fh, block, f.fattr)
+	if !ok {
+		var err error
+		if b, err = f.fillBlock(block); err != nil {
+			return 0, err
+		}
+	}
+
+	if off >= uint64(len(b.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, b.data[off:])
+	f.curr += uint64(n)
+
+	if b.eof && off+uint64(n) == uint64(len(b.data)) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// fillBlock reads a whole block from the server and caches it
+func (f *File) fillBlock(block uint64) (*cachedBlock, error) {
+	c := f.dataCache
+	reserved := f.acquire(c.blockSize)
+	defer f.release(reserved)
+
+	buf := make([]byte, c.blockSize)
+	offset := block * uint64(c.blockSize)
+
+	var (
+		filled int
+		eof    bool
+		attr   *Fattr
+	)
+
+	for filled < len(buf) && !eof {
+		size := uint32(len(buf) - filled)
+		if f.fsinfo.RTMax > 0 {
+			size = min(f.fsinfo.RTMax, size)
+		}
+		n, e, a, err := f.readAt(buf[filled:filled+int(size)], offset+uint64(filled))
+		if err != nil {
+			return nil, err
+		}
+
+		if a != nil {
+			attr = a
+		}
+
+		filled += n
+		eof = e || n == 0
+	}
+
+	// the file changed under us, nothing cached for it can be trusted
+	if attr != nil && f.fattr != nil && (attr.Mtime != f.fattr.Mtime || attr.Ctime != f.fattr.Ctime) {
+		c.invalidate(f.fh)
+	}
+	if attr != nil {
+		f.fattr = attr
+	}
+
+	b := &cachedBlock{
+		key:  blockKey{string(f.fh), block},
+		data: buf[:filled],
+		eof:  eof,
+	}
+
+	if f.fattr != nil {
+		b.mtime = f.fattr.Mtime
+		b.ctime = f.fattr.Ctime
+		c.put(b)
+	}
+
+	return b, nil
+}
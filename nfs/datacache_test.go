@@ -0,0 +1,95 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDataCacheLRU(t *testing.T) {
+	c := NewDataCache(8, 4)
+	attr := &Fattr{Mtime: NFS3Time{Seconds: 1}}
+
+	for i := uint64(0); i < 3; i++ {
+		c.put(&cachedBlock{key: blockKey{"fh", i}, mtime: attr.Mtime, data: []byte{1, 2, 3, 4}})
+	}
+
+	// block 0 was evicted to keep the cache within 8 bytes
+	if _, ok := c.get([]byte("fh"), 0, attr); ok {
+		t.Fatalf("expected block 0 to be evicted")
+	}
+	if _, ok := c.get([]byte("fh"), 2, attr); !ok {
+		t.Fatalf("expected block 2 to be cached")
+	}
+
+	// a changed mtime makes the block stale
+	changed := &Fattr{Mtime: NFS3Time{Seconds: 2}}
+	if _, ok := c.get([]byte("fh"), 1, changed); ok {
+		t.Fatalf("expected stale block to be dropped")
+	}
+
+	s := c.Stats()
+	if s.Hits != 1 || s.Misses != 2 || s.Evictions != 1 || s.Bytes != 4 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+	if s.HitRate() < 0.33 || s.HitRate() > 0.34 {
+		t.Fatalf("unexpected hit rate: %f", s.HitRate())
+	}
+
+	c.invalidate([]byte("fh"))
+	if c.Stats().Bytes != 0 {
+		t.Fatalf("expected empty cache after invalidate")
+	}
+}
+
+func TestDataCacheSpillDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfs-datacache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	attr := &Fattr{Mtime: NFS3Time{Seconds: 1}}
+	c := NewDataCache(1024, 4)
+	if err = c.SetSpillDir(dir, 1024); err != nil {
+		t.Fatal(err)
+	}
+	c.put(&cachedBlock{key: blockKey{"fh", 0}, mtime: attr.Mtime, data: []byte{1, 2, 3, 4}})
+	c.put(&cachedBlock{key: blockKey{"fh", 1}, mtime: attr.Mtime, data: []byte{5, 6}, eof: true})
+
+	// a new cache over the same directory, as after a restart
+	c = NewDataCache(1024, 4)
+	if err = c.SetSpillDir(dir, 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	b, ok := c.get([]byte("fh"), 1, attr)
+	if !ok || !b.eof || !bytes.Equal(b.data, []byte{5, 6}) {
+		t.Fatalf("expected block 1 from disk, got %+v", b)
+	}
+	if c.Stats().DiskHits != 1 {
+		t.Fatalf("expected a disk hit: %+v", c.Stats())
+	}
+
+	// corrupt block 0, it must not be served
+	name := filepath.Join(dir, c.disk.name(blockKey{"fh", 0}))
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[len(buf)-1] ^= 0xff
+	if err = ioutil.WriteFile(name, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.get([]byte("fh"), 0, attr); ok {
+		t.Fatalf("served a corrupt block")
+	}
+	if _, err = os.Stat(name); !os.IsNotExist(err) {
+		t.Fatalf("corrupt block file was not removed")
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+// Hand-written decoders of the replies a metadata scan or a bulk read spends
+// its time decoding, see xdr.Decoder.  They must read exactly what the
+// reflective decoder reads from the structures they are methods of.
+
+func (t *NFS3Time) DecodeXDR(r *xdr.Reader) {
+	t.Seconds = r.DecodeUint32()
+	t.Nseconds = r.DecodeUint32()
+}
+
+func (f *Fattr) DecodeXDR(r *xdr.Reader) {
+	f.Type = r.DecodeUint32()
+	f.FileMode = r.DecodeUint32()
+	f.Nlink = r.DecodeUint32()
+	f.UID = r.DecodeUint32()
+	f.GID = r.DecodeUint32()
+	f.Filesize = r.DecodeUint64()
+	f.Used = r.DecodeUint64()
+	f.SpecData[0] = r.DecodeUint32()
+	f.SpecData[1] = r.DecodeUint32()
+	f.FSID = r.DecodeUint64()
+	f.Fileid = r.DecodeUint64()
+	f.Atime.DecodeXDR(r)
+	f.Mtime.DecodeXDR(r)
+	f.Ctime.DecodeXDR(r)
+}
+
+func (a *PostOpAttr) DecodeXDR(r *xdr.Reader) {
+	if a.IsSet = r.DecodeBool(); a.IsSet {
+		a.Attr.DecodeXDR(r)
+	}
+}
+
+func (h *PostOpFH3) DecodeXDR(r *xdr.Reader) {
+	if h.IsSet = r.DecodeBool(); h.IsSet {
+		h.FH = r.DecodeOpaque()
+	}
+}
+
+func (w *WccData) DecodeXDR(r *xdr.Reader) {
+	if w.Before.IsSet = r.DecodeBool(); w.Before.IsSet {
+		w.Before.Size = r.DecodeUint64()
+		w.Before.MTime.DecodeXDR(r)
+		w.Before.CTime.DecodeXDR(r)
+	}
+	w.After.DecodeXDR(r)
+}
+
+func (e *EntryPlus) DecodeXDR(r *xdr.Reader) {
+	e.FileId = r.DecodeUint64()
+	e.FileName = r.DecodeString()
+	e.Cookie = r.DecodeUint64()
+	e.Attr.DecodeXDR(r)
+	e.Handle.DecodeXDR(r)
+}
+
+// readRes is the head of a READ3resok, the data follows
+type readRes struct {
+	Attr  PostOpAttr
+	Count uint32
+	EOF   uint32
+	Data  struct {
+		Length uint32
+	}
+}
+
+func (res *readRes) DecodeXDR(r *xdr.Reader) {
+	res.Attr.DecodeXDR(r)
+	res.Count = r.DecodeUint32()
+	res.EOF = r.DecodeUint32()
+	res.Data.Length = r.DecodeUint32()
+}
+
+// writeRes is a WRITE3resok
+type writeRes struct {
+	Wcc       WccData
+	Count     uint32
+	How       uint32
+	WriteVerf uint64
+}
+
+func (res *writeRes) DecodeXDR(r *xdr.Reader) {
+	res.Wcc.DecodeXDR(r)
+	res.Count = r.DecodeUint32()
+	res.How = r.DecodeUint32()
+	res.WriteVerf = r.DecodeUint64()
+}
+
+// lookupOk is a LOOKUP3resok
+type lookupOk struct {
+	FH      []byte
+	Attr    PostOpAttr
+	DirAttr PostOpAttr
+}
+
+func (res *lookupOk) DecodeXDR(r *xdr.Reader) {
+	res.FH = r.DecodeOpaque()
+	res.Attr.DecodeXDR(r)
+	res.DirAttr.DecodeXDR(r)
+}
+
+// dirListOK is the head of a READDIRPLUS3resok, the entries follow
+type dirListOK struct {
+	DirAttrs   PostOpAttr
+	CookieVerf uint64
+}
+
+func (res *dirListOK) DecodeXDR(r *xdr.Reader) {
+	res.DirAttrs.DecodeXDR(r)
+	res.CookieVerf = r.DecodeUint64()
+}
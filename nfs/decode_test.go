@@ -0,0 +1,121 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+	xdr2 "github.com/rasky/go-xdr/xdr2"
+)
+
+// TestDecoders checks that the hand-written decoders read what the
+// reflective decoder reads, from whole and truncated replies
+func TestDecoders(t *testing.T) {
+	attr := Fattr{
+		Type: NF3Reg, FileMode: 0644, Nlink: 1, UID: 10, GID: 20,
+		Filesize: 1 << 40, Used: 4096, SpecData: [2]uint32{3, 4},
+		FSID: 0xfeed, Fileid: 42,
+		Atime: NFS3Time{1, 2}, Mtime: NFS3Time{3, 4}, Ctime: NFS3Time{5, 6},
+	}
+	wcc := WccData{After: PostOpAttr{IsSet: true, Attr: attr}}
+	wcc.Before.IsSet = true
+	wcc.Before.Size = 7
+	wcc.Before.MTime = NFS3Time{8, 9}
+
+	read := &readRes{Attr: PostOpAttr{IsSet: true, Attr: attr}, Count: 5, EOF: 1}
+	read.Data.Length = 5
+
+	for _, val := range []interface{}{
+		read,
+		&readRes{},
+		&writeRes{Wcc: wcc, Count: 10, How: 2, WriteVerf: 0xdeadbeef},
+		&lookupOk{FH: []byte{1, 2, 3, 4, 5}, Attr: PostOpAttr{IsSet: true, Attr: attr}},
+		&lookupOk{},
+		&dirListOK{DirAttrs: PostOpAttr{IsSet: true, Attr: attr}, CookieVerf: 9},
+		&EntryPlus{
+			FileId: 42, FileName: "name", Cookie: 3,
+			Attr:   PostOpAttr{IsSet: true, Attr: attr},
+			Handle: PostOpFH3{IsSet: true, FH: []byte{1, 2, 3}},
+		},
+		&EntryPlus{FileName: "x"},
+	} {
+		var buf bytes.Buffer
+		if err := xdr.Write(&buf, val); err != nil {
+			t.Fatalf("encode %T: %s", val, err)
+		}
+		data := buf.Bytes()
+
+		for n := 0; n <= len(data); n++ {
+			typ := reflect.TypeOf(val).Elem()
+			want, got := reflect.New(typ).Interface(), reflect.New(typ).Interface()
+
+			_, wantErr := xdr2.Unmarshal(bytes.NewReader(data[:n]), want)
+			gotErr := xdr.Read(bytes.NewReader(data[:n]), got)
+			if (wantErr == nil) != (gotErr == nil) {
+				t.Fatalf("%T from %d of %d bytes: error %v, reflection says %v", val, n, len(data), gotErr, wantErr)
+			}
+			if gotErr == nil && !reflect.DeepEqual(got, want) {
+				t.Fatalf("%T: decoded %+v, reflection says %+v", val, got, want)
+			}
+		}
+	}
+}
+
+func TestDecodeBadBool(t *testing.T) {
+	data := []byte{0, 0, 0, 2}
+	if err := xdr.Read(bytes.NewReader(data), new(PostOpAttr)); err == nil {
+		t.Errorf("decoded a discriminant of 2")
+	}
+}
+
+func TestReadDirPlusPages(t *testing.T) {
+	v := loopbackTarget(t)
+	defer v.Close()
+
+	if _, err := v.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	for i := 0; i < 200; i++ {
+		if _, err := v.Create(fmt.Sprintf("/dir/f%03d", i), 0644); err != nil {
+			t.Fatalf("create: %s", err)
+		}
+	}
+
+	_, fh, err := v.Lookup("/dir")
+	if err != nil {
+		t.Fatalf("lookup: %s", err)
+	}
+
+	var names []string
+	var pages int
+	var first *EntryPlus
+	err = v.ReadDirPlusPagesByFh(fh, func(page []EntryPlus) error {
+		if pages++; pages == 1 {
+			first = &page[0]
+		} else if len(page) > 0 && &page[0] != first {
+			t.Errorf("page %d decoded into a new slice", pages)
+		}
+		for _, e := range page {
+			names = append(names, e.FileName)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("readdirplus: %s", err)
+	}
+	if pages < 2 || len(names) != 200 || !sort.StringsAreSorted(names) {
+		t.Fatalf("%d pages, %d entries: %v", pages, len(names), names)
+	}
+
+	stop := errors.New("stop")
+	if err = v.ReadDirPlusPagesByFh(fh, func([]EntryPlus) error { return stop }); err != stop {
+		t.Fatalf("got %v, want the error of fn", err)
+	}
+}
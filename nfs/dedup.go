@@ -0,0 +1,122 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	_path "path"
+
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// ContentSum is the SHA-256 digest of the content of a file
+type ContentSum [sha256.Size]byte
+
+func (s ContentSum) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// ContentIndex tells which content is present on a target already, for
+// UploadOptions.Dedup.  Paths are on the target, from the root of the export.
+type ContentIndex interface {
+	// Lookup returns the path of a file holding the content sum, and false
+	// if there is none.  The path may be stale: the upload checks that it
+	// names a file of the size expected before linking to it.
+	Lookup(sum ContentSum) (string, bool)
+
+	// Add records that the file at path holds the content sum, once
+	// uploaded
+	Add(sum ContentSum, path string) error
+}
+
+// ContentMap is an in-memory ContentIndex, by path.  It is not safe for
+// concurrent use.
+type ContentMap map[ContentSum]string
+
+func (m ContentMap) Lookup(sum ContentSum) (string, bool) {
+	path, ok := m[sum]
+	return path, ok
+}
+
+func (m ContentMap) Add(sum ContentSum, path string) error {
+	m[sum] = path
+	return nil
+}
+
+// HashStore is a ContentIndex kept on the target itself, as hard links named
+// by the hex digest of their content in directory Dir, which must exist and
+// be on the same filesystem as the uploads.  Unlike a ContentMap it outlasts
+// the process, and is shared by everyone uploading there.
+type HashStore struct {
+	Target *Target
+	Dir    string
+}
+
+func (s *HashStore) Lookup(sum ContentSum) (string, bool) {
+	return _path.Join(s.Dir, sum.String()), true
+}
+
+func (s *HashStore) Add(sum ContentSum, path string) error {
+	err := s.Target.Link(path, _path.Join(s.Dir, sum.String()))
+	if os.IsExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// hashLocal returns the digest of local file local
+func hashLocal(local string) (ContentSum, error) {
+	var sum ContentSum
+
+	f, err := os.Open(local)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+
+	return sum, nil
+}
+
+// link makes path of directory parent a hard link to a file holding content
+// sum already, and reports whether it did.  A stale index entry, or a server
+// refusing the link, leave the file to be uploaded.
+func (u *uploader) link(sum ContentSum, parent []byte, path string, fi os.FileInfo) (bool, error) {
+	have, ok := u.opts.Dedup.Lookup(sum)
+	if !ok {
+		return false, nil
+	}
+
+	info, fh, err := u.v.Lookup(have)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != fi.Size() {
+		util.Debugf("upload %s: %s is not content %s", path, have, sum)
+		return false, nil
+	}
+
+	full := _path.Join(u.root, path)
+	if have != full {
+		name := _path.Base(path)
+		if err = u.v.remove(parent, name); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		if err = u.v.LinkByFh(fh, parent, name); err != nil {
+			util.Debugf("upload %s: link to %s: %s", path, have, err)
+			return false, nil
+		}
+	}
+
+	u.result.Linked++
+	u.result.LinkedBytes += uint64(fi.Size())
+
+	return true, nil
+}
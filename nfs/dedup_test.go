@@ -0,0 +1,65 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadDedup(t *testing.T) {
+	local := t.TempDir()
+	for path, data := range map[string]string{"a": "template", "b": "template", "sub/c": "template", "d": "other"} {
+		path = filepath.Join(local, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v := loopbackTarget(t)
+	defer v.Close()
+	for _, dir := range []string{"/one", "/two", "/store"} {
+		if _, err := v.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := UploadTree(local, &TreeRef{v, "/one"}, UploadOptions{Dedup: ContentMap{}})
+	if err != nil {
+		t.Fatalf("upload: %s", err)
+	}
+	if res.Files != 2 || res.Linked != 2 || res.LinkedBytes != 16 {
+		t.Errorf("result: %+v", res)
+	}
+	attr, _, err := v.GetAttr("/one/sub/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attr.Nlink != 3 {
+		t.Errorf("%d links to the template, want 3", attr.Nlink)
+	}
+	if got := readAll(t, v, "/one/sub/c"); got != "template" {
+		t.Errorf("read %q", got)
+	}
+
+	// the store outlasts the upload that filled it
+	store := &HashStore{Target: v, Dir: "/store"}
+	if _, err = UploadTree(local, &TreeRef{v, "/one"}, UploadOptions{Dedup: store}); err != nil {
+		t.Fatalf("upload to the store: %s", err)
+	}
+	res, err = UploadTree(local, &TreeRef{v, "/two"}, UploadOptions{Dedup: store})
+	if err != nil {
+		t.Fatalf("upload from the store: %s", err)
+	}
+	if res.Files != 0 || res.Linked != 4 {
+		t.Errorf("result: %+v", res)
+	}
+	if got := readAll(t, v, "/two/d"); got != "other" {
+		t.Errorf("read %q", got)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	_path "path"
+	"sort"
+)
+
+// ChangeOp is the kind of difference between two trees
+type ChangeOp int
+
+const (
+	ChangeAdded ChangeOp = iota + 1
+	ChangeRemoved
+	ChangeModified
+)
+
+func (op ChangeOp) String() string {
+	switch op {
+	case ChangeAdded:
+		return "ADDED"
+	case ChangeRemoved:
+		return "REMOVED"
+	case ChangeModified:
+		return "MODIFIED"
+	default:
+		return fmt.Sprintf("ChangeOp(%d)", int(op))
+	}
+}
+
+// Change is a difference between two trees.  A directory added or removed is
+// reported alone, not along with everything below it.
+type Change struct {
+	Op   ChangeOp
+	Path string
+	// Old and New are the attributes on either side, nil on the side the
+	// entry is missing from
+	Old, New *Fattr
+}
+
+// TreeRef names a tree to compare, a path on a target
+type TreeRef struct {
+	Target *Target
+	Path   string
+}
+
+// DiffOptions tune how Diff compares trees
+type DiffOptions struct {
+	// Content compares regular files by a hash of their data rather than
+	// by mtime and fileid, for trees copied with different timestamps.  It
+	// reads every file of the same size on both sides.
+	Content bool
+}
+
+// Diff compares tree a to tree b, on the same or different targets, and
+// returns how b differs from a.  Entries are matched by name and compared by
+// type, size and mtime, and by fileid when both are on the same target.
+// Paths in the changes are relative to the roots of the trees.
+func Diff(a, b *TreeRef) ([]Change, error) {
+	return DiffWithOptions(a, b, DiffOptions{})
+}
+
+// DiffWithOptions is Diff, tuned by opts
+func DiffWithOptions(a, b *TreeRef, opts DiffOptions) ([]Change, error) {
+	aAttr, afh, err := a.Target.GetAttr(a.Path)
+	if err != nil {
+		return nil, err
+	}
+	bAttr, bfh, err := b.Target.GetAttr(b.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &differ{a: a.Target, b: b.Target, opts: opts}
+	if !aAttr.IsDir() || !bAttr.IsDir() {
+		same, err := d.same(&diffEntry{afh, aAttr}, &diffEntry{bfh, bAttr})
+		if err != nil || same {
+			return nil, err
+		}
+		return []Change{{Op: ChangeModified, Old: aAttr, New: bAttr}}, nil
+	}
+
+	if err = d.diffDirs(afh, bfh, ""); err != nil {
+		return nil, err
+	}
+
+	return d.changes, nil
+}
+
+type differ struct {
+	a, b    *Target
+	opts    DiffOptions
+	changes []Change
+}
+
+// diffEntry is an entry of a directory being compared
+type diffEntry struct {
+	fh   []byte
+	attr *Fattr
+}
+
+// diffDirs records the differences between directory afh of a and bfh of b,
+// naming them under prefix
+func (d *differ) diffDirs(afh, bfh []byte, prefix string) error {
+	aEntries, err := listDiffEntries(d.a, afh)
+	if err != nil {
+		return err
+	}
+	bEntries, err := listDiffEntries(d.b, bfh)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(aEntries)+len(bEntries))
+	for name := range aEntries {
+		names = append(names, name)
+	}
+	for name := range bEntries {
+		if _, ok := aEntries[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := _path.Join(prefix, name)
+		ae, inA := aEntries[name]
+		be, inB := bEntries[name]
+
+		switch {
+		case !inB:
+			d.changes = append(d.changes, Change{Op: ChangeRemoved, Path: path, Old: ae.attr})
+		case !inA:
+			d.changes = append(d.changes, Change{Op: ChangeAdded, Path: path, New: be.attr})
+		case ae.attr.IsDir() && be.attr.IsDir():
+			if err = d.diffDirs(ae.fh, be.fh, path); err != nil {
+				return err
+			}
+		default:
+			same, err := d.same(&ae, &be)
+			if err != nil {
+				return fmt.Errorf("diff %s: %w", path, err)
+			}
+			if !same {
+				d.changes = append(d.changes, Change{Op: ChangeModified, Path: path, Old: ae.attr, New: be.attr})
+			}
+		}
+	}
+
+	return nil
+}
+
+// same reports whether two entries that are not both directories look
+// unchanged
+func (d *differ) same(a, b *diffEntry) (bool, error) {
+	if a.attr.Type != b.attr.Type || a.attr.Filesize != b.attr.Filesize {
+		return false, nil
+	}
+
+	if d.opts.Content && a.attr.Type == NF3Reg {
+		ah, err := hashFile(d.a, a)
+		if err != nil {
+			return false, err
+		}
+		bh, err := hashFile(d.b, b)
+		if err != nil {
+			return false, err
+		}
+		return bytes.Equal(ah, bh), nil
+	}
+
+	if a.attr.Mtime != b.attr.Mtime {
+		return false, nil
+	}
+
+	// fileids are only comparable within a filesystem
+	return d.a != d.b || a.attr.Fileid == b.attr.Fileid, nil
+}
+
+// hashFile returns the SHA-256 of the data of a file
+func hashFile(v *Target, e *diffEntry) ([]byte, error) {
+	// read without opening, so the file is neither tracked nor committed
+	f := &File{Target: v, fsinfo: v.fsinfo, fattr: e.attr, fh: e.fh}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// listDiffEntries lists directory fh of v, with the handle and attributes of
+// every entry
+func listDiffEntries(v *Target, fh []byte) (map[string]diffEntry, error) {
+	list, err := v.ReadDirPlusByFh(fh)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]diffEntry, len(list))
+	for _, e := range list {
+		if e.FileName == "." || e.FileName == ".." {
+			continue
+		}
+
+		de := diffEntry{attr: e.Attr.attr()}
+		if e.Handle.IsSet {
+			de.fh = e.Handle.FH
+		}
+
+		// servers may leave either out of READDIRPLUS
+		if de.fh == nil || de.attr == nil {
+			attr, efh, _, err := v.lookup(context.Background(), fh, e.FileName)
+			if err != nil {
+				return nil, err
+			}
+			de.fh, de.attr = efh, attr
+		}
+
+		entries[e.FileName] = de
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,50 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"testing"
+)
+
+func TestDiffTargets(t *testing.T) {
+	a := loopbackTarget(t)
+	defer a.Close()
+	b := loopbackTarget(t)
+	defer b.Close()
+
+	// the same tree copied to another server, timestamps not preserved
+	for _, v := range []*Target{a, b} {
+		if _, err := v.Mkdir("/src", 0755); err != nil {
+			t.Fatalf("mkdir: %s", err)
+		}
+		if _, err := v.Mkdir("/src/sub", 0755); err != nil {
+			t.Fatalf("mkdir: %s", err)
+		}
+		writeFile(t, v, "/src/one", "1111")
+		writeFile(t, v, "/src/sub/two", "2222")
+	}
+
+	changes, err := Diff(&TreeRef{a, "/src"}, &TreeRef{b, "/src"})
+	if err != nil {
+		t.Fatalf("diff: %s", err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("expected the files to differ by mtime, got %+v", changes)
+	}
+
+	changes, err = DiffWithOptions(&TreeRef{a, "/src"}, &TreeRef{b, "/src"}, DiffOptions{Content: true})
+	if err != nil || len(changes) != 0 {
+		t.Fatalf("expected identical content, got %+v, %v", changes, err)
+	}
+
+	writeFile(t, b, "/src/sub/two", "2223")
+	writeFile(t, b, "/src/three", "3")
+	changes, err = DiffWithOptions(&TreeRef{a, "/src"}, &TreeRef{b, "/src"}, DiffOptions{Content: true})
+	if err != nil {
+		t.Fatalf("diff: %s", err)
+	}
+	if len(changes) != 2 || changes[0].Op != ChangeModified || changes[0].Path != "sub/two" || changes[1].Op != ChangeAdded || changes[1].Path != "three" {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+}
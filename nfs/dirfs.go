@@ -0,0 +1,578 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+//go:build !windows && !plan9
+
+package nfs
+
+import (
+	"errors"
+	"os"
+	_path "path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DirFS is a Backend exporting a local directory, for a Go process to serve
+// files over NFS, as an edge gateway or as the far end of a test.  Handles
+// are inode numbers, and attributes those of the local filesystem, so that
+// the wcc data of a change is what happened to the file, changes made
+// locally included.
+//
+// A handle is known from the time its entry was looked up, listed or made;
+// the handles clients kept from before a restart are stale until they look
+// up their paths again.  Mounts below the directory are not crossed, as
+// their inode numbers may be those of others.  Symlinks are served as they
+// are, never followed.
+type DirFS struct {
+	root string
+	dev  uint64
+
+	sync.Mutex
+
+	// path of the inodes handed out, relative to root
+	paths map[uint64]string
+}
+
+// NewDirFS returns a backend exporting directory root
+func NewDirFS(root string) (*DirFS, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || !fi.IsDir() {
+		return nil, &os.PathError{Op: "export", Path: root, Err: syscall.ENOTDIR}
+	}
+
+	return &DirFS{
+		root:  root,
+		dev:   uint64(st.Dev),
+		paths: map[uint64]string{uint64(st.Ino): "."},
+	}, nil
+}
+
+func (fs *DirFS) full(rel string) string {
+	return filepath.Join(fs.root, filepath.FromSlash(rel))
+}
+
+// attr returns the attributes of local file fi
+func (fs *DirFS) attr(fi os.FileInfo) *Fattr {
+	mode := fi.Mode()
+	attr := &Fattr{
+		FileMode: ModeBits(mode),
+		Filesize: uint64(fi.Size()),
+		Used:     uint64(fi.Size()),
+		Mtime:    NewNFS3Time(fi.ModTime()),
+	}
+
+	if attr.Type = FileType(mode); attr.Type == 0 {
+		attr.Type = NF3Reg
+	}
+
+	attr.Atime, attr.Ctime = attr.Mtime, attr.Mtime
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		attr.Fileid = uint64(st.Ino)
+		attr.FSID = uint64(st.Dev)
+		attr.Nlink = uint32(st.Nlink)
+		attr.UID, attr.GID = st.Uid, st.Gid
+		attr.Used = uint64(st.Blocks) * 512
+		statExtra(st, attr)
+	}
+
+	return attr
+}
+
+// lstat returns the attributes of rel, as long as it is on the exported
+// filesystem
+func (fs *DirFS) lstat(rel string) (os.FileInfo, *Fattr, error) {
+	fi, err := os.Lstat(fs.full(rel))
+	if err != nil {
+		return nil, nil, localError(err)
+	}
+
+	attr := fs.attr(fi)
+	if attr.FSID != fs.dev {
+		return nil, nil, NFS3Error(NFS3ErrXDev)
+	}
+
+	return fi, attr, nil
+}
+
+// handle returns the handle of rel, of attributes attr
+func (fs *DirFS) handle(rel string, attr *Fattr) []byte {
+	fs.Lock()
+	defer fs.Unlock()
+
+	fs.paths[attr.Fileid] = rel
+	return handleID(attr.Fileid)
+}
+
+// resolve returns the path of fh and its attributes.  A handle whose path
+// is gone, or another file's since, is stale.
+func (fs *DirFS) resolve(fh []byte) (string, os.FileInfo, *Fattr, error) {
+	id, ok := parseHandleID(fh)
+	if !ok {
+		return "", nil, nil, NFS3Error(NFS3ErrBadHandle)
+	}
+
+	fs.Lock()
+	rel, ok := fs.paths[id]
+	fs.Unlock()
+	if !ok {
+		return "", nil, nil, NFS3Error(NFS3ErrStale)
+	}
+
+	fi, attr, err := fs.lstat(rel)
+	if err == nil && attr.Fileid == id {
+		return rel, fi, attr, nil
+	}
+
+	fs.Lock()
+	if fs.paths[id] == rel {
+		delete(fs.paths, id)
+	}
+	fs.Unlock()
+
+	return "", nil, nil, NFS3Error(NFS3ErrStale)
+}
+
+// resolveDir returns the path of directory fh
+func (fs *DirFS) resolveDir(fh []byte) (string, error) {
+	rel, fi, _, err := fs.resolve(fh)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", NFS3Error(NFS3ErrNotDir)
+	}
+
+	return rel, nil
+}
+
+// entry returns the path of name in directory dir
+func (fs *DirFS) entry(dir []byte, name string) (string, error) {
+	if err := validName(name); err != nil {
+		return "", err
+	}
+	if strings.ContainsAny(name, "/\x00") {
+		return "", NFS3Error(NFS3ErrInval)
+	}
+
+	rel, err := fs.resolveDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	return _path.Join(rel, name), nil
+}
+
+// moved has the handles of from, and of all below it, follow a rename to to
+func (fs *DirFS) moved(from, to string) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	for id, rel := range fs.paths {
+		if rel == from || strings.HasPrefix(rel, from+"/") {
+			fs.paths[id] = to + rel[len(from):]
+		}
+	}
+}
+
+func (fs *DirFS) Root(dirpath string) ([]byte, error) {
+	// cleaned from "/", so that ".." stops at the root, and nothing left may
+	// lead out of it
+	rel := strings.TrimPrefix(_path.Clean("/"+dirpath), "/")
+	if rel == "" {
+		rel = "."
+	}
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return nil, NFS3Error(NFS3ErrAcces)
+	}
+	fi, attr, err := fs.lstat(rel)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, NFS3Error(NFS3ErrNotDir)
+	}
+
+	return fs.handle(rel, attr), nil
+}
+
+func (fs *DirFS) GetAttr(fh []byte) (*Fattr, error) {
+	_, _, attr, err := fs.resolve(fh)
+	return attr, err
+}
+
+func (fs *DirFS) SetAttr(fh []byte, attr Sattr3) error {
+	rel, fi, cur, err := fs.resolve(fh)
+	if err != nil {
+		return err
+	}
+
+	return fs.setAttr(rel, fi, cur, attr)
+}
+
+// setAttr applies attr to rel, of local file fi and attributes cur
+func (fs *DirFS) setAttr(rel string, fi os.FileInfo, cur *Fattr, attr Sattr3) error {
+	full := fs.full(rel)
+	symlink := fi.Mode()&os.ModeSymlink != 0
+
+	if attr.Size.SetIt {
+		if !fi.Mode().IsRegular() {
+			return NFS3Error(NFS3ErrInval)
+		}
+		if err := os.Truncate(full, int64(attr.Size.Size)); err != nil {
+			return localError(err)
+		}
+	}
+	if attr.Mode.SetIt && !symlink {
+		if err := os.Chmod(full, FileMode(0, attr.Mode.Mode)); err != nil {
+			return localError(err)
+		}
+	}
+	if attr.UID.SetIt || attr.GID.SetIt {
+		uid, gid := -1, -1
+		if attr.UID.SetIt {
+			uid = int(attr.UID.UID)
+		}
+		if attr.GID.SetIt {
+			gid = int(attr.GID.UID)
+		}
+		if err := os.Lchown(full, uid, gid); err != nil {
+			return localError(err)
+		}
+	}
+
+	if (attr.Atime.SetIt != DontChange || attr.Mtime.SetIt != DontChange) && !symlink {
+		atime, mtime := cur.Atime.Time(), cur.Mtime.Time()
+		now := time.Now()
+		switch attr.Atime.SetIt {
+		case SetToServerTime:
+			atime = now
+		case SetToClientTime:
+			atime = attr.Atime.Time.Time()
+		}
+		switch attr.Mtime.SetIt {
+		case SetToServerTime:
+			mtime = now
+		case SetToClientTime:
+			mtime = attr.Mtime.Time.Time()
+		}
+		if err := os.Chtimes(full, atime, mtime); err != nil {
+			return localError(err)
+		}
+	}
+
+	return nil
+}
+
+func (fs *DirFS) Lookup(dir []byte, name string) ([]byte, error) {
+	rel, err := fs.entry(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	_, attr, err := fs.lstat(rel)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.handle(rel, attr), nil
+}
+
+func (fs *DirFS) Readlink(fh []byte) (string, error) {
+	rel, fi, _, err := fs.resolve(fh)
+	if err != nil {
+		return "", err
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return "", NFS3Error(NFS3ErrInval)
+	}
+
+	target, err := os.Readlink(fs.full(rel))
+	return target, localError(err)
+}
+
+func (fs *DirFS) Read(fh []byte, offset uint64, count uint32) ([]byte, bool, error) {
+	rel, fi, _, err := fs.resolve(fh)
+	if err != nil {
+		return nil, false, err
+	}
+	if fi.IsDir() {
+		return nil, false, NFS3Error(NFS3ErrIsDir)
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, false, NFS3Error(NFS3ErrInval)
+	}
+
+	// not through a symlink swapped in since, out of the export maybe
+	f, err := os.OpenFile(fs.full(rel), os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, false, localError(err)
+	}
+	defer f.Close()
+
+	data := make([]byte, count)
+	n, err := f.ReadAt(data, int64(offset))
+	if err != nil && n < len(data) {
+		// io.EOF, or the error of the read
+		if n == 0 && offset < uint64(fi.Size()) {
+			return nil, false, localError(err)
+		}
+		return data[:n], true, nil
+	}
+
+	return data[:n], offset+uint64(n) >= uint64(fi.Size()), nil
+}
+
+func (fs *DirFS) Write(fh []byte, offset uint64, data []byte) (int, error) {
+	rel, fi, _, err := fs.resolve(fh)
+	if err != nil {
+		return 0, err
+	}
+	if !fi.Mode().IsRegular() {
+		return 0, NFS3Error(NFS3ErrInval)
+	}
+
+	f, err := os.OpenFile(fs.full(rel), os.O_WRONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return 0, localError(err)
+	}
+	defer f.Close()
+
+	n, err := f.WriteAt(data, int64(offset))
+	return n, localError(err)
+}
+
+func (fs *DirFS) Commit(fh []byte) error {
+	rel, fi, _, err := fs.resolve(fh)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.OpenFile(fs.full(rel), os.O_WRONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return localError(err)
+	}
+	defer f.Close()
+
+	return localError(f.Sync())
+}
+
+// made returns the handle of rel, just made, with the attributes of attr
+// other than its mode applied
+func (fs *DirFS) made(rel string, attr Sattr3) ([]byte, error) {
+	fi, cur, err := fs.lstat(rel)
+	if err != nil {
+		return nil, err
+	}
+	if err = fs.setAttr(rel, fi, cur, attr); err != nil {
+		return nil, err
+	}
+
+	// the times set
+	if _, cur, err = fs.lstat(rel); err != nil {
+		return nil, err
+	}
+
+	return fs.handle(rel, cur), nil
+}
+
+func (fs *DirFS) Create(dir []byte, name string, attr Sattr3, guarded bool) ([]byte, error) {
+	rel, err := fs.entry(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	if guarded {
+		flags |= os.O_EXCL
+	}
+	if fi, err := os.Lstat(fs.full(rel)); err == nil && !fi.Mode().IsRegular() {
+		return nil, os.ErrExist
+	}
+
+	perm := os.FileMode(0644)
+	if attr.Mode.SetIt {
+		perm = FileMode(0, attr.Mode.Mode)
+	}
+	f, err := os.OpenFile(fs.full(rel), flags, perm)
+	if err != nil {
+		return nil, localError(err)
+	}
+	f.Close()
+
+	// the mode as asked, whatever the umask of the process
+	attr.Mode = SetMode{SetIt: true, Mode: ModeBits(perm)}
+	return fs.made(rel, attr)
+}
+
+func (fs *DirFS) Mkdir(dir []byte, name string, attr Sattr3) ([]byte, error) {
+	rel, err := fs.entry(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	perm := os.FileMode(0755)
+	if attr.Mode.SetIt {
+		perm = FileMode(0, attr.Mode.Mode)
+	}
+	if err = os.Mkdir(fs.full(rel), perm); err != nil {
+		return nil, localError(err)
+	}
+
+	attr.Mode = SetMode{SetIt: true, Mode: ModeBits(perm)}
+	return fs.made(rel, attr)
+}
+
+func (fs *DirFS) Symlink(dir []byte, name, target string, attr Sattr3) ([]byte, error) {
+	rel, err := fs.entry(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.Symlink(target, fs.full(rel)); err != nil {
+		return nil, localError(err)
+	}
+
+	// only the owner of a symlink may be set
+	return fs.made(rel, Sattr3{UID: attr.UID, GID: attr.GID})
+}
+
+func (fs *DirFS) Link(fh []byte, dir []byte, name string) error {
+	from, fi, _, err := fs.resolve(fh)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return NFS3Error(NFS3ErrIsDir)
+	}
+
+	rel, err := fs.entry(dir, name)
+	if err != nil {
+		return err
+	}
+
+	return localError(os.Link(fs.full(from), fs.full(rel)))
+}
+
+func (fs *DirFS) Remove(dir []byte, name string) error {
+	rel, err := fs.entry(dir, name)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(fs.full(rel))
+	if err != nil {
+		return localError(err)
+	}
+	if fi.IsDir() {
+		return NFS3Error(NFS3ErrIsDir)
+	}
+
+	return localError(syscall.Unlink(fs.full(rel)))
+}
+
+func (fs *DirFS) RmDir(dir []byte, name string) error {
+	rel, err := fs.entry(dir, name)
+	if err != nil {
+		return err
+	}
+
+	return localError(syscall.Rmdir(fs.full(rel)))
+}
+
+func (fs *DirFS) Rename(fromDir []byte, fromName string, toDir []byte, toName string) error {
+	from, err := fs.entry(fromDir, fromName)
+	if err != nil {
+		return err
+	}
+	to, err := fs.entry(toDir, toName)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(fs.full(from), fs.full(to)); err != nil {
+		return localError(err)
+	}
+	fs.moved(from, to)
+
+	return nil
+}
+
+func (fs *DirFS) ReadDir(dir []byte) ([]string, error) {
+	rel, err := fs.resolveDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(fs.full(rel))
+	if err != nil {
+		return nil, localError(err)
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, localError(err)
+	}
+
+	// sorted, so that cookies stay put while the directory is unchanged
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (fs *DirFS) FSStat(fh []byte) (*FSStat, error) {
+	rel, _, _, err := fs.resolve(fh)
+	if err != nil {
+		return nil, err
+	}
+
+	return localFSStat(fs.full(rel))
+}
+
+// local errors by nfsstat3, those nfsStatus does not know of
+var localErrors = map[syscall.Errno]uint32{
+	syscall.EIO:          NFS3ErrIO,
+	syscall.ENXIO:        NFS3ErrNXIO,
+	syscall.EXDEV:        NFS3ErrXDev,
+	syscall.ENODEV:       NFS3ErrNoDev,
+	syscall.ENOTDIR:      NFS3ErrNotDir,
+	syscall.EISDIR:       NFS3ErrIsDir,
+	syscall.EINVAL:       NFS3ErrInval,
+	syscall.EFBIG:        NFS3ErrFBig,
+	syscall.ENOSPC:       NFS3ErrNoSpc,
+	syscall.EROFS:        NFS3ErrROFS,
+	syscall.EMLINK:       NFS3ErrMLink,
+	syscall.ENAMETOOLONG: NFS3ErrNameTooLong,
+	syscall.ENOTEMPTY:    NFS3ErrNotEmpty,
+	syscall.EDQUOT:       NFS3ErrDQuot,
+	syscall.ELOOP:        NFS3ErrInval,
+}
+
+// localError returns the error of a local call as the Server answers it
+func localError(err error) error {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		if status, ok := localErrors[errno]; ok {
+			return NFS3Error(status)
+		}
+	}
+
+	return err
+}
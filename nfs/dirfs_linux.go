@@ -0,0 +1,40 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"syscall"
+	"time"
+)
+
+// statExtra fills in the attributes of st that os.FileInfo has not
+func statExtra(st *syscall.Stat_t, attr *Fattr) {
+	attr.Atime = NewNFS3Time(time.Unix(st.Atim.Unix()))
+	attr.Ctime = NewNFS3Time(time.Unix(st.Ctim.Unix()))
+
+	// as gnu_dev_major and gnu_dev_minor split it
+	rdev := uint64(st.Rdev)
+	attr.SpecData = [2]uint32{
+		uint32((rdev>>8)&0xfff | (rdev>>32)&^0xfff),
+		uint32(rdev&0xff | (rdev>>12)&^0xff),
+	}
+}
+
+// localFSStat returns the space and file counts of the filesystem of path
+func localFSStat(path string) (*FSStat, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return nil, localError(err)
+	}
+
+	bsize := uint64(st.Bsize)
+	return &FSStat{
+		TBytes: st.Blocks * bsize,
+		FBytes: st.Bfree * bsize,
+		ABytes: st.Bavail * bsize,
+		TFiles: st.Files,
+		FFiles: st.Ffree,
+		AFiles: st.Ffree,
+	}, nil
+}
@@ -0,0 +1,203 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+//go:build !windows && !plan9
+
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+func TestDirFS(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "local"), []byte("made locally"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("many%03d", i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs, err := NewDirFS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := DialLoopback(NewServer(fs)).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	if got := readAll(t, v, "/local"); got != "made locally" {
+		t.Errorf("local = %q", got)
+	}
+
+	if _, err = v.Mkdir("/a", 0750); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, v, "/a/f", "over nfs")
+	if data, err := os.ReadFile(filepath.Join(dir, "a", "f")); err != nil || string(data) != "over nfs" {
+		t.Errorf("a/f = %q, %v", data, err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "a"))
+	if err != nil || fi.Mode().Perm() != 0750 {
+		t.Errorf("a: %v %v", fi.Mode(), err)
+	}
+
+	// handles follow renames
+	_, fh, err := v.Lookup("/a/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = v.Rename("/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	attr, err := v.GetAttrByFh(fh)
+	if err != nil || attr.Filesize != 8 {
+		t.Errorf("after rename: %+v %v", attr, err)
+	}
+
+	if _, err = v.Symlink("f", "/b/link"); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "b", "link")); err != nil || target != "f" {
+		t.Errorf("link -> %q, %v", target, err)
+	}
+
+	if err = v.RmDir("/b"); !IsNotEmptyError(err) {
+		t.Errorf("rmdir non-empty: %v", err)
+	}
+
+	// READDIRPLUS over several pages
+	entries, err := v.ReadDirPlus("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 302 {
+		t.Errorf("%d entries", len(entries))
+	}
+
+	// a handle of a file removed locally is stale
+	if err = os.RemoveAll(filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = v.GetAttrByFh(fh); !IsStaleError(err) {
+		t.Errorf("removed: %v", err)
+	}
+
+	st, err := v.FSStat("/")
+	if err != nil || st.TBytes == 0 {
+		t.Errorf("fsstat: %+v %v", st, err)
+	}
+}
+
+func TestDirFSRootEscape(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"export/x", "x"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs, err := NewDirFS(filepath.Join(dir, "export"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// "/../x" is "/x" of the export, not the x beside it
+	fh, err := fs.Root("/../x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := fs.Root("/x"); string(fh) != string(want) {
+		t.Errorf("/../x is not /x of the export")
+	}
+	if _, err = fs.Root("/../../etc"); err == nil {
+		t.Error("root /../../etc")
+	}
+}
+
+func TestDirFSReadSymlink(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "export"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret"), []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../secret", filepath.Join(dir, "export", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err := NewDirFS(filepath.Join(dir, "export"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.Root("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh, err := fs.Lookup(root, "link")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// READ of the handle of the link itself does not go through it
+	var nfsErr *Error
+	if data, _, err := fs.Read(fh, 0, 100); !errors.As(err, &nfsErr) || nfsErr.ErrorNum != NFS3ErrInval {
+		t.Errorf("read link: %q %v", data, err)
+	}
+}
+
+func TestDirFSExportHandles(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"pub", "secret"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs, err := NewDirFS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(fs)
+	if err = s.SetExports(ServerExport{Path: "/pub"}); err != nil {
+		t.Fatal(err)
+	}
+	v, err := serveTCP(t, s)().Mount("/pub", rpc.AuthNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	// handles of the backend outside /pub, never handed out by the server
+	root, err := fs.Root("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := fs.Lookup(root, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fh := range [][]byte{root, secret} {
+		if _, err = v.GetAttrByFh(fh); err == nil {
+			t.Errorf("getattr of forged handle %x", fh)
+		}
+	}
+	if _, err = v.MkdirByParentFh(secret, "d", 0755); err == nil {
+		t.Error("mkdir under a forged handle")
+	}
+
+	if _, err = v.Mkdir("/d", 0755); err != nil {
+		t.Errorf("mkdir in the export: %v", err)
+	}
+}
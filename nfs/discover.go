@@ -0,0 +1,175 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// DiscoverConcurrency is the number of hosts Discover probes at once
+const DiscoverConcurrency = 64
+
+// maxDiscoverHosts bounds the hosts a single Discover expands its targets to
+const maxDiscoverHosts = 1 << 16
+
+// DiscoveredServer is an NFSv3 server found by Discover
+type DiscoveredServer struct {
+	Addr string
+	// Exports is the export list of the server, nil if its MOUNT service
+	// could not be reached
+	Exports []Export
+}
+
+// Discover probes the targets, host names, addresses or CIDR ranges such as
+// 192.168.1.0/24, in parallel for an NFSv3 server registered with the
+// portmapper, and returns those found along with their exports, in the order
+// of the targets.  Each host gets timeout to answer.  Cancelling ctx stops
+// the scan and returns what was found so far.
+func Discover(ctx context.Context, targets []string, timeout time.Duration) ([]DiscoveredServer, error) {
+	hosts, err := expandTargets(targets)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([]*DiscoveredServer, len(hosts))
+	sem := make(chan struct{}, DiscoverConcurrency)
+	var wg sync.WaitGroup
+
+scan:
+	for i, host := range hosts {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break scan
+		}
+
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			found[i] = probe(ctx, host, timeout)
+		}(i, host)
+	}
+	wg.Wait()
+
+	var servers []DiscoveredServer
+	for _, s := range found {
+		if s != nil {
+			servers = append(servers, *s)
+		}
+	}
+
+	return servers, ctx.Err()
+}
+
+// probe returns the server on host, or nil if there is none
+func probe(ctx context.Context, host string, timeout time.Duration) *DiscoveredServer {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	client, err := dialContext(ctx, host, rpc.PmapPort)
+	if err != nil {
+		util.Debugf("discover: %s: %s", host, err)
+		return nil
+	}
+	pm := rpc.NewPortmapper(client, host)
+	defer pm.Close()
+
+	port, err := pm.Lookup(rpc.Mapping{Prog: Nfs3Prog, Vers: Nfs3Vers, Prot: rpc.IPProtoTCP})
+	if err != nil || port == 0 {
+		util.Debugf("discover: %s: no nfs service, %v", host, err)
+		return nil
+	}
+
+	s := &DiscoveredServer{Addr: host}
+
+	port, err = pm.Lookup(rpc.Mapping{Prog: MountProg, Vers: MountVers, Prot: rpc.IPProtoTCP})
+	if err != nil || port == 0 {
+		util.Debugf("discover: %s: no mount service, %v", host, err)
+		return s
+	}
+
+	client, err = dialContext(ctx, host, port)
+	if err != nil {
+		util.Debugf("discover: %s: %s", host, err)
+		return s
+	}
+	defer client.Close()
+
+	if s.Exports, err = (&Mount{Client: client}).Exports(); err != nil {
+		util.Debugf("discover: %s: export: %s", host, err)
+	}
+
+	return s
+}
+
+// dialContext connects to port on host, and closes the client once ctx is
+// done so calls on it give up
+func dialContext(ctx context.Context, host string, port int) (*rpc.Client, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+
+	client := rpc.NewClient(conn)
+	go func() {
+		<-ctx.Done()
+		client.Close()
+	}()
+
+	return client, nil
+}
+
+// expandTargets returns the hosts named by targets, with CIDR ranges expanded
+// to their addresses less the network and broadcast ones
+func expandTargets(targets []string) ([]string, error) {
+	var hosts []string
+	for _, t := range targets {
+		if !strings.Contains(t, "/") {
+			hosts = append(hosts, t)
+			continue
+		}
+
+		ip, ipnet, err := net.ParseCIDR(t)
+		if err != nil {
+			return nil, err
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+
+		ones, bits := ipnet.Mask.Size()
+		if bits-ones > 16 || len(hosts)+1<<uint(bits-ones) > maxDiscoverHosts {
+			return nil, fmt.Errorf("discover: %s has too many addresses", t)
+		}
+
+		n := 1 << uint(bits-ones)
+		first, last := 0, n
+		if bits == 32 && n > 2 {
+			first, last = 1, n-1
+		}
+
+		base := new(big.Int).SetBytes(ipnet.IP.To16()[16-len(ip):])
+		for i := first; i < last; i++ {
+			b := new(big.Int).Add(base, big.NewInt(int64(i))).Bytes()
+			addr := make(net.IP, len(ip))
+			copy(addr[len(addr)-len(b):], b)
+			hosts = append(hosts, addr.String())
+		}
+	}
+
+	return hosts, nil
+}
@@ -0,0 +1,25 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandTargets(t *testing.T) {
+	hosts, err := expandTargets([]string{"nas", "10.0.0.0/30", "fd00::/127"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"nas", "10.0.0.1", "10.0.0.2", "fd00::", "fd00::1"}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Fatalf("expected %v, got %v", want, hosts)
+	}
+
+	if _, err = expandTargets([]string{"10.0.0.0/8"}); err == nil {
+		t.Fatal("expected a /8 to be refused")
+	}
+}
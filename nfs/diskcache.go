@@ -0,0 +1,310 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var diskBlockMagic = [4]byte{'N', 'F', 'C', '1'}
+
+// diskBlockHeader precedes the data of every block file.  CRC is the IEEE
+// crc32 of the data and guards against torn or corrupted files.
+type diskBlockHeader struct {
+	Magic  [4]byte
+	Mtime  NFS3Time
+	Ctime  NFS3Time
+	EOF    uint32
+	Length uint32
+	CRC    uint32
+}
+
+var errBadBlockFile = errors.New("nfs: corrupt cache block file")
+
+// diskCache keeps data cache blocks as files below dir, one file per block,
+// evicting the least recently used files to stay within maxBytes.  Blocks
+// written by a previous process are picked up again.
+type diskCache struct {
+	sync.Mutex
+	dir      string
+	maxBytes int64
+	size     int64
+
+	lru   *list.List
+	files map[string]*list.Element
+
+	// names of the block files, grouped by file handle prefix
+	byPrefix map[string]map[string]struct{}
+}
+
+type diskFile struct {
+	name string
+	size int64
+}
+
+// SetSpillDir makes the cache also keep its blocks in files below dir, using
+// at most maxBytes of disk.  Blocks left in dir by an earlier run are reused
+// once their integrity marker and the file attributes check out, so large
+// read-mostly data survives restarts.  Use a separate dir per export, since
+// blocks are keyed by file handle.
+func (c *DataCache) SetSpillDir(dir string, maxBytes int64) error {
+	d := &diskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		files:    make(map[string]*list.Element),
+		byPrefix: make(map[string]map[string]struct{}),
+	}
+
+	if err := d.load(); err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.disk = d
+	c.Unlock()
+
+	return nil
+}
+
+// load indexes the block files already present, oldest first
+func (d *diskCache) load() error {
+	if err := os.MkdirAll(d.dir, 0700); err != nil {
+		return err
+	}
+
+	type found struct {
+		name  string
+		size  int64
+		mtime time.Time
+	}
+
+	var files []found
+	err := filepath.Walk(d.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			return nil
+		}
+
+		// leftovers of an interrupted write
+		if strings.HasSuffix(path, ".tmp") {
+			return os.Remove(path)
+		}
+
+		rel, err := filepath.Rel(d.dir, path)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, found{rel, fi.Size(), fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// insert oldest first, so the most recently written file ends up in front
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime.Before(files[j].mtime) })
+
+	d.Lock()
+	defer d.Unlock()
+	for _, f := range files {
+		d.add(f.name, f.size)
+	}
+	d.evict()
+
+	return nil
+}
+
+// prefix returns the part of the file name shared by all blocks of fh
+func (d *diskCache) prefix(fh string) string {
+	sum := sha256.Sum256([]byte(fh))
+	h := hex.EncodeToString(sum[:])
+	return filepath.Join(h[:2], h) + "-"
+}
+
+func (d *diskCache) name(key blockKey) string {
+	return d.prefix(key.fh) + strconv.FormatUint(key.block, 10)
+}
+
+// get reads a block back from disk.  Corrupt files are removed.
+func (d *diskCache) get(key blockKey) (*cachedBlock, bool) {
+	name := d.name(key)
+
+	d.Lock()
+	e, ok := d.files[name]
+	if ok {
+		d.lru.MoveToFront(e)
+	}
+	d.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	b, err := readBlockFile(filepath.Join(d.dir, name))
+	if err != nil {
+		d.remove(name)
+		return nil, false
+	}
+
+	b.key = key
+	return b, true
+}
+
+func readBlockFile(path string) (*cachedBlock, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bytes.NewReader(buf)
+	var hdr diskBlockHeader
+	if err = binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		return nil, errBadBlockFile
+	}
+
+	data := buf[len(buf)-r.Len():]
+	if hdr.Magic != diskBlockMagic || int(hdr.Length) != len(data) || crc32.ChecksumIEEE(data) != hdr.CRC {
+		return nil, errBadBlockFile
+	}
+
+	return &cachedBlock{
+		mtime: hdr.Mtime,
+		ctime: hdr.Ctime,
+		data:  data,
+		eof:   hdr.EOF != 0,
+	}, nil
+}
+
+// put writes b to disk, replacing any older copy
+func (d *diskCache) put(b *cachedBlock) error {
+	name := d.name(b.key)
+	path := filepath.Join(d.dir, name)
+
+	hdr := diskBlockHeader{
+		Magic:  diskBlockMagic,
+		Mtime:  b.mtime,
+		Ctime:  b.ctime,
+		Length: uint32(len(b.data)),
+		CRC:    crc32.ChecksumIEEE(b.data),
+	}
+	if b.eof {
+		hdr.EOF = 1
+	}
+
+	w := new(bytes.Buffer)
+	if err := binary.Write(w, binary.BigEndian, &hdr); err != nil {
+		return err
+	}
+	w.Write(b.data)
+
+	if int64(w.Len()) > d.maxBytes {
+		return fmt.Errorf("nfs: block of %d bytes exceeds disk cache size", w.Len())
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	// write then rename, so a crash never leaves a half written block behind
+	// under its real name
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, w.Bytes(), 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if e, ok := d.files[name]; ok {
+		f := d.lru.Remove(e).(*diskFile)
+		d.size -= f.size
+	}
+	d.add(name, int64(w.Len()))
+	d.evict()
+
+	return nil
+}
+
+// add indexes a block file, the caller holds the lock
+func (d *diskCache) add(name string, size int64) {
+	d.files[name] = d.lru.PushFront(&diskFile{name: name, size: size})
+	d.size += size
+
+	prefix := name[:strings.LastIndex(name, "-")+1]
+	if d.byPrefix[prefix] == nil {
+		d.byPrefix[prefix] = make(map[string]struct{})
+	}
+	d.byPrefix[prefix][name] = struct{}{}
+}
+
+// invalidate removes all blocks of fh
+func (d *diskCache) invalidate(fh string) {
+	d.Lock()
+	defer d.Unlock()
+
+	for name := range d.byPrefix[d.prefix(fh)] {
+		d.drop(d.files[name])
+	}
+}
+
+func (d *diskCache) remove(name string) {
+	d.Lock()
+	defer d.Unlock()
+
+	if e, ok := d.files[name]; ok {
+		d.drop(e)
+	}
+}
+
+// evict removes the least recently used files until the cache fits.  The
+// caller holds the lock.
+func (d *diskCache) evict() {
+	for d.size > d.maxBytes && d.lru.Len() > 0 {
+		d.drop(d.lru.Back())
+	}
+}
+
+func (d *diskCache) drop(e *list.Element) {
+	f := d.lru.Remove(e).(*diskFile)
+	delete(d.files, f.name)
+	d.size -= f.size
+
+	prefix := f.name[:strings.LastIndex(f.name, "-")+1]
+	delete(d.byPrefix[prefix], f.name)
+	if len(d.byPrefix[prefix]) == 0 {
+		delete(d.byPrefix, prefix)
+	}
+
+	os.Remove(filepath.Join(d.dir, f.name))
+}
+
+func (d *diskCache) bytes() int64 {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.size
+}
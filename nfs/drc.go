@@ -0,0 +1,188 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"container/list"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// Defaults of the duplicate request cache of a Server, see SetDRC
+const (
+	DefaultDRCSize = 1024
+	DefaultDRCTTL  = 2 * time.Minute
+)
+
+// DRCStats counts what the duplicate request cache of a Server did
+type DRCStats struct {
+	// Entries are the replies cached
+	Entries int `json:"entries"`
+
+	// Replayed are the retransmissions answered with the cached reply,
+	// Dropped those of calls still in progress, left unanswered
+	Replayed uint64 `json:"replayed"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+// SetDRC sizes the duplicate request cache of the server, which holds the
+// replies to the last size calls of the procedures not safe to run twice,
+// those changing the namespace and SETATTR, for ttl.  A retransmission of
+// one, the same xid and arguments from the same client, is answered with
+// the reply to the call rather than run again: a REMOVE retransmitted after
+// its reply was lost would fail with NFS3ERR_NOENT otherwise.  A size of 0
+// turns the cache off; servers start with DefaultDRCSize and DefaultDRCTTL.
+// It is to be set before the server serves calls.
+func (s *Server) SetDRC(size int, ttl time.Duration) {
+	if size <= 0 {
+		s.drc = nil
+		return
+	}
+
+	s.drc = &drc{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[drcKey]*drcEntry),
+		lru:     list.New(),
+	}
+}
+
+// DRCStats returns the counts of the duplicate request cache of the server
+func (s *Server) DRCStats() DRCStats {
+	if s.drc == nil {
+		return DRCStats{}
+	}
+	return s.drc.stats()
+}
+
+// nonIdempotent tells the procedures whose replies the cache holds
+func nonIdempotent(proc uint32) bool {
+	switch proc {
+	case NFSProc3SetAttr, NFSProc3Create, NFSProc3Mkdir, NFSProc3Symlink, NFSProc3MkNod,
+		NFSProc3Remove, NFSProc3RmDir, NFSProc3Rename, NFSProc3Link:
+		return true
+	}
+	return false
+}
+
+// drcKey tells a call from others: xids are reused, by clients restarting,
+// so the checksum of the arguments is part of it
+type drcKey struct {
+	xid    uint32
+	client string
+	proc   uint32
+	sum    uint32
+}
+
+type drcEntry struct {
+	key drcKey
+	at  time.Time
+
+	// done is closed once reply and err are set
+	done  chan struct{}
+	reply []byte
+	err   error
+
+	elem *list.Element
+}
+
+type drc struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[drcKey]*drcEntry
+	lru     *list.List
+
+	replayed, dropped uint64
+}
+
+// begin returns the entry of key, and whether it is that of an earlier call,
+// adding it otherwise
+func (c *drc) begin(key drcKey) (*drcEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if e, ok := c.entries[key]; ok {
+		if c.ttl <= 0 || now.Sub(e.at) < c.ttl {
+			return e, true
+		}
+		c.remove(e)
+	}
+
+	e := &drcEntry{key: key, at: now, done: make(chan struct{})}
+	e.elem = c.lru.PushBack(e)
+	c.entries[key] = e
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Front().Value.(*drcEntry))
+	}
+
+	return e, false
+}
+
+// remove drops e, the caller holds the lock
+func (c *drc) remove(e *drcEntry) {
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.key)
+}
+
+func (c *drc) stats() DRCStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return DRCStats{Entries: len(c.entries), Replayed: c.replayed, Dropped: c.dropped}
+}
+
+// serve runs call with serve, unless it is a retransmission: the reply to
+// the call is then written again, or none if it is still in progress, for
+// the client to retransmit later
+func (c *drc) serve(call *rpc.ServerCall, w io.Writer, serve rpc.Handler) error {
+	args, err := ioutil.ReadAll(call.Args)
+	if err != nil {
+		return rpc.ErrGarbageArgs
+	}
+	call.Args = bytes.NewReader(args)
+
+	key := drcKey{xid: call.Xid, proc: call.Proc, sum: crc32.ChecksumIEEE(args)}
+	if call.RemoteAddr != nil {
+		key.client = call.RemoteAddr.String()
+	}
+
+	e, dup := c.begin(key)
+	if dup {
+		select {
+		case <-e.done:
+		default:
+			c.mu.Lock()
+			c.dropped++
+			c.mu.Unlock()
+			util.Debugf("server: %s: retransmission of xid %x in progress, dropped", ProcName(call.Proc), call.Xid)
+			return rpc.ErrDrop
+		}
+
+		c.mu.Lock()
+		c.replayed++
+		c.mu.Unlock()
+		util.Debugf("server: %s: retransmission of xid %x, replayed", ProcName(call.Proc), call.Xid)
+		if _, err = w.Write(e.reply); err != nil {
+			return err
+		}
+		return e.err
+	}
+
+	reply := new(bytes.Buffer)
+	e.err = serve(call, io.MultiWriter(w, reply))
+	e.reply = reply.Bytes()
+	close(e.done)
+
+	return e.err
+}
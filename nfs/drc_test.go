@@ -0,0 +1,66 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+func TestDRC(t *testing.T) {
+	fs := NewMemFS()
+	s := NewServer(fs)
+	v, err := DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	writeFile(t, v, "/f", "data")
+
+	root, err := fs.Root("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := new(bytes.Buffer)
+	xdr.Write(args, Diropargs3{FH: root, Filename: "f"})
+
+	// a REMOVE, then retransmissions of it
+	remove := func(xid uint32) uint32 {
+		call := &rpc.ServerCall{
+			Header: rpc.Header{Prog: Nfs3Prog, Vers: Nfs3Vers, Proc: NFSProc3Remove},
+			Xid:    xid,
+			Args:   bytes.NewReader(args.Bytes()),
+		}
+		res := new(bytes.Buffer)
+		if err := s.serveNFS(call, res); err != nil {
+			t.Fatal(err)
+		}
+		status, err := xdr.ReadUint32(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	if status := remove(1); status != NFS3Ok {
+		t.Fatalf("remove: %s", StatusName(status))
+	}
+	if status := remove(1); status != NFS3Ok {
+		t.Errorf("retransmitted remove: %s", StatusName(status))
+	}
+	if status := remove(2); status != NFS3ErrNoEnt {
+		t.Errorf("second remove: %s", StatusName(status))
+	}
+	if st := s.DRCStats(); st.Replayed != 1 || st.Entries < 2 {
+		t.Errorf("stats = %+v", st)
+	}
+
+	s.SetDRC(0, 0)
+	if status := remove(1); status != NFS3ErrNoEnt {
+		t.Errorf("remove without a cache: %s", StatusName(status))
+	}
+}
@@ -0,0 +1,402 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	_path "path"
+	"sort"
+)
+
+// Types of SpecEntry
+const (
+	SpecDir     = "directory"
+	SpecFile    = "file"
+	SpecSymlink = "symlink"
+)
+
+// SpecEntry is an entry of a TreeSpec
+type SpecEntry struct {
+	// Path is where the entry is, from the root of the export
+	Path string
+
+	// Type is SpecDir, SpecFile or SpecSymlink
+	Type string
+
+	// Mode is the permissions of a directory or file, left as they are if
+	// zero, but for entries made, which are made 0755 or 0644
+	Mode os.FileMode
+
+	// UID and GID are the owner of the entry, left as they are if nil
+	UID, GID *uint32
+
+	// Target is what a symlink points to
+	Target string
+
+	// The content of a file is Content, or that of local file Source, or
+	// what Open reads, in that order.  Without any, a file is made empty if
+	// missing and its data left as they are otherwise.
+	Content []byte
+	Source  string
+	Open    func() (io.ReadCloser, error)
+}
+
+// TreeSpec describes the state a tree should be in, for EnsureTree to bring
+// it to.  Entries are ensured parents first, whatever their order, and
+// directories above them not in the spec are made 0755.  Entries of the tree
+// not in the spec are left alone.
+type TreeSpec struct {
+	Entries []SpecEntry
+}
+
+// Kinds of EnsureAction
+const (
+	EnsureMkdir   = "mkdir"
+	EnsureCreate  = "create"
+	EnsureWrite   = "write"
+	EnsureSymlink = "symlink"
+	EnsureRelink  = "relink"
+	EnsureReplace = "replace"
+	EnsureChmod   = "chmod"
+	EnsureChown   = "chown"
+)
+
+// EnsureAction is a change EnsureTree made, or would make in a dry run
+type EnsureAction struct {
+	Op     string `json:"op"`
+	Path   string `json:"path"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// EnsureReport is the outcome of EnsureTree, see WriteJSON
+type EnsureReport struct {
+	DryRun  bool           `json:"dry_run"`
+	Actions []EnsureAction `json:"actions"`
+}
+
+// Changed reports whether the tree was not as the spec has it
+func (r *EnsureReport) Changed() bool {
+	return len(r.Actions) > 0
+}
+
+// WriteJSON writes the report to w as indented JSON
+func (r *EnsureReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// EnsureOptions tune EnsureTree
+type EnsureOptions struct {
+	// DryRun reports the changes that would be made without making them.
+	// The chmod and chown of entries that would be made are not reported.
+	DryRun bool
+
+	// Replace removes entries of another type than the spec has, with all
+	// below them, rather than failing
+	Replace bool
+}
+
+// EnsureTree brings the export to the state of spec, changing only what
+// differs from it, so that running it again changes nothing: provisioning of
+// the data directories of an application, say.  It stops at the first error,
+// returning what was done so far.
+func (v *Target) EnsureTree(spec *TreeSpec) (*EnsureReport, error) {
+	return v.EnsureTreeWithOptions(spec, EnsureOptions{})
+}
+
+// EnsureTreeWithOptions is EnsureTree tuned by opts
+func (v *Target) EnsureTreeWithOptions(spec *TreeSpec, opts EnsureOptions) (*EnsureReport, error) {
+	e := &ensurer{
+		v:      v,
+		opts:   opts,
+		report: &EnsureReport{DryRun: opts.DryRun, Actions: []EnsureAction{}},
+		dirs:   map[string]bool{"/": true},
+	}
+
+	entries := append([]SpecEntry(nil), spec.Entries...)
+	for i := range entries {
+		entries[i].Path = _path.Clean("/" + entries[i].Path)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+
+	for i := range entries {
+		if err := e.ensure(&entries[i]); err != nil {
+			return e.report, fmt.Errorf("%s: %w", entries[i].Path, err)
+		}
+	}
+
+	return e.report, nil
+}
+
+var specTypes = map[string]uint32{
+	SpecDir:     NF3Dir,
+	SpecFile:    NF3Reg,
+	SpecSymlink: NF3Lnk,
+}
+
+type ensurer struct {
+	v      *Target
+	opts   EnsureOptions
+	report *EnsureReport
+
+	// directories known to be there, or to be made in a dry run
+	dirs map[string]bool
+}
+
+func (e *ensurer) act(op, path, detail string) {
+	e.report.Actions = append(e.report.Actions, EnsureAction{Op: op, Path: path, Detail: detail})
+}
+
+// stat returns the attributes of path, nil if there is none
+func (e *ensurer) stat(path string) (*Fattr, []byte, error) {
+	if e.opts.DryRun && !e.dirs[_path.Dir(path)] {
+		// below a directory that would be made
+		return nil, nil, nil
+	}
+
+	attr, fh, err := e.v.lstat(path)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	return attr, fh, err
+}
+
+// parents makes the directories down to dir that are not there
+func (e *ensurer) parents(dir string) error {
+	if e.dirs[dir] {
+		return nil
+	}
+	if err := e.parents(_path.Dir(dir)); err != nil {
+		return err
+	}
+
+	attr, _, err := e.stat(dir)
+	switch {
+	case err != nil:
+		return err
+	case attr == nil:
+		e.act(EnsureMkdir, dir, "0755")
+		if !e.opts.DryRun {
+			if _, err = e.v.Mkdir(dir, 0755); err != nil {
+				return err
+			}
+		}
+	case attr.Type != NF3Dir:
+		return fmt.Errorf("%s: not a directory", dir)
+	}
+	e.dirs[dir] = true
+
+	return nil
+}
+
+func (e *ensurer) ensure(s *SpecEntry) error {
+	typ, ok := specTypes[s.Type]
+	if !ok {
+		return fmt.Errorf("type %q: unknown", s.Type)
+	}
+
+	if err := e.parents(_path.Dir(s.Path)); err != nil {
+		return err
+	}
+
+	attr, fh, err := e.stat(s.Path)
+	if err != nil {
+		return err
+	}
+
+	if attr != nil && attr.Type != typ {
+		if !e.opts.Replace {
+			return fmt.Errorf("is a %s, not a %s", typeToJSON[attr.Type], s.Type)
+		}
+		e.act(EnsureReplace, s.Path, typeToJSON[attr.Type])
+		if !e.opts.DryRun {
+			if attr.Type == NF3Dir {
+				err = e.v.RemoveAll(s.Path)
+			} else {
+				err = e.v.Remove(s.Path)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		attr = nil
+	}
+
+	made := attr == nil
+	switch typ {
+	case NF3Dir:
+		err = e.dir(s, made)
+		e.dirs[s.Path] = true
+	case NF3Lnk:
+		err = e.symlink(s, made)
+	case NF3Reg:
+		err = e.file(s, attr)
+	}
+	if err != nil || (made && e.opts.DryRun) {
+		return err
+	}
+
+	if made {
+		if attr, fh, err = e.v.lstat(s.Path); err != nil {
+			return err
+		}
+	}
+
+	return e.attrs(s, attr, fh)
+}
+
+func (e *ensurer) dir(s *SpecEntry, made bool) error {
+	if !made {
+		return nil
+	}
+
+	mode := specMode(s.Mode, 0755)
+	e.act(EnsureMkdir, s.Path, fmt.Sprintf("%04o", ModeBits(mode)))
+	if e.opts.DryRun {
+		return nil
+	}
+	_, err := e.v.Mkdir(s.Path, mode)
+	return err
+}
+
+func (e *ensurer) symlink(s *SpecEntry, made bool) error {
+	if made {
+		e.act(EnsureSymlink, s.Path, s.Target)
+		if e.opts.DryRun {
+			return nil
+		}
+		_, err := e.v.Symlink(s.Target, s.Path)
+		return err
+	}
+
+	target, err := e.v.Readlink(s.Path)
+	if err != nil || target == s.Target {
+		return err
+	}
+
+	e.act(EnsureRelink, s.Path, target+" -> "+s.Target)
+	if e.opts.DryRun {
+		return nil
+	}
+	if err = e.v.Remove(s.Path); err != nil {
+		return err
+	}
+	_, err = e.v.Symlink(s.Target, s.Path)
+	return err
+}
+
+func (e *ensurer) file(s *SpecEntry, attr *Fattr) error {
+	data, err := s.content()
+	if err != nil {
+		return err
+	}
+
+	op := EnsureCreate
+	if attr != nil {
+		if data == nil {
+			return nil
+		}
+		if same, err := e.sameContent(s.Path, attr, data); err != nil || same {
+			return err
+		}
+		op = EnsureWrite
+	}
+
+	e.act(op, s.Path, fmt.Sprintf("%d bytes", len(data)))
+	if e.opts.DryRun {
+		return nil
+	}
+
+	// the mode of a file written over is left to attrs
+	m := Mutation{Op: OpCreate, Path: s.Path, Mode: specMode(s.Mode, 0644), Data: data}
+	return m.Apply(e.v)
+}
+
+// content returns the data of file s, nil if the spec has none
+func (s *SpecEntry) content() ([]byte, error) {
+	switch {
+	case s.Content != nil:
+		return s.Content, nil
+	case s.Source != "":
+		return ioutil.ReadFile(s.Source)
+	case s.Open != nil:
+		r, err := s.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+
+	return nil, nil
+}
+
+// sameContent reports whether file path of attributes attr holds data
+func (e *ensurer) sameContent(path string, attr *Fattr, data []byte) (bool, error) {
+	if attr.Filesize != uint64(len(data)) {
+		return false, nil
+	}
+
+	f, err := e.v.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	have, err := ioutil.ReadAll(f)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(have, data), nil
+}
+
+// attrs sets the mode and owner of the entry of s to those of the spec
+func (e *ensurer) attrs(s *SpecEntry, attr *Fattr, fh []byte) error {
+	var sattr Sattr3
+	var changed bool
+
+	if s.Mode != 0 && s.Type != SpecSymlink {
+		if mode := ModeBits(s.Mode); attr.FileMode&ModeMask != mode {
+			e.act(EnsureChmod, s.Path, fmt.Sprintf("%04o -> %04o", attr.FileMode&ModeMask, mode))
+			sattr.Mode = SetMode{SetIt: true, Mode: mode}
+			changed = true
+		}
+	}
+
+	uid, gid := attr.UID, attr.GID
+	if s.UID != nil && *s.UID != attr.UID {
+		uid = *s.UID
+		sattr.UID = SetUID{SetIt: true, UID: uid}
+	}
+	if s.GID != nil && *s.GID != attr.GID {
+		gid = *s.GID
+		sattr.GID = SetUID{SetIt: true, UID: gid}
+	}
+	if sattr.UID.SetIt || sattr.GID.SetIt {
+		e.act(EnsureChown, s.Path, fmt.Sprintf("%d:%d -> %d:%d", attr.UID, attr.GID, uid, gid))
+		changed = true
+	}
+
+	if !changed || e.opts.DryRun {
+		return nil
+	}
+	return e.v.SetAttrByFh(fh, sattr)
+}
+
+func specMode(mode, def os.FileMode) os.FileMode {
+	if mode == 0 {
+		return def
+	}
+	return mode
+}
+
@@ -0,0 +1,104 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEnsureTree(t *testing.T) {
+	v := loopbackTarget(t)
+	if _, err := v.Mkdir("/app", 0777); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, v, "/app/config", "old")
+
+	uid := uint32(1000)
+	spec := &TreeSpec{Entries: []SpecEntry{
+		{Path: "/app/data/cache", Type: SpecDir, Mode: 0700},
+		{Path: "/app/config", Type: SpecFile, Content: []byte("new"), Mode: 0600},
+		{Path: "/app", Type: SpecDir, Mode: 0755, UID: &uid},
+		{Path: "/app/current", Type: SpecSymlink, Target: "data"},
+		{Path: "/app/empty", Type: SpecFile},
+		{Path: "/app/data/seed", Type: SpecFile, Open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("seed")), nil
+		}},
+	}}
+
+	ops := func(r *EnsureReport) []string {
+		var s []string
+		for _, a := range r.Actions {
+			s = append(s, a.Op+" "+a.Path)
+		}
+		return s
+	}
+	want := []string{
+		"chmod /app",
+		"chown /app",
+		"write /app/config",
+		"chmod /app/config",
+		"symlink /app/current",
+		"mkdir /app/data",
+		"mkdir /app/data/cache",
+		"create /app/data/seed",
+		"create /app/empty",
+	}
+
+	dry, err := v.EnsureTreeWithOptions(spec, EnsureOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ops(dry); !reflect.DeepEqual(got, want) {
+		t.Errorf("dry run:\n%s", strings.Join(got, "\n"))
+	}
+	if got := readAll(t, v, "/app/config"); got != "old" {
+		t.Errorf("dry run wrote %q", got)
+	}
+
+	r, err := v.EnsureTree(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ops(r); !reflect.DeepEqual(got, want) {
+		t.Errorf("actions:\n%s", strings.Join(got, "\n"))
+	}
+
+	attr, _, err := v.GetAttr("/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attr.FileMode&0777 != 0755 || attr.UID != 1000 {
+		t.Errorf("/app: %04o %d", attr.FileMode, attr.UID)
+	}
+	if attr, _, err = v.GetAttr("/app/data/cache"); err != nil || attr.FileMode&0777 != 0700 {
+		t.Errorf("/app/data/cache: %v %v", attr, err)
+	}
+	if got := readAll(t, v, "/app/config"); got != "new" {
+		t.Errorf("/app/config = %q", got)
+	}
+	if target, err := v.Readlink("/app/current"); err != nil || target != "data" {
+		t.Errorf("/app/current -> %q, %v", target, err)
+	}
+
+	// idempotent
+	if r, err = v.EnsureTree(spec); err != nil || r.Changed() {
+		t.Errorf("again: %v %v", ops(r), err)
+	}
+
+	// of another type
+	spec.Entries = []SpecEntry{{Path: "/app/config", Type: SpecDir}}
+	if _, err = v.EnsureTree(spec); err == nil {
+		t.Error("file replaced by a directory")
+	}
+	if r, err = v.EnsureTreeWithOptions(spec, EnsureOptions{Replace: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ops(r); !reflect.DeepEqual(got, []string{"replace /app/config", "mkdir /app/config"}) {
+		t.Errorf("replace: %v", got)
+	}
+}
@@ -3,8 +3,15 @@
 //
 package nfs
 
-import "os"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
 
+// nfsstat3 values, RFC 1813 section 2.6
 const (
 	NFS3Ok             = 0
 	NFS3ErrPerm        = 1
@@ -34,6 +41,7 @@ const (
 	NFS3ErrTooSmall    = 10005
 	NFS3ErrServerFault = 10006
 	NFS3ErrBadType     = 10007
+	NFS3ErrJukebox     = 10008
 )
 
 var errToName = map[uint32]string{
@@ -65,8 +73,64 @@ var errToName = map[uint32]string{
 	10005: "NFS3ERR_TOOSMALL",
 	10006: "NFS3ERR_SERVERFAULT",
 	10007: "NFS3ERR_BADTYPE",
+	10008: "NFS3ERR_JUKEBOX",
+}
+
+// errToMessage describes each nfsstat3, after RFC 1813
+var errToMessage = map[uint32]string{
+	NFS3Ok:             "success",
+	NFS3ErrPerm:        "not owner",
+	NFS3ErrNoEnt:       "no such file or directory",
+	NFS3ErrIO:          "I/O error",
+	NFS3ErrNXIO:        "no such device or address",
+	NFS3ErrAcces:       "permission denied",
+	NFS3ErrExist:       "file exists",
+	NFS3ErrXDev:        "cross-device link",
+	NFS3ErrNoDev:       "no such device",
+	NFS3ErrNotDir:      "not a directory",
+	NFS3ErrIsDir:       "is a directory",
+	NFS3ErrInval:       "invalid argument",
+	NFS3ErrFBig:        "file too large",
+	NFS3ErrNoSpc:       "no space left on device",
+	NFS3ErrROFS:        "read-only file system",
+	NFS3ErrMLink:       "too many hard links",
+	NFS3ErrNameTooLong: "file name too long",
+	NFS3ErrNotEmpty:    "directory not empty",
+	NFS3ErrDQuot:       "disk quota exceeded",
+	NFS3ErrStale:       "stale file handle",
+	NFS3ErrRemote:      "too many levels of remote in path",
+	NFS3ErrBadHandle:   "illegal file handle",
+	NFS3ErrNotSync:     "update synchronization mismatch",
+	NFS3ErrBadCookie:   "stale READDIR cookie",
+	NFS3ErrNotSupp:     "operation not supported",
+	NFS3ErrTooSmall:    "buffer or request too small",
+	NFS3ErrServerFault: "server fault",
+	NFS3ErrBadType:     "object type not supported by the server",
+	NFS3ErrJukebox:     "request not completed in time, try again later",
+}
+
+// StatusName returns the RFC 1813 name of an nfsstat3, e.g. NFS3ERR_NOENT
+func StatusName(status uint32) string {
+	if name, ok := errToName[status]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("NFS3ERR(%d)", status)
+}
+
+// StatusText returns a description of an nfsstat3, e.g. "no such file or
+// directory"
+func StatusText(status uint32) string {
+	if msg, ok := errToMessage[status]; ok {
+		return msg
+	}
+
+	return "unknown error"
 }
 
+// NFS3Error returns the error of an nfsstat3, nil for NFS3_OK.  NOENT, EXIST
+// and PERM are returned as their os counterparts, everything else as an *Error,
+// including statuses not defined by RFC 1813.
 func NFS3Error(errnum uint32) error {
 	switch errnum {
 	case NFS3Ok:
@@ -78,14 +142,10 @@ func NFS3Error(errnum uint32) error {
 	case NFS3ErrNoEnt:
 		return os.ErrNotExist
 	default:
-		if errStr, ok := errToName[errnum]; ok {
-			return &Error{
-				ErrorNum:    errnum,
-				ErrorString: errStr,
-			}
+		return &Error{
+			ErrorNum:    errnum,
+			ErrorString: StatusName(errnum),
 		}
-
-		return os.ErrInvalid
 	}
 }
 
@@ -95,11 +155,52 @@ type Error struct {
 	ErrorString string
 }
 
-func (err *Error) Error() string { return err.ErrorString }
+func (err *Error) Error() string { return err.ErrorString + ": " + StatusText(err.ErrorNum) }
+
+// Is matches the statuses that have an io/fs counterpart to it, so that
+// errors.Is(err, fs.ErrPermission) holds for NFS3ERR_ACCES, and
+// errors.Is(err, ErrFileTooLarge) for NFS3ERR_FBIG
+func (err *Error) Is(target error) bool {
+	switch target {
+	case os.ErrPermission:
+		return err.ErrorNum == NFS3ErrAcces
+	case ErrFileTooLarge:
+		return err.ErrorNum == NFS3ErrFBig
+	case os.ErrInvalid:
+		_, known := errToName[err.ErrorNum]
+		return err.ErrorNum == NFS3ErrInval || !known
+	default:
+		return false
+	}
+}
+
+// IsTransient reports whether a call that failed with err may succeed if
+// retried as is, later: the server asked for a delay with NFS3ERR_JUKEBOX, or
+// the call timed out or lost its connection.  Whether retrying is safe, for
+// calls that are not idempotent, is up to the caller.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var nfsErr *Error
+	if errors.As(err, &nfsErr) {
+		return nfsErr.ErrorNum == NFS3ErrJukebox
+	}
+
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) && timeout.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		isConnLost(err)
+}
 
 func IsNotEmptyError(err error) bool {
-	nfsErr, ok := err.(*Error)
-	if !ok {
+	var nfsErr *Error
+	if !errors.As(err, &nfsErr) {
 		return false
 	}
 
@@ -110,9 +211,20 @@ func IsNotEmptyError(err error) bool {
 	return false
 }
 
+// IsNoSpaceError reports whether err is the filesystem or the quota of the
+// user running out of space, NFS3ERR_NOSPC or NFS3ERR_DQUOT
+func IsNoSpaceError(err error) bool {
+	var nfsErr *Error
+	if !errors.As(err, &nfsErr) {
+		return false
+	}
+
+	return nfsErr.ErrorNum == NFS3ErrNoSpc || nfsErr.ErrorNum == NFS3ErrDQuot
+}
+
 func IsNotDirError(err error) bool {
-	nfsErr, ok := err.(*Error)
-	if !ok {
+	var nfsErr *Error
+	if !errors.As(err, &nfsErr) {
 		return false
 	}
 
@@ -122,3 +234,34 @@ func IsNotDirError(err error) bool {
 
 	return false
 }
+
+func IsStaleError(err error) bool {
+	var nfsErr *Error
+	if !errors.As(err, &nfsErr) {
+		return false
+	}
+
+	if nfsErr.ErrorNum == NFS3ErrStale {
+		return true
+	}
+
+	return false
+}
+
+// LookupTimeoutError is returned when a path walk runs out of time.  Component
+// is the path element that was being looked up when the deadline passed.
+type LookupTimeoutError struct {
+	Path      string
+	Component string
+	Err       error
+}
+
+func (err *LookupTimeoutError) Error() string {
+	return fmt.Sprintf("lookup %s: timed out at component %q: %s", err.Path, err.Component, err.Err)
+}
+
+func (err *LookupTimeoutError) Unwrap() error { return err.Err }
+
+// Timeout reports whether the walk ran out of time rather than being
+// cancelled, in the manner of net.Error.
+func (err *LookupTimeoutError) Timeout() bool { return err.Err != context.Canceled }
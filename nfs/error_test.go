@@ -0,0 +1,66 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestNFS3Error(t *testing.T) {
+	for status, name := range errToName {
+		if _, ok := errToMessage[status]; !ok {
+			t.Errorf("%s has no message", name)
+		}
+		if StatusName(status) != name {
+			t.Errorf("StatusName(%d) = %s, want %s", status, StatusName(status), name)
+		}
+	}
+
+	err := NFS3Error(NFS3ErrNotEmpty)
+	if err.Error() != "NFS3ERR_NOTEMPTY: directory not empty" {
+		t.Errorf("error text: %q", err)
+	}
+	if !IsNotEmptyError(fmt.Errorf("rmdir: %w", err)) {
+		t.Errorf("IsNotEmptyError does not see through wrapping")
+	}
+
+	if !errors.Is(NFS3Error(NFS3ErrAcces), fs.ErrPermission) {
+		t.Errorf("NFS3ERR_ACCES is not fs.ErrPermission")
+	}
+	if !errors.Is(NFS3Error(NFS3ErrNoEnt), fs.ErrNotExist) {
+		t.Errorf("NFS3ERR_NOENT is not fs.ErrNotExist")
+	}
+
+	unknown := NFS3Error(4242)
+	if !errors.Is(unknown, os.ErrInvalid) || unknown.(*Error).ErrorNum != 4242 {
+		t.Errorf("unknown status: %v", unknown)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{NFS3Error(NFS3ErrJukebox), true},
+		{fmt.Errorf("write: %w", NFS3Error(NFS3ErrJukebox)), true},
+		{NFS3Error(NFS3ErrIO), false},
+		{NFS3Error(NFS3ErrNoEnt), false},
+		{&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, true},
+		{fmt.Errorf("reply: %w", io.ErrUnexpectedEOF), true},
+		{&LookupTimeoutError{Path: "/a", Component: "a", Err: errors.New("deadline")}, true},
+		{errors.New("boom"), false},
+	} {
+		if got := IsTransient(c.err); got != c.want {
+			t.Errorf("IsTransient(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// EventType is what happened to a target, see SetEventHandler
+type EventType int
+
+const (
+	// EventConnected: a lost connection was dialed again
+	EventConnected EventType = iota
+
+	// EventDisconnected: a connection was found lost, Err says how
+	EventDisconnected
+
+	// EventReconnecting: a lost connection is being dialed again
+	EventReconnecting
+
+	// EventMountRefreshed: the export was mounted again under a new root
+	// handle, see SetRemountAfter
+	EventMountRefreshed
+
+	// EventServerRebootDetected: the write verifier of the server changed,
+	// data written unstable and not committed may be lost
+	EventServerRebootDetected
+)
+
+var eventNames = map[EventType]string{
+	EventConnected:            "connected",
+	EventDisconnected:         "disconnected",
+	EventReconnecting:         "reconnecting",
+	EventMountRefreshed:       "mount refreshed",
+	EventServerRebootDetected: "server reboot detected",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventNames[t]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("event %d", int(t))
+}
+
+// Event is a change in the state of a target or of its connections
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Addr is the server end of the connection
+	Addr net.Addr
+
+	// Err is why a connection was lost, or why dialing it again failed
+	Err error
+
+	// OldFH and NewFH are the root handles before and after a refreshed
+	// mount
+	OldFH, NewFH []byte
+
+	// OldVerf and NewVerf are the write verifiers before and after a
+	// server reboot
+	OldVerf, NewVerf uint64
+}
+
+// EventHandler is called with each event of a target.  It is called
+// synchronously from the call that noticed the event, so it must not block
+// for long.
+type EventHandler func(ev *Event)
+
+// SetEventHandler has fn called with the events of the target, instead of
+// leaving them to be inferred from errors.  Nil, the default, drops them.
+func (v *Target) SetEventHandler(fn EventHandler) {
+	v.eventMu.Lock()
+	defer v.eventMu.Unlock()
+
+	v.eventHandler = fn
+}
+
+// EventChannel returns a handler sending events to ch, for SetEventHandler.
+// Events are dropped while ch is full rather than holding calls up.
+func EventChannel(ch chan<- Event) EventHandler {
+	return func(ev *Event) {
+		select {
+		case ch <- *ev:
+		default:
+			util.Debugf("event %s dropped, channel full", ev.Type)
+		}
+	}
+}
+
+// SetAutoReconnect has a connection found lost dialed again to the same
+// address, port and TLS configuration, so that the calls after the one that
+// failed succeed.  The call that found the connection lost fails anyway,
+// whether it reached the server is unknown.  Off by default.
+func (v *Target) SetAutoReconnect(on bool) {
+	v.eventMu.Lock()
+	defer v.eventMu.Unlock()
+
+	v.reconnect = on
+}
+
+// emit hands ev to the event handler, if any
+func (v *Target) emit(ev *Event) {
+	v.eventMu.Lock()
+	fn := v.eventHandler
+	v.eventMu.Unlock()
+
+	if fn == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	fn(ev)
+}
+
+// isConnLostError reports whether err says the connection of a call is gone,
+// rather than the call failed
+func isConnLostError(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) ||
+		isConnLost(err)
+}
+
+// connState is what the target knows of one of its connections
+type connState struct {
+	// bumped each time the connection is dialed again
+	gen uint64
+
+	// whether it was found lost and not dialed again yet
+	lost bool
+}
+
+// connGen returns the generation of client, to pass to connLost should a
+// call sent now fail
+func (v *Target) connGen(client *rpc.Client) uint64 {
+	v.eventMu.Lock()
+	defer v.eventMu.Unlock()
+
+	if cs, ok := v.connStates[client]; ok {
+		return cs.gen
+	}
+
+	return 0
+}
+
+// connLost notes that a call sent on generation gen of client failed with
+// err, emits EventDisconnected the first time and dials again if asked to
+func (v *Target) connLost(client *rpc.Client, gen uint64, err error) {
+	if !isConnLostError(err) {
+		return
+	}
+
+	v.callMu.Lock()
+	closed := v.closed
+	v.callMu.Unlock()
+	if closed {
+		return
+	}
+
+	v.reconnectMu.Lock()
+	defer v.reconnectMu.Unlock()
+
+	v.eventMu.Lock()
+	if v.connStates == nil {
+		v.connStates = make(map[*rpc.Client]*connState)
+	}
+	cs, ok := v.connStates[client]
+	if !ok {
+		cs = new(connState)
+		v.connStates[client] = cs
+	}
+	reconnect := v.reconnect
+	v.eventMu.Unlock()
+
+	// another call dealt with it already
+	if cs.gen != gen {
+		return
+	}
+
+	addr := client.RemoteAddr()
+	if !cs.lost {
+		cs.lost = true
+		util.Errorf("connection to %s lost: %s", addr, err)
+		v.emit(&Event{Type: EventDisconnected, Addr: addr, Err: err})
+	}
+
+	raddr, ok := addr.(*net.TCPAddr)
+	if !reconnect || !ok {
+		return
+	}
+
+	v.emit(&Event{Type: EventReconnecting, Addr: addr})
+
+	// keep using a privileged port if the connection did
+	priv := false
+	if laddr, ok := client.LocalAddr().(*net.TCPAddr); ok {
+		priv = laddr.Port < 1024
+	}
+
+	fresh, err := dialService(raddr.IP.String(), raddr.Port, priv, client.TLSConfig())
+	if err != nil {
+		util.Errorf("reconnect to %s: %s", addr, err)
+		v.emit(&Event{Type: EventDisconnected, Addr: addr, Err: err})
+		return
+	}
+	client.Redial(fresh.Transport())
+
+	v.eventMu.Lock()
+	cs.gen++
+	cs.lost = false
+	v.eventMu.Unlock()
+
+	util.Debugf("reconnected to %s", addr)
+	v.emit(&Event{Type: EventConnected, Addr: addr})
+}
+
+// seeWriteVerf checks the write verifier of a WRITE or COMMIT reply against
+// the last one, and emits EventServerRebootDetected if it changed
+func (v *Target) seeWriteVerf(verf uint64) {
+	v.eventMu.Lock()
+	old, known := v.writeVerf, v.writeVerfSet
+	v.writeVerf, v.writeVerfSet = verf, true
+	v.eventMu.Unlock()
+
+	if known && old != verf {
+		util.Errorf("write verifier changed from %x to %x, the server rebooted", old, verf)
+		v.emit(&Event{Type: EventServerRebootDetected, Addr: v.RemoteAddr(), OldVerf: old, NewVerf: verf})
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+// tcpServer serves s on addr until stop, which also drops the connections
+func tcpServer(t *testing.T, s *Server, addr string) (net.Addr, func()) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+			go s.ServeConn(c)
+		}
+	}()
+
+	return l.Addr(), func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	fs := NewMemFS()
+	root, err := fs.Root("/")
+	if err != nil {
+		t.Fatalf("root: %s", err)
+	}
+
+	addr, stop := tcpServer(t, NewServer(fs), "127.0.0.1:0")
+	client, err := rpc.DialTCP("tcp", nil, addr.String())
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	v, err := NewTargetWithClient(client, rpc.AuthNull, root, "/")
+	if err != nil {
+		t.Fatalf("target: %s", err)
+	}
+	defer v.Close()
+
+	events := make(chan Event, 16)
+	v.SetEventHandler(EventChannel(events))
+	v.SetAutoReconnect(true)
+
+	writeFile(t, v, "/before", "data")
+
+	// the server restarts on the same port, with a new write verifier
+	stop()
+	_, stop = tcpServer(t, NewServer(fs), addr.String())
+	defer stop()
+
+	if _, err := v.FSInfo(); err == nil {
+		t.Fatalf("fsinfo over the lost connection succeeded")
+	}
+	if _, err := v.FSInfo(); err != nil {
+		t.Fatalf("fsinfo after reconnecting: %s", err)
+	}
+	writeFile(t, v, "/after", "data")
+
+	var got []EventType
+	for len(events) > 0 {
+		got = append(got, (<-events).Type)
+	}
+
+	want := []EventType{EventDisconnected, EventReconnecting, EventConnected, EventServerRebootDetected}
+	if len(got) != len(want) {
+		t.Fatalf("events %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("events %v, want %v", got, want)
+		}
+	}
+}
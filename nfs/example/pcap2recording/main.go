@@ -0,0 +1,66 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-nfs/nfsv3/nfs/pcap"
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// pcap2recording writes the exchanges of a capture as a recording, for
+// rpc.LoadRecording and rpc.NewReplayTransport
+func main() {
+	progs := flag.String("progs", "", "comma separated RPC programs to keep, all if empty")
+	debug := flag.Bool("debug", false, "log what is lost of the capture")
+	flag.Parse()
+	if flag.NArg() != 2 {
+		util.Infof("%s [-progs 100003,100005] <capture.pcap> <recording.jsonl>", os.Args[0])
+		os.Exit(-1)
+	}
+	util.DefaultLogger.SetDebug(*debug)
+
+	var opts pcap.Options
+	for _, p := range strings.Split(*progs, ",") {
+		if p == "" {
+			continue
+		}
+		prog, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			log.Fatalf("program %q: %v", p, err)
+		}
+		opts.Progs = append(opts.Progs, uint32(prog))
+	}
+
+	in, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer in.Close()
+
+	capture, err := pcap.ReadWithOptions(in, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out, err := os.Create(flag.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = rpc.WriteRecording(out, capture.Exchanges); err != nil {
+		log.Fatal(err)
+	}
+	if err = out.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	util.Infof("%d exchanges of %d packets, %d skipped, %d calls unanswered, %d gaps",
+		len(capture.Exchanges), capture.Packets, capture.Skipped, capture.Unanswered, capture.Gaps)
+}
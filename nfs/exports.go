@@ -0,0 +1,457 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	_path "path"
+	"strings"
+	"sync"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+// Squash modes of a ServerExport, the credentials its calls are served with
+const (
+	// SquashNone serves calls with the uid and gid they carry
+	SquashNone = iota
+	// SquashRoot serves those of uid 0 as the anonymous user, as
+	// root_squash does
+	SquashRoot
+	// SquashAll serves every call as the anonymous user, as all_squash does
+	SquashAll
+)
+
+// DefaultAnonID is the uid and gid of the anonymous user, nobody
+const DefaultAnonID = 65534
+
+// ServerExport is an entry of the export table of a Server, see SetExports
+type ServerExport struct {
+	// Path is the exported directory.  Clients may mount it or any
+	// directory below it.
+	Path string
+
+	// Clients are the addresses, as "192.0.2.7", and networks, as
+	// "192.0.2.0/24", allowed to mount Path; any client if there are none
+	Clients []string
+
+	// ReadOnly refuses the calls changing the filesystem with
+	// NFS3ERR_ROFS
+	ReadOnly bool
+
+	// Squash and the anonymous AnonUID and AnonGID are the credentials
+	// calls are served with; anonymous ids of 0 are DefaultAnonID
+	Squash           int
+	AnonUID, AnonGID uint32
+
+	// Flavors are the auth flavors accepted, in order of preference, those
+	// of SetAuthFlavors if there are none.  Calls of others are refused
+	// with AUTH_TOOWEAK.
+	Flavors []uint32
+}
+
+// export is a ServerExport with its clients parsed
+type export struct {
+	ServerExport
+	nets []*net.IPNet
+}
+
+// SetExports sets the export table of the server, replacing the paths given
+// to NewServer.  Mounts are refused unless the client is allowed by an
+// export of the path, and every call is then checked against the exports
+// its handles were reached under: the server binds the handles it hands out
+// to the export mounted, a handle bound to none is stale and one of no
+// export of the client refused, so that handles cannot be forged out of
+// an export.  A handle bound to several exports of the client is served as
+// the most open of them allows.  It is to be set before the server serves
+// calls.
+func (s *Server) SetExports(exports ...ServerExport) error {
+	table := make([]*export, 0, len(exports))
+	paths := make([]string, 0, len(exports))
+	for _, e := range exports {
+		x := &export{ServerExport: e}
+		x.Path = "/" + strings.Trim(e.Path, "/")
+		for _, c := range e.Clients {
+			if !strings.Contains(c, "/") {
+				ip := net.ParseIP(c)
+				if ip == nil {
+					return fmt.Errorf("export %s: bad client address %q", e.Path, c)
+				}
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				x.nets = append(x.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+			_, n, err := net.ParseCIDR(c)
+			if err != nil {
+				return fmt.Errorf("export %s: %w", e.Path, err)
+			}
+			x.nets = append(x.nets, n)
+		}
+		if x.AnonUID == 0 {
+			x.AnonUID = DefaultAnonID
+		}
+		if x.AnonGID == 0 {
+			x.AnonGID = DefaultAnonID
+		}
+
+		table = append(table, x)
+		paths = append(paths, x.Path)
+	}
+
+	s.table = table
+	s.exports = paths
+	if s.bound == nil {
+		s.bound = &boundBackend{Backend: s.backend}
+		s.backend = s.bound
+	}
+	s.bound.reset()
+
+	return nil
+}
+
+// boundBackend is the backend of a server with an export table, binding the
+// handles it hands out to the exports of the handles they were reached from
+type boundBackend struct {
+	Backend
+
+	sync.Mutex
+	under map[string][]*export
+}
+
+func (b *boundBackend) reset() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.under = make(map[string][]*export)
+}
+
+// bind adds exports xs to those of fh
+func (b *boundBackend) bind(fh []byte, xs ...*export) {
+	b.Lock()
+	defer b.Unlock()
+
+	have := b.under[string(fh)]
+next:
+	for _, x := range xs {
+		for _, h := range have {
+			if h == x {
+				continue next
+			}
+		}
+		have = append(have, x)
+	}
+	b.under[string(fh)] = have
+}
+
+// exports returns the exports fh is bound to
+func (b *boundBackend) exports(fh []byte) []*export {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.under[string(fh)]
+}
+
+// inherit binds fh, reached from dir, to the exports of dir
+func (b *boundBackend) inherit(dir, fh []byte, err error) ([]byte, error) {
+	if err == nil {
+		b.bind(fh, b.exports(dir)...)
+	}
+	return fh, err
+}
+
+func (b *boundBackend) Lookup(dir []byte, name string) ([]byte, error) {
+	fh, err := b.Backend.Lookup(dir, name)
+	return b.inherit(dir, fh, err)
+}
+
+func (b *boundBackend) Create(dir []byte, name string, attr Sattr3, guarded bool) ([]byte, error) {
+	fh, err := b.Backend.Create(dir, name, attr, guarded)
+	return b.inherit(dir, fh, err)
+}
+
+func (b *boundBackend) Mkdir(dir []byte, name string, attr Sattr3) ([]byte, error) {
+	fh, err := b.Backend.Mkdir(dir, name, attr)
+	return b.inherit(dir, fh, err)
+}
+
+func (b *boundBackend) Symlink(dir []byte, name, target string, attr Sattr3) ([]byte, error) {
+	fh, err := b.Backend.Symlink(dir, name, target, attr)
+	return b.inherit(dir, fh, err)
+}
+
+// callHandles returns the handles in the arguments of a call of NFS
+// procedure proc, and the arguments to serve it from
+func callHandles(proc uint32, args io.Reader) ([][]byte, io.Reader, error) {
+	rs, ok := args.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(args)
+		if err != nil {
+			return nil, nil, err
+		}
+		rs = bytes.NewReader(data)
+	}
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// every procedure but NULL has a handle first, RENAME and LINK another
+	fh, err := readHandle(rs)
+	if err != nil {
+		return nil, nil, err
+	}
+	fhs := [][]byte{fh}
+	switch proc {
+	case NFSProc3Rename:
+		if _, err = readString(rs); err != nil {
+			return nil, nil, err
+		}
+		fallthrough
+	case NFSProc3Link:
+		if fh, err = readHandle(rs); err != nil {
+			return nil, nil, err
+		}
+		fhs = append(fhs, fh)
+	}
+
+	if _, err = rs.Seek(start, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	return fhs, rs, nil
+}
+
+// remoteIP returns the address of the client of a call, nil if it has none,
+// as over a pipe
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// allows tells whether the client of address ip may use the export
+func (x *export) allows(ip net.IP) bool {
+	if len(x.nets) == 0 {
+		return true
+	}
+	for _, n := range x.nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// accepts tells whether the export takes credentials of flavor, those of
+// flavors if it sets none
+func (x *export) accepts(flavor uint32, flavors []uint32) bool {
+	if len(x.Flavors) > 0 {
+		flavors = x.Flavors
+	}
+	for _, f := range flavors {
+		if f == flavor {
+			return true
+		}
+	}
+	return false
+}
+
+// under tells whether dirpath is the path of the export or below it
+func (x *export) under(dirpath string) bool {
+	return x.Path == "/" || dirpath == x.Path || strings.HasPrefix(dirpath, x.Path+"/")
+}
+
+// mountPath returns dirpath, of a MNT, cleaned, false if it has a ".."
+// component, which is refused rather than resolved
+func mountPath(dirpath string) (string, bool) {
+	for _, c := range strings.Split(dirpath, "/") {
+		if c == ".." {
+			return "", false
+		}
+	}
+	return _path.Clean("/" + dirpath), true
+}
+
+// mountExport returns the export a client may mount dirpath, cleaned, from,
+// the deepest, and the mountstat3 to refuse the mount with if there is none
+func (s *Server) mountExport(call *rpc.ServerCall, dirpath string) (*export, uint32) {
+	ip := remoteIP(call.RemoteAddr)
+
+	var found *export
+	status := uint32(MNT3ErrNoEnt)
+	for _, x := range s.table {
+		if !x.under(dirpath) {
+			continue
+		}
+		if !x.allows(ip) || !x.accepts(call.Cred.Flavor, s.flavors) {
+			status = MNT3ErrAcces
+			continue
+		}
+		if found == nil || len(x.Path) > len(found.Path) {
+			found = x
+		}
+	}
+	if found == nil {
+		return nil, status
+	}
+
+	return found, MNT3Ok
+}
+
+// grant is what a call may do, and as whom
+type grant struct {
+	readOnly bool
+
+	// uid and gid are those the call is served as, and squashed set if
+	// they are not those of its credential
+	uid, gid uint32
+	squashed bool
+	unix     bool
+}
+
+// grant returns what call may do under the exports its handles fhs are bound
+// to, or those of the whole table if it has none, nil if there is no export
+// table.  A handle bound to no export is stale, a client allowed by none of
+// those of a handle is refused with NFS3ERR_ACCES, a credential of a flavor
+// none of them accepts with AUTH_TOOWEAK.  A call of several handles is
+// read-only if one of them is.
+func (s *Server) grant(call *rpc.ServerCall, fhs ...[]byte) (*grant, uint32, error) {
+	if s.table == nil {
+		return nil, NFS3Ok, nil
+	}
+	if len(fhs) == 0 {
+		return s.grantOf(call, s.table)
+	}
+
+	var g *grant
+	for _, fh := range fhs {
+		xs := s.bound.exports(fh)
+		if len(xs) == 0 {
+			return nil, NFS3ErrStale, nil
+		}
+		fg, status, err := s.grantOf(call, xs)
+		if status != NFS3Ok || err != nil {
+			return nil, status, err
+		}
+		if g == nil {
+			g = fg
+		} else {
+			g.readOnly = g.readOnly || fg.readOnly
+		}
+	}
+
+	return g, NFS3Ok, nil
+}
+
+// grantOf returns what call may do under exports xs, the most open of those
+// of its client
+func (s *Server) grantOf(call *rpc.ServerCall, xs []*export) (*grant, uint32, error) {
+	var cred *rpc.AuthUnix
+	if call.Cred.Flavor == rpc.AuthFlavorUnix {
+		cred, _ = rpc.ParseAuthUnix(call.Cred)
+	}
+
+	ip := remoteIP(call.RemoteAddr)
+	var g *grant
+	allowed := false
+	for _, x := range xs {
+		if !x.allows(ip) {
+			continue
+		}
+		allowed = true
+		if !x.accepts(call.Cred.Flavor, s.flavors) {
+			continue
+		}
+
+		xg := &grant{readOnly: x.ReadOnly, uid: x.AnonUID, gid: x.AnonGID, squashed: true}
+		if cred != nil && (x.Squash == SquashNone || x.Squash == SquashRoot && cred.Uid != 0) {
+			xg.uid, xg.gid, xg.squashed, xg.unix = cred.Uid, cred.Gid, false, true
+		}
+
+		// the most open of the exports: writable, and unsquashed, if one is
+		switch {
+		case g == nil:
+			g = xg
+		case g.squashed && !xg.squashed:
+			xg.readOnly = xg.readOnly && g.readOnly
+			g = xg
+		default:
+			g.readOnly = g.readOnly && xg.readOnly
+		}
+	}
+
+	switch {
+	case !allowed:
+		return nil, NFS3ErrAcces, nil
+	case g == nil:
+		return nil, NFS3Ok, &rpc.AuthError{Flavor: call.Cred.Flavor, Status: rpc.AuthTooWeak}
+	}
+
+	return g, NFS3Ok, nil
+}
+
+// modifying tells the procedures a read-only export refuses
+func modifying(proc uint32) bool {
+	switch proc {
+	case NFSProc3SetAttr, NFSProc3Write, NFSProc3Create, NFSProc3Mkdir, NFSProc3Symlink,
+		NFSProc3MkNod, NFSProc3Remove, NFSProc3RmDir, NFSProc3Rename, NFSProc3Link:
+		return true
+	}
+	return false
+}
+
+// grantedArgs are the arguments of a call served under an export table,
+// with what it was granted
+type grantedArgs struct {
+	io.Reader
+	grant *grant
+}
+
+// callGrant returns the grant the arguments of a call were passed with, nil
+// if the server has no export table
+func callGrant(args io.Reader) *grant {
+	if a, ok := args.(*grantedArgs); ok {
+		return a.grant
+	}
+	return nil
+}
+
+// own has the entry made with attr owned by whom the call is served as,
+// unless the client set its owner itself and is not squashed
+func own(args io.Reader, attr *Sattr3) {
+	g := callGrant(args)
+	if g == nil || !g.unix && !g.squashed {
+		return
+	}
+
+	if g.squashed || !attr.UID.SetIt {
+		attr.UID = SetUID{SetIt: true, UID: g.uid}
+	}
+	if g.squashed || !attr.GID.SetIt {
+		attr.GID = SetUID{SetIt: true, UID: g.gid}
+	}
+}
+
+// squashedChown tells whether attr changes the owner in a call of a squashed
+// client, which may not
+func squashedChown(args io.Reader, attr Sattr3) bool {
+	g := callGrant(args)
+	return g != nil && g.squashed && (attr.UID.SetIt || attr.GID.SetIt)
+}
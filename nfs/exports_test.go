@@ -0,0 +1,122 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+// serveTCP serves s on a port of 127.0.0.1 and returns a Mount dialing it
+func serveTCP(t *testing.T, s *Server) func() *Mount {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.Serve(l)
+
+	return func() *Mount {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Mount{Client: rpc.NewClient(conn)}
+	}
+}
+
+func TestExports(t *testing.T) {
+	s := NewServer(NewMemFS())
+	err := s.SetExports(
+		ServerExport{Path: "/", Clients: []string{"10.0.0.0/8"}},
+		ServerExport{Path: "/pub", Clients: []string{"127.0.0.1"}, ReadOnly: true},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetExports(ServerExport{Path: "/", Clients: []string{"not an address"}}); err == nil {
+		t.Error("bad client accepted")
+	}
+	dial := serveTCP(t, s)
+
+	exports, err := dial().Exports()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exports) != 2 || exports[1].Dir != "/pub" || len(exports[1].Groups) != 1 || exports[1].Groups[0] != "127.0.0.1" {
+		t.Errorf("exports = %+v", exports)
+	}
+
+	if _, err = dial().Mount("/", rpc.AuthNull); err == nil {
+		t.Error("mounted / from a client not allowed")
+	}
+	if _, err = dial().Mount("/pub/../etc", rpc.AuthNull); err == nil {
+		t.Error("mounted /pub/../etc")
+	}
+	v, err := dial().Mount("/pub/docs", rpc.AuthNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	if _, _, err = v.Lookup("/"); err != nil {
+		t.Errorf("lookup: %v", err)
+	}
+	var nfsErr *Error
+	if _, err = v.Mkdir("/d", 0755); !errors.As(err, &nfsErr) || nfsErr.ErrorNum != NFS3ErrROFS {
+		t.Errorf("mkdir on a read-only export: %v", err)
+	}
+}
+
+func TestExportSquash(t *testing.T) {
+	s := NewServer(NewMemFS())
+	if err := s.SetExports(ServerExport{Path: "/", Squash: SquashRoot, AnonUID: 99, Flavors: []uint32{rpc.AuthFlavorUnix}}); err != nil {
+		t.Fatal(err)
+	}
+	dial := serveTCP(t, s)
+
+	if _, err := dial().Mount("/", rpc.AuthNull); err == nil {
+		t.Error("mounted with AUTH_NULL")
+	}
+
+	for _, c := range []struct {
+		name      string
+		uid, gid  uint32
+		owner     uint32
+		ownerGID  uint32
+		chownFail bool
+	}{
+		{"root", 0, 0, 99, DefaultAnonID, true},
+		{"user", 1000, 100, 1000, 100, false},
+	} {
+		v, err := dial().Mount("/", rpc.NewAuthUnix("client", c.uid, c.gid).Auth())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = v.Mkdir("/"+c.name, 0755); err != nil {
+			t.Fatal(err)
+		}
+		fi, fh, err := v.Lookup("/" + c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attr := fi.(*Fattr); attr.UID != c.owner || attr.GID != c.ownerGID {
+			t.Errorf("%s: owner %d:%d", c.name, attr.UID, attr.GID)
+		}
+
+		err = v.SetAttrByFh(fh, Sattr3{UID: SetUID{SetIt: true, UID: 5}})
+		if c.chownFail != (err != nil) {
+			t.Errorf("%s: chown: %v", c.name, err)
+		}
+		if c.chownFail && !os.IsPermission(err) {
+			t.Errorf("%s: chown: %v", c.name, err)
+		}
+		v.Close()
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"fmt"
+	"os"
+	_path "path"
+	"path/filepath"
+	"sync"
+)
+
+// madeDir is a directory made ahead of the walk, see fanout
+type madeDir struct {
+	fh      []byte
+	asOwner bool
+}
+
+// fanoutDir is a directory to make by fanout, below one made already
+type fanoutDir struct {
+	local  string
+	rel    string
+	fi     os.FileInfo
+	parent []byte
+	made   madeDir
+	err    error
+}
+
+// fanout makes the directories below local directory local in directory fh,
+// level by level, UploadOptions.DirFanout at a time, and notes their handles
+// for the walk.  A directory is only made once its parent is, which the
+// levels see to.
+func (u *uploader) fanout(local string, fh []byte) error {
+	u.made = make(map[string]madeDir)
+	level := []*fanoutDir{{local: local, made: madeDir{fh: fh}}}
+	for len(level) > 0 {
+		var next []*fanoutDir
+		for _, d := range level {
+			entries, err := os.ReadDir(d.local)
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				if !e.IsDir() {
+					continue
+				}
+				fi, err := e.Info()
+				if err != nil {
+					return err
+				}
+				next = append(next, &fanoutDir{
+					local:  filepath.Join(d.local, e.Name()),
+					rel:    _path.Join(d.rel, e.Name()),
+					fi:     fi,
+					parent: d.made.fh,
+				})
+			}
+		}
+
+		u.mkdirs(next)
+		for _, d := range next {
+			if d.err != nil {
+				return fmt.Errorf("upload %s: %w", d.rel, d.err)
+			}
+			u.made[d.rel] = d.made
+		}
+		level = next
+	}
+
+	return nil
+}
+
+// mkdirs makes dirs, UploadOptions.DirFanout at a time
+func (u *uploader) mkdirs(dirs []*fanoutDir) {
+	work := make(chan *fanoutDir)
+	var wg sync.WaitGroup
+	for i := 0; i < u.opts.DirFanout && i < len(dirs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range work {
+				name := _path.Base(d.rel)
+				d.made.fh, d.made.asOwner, d.err = u.create(d.parent, name, u.owner(d.fi), func() ([]byte, error) {
+					return u.v.MkdirByParentFh(d.parent, name, d.fi.Mode())
+				})
+			}
+		}()
+	}
+
+	for _, d := range dirs {
+		work <- d
+	}
+	close(work)
+	wg.Wait()
+}
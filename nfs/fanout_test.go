@@ -0,0 +1,66 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+func TestUploadDirFanout(t *testing.T) {
+	local := t.TempDir()
+	for i := 0; i < 27; i++ {
+		dir := filepath.Join(local, fmt.Sprint(i/9), fmt.Sprint(i/3%3), fmt.Sprint(i%3))
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "f"), []byte("data"), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := NewServer(NewMemFS())
+	var mu sync.Mutex
+	var procs []uint32
+	s.Register(Nfs3Prog, Nfs3Vers, func(call *rpc.ServerCall, w io.Writer) error {
+		if call.Proc == NFSProc3Mkdir || call.Proc == NFSProc3Create {
+			mu.Lock()
+			procs = append(procs, call.Proc)
+			mu.Unlock()
+		}
+		return s.serveNFS(call, w)
+	})
+	v, err := DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	res, err := UploadTree(local, &TreeRef{v, "/"}, UploadOptions{DirFanout: 8})
+	if err != nil {
+		t.Fatalf("upload: %s", err)
+	}
+	if res.Dirs != 39 || res.Files != 27 {
+		t.Errorf("result: %+v", res)
+	}
+
+	// every directory first, each once
+	if len(procs) != 39+27 {
+		t.Fatalf("%d MKDIR and CREATE calls, want %d", len(procs), 39+27)
+	}
+	for i, proc := range procs {
+		if (i < 39) != (proc == NFSProc3Mkdir) {
+			t.Fatalf("call %d is %s", i, ProcName(proc))
+		}
+	}
+	if got := readAll(t, v, "/2/1/0/f"); got != "data" {
+		t.Errorf("read %q", got)
+	}
+}
@@ -4,8 +4,11 @@
 package nfs
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"os"
 
 	"github.com/go-nfs/nfsv3/nfs/rpc"
@@ -25,6 +28,18 @@ type File struct {
 
 	// filehandle to the file
 	fh []byte
+
+	// whether the file was written to, and needs a commit on Close
+	written bool
+
+	// data written unstable and not committed yet, and the write verifier
+	// it was written under, see SetWriteBehind
+	uncommitted     []uncommittedWrite
+	uncommittedSize int
+	verf            uint64
+
+	// held is what of the memory budget the data kept accounts for
+	held int64
 }
 
 // Readlink gets the target of a symlink
@@ -69,6 +84,28 @@ func (f *File) Readlink() (string, error) {
 }
 
 func (f *File) Read(p []byte) (int, error) {
+	if f.dataCache != nil {
+		return f.readCached(p)
+	}
+
+	readSize := min(f.fsinfo.RTPref, len32(p))
+
+	// the reply is buffered in full before it is copied out
+	reserved := f.acquire(int(readSize))
+	n, eof, _, err := f.readAt(p[:readSize], f.curr)
+	f.release(reserved)
+	f.curr += uint64(n)
+	if err == nil && eof {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// readAt issues a single READ for up to len(p) bytes at offset.  It returns
+// the number of bytes read, whether the server reported EOF and the post-op
+// attributes of the file if the server sent them.
+func (f *File) readAt(p []byte, offset uint64) (int, bool, *Fattr, error) {
 	type ReadArgs struct {
 		rpc.Header
 		FH     []byte
@@ -76,17 +113,8 @@ func (f *File) Read(p []byte) (int, error) {
 		Count  uint32
 	}
 
-	type ReadRes struct {
-		Attr  PostOpAttr
-		Count uint32
-		EOF   uint32
-		Data  struct {
-			Length uint32
-		}
-	}
-
-	readSize := min(f.fsinfo.RTPref, uint32(len(p)))
-	util.Debugf("read(%x) len=%d offset=%d", f.fh, readSize, f.curr)
+	readSize := uint32(len(p))
+	util.Debugf("read(%x) len=%d offset=%d", f.fh, readSize, offset)
 
 	r, err := f.call(&ReadArgs{
 		Header: rpc.Header{
@@ -98,101 +126,184 @@ func (f *File) Read(p []byte) (int, error) {
 			Verf:    rpc.AuthNull,
 		},
 		FH:     f.fh,
-		Offset: uint64(f.curr),
+		Offset: offset,
 		Count:  readSize,
 	})
 
 	if err != nil {
 		util.Debugf("read(%x): %s", f.fh, err.Error())
-		return 0, err
+		return 0, false, nil, err
 	}
 
-	readres := &ReadRes{}
+	readres := &readRes{}
 	if err = xdr.Read(r, readres); err != nil {
-		return 0, err
+		return 0, false, nil, err
 	}
 
-	f.curr = f.curr + uint64(readres.Data.Length)
-	n, err := r.Read(p[:readres.Data.Length])
-	if err != nil {
-		return n, err
+	var attr *Fattr
+	if readres.Attr.IsSet {
+		attr = &readres.Attr.Attr
+		f.cache.putAttr(f.fh, attr)
 	}
 
-	if readres.EOF != 0 {
-		err = io.EOF
+	if readres.Data.Length > uint32(len(p)) {
+		return 0, false, attr, fmt.Errorf("read(%x): server returned %d bytes, asked for %d", f.fh, readres.Data.Length, len(p))
 	}
 
-	return n, err
+	n, err := io.ReadFull(r, p[:readres.Data.Length])
+	f.stats.addRead(n)
+	if err != nil {
+		return n, false, attr, err
+	}
+
+	return n, readres.EOF != 0, attr, nil
 }
 
 func (f *File) Write(p []byte) (int, error) {
-	type WriteArgs struct {
-		rpc.Header
-		FH     []byte
-		Offset uint64
-		Count  uint32
+	totalToWrite := uint64(len(p))
+	written := uint64(0)
+	if err := f.checkFileSize(f.curr, totalToWrite); err != nil {
+		return 0, err
+	}
 
-		// UNSTABLE(0), DATA_SYNC(1), FILE_SYNC(2) default
-		How      uint32
-		Contents []byte
+	if f.dataCache != nil {
+		defer f.dataCache.invalidate(f.fh)
 	}
 
-	type WriteRes struct {
-		Wcc       WccData
-		Count     uint32
-		How       uint32
-		WriteVerf uint64
+	// with write-behind, data is written unstable and kept until committed
+	how := uint32(FileSync)
+	if f.writeBehindSize() > 0 {
+		how = Unstable
 	}
 
-	totalToWrite := uint32(len(p))
-	written := uint32(0)
+	ev := f.opBegin(AuditEvent{Proc: NFSProc3Write, FH: f.fh})
+	f.written = true
 
 	for written = 0; written < totalToWrite; {
-		writeSize := min(f.fsinfo.WTPref, totalToWrite-written)
-
-		res, err := f.call(&WriteArgs{
-			Header: rpc.Header{
-				Rpcvers: 2,
-				Prog:    Nfs3Prog,
-				Vers:    Nfs3Vers,
-				Proc:    NFSProc3Write,
-				Cred:    f.auth,
-				Verf:    rpc.AuthNull,
-			},
-			FH:       f.fh,
-			Offset:   f.curr,
-			Count:    writeSize,
-			How:      2,
-			Contents: p[written : written+writeSize],
-		})
-
-		if err != nil {
-			util.Errorf("write(%x): %s", f.fh, err.Error())
-			return int(written), err
+		writeSize := f.fsinfo.WTPref
+		if left := totalToWrite - written; left < uint64(writeSize) {
+			writeSize = uint32(left)
 		}
 
-		writeres := &WriteRes{}
-		if err = xdr.Read(res, writeres); err != nil {
-			util.Errorf("write(%x) failed to parse result: %s", f.fh, err.Error())
-			util.Debugf("write(%x) partial result: %+v", f.fh, writeres)
+		chunk := p[written : written+uint64(writeSize)]
+
+		// the data written unstable is accounted for as long as it is kept
+		var reserved int64
+		if how == Unstable {
+			if err := f.hold(len(chunk)); err != nil {
+				ev.Count = written
+				f.opEnd(ev, err)
+				return int(written), err
+			}
+		} else {
+			reserved = f.acquire(len(chunk))
+		}
+		writeres, err := f.writeAt(ev, chunk, f.curr, how)
+		f.release(reserved)
+		if err != nil {
+			f.settle()
+			ev.Count = written
+			f.opEnd(ev, err)
 			return int(written), err
 		}
+		ev.Attr = writeres.Wcc.After.attr()
 
-		if writeres.Count != writeSize {
-			util.Debugf("write(%x) did not write full data payload: sent: %d, written: %d", writeSize, writeres.Count)
+		if how == Unstable {
+			if err = f.keep(chunk[:writeres.Count], f.curr, writeres); err != nil {
+				ev.Count = written
+				f.opEnd(ev, err)
+				return int(written), err
+			}
 		}
 
 		f.curr += uint64(writeres.Count)
-		written += writeres.Count
+		written += uint64(writeres.Count)
+		f.stats.addWritten(int(writeres.Count))
 
 		util.Debugf("write(%x) len=%d new_offset=%d written=%d total=%d", f.fh, totalToWrite, f.curr, writeres.Count, written)
 	}
 
+	ev.Count = written
+	f.opEnd(ev, nil)
 	return int(written), nil
 }
 
-// Close commits the file
+// writeAt sends a single WRITE of p at offset, stable as how says, for the
+// operation of ev if not nil, and fails unless some of it was written.  The
+// caller accounts p against the memory budget, the call being marshalled into
+// its own buffer before it is sent.
+func (f *File) writeAt(ev *OpEvent, p []byte, offset uint64, how uint32) (*writeRes, error) {
+	type WriteArgs struct {
+		rpc.Header
+		FH     []byte
+		Offset uint64
+		Count  uint32
+
+		// UNSTABLE(0), DATA_SYNC(1), FILE_SYNC(2) default
+		How      uint32
+		Contents []byte
+	}
+
+	res, err := f.callOp(ev, &WriteArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    Nfs3Prog,
+			Vers:    Nfs3Vers,
+			Proc:    NFSProc3Write,
+			Cred:    f.auth,
+			Verf:    rpc.AuthNull,
+		},
+		FH:       f.fh,
+		Offset:   offset,
+		Count:    uint32(len(p)),
+		How:      how,
+		Contents: p,
+	})
+
+	if err != nil {
+		util.Errorf("write(%x): %s", f.fh, err.Error())
+		return nil, err
+	}
+
+	writeres := &writeRes{}
+	if err = xdr.Read(res, writeres); err != nil {
+		util.Errorf("write(%x) failed to parse result: %s", f.fh, err.Error())
+		util.Debugf("write(%x) partial result: %+v", f.fh, writeres)
+		return nil, err
+	}
+
+	f.cache.wcc(f.fh, &writeres.Wcc)
+	f.seeWriteVerf(writeres.WriteVerf)
+
+	if writeres.Count != uint32(len(p)) {
+		util.Debugf("write(%x) did not write full data payload: sent: %d, written: %d", f.fh, len(p), writeres.Count)
+	}
+
+	// a server writing nothing would keep us here forever, and one
+	// writing more than sent is lying
+	if writeres.Count == 0 || writeres.Count > uint32(len(p)) {
+		if writeres.Count == 0 {
+			return nil, io.ErrShortWrite
+		}
+		return nil, fmt.Errorf("write(%x): server wrote %d bytes of %d", f.fh, writeres.Count, len(p))
+	}
+
+	return writeres, nil
+}
+
+// Close commits the file, if it was written to
 func (f *File) Close() error {
+	f.handles.untrack(f)
+	if !f.written {
+		return nil
+	}
+
+	return f.commit()
+}
+
+// commitOnce sends a COMMIT of the whole file and returns the write verifier
+// of the reply
+func (f *File) commitOnce() (uint64, error) {
 	type CommitArg struct {
 		rpc.Header
 		FH     []byte
@@ -200,7 +311,8 @@ func (f *File) Close() error {
 		Count  uint32
 	}
 
-	_, err := f.call(&CommitArg{
+	ev := f.opBegin(AuditEvent{Proc: NFSProc3Commit, FH: f.fh})
+	res, err := f.callOp(ev, &CommitArg{
 		Header: rpc.Header{
 			Rpcvers: 2,
 			Prog:    Nfs3Prog,
@@ -213,11 +325,24 @@ func (f *File) Close() error {
 	})
 
 	if err != nil {
+		f.opEnd(ev, err)
 		util.Debugf("commit(%x): %s", f.fh, err.Error())
-		return err
+		return 0, err
 	}
 
-	return nil
+	var commitres struct {
+		Wcc  WccData
+		Verf uint64
+	}
+	if err = xdr.Read(res, &commitres); err != nil {
+		f.opEnd(ev, err)
+		return 0, err
+	}
+	ev.Attr = commitres.Wcc.After.attr()
+	f.seeWriteVerf(commitres.Verf)
+	f.opEnd(ev, nil)
+
+	return commitres.Verf, nil
 }
 
 // Seek sets the offset for the next Read or Write to offset, interpreted according to whence.
@@ -228,25 +353,36 @@ func (f *File) Seek(offset int64, whence int) (int64, error) {
 	// However, as we're working with the shared file system, the file
 	// size might even change between NFSPROC3_GETATTR call and
 	// Seek() call, so don't even try to validate it.
+	var base uint64
 	switch whence {
 	case io.SeekStart:
-		if offset < 0 {
-			return int64(f.curr), errors.New("offset cannot be negative")
-		}
-		f.curr = uint64(offset)
-		return int64(f.curr), nil
 	case io.SeekCurrent:
-		f.curr = uint64(int64(f.curr) + offset)
-		return int64(f.curr), nil
+		base = f.curr
 	case io.SeekEnd:
-		if f.curr < f.fattr.Filesize {
-			f.curr = f.fattr.Filesize
+		if f.fattr == nil {
+			fattr, err := f.GetAttrByFh(f.fh)
+			if err != nil {
+				return int64(f.curr), err
+			}
+			f.fattr = fattr
 		}
-		return int64(f.curr), nil
+		base = f.fattr.Filesize
 	default:
 		// This indicates serious programming error
 		return int64(f.curr), errors.New("Invalid whence")
 	}
+
+	// offsets are unsigned on the wire, but io.Seeker's are not: files are
+	// addressed up to 2^63-1 and no further
+	if base > math.MaxInt64 || (offset > 0 && int64(base) > math.MaxInt64-offset) {
+		return int64(f.curr), errors.New("offset overflows int64")
+	}
+	offset += int64(base)
+	if offset < 0 {
+		return int64(f.curr), errors.New("offset cannot be negative")
+	}
+	f.curr = uint64(offset)
+	return int64(f.curr), nil
 }
 
 // OpenFile writes to an existing file or creates one
@@ -268,13 +404,14 @@ func (v *Target) OpenFile(path string, perm os.FileMode) (*File, error) {
 		fsinfo: v.fsinfo,
 		fh:     fh,
 	}
+	v.handles.track(f, path)
 
 	return f, nil
 }
 
 // Open opens a file for reading
 func (v *Target) Open(path string) (*File, error) {
-	fattr, fh, _, _, err := v.lookupInner(v.fh, path, true, nil)
+	fattr, fh, _, _, err := v.lookupInner(context.Background(), v.root(), path, true, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -285,6 +422,7 @@ func (v *Target) Open(path string) (*File, error) {
 		fattr:  fattr,
 		fh:     fh,
 	}
+	v.handles.track(f, path)
 
 	return f, nil
 }
@@ -297,12 +435,40 @@ func (v *Target) OpenByFh(fh []byte, fattr *Fattr) (*File, error) {
 		fattr:  fattr,
 		fh:     fh,
 	}
+	v.handles.track(f, "")
 
 	return f, nil
 }
 
-// Symlink creates a symlink as where pointing to symlink
+// Symlink creates a symlink at path symlink pointing to where, as os.Symlink
+// does
 func (v *Target) Symlink(where, symlink string) (*File, error) {
+	_, _, symlinkName, fh, err := v.lookupInner(context.Background(), v.root(), symlink, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	linkFh, err := v.SymlinkByFh(fh, symlinkName, where)
+	if err != nil {
+		return nil, err
+	}
+
+	symFile := &File{
+		Target: v,
+		fsinfo: v.fsinfo,
+		fh:     linkFh,
+	}
+
+	return symFile, nil
+}
+
+// SymlinkByFh creates symlink name in directory fh pointing to target, and
+// returns its handle
+func (v *Target) SymlinkByFh(fh []byte, name string, target string) ([]byte, error) {
+	if err := v.checkName(fh, name); err != nil {
+		return nil, err
+	}
+
 	type symlinkdata3 struct {
 		SymlinkAttr Sattr3
 		SymlinkData []byte
@@ -315,17 +481,13 @@ func (v *Target) Symlink(where, symlink string) (*File, error) {
 	}
 
 	type SymlinkRes struct {
-		obj     PostOpFH3
-		objAttr PostOpAttr
+		Obj     PostOpFH3
+		ObjAttr PostOpAttr
 		Wcc     WccData
 	}
 
-	_, _, symlinkName, fh, err := v.lookupInner(v.fh, symlink, false, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	r, err := v.call(&SymlinkArgs{
+	ev := v.opBegin(AuditEvent{Proc: NFSProc3Symlink, FH: fh, Name: name})
+	r, err := v.callOp(ev, &SymlinkArgs{
 		Header: rpc.Header{
 			Rpcvers: 2,
 			Prog:    Nfs3Prog,
@@ -336,35 +498,50 @@ func (v *Target) Symlink(where, symlink string) (*File, error) {
 		},
 		Where: Diropargs3{
 			FH:       fh,
-			Filename: symlinkName,
+			Filename: name,
 		},
 		Symlink: symlinkdata3{
 			SymlinkAttr: Sattr3{},
-			SymlinkData: []byte(symlink),
+			SymlinkData: []byte(target),
 		},
 	})
 
 	if err != nil {
-		util.Debugf("Symlink(%s): %s", where, err.Error())
+		v.opEnd(ev, err)
+		v.cache.invalidate(fh)
+		util.Debugf("symlink(%x %s): %s", fh, name, err.Error())
 		return nil, err
 	}
 
+	v.cache.removeDirent(fh, name)
 	symlinkres := &SymlinkRes{}
 	if err = xdr.Read(r, symlinkres); err != nil {
+		v.opEnd(ev, err)
+		v.cache.invalidate(fh)
 		return nil, err
 	}
+	v.cache.wcc(fh, &symlinkres.Wcc)
 
-	if !symlinkres.obj.IsSet {
+	if !symlinkres.Obj.IsSet {
+		v.opEnd(ev, nil)
 		return nil, errors.New("fh not set")
 	}
 
-	symFile := &File{
-		Target: v,
-		fsinfo: v.fsinfo,
-		fh:     symlinkres.obj.FH,
+	ev.Attr = symlinkres.Wcc.After.attr()
+	ev.ObjFH = symlinkres.Obj.FH
+	ev.ObjAttr = symlinkres.ObjAttr.attr()
+	v.opEnd(ev, nil)
+
+	return symlinkres.Obj.FH, nil
+}
+
+// len32 is the length of p, up to what fits a count on the wire
+func len32(p []byte) uint32 {
+	if uint64(len(p)) > math.MaxUint32 {
+		return math.MaxUint32
 	}
 
-	return symFile, nil
+	return uint32(len(p))
 }
 
 func min(x, y uint32) uint32 {
@@ -0,0 +1,40 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrFileTooLarge is returned for writes and truncations past the maximum
+// file size of the server, whether the client or the server, as
+// NFS3ERR_FBIG, finds out
+var ErrFileTooLarge = errors.New("nfs: file too large")
+
+// MaxFileSize returns the maximum file size the server reported in FSINFO,
+// so that callers can check a file fits before they start writing it, zero if
+// the server set no limit
+func (v *Target) MaxFileSize() uint64 {
+	if v.fsinfo == nil {
+		return 0
+	}
+
+	return v.fsinfo.Size
+}
+
+// checkFileSize fails if n bytes at offset would reach past the maximum file
+// size, or past the end of a 64 bit offset
+func (v *Target) checkFileSize(offset, n uint64) error {
+	max := v.MaxFileSize()
+	if max == 0 {
+		max = 1<<64 - 1
+	}
+
+	if offset > max || n > max-offset {
+		return fmt.Errorf("%w: %d bytes at offset %d, the server allows %d", ErrFileTooLarge, n, offset, max)
+	}
+
+	return nil
+}
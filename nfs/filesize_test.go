@@ -0,0 +1,212 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+// sparseFS keeps the data of regular files as the writes that made it, so
+// that files of terabytes cost what was written to them
+type sparseFS struct {
+	*MemFS
+
+	mu    sync.Mutex
+	files map[string]*sparseFile
+}
+
+type sparseFile struct {
+	size   uint64
+	writes []sparseWrite
+}
+
+type sparseWrite struct {
+	offset uint64
+	data   []byte
+}
+
+func newSparseFS() *sparseFS {
+	return &sparseFS{MemFS: NewMemFS(), files: make(map[string]*sparseFile)}
+}
+
+func (fs *sparseFS) file(fh []byte) *sparseFile {
+	f, ok := fs.files[string(fh)]
+	if !ok {
+		f = &sparseFile{}
+		fs.files[string(fh)] = f
+	}
+
+	return f
+}
+
+func (fs *sparseFS) GetAttr(fh []byte) (*Fattr, error) {
+	attr, err := fs.MemFS.GetAttr(fh)
+	if err != nil || attr.Type != NF3Reg {
+		return attr, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	attr.Filesize = fs.file(fh).size
+
+	return attr, nil
+}
+
+func (fs *sparseFS) SetAttr(fh []byte, attr Sattr3) error {
+	if attr.Size.SetIt {
+		fs.mu.Lock()
+		fs.file(fh).size = attr.Size.Size
+		fs.mu.Unlock()
+		attr.Size.SetIt = false
+	}
+
+	return fs.MemFS.SetAttr(fh, attr)
+}
+
+func (fs *sparseFS) Write(fh []byte, offset uint64, data []byte) (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f := fs.file(fh)
+	f.writes = append(f.writes, sparseWrite{offset, append([]byte(nil), data...)})
+	if end := offset + uint64(len(data)); end > f.size {
+		f.size = end
+	}
+
+	return len(data), nil
+}
+
+func (fs *sparseFS) Read(fh []byte, offset uint64, count uint32) ([]byte, bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f := fs.file(fh)
+	if offset >= f.size {
+		return nil, true, nil
+	}
+	end := offset + uint64(count)
+	if end > f.size {
+		end = f.size
+	}
+
+	data := make([]byte, end-offset)
+	for _, w := range f.writes {
+		wend := w.offset + uint64(len(w.data))
+		if wend <= offset || w.offset >= end {
+			continue
+		}
+		lo, hi := w.offset, wend
+		if lo < offset {
+			lo = offset
+		}
+		if hi > end {
+			hi = end
+		}
+		copy(data[lo-offset:hi-offset], w.data[lo-w.offset:hi-w.offset])
+	}
+
+	return data, end == f.size, nil
+}
+
+func TestLargeOffsets(t *testing.T) {
+	v, err := DialLoopback(NewServer(newSparseFS())).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	if got := v.MaxFileSize(); got != 1<<63-1 {
+		t.Errorf("max file size %d, want 2^63-1", got)
+	}
+
+	f, err := v.OpenFile("/big", 0644)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	defer f.Close()
+
+	// past 4GiB, which a 32 bit offset anywhere on the way would wrap
+	for _, off := range []int64{5 << 30, 1 << 40, 1<<63 - 5} {
+		if _, err = f.Seek(off, io.SeekStart); err != nil {
+			t.Fatalf("seek to %d: %s", off, err)
+		}
+		if _, err = f.Write([]byte("data")); err != nil {
+			t.Fatalf("write at %d: %s", off, err)
+		}
+
+		if _, err = f.Seek(off-2, io.SeekStart); err != nil {
+			t.Fatalf("seek: %s", err)
+		}
+		buf := make([]byte, 6)
+		if _, err = io.ReadFull(f, buf); err != nil {
+			t.Fatalf("read at %d: %s", off-2, err)
+		}
+		if !bytes.Equal(buf, []byte("\x00\x00data")) {
+			t.Errorf("read %q at %d", buf, off-2)
+		}
+	}
+
+	if end, err := f.Seek(0, io.SeekEnd); err != nil || end != 1<<63-1 {
+		t.Errorf("seek to end: %d, %v", end, err)
+	}
+
+	// the last byte may be written, none past it
+	if _, err = f.Write([]byte("x")); !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("write past 2^63-1: got %v, want ErrFileTooLarge", err)
+	}
+	if _, err = f.Seek(1, io.SeekCurrent); err == nil {
+		t.Errorf("seek past 2^63-1 succeeded")
+	}
+	if _, err = f.Seek(math.MinInt64, io.SeekEnd); err == nil {
+		t.Errorf("seek to a negative offset succeeded")
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	s := NewServer(newSparseFS())
+	fsinfo := DefaultServerFSInfo
+	fsinfo.Size = 1 << 20
+	s.SetFSInfo(fsinfo)
+
+	v, err := DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	if got := v.MaxFileSize(); got != 1<<20 {
+		t.Fatalf("max file size %d, want 1MiB", got)
+	}
+
+	f, err := v.OpenFile("/file", 0644)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	defer f.Close()
+
+	f.Seek(1<<20-2, io.SeekStart)
+	if _, err = f.Write([]byte("abc")); !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("write past the limit: got %v, want ErrFileTooLarge", err)
+	}
+	_, fh, _ := v.Lookup("/file")
+	if err = v.SetAttrByFh(fh, Sattr3{Size: SetSize{SetIt: true, Size: 2 << 20}}); !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("truncate past the limit: got %v, want ErrFileTooLarge", err)
+	}
+	if _, err = v.CreateTruncate("/other", 0644, 2<<20); !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("create past the limit: got %v, want ErrFileTooLarge", err)
+	}
+
+	// a client that does not know the limit hears it from the server
+	v.fsinfo.Size = 0
+	if _, err = f.Write([]byte("abc")); !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("write past the limit of the server: got %v, want NFS3ERR_FBIG", err)
+	}
+}
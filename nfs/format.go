@@ -0,0 +1,245 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ModeString returns the type and permissions of attr as ls -l shows them,
+// as drwxr-xr-x, with s, S, t and T for the setuid, setgid and sticky bits
+func ModeString(attr *Fattr) string {
+	var b [10]byte
+
+	switch attr.Type {
+	case NF3Dir:
+		b[0] = 'd'
+	case NF3Lnk:
+		b[0] = 'l'
+	case NF3Blk:
+		b[0] = 'b'
+	case NF3Chr:
+		b[0] = 'c'
+	case NF3Sock:
+		b[0] = 's'
+	case NF3FIFO:
+		b[0] = 'p'
+	default:
+		b[0] = '-'
+	}
+
+	const rwx = "rwx"
+	for i := 0; i < 9; i++ {
+		if attr.FileMode&(1<<uint(8-i)) != 0 {
+			b[i+1] = rwx[i%3]
+		} else {
+			b[i+1] = '-'
+		}
+	}
+
+	special := func(bit uint32, i int, set byte) {
+		if attr.FileMode&bit == 0 {
+			return
+		}
+		if b[i] == 'x' {
+			b[i] = set
+		} else {
+			b[i] = set - 'a' + 'A'
+		}
+	}
+	special(ModeSetuid, 3, 's')
+	special(ModeSetgid, 6, 's')
+	special(ModeSticky, 9, 't')
+
+	return string(b[:])
+}
+
+// TypeName returns the type of attr as stat(1) names it
+func TypeName(attr *Fattr) string {
+	switch attr.Type {
+	case NF3Reg:
+		if attr.Filesize == 0 {
+			return "regular empty file"
+		}
+		return "regular file"
+	case NF3Dir:
+		return "directory"
+	case NF3Lnk:
+		return "symbolic link"
+	case NF3Blk:
+		return "block special file"
+	case NF3Chr:
+		return "character special file"
+	case NF3Sock:
+		return "socket"
+	case NF3FIFO:
+		return "fifo"
+	default:
+		return "unknown"
+	}
+}
+
+// ListFormat formats attributes for humans, as ls -l and stat(1) do
+type ListFormat struct {
+	// Users and Groups name uids and gids, and Resolver those they do not.
+	// Ids without a name are shown as numbers.
+	Users, Groups map[uint32]string
+	Resolver      IDResolver
+
+	// Now tells recent times, shown with the time of day, from those older
+	// than six months or in the future, shown with the year.  It is the time
+	// of the call if zero.
+	Now time.Time
+
+	// Location is the time zone times are shown in, local time if nil
+	Location *time.Location
+}
+
+func (lf *ListFormat) user(uid uint32) string {
+	if name, ok := lf.Users[uid]; ok {
+		return name
+	}
+	if lf.Resolver != nil {
+		if name, ok := lf.Resolver.User(uid); ok {
+			return name
+		}
+	}
+	return strconv.FormatUint(uint64(uid), 10)
+}
+
+func (lf *ListFormat) group(gid uint32) string {
+	if name, ok := lf.Groups[gid]; ok {
+		return name
+	}
+	if lf.Resolver != nil {
+		if name, ok := lf.Resolver.Group(gid); ok {
+			return name
+		}
+	}
+	return strconv.FormatUint(uint64(gid), 10)
+}
+
+func (lf *ListFormat) localTime(t NFS3Time) time.Time {
+	loc := lf.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	return t.Time().In(loc)
+}
+
+// lsTime returns t as ls -l shows it
+func (lf *ListFormat) lsTime(t NFS3Time) string {
+	now := lf.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	mtime := lf.localTime(t)
+	if mtime.After(now) || now.Sub(mtime) > 182*24*time.Hour {
+		return mtime.Format("Jan _2  2006")
+	}
+	return mtime.Format("Jan _2 15:04")
+}
+
+// lsSize returns the size column of attr: the major and minor numbers of
+// devices, the size of anything else
+func lsSize(attr *Fattr) string {
+	if attr.Type == NF3Blk || attr.Type == NF3Chr {
+		return fmt.Sprintf("%d, %d", attr.SpecData[0], attr.SpecData[1])
+	}
+	return strconv.FormatUint(attr.Filesize, 10)
+}
+
+// lsFields returns the columns of ls -l for an entry, link being the target
+// of a symlink if known.  A nil attr is shown with question marks, as ls
+// does for entries it could not stat.
+func (lf *ListFormat) lsFields(name string, attr *Fattr, link string) []string {
+	if attr == nil {
+		return []string{"-?????????", "?", "?", "?", "?", "?", name}
+	}
+
+	if attr.Type == NF3Lnk && link != "" {
+		name += " -> " + link
+	}
+
+	return []string{
+		ModeString(attr),
+		strconv.FormatUint(uint64(attr.Nlink), 10),
+		lf.user(attr.UID),
+		lf.group(attr.GID),
+		lsSize(attr),
+		lf.lsTime(attr.Mtime),
+		name,
+	}
+}
+
+// Line returns the line ls -l shows for entry name of attributes attr,
+// link being the target of a symlink, if known
+func (lf *ListFormat) Line(name string, attr *Fattr, link string) string {
+	return strings.Join(lf.lsFields(name, attr, link), " ")
+}
+
+// Lines returns the lines ls -l shows for entries, sorted by name and with
+// their columns aligned, leaving out "." and "..".  links are the targets of
+// the symlinks among them, by name, and may be nil.
+func (lf *ListFormat) Lines(entries []*EntryPlus, links map[string]string) []string {
+	var rows [][]string
+	for _, e := range entries {
+		if e.FileName == "." || e.FileName == ".." {
+			continue
+		}
+		rows = append(rows, lf.lsFields(e.FileName, e.Attr.attr(), links[e.FileName]))
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i][6] < rows[j][6] })
+
+	// numbers to the right, names to the left, as ls aligns them
+	var widths [6]int
+	for _, row := range rows {
+		for i := range widths {
+			if len(row[i]) > widths[i] {
+				widths[i] = len(row[i])
+			}
+		}
+	}
+
+	lines := make([]string, len(rows))
+	for i, row := range rows {
+		lines[i] = fmt.Sprintf("%s %*s %-*s %-*s %*s %s %s",
+			row[0], widths[1], row[1], widths[2], row[2], widths[3], row[3],
+			widths[4], row[4], row[5], row[6])
+	}
+
+	return lines
+}
+
+// Stat returns the attributes of name as stat(1) shows them, link being the
+// target of a symlink, if known
+func (lf *ListFormat) Stat(name string, attr *Fattr, link string) string {
+	var b strings.Builder
+
+	if attr.Type == NF3Lnk && link != "" {
+		fmt.Fprintf(&b, "  File: %s -> %s\n", name, link)
+	} else {
+		fmt.Fprintf(&b, "  File: %s\n", name)
+	}
+	fmt.Fprintf(&b, "  Size: %-15d Blocks: %-10d %s\n", attr.Filesize, (attr.Used+511)/512, TypeName(attr))
+	fmt.Fprintf(&b, "Device: %xh/%dd\tInode: %-11d Links: %d", attr.FSID, attr.FSID, attr.Fileid, attr.Nlink)
+	if attr.Type == NF3Blk || attr.Type == NF3Chr {
+		fmt.Fprintf(&b, "     Device type: %d,%d", attr.SpecData[0], attr.SpecData[1])
+	}
+	b.WriteByte('\n')
+	fmt.Fprintf(&b, "Access: (%04o/%s)  Uid: (%5d/%8s)   Gid: (%5d/%8s)\n",
+		attr.FileMode&ModeMask, ModeString(attr), attr.UID, lf.user(attr.UID), attr.GID, lf.group(attr.GID))
+
+	const layout = "2006-01-02 15:04:05.000000000 -0700"
+	fmt.Fprintf(&b, "Access: %s\n", lf.localTime(attr.Atime).Format(layout))
+	fmt.Fprintf(&b, "Modify: %s\n", lf.localTime(attr.Mtime).Format(layout))
+	fmt.Fprintf(&b, "Change: %s\n", lf.localTime(attr.Ctime).Format(layout))
+
+	return b.String()
+}
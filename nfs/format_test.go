@@ -0,0 +1,72 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestModeString(t *testing.T) {
+	for _, tc := range []struct {
+		typ, mode uint32
+		want      string
+	}{
+		{NF3Reg, 0644, "-rw-r--r--"},
+		{NF3Dir, 01777, "drwxrwxrwt"},
+		{NF3Reg, 04755, "-rwsr-xr-x"},
+		{NF3Reg, 02644, "-rw-r-Sr--"},
+		{NF3Lnk, 0777, "lrwxrwxrwx"},
+		{NF3Chr, 0620, "crw--w----"},
+		{NF3Dir, 01700, "drwx-----T"},
+	} {
+		if got := ModeString(&Fattr{Type: tc.typ, FileMode: tc.mode}); got != tc.want {
+			t.Errorf("%d %o: got %s, want %s", tc.typ, tc.mode, got, tc.want)
+		}
+	}
+}
+
+func TestListFormat(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	recent := NFS3Time{Seconds: uint32(now.Add(-time.Hour).Unix())}
+	old := NFS3Time{Seconds: uint32(now.AddDate(-2, 0, 0).Unix())}
+
+	entry := func(name string, attr Fattr) *EntryPlus {
+		e := &EntryPlus{FileName: name}
+		e.Attr.IsSet, e.Attr.Attr = true, attr
+		return e
+	}
+	entries := []*EntryPlus{
+		{FileName: "."},
+		entry("zeta", Fattr{Type: NF3Reg, FileMode: 0644, Nlink: 1, UID: 1000, GID: 1000, Filesize: 123456, Mtime: recent}),
+		entry("alpha", Fattr{Type: NF3Dir, FileMode: 0755, Nlink: 12, UID: 0, GID: 0, Filesize: 4096, Mtime: old}),
+		entry("link", Fattr{Type: NF3Lnk, FileMode: 0777, Nlink: 1, UID: 0, GID: 0, Filesize: 4, Mtime: recent}),
+		{FileName: "gone"},
+	}
+
+	lf := &ListFormat{Users: map[uint32]string{0: "root"}, Groups: map[uint32]string{0: "wheel"}, Now: now, Location: time.UTC}
+	want := []string{
+		"drwxr-xr-x 12 root wheel   4096 Jun  1  2022 alpha",
+		"-?????????  ? ?    ?          ? ? gone",
+		"lrwxrwxrwx  1 root wheel      4 Jun  1 11:00 link -> zeta",
+		"-rw-r--r--  1 1000 1000  123456 Jun  1 11:00 zeta",
+	}
+	if got := lf.Lines(entries, map[string]string{"link": "zeta"}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	stat := lf.Stat("zeta", &entries[1].Attr.Attr, "")
+	for _, line := range []string{
+		"  File: zeta\n",
+		"regular file\n",
+		"Access: (0644/-rw-r--r--)  Uid: ( 1000/    1000)   Gid: ( 1000/    1000)\n",
+		"Modify: 2024-06-01 11:00:00.000000000 +0000\n",
+	} {
+		if !strings.Contains(stat, line) {
+			t.Errorf("stat has no %q:\n%s", line, stat)
+		}
+	}
+}
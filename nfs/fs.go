@@ -0,0 +1,189 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	_path "path"
+	"sort"
+	"time"
+)
+
+// FS returns a read-only io/fs view of the export, rooted at its root.  It
+// implements fs.StatFS and fs.ReadDirFS, and files opened through it
+// implement io.Seeker, so it can be handed to fs.WalkDir, http.FS or
+// testing/fstest.
+func (v *Target) FS() fs.FS {
+	return &targetFS{v}
+}
+
+type targetFS struct {
+	v *Target
+}
+
+// stat looks up name, a valid fs path
+func (fsys *targetFS) stat(op, name string) (*Fattr, []byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	attr, fh, err := fsys.v.GetAttr(_path.Join("/", name))
+	if err != nil {
+		return nil, nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	return attr, fh, nil
+}
+
+func (fsys *targetFS) Open(name string) (fs.File, error) {
+	attr, fh, err := fsys.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &fsInfo{name: _path.Base(name), attr: attr}
+	if attr.IsDir() {
+		return &fsDir{fsys: fsys, path: name, fh: fh, info: info}, nil
+	}
+
+	// reads go straight to the handle, not tracked as an open file
+	return &fsFile{f: &File{Target: fsys.v, fsinfo: fsys.v.fsinfo, fattr: attr, fh: fh}, info: info}, nil
+}
+
+func (fsys *targetFS) Stat(name string) (fs.FileInfo, error) {
+	attr, _, err := fsys.stat("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fsInfo{name: _path.Base(name), attr: attr}, nil
+}
+
+func (fsys *targetFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	_, fh, err := fsys.stat("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return fsys.readDir(name, fh)
+}
+
+// readDir lists directory fh at name, sorted by name
+func (fsys *targetFS) readDir(name string, fh []byte) ([]fs.DirEntry, error) {
+	list, err := fsys.v.ReadDirPlusByFh(fh)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	entries := make([]fs.DirEntry, 0, len(list))
+	for _, e := range list {
+		if e.FileName == "." || e.FileName == ".." {
+			continue
+		}
+
+		attr := e.Attr.attr()
+		if attr == nil {
+			if attr, _, _, err = fsys.v.lookup(context.Background(), fh, e.FileName); err != nil {
+				return nil, &fs.PathError{Op: "readdir", Path: _path.Join(name, e.FileName), Err: err}
+			}
+		}
+		entries = append(entries, &fsInfo{name: e.FileName, attr: attr})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// fsFile is a regular file, or anything else that is not a directory
+type fsFile struct {
+	f    *File
+	info *fsInfo
+}
+
+func (f *fsFile) Read(p []byte) (int, error) {
+	return f.f.Read(p)
+}
+
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
+	return f.f.Seek(offset, whence)
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *fsFile) Close() error {
+	return nil
+}
+
+type fsDir struct {
+	fsys *targetFS
+	path string
+	fh   []byte
+	info *fsInfo
+
+	// entries not yet returned by ReadDir, listed on the first call
+	entries []fs.DirEntry
+	listed  bool
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.path, Err: fs.ErrInvalid}
+}
+
+func (d *fsDir) Close() error {
+	return nil
+}
+
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.listed {
+		entries, err := d.fsys.readDir(d.path, d.fh)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.listed = entries, true
+	}
+
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// fsInfo describes an entry by its attributes, as both fs.FileInfo and
+// fs.DirEntry
+type fsInfo struct {
+	name string
+	attr *Fattr
+}
+
+func (fi *fsInfo) Name() string               { return fi.name }
+func (fi *fsInfo) Size() int64                { return int64(fi.attr.Filesize) }
+func (fi *fsInfo) ModTime() time.Time         { return fi.attr.ModTime() }
+func (fi *fsInfo) IsDir() bool                { return fi.attr.IsDir() }
+func (fi *fsInfo) Sys() interface{}           { return fi.attr }
+func (fi *fsInfo) Type() fs.FileMode          { return fi.Mode().Type() }
+func (fi *fsInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+func (fi *fsInfo) Mode() fs.FileMode {
+	return FileMode(fi.attr.Type, fi.attr.FileMode)
+}
@@ -0,0 +1,61 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCrossFilesystem is returned by RemoveAll, when SetOneFilesystem is set,
+// for a directory on another filesystem than the root of the target
+var ErrCrossFilesystem = errors.New("nfs: directory on another filesystem")
+
+// pinRoot records the fsid of the root of the target, from the attributes
+// FSINFO returned if it did
+func (v *Target) pinRoot(attr *Fattr) error {
+	if attr == nil {
+		var err error
+		if attr, err = v.getAttr(v.root()); err != nil {
+			return err
+		}
+	}
+
+	v.rootFSID = attr.FSID
+	return nil
+}
+
+// RootFSID returns the fsid of the root of the target, as of the mount
+func (v *Target) RootFSID() uint64 {
+	return v.rootFSID
+}
+
+// SameFilesystem reports whether path is on the filesystem of the root of
+// the target.  Servers export nested filesystems, submounts of the exported
+// directory, under their own fsid.
+func (v *Target) SameFilesystem(path string) (bool, error) {
+	fi, _, err := v.Lookup(path)
+	if err != nil {
+		return false, err
+	}
+
+	return fi.(*Fattr).FSID == v.rootFSID, nil
+}
+
+// SetOneFilesystem has RemoveAll refuse to descend into directories on
+// another filesystem than the root of the target, as find -xdev does, and
+// fail with ErrCrossFilesystem instead of emptying a nested export
+func (v *Target) SetOneFilesystem(one bool) {
+	v.oneFS = one
+}
+
+// checkFilesystem fails with ErrCrossFilesystem if the target stays on one
+// filesystem and attr is on another
+func (v *Target) checkFilesystem(path string, attr *Fattr) error {
+	if !v.oneFS || attr == nil || attr.FSID == v.rootFSID {
+		return nil
+	}
+
+	return fmt.Errorf("%s: fsid %#x, root fsid %#x: %w", path, attr.FSID, v.rootFSID, ErrCrossFilesystem)
+}
@@ -0,0 +1,68 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+// submountFS reports the objects of nested as on a filesystem of their own,
+// as a nested export would be
+type submountFS struct {
+	*MemFS
+	nested map[string]bool
+}
+
+func (fs *submountFS) GetAttr(fh []byte) (*Fattr, error) {
+	attr, err := fs.MemFS.GetAttr(fh)
+	if err == nil && fs.nested[string(fh)] {
+		attr.FSID = 2
+	}
+
+	return attr, err
+}
+
+func TestSameFilesystem(t *testing.T) {
+	fs := &submountFS{MemFS: NewMemFS(), nested: make(map[string]bool)}
+	v, err := DialLoopback(NewServer(fs)).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	for _, dir := range []string{"/tree", "/tree/sub"} {
+		if _, err = v.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("mkdir: %s", err)
+		}
+	}
+	writeFile(t, v, "/tree/sub/file", "data")
+	for _, path := range []string{"/tree/sub", "/tree/sub/file"} {
+		_, fh, _ := v.Lookup(path)
+		fs.nested[string(fh)] = true
+	}
+	v.SetCacheTTL(0)
+
+	if same, err := v.SameFilesystem("/tree"); err != nil || !same {
+		t.Errorf("/tree: got %v, %v, want the root filesystem", same, err)
+	}
+	if same, err := v.SameFilesystem("/tree/sub"); err != nil || same {
+		t.Errorf("/tree/sub: got %v, %v, want another filesystem", same, err)
+	}
+
+	v.SetOneFilesystem(true)
+	if err = v.RemoveAll("/tree"); !errors.Is(err, ErrCrossFilesystem) {
+		t.Fatalf("remove all: got %v, want ErrCrossFilesystem", err)
+	}
+	if _, _, err = v.Lookup("/tree/sub/file"); err != nil {
+		t.Errorf("nested file removed: %s", err)
+	}
+
+	v.SetOneFilesystem(false)
+	if err = v.RemoveAll("/tree"); err != nil {
+		t.Fatalf("remove all: %s", err)
+	}
+}
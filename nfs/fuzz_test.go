@@ -0,0 +1,36 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+func FuzzDecodeEntryPlusStream(f *testing.F) {
+	w := new(bytes.Buffer)
+	xdr.Write(w, true)
+	xdr.Write(w, &EntryPlus{
+		FileId:   7,
+		FileName: "file",
+		Cookie:   1,
+		Attr:     PostOpAttr{IsSet: true, Attr: Fattr{Type: NF3Reg, Fileid: 7}},
+		Handle:   PostOpFH3{IsSet: true, FH: []byte{1, 2, 3, 4}},
+	})
+	xdr.Write(w, false)
+	xdr.Write(w, true)
+	f.Add(w.Bytes())
+
+	// a name length far beyond the data
+	f.Add([]byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 7, 0x7f, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		entries, _, err := DecodeEntryPlusStream(bytes.NewReader(data))
+		if err == nil && len(entries) > len(data)/4 {
+			t.Fatalf("decoded %d entries from %d bytes", len(entries), len(data))
+		}
+	})
+}
@@ -0,0 +1,683 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package gateway
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	_path "path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs"
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// MultipartDir is where the S3 gateway stages the parts of multipart
+// uploads, relative to the root of the export.  It is left out of listings.
+const MultipartDir = ".s3-multipart"
+
+// copyBufferSize is the size of the writes the S3 gateway issues, File.Write
+// splits them into WRITE calls of the server's preferred size
+const copyBufferSize = 1 << 20
+
+// S3Handler serves a minimal, path-style subset of the S3 API with the export
+// v is mounted on as the single bucket named bucket: GetObject, HeadObject,
+// PutObject, DeleteObject, ListObjects (V1 and V2) and multipart uploads.
+// Keys map to paths, "a/b/c" to the file c in directory a/b, and
+// directories are created as needed.  Requests are not authenticated, put it
+// behind something that does.
+type S3Handler struct {
+	v      *nfs.Target
+	bucket string
+}
+
+// NewS3Handler returns an S3 handler serving v as bucket
+func NewS3Handler(v *nfs.Target, bucket string) *S3Handler {
+	return &S3Handler{v: v, bucket: bucket}
+}
+
+func (h *S3Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	util.Debugf("s3 %s %s", r.Method, r.URL)
+
+	if r.URL.Path == "/" {
+		if r.Method != http.MethodGet {
+			s3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed")
+			return
+		}
+		h.listBuckets(w)
+		return
+	}
+
+	bucket, key := splitBucketKey(r.URL.Path)
+	if bucket != h.bucket {
+		s3Error(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	q := r.URL.Query()
+	var err error
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		err = h.listObjects(w, r)
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case key == "":
+		s3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		err = h.createMultipart(w, key)
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		err = h.uploadPart(w, r, q.Get("uploadId"), q.Get("partNumber"))
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		err = h.completeMultipart(w, r, key, q.Get("uploadId"))
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		err = h.abortMultipart(w, q.Get("uploadId"))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		err = h.getObject(w, r, key)
+	case r.Method == http.MethodPut:
+		err = h.putObject(w, r, key)
+	case r.Method == http.MethodDelete:
+		err = h.deleteObject(w, key)
+	default:
+		s3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+
+	if err != nil {
+		util.Debugf("s3 %s %s: %s", r.Method, r.URL, err)
+		status, code := s3ErrorCode(err)
+		s3Error(w, r, status, code)
+	}
+}
+
+// s3Err is an S3 error code the gateway raises itself
+type s3Err string
+
+func (e s3Err) Error() string { return string(e) }
+
+const (
+	errNoSuchUpload  = s3Err("NoSuchUpload")
+	errInvalidPart   = s3Err("InvalidPart")
+	errInvalidArg    = s3Err("InvalidArgument")
+	errMalformedXML  = s3Err("MalformedXML")
+	errInvalidObject = s3Err("InvalidObjectState")
+)
+
+// s3ErrorCode maps err to an HTTP status and S3 error code
+func s3ErrorCode(err error) (int, string) {
+	var se s3Err
+	switch {
+	case errors.As(err, &se):
+		if se == errNoSuchUpload || se == errInvalidObject {
+			return http.StatusNotFound, string(se)
+		}
+		return http.StatusBadRequest, string(se)
+	case os.IsNotExist(err) || errors.Is(err, os.ErrNotExist) || nfs.IsNotDirError(err):
+		return http.StatusNotFound, "NoSuchKey"
+	case errors.Is(err, os.ErrPermission):
+		return http.StatusForbidden, "AccessDenied"
+	default:
+		return http.StatusInternalServerError, "InternalError"
+	}
+}
+
+type s3ErrorBody struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+}
+
+func s3Error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+
+	writeXML(w, status, &s3ErrorBody{Code: code, Message: code, Resource: r.URL.Path})
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		util.Errorf("s3: encoding response: %s", err)
+	}
+}
+
+// splitBucketKey splits a path-style URL path into bucket and key
+func splitBucketKey(p string) (string, string) {
+	p = strings.TrimPrefix(p, "/")
+	if i := strings.IndexByte(p, '/'); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+
+	return p, ""
+}
+
+// keyPath maps a key to its path on the export
+func keyPath(key string) string {
+	return _path.Clean("/" + key)
+}
+
+func etag(sum []byte) string {
+	return `"` + hex.EncodeToString(sum) + `"`
+}
+
+// attrETag is the ETag of an object not written through the gateway, whose
+// MD5 is unknown; it changes whenever the file does
+func attrETag(attr *nfs.Fattr) string {
+	return fmt.Sprintf(`"%x-%x-%x"`, attr.Fileid, attr.Filesize, attr.ModTime().UnixNano())
+}
+
+type bucketEntry struct {
+	Name         string
+	CreationDate time.Time
+}
+
+type bucketsResult struct {
+	XMLName xml.Name      `xml:"ListAllMyBucketsResult"`
+	Buckets []bucketEntry `xml:"Buckets>Bucket"`
+}
+
+func (h *S3Handler) listBuckets(w http.ResponseWriter) {
+	writeXML(w, http.StatusOK, &bucketsResult{Buckets: []bucketEntry{{Name: h.bucket}}})
+}
+
+func (h *S3Handler) getObject(w http.ResponseWriter, r *http.Request, key string) error {
+	attr, fh, err := h.v.GetAttr(keyPath(key))
+	if err != nil {
+		return err
+	}
+	if attr.IsDir() {
+		return os.ErrNotExist
+	}
+
+	f, err := h.v.OpenByFh(fh, attr)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", attrETag(attr))
+	http.ServeContent(w, r, "", attr.ModTime(), f)
+
+	return nil
+}
+
+func (h *S3Handler) putObject(w http.ResponseWriter, r *http.Request, key string) error {
+	path := keyPath(key)
+
+	// a key ending in / with no data is a folder placeholder
+	if strings.HasSuffix(key, "/") {
+		if err := h.mkdirAll(path); err != nil {
+			return err
+		}
+		w.Header().Set("ETag", etag(md5.New().Sum(nil)))
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	sum, err := h.writeFile(path, r.Body)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", etag(sum))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// writeFile replaces the file at path with the data read from r, creating
+// its directory as needed, and returns the MD5 of the data.  The data is
+// written to a temporary file renamed over path once whole, so that a
+// failed request leaves the object as it was.
+func (h *S3Handler) writeFile(path string, r io.Reader) ([]byte, error) {
+	f, tmp, err := h.createTemp(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := md5.New()
+	_, err = io.CopyBuffer(io.MultiWriter(f, sum), r, make([]byte, copyBufferSize))
+	if err = h.place(f, tmp, path, err); err != nil {
+		return nil, err
+	}
+
+	return sum.Sum(nil), nil
+}
+
+// createTemp makes a temporary file beside path, and its directory as
+// needed, for an object to be written to before it is placed
+func (h *S3Handler) createTemp(path string) (*nfs.File, string, error) {
+	dir := _path.Dir(path)
+	if err := h.mkdirAll(dir); err != nil {
+		return nil, "", err
+	}
+
+	return h.v.CreateTemp(dir, _path.Base(path)+".*")
+}
+
+// place closes f, the temporary file tmp, and renames it over path unless
+// writing it failed with err, removing it otherwise
+func (h *S3Handler) place(f *nfs.File, tmp, path string, err error) error {
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// temporary files are made private
+		var fh []byte
+		if _, fh, err = h.v.Lookup(tmp); err == nil {
+			err = h.v.SetAttrByFh(fh, nfs.Sattr3{Mode: nfs.SetMode{SetIt: true, Mode: 0644}})
+		}
+	}
+	if err == nil {
+		err = h.v.Rename(tmp, path)
+	}
+	if err != nil {
+		if rerr := h.v.Remove(tmp); rerr != nil {
+			util.Errorf("s3: removing %s: %s", tmp, rerr)
+		}
+	}
+
+	return err
+}
+
+// mkdirAll creates the directory at path and its parents
+func (h *S3Handler) mkdirAll(path string) error {
+	if path == "/" || path == "." {
+		return nil
+	}
+
+	attr, _, err := h.v.GetAttr(path)
+	if err == nil {
+		if !attr.IsDir() {
+			return errInvalidObject
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err = h.mkdirAll(_path.Dir(path)); err != nil {
+		return err
+	}
+
+	_, err = h.v.Mkdir(path, 0755)
+	if errors.Is(err, os.ErrExist) {
+		// lost a race with another request
+		return nil
+	}
+
+	return err
+}
+
+func (h *S3Handler) deleteObject(w http.ResponseWriter, key string) error {
+	path := keyPath(key)
+
+	var err error
+	if strings.HasSuffix(key, "/") {
+		err = h.v.RmDir(path)
+	} else {
+		err = h.v.Remove(path)
+	}
+
+	// deleting a missing key succeeds in S3
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type listEntry struct {
+	Key          string
+	LastModified time.Time
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type listResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	KeyCount              int    `xml:",omitempty"`
+	Marker                string `xml:",omitempty"`
+	NextMarker            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	IsTruncated           bool
+	Contents              []listEntry
+	CommonPrefixes        []struct{ Prefix string }
+}
+
+func (h *S3Handler) listObjects(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	prefix, delim := q.Get("prefix"), q.Get("delimiter")
+	if delim != "" && delim != "/" {
+		return errInvalidArg
+	}
+
+	maxKeys := 1000
+	if s := q.Get("max-keys"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return errInvalidArg
+		}
+		maxKeys = n
+	}
+
+	v2 := q.Get("list-type") == "2"
+	after := q.Get("marker")
+	if v2 {
+		after = q.Get("start-after")
+		if token := q.Get("continuation-token"); token != "" {
+			after = token
+		}
+	}
+
+	// everything under the directory the prefix ends in
+	dir := ""
+	if i := strings.LastIndexByte(prefix, '/'); i >= 0 {
+		dir = prefix[:i+1]
+	}
+
+	var keys []listEntry
+	var prefixes []string
+	err := h.walk(dir, delim != "", func(key string, attr *nfs.Fattr) {
+		if !strings.HasPrefix(key, prefix) {
+			return
+		}
+		if attr.IsDir() {
+			prefixes = append(prefixes, key+"/")
+			return
+		}
+		keys = append(keys, listEntry{
+			Key:          key,
+			LastModified: attr.ModTime().UTC(),
+			ETag:         attrETag(attr),
+			Size:         int64(attr.Filesize),
+			StorageClass: "STANDARD",
+		})
+	})
+	if err != nil && !os.IsNotExist(err) && !nfs.IsNotDirError(err) {
+		return err
+	}
+
+	res := &listResult{Name: h.bucket, Prefix: prefix, Delimiter: delim, MaxKeys: maxKeys}
+
+	// merge keys and common prefixes in key order, as S3 pages them
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+	sort.Strings(prefixes)
+	var last string
+	for i, j := 0, 0; i < len(keys) || j < len(prefixes); {
+		var name string
+		isPrefix := j < len(prefixes) && (i == len(keys) || prefixes[j] < keys[i].Key)
+		if isPrefix {
+			name = prefixes[j]
+			j++
+		} else {
+			name = keys[i].Key
+			i++
+		}
+		if name <= after {
+			continue
+		}
+
+		if len(res.Contents)+len(res.CommonPrefixes) == maxKeys {
+			res.IsTruncated = true
+			break
+		}
+
+		if isPrefix {
+			res.CommonPrefixes = append(res.CommonPrefixes, struct{ Prefix string }{name})
+		} else {
+			res.Contents = append(res.Contents, keys[i-1])
+		}
+		last = name
+	}
+
+	if v2 {
+		res.KeyCount = len(res.Contents) + len(res.CommonPrefixes)
+		res.ContinuationToken = q.Get("continuation-token")
+		res.StartAfter = q.Get("start-after")
+		if res.IsTruncated {
+			res.NextContinuationToken = last
+		}
+	} else {
+		res.Marker = q.Get("marker")
+		if res.IsTruncated {
+			res.NextMarker = last
+		}
+	}
+
+	writeXML(w, http.StatusOK, res)
+	return nil
+}
+
+// walk calls fn with the key and attributes of every entry below the
+// directory of key prefix dir, or only of its entries if shallow.
+// Directories are passed to fn only when shallow.
+func (h *S3Handler) walk(dir string, shallow bool, fn func(key string, attr *nfs.Fattr)) error {
+	entries, err := h.v.ReadDirPlus(keyPath(dir))
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.FileName == "." || e.FileName == ".." || (dir == "" && e.FileName == MultipartDir) || strings.HasPrefix(e.FileName, nfs.TempPrefix) {
+			continue
+		}
+
+		key := dir + e.FileName
+		attr := &e.Attr.Attr
+		if !e.Attr.IsSet {
+			if attr, _, err = h.v.GetAttr(keyPath(key)); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case !attr.IsDir():
+			fn(key, attr)
+		case shallow:
+			fn(key, attr)
+		default:
+			if err = h.walk(key+"/", false, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// uploadDir is the staging directory of a multipart upload
+func uploadDir(id string) (string, error) {
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return "", errNoSuchUpload
+	}
+
+	return _path.Join("/", MultipartDir, id), nil
+}
+
+type initiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+func (h *S3Handler) createMultipart(w http.ResponseWriter, key string) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(b)
+
+	dir, _ := uploadDir(id)
+	if err := h.mkdirAll(dir); err != nil {
+		return err
+	}
+
+	writeXML(w, http.StatusOK, &initiateResult{Bucket: h.bucket, Key: key, UploadId: id})
+	return nil
+}
+
+// uploadPart stages a part as a file of the upload's directory, named by its
+// number
+func (h *S3Handler) uploadPart(w http.ResponseWriter, r *http.Request, id, number string) error {
+	dir, err := uploadDir(id)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 1 || n > 10000 {
+		return errInvalidArg
+	}
+
+	if _, _, err = h.v.Lookup(dir); err != nil {
+		if os.IsNotExist(err) {
+			return errNoSuchUpload
+		}
+		return err
+	}
+
+	sum, err := h.writeFile(_path.Join(dir, strconv.Itoa(n)), r.Body)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", etag(sum))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+type completeRequest struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type completeResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Bucket  string
+	Key     string
+	ETag    string
+}
+
+// completeMultipart writes the parts of an upload one after the other into
+// the object, then drops them
+func (h *S3Handler) completeMultipart(w http.ResponseWriter, r *http.Request, key, id string) error {
+	dir, err := uploadDir(id)
+	if err != nil {
+		return err
+	}
+
+	var req completeRequest
+	if err = xml.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Parts) == 0 {
+		return errMalformedXML
+	}
+
+	if _, _, err = h.v.Lookup(dir); err != nil {
+		if os.IsNotExist(err) {
+			return errNoSuchUpload
+		}
+		return err
+	}
+
+	// the parts go to a temporary file, the object is left as it is if
+	// one of them is not right
+	path := keyPath(key)
+	f, tmp, err := h.createTemp(path)
+	if err != nil {
+		return err
+	}
+
+	// the ETag of a multipart object is the MD5 of the MD5s of its parts
+	sums := md5.New()
+	buf := make([]byte, copyBufferSize)
+	prev := 0
+	for _, p := range req.Parts {
+		if p.PartNumber <= prev {
+			err = s3Err("InvalidPartOrder")
+			break
+		}
+		prev = p.PartNumber
+
+		if err = h.appendPart(f, _path.Join(dir, strconv.Itoa(p.PartNumber)), p.ETag, sums, buf); err != nil {
+			break
+		}
+	}
+	if err = h.place(f, tmp, path, err); err != nil {
+		return err
+	}
+
+	if err = h.v.RemoveAll(dir); err != nil {
+		util.Errorf("s3: removing upload %s: %s", id, err)
+	}
+
+	tag := fmt.Sprintf(`"%x-%d"`, sums.Sum(nil), len(req.Parts))
+	writeXML(w, http.StatusOK, &completeResult{Bucket: h.bucket, Key: key, ETag: tag})
+	return nil
+}
+
+// appendPart copies the staged part at path to f, checking it against the
+// ETag the client was given for it
+func (h *S3Handler) appendPart(f *nfs.File, path, tag string, sums io.Writer, buf []byte) error {
+	part, err := h.v.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errInvalidPart
+		}
+		return err
+	}
+	defer part.Close()
+
+	sum := md5.New()
+	if _, err = io.CopyBuffer(io.MultiWriter(f, sum), part, buf); err != nil {
+		return err
+	}
+
+	if tag != "" && strings.Trim(tag, `"`) != hex.EncodeToString(sum.Sum(nil)) {
+		return errInvalidPart
+	}
+	sums.Write(sum.Sum(nil))
+
+	return nil
+}
+
+func (h *S3Handler) abortMultipart(w http.ResponseWriter, id string) error {
+	dir, err := uploadDir(id)
+	if err != nil {
+		return err
+	}
+
+	if err = h.v.RemoveAll(dir); err != nil {
+		if os.IsNotExist(err) {
+			return errNoSuchUpload
+		}
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,181 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package gateway
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs"
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+func s3Do(t *testing.T, srv *httptest.Server, method, url, body string) (*http.Response, string) {
+	req, err := http.NewRequest(method, srv.URL+url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %s", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	return resp, string(data)
+}
+
+func TestS3(t *testing.T) {
+	v, err := nfs.DialLoopback(nfs.NewServer(nfs.NewMemFS())).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	srv := httptest.NewServer(NewS3Handler(v, "bucket"))
+	defer srv.Close()
+
+	for _, key := range []string{"a/b/one", "a/two", "three"} {
+		if resp, body := s3Do(t, srv, "PUT", "/bucket/"+key, "data of "+key); resp.StatusCode != 200 {
+			t.Fatalf("put %s: %s %s", key, resp.Status, body)
+		}
+	}
+
+	resp, body := s3Do(t, srv, "GET", "/bucket/a/two", "")
+	if resp.StatusCode != 200 || body != "data of a/two" {
+		t.Fatalf("get: %s %q", resp.Status, body)
+	}
+	if resp, _ = s3Do(t, srv, "GET", "/bucket/missing", ""); resp.StatusCode != 404 {
+		t.Fatalf("get missing: %s", resp.Status)
+	}
+
+	list := func(query string) listResult {
+		resp, body := s3Do(t, srv, "GET", "/bucket?list-type=2&"+query, "")
+		if resp.StatusCode != 200 {
+			t.Fatalf("list %s: %s %s", query, resp.Status, body)
+		}
+		var res listResult
+		if err := xml.Unmarshal([]byte(body), &res); err != nil {
+			t.Fatalf("list %s: %s", query, err)
+		}
+		return res
+	}
+	keys := func(res listResult) []string {
+		var keys []string
+		for _, e := range res.Contents {
+			keys = append(keys, e.Key)
+		}
+		for _, p := range res.CommonPrefixes {
+			keys = append(keys, p.Prefix)
+		}
+		return keys
+	}
+
+	if got := keys(list("")); !reflect.DeepEqual(got, []string{"a/b/one", "a/two", "three"}) {
+		t.Errorf("list: got %v", got)
+	}
+	if got := keys(list("delimiter=/")); !reflect.DeepEqual(got, []string{"three", "a/"}) {
+		t.Errorf("list with delimiter: got %v", got)
+	}
+	if got := keys(list("prefix=a/t")); !reflect.DeepEqual(got, []string{"a/two"}) {
+		t.Errorf("list with prefix: got %v", got)
+	}
+	page := list("max-keys=2")
+	if !page.IsTruncated || page.NextContinuationToken != "a/two" {
+		t.Errorf("list page: truncated %v, token %q", page.IsTruncated, page.NextContinuationToken)
+	}
+	if got := keys(list("continuation-token=" + page.NextContinuationToken)); !reflect.DeepEqual(got, []string{"three"}) {
+		t.Errorf("list next page: got %v", got)
+	}
+
+	if resp, _ = s3Do(t, srv, "DELETE", "/bucket/three", ""); resp.StatusCode != 204 {
+		t.Fatalf("delete: %s", resp.Status)
+	}
+	if resp, _ = s3Do(t, srv, "HEAD", "/bucket/three", ""); resp.StatusCode != 404 {
+		t.Fatalf("head deleted: %s", resp.Status)
+	}
+}
+
+func TestS3Multipart(t *testing.T) {
+	v, err := nfs.DialLoopback(nfs.NewServer(nfs.NewMemFS())).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	srv := httptest.NewServer(NewS3Handler(v, "bucket"))
+	defer srv.Close()
+
+	_, body := s3Do(t, srv, "POST", "/bucket/big?uploads", "")
+	var init initiateResult
+	if err = xml.Unmarshal([]byte(body), &init); err != nil || init.UploadId == "" {
+		t.Fatalf("initiate: %s %v", body, err)
+	}
+
+	// parts uploaded out of order
+	parts := []string{strings.Repeat("x", 5000), strings.Repeat("y", 3000), "z"}
+	tags := make([]string, len(parts))
+	for _, i := range []int{2, 0, 1} {
+		resp, body := s3Do(t, srv, "PUT", fmt.Sprintf("/bucket/big?partNumber=%d&uploadId=%s", i+1, init.UploadId), parts[i])
+		if resp.StatusCode != 200 {
+			t.Fatalf("part %d: %s %s", i+1, resp.Status, body)
+		}
+		tags[i] = resp.Header.Get("ETag")
+	}
+
+	if got := list(t, v); !reflect.DeepEqual(got, []string{}) {
+		t.Errorf("staged parts are listed: %v", got)
+	}
+
+	// a failed complete leaves the object there before as it was
+	if resp, body := s3Do(t, srv, "PUT", "/bucket/big", "old"); resp.StatusCode != 200 {
+		t.Fatalf("put: %s %s", resp.Status, body)
+	}
+	bad := fmt.Sprintf("<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>%q</ETag></Part></CompleteMultipartUpload>", strings.Repeat("0", 32))
+	if resp, _ := s3Do(t, srv, "POST", "/bucket/big?uploadId="+init.UploadId, bad); resp.StatusCode == 200 {
+		t.Fatal("complete with a wrong part")
+	}
+	if _, body = s3Do(t, srv, "GET", "/bucket/big", ""); body != "old" {
+		t.Errorf("after a failed complete: %.16q", body)
+	}
+	if got := list(t, v); !reflect.DeepEqual(got, []string{"big"}) {
+		t.Errorf("after a failed complete: listed %v", got)
+	}
+
+	complete := "<CompleteMultipartUpload>"
+	for i, tag := range tags {
+		complete += fmt.Sprintf("<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, tag)
+	}
+	complete += "</CompleteMultipartUpload>"
+	if resp, body := s3Do(t, srv, "POST", "/bucket/big?uploadId="+init.UploadId, complete); resp.StatusCode != 200 {
+		t.Fatalf("complete: %s %s", resp.Status, body)
+	}
+
+	if _, body = s3Do(t, srv, "GET", "/bucket/big", ""); body != strings.Join(parts, "") {
+		t.Fatalf("get: got %d bytes, want %d", len(body), len(strings.Join(parts, "")))
+	}
+
+	if _, _, err = v.Lookup("/" + MultipartDir + "/" + init.UploadId); err == nil {
+		t.Errorf("parts left behind after complete")
+	}
+}
+
+// list returns the keys the gateway lists for v
+func list(t *testing.T, v *nfs.Target) []string {
+	keys := []string{}
+	err := (&S3Handler{v: v}).walk("", false, func(key string, _ *nfs.Fattr) {
+		keys = append(keys, key)
+	})
+	if err != nil {
+		t.Fatalf("walk: %s", err)
+	}
+
+	return keys
+}
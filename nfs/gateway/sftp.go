@@ -0,0 +1,247 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package gateway
+
+import (
+	"io"
+	"os"
+	_path "path"
+	"sync"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs"
+	"github.com/go-nfs/nfsv3/nfs/util"
+	"github.com/pkg/sftp"
+)
+
+// ServeSFTP serves the SFTP subsystem over conn, typically the channel of an
+// SSH session the caller accepted, until the client goes away.  Paths are
+// relative to the root of the export v is mounted on.
+func ServeSFTP(conn io.ReadWriteCloser, v *nfs.Target) error {
+	s := sftp.NewRequestServer(conn, SFTPHandlers(v))
+	defer s.Close()
+
+	err := s.Serve()
+	if err == io.EOF {
+		return nil
+	}
+
+	return err
+}
+
+// SFTPHandlers returns handlers for a pkg/sftp request server that translate
+// SFTP requests into NFS calls on v
+func SFTPHandlers(v *nfs.Target) sftp.Handlers {
+	h := &sftpHandler{v: v}
+	return sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h}
+}
+
+type sftpHandler struct {
+	v *nfs.Target
+}
+
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	f, err := h.v.Open(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sftpFile{f: f}, nil
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	perm := os.FileMode(0644)
+	if r.AttrFlags().Permissions {
+		perm = nfs.FileMode(0, nfs.ModeBits(r.Attributes().FileMode()))
+	}
+
+	var f *nfs.File
+	var err error
+	if r.Pflags().Trunc {
+		var fh []byte
+		if fh, err = h.v.CreateTruncate(r.Filepath, perm, 0); err == nil {
+			f, err = h.v.OpenByFh(fh, nil)
+		}
+	} else {
+		f, err = h.v.OpenFile(r.Filepath, perm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &sftpFile{f: f}, nil
+}
+
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	util.Debugf("sftp %s %s", r.Method, r.Filepath)
+
+	switch r.Method {
+	case "Setstat":
+		return h.setstat(r)
+	case "Rename", "PosixRename":
+		return h.v.Rename(r.Filepath, r.Target)
+	case "Rmdir":
+		return h.v.RmDir(r.Filepath)
+	case "Remove":
+		return h.v.Remove(r.Filepath)
+	case "Mkdir":
+		_, err := h.v.Mkdir(r.Filepath, 0755)
+		return err
+	case "Symlink":
+		// sftp names the new link Target and what it points to Filepath
+		_, err := h.v.Symlink(r.Filepath, r.Target)
+		return err
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// setstat applies the attributes of a SETSTAT request
+func (h *sftpHandler) setstat(r *sftp.Request) error {
+	_, fh, err := h.v.Lookup(r.Filepath)
+	if err != nil {
+		return err
+	}
+
+	flags, attrs := r.AttrFlags(), r.Attributes()
+
+	var sattr nfs.Sattr3
+	if flags.Permissions {
+		sattr.Mode = nfs.SetMode{SetIt: true, Mode: nfs.ModeBits(attrs.FileMode())}
+	}
+	if flags.UidGid {
+		sattr.UID = nfs.SetUID{SetIt: true, UID: attrs.UID}
+		sattr.GID = nfs.SetUID{SetIt: true, UID: attrs.GID}
+	}
+	if flags.Size {
+		sattr.Size = nfs.SetSize{SetIt: true, Size: attrs.Size}
+	}
+	if flags.Acmodtime {
+		sattr.Atime = nfs.SetTimeTo(time.Unix(int64(attrs.Atime), 0))
+		sattr.Mtime = nfs.SetTimeTo(time.Unix(int64(attrs.Mtime), 0))
+	}
+
+	return h.v.SetAttrByFh(fh, sattr)
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		entries, err := h.v.ReadDirPlus(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+
+		infos := make([]os.FileInfo, 0, len(entries))
+		for _, e := range entries {
+			if e.FileName == "." || e.FileName == ".." {
+				continue
+			}
+			if !e.Attr.IsSet {
+				fi, _, err := h.v.Lstat(_path.Join(r.Filepath, e.FileName))
+				if err != nil {
+					return nil, err
+				}
+				e.Attr.Attr, e.Attr.IsSet = *fi.(*nfs.Fattr), true
+			}
+			infos = append(infos, &fileInfo{name: e.FileName, attr: &e.Attr.Attr})
+		}
+		return listerAt(infos), nil
+
+	case "Stat":
+		attr, _, err := h.v.GetAttr(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{&fileInfo{name: _path.Base(r.Filepath), attr: attr}}, nil
+
+	case "Lstat":
+		fi, _, err := h.v.Lstat(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{&fileInfo{name: _path.Base(r.Filepath), attr: fi.(*nfs.Fattr)}}, nil
+
+	case "Readlink":
+		target, err := h.v.Readlink(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{&fileInfo{name: target, attr: &nfs.Fattr{Type: nfs.NF3Lnk}}}, nil
+
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// sftpFile adapts a File to the positional reads and writes of SFTP, which a
+// client may issue concurrently
+type sftpFile struct {
+	sync.Mutex
+	f *nfs.File
+}
+
+func (s *sftpFile) ReadAt(p []byte, off int64) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, err := s.f.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(s.f, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+func (s *sftpFile) WriteAt(p []byte, off int64) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, err := s.f.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	return s.f.Write(p)
+}
+
+// Close is called by the request server when the client closes the handle
+func (s *sftpFile) Close() error {
+	return s.f.Close()
+}
+
+// fileInfo describes an entry by its NFS attributes
+type fileInfo struct {
+	name string
+	attr *nfs.Fattr
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return int64(fi.attr.Filesize) }
+func (fi *fileInfo) ModTime() time.Time { return fi.attr.ModTime() }
+func (fi *fileInfo) IsDir() bool        { return fi.attr.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return fi.attr }
+
+func (fi *fileInfo) Mode() os.FileMode {
+	return nfs.FileMode(fi.attr.Type, fi.attr.FileMode)
+}
+
+// listerAt serves a listing held in memory
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
@@ -0,0 +1,98 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package gateway
+
+import (
+	"io"
+	"sort"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs"
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/pkg/sftp"
+)
+
+// sftpClient returns a client talking to the gateway for v over pipes
+func sftpClient(t *testing.T, v *nfs.Target) *sftp.Client {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+
+	go ServeSFTP(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw}, v)
+
+	c, err := sftp.NewClientPipe(cr, cw)
+	if err != nil {
+		t.Fatalf("sftp client: %s", err)
+	}
+
+	return c
+}
+
+func TestSFTP(t *testing.T) {
+	v, err := nfs.DialLoopback(nfs.NewServer(nfs.NewMemFS())).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	c := sftpClient(t, v)
+	defer c.Close()
+
+	if err = c.Mkdir("/dir"); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+
+	f, err := c.Create("/dir/a")
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if _, err = f.Write([]byte("hello, sftp")); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	f.Close()
+
+	if err = c.Rename("/dir/a", "/dir/b"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+
+	infos, err := c.ReadDir("/dir")
+	if err != nil {
+		t.Fatalf("readdir: %s", err)
+	}
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	if len(names) != 1 || names[0] != "b" {
+		t.Fatalf("readdir: got %v, want [b]", names)
+	}
+
+	fi, err := c.Stat("/dir")
+	if err != nil || !fi.IsDir() {
+		t.Fatalf("stat: %v, %v", fi, err)
+	}
+
+	f, err = c.Open("/dir/b")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != "hello, sftp" {
+		t.Fatalf("read: %q, %v", data, err)
+	}
+
+	if err = c.Remove("/dir/b"); err != nil {
+		t.Fatalf("remove: %s", err)
+	}
+	if _, err = c.Stat("/dir/b"); err == nil {
+		t.Fatalf("stat after remove: no error")
+	}
+	if err = c.RemoveDirectory("/dir"); err != nil {
+		t.Fatalf("rmdir: %s", err)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// HandleStats counts the files opened from a target, much like sql.DBStats
+// does for connections
+type HandleStats struct {
+	Open   int    // files open now
+	Opened uint64 // files opened over the life of the target
+	Closed uint64 // files closed over the life of the target
+}
+
+// OpenHandle is a file opened from a target and not closed yet
+type OpenHandle struct {
+	FH     []byte
+	Path   string
+	Opened time.Time
+	// Stack is where the file was opened, if SetHandleStacks is enabled
+	Stack string
+}
+
+type handleTracker struct {
+	sync.Mutex
+	stacks         bool
+	open           map[*File]*OpenHandle
+	opened, closed uint64
+}
+
+// SetHandleStacks has the stack of the caller recorded when a file is opened,
+// so that leaked files reported by Close and OpenHandles say where they come
+// from.  This costs a stack trace per open, enable it when debugging.
+func (v *Target) SetHandleStacks(enable bool) {
+	v.handles.Lock()
+	defer v.handles.Unlock()
+
+	v.handles.stacks = enable
+}
+
+// HandleStats returns the counts of files opened from the target
+func (v *Target) HandleStats() HandleStats {
+	v.handles.Lock()
+	defer v.handles.Unlock()
+
+	return HandleStats{
+		Open:   len(v.handles.open),
+		Opened: v.handles.opened,
+		Closed: v.handles.closed,
+	}
+}
+
+// OpenHandles returns the files opened from the target and not closed yet
+func (v *Target) OpenHandles() []OpenHandle {
+	v.handles.Lock()
+	defer v.handles.Unlock()
+
+	handles := make([]OpenHandle, 0, len(v.handles.open))
+	for _, h := range v.handles.open {
+		handles = append(handles, *h)
+	}
+
+	return handles
+}
+
+func (t *handleTracker) track(f *File, path string) {
+	t.Lock()
+	defer t.Unlock()
+
+	h := &OpenHandle{FH: f.fh, Path: path, Opened: time.Now()}
+	if t.stacks {
+		h.Stack = string(debug.Stack())
+	}
+
+	if t.open == nil {
+		t.open = make(map[*File]*OpenHandle)
+	}
+	t.open[f] = h
+	t.opened++
+}
+
+func (t *handleTracker) untrack(f *File) {
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.open[f]; ok {
+		delete(t.open, f)
+		t.closed++
+	}
+}
+
+// reportLeaks logs the files still open when the target is closed
+func (v *Target) reportLeaks() {
+	for _, h := range v.OpenHandles() {
+		if h.Stack != "" {
+			util.Errorf("close(%s): file %q (%x) opened at %s was never closed, opened from:\n%s", v.dirPath, h.Path, h.FH, h.Opened.Format(time.RFC3339), h.Stack)
+		} else {
+			util.Errorf("close(%s): file %q (%x) opened at %s was never closed", v.dirPath, h.Path, h.FH, h.Opened.Format(time.RFC3339))
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+// Defaults of HedgeOptions
+const (
+	DefaultHedgePercentile = 0.95
+	DefaultHedgeMinDelay   = time.Millisecond
+)
+
+// calls of a procedure seen before its percentile is trusted, and kept to
+// compute it
+const (
+	hedgeMinSamples = 20
+	hedgeSamples    = 256
+)
+
+// HedgeOptions tune request hedging, see SetHedging
+type HedgeOptions struct {
+	// Percentile is the fraction of recent calls of the same procedure a
+	// call may take longer than before it is hedged,
+	// DefaultHedgePercentile if zero
+	Percentile float64
+
+	// MinDelay is the least a call waits before it is hedged,
+	// DefaultHedgeMinDelay if zero
+	MinDelay time.Duration
+
+	// Replica, if set, is the address of a server exporting the same
+	// filesystem under the same handles, such as the partner of a filer
+	// pair, which hedged calls are sent to.  Otherwise they go over another
+	// connection of the target, see NConnect.
+	Replica string
+}
+
+// HedgeStats counts hedged calls
+type HedgeStats struct {
+	// Hedged counts the calls sent twice, Won those the duplicate answered
+	// first
+	Hedged uint64
+	Won    uint64
+}
+
+type hedger struct {
+	opts    HedgeOptions
+	replica *rpc.Client
+
+	sync.Mutex
+	samples map[uint32]*latencies
+	stats   HedgeStats
+}
+
+// latencies are the last hedgeSamples latencies of a procedure
+type latencies struct {
+	ring  []time.Duration
+	next  int
+	delay time.Duration
+}
+
+// SetHedging has READ and GETATTR calls that take longer than most sent again
+// over another connection, or to a replica, the first reply being used, to
+// cut the tail latency of a congested filer.  Both are idempotent, so the
+// duplicate does no harm but the load it adds.  A nil opts disables hedging.
+func (v *Target) SetHedging(opts *HedgeOptions) error {
+	if opts == nil {
+		v.closeHedger()
+		return nil
+	}
+
+	h := &hedger{opts: *opts, samples: make(map[uint32]*latencies)}
+	if h.opts.Percentile <= 0 || h.opts.Percentile >= 1 {
+		h.opts.Percentile = DefaultHedgePercentile
+	}
+	if h.opts.MinDelay == 0 {
+		h.opts.MinDelay = DefaultHedgeMinDelay
+	}
+
+	if h.opts.Replica != "" {
+		m := rpc.Mapping{Prog: Nfs3Prog, Vers: Nfs3Vers, Prot: rpc.IPProtoTCP}
+		client, err := DialServiceTLS(h.opts.Replica, m, v.privileged(), v.TLSConfig())
+		if err != nil {
+			return err
+		}
+		h.replica = client
+	} else if conns, _ := v.connections(); len(conns) == 0 {
+		return errors.New("hedging: no replica and a single connection, see NConnect")
+	}
+
+	v.swapHedger(h)
+	return nil
+}
+
+func (v *Target) closeHedger() {
+	v.swapHedger(nil)
+}
+
+// swapHedger makes h the hedger of v, closing the replica of the one before
+func (v *Target) swapHedger(h *hedger) {
+	v.hedgeMu.Lock()
+	old := v.hedge
+	v.hedge = h
+	v.hedgeMu.Unlock()
+
+	if old != nil && old.replica != nil {
+		old.replica.Close()
+	}
+}
+
+// hedging returns the hedger of v, nil if hedging is off
+func (v *Target) hedging() *hedger {
+	v.hedgeMu.Lock()
+	defer v.hedgeMu.Unlock()
+
+	return v.hedge
+}
+
+// HedgeStats returns the counts of hedged calls
+func (v *Target) HedgeStats() HedgeStats {
+	h := v.hedging()
+	if h == nil {
+		return HedgeStats{}
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	return h.stats
+}
+
+func hedgeable(proc uint32) bool {
+	return proc == NFSProc3Read || proc == NFSProc3GetAttr
+}
+
+// delay returns how long a call of proc waits before it is hedged, and
+// whether enough calls were seen to tell
+func (h *hedger) delay(proc uint32) (time.Duration, bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	l, ok := h.samples[proc]
+	if !ok || len(l.ring) < hedgeMinSamples {
+		return 0, false
+	}
+
+	return l.delay, true
+}
+
+// record notes the latency of a call of proc
+func (h *hedger) record(proc uint32, rtt time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+
+	l, ok := h.samples[proc]
+	if !ok {
+		l = &latencies{}
+		h.samples[proc] = l
+	}
+
+	if len(l.ring) < hedgeSamples {
+		l.ring = append(l.ring, rtt)
+	} else {
+		l.ring[l.next] = rtt
+	}
+	l.next = (l.next + 1) % hedgeSamples
+
+	// sorting is cheap next to a round trip, but no need on every call
+	if (len(l.ring) >= hedgeMinSamples && l.next%8 == 0) || len(l.ring) == hedgeMinSamples {
+		sorted := append([]time.Duration(nil), l.ring...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		l.delay = sorted[int(float64(len(sorted)-1)*h.opts.Percentile)]
+		if l.delay < h.opts.MinDelay {
+			l.delay = h.opts.MinDelay
+		}
+	}
+}
+
+// alternate returns the client a call sent over primary is hedged to
+func (h *hedger) alternate(v *Target, primary *rpc.Client) *rpc.Client {
+	if h.replica != nil {
+		return h.replica
+	}
+
+	if primary != v.Client {
+		return v.Client
+	}
+	if conns, _ := v.connections(); len(conns) > 0 {
+		return conns[0]
+	}
+
+	return nil
+}
+
+// cloneCall returns a shallow copy of call c, which the client marshals on
+// its own while the original is in flight
+func cloneCall(c interface{}) interface{} {
+	val := reflect.ValueOf(c)
+	if val.Kind() != reflect.Ptr {
+		return c
+	}
+
+	cp := reflect.New(val.Elem().Type())
+	cp.Elem().Set(val.Elem())
+	return cp.Interface()
+}
+
+// send sends call c of proc over client, hedging it if enabled
+func (v *Target) send(client *rpc.Client, proc uint32, c interface{}, deadline time.Time) (io.ReadSeeker, error) {
+	h := v.hedging()
+	if h == nil || !hedgeable(proc) {
+		return client.CallDeadline(c, deadline)
+	}
+
+	alt := h.alternate(v, client)
+	delay, ok := h.delay(proc)
+	start := time.Now()
+	if alt == nil || !ok {
+		res, err := client.CallDeadline(c, deadline)
+		if err == nil {
+			h.record(proc, time.Since(start))
+		}
+		return res, err
+	}
+
+	type result struct {
+		res   io.ReadSeeker
+		err   error
+		hedge bool
+	}
+	results := make(chan result, 2)
+	dup := cloneCall(c)
+
+	go func() {
+		res, err := client.CallDeadline(c, deadline)
+		results <- result{res, err, false}
+	}()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		if r.err == nil {
+			h.record(proc, time.Since(start))
+		}
+		return r.res, r.err
+	case <-timer.C:
+	}
+
+	go func() {
+		res, err := alt.CallDeadline(dup, deadline)
+		results <- result{res, err, true}
+	}()
+	h.Lock()
+	h.stats.Hedged++
+	h.Unlock()
+
+	// the first reply wins, a failure waits for the other one
+	var first error
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err != nil {
+			if first == nil {
+				first = r.err
+			}
+			continue
+		}
+
+		h.Lock()
+		if r.hedge {
+			h.stats.Won++
+		}
+		h.Unlock()
+		h.record(proc, time.Since(start))
+		return r.res, nil
+	}
+
+	return nil, first
+}
@@ -0,0 +1,78 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+func TestHedging(t *testing.T) {
+	// two servers of the same filesystem, one of which stalls when told
+	fs := NewMemFS()
+	slow, fast := NewServer(fs), NewServer(fs)
+	var stall int32
+	slow.Register(Nfs3Prog, Nfs3Vers, func(call *rpc.ServerCall, w io.Writer) error {
+		if call.Proc == NFSProc3GetAttr && atomic.LoadInt32(&stall) != 0 {
+			time.Sleep(time.Second)
+		}
+		return slow.serveNFS(call, w)
+	})
+
+	v, err := DialLoopback(slow).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+	v.conns = []*rpc.Client{fast.Pipe()}
+
+	if err = v.SetHedging(&HedgeOptions{MinDelay: 10 * time.Millisecond}); err != nil {
+		t.Fatalf("hedging: %s", err)
+	}
+
+	// learn how long a GETATTR takes
+	for i := 0; i < hedgeMinSamples; i++ {
+		if _, err = v.getAttr(v.root()); err != nil {
+			t.Fatalf("getattr: %s", err)
+		}
+	}
+	if stats := v.HedgeStats(); stats.Hedged != 0 {
+		t.Fatalf("hedged while the server was fast: %+v", stats)
+	}
+
+	// calls are spread over both connections, some meet the stall
+	atomic.StoreInt32(&stall, 1)
+	for i := 0; i < 4; i++ {
+		start := time.Now()
+		if _, err = v.getAttr(v.root()); err != nil {
+			t.Fatalf("getattr: %s", err)
+		}
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Errorf("getattr took %s, hedging did not cut it", d)
+		}
+	}
+
+	if stats := v.HedgeStats(); stats.Hedged == 0 || stats.Won == 0 {
+		t.Errorf("stats: %+v, want hedged calls won", stats)
+	}
+
+	// hedging turned off and on while calls are sent
+	atomic.StoreInt32(&stall, 0)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			v.getAttr(v.root())
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		v.SetHedging(nil)
+		v.SetHedging(&HedgeOptions{})
+	}
+	<-done
+}
@@ -0,0 +1,78 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+)
+
+// blocks DetectHoles reads per ReadRanges, which bounds the memory it takes
+const holeBatch = 64
+
+// Extent is a span of a file that holds data, or only zeros
+type Extent struct {
+	Offset uint64
+	Length uint64
+	Hole   bool
+}
+
+// DetectHoles maps file path into extents of data and holes, at the
+// granularity of blockSize, for image backups to skip the holes of sparse
+// files.  NFSv3 has no SEEK_HOLE: every block is read, many at once, and
+// those all zeros count as holes, whether the server allocated them or not.
+// Adjacent extents of the same kind are merged.
+func (v *Target) DetectHoles(path string, blockSize uint64) ([]Extent, error) {
+	if blockSize == 0 {
+		return nil, errors.New("detect holes: zero block size")
+	}
+
+	attr, fh, err := v.Lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	size := uint64(attr.Size())
+
+	var extents []Extent
+	add := func(offset, length uint64, hole bool) {
+		if n := len(extents); n > 0 && extents[n-1].Hole == hole {
+			extents[n-1].Length += length
+			return
+		}
+		extents = append(extents, Extent{Offset: offset, Length: length, Hole: hole})
+	}
+
+	for offset := uint64(0); offset < size; {
+		var ranges []Range
+		for i := 0; i < holeBatch && offset < size; i++ {
+			length := blockSize
+			if size-offset < length {
+				length = size - offset
+			}
+			ranges = append(ranges, Range{Offset: offset, Length: length})
+			offset += length
+		}
+
+		blocks, err := v.ReadRanges(fh, ranges)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, b := range blocks {
+			// blocks truncated away while read come back empty, as holes
+			add(ranges[i].Offset, ranges[i].Length, isZero(b))
+		}
+	}
+
+	return extents, nil
+}
+
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,35 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDetectHoles(t *testing.T) {
+	v := loopbackTarget(t)
+	defer v.Close()
+
+	// data, a hole of two blocks, data, and a tail of zeros short of a block
+	data := make([]byte, 4*4096+100)
+	data[10] = 1
+	data[3*4096] = 1
+	writeFile(t, v, "/sparse", string(data))
+
+	extents, err := v.DetectHoles("/sparse", 4096)
+	if err != nil {
+		t.Fatalf("detect holes: %s", err)
+	}
+
+	want := []Extent{
+		{Offset: 0, Length: 4096},
+		{Offset: 4096, Length: 2 * 4096, Hole: true},
+		{Offset: 3 * 4096, Length: 4096},
+		{Offset: 4 * 4096, Length: 100, Hole: true},
+	}
+	if !reflect.DeepEqual(extents, want) {
+		t.Errorf("extents %+v, want %+v", extents, want)
+	}
+}
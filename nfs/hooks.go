@@ -0,0 +1,111 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"io"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+// OpEvent is a mutating operation as seen by the hooks set with SetOpHooks.
+// It is described as for the audit hook, and once the operation completes
+// the post-op attributes returned by the server are filled in, so external
+// caches and indexes can be updated without another GETATTR.
+type OpEvent struct {
+	AuditEvent
+
+	// Attr are the attributes of FH after the operation, ToAttr those of
+	// ToFH for RENAME and LINK.  Nil if the server did not return them.
+	Attr   *Fattr
+	ToAttr *Fattr
+
+	// ObjFH and ObjAttr describe the object made by CREATE, MKDIR and SYMLINK
+	ObjFH   []byte
+	ObjAttr *Fattr
+
+	// cred is the credential the operation was sent with, once it was, and
+	// resolved set once the principal is filled in from it
+	cred     *rpc.Auth
+	resolved bool
+}
+
+// OpHook observes a mutating operation.  It is called synchronously, so it
+// must not block for long.
+type OpHook func(ev *OpEvent)
+
+// SetOpHooks installs before, called as each mutating operation is about to
+// be sent, and after, called once it completed with its result.  The after
+// hook sees the same event as the before hook, so one may be matched to the
+// other by pointer.  Either may be nil.  The before hook sees the principal
+// of the target's credential, the one a CredentialProvider chooses being
+// known once the operation is sent.
+func (v *Target) SetOpHooks(before, after OpHook) {
+	v.beforeHook = before
+	v.afterHook = after
+}
+
+// opBegin returns the event for an operation about to be sent, after handing
+// it to the before hook
+func (v *Target) opBegin(ev AuditEvent) *OpEvent {
+	op := &OpEvent{AuditEvent: ev}
+	op.Op = ProcName(op.Proc)
+	if v.beforeHook != nil {
+		op.Time = time.Now()
+		v.principal(&op.AuditEvent, v.auth)
+		op.resolved = v.creds == nil
+		v.beforeHook(op)
+	}
+
+	return op
+}
+
+// opEnd hands the completed operation to the audit hook, then to the after
+// hook, the principal resolved once for both
+func (v *Target) opEnd(ev *OpEvent, err error) {
+	if v.auditHook == nil && v.afterHook == nil {
+		return
+	}
+
+	ev.Time = time.Now()
+	if !ev.resolved {
+		auth := v.auth
+		if ev.cred != nil {
+			auth = *ev.cred
+		}
+		v.principal(&ev.AuditEvent, auth)
+		ev.resolved = true
+	}
+	ev.Err = err
+
+	if v.auditHook != nil {
+		v.auditHook(&ev.AuditEvent)
+	}
+	if v.afterHook != nil {
+		v.afterHook(ev)
+	}
+}
+
+// callOp is call for the operation of ev, if not nil, noting the credential
+// it was sent with
+func (v *Target) callOp(ev *OpEvent, c interface{}) (io.ReadSeeker, error) {
+	res, err := v.call(c)
+	if h, ok := c.(interface{ RPCHeader() *rpc.Header }); ok && ev != nil {
+		cred := h.RPCHeader().Cred
+		ev.cred = &cred
+	}
+
+	return res, err
+}
+
+// attr returns the attributes, nil if they are not set
+func (p *PostOpAttr) attr() *Fattr {
+	if !p.IsSet {
+		return nil
+	}
+
+	attr := p.Attr
+	return &attr
+}
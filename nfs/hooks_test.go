@@ -0,0 +1,63 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestOpHooks(t *testing.T) {
+	v := loopbackTarget(t)
+	defer v.Close()
+
+	var before, after []*OpEvent
+	var audited []*AuditEvent
+	v.SetOpHooks(func(ev *OpEvent) {
+		before = append(before, ev)
+	}, func(ev *OpEvent) {
+		after = append(after, ev)
+	})
+	v.SetAuditHook(func(ev *AuditEvent) { audited = append(audited, ev) })
+
+	if _, err := v.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	if len(before) != 1 || len(after) != 1 || before[0] != after[0] {
+		t.Fatalf("expected one matched event, got %d before and %d after", len(before), len(after))
+	}
+	if len(audited) != 1 || audited[0] != &after[0].AuditEvent {
+		t.Fatalf("expected the audit hook to see the event of the after hook, got %d", len(audited))
+	}
+	ev := after[0]
+	if ev.Op != "MKDIR" || ev.Name != "dir" || ev.Err != nil {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+	if ev.ObjFH == nil || ev.ObjAttr == nil || !ev.ObjAttr.IsDir() {
+		t.Fatalf("expected the new directory in the event, got %+v", ev)
+	}
+	if ev.Attr == nil || !ev.Attr.IsDir() {
+		t.Fatalf("expected the parent's post-op attributes, got %+v", ev.Attr)
+	}
+
+	f, err := v.OpenFile("/dir/file", 0644)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if _, err = f.Write([]byte("hello")); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	ev = after[len(after)-1]
+	if ev.Op != "WRITE" || ev.Count != 5 || ev.Attr == nil || ev.Attr.Size() != 5 {
+		t.Fatalf("unexpected write event %+v", ev)
+	}
+	f.Close()
+
+	err = v.Remove("/dir/missing")
+	ev = after[len(after)-1]
+	if ev.Op != "REMOVE" || !errors.Is(ev.Err, err) || !os.IsNotExist(ev.Err) {
+		t.Fatalf("expected the failed remove, got %+v", ev)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bufio"
+	"io"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IDResolver names the uids and gids of attributes and credentials, for
+// listings and audit logs to show names rather than numbers
+type IDResolver interface {
+	// User returns the name of uid, and false if it has none
+	User(uid uint32) (string, bool)
+
+	// Group returns the name of gid, and false if it has none
+	Group(gid uint32) (string, bool)
+}
+
+// StaticIDs is an IDResolver of fixed names
+type StaticIDs struct {
+	Users, Groups map[uint32]string
+}
+
+func (s *StaticIDs) User(uid uint32) (string, bool) {
+	name, ok := s.Users[uid]
+	return name, ok
+}
+
+func (s *StaticIDs) Group(gid uint32) (string, bool) {
+	name, ok := s.Groups[gid]
+	return name, ok
+}
+
+// ParsePasswd reads the names of files in the formats of /etc/passwd and
+// /etc/group, of the server rather than of the client say, either of which
+// may be nil.  Comments, blank lines and NIS entries are skipped.
+func ParsePasswd(passwd, group io.Reader) (*StaticIDs, error) {
+	s := &StaticIDs{Users: make(map[uint32]string), Groups: make(map[uint32]string)}
+
+	for _, f := range []struct {
+		r     io.Reader
+		names map[uint32]string
+	}{{passwd, s.Users}, {group, s.Groups}} {
+		if f.r == nil {
+			continue
+		}
+
+		sc := bufio.NewScanner(f.r)
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if line == "" || line[0] == '#' || line[0] == '+' || line[0] == '-' {
+				continue
+			}
+
+			// name:password:id:...
+			fields := strings.SplitN(line, ":", 4)
+			if len(fields) < 3 {
+				continue
+			}
+			id, err := strconv.ParseUint(fields[2], 10, 32)
+			if err != nil {
+				continue
+			}
+			// the first name of an id wins, as getpwuid returns it
+			if _, ok := f.names[uint32(id)]; !ok {
+				f.names[uint32(id)] = fields[0]
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// SystemIDs names ids as the client system does, through os/user: from
+// /etc/passwd and /etc/group, or, when built with cgo, from whatever the name
+// service switch is set up with, such as LDAP.  Clients and servers sharing
+// a directory agree on names.
+type SystemIDs struct{}
+
+func (SystemIDs) User(uid uint32) (string, bool) {
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return "", false
+	}
+	return u.Username, true
+}
+
+func (SystemIDs) Group(gid uint32) (string, bool) {
+	g, err := user.LookupGroupId(strconv.FormatUint(uint64(gid), 10))
+	if err != nil {
+		return "", false
+	}
+	return g.Name, true
+}
+
+// CachedIDs keeps the names an IDResolver gives, and their absence, for TTL,
+// for resolvers too slow to be asked for every entry of a listing, as those
+// asking a directory server are.  It is safe for concurrent use.
+type CachedIDs struct {
+	resolver IDResolver
+	ttl      time.Duration
+
+	mu     sync.Mutex
+	users  map[uint32]cachedID
+	groups map[uint32]cachedID
+}
+
+type cachedID struct {
+	name    string
+	ok      bool
+	expires time.Time
+}
+
+// NewCachedIDs returns r with its names kept for ttl
+func NewCachedIDs(r IDResolver, ttl time.Duration) *CachedIDs {
+	return &CachedIDs{
+		resolver: r,
+		ttl:      ttl,
+		users:    make(map[uint32]cachedID),
+		groups:   make(map[uint32]cachedID),
+	}
+}
+
+func (c *CachedIDs) User(uid uint32) (string, bool) {
+	return c.lookup(c.users, uid, c.resolver.User)
+}
+
+func (c *CachedIDs) Group(gid uint32) (string, bool) {
+	return c.lookup(c.groups, gid, c.resolver.Group)
+}
+
+func (c *CachedIDs) lookup(cache map[uint32]cachedID, id uint32, resolve func(uint32) (string, bool)) (string, bool) {
+	c.mu.Lock()
+	e, ok := cache[id]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.name, e.ok
+	}
+
+	e.name, e.ok = resolve(id)
+	e.expires = time.Now().Add(c.ttl)
+
+	c.mu.Lock()
+	cache[id] = e
+	c.mu.Unlock()
+
+	return e.name, e.ok
+}
+
+// SetIDResolver has the user and group of audit events named by r, nil for
+// numbers only.  Audit hooks are called synchronously, so a slow resolver
+// should be wrapped in CachedIDs.
+func (v *Target) SetIDResolver(r IDResolver) {
+	v.ids = r
+}
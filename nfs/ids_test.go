@@ -0,0 +1,78 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+type countingIDs struct {
+	StaticIDs
+	calls int
+}
+
+func (c *countingIDs) User(uid uint32) (string, bool) {
+	c.calls++
+	return c.StaticIDs.User(uid)
+}
+
+func TestIDResolvers(t *testing.T) {
+	ids, err := ParsePasswd(strings.NewReader(`# users
+root:x:0:0:root:/root:/bin/sh
+alice:x:1000:1000::/home/alice:/bin/sh
+toor:x:0:0:root:/root:/bin/sh
++@nis::::::
+`), strings.NewReader(`wheel:x:0:root
+staff:x:50:alice
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := ids.User(0); name != "root" {
+		t.Fatalf("uid 0 is %q", name)
+	}
+	if name, _ := ids.Group(50); name != "staff" {
+		t.Fatalf("gid 50 is %q", name)
+	}
+	if _, ok := ids.User(1001); ok {
+		t.Fatal("uid 1001 named")
+	}
+
+	slow := &countingIDs{StaticIDs: *ids}
+	cached := NewCachedIDs(slow, time.Hour)
+	for i := 0; i < 3; i++ {
+		cached.User(1000)
+		cached.User(1001)
+	}
+	if slow.calls != 2 {
+		t.Fatalf("resolver asked %d times", slow.calls)
+	}
+
+	lf := &ListFormat{Users: map[uint32]string{1000: "override"}, Resolver: cached}
+	line := lf.Line("f", &Fattr{Type: NF3Reg, UID: 1000, GID: 50}, "")
+	if !strings.Contains(line, " override staff ") {
+		t.Fatalf("line %q", line)
+	}
+
+	s := NewServer(NewMemFS())
+	v, err := DialLoopback(s).Mount("/", rpc.NewAuthUnix("client", 1000, 0).Auth())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	var ev *AuditEvent
+	v.SetAuditHook(func(e *AuditEvent) { ev = e })
+	v.SetIDResolver(ids)
+	if _, err = v.Mkdir("/d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if ev == nil || ev.User != "alice" || ev.Group != "wheel" {
+		t.Fatalf("audit event %+v", ev)
+	}
+}
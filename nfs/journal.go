@@ -0,0 +1,163 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// Journal is a durable queue of mutations kept in a local file, for
+// replicating a tree to a mirror that is only reachable now and then.
+// Mutations applied to the primary are appended as they happen, and replayed
+// against the mirror whenever it can be reached.  The file holds one JSON
+// Mutation per line and survives restarts.
+type Journal struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	pending []Mutation
+}
+
+// OpenJournal opens the journal in the file path, creating it if need be.
+// Mutations left in it by an earlier run are pending again.  A last line cut
+// short by a crash is dropped.
+func OpenJournal(path string) (*Journal, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	j := &Journal{path: path}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, len(data)+1)
+	for line := 1; sc.Scan(); line++ {
+		var m Mutation
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			util.Errorf("journal %s: line %d: %s, dropped", path, line, err)
+			break
+		}
+		j.pending = append(j.pending, m)
+	}
+
+	// rewrite it, to drop a torn line before appending behind it
+	if err = j.rewrite(); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// Append adds m to the journal, on disk before it returns
+func (j *Journal) Append(m Mutation) error {
+	line, err := json.Marshal(&m)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err = j.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err = j.f.Sync(); err != nil {
+		return err
+	}
+	j.pending = append(j.pending, m)
+
+	return nil
+}
+
+// Pending returns the mutations not replayed yet
+func (j *Journal) Pending() []Mutation {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return append([]Mutation(nil), j.pending...)
+}
+
+// Replay applies the pending mutations to v, in order, and drops them from
+// the journal.  It stops at the first that fails, with a *MirrorError, and
+// returns how many were applied.  Should the process die in the middle, the
+// mutations applied already are replayed again next time, which Apply
+// tolerates.
+func (j *Journal) Replay(v *Target) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	n := 0
+	var err error
+	for _, m := range j.pending {
+		if aerr := m.Apply(v); aerr != nil {
+			err = &MirrorError{Mutation: m, Err: aerr}
+			break
+		}
+		n++
+	}
+	if n == 0 {
+		return 0, err
+	}
+
+	j.pending = j.pending[n:]
+	if werr := j.rewrite(); werr != nil && err == nil {
+		err = werr
+	}
+	util.Debugf("journal %s: %d mutations replayed, %d pending", j.path, n, len(j.pending))
+
+	return n, err
+}
+
+// Close closes the file of the journal
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.f.Close()
+}
+
+// rewrite replaces the file with the pending mutations, and reopens it for
+// appending; the caller holds the lock
+func (j *Journal) rewrite() error {
+	w := new(bytes.Buffer)
+	enc := json.NewEncoder(w)
+	for i := range j.pending {
+		if err := enc.Encode(&j.pending[i]); err != nil {
+			return err
+		}
+	}
+
+	// write then rename, so a crash leaves either journal whole
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(w.Bytes()); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if j.f != nil {
+		j.f.Close()
+	}
+	j.f, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0600)
+
+	return err
+}
@@ -0,0 +1,78 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	for _, m := range []Mutation{
+		{Op: OpMkdir, Path: "/etc", Mode: 0755},
+		{Op: OpCreate, Path: "/etc/a", Mode: 0644, Data: []byte("hello")},
+		{Op: OpWrite, Path: "/etc/a", Mode: 0644, Offset: 5, Data: []byte(" world")},
+		{Op: OpRename, Path: "/etc/a", To: "/etc/b"},
+		{Op: OpCreate, Path: "/tmp/c", Mode: 0644, Data: []byte("c")},
+		{Op: OpRemove, Path: "/etc/b"},
+	} {
+		if err = j.Append(m); err != nil {
+			t.Fatalf("append: %s", err)
+		}
+	}
+	j.Close()
+
+	// a crash cut the last line short
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"mkd`)
+	f.Close()
+
+	if j, err = OpenJournal(path); err != nil {
+		t.Fatalf("reopen: %s", err)
+	}
+	defer j.Close()
+	if n := len(j.Pending()); n != 6 {
+		t.Fatalf("%d mutations pending after reopening, want 6", n)
+	}
+
+	mirror := loopbackTarget(t)
+	defer mirror.Close()
+
+	// /tmp is missing on the mirror
+	n, err := j.Replay(mirror)
+	if n != 4 || err == nil {
+		t.Fatalf("replay: %d, %v", n, err)
+	}
+	if got := readAll(t, mirror, "/etc/b"); got != "hello world" {
+		t.Errorf("read %q", got)
+	}
+
+	if _, err = mirror.Mkdir("/tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = j.Replay(mirror); n != 2 || err != nil {
+		t.Fatalf("second replay: %d, %v", n, err)
+	}
+	if _, _, err = mirror.Lookup("/etc/b"); !os.IsNotExist(err) {
+		t.Errorf("/etc/b not removed: %v", err)
+	}
+
+	if j, err = OpenJournal(path); err != nil {
+		t.Fatalf("reopen: %s", err)
+	}
+	defer j.Close()
+	if n := len(j.Pending()); n != 0 {
+		t.Errorf("%d mutations pending after replay", n)
+	}
+}
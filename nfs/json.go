@@ -0,0 +1,305 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// JSON encodings of attributes and listings, with field names that stay the
+// same from one release to the next, for monitoring agents to emit as they
+// are.  Times are RFC 3339 strings in UTC, modes octal strings and file types
+// names.
+
+// MarshalJSON encodes t as an RFC 3339 time in UTC, to the nanosecond
+func (t NFS3Time) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.Time().UTC())
+}
+
+func (t *NFS3Time) UnmarshalJSON(b []byte) error {
+	var tm time.Time
+	if err := json.Unmarshal(b, &tm); err != nil {
+		return err
+	}
+
+	*t = NewNFS3Time(tm)
+	return nil
+}
+
+var typeToJSON = map[uint32]string{
+	NF3Reg:  "file",
+	NF3Dir:  "directory",
+	NF3Blk:  "block",
+	NF3Chr:  "char",
+	NF3Lnk:  "symlink",
+	NF3Sock: "socket",
+	NF3FIFO: "fifo",
+}
+
+type fattrJSON struct {
+	Type   string    `json:"type"`
+	Mode   string    `json:"mode"`
+	Nlink  uint32    `json:"nlink"`
+	UID    uint32    `json:"uid"`
+	GID    uint32    `json:"gid"`
+	Size   uint64    `json:"size"`
+	Used   uint64    `json:"used"`
+	Rdev   [2]uint32 `json:"rdev"`
+	FSID   uint64    `json:"fsid"`
+	FileID uint64    `json:"fileid"`
+	Atime  NFS3Time  `json:"atime"`
+	Mtime  NFS3Time  `json:"mtime"`
+	Ctime  NFS3Time  `json:"ctime"`
+}
+
+func (f Fattr) MarshalJSON() ([]byte, error) {
+	typ, ok := typeToJSON[f.Type]
+	if !ok {
+		typ = strconv.FormatUint(uint64(f.Type), 10)
+	}
+
+	return json.Marshal(&fattrJSON{
+		Type:   typ,
+		Mode:   fmt.Sprintf("%04o", f.FileMode),
+		Nlink:  f.Nlink,
+		UID:    f.UID,
+		GID:    f.GID,
+		Size:   f.Filesize,
+		Used:   f.Used,
+		Rdev:   f.SpecData,
+		FSID:   f.FSID,
+		FileID: f.Fileid,
+		Atime:  f.Atime,
+		Mtime:  f.Mtime,
+		Ctime:  f.Ctime,
+	})
+}
+
+func (f *Fattr) UnmarshalJSON(b []byte) error {
+	var j fattrJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+
+	mode, err := strconv.ParseUint(j.Mode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("mode %q: %w", j.Mode, err)
+	}
+
+	*f = Fattr{
+		FileMode: uint32(mode),
+		Nlink:    j.Nlink,
+		UID:      j.UID,
+		GID:      j.GID,
+		Filesize: j.Size,
+		Used:     j.Used,
+		SpecData: j.Rdev,
+		FSID:     j.FSID,
+		Fileid:   j.FileID,
+		Atime:    j.Atime,
+		Mtime:    j.Mtime,
+		Ctime:    j.Ctime,
+	}
+
+	for typ, name := range typeToJSON {
+		if name == j.Type {
+			f.Type = typ
+			return nil
+		}
+	}
+	typ, err := strconv.ParseUint(j.Type, 10, 32)
+	if err != nil {
+		return fmt.Errorf("type %q: unknown", j.Type)
+	}
+	f.Type = uint32(typ)
+
+	return nil
+}
+
+// MarshalJSON encodes the attributes, or null if there are none
+func (p PostOpAttr) MarshalJSON() ([]byte, error) {
+	if !p.IsSet {
+		return []byte("null"), nil
+	}
+
+	return json.Marshal(p.Attr)
+}
+
+func (p *PostOpAttr) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*p = PostOpAttr{}
+		return nil
+	}
+
+	p.IsSet = true
+	return json.Unmarshal(b, &p.Attr)
+}
+
+type entryPlusJSON struct {
+	Name   string     `json:"name"`
+	FileID uint64     `json:"fileid"`
+	Cookie uint64     `json:"cookie"`
+	Attr   PostOpAttr `json:"attr"`
+	Handle string     `json:"handle,omitempty"`
+}
+
+// MarshalJSON encodes the entry, its handle in hex
+func (e EntryPlus) MarshalJSON() ([]byte, error) {
+	j := entryPlusJSON{Name: e.FileName, FileID: e.FileId, Cookie: e.Cookie, Attr: e.Attr}
+	if e.Handle.IsSet {
+		j.Handle = hex.EncodeToString(e.Handle.FH)
+	}
+
+	return json.Marshal(&j)
+}
+
+func (e *EntryPlus) UnmarshalJSON(b []byte) error {
+	var j entryPlusJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+
+	*e = EntryPlus{FileName: j.Name, FileId: j.FileID, Cookie: j.Cookie, Attr: j.Attr}
+	if j.Handle != "" {
+		fh, err := hex.DecodeString(j.Handle)
+		if err != nil {
+			return fmt.Errorf("handle: %w", err)
+		}
+		e.Handle = PostOpFH3{IsSet: true, FH: fh}
+	}
+
+	return nil
+}
+
+// FSINFO properties by name
+var propertiesToJSON = []struct {
+	bit  uint32
+	name string
+}{
+	{FSF3Link, "link"},
+	{FSF3Symlink, "symlink"},
+	{FSF3Homogeneous, "homogeneous"},
+	{FSF3CanSetTime, "cansettime"},
+}
+
+type fsInfoJSON struct {
+	Attr        PostOpAttr `json:"attr"`
+	RTMax       uint32     `json:"rtmax"`
+	RTPref      uint32     `json:"rtpref"`
+	RTMult      uint32     `json:"rtmult"`
+	WTMax       uint32     `json:"wtmax"`
+	WTPref      uint32     `json:"wtpref"`
+	WTMult      uint32     `json:"wtmult"`
+	DTPref      uint32     `json:"dtpref"`
+	MaxFileSize uint64     `json:"maxfilesize"`
+	TimeDelta   int64      `json:"time_delta_ns"`
+	Properties  []string   `json:"properties"`
+}
+
+func (fi FSInfo) MarshalJSON() ([]byte, error) {
+	j := fsInfoJSON{
+		Attr:        fi.Attr,
+		RTMax:       fi.RTMax,
+		RTPref:      fi.RTPref,
+		RTMult:      fi.RTMult,
+		WTMax:       fi.WTMax,
+		WTPref:      fi.WTPref,
+		WTMult:      fi.WTMult,
+		DTPref:      fi.DTPref,
+		MaxFileSize: fi.Size,
+		TimeDelta:   int64(fi.TimeDelta.Seconds)*int64(time.Second) + int64(fi.TimeDelta.Nseconds),
+		Properties:  []string{},
+	}
+	for _, p := range propertiesToJSON {
+		if fi.Properties&p.bit != 0 {
+			j.Properties = append(j.Properties, p.name)
+		}
+	}
+
+	return json.Marshal(&j)
+}
+
+func (fi *FSInfo) UnmarshalJSON(b []byte) error {
+	var j fsInfoJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+
+	*fi = FSInfo{
+		Attr:   j.Attr,
+		RTMax:  j.RTMax,
+		RTPref: j.RTPref,
+		RTMult: j.RTMult,
+		WTMax:  j.WTMax,
+		WTPref: j.WTPref,
+		WTMult: j.WTMult,
+		DTPref: j.DTPref,
+		Size:   j.MaxFileSize,
+		TimeDelta: NFS3Time{
+			Seconds:  uint32(j.TimeDelta / int64(time.Second)),
+			Nseconds: uint32(j.TimeDelta % int64(time.Second)),
+		},
+	}
+
+names:
+	for _, name := range j.Properties {
+		for _, p := range propertiesToJSON {
+			if p.name == name {
+				fi.Properties |= p.bit
+				continue names
+			}
+		}
+		return fmt.Errorf("property %q: unknown", name)
+	}
+
+	return nil
+}
+
+type fsStatJSON struct {
+	Attr       PostOpAttr `json:"attr"`
+	TotalBytes uint64     `json:"total_bytes"`
+	FreeBytes  uint64     `json:"free_bytes"`
+	AvailBytes uint64     `json:"avail_bytes"`
+	TotalFiles uint64     `json:"total_files"`
+	FreeFiles  uint64     `json:"free_files"`
+	AvailFiles uint64     `json:"avail_files"`
+	Invarsec   uint32     `json:"invarsec"`
+}
+
+func (st FSStat) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&fsStatJSON{
+		Attr:       st.Attr,
+		TotalBytes: st.TBytes,
+		FreeBytes:  st.FBytes,
+		AvailBytes: st.ABytes,
+		TotalFiles: st.TFiles,
+		FreeFiles:  st.FFiles,
+		AvailFiles: st.AFiles,
+		Invarsec:   st.Invarsec,
+	})
+}
+
+func (st *FSStat) UnmarshalJSON(b []byte) error {
+	var j fsStatJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+
+	*st = FSStat{
+		Attr:     j.Attr,
+		TBytes:   j.TotalBytes,
+		FBytes:   j.FreeBytes,
+		ABytes:   j.AvailBytes,
+		TFiles:   j.TotalFiles,
+		FFiles:   j.FreeFiles,
+		AFiles:   j.AvailFiles,
+		Invarsec: j.Invarsec,
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestJSON(t *testing.T) {
+	attr := Fattr{
+		Type:     NF3Reg,
+		FileMode: 0644,
+		Nlink:    1,
+		UID:      1000,
+		GID:      100,
+		Filesize: 5,
+		Used:     4096,
+		FSID:     7,
+		Fileid:   42,
+		Mtime:    NFS3Time{Seconds: 1700000000, Nseconds: 5},
+	}
+
+	b, err := json.Marshal(attr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"type":"file","mode":"0644","nlink":1,"uid":1000,"gid":100,"size":5,"used":4096,"rdev":[0,0],` +
+		`"fsid":7,"fileid":42,"atime":"1970-01-01T00:00:00Z","mtime":"2023-11-14T22:13:20.000000005Z","ctime":"1970-01-01T00:00:00Z"}`
+	if string(b) != want {
+		t.Fatalf("got %s\nwant %s", b, want)
+	}
+
+	e := EntryPlus{FileId: 42, FileName: "f", Cookie: 3, Attr: PostOpAttr{IsSet: true, Attr: attr}, Handle: PostOpFH3{IsSet: true, FH: []byte{1, 2}}}
+	fsinfo := DefaultServerFSInfo
+	fsstat := FSStat{TBytes: 100, FBytes: 50, ABytes: 40, TFiles: 10, FFiles: 5, AFiles: 4, Invarsec: 1}
+	for _, tc := range []struct{ in, out interface{} }{
+		{&e, new(EntryPlus)},
+		{&EntryPlus{FileName: "bare"}, new(EntryPlus)},
+		{&fsinfo, new(FSInfo)},
+		{&fsstat, new(FSStat)},
+	} {
+		b, err := json.Marshal(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = json.Unmarshal(b, tc.out); err != nil {
+			t.Fatalf("%s: %s", b, err)
+		}
+		if !reflect.DeepEqual(tc.in, tc.out) {
+			t.Errorf("%s: round trip gave %+v", b, tc.out)
+		}
+	}
+}
@@ -0,0 +1,575 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemFS is a Backend keeping a filesystem in memory, for tests and as a mock
+// server.  Every export path is its root directory.
+type MemFS struct {
+	sync.Mutex
+
+	nodes  map[uint64]*memNode
+	nextID uint64
+}
+
+type memNode struct {
+	attr     Fattr
+	data     []byte
+	target   string
+	children map[string]uint64
+}
+
+const memFSRoot = 1
+
+// NewMemFS returns an empty filesystem
+func NewMemFS() *MemFS {
+	fs := &MemFS{
+		nodes:  make(map[uint64]*memNode),
+		nextID: memFSRoot,
+	}
+	fs.newNode(NF3Dir, 0755)
+
+	return fs
+}
+
+// newNode adds a node, the caller holds the lock
+func (fs *MemFS) newNode(typ uint32, mode uint32) (uint64, *memNode) {
+	id := fs.nextID
+	fs.nextID++
+
+	now := memFSNow()
+	n := &memNode{
+		attr: Fattr{
+			Type:     typ,
+			FileMode: mode & ModeMask,
+			Nlink:    1,
+			FSID:     1,
+			Fileid:   id,
+			Atime:    now,
+			Mtime:    now,
+			Ctime:    now,
+		},
+	}
+	if typ == NF3Dir {
+		n.attr.Nlink = 2
+		n.children = make(map[string]uint64)
+	}
+	fs.nodes[id] = n
+
+	return id, n
+}
+
+func memFSNow() NFS3Time {
+	return NewNFS3Time(time.Now())
+}
+
+// touch updates the mtime and ctime of n
+func (n *memNode) touch() {
+	n.attr.Mtime = memFSNow()
+	n.attr.Ctime = n.attr.Mtime
+}
+
+// node returns the node of fh, the caller holds the lock
+func (fs *MemFS) node(fh []byte) (*memNode, error) {
+	id, ok := parseHandleID(fh)
+	if !ok {
+		return nil, NFS3Error(NFS3ErrBadHandle)
+	}
+
+	n, ok := fs.nodes[id]
+	if !ok {
+		return nil, NFS3Error(NFS3ErrStale)
+	}
+
+	return n, nil
+}
+
+// dir returns the directory node of fh, the caller holds the lock
+func (fs *MemFS) dir(fh []byte) (*memNode, error) {
+	n, err := fs.node(fh)
+	if err != nil {
+		return nil, err
+	}
+	if n.attr.Type != NF3Dir {
+		return nil, NFS3Error(NFS3ErrNotDir)
+	}
+
+	return n, nil
+}
+
+func validName(name string) error {
+	switch {
+	case name == "" || name == "." || name == "..":
+		return NFS3Error(NFS3ErrInval)
+	case len(name) > 255:
+		return NFS3Error(NFS3ErrNameTooLong)
+	}
+
+	return nil
+}
+
+func (fs *MemFS) Root(dirpath string) ([]byte, error) {
+	return handleID(memFSRoot), nil
+}
+
+func (fs *MemFS) GetAttr(fh []byte) (*Fattr, error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	n, err := fs.node(fh)
+	if err != nil {
+		return nil, err
+	}
+
+	attr := n.attr
+	return &attr, nil
+}
+
+func (fs *MemFS) SetAttr(fh []byte, attr Sattr3) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	n, err := fs.node(fh)
+	if err != nil {
+		return err
+	}
+
+	return n.setAttr(attr)
+}
+
+// setAttr applies attr to n, the caller holds the lock
+func (n *memNode) setAttr(attr Sattr3) error {
+	if attr.Size.SetIt {
+		if n.attr.Type != NF3Reg {
+			return NFS3Error(NFS3ErrInval)
+		}
+		n.resize(attr.Size.Size)
+		n.attr.Mtime = memFSNow()
+	}
+	if attr.Mode.SetIt {
+		n.attr.FileMode = attr.Mode.Mode & ModeMask
+	}
+	if attr.UID.SetIt {
+		n.attr.UID = attr.UID.UID
+	}
+	if attr.GID.SetIt {
+		n.attr.GID = attr.GID.UID
+	}
+
+	switch attr.Atime.SetIt {
+	case SetToServerTime:
+		n.attr.Atime = memFSNow()
+	case SetToClientTime:
+		n.attr.Atime = attr.Atime.Time
+	}
+	switch attr.Mtime.SetIt {
+	case SetToServerTime:
+		n.attr.Mtime = memFSNow()
+	case SetToClientTime:
+		n.attr.Mtime = attr.Mtime.Time
+	}
+	n.attr.Ctime = memFSNow()
+
+	return nil
+}
+
+func (n *memNode) resize(size uint64) {
+	if size <= uint64(len(n.data)) {
+		n.data = n.data[:size]
+	} else {
+		n.data = append(n.data, make([]byte, size-uint64(len(n.data)))...)
+	}
+	n.attr.Filesize = size
+	n.attr.Used = size
+}
+
+func (fs *MemFS) Lookup(dir []byte, name string) ([]byte, error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	d, err := fs.dir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	id, ok := d.children[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return handleID(id), nil
+}
+
+func (fs *MemFS) Readlink(fh []byte) (string, error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	n, err := fs.node(fh)
+	if err != nil {
+		return "", err
+	}
+	if n.attr.Type != NF3Lnk {
+		return "", NFS3Error(NFS3ErrInval)
+	}
+
+	return n.target, nil
+}
+
+func (fs *MemFS) Read(fh []byte, offset uint64, count uint32) ([]byte, bool, error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	n, err := fs.node(fh)
+	if err != nil {
+		return nil, false, err
+	}
+	if n.attr.Type == NF3Dir {
+		return nil, false, NFS3Error(NFS3ErrIsDir)
+	}
+
+	size := uint64(len(n.data))
+	if offset >= size {
+		return nil, true, nil
+	}
+
+	end := offset + uint64(count)
+	if end > size {
+		end = size
+	}
+
+	data := make([]byte, end-offset)
+	copy(data, n.data[offset:end])
+	n.attr.Atime = memFSNow()
+
+	return data, end == size, nil
+}
+
+func (fs *MemFS) Write(fh []byte, offset uint64, data []byte) (int, error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	n, err := fs.node(fh)
+	if err != nil {
+		return 0, err
+	}
+	if n.attr.Type != NF3Reg {
+		return 0, NFS3Error(NFS3ErrInval)
+	}
+
+	end := offset + uint64(len(data))
+	if end > uint64(len(n.data)) {
+		n.resize(end)
+	}
+	copy(n.data[offset:], data)
+	n.touch()
+
+	return len(data), nil
+}
+
+func (fs *MemFS) Commit(fh []byte) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	_, err := fs.node(fh)
+	return err
+}
+
+// create adds a new node to dir, the caller holds the lock
+func (fs *MemFS) create(dir []byte, name string, typ uint32, attr Sattr3) ([]byte, *memNode, error) {
+	if err := validName(name); err != nil {
+		return nil, nil, err
+	}
+
+	d, err := fs.dir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := d.children[name]; ok {
+		return nil, nil, os.ErrExist
+	}
+
+	mode := uint32(0644)
+	if typ == NF3Dir {
+		mode = 0755
+	}
+	if typ == NF3Lnk {
+		mode = 0777
+	}
+	id, n := fs.newNode(typ, mode)
+	n.setAttr(attr)
+
+	d.children[name] = id
+	if typ == NF3Dir {
+		d.attr.Nlink++
+	}
+	d.touch()
+
+	return handleID(id), n, nil
+}
+
+func (fs *MemFS) Create(dir []byte, name string, attr Sattr3, guarded bool) ([]byte, error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if d, err := fs.dir(dir); err == nil && !guarded {
+		if id, ok := d.children[name]; ok {
+			n := fs.nodes[id]
+			if n.attr.Type != NF3Reg {
+				return nil, os.ErrExist
+			}
+			return handleID(id), n.setAttr(attr)
+		}
+	}
+
+	fh, _, err := fs.create(dir, name, NF3Reg, attr)
+	return fh, err
+}
+
+func (fs *MemFS) Mkdir(dir []byte, name string, attr Sattr3) ([]byte, error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	fh, _, err := fs.create(dir, name, NF3Dir, attr)
+	return fh, err
+}
+
+func (fs *MemFS) Symlink(dir []byte, name, target string, attr Sattr3) ([]byte, error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	fh, n, err := fs.create(dir, name, NF3Lnk, attr)
+	if err != nil {
+		return nil, err
+	}
+	n.target = target
+	n.attr.Filesize = uint64(len(target))
+
+	return fh, nil
+}
+
+func (fs *MemFS) Link(fh []byte, dir []byte, name string) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if err := validName(name); err != nil {
+		return err
+	}
+
+	n, err := fs.node(fh)
+	if err != nil {
+		return err
+	}
+	if n.attr.Type == NF3Dir {
+		return NFS3Error(NFS3ErrIsDir)
+	}
+
+	d, err := fs.dir(dir)
+	if err != nil {
+		return err
+	}
+	if _, ok := d.children[name]; ok {
+		return os.ErrExist
+	}
+
+	id, _ := parseHandleID(fh)
+	d.children[name] = id
+	d.touch()
+	n.attr.Nlink++
+	n.attr.Ctime = memFSNow()
+
+	return nil
+}
+
+// unlink drops name from d, the caller holds the lock
+func (fs *MemFS) unlink(d *memNode, name string) {
+	id := d.children[name]
+	delete(d.children, name)
+	d.touch()
+
+	n := fs.nodes[id]
+	if n.attr.Type == NF3Dir {
+		d.attr.Nlink--
+		delete(fs.nodes, id)
+		return
+	}
+
+	n.attr.Nlink--
+	n.attr.Ctime = memFSNow()
+	if n.attr.Nlink == 0 {
+		delete(fs.nodes, id)
+	}
+}
+
+func (fs *MemFS) Remove(dir []byte, name string) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	d, err := fs.dir(dir)
+	if err != nil {
+		return err
+	}
+
+	id, ok := d.children[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if fs.nodes[id].attr.Type == NF3Dir {
+		return NFS3Error(NFS3ErrIsDir)
+	}
+
+	fs.unlink(d, name)
+	return nil
+}
+
+func (fs *MemFS) RmDir(dir []byte, name string) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	d, err := fs.dir(dir)
+	if err != nil {
+		return err
+	}
+
+	id, ok := d.children[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	n := fs.nodes[id]
+	if n.attr.Type != NF3Dir {
+		return NFS3Error(NFS3ErrNotDir)
+	}
+	if len(n.children) != 0 {
+		return NFS3Error(NFS3ErrNotEmpty)
+	}
+
+	fs.unlink(d, name)
+	return nil
+}
+
+func (fs *MemFS) Rename(fromDir []byte, fromName string, toDir []byte, toName string) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if err := validName(toName); err != nil {
+		return err
+	}
+
+	from, err := fs.dir(fromDir)
+	if err != nil {
+		return err
+	}
+	to, err := fs.dir(toDir)
+	if err != nil {
+		return err
+	}
+
+	id, ok := from.children[fromName]
+	if !ok {
+		return os.ErrNotExist
+	}
+	n := fs.nodes[id]
+
+	// a directory may not be moved below itself
+	if n.attr.Type == NF3Dir {
+		toID, _ := parseHandleID(toDir)
+		if fs.contains(id, toID) {
+			return NFS3Error(NFS3ErrInval)
+		}
+	}
+
+	if oldID, ok := to.children[toName]; ok {
+		if oldID == id {
+			return nil
+		}
+
+		old := fs.nodes[oldID]
+		switch {
+		case n.attr.Type == NF3Dir && old.attr.Type != NF3Dir:
+			return NFS3Error(NFS3ErrNotDir)
+		case n.attr.Type != NF3Dir && old.attr.Type == NF3Dir:
+			return NFS3Error(NFS3ErrIsDir)
+		case old.attr.Type == NF3Dir && len(old.children) != 0:
+			return NFS3Error(NFS3ErrNotEmpty)
+		}
+		fs.unlink(to, toName)
+	}
+
+	delete(from.children, fromName)
+	to.children[toName] = id
+	if n.attr.Type == NF3Dir {
+		from.attr.Nlink--
+		to.attr.Nlink++
+	}
+	from.touch()
+	to.touch()
+	n.attr.Ctime = memFSNow()
+
+	return nil
+}
+
+// contains reports whether dir is id or below it, the caller holds the lock
+func (fs *MemFS) contains(id, dir uint64) bool {
+	if id == dir {
+		return true
+	}
+
+	n := fs.nodes[id]
+	for _, child := range n.children {
+		if c := fs.nodes[child]; c != nil && c.attr.Type == NF3Dir && fs.contains(child, dir) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (fs *MemFS) ReadDir(dir []byte) ([]string, error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	d, err := fs.dir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// sorted, so that cookies stay put while the directory is unchanged
+	names := make([]string, 0, len(d.children))
+	for name := range d.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (fs *MemFS) FSStat(fh []byte) (*FSStat, error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if _, err := fs.node(fh); err != nil {
+		return nil, err
+	}
+
+	var used uint64
+	for _, n := range fs.nodes {
+		used += uint64(len(n.data))
+	}
+
+	const total = 1 << 40
+	return &FSStat{
+		TBytes: total,
+		FBytes: total - used,
+		ABytes: total - used,
+		TFiles: 1 << 32,
+		FFiles: 1<<32 - uint64(len(fs.nodes)),
+		AFiles: 1<<32 - uint64(len(fs.nodes)),
+	}, nil
+}
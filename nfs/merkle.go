@@ -0,0 +1,354 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	_path "path"
+	"sort"
+	"strings"
+)
+
+// MerkleNode is an entry of a MerkleTree.  The hash of a regular file is the
+// SHA-256 of its data, that of a symlink the SHA-256 of its target, and that
+// of a directory the SHA-256 of the names, types and hashes of its entries,
+// sorted by name.  Owners, permissions and times are left out, for trees
+// copied with different ones to compare equal.
+type MerkleNode struct {
+	Type     uint32                 `json:"type"`
+	Hash     []byte                 `json:"hash"`
+	Children map[string]*MerkleNode `json:"children,omitempty"`
+}
+
+// MerkleTree is the hash tree of a remote tree, whose subtrees compare equal
+// with those of another one when their hashes do, without reading them
+type MerkleTree struct {
+	Root *MerkleNode `json:"root"`
+}
+
+// BuildMerkleTree reads the whole of tree and returns its hash tree
+func BuildMerkleTree(tree *TreeRef) (*MerkleTree, error) {
+	attr, fh, err := tree.Target.GetAttr(tree.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := buildMerkleNode(tree.Target, &diffEntry{fh: fh, attr: attr})
+	if err != nil {
+		return nil, err
+	}
+
+	return &MerkleTree{Root: root}, nil
+}
+
+// LoadMerkleTree reads a tree written by Save
+func LoadMerkleTree(r io.Reader) (*MerkleTree, error) {
+	m := new(MerkleTree)
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Save writes m to w as JSON, for a later Update
+func (m *MerkleTree) Save(w io.Writer) error {
+	return json.NewEncoder(w).Encode(m)
+}
+
+// Find returns the node at path of the tree, nil if there is none
+func (m *MerkleTree) Find(path string) *MerkleNode {
+	n := m.Root
+	for _, name := range strings.Split(strings.Trim(_path.Clean("/"+path), "/"), "/") {
+		if name == "" {
+			break
+		}
+		if n = n.Children[name]; n == nil {
+			return nil
+		}
+	}
+
+	return n
+}
+
+// Diff returns the paths, sorted, at which m and o differ: entries only in
+// one of them, and entries of different types or hashes.  Subtrees of equal
+// hashes are not descended into, and a directory is only reported when it
+// is missing from either tree or is something else in the other.
+func (m *MerkleTree) Diff(o *MerkleTree) []string {
+	var paths []string
+	diffMerkleNodes(m.Root, o.Root, "/", &paths)
+	sort.Strings(paths)
+
+	return paths
+}
+
+func diffMerkleNodes(a, b *MerkleNode, path string, paths *[]string) {
+	if a.Type == b.Type && bytes.Equal(a.Hash, b.Hash) {
+		return
+	}
+	if a.Type != NF3Dir || b.Type != NF3Dir {
+		*paths = append(*paths, path)
+		return
+	}
+
+	for name, ac := range a.Children {
+		if bc, ok := b.Children[name]; ok {
+			diffMerkleNodes(ac, bc, _path.Join(path, name), paths)
+		} else {
+			*paths = append(*paths, _path.Join(path, name))
+		}
+	}
+	for name := range b.Children {
+		if _, ok := a.Children[name]; !ok {
+			*paths = append(*paths, _path.Join(path, name))
+		}
+	}
+}
+
+// Update returns the hash tree of tree, of which m is an older hash tree,
+// reading only the entries at the paths of changed and the directories
+// above them.  changed are paths on the target, as ChangedSince(tree.Path)
+// returns them: entries created or modified, and directories an entry was
+// created in or removed from.  Paths outside tree are ignored.  m is left
+// as it was, the new tree sharing the nodes that did not change with it.
+func (m *MerkleTree) Update(tree *TreeRef, changed []string) (*MerkleTree, error) {
+	u := &merkleUpdate{v: tree.Target, fresh: make(map[*MerkleNode]bool)}
+	root := u.copy(m.Root)
+
+	// parents first, so their children are in place when they are reached
+	rels := make([]string, 0, len(changed))
+	for _, p := range changed {
+		if rel, ok := relPath(tree.Path, p); ok {
+			rels = append(rels, rel)
+		}
+	}
+	sort.Strings(rels)
+
+	for _, rel := range rels {
+		if err := u.refresh(root, tree.Path, rel); err != nil {
+			return nil, err
+		}
+	}
+	u.rehash(root)
+
+	return &MerkleTree{Root: root}, nil
+}
+
+// relPath returns path p on the target relative to root, and false if it is
+// outside of it
+func relPath(root, p string) (string, bool) {
+	root, p = _path.Clean("/"+root), _path.Clean("/"+p)
+	if root == "/" {
+		return p, true
+	}
+	if p == root {
+		return "/", true
+	}
+	if !strings.HasPrefix(p, root+"/") {
+		return "", false
+	}
+
+	return p[len(root):], true
+}
+
+type merkleUpdate struct {
+	v *Target
+
+	// fresh are the nodes of the new tree not shared with the old one,
+	// whose hashes are recomputed
+	fresh map[*MerkleNode]bool
+}
+
+// copy returns a fresh copy of n, or n if it is fresh already
+func (u *merkleUpdate) copy(n *MerkleNode) *MerkleNode {
+	if u.fresh[n] {
+		return n
+	}
+
+	c := &MerkleNode{Type: n.Type, Hash: n.Hash}
+	if n.Children != nil {
+		c.Children = make(map[string]*MerkleNode, len(n.Children))
+		for name, child := range n.Children {
+			c.Children[name] = child
+		}
+	}
+	u.fresh[c] = true
+
+	return c
+}
+
+// refresh reads again the entry at rel of the tree at root on the target,
+// copying the directories above it
+func (u *merkleUpdate) refresh(n *MerkleNode, root, rel string) error {
+	if rel == "/" {
+		return u.refreshDir(n, root)
+	}
+
+	dir := "/"
+	names := strings.Split(rel[1:], "/")
+	for i, name := range names {
+		if n.Type != NF3Dir {
+			// replaced by something else, and read anew already
+			return nil
+		}
+
+		p := _path.Join(dir, name)
+		child, ok := n.Children[name]
+		if i == len(names)-1 || !ok {
+			// a missing directory is read whole
+			return u.refreshEntry(n, name, _path.Join(root, p), child)
+		}
+
+		child = u.copy(child)
+		n.Children[name] = child
+		n, dir = child, p
+	}
+
+	return nil
+}
+
+// refreshEntry reads again entry name of directory n, at path on the
+// target, whose node was old
+func (u *merkleUpdate) refreshEntry(n *MerkleNode, name, path string, old *MerkleNode) error {
+	attr, fh, err := u.v.lstat(path)
+	if os.IsNotExist(err) {
+		delete(n.Children, name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if old != nil && old.Type == NF3Dir && attr.Type == NF3Dir {
+		c := u.copy(old)
+		n.Children[name] = c
+		return u.refreshDirFh(c, fh)
+	}
+
+	c, err := buildMerkleNode(u.v, &diffEntry{fh: fh, attr: attr})
+	if err != nil {
+		return err
+	}
+	n.Children[name] = c
+
+	return nil
+}
+
+func (u *merkleUpdate) refreshDir(n *MerkleNode, path string) error {
+	_, fh, err := u.v.GetAttr(path)
+	if err != nil {
+		return err
+	}
+
+	return u.refreshDirFh(n, fh)
+}
+
+// refreshDirFh lists directory fh again, keeping the nodes of the entries
+// still there as they are, reading the new ones whole and dropping the
+// removed ones
+func (u *merkleUpdate) refreshDirFh(n *MerkleNode, fh []byte) error {
+	entries, err := listDiffEntries(u.v, fh)
+	if err != nil {
+		return err
+	}
+
+	children := make(map[string]*MerkleNode, len(entries))
+	for name, e := range entries {
+		if old, ok := n.Children[name]; ok && old.Type == e.attr.Type {
+			children[name] = old
+			continue
+		}
+
+		e := e
+		if children[name], err = buildMerkleNode(u.v, &e); err != nil {
+			return err
+		}
+	}
+	n.Children = children
+
+	return nil
+}
+
+// rehash recomputes the hashes of the fresh directories below n, and of n
+func (u *merkleUpdate) rehash(n *MerkleNode) {
+	if !u.fresh[n] || n.Type != NF3Dir {
+		return
+	}
+
+	for _, child := range n.Children {
+		u.rehash(child)
+	}
+	n.Hash = hashMerkleDir(n.Children)
+}
+
+// buildMerkleNode reads the entry e, and what is below if it is a directory
+func buildMerkleNode(v *Target, e *diffEntry) (*MerkleNode, error) {
+	n := &MerkleNode{Type: e.attr.Type}
+
+	switch e.attr.Type {
+	case NF3Dir:
+		entries, err := listDiffEntries(v, e.fh)
+		if err != nil {
+			return nil, err
+		}
+
+		n.Children = make(map[string]*MerkleNode, len(entries))
+		for name, ce := range entries {
+			ce := ce
+			if n.Children[name], err = buildMerkleNode(v, &ce); err != nil {
+				return nil, err
+			}
+		}
+		n.Hash = hashMerkleDir(n.Children)
+
+	case NF3Reg:
+		sum, err := hashFile(v, e)
+		if err != nil {
+			return nil, err
+		}
+		n.Hash = sum
+
+	case NF3Lnk:
+		_, target, err := v.readlinkFh(e.fh)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256([]byte(target))
+		n.Hash = sum[:]
+
+	default:
+		sum := sha256.Sum256(nil)
+		n.Hash = sum[:]
+	}
+
+	return n, nil
+}
+
+// hashMerkleDir returns the hash of a directory of children
+func hashMerkleDir(children map[string]*MerkleNode) []byte {
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	var typ [4]byte
+	for _, name := range names {
+		c := children[name]
+		binary.BigEndian.PutUint32(typ[:], c.Type)
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+		h.Write(typ[:])
+		h.Write(c.Hash)
+	}
+
+	return h.Sum(nil)
+}
@@ -0,0 +1,89 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMerkleTree(t *testing.T) {
+	a, b := loopbackTarget(t), loopbackTarget(t)
+	for _, v := range []*Target{a, b} {
+		for _, dir := range []string{"/data", "/data/x", "/data/y"} {
+			if _, err := v.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		writeFile(t, v, "/data/x/one", "1")
+		writeFile(t, v, "/data/y/two", "2")
+		if _, err := v.Symlink("x/one", "/data/link"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ta, tb := &TreeRef{Target: a, Path: "/data"}, &TreeRef{Target: b, Path: "/data"}
+	ma, err := BuildMerkleTree(ta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb, err := BuildMerkleTree(tb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := ma.Diff(mb); len(diff) != 0 || !bytes.Equal(ma.Root.Hash, mb.Root.Hash) {
+		t.Fatalf("replicas differ: %v", diff)
+	}
+
+	// the tree survives being saved
+	var buf bytes.Buffer
+	if err = mb.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if mb, err = LoadMerkleTree(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	writeFile(t, b, "/data/x/one", "changed")
+	if err = b.Remove("/data/y/two"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.Mkdir("/data/z", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, b, "/data/z/three", "3")
+
+	changed, err := b.ChangedSince("/data", cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := mb.Update(tb, changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := BuildMerkleTree(tb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := updated.Diff(full); len(diff) != 0 {
+		t.Fatalf("updated tree differs from a full one at %v", diff)
+	}
+	if mb.Find("/y/two") == nil {
+		t.Fatal("update changed the old tree")
+	}
+	if updated.Find("/x") == mb.Find("/x") || updated.Find("/y") == mb.Find("/y") {
+		t.Fatal("changed directories shared with the old tree")
+	}
+
+	want := []string{"/x/one", "/y/two", "/z"}
+	if diff := ma.Diff(updated); !reflect.DeepEqual(diff, want) {
+		t.Fatalf("expected differences at %v, got %v", want, diff)
+	}
+}
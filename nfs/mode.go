@@ -0,0 +1,110 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"os"
+)
+
+// The bits of the mode of fattr3 and sattr3, RFC 1813 section 2.5, as
+// stat(2) has them
+const (
+	ModeSetuid = 04000
+	ModeSetgid = 02000
+	ModeSticky = 01000
+	ModePerm   = 0777
+
+	// ModeMask is what of a mode the protocol defines
+	ModeMask = ModeSetuid | ModeSetgid | ModeSticky | ModePerm
+
+	// ModeTypeMask are the bits of the file type, S_IFMT, that some
+	// servers leave in the mode of fattr3, see ModeType
+	ModeTypeMask = 0170000
+)
+
+// the S_IFMT values of the NF3 types
+var typeBits = map[uint32]uint32{
+	NF3Reg:  0100000,
+	NF3Dir:  0040000,
+	NF3Blk:  0060000,
+	NF3Chr:  0020000,
+	NF3Lnk:  0120000,
+	NF3Sock: 0140000,
+	NF3FIFO: 0010000,
+}
+
+// the os.FileMode type bits of the NF3 types
+var typeModes = map[uint32]os.FileMode{
+	NF3Reg:  0,
+	NF3Dir:  os.ModeDir,
+	NF3Blk:  os.ModeDevice,
+	NF3Chr:  os.ModeDevice | os.ModeCharDevice,
+	NF3Lnk:  os.ModeSymlink,
+	NF3Sock: os.ModeSocket,
+	NF3FIFO: os.ModeNamedPipe,
+}
+
+// FileMode returns the os.FileMode of a file of type ftype, an NF3 type, and
+// mode, as fattr3 has them.  Types other than the NF3 ones add no type bits.
+func FileMode(ftype, mode uint32) os.FileMode {
+	m := os.FileMode(mode & ModePerm)
+	if mode&ModeSetuid != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&ModeSetgid != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&ModeSticky != 0 {
+		m |= os.ModeSticky
+	}
+
+	return m | typeModes[ftype]
+}
+
+// ModeBits returns the permission and special bits of m as the mode of
+// sattr3 has them, the reverse of FileMode for Sattr3.Mode
+func ModeBits(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= ModeSetuid
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= ModeSetgid
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= ModeSticky
+	}
+
+	return mode
+}
+
+// FileType returns the NF3 type of the type bits of m, 0 for those of none
+// (os.ModeIrregular)
+func FileType(m os.FileMode) uint32 {
+	switch {
+	case m.IsRegular():
+		return NF3Reg
+	case m&os.ModeCharDevice != 0:
+		return NF3Chr
+	}
+	for ftype, bits := range typeModes {
+		if bits != 0 && m.Type() == bits {
+			return ftype
+		}
+	}
+
+	return 0
+}
+
+// ModeType returns the NF3 type of the S_IFMT bits of a mode, for servers
+// that leave them in the mode of fattr3, 0 if there are none
+func ModeType(mode uint32) uint32 {
+	for ftype, bits := range typeBits {
+		if mode&ModeTypeMask == bits {
+			return ftype
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,31 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestFileMode(t *testing.T) {
+	for _, ftype := range []uint32{NF3Reg, NF3Dir, NF3Blk, NF3Chr, NF3Lnk, NF3Sock, NF3FIFO} {
+		m := FileMode(ftype, 04755)
+		if FileType(m) != ftype || ModeBits(m) != 04755 || m.Perm() != 0755 || m&os.ModeSetuid == 0 {
+			t.Errorf("type %d: %v", ftype, m)
+		}
+		if ModeType(typeBits[ftype]|0644) != ftype {
+			t.Errorf("type %d: S_IFMT %o", ftype, typeBits[ftype])
+		}
+	}
+
+	if m := FileMode(NF3Dir, 03777); m != os.ModeDir|os.ModeSetgid|os.ModeSticky|0777 {
+		t.Errorf("sticky directory: %v", m)
+	}
+	if attr := (&Fattr{Type: NF3Dir, FileMode: 0755}); !attr.Mode().IsDir() {
+		t.Errorf("directory mode %v", attr.Mode())
+	}
+	if ModeType(0644) != 0 || FileType(os.ModeIrregular) != 0 {
+		t.Error("type of no type bits")
+	}
+}
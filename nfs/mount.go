@@ -4,10 +4,12 @@
 package nfs
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 
 	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/util"
 	"github.com/go-nfs/nfsv3/nfs/xdr"
 )
 
@@ -38,6 +40,77 @@ type Mount struct {
 	dirPath string
 	Addr    string
 	priv    bool
+
+	tlsConfig *tls.Config
+
+	// authFallback lets Mount fall back to AUTH_NULL, see SetAuthFallback
+	authFallback bool
+}
+
+// SetAuthFallback lets Mount use AUTH_NULL on an export that does not accept
+// the flavor of the credential but takes AUTH_NULL, files then being created
+// as nobody.  Off by default, such a mount fails.  Exports that require
+// kerberos fail either way.
+func (m *Mount) SetAuthFallback(allow bool) {
+	m.authFallback = allow
+}
+
+// Export is an entry of the export list of a server
+type Export struct {
+	Dir string
+	// Groups are the hosts or netgroups allowed to mount Dir, all when
+	// empty
+	Groups []string
+}
+
+// Exports returns the export list of the server, from MOUNTPROC3_EXPORT
+func (m *Mount) Exports() ([]Export, error) {
+	res, err := m.Call(&rpc.Header{
+		Rpcvers: 2,
+		Prog:    MountProg,
+		Vers:    MountVers,
+		Proc:    MountProc3Export,
+		Cred:    rpc.AuthNull,
+		Verf:    rpc.AuthNull,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var exports []Export
+	for {
+		follows, err := xdr.ReadBoolean(res)
+		if err != nil {
+			return nil, err
+		}
+		if !follows {
+			return exports, nil
+		}
+
+		dir, err := xdr.ReadOpaque(res)
+		if err != nil {
+			return nil, err
+		}
+		e := Export{Dir: string(dir)}
+
+		for {
+			follows, err = xdr.ReadBoolean(res)
+			if err != nil {
+				return nil, err
+			}
+			if !follows {
+				break
+			}
+
+			group, err := xdr.ReadOpaque(res)
+			if err != nil {
+				return nil, err
+			}
+			e.Groups = append(e.Groups, string(group))
+		}
+
+		exports = append(exports, e)
+	}
 }
 
 func (m *Mount) Unmount() error {
@@ -64,11 +137,40 @@ func (m *Mount) Unmount() error {
 		return err
 	}
 
+	m.dirPath = ""
 	return nil
 }
 
 // Mount creates a mount to a filesystem, with a priv flag to use local (un)privileged ports
 func (m *Mount) Mount(dirpath string, auth rpc.Auth) (*Target, error) {
+	fh, auth, err := m.mnt(dirpath, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	m.dirPath = dirpath
+	m.auth = auth
+
+	var vol *Target
+	if m.Addr != "" {
+		vol, err = newTarget(m.Addr, auth, fh, dirpath, m.priv, m.tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		vol, err = NewTargetWithClient(m.Client, auth, fh, dirpath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	vol.mount = m
+	return vol, nil
+}
+
+// mnt calls MNT for dirpath, returning the root handle of the export and the
+// credential to use on it
+func (m *Mount) mnt(dirpath string, auth rpc.Auth) ([]byte, rpc.Auth, error) {
 	type mount struct {
 		rpc.Header
 		Dirpath string
@@ -86,55 +188,81 @@ func (m *Mount) Mount(dirpath string, auth rpc.Auth) (*Target, error) {
 		dirpath,
 	})
 	if err != nil {
-		return nil, err
+		return nil, auth, err
 	}
 
 	mountstat3, err := xdr.ReadUint32(res)
 	if err != nil {
-		return nil, err
+		return nil, auth, err
 	}
 
 	switch mountstat3 {
 	case MNT3Ok:
 		fh, err := xdr.ReadOpaque(res)
 		if err != nil {
-			return nil, err
+			return nil, auth, err
 		}
 
-		_, _ = xdr.ReadUint32List(res)
-
-		m.dirPath = dirpath
-		m.auth = auth
+		flavors, err := xdr.ReadUint32List(res)
+		if err != nil {
+			return nil, auth, err
+		}
 
-		var vol *Target
-		if m.Addr != "" {
-			vol, err = NewTarget(m.Addr, auth, fh, dirpath, m.priv)
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			vol, err = NewTargetWithClient(m.Client, auth, fh, dirpath)
-			if err != nil {
-				return nil, err
-			}
+		auth, err = selectAuth(auth, flavors, m.authFallback)
+		if err != nil {
+			return nil, auth, err
 		}
 
-		return vol, nil
+		return fh, auth, nil
 
 	case MNT3ErrPerm:
-		return nil, errors.New("MNT3ERR_PERM")
+		return nil, auth, errors.New("MNT3ERR_PERM")
 	case MNT3ErrNoEnt:
-		return nil, errors.New("MNT3ERR_NOENT")
+		return nil, auth, errors.New("MNT3ERR_NOENT")
 	case MNT3ErrIO:
-		return nil, errors.New("MNT3ERR_IO")
+		return nil, auth, errors.New("MNT3ERR_IO")
 	case MNT3ErrAcces:
-		return nil, errors.New("MNT3ERR_ACCES")
+		return nil, auth, errors.New("MNT3ERR_ACCES")
 	case MNT3ErrNotDir:
-		return nil, errors.New("MNT3ERR_NOTDIR")
+		return nil, auth, errors.New("MNT3ERR_NOTDIR")
 	case MNT3ErrNameTooLong:
-		return nil, errors.New("MNT3ERR_NAMETOOLONG")
+		return nil, auth, errors.New("MNT3ERR_NAMETOOLONG")
+	}
+	return nil, auth, fmt.Errorf("unknown mount stat: %d", mountstat3)
+}
+
+// selectAuth picks the credential to use on an export that accepts the auth
+// flavors listed.  auth is kept if the server takes it, otherwise AUTH_NULL is
+// used if fallback allows it and the server takes that.  An empty list puts no
+// constraints.
+func selectAuth(auth rpc.Auth, flavors []uint32, fallback bool) (rpc.Auth, error) {
+	if len(flavors) == 0 {
+		return auth, nil
+	}
+
+	gss, null := false, false
+	for _, f := range flavors {
+		switch f {
+		case auth.Flavor:
+			return auth, nil
+		case rpc.AuthFlavorRPCSecGSS, rpc.AuthFlavorKRB5, rpc.AuthFlavorKRB5I, rpc.AuthFlavorKRB5P:
+			gss = true
+		case rpc.AuthFlavorNull:
+			null = true
+		}
 	}
-	return nil, fmt.Errorf("unknown mount stat: %d", mountstat3)
+
+	switch {
+	case gss:
+		return auth, fmt.Errorf("mount: export requires kerberos (RPCSEC_GSS), flavors %v, but credential has flavor %d", flavors, auth.Flavor)
+	case null && fallback:
+		util.Errorf("mount: flavor %d not accepted by the server, falling back to AUTH_NULL", auth.Flavor)
+		return rpc.AuthNull, nil
+	case null:
+		return auth, fmt.Errorf("mount: credential flavor %d not accepted by the export, flavors %v, AUTH_NULL would be, see SetAuthFallback", auth.Flavor, flavors)
+	}
+
+	return auth, fmt.Errorf("mount: credential flavor %d not accepted by the export, flavors %v", auth.Flavor, flavors)
 }
 
 func DialMount(addr string, priv bool) (*Mount, error) {
@@ -146,6 +274,12 @@ func DialMount(addr string, priv bool) (*Mount, error) {
 		Port: 0,
 	}
 
+	// look up the services a mount goes on to use along with MOUNT, the
+	// dials below are served from the cache
+	if _, err := ResolvePorts(addr, mountMappings...); err != nil {
+		util.Debugf("mount: resolving ports on %s: %s", addr, err)
+	}
+
 	client, err := DialService(addr, m, priv)
 	if err != nil {
 		return nil, err
@@ -157,3 +291,31 @@ func DialMount(addr string, priv bool) (*Mount, error) {
 		priv:   priv,
 	}, nil
 }
+
+// DialMountTLS is DialMount over TLS, see DialServiceTLS.  Targets mounted
+// from it connect over TLS as well.
+func DialMountTLS(addr string, priv bool, config *tls.Config) (*Mount, error) {
+	m := rpc.Mapping{
+		Prog: MountProg,
+		Vers: MountVers,
+		Prot: rpc.IPProtoTCP,
+		Port: 0,
+	}
+
+	// see DialMount
+	if _, err := ResolvePorts(addr, mountMappings...); err != nil {
+		util.Debugf("mount: resolving ports on %s: %s", addr, err)
+	}
+
+	client, err := DialServiceTLS(addr, m, priv, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Mount{
+		Client:    client,
+		Addr:      addr,
+		priv:      priv,
+		tlsConfig: config,
+	}, nil
+}
@@ -0,0 +1,194 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// NConnectPolicy decides which connection a call is sent on
+type NConnectPolicy int
+
+const (
+	// NConnectRoundRobin spreads calls evenly over all connections
+	NConnectRoundRobin NConnectPolicy = iota
+
+	// NConnectByHandle sends all calls for a file handle over the same
+	// connection, which keeps the calls for a file in order on the wire.
+	NConnectByHandle
+)
+
+// privileged tells whether the first connection is from a privileged port,
+// for those opened next to keep using one
+func (v *Target) privileged() bool {
+	laddr, ok := v.LocalAddr().(*net.TCPAddr)
+	return ok && laddr.Port < 1024
+}
+
+// NConnect opens n-1 additional connections to the NFS server, like the
+// nconnect mount option of the linux client, and spreads calls over all n of
+// them according to policy.  Connections opened by an earlier NConnect are
+// closed first.  An n of 1 opens none, leaving the target on its first
+// connection, whatever it is over; an n less than 1 is an error.
+func (v *Target) NConnect(n int, policy NConnectPolicy) error {
+	if n < 1 {
+		return fmt.Errorf("nconnect: %d connections", n)
+	}
+	if n == 1 {
+		v.setConnections(nil, policy)
+		return nil
+	}
+
+	raddr, ok := v.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return errors.New("nconnect: target is not connected over tcp")
+	}
+
+	priv := v.privileged()
+	conns := make([]*rpc.Client, 0, n-1)
+	for i := 1; i < n; i++ {
+		client, err := dialService(raddr.IP.String(), raddr.Port, priv, v.TLSConfig())
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return err
+		}
+		conns = append(conns, client)
+	}
+
+	util.Debugf("nconnect: %d connections to %s", n, raddr)
+	v.setConnections(conns, policy)
+
+	return nil
+}
+
+// setConnections replaces the additional connections, closing those before
+func (v *Target) setConnections(conns []*rpc.Client, policy NConnectPolicy) {
+	v.connsMu.Lock()
+	old := v.conns
+	v.conns = conns
+	v.policy = policy
+	v.connsMu.Unlock()
+
+	for _, c := range old {
+		c.Close()
+	}
+}
+
+// connections returns the additional connections, and their policy, as
+// NConnect last set them
+func (v *Target) connections() ([]*rpc.Client, NConnectPolicy) {
+	v.connsMu.Lock()
+	defer v.connsMu.Unlock()
+
+	return v.conns, v.policy
+}
+
+// pick returns the connection the call c should be sent on
+func (v *Target) pick(c interface{}) *rpc.Client {
+	conns, policy := v.connections()
+	n := uint32(len(conns) + 1)
+	if n == 1 {
+		return v.Client
+	}
+
+	var i uint32
+	switch policy {
+	case NConnectByHandle:
+		if fh := callHandle(c); fh != nil {
+			h := fnv.New32a()
+			h.Write(fh)
+			i = h.Sum32() % n
+			break
+		}
+		fallthrough
+	default:
+		i = atomic.AddUint32(&v.next, 1) % n
+	}
+
+	if i == 0 {
+		return v.Client
+	}
+
+	return conns[i-1]
+}
+
+// retransmits sums the retransmits over all connections
+func (v *Target) retransmits() uint64 {
+	n := v.Client.Retransmits()
+	conns, _ := v.connections()
+	for _, c := range conns {
+		n += c.Retransmits()
+	}
+
+	return n
+}
+
+// callHandle finds the file handle a call operates on: the first []byte field
+// of the call, or of a directory operation argument.
+func callHandle(c interface{}) []byte {
+	val := reflect.Indirect(reflect.ValueOf(c))
+	if val.Kind() != reflect.Struct {
+		return nil
+	}
+
+	for i := 0; i < val.NumField(); i++ {
+		f := val.Field(i)
+		if !f.CanInterface() {
+			continue
+		}
+
+		switch f.Interface().(type) {
+		case []byte:
+			return f.Bytes()
+		case Diropargs3:
+			return f.Interface().(Diropargs3).FH
+		}
+	}
+
+	return nil
+}
+
+// setCallHandle replaces handle old of call c, as callHandle finds it, with
+// fh, and reports whether it did
+func setCallHandle(c interface{}, old, fh []byte) bool {
+	val := reflect.Indirect(reflect.ValueOf(c))
+	if val.Kind() != reflect.Struct {
+		return false
+	}
+
+	for i := 0; i < val.NumField(); i++ {
+		f := val.Field(i)
+		if !f.CanInterface() {
+			continue
+		}
+
+		switch h := f.Interface().(type) {
+		case []byte:
+			if !f.CanSet() || !sameHandle(h, old) {
+				return false
+			}
+			f.SetBytes(fh)
+			return true
+		case Diropargs3:
+			if !f.CanSet() || !sameHandle(h.FH, old) {
+				return false
+			}
+			h.FH = fh
+			f.Set(reflect.ValueOf(h))
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,25 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import "testing"
+
+func TestNConnectCount(t *testing.T) {
+	v := loopbackTarget(t)
+	defer v.Close()
+
+	if err := v.NConnect(0, NConnectRoundRobin); err == nil {
+		t.Error("nconnect of 0 connections")
+	}
+	// a single connection needs none opened, nor tcp
+	if err := v.NConnect(1, NConnectRoundRobin); err != nil {
+		t.Errorf("nconnect of 1 connection: %v", err)
+	}
+	if conns, _ := v.connections(); len(conns) != 0 {
+		t.Errorf("%d connections opened", len(conns))
+	}
+	if err := v.NConnect(2, NConnectRoundRobin); err == nil {
+		t.Error("nconnect over a pipe")
+	}
+}
@@ -4,11 +4,13 @@
 package nfs
 
 import (
+	"crypto/tls"
 	"fmt"
+	"math"
 	"math/rand"
 	"net"
 	"os"
-	"syscall"
+	"strconv"
 	"time"
 
 	"github.com/go-nfs/nfsv3/nfs/rpc"
@@ -30,6 +32,7 @@ const (
 	Nfs3Vers = 3
 
 	// program methods
+	NFSProc3Null        = 0
 	NFSProc3GetAttr     = 1
 	NFSProc3SetAttr     = 2
 	NFSProc3Lookup      = 3
@@ -40,11 +43,16 @@ const (
 	NFSProc3Create      = 8
 	NFSProc3Mkdir       = 9
 	NFSProc3Symlink     = 10
+	NFSProc3MkNod       = 11
 	NFSProc3Remove      = 12
 	NFSProc3RmDir       = 13
 	NFSProc3Rename      = 14
+	NFSProc3Link        = 15
+	NFSProc3ReadDir     = 16
 	NFSProc3ReadDirPlus = 17
+	NFSProc3FSStat      = 18
 	NFSProc3FSInfo      = 19
+	NFSProc3PathConf    = 20
 	NFSProc3Commit      = 21
 
 	// The size in bytes of the opaque cookie verifier passed by
@@ -61,6 +69,40 @@ const (
 	NF3FIFO = 7
 )
 
+var procToName = map[uint32]string{
+	0:  "NULL",
+	1:  "GETATTR",
+	2:  "SETATTR",
+	3:  "LOOKUP",
+	4:  "ACCESS",
+	5:  "READLINK",
+	6:  "READ",
+	7:  "WRITE",
+	8:  "CREATE",
+	9:  "MKDIR",
+	10: "SYMLINK",
+	11: "MKNOD",
+	12: "REMOVE",
+	13: "RMDIR",
+	14: "RENAME",
+	15: "LINK",
+	16: "READDIR",
+	17: "READDIRPLUS",
+	18: "FSSTAT",
+	19: "FSINFO",
+	20: "PATHCONF",
+	21: "COMMIT",
+}
+
+// ProcName returns the RFC 1813 name of an NFSv3 procedure
+func ProcName(proc uint32) string {
+	if name, ok := procToName[proc]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("PROC%d", proc)
+}
+
 type Diropargs3 struct {
 	FH       []byte
 	Filename string
@@ -127,6 +169,35 @@ type NFS3Time struct {
 	Nseconds uint32
 }
 
+// NewNFS3Time returns t as an NFS3Time.  NFS3 times are unsigned 32-bit
+// seconds since the epoch, times out of range are clamped to the first or
+// the last of them, 1970 or 2106.
+func NewNFS3Time(t time.Time) NFS3Time {
+	switch sec := t.Unix(); {
+	case sec < 0:
+		return NFS3Time{}
+	case sec > math.MaxUint32:
+		return NFS3Time{Seconds: math.MaxUint32, Nseconds: 999999999}
+	}
+
+	return NFS3Time{Seconds: uint32(t.Unix()), Nseconds: uint32(t.Nanosecond())}
+}
+
+// Time returns t as a time.Time, in local time
+func (t NFS3Time) Time() time.Time {
+	return time.Unix(int64(t.Seconds), int64(t.Nseconds))
+}
+
+// SetTimeTo returns a SetTime setting a time to t, SetTimeToServer one
+// setting it to the time of the server
+func SetTimeTo(t time.Time) SetTime {
+	return SetTime{SetIt: SetToClientTime, Time: NewNFS3Time(t)}
+}
+
+func SetTimeToServer() SetTime {
+	return SetTime{SetIt: SetToServerTime}
+}
+
 type Fattr struct {
 	Type                uint32
 	FileMode            uint32
@@ -149,12 +220,24 @@ func (f *Fattr) Size() int64 {
 	return int64(f.Filesize)
 }
 
+// Mode returns the mode and type of the file as os.FileMode has them, see
+// FileMode
 func (f *Fattr) Mode() os.FileMode {
-	return os.FileMode(f.FileMode)
+	return FileMode(f.Type, f.FileMode)
 }
 
 func (f *Fattr) ModTime() time.Time {
-	return time.Unix(int64(f.Mtime.Seconds), int64(f.Mtime.Nseconds))
+	return f.Mtime.Time()
+}
+
+// AccessTime and ChangeTime return the atime and ctime as time.Time, as
+// ModTime does the mtime
+func (f *Fattr) AccessTime() time.Time {
+	return f.Atime.Time()
+}
+
+func (f *Fattr) ChangeTime() time.Time {
+	return f.Ctime.Time()
 }
 
 func (f *Fattr) IsDir() bool {
@@ -254,19 +337,35 @@ type FSInfo struct {
 
 // DialService Dial an RPC svc after getting the port from the portmapper
 func DialService(addr string, prog rpc.Mapping, priv bool) (*rpc.Client, error) {
-	pm, err := rpc.DialPortmapper("tcp", addr)
-	if err != nil {
-		util.Errorf("Failed to connect to portmapper: %s", err)
-		return nil, err
-	}
-	defer pm.Close()
+	return DialServiceTLS(addr, prog, priv, nil)
+}
 
-	port, err := pm.Getport(prog)
-	if err != nil {
-		return nil, err
+// DialServiceTLS is DialService over TLS, for servers tunneled through
+// stunnel or a similar TLS terminator.  If prog.Port is set it is dialed
+// directly, otherwise the port is looked up from the portmapper, which is
+// queried in the clear.
+func DialServiceTLS(addr string, prog rpc.Mapping, priv bool, config *tls.Config) (*rpc.Client, error) {
+	// retries dial resolved addresses, keep verifying the host name
+	if config != nil && config.ServerName == "" && net.ParseIP(addr) == nil {
+		config = config.Clone()
+		config.ServerName = addr
 	}
 
-	client, err := dialService(addr, port, priv)
+	var client *rpc.Client
+	err := retryDial(addr, func(ip string) error {
+		var err error
+		port := int(prog.Port)
+		if port == 0 {
+			if port, err = lookupPort(addr, ip, prog); err != nil {
+				return err
+			}
+		}
+
+		if client, err = dialService(ip, port, priv, config); err != nil {
+			forgetPort(addr, prog)
+		}
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -274,13 +373,20 @@ func DialService(addr string, prog rpc.Mapping, priv bool) (*rpc.Client, error)
 	return client, nil
 }
 
-func dialService(addr string, port int, priv bool) (*rpc.Client, error) {
+// dialService connects to port on addr, over TLS if config is set
+func dialService(addr string, port int, priv bool, config *tls.Config) (*rpc.Client, error) {
 	var (
 		ldr    *net.TCPAddr
 		client *rpc.Client
 		err    error
 	)
 
+	if priv {
+		if priv, err = usePrivPort(addr, port); err != nil {
+			return nil, err
+		}
+	}
+
 	if priv {
 		r1 := rand.New(rand.NewSource(time.Now().UnixNano()))
 
@@ -295,10 +401,10 @@ func dialService(addr string, port int, priv bool) (*rpc.Client, error) {
 				Port: p,
 			}
 
-			raddr := fmt.Sprintf("%s:%d", addr, port)
+			raddr := net.JoinHostPort(addr, strconv.Itoa(port))
 			util.Debugf("Connecting to %s", raddr)
 
-			client, err = rpc.DialTCP("tcp", ldr, raddr)
+			client, err = dial(ldr, raddr, config)
 			if err == nil {
 				break
 			}
@@ -312,10 +418,10 @@ func dialService(addr string, port int, priv bool) (*rpc.Client, error) {
 
 		util.Debugf("using random port %d -> %d", p, port)
 	} else {
-		raddr := fmt.Sprintf("%s:%d", addr, port)
+		raddr := net.JoinHostPort(addr, strconv.Itoa(port))
 		util.Debugf("Connecting to %s from unprivileged port", raddr)
 
-		client, err = rpc.DialTCP("tcp", ldr, raddr)
+		client, err = dial(ldr, raddr, config)
 		if err != nil {
 			return nil, err
 		}
@@ -324,12 +430,10 @@ func dialService(addr string, port int, priv bool) (*rpc.Client, error) {
 	return client, nil
 }
 
-func isAddrInUse(err error) bool {
-	if er, ok := err.(*net.OpError); ok {
-		if syser, ok := er.Err.(*os.SyscallError); ok {
-			return syser.Err == syscall.EADDRINUSE
-		}
+func dial(ldr *net.TCPAddr, raddr string, config *tls.Config) (*rpc.Client, error) {
+	if config != nil {
+		return rpc.DialTLS("tcp", ldr, raddr, config)
 	}
 
-	return false
+	return rpc.DialTCP("tcp", ldr, raddr)
 }
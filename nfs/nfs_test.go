@@ -4,10 +4,14 @@
 package nfs
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"net"
+	"os"
 	"sync"
 	"testing"
+	"time"
 )
 
 func listenAndServe(t *testing.T, port int) (*net.TCPListener, *sync.WaitGroup, error) {
@@ -41,13 +45,13 @@ func TestDialService(t *testing.T) {
 	}
 	defer listener.Close()
 
-	_, err = dialService("127.0.0.1", 6666, false)
+	_, err = dialService("127.0.0.1", 6666, false, nil)
 	if err != nil {
 		t.Logf("error dialing: %s", err.Error())
 		t.FailNow()
 	}
 
-	_, err = dialService("127.0.0.1", 6666, false)
+	_, err = dialService("127.0.0.1", 6666, false, nil)
 	if err != nil {
 		t.Logf("error dialing: %s", err.Error())
 		t.FailNow()
@@ -55,3 +59,78 @@ func TestDialService(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestPrivPortFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	canBindPrivPort = func() (bool, error) { return false, os.ErrPermission }
+	defer func() {
+		canBindPrivPort = CanBindPrivPort
+		SetPrivPortPolicy(PrivPortRequire, nil)
+	}()
+
+	if _, err := dialService("127.0.0.1", port, true, nil); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("required privileged port: %v", err)
+	}
+
+	var warned *PrivPortWarning
+	SetPrivPortPolicy(PrivPortFallback, func(w *PrivPortWarning) { warned = w })
+
+	client, err := dialService("127.0.0.1", port, true, nil)
+	if err != nil {
+		t.Fatalf("fallback dial: %s", err)
+	}
+	defer client.Close()
+
+	if warned == nil || warned.Port != port || !errors.Is(warned.Err, os.ErrPermission) {
+		t.Errorf("warning %+v", warned)
+	}
+	if p := client.LocalAddr().(*net.TCPAddr).Port; p < 1024 {
+		t.Errorf("fell back to port %d", p)
+	}
+}
+
+func TestChtimes(t *testing.T) {
+	v := loopbackTarget(t)
+	writeFile(t, v, "/f", "x")
+
+	mtime := time.Date(2020, 2, 29, 12, 30, 0, 123456789, time.UTC)
+	if got := NewNFS3Time(mtime).Time(); !got.Equal(mtime) {
+		t.Fatalf("round trip of %s gave %s", mtime, got)
+	}
+	if got := NewNFS3Time(time.Date(1969, 7, 20, 20, 17, 0, 0, time.UTC)); got != (NFS3Time{}) {
+		t.Errorf("1969 gave %+v", got)
+	}
+	if got := NewNFS3Time(time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC)); got.Seconds != math.MaxUint32 {
+		t.Errorf("2200 gave %+v", got)
+	}
+
+	before, _, err := v.GetAttr("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = v.Chtimes("/f", time.Time{}, mtime); err != nil {
+		t.Fatal(err)
+	}
+	attr, _, err := v.GetAttr("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !attr.ModTime().Equal(mtime) || attr.Atime != before.Atime {
+		t.Fatalf("mtime %s, atime %s was %s", attr.ModTime(), attr.AccessTime(), before.AccessTime())
+	}
+}
@@ -0,0 +1,408 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+// Package nfstest checks that a server behaves the way this client expects,
+// to validate a filer, a mock server or a gateway before relying on it.
+//
+// Run is meant to be called from a test:
+//
+//	func TestFiler(t *testing.T) {
+//		m, _ := nfs.DialMount("filer", false)
+//		v, _ := m.Mount("/export", rpc.AuthNull)
+//		defer v.Close()
+//
+//		nfstest.Run(t, v, "/nfstest")
+//	}
+package nfstest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	_path "path"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/go-nfs/nfsv3/nfs"
+)
+
+// fixture is the tree TestFS writes and checks, paths relative to its
+// directory mapped to contents, directories ending in /
+var fixture = map[string]string{
+	"empty":               "",
+	"hello.txt":           "hello, world\n",
+	"dir/":                "",
+	"dir/nested/":         "",
+	"dir/nested/deep.txt": "deep",
+	"dir/empty-dir/":      "",
+	"dir/with space":      "a name with a space",
+	"dir/unicode-état":    "été",
+}
+
+// TestFS writes a fixture tree in dir on v, which must not exist, and checks
+// it through Target.FS with testing/fstest.  The tree is left in place.
+func TestFS(v *nfs.Target, dir string) error {
+	if _, err := v.Mkdir(dir, 0755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", dir, err)
+	}
+
+	// parents sort before what they contain, so they exist in time
+	names := make([]string, 0, len(fixture))
+	for name := range fixture {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var expected []string
+	for _, name := range names {
+		path := _path.Join(dir, name)
+		if strings.HasSuffix(name, "/") {
+			if _, err := v.Mkdir(path, 0755); err != nil {
+				return fmt.Errorf("mkdir %s: %w", path, err)
+			}
+			continue
+		}
+
+		expected = append(expected, name)
+		if err := writeFile(v, path, []byte(fixture[name])); err != nil {
+			return err
+		}
+	}
+
+	fsys, err := fs.Sub(v.FS(), strings.TrimPrefix(_path.Clean("/"+dir), "/"))
+	if err != nil {
+		return err
+	}
+
+	return fstest.TestFS(fsys, expected...)
+}
+
+// Run checks v in dir, which must not exist, as subtests of t: TestFS, then
+// the read-write suite, each case in a directory of its own.  dir is removed
+// afterwards unless a case failed.
+func Run(t *testing.T, v *nfs.Target, dir string) {
+	if _, err := v.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("mkdir %s: %s", dir, err)
+	}
+
+	t.Run("TestFS", func(t *testing.T) {
+		if err := TestFS(v, _path.Join(dir, "TestFS")); err != nil {
+			t.Error(err)
+		}
+	})
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			cdir := _path.Join(dir, c.name)
+			if _, err := v.Mkdir(cdir, 0755); err != nil {
+				t.Fatalf("mkdir %s: %s", cdir, err)
+			}
+			c.fn(t, v, cdir)
+		})
+	}
+
+	if !t.Failed() {
+		if err := v.RemoveAll(dir); err != nil {
+			t.Errorf("cleanup %s: %s", dir, err)
+		}
+	}
+}
+
+var cases = []struct {
+	name string
+	fn   func(t *testing.T, v *nfs.Target, dir string)
+}{
+	{"WriteRead", testWriteRead},
+	{"Overwrite", testOverwrite},
+	{"Truncate", testTruncate},
+	{"SetAttr", testSetAttr},
+	{"Rename", testRename},
+	{"Remove", testRemove},
+	{"Mkdir", testMkdir},
+	{"LargeDir", testLargeDir},
+}
+
+// writeFile creates or replaces path with data
+func writeFile(v *nfs.Target, path string, data []byte) error {
+	f, err := v.OpenFile(path, 0644)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", path, err)
+	}
+
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func readFile(v *nfs.Target, path string) ([]byte, error) {
+	f, err := v.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	return data, nil
+}
+
+// pattern returns n bytes that differ at every offset within a WRITE
+func pattern(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7 / 3)
+	}
+
+	return b
+}
+
+// testWriteRead writes a file spanning several READs and WRITEs and reads it
+// back
+func testWriteRead(t *testing.T, v *nfs.Target, dir string) {
+	info, err := v.FSInfo()
+	if err != nil {
+		t.Fatalf("fsinfo: %s", err)
+	}
+
+	size := int(info.WTPref)*2 + int(info.RTPref) + 17
+	data := pattern(size)
+	path := _path.Join(dir, "file")
+	if err = writeFile(v, path, data); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readFile(v, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read back %d bytes, different from the %d written", len(got), len(data))
+	}
+
+	attr, _, err := v.GetAttr(path)
+	if err != nil {
+		t.Fatalf("getattr: %s", err)
+	}
+	if attr.Filesize != uint64(size) {
+		t.Errorf("size: got %d, want %d", attr.Filesize, size)
+	}
+}
+
+// testOverwrite writes within and past the end of a file
+func testOverwrite(t *testing.T, v *nfs.Target, dir string) {
+	path := _path.Join(dir, "file")
+	if err := writeFile(v, path, []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := v.OpenFile(path, 0644)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	for _, w := range []struct {
+		off  int64
+		data string
+	}{{2, "ab"}, {12, "xy"}} {
+		if _, err = f.Seek(w.off, io.SeekStart); err != nil {
+			t.Fatalf("seek: %s", err)
+		}
+		if _, err = f.Write([]byte(w.data)); err != nil {
+			t.Fatalf("write at %d: %s", w.off, err)
+		}
+	}
+	if err = f.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+
+	got, err := readFile(v, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "01ab456789\x00\x00xy"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// testTruncate shrinks and extends a file with SETATTR
+func testTruncate(t *testing.T, v *nfs.Target, dir string) {
+	path := _path.Join(dir, "file")
+	if err := writeFile(v, path, []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []uint64{4, 8} {
+		_, fh, err := v.Lookup(path)
+		if err != nil {
+			t.Fatalf("lookup: %s", err)
+		}
+		if err = v.SetAttrByFh(fh, nfs.Sattr3{Size: nfs.SetSize{SetIt: true, Size: size}}); err != nil {
+			t.Fatalf("truncate to %d: %s", size, err)
+		}
+	}
+
+	got, err := readFile(v, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "0123\x00\x00\x00\x00"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// testSetAttr changes the mode and times of a file
+func testSetAttr(t *testing.T, v *nfs.Target, dir string) {
+	path := _path.Join(dir, "file")
+	if err := writeFile(v, path, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	_, fh, err := v.Lookup(path)
+	if err != nil {
+		t.Fatalf("lookup: %s", err)
+	}
+
+	mtime := nfs.NFS3Time{Seconds: 1500000000, Nseconds: 0}
+	err = v.SetAttrByFh(fh, nfs.Sattr3{
+		Mode:  nfs.SetMode{SetIt: true, Mode: 0640},
+		Mtime: nfs.SetTime{SetIt: nfs.SetToClientTime, Time: mtime},
+	})
+	if err != nil {
+		t.Fatalf("setattr: %s", err)
+	}
+
+	attr, err := v.GetAttrByFh(fh)
+	if err != nil {
+		t.Fatalf("getattr: %s", err)
+	}
+	if attr.FileMode&0777 != 0640 {
+		t.Errorf("mode: got %o, want 640", attr.FileMode&0777)
+	}
+	if attr.Mtime.Seconds != mtime.Seconds {
+		t.Errorf("mtime: got %d, want %d", attr.Mtime.Seconds, mtime.Seconds)
+	}
+}
+
+// testRename renames a file, over another one and into another directory
+func testRename(t *testing.T, v *nfs.Target, dir string) {
+	a, b, c := _path.Join(dir, "a"), _path.Join(dir, "b"), _path.Join(dir, "sub", "c")
+	for path, data := range map[string]string{a: "a", b: "b"} {
+		if err := writeFile(v, path, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := v.Mkdir(_path.Dir(c), 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+
+	if err := v.Rename(a, b); err != nil {
+		t.Fatalf("rename over: %s", err)
+	}
+	if _, _, err := v.Lookup(a); !os.IsNotExist(err) {
+		t.Errorf("lookup renamed: got %v, want not exist", err)
+	}
+	if got, err := readFile(v, b); err != nil || string(got) != "a" {
+		t.Errorf("read renamed over: got %q, %v", got, err)
+	}
+
+	if err := v.Rename(b, c); err != nil {
+		t.Fatalf("rename across directories: %s", err)
+	}
+	if got, err := readFile(v, c); err != nil || string(got) != "a" {
+		t.Errorf("read renamed across directories: got %q, %v", got, err)
+	}
+}
+
+// testRemove removes a file, a missing file and a directory
+func testRemove(t *testing.T, v *nfs.Target, dir string) {
+	path := _path.Join(dir, "file")
+	if err := writeFile(v, path, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.Remove(path); err != nil {
+		t.Fatalf("remove: %s", err)
+	}
+	if _, _, err := v.Lookup(path); !os.IsNotExist(err) {
+		t.Errorf("lookup removed: got %v, want not exist", err)
+	}
+	if err := v.Remove(path); !os.IsNotExist(err) {
+		t.Errorf("remove missing: got %v, want not exist", err)
+	}
+
+	sub := _path.Join(dir, "sub")
+	if _, err := v.Mkdir(sub, 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	if err := writeFile(v, _path.Join(sub, "file"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.RmDir(sub); !nfs.IsNotEmptyError(err) {
+		t.Errorf("rmdir non-empty: got %v, want NFS3ERR_NOTEMPTY", err)
+	}
+	if err := v.RemoveAll(sub); err != nil {
+		t.Errorf("remove all: %s", err)
+	}
+}
+
+// testMkdir creates a directory twice
+func testMkdir(t *testing.T, v *nfs.Target, dir string) {
+	sub := _path.Join(dir, "sub")
+	if _, err := v.Mkdir(sub, 0750); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	if _, err := v.Mkdir(sub, 0750); !errors.Is(err, os.ErrExist) {
+		t.Errorf("mkdir existing: got %v, want exist", err)
+	}
+
+	attr, _, err := v.GetAttr(sub)
+	if err != nil {
+		t.Fatalf("getattr: %s", err)
+	}
+	if !attr.IsDir() {
+		t.Errorf("type: got %d, want a directory", attr.Type)
+	}
+}
+
+// testLargeDir lists a directory too large for a single READDIRPLUS
+func testLargeDir(t *testing.T, v *nfs.Target, dir string) {
+	const n = 500
+	for i := 0; i < n; i++ {
+		if _, err := v.Create(_path.Join(dir, fmt.Sprintf("file-with-a-longish-name-%04d", i)), 0644); err != nil {
+			t.Fatalf("create: %s", err)
+		}
+	}
+
+	entries, err := v.ReadDirPlus(dir)
+	if err != nil {
+		t.Fatalf("readdirplus: %s", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		if e.FileName == "." || e.FileName == ".." {
+			continue
+		}
+		if seen[e.FileName] {
+			t.Errorf("%s listed twice", e.FileName)
+		}
+		seen[e.FileName] = true
+	}
+	if len(seen) != n {
+		t.Errorf("listed %d entries, want %d", len(seen), n)
+	}
+}
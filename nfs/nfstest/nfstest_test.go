@@ -0,0 +1,56 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfstest
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs"
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+func TestLoopback(t *testing.T) {
+	v, err := nfs.DialLoopback(nfs.NewServer(nfs.NewMemFS())).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	Run(t, v, "/nfstest")
+}
+
+// TestServer runs the suite against the server named by NFSTEST_TARGET, as
+// host:/export, to check a filer with go test -run TestServer
+func TestServer(t *testing.T) {
+	target := os.Getenv("NFSTEST_TARGET")
+	if target == "" {
+		t.Skip("NFSTEST_TARGET not set")
+	}
+
+	i := strings.IndexByte(target, ':')
+	if i < 0 {
+		t.Fatalf("NFSTEST_TARGET %q: want host:/export", target)
+	}
+
+	m, err := nfs.DialMount(target[:i], false)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer m.Close()
+
+	auth, err := rpc.NewAuthUnixFromOS()
+	if err != nil {
+		t.Fatalf("credential: %s", err)
+	}
+
+	v, err := m.Mount(target[i+1:], auth.Auth())
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	Run(t, v, "/nfstest")
+}
@@ -0,0 +1,434 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/util"
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+// NLM procedures, version 4
+const (
+	NLMProc4Null    = 0
+	NLMProc4Test    = 1
+	NLMProc4Lock    = 2
+	NLMProc4Cancel  = 3
+	NLMProc4Unlock  = 4
+	NLMProc4Share   = 20
+	NLMProc4Unshare = 21
+	NLMProc4FreeAll = 23
+)
+
+// nlm4_stats values
+const (
+	NLM4Granted           = 0
+	NLM4Denied            = 1
+	NLM4DeniedNoLocks     = 2
+	NLM4Blocked           = 3
+	NLM4DeniedGracePeriod = 4
+	NLM4Deadlck           = 5
+	NLM4ROFS              = 6
+	NLM4StaleFH           = 7
+	NLM4FBig              = 8
+	NLM4Failed            = 9
+)
+
+var nlmStatName = map[uint32]string{
+	NLM4Granted:           "NLM4_GRANTED",
+	NLM4Denied:            "NLM4_DENIED",
+	NLM4DeniedNoLocks:     "NLM4_DENIED_NOLOCKS",
+	NLM4Blocked:           "NLM4_BLOCKED",
+	NLM4DeniedGracePeriod: "NLM4_DENIED_GRACE_PERIOD",
+	NLM4Deadlck:           "NLM4_DEADLCK",
+	NLM4ROFS:              "NLM4_ROFS",
+	NLM4StaleFH:           "NLM4_STALE_FH",
+	NLM4FBig:              "NLM4_FBIG",
+	NLM4Failed:            "NLM4_FAILED",
+}
+
+// Share reservation modes, what a share denies to others (fsh4_mode)
+const (
+	ShareDenyNone      = 0
+	ShareDenyRead      = 1
+	ShareDenyWrite     = 2
+	ShareDenyReadWrite = 3
+)
+
+// Share reservation access, what a share is for (fsh4_access)
+const (
+	ShareAccessNone      = 0
+	ShareAccessRead      = 1
+	ShareAccessWrite     = 2
+	ShareAccessReadWrite = 3
+)
+
+// NLMError is a lock manager reply other than NLM4_GRANTED
+type NLMError struct {
+	Proc uint32
+	Stat uint32
+}
+
+func (e *NLMError) Error() string {
+	name, ok := nlmStatName[e.Stat]
+	if !ok {
+		name = fmt.Sprintf("nlm4_stats %d", e.Stat)
+	}
+
+	return fmt.Sprintf("nlm proc %d: %s", e.Proc, name)
+}
+
+// Is matches a denied request to os.ErrPermission
+func (e *NLMError) Is(target error) bool {
+	return target == os.ErrPermission && e.Stat == NLM4Denied
+}
+
+// Temporary reports whether the request may be granted if retried, which is
+// the case while the server is in its grace period or out of locks
+func (e *NLMError) Temporary() bool {
+	return e.Stat == NLM4DeniedGracePeriod || e.Stat == NLM4DeniedNoLocks
+}
+
+// IsNLMDenied reports whether err is a lock or share the server refused
+// because it conflicts with another
+func IsNLMDenied(err error) bool {
+	var nlmErr *NLMError
+	return errors.As(err, &nlmErr) && nlmErr.Stat == NLM4Denied
+}
+
+// LockManager is a client of the NLM service of a server, which holds the
+// locks and share reservations NFSv3 itself has no notion of
+type LockManager struct {
+	*rpc.Client
+	auth rpc.Auth
+
+	// the caller name, owner handle and process id requests are made as
+	caller string
+	owner  []byte
+	svid   int32
+
+	cookie uint32
+
+	// whether the client is ours to close
+	own bool
+}
+
+var lockOwners uint32
+
+// NewLockManagerWithClient returns a lock manager talking over client, which
+// is left open on Close
+func NewLockManagerWithClient(client *rpc.Client, auth rpc.Auth) *LockManager {
+	caller := ""
+	if au, err := rpc.ParseAuthUnix(auth); err == nil {
+		caller = au.Machinename
+	}
+	if caller == "" {
+		caller, _ = os.Hostname()
+	}
+
+	// the owner tells apart lock managers of the same process
+	owner := fmt.Sprintf("%d.%d@%s", os.Getpid(), atomic.AddUint32(&lockOwners, 1), caller)
+
+	return &LockManager{
+		Client: client,
+		auth:   auth,
+		caller: caller,
+		owner:  []byte(owner),
+		svid:   int32(os.Getpid()),
+	}
+}
+
+// DialLockManager connects to the NLM service of addr
+func DialLockManager(addr string, auth rpc.Auth, priv bool) (*LockManager, error) {
+	m := rpc.Mapping{
+		Prog: NLMProg,
+		Vers: NLMVers,
+		Prot: rpc.IPProtoTCP,
+		Port: 0,
+	}
+
+	client, err := DialService(addr, m, priv)
+	if err != nil {
+		return nil, err
+	}
+
+	l := NewLockManagerWithClient(client, auth)
+	l.own = true
+
+	return l, nil
+}
+
+// Close closes the connection of the lock manager, if it dialed it.  The
+// server drops the locks and shares of a client only when told, or when
+// the client host reboots.
+func (l *LockManager) Close() error {
+	if !l.own {
+		return nil
+	}
+
+	return l.Client.Close()
+}
+
+func (l *LockManager) nextCookie() []byte {
+	c := atomic.AddUint32(&l.cookie, 1)
+	return []byte{byte(c >> 24), byte(c >> 16), byte(c >> 8), byte(c)}
+}
+
+func (l *LockManager) header(proc uint32) rpc.Header {
+	return rpc.Header{
+		Rpcvers: 2,
+		Prog:    NLMProg,
+		Vers:    NLMVers,
+		Proc:    proc,
+		Cred:    l.auth,
+		Verf:    rpc.AuthNull,
+	}
+}
+
+// nlmShare is nlm4_share
+type nlmShare struct {
+	CallerName string
+	FH         []byte
+	OH         []byte
+	Mode       uint32
+	Access     uint32
+}
+
+func (l *LockManager) share(proc uint32, fh []byte, access, deny uint32, reclaim bool) error {
+	type shareArgs struct {
+		rpc.Header
+		Cookie  []byte
+		Share   nlmShare
+		Reclaim bool
+	}
+
+	res, err := l.Call(&shareArgs{
+		l.header(proc),
+		l.nextCookie(),
+		nlmShare{l.caller, fh, l.owner, deny, access},
+		reclaim,
+	})
+	if err != nil {
+		return err
+	}
+
+	reply := struct {
+		Cookie   []byte
+		Stat     uint32
+		Sequence int32
+	}{}
+	if err = xdr.Read(res, &reply); err != nil {
+		return err
+	}
+	if reply.Stat != NLM4Granted {
+		return &NLMError{Proc: proc, Stat: reply.Stat}
+	}
+
+	return nil
+}
+
+// ShareByFh takes a share reservation on file fh, for access, one of the
+// ShareAccess values, denying deny, one of the ShareDeny values, to others.
+// Reservations are advisory to NFS clients: they bind other lock manager
+// clients, and the SMB clients of filers that serve the same files both
+// ways.
+func (l *LockManager) ShareByFh(fh []byte, access, deny uint32) (*ShareReservation, error) {
+	if err := l.share(NLMProc4Share, fh, access, deny, false); err != nil {
+		util.Debugf("nlm: share(%x, %d, %d): %s", fh, access, deny, err)
+		return nil, err
+	}
+
+	return &ShareReservation{l: l, fh: fh, access: access, deny: deny}, nil
+}
+
+// ShareReservation is a share held on a file, until Unshare
+type ShareReservation struct {
+	l            *LockManager
+	fh           []byte
+	access, deny uint32
+
+	once sync.Once
+	err  error
+}
+
+// Unshare releases the reservation, it is a no-op past the first call
+func (s *ShareReservation) Unshare() error {
+	s.once.Do(func() {
+		s.err = s.l.share(NLMProc4Unshare, s.fh, s.access, s.deny, false)
+	})
+
+	return s.err
+}
+
+// Reclaim takes the reservation again after the server rebooted, during its
+// grace period
+func (s *ShareReservation) Reclaim() error {
+	return s.l.share(NLMProc4Share, s.fh, s.access, s.deny, true)
+}
+
+// nlmLock is nlm4_lock, a range of Len bytes from Offset, 0 for up to the
+// end of the file however far it goes
+type nlmLock struct {
+	CallerName string
+	FH         []byte
+	OH         []byte
+	Svid       int32
+	Offset     uint64
+	Len        uint64
+}
+
+func (l *LockManager) lockCall(c interface{}, proc uint32) error {
+	res, err := l.Call(c)
+	if err != nil {
+		return err
+	}
+
+	reply := struct {
+		Cookie []byte
+		Stat   uint32
+	}{}
+	if err = xdr.Read(res, &reply); err != nil {
+		return err
+	}
+	if reply.Stat != NLM4Granted {
+		return &NLMError{Proc: proc, Stat: reply.Stat}
+	}
+
+	return nil
+}
+
+func (l *LockManager) lock(fh []byte, offset, length uint64, exclusive bool) error {
+	type lockArgs struct {
+		rpc.Header
+		Cookie    []byte
+		Block     bool
+		Exclusive bool
+		Lock      nlmLock
+		Reclaim   bool
+		State     int32
+	}
+
+	// never blocking: a blocked lock is granted by a callback to the
+	// client, which takes an NLM service of our own
+	return l.lockCall(&lockArgs{
+		Header:    l.header(NLMProc4Lock),
+		Cookie:    l.nextCookie(),
+		Exclusive: exclusive,
+		Lock:      nlmLock{l.caller, fh, l.owner, l.svid, offset, length},
+	}, NLMProc4Lock)
+}
+
+// Lock polling backoff, see LockByFh
+const (
+	lockPollMin = 10 * time.Millisecond
+	lockPollMax = time.Second
+)
+
+// LockByFh takes a lock on length bytes of file fh from offset, length 0
+// locking up to the end of the file however far it grows.  An exclusive
+// lock keeps others from locking the range at all, a shared one from
+// locking it exclusively.  If wait is set a conflicting lock is waited for,
+// by retrying with a backoff, as are the grace period of a server that
+// rebooted and a server out of locks.  Locks are advisory, they only bind
+// clients that take them too.
+func (l *LockManager) LockByFh(fh []byte, offset, length uint64, exclusive, wait bool) (*ByteRangeLock, error) {
+	delay := lockPollMin
+	for {
+		err := l.lock(fh, offset, length, exclusive)
+		if err == nil {
+			return &ByteRangeLock{l: l, fh: fh, offset: offset, length: length}, nil
+		}
+
+		var nlmErr *NLMError
+		if !wait || !errors.As(err, &nlmErr) || !(nlmErr.Stat == NLM4Denied || nlmErr.Temporary()) {
+			util.Debugf("nlm: lock(%x, %d, %d): %s", fh, offset, length, err)
+			return nil, err
+		}
+
+		time.Sleep(delay)
+		if delay *= 2; delay > lockPollMax {
+			delay = lockPollMax
+		}
+	}
+}
+
+// ByteRangeLock is a lock held on a range of a file, until Unlock
+type ByteRangeLock struct {
+	l              *LockManager
+	fh             []byte
+	offset, length uint64
+
+	once sync.Once
+	err  error
+}
+
+// Unlock releases the lock, it is a no-op past the first call
+func (b *ByteRangeLock) Unlock() error {
+	type unlockArgs struct {
+		rpc.Header
+		Cookie []byte
+		Lock   nlmLock
+	}
+
+	b.once.Do(func() {
+		l := b.l
+		b.err = l.lockCall(&unlockArgs{
+			l.header(NLMProc4Unlock),
+			l.nextCookie(),
+			nlmLock{l.caller, b.fh, l.owner, l.svid, b.offset, b.length},
+		}, NLMProc4Unlock)
+	})
+
+	return b.err
+}
+
+// LockManager returns the lock manager of the server of v, connecting to it
+// on first use.  Targets over a loopback or a caller supplied connection
+// talk NLM over that connection.  It is closed along with v.
+func (v *Target) LockManager() (*LockManager, error) {
+	v.nlmMu.Lock()
+	defer v.nlmMu.Unlock()
+
+	if v.nlm != nil {
+		return v.nlm, nil
+	}
+
+	if m := v.mount; m != nil && m.Addr != "" {
+		nlm := rpc.Mapping{Prog: NLMProg, Vers: NLMVers, Prot: rpc.IPProtoTCP}
+		client, err := DialServiceTLS(m.Addr, nlm, m.priv, m.tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		v.nlm = NewLockManagerWithClient(client, v.auth)
+		v.nlm.own = true
+	} else {
+		v.nlm = NewLockManagerWithClient(v.Client, v.auth)
+	}
+
+	return v.nlm, nil
+}
+
+// Share takes a share reservation on file path, see ShareByFh.  To copy a
+// file other clients must not change meanwhile, share it for reading
+// denying writes.
+func (v *Target) Share(path string, access, deny uint32) (*ShareReservation, error) {
+	l, err := v.LockManager()
+	if err != nil {
+		return nil, err
+	}
+
+	_, fh, err := v.Lookup(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.ShareByFh(fh, access, deny)
+}
@@ -0,0 +1,203 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+// fakeNLM answers NLM calls as a lock manager would, with a table of shares
+// and exclusive locks
+type fakeNLM struct {
+	sync.Mutex
+	shares map[string]nlmShare
+	locks  map[string]nlmLock
+}
+
+func newFakeNLM() *fakeNLM {
+	return &fakeNLM{shares: make(map[string]nlmShare), locks: make(map[string]nlmLock)}
+}
+
+func (st *fakeNLM) serve(call *rpc.ServerCall, w io.Writer) error {
+	switch call.Proc {
+	case NLMProc4Lock, NLMProc4Unlock:
+		return st.serveLock(call, w)
+	}
+
+	var args struct {
+		Cookie  []byte
+		Share   nlmShare
+		Reclaim bool
+	}
+	if err := xdr.Read(call.Args, &args); err != nil {
+		return rpc.ErrGarbageArgs
+	}
+
+	st.Lock()
+	defer st.Unlock()
+
+	key := string(args.Share.FH) + "\x00" + string(args.Share.OH)
+	stat := uint32(NLM4Granted)
+	switch call.Proc {
+	case NLMProc4Share:
+		for k, s := range st.shares {
+			if k == key || string(s.FH) != string(args.Share.FH) {
+				continue
+			}
+			if s.Mode&args.Share.Access != 0 || args.Share.Mode&s.Access != 0 {
+				stat = NLM4Denied
+			}
+		}
+		if stat == NLM4Granted {
+			st.shares[key] = args.Share
+		}
+	case NLMProc4Unshare:
+		delete(st.shares, key)
+	default:
+		return rpc.ErrProcUnavail
+	}
+
+	return xdr.Write(w, struct {
+		Cookie   []byte
+		Stat     uint32
+		Sequence int32
+	}{args.Cookie, stat, 0})
+}
+
+// serveLock locks whole files only, which is all AppendRecord takes
+func (st *fakeNLM) serveLock(call *rpc.ServerCall, w io.Writer) error {
+	var args struct {
+		Cookie []byte
+		Lock   nlmLock
+	}
+	if call.Proc == NLMProc4Lock {
+		var lockArgs struct {
+			Cookie           []byte
+			Block, Exclusive bool
+			Lock             nlmLock
+			Reclaim          bool
+			State            int32
+		}
+		if err := xdr.Read(call.Args, &lockArgs); err != nil {
+			return rpc.ErrGarbageArgs
+		}
+		args.Cookie, args.Lock = lockArgs.Cookie, lockArgs.Lock
+	} else if err := xdr.Read(call.Args, &args); err != nil {
+		return rpc.ErrGarbageArgs
+	}
+
+	st.Lock()
+	defer st.Unlock()
+
+	stat := uint32(NLM4Granted)
+	held, ok := st.locks[string(args.Lock.FH)]
+	switch {
+	case call.Proc == NLMProc4Unlock:
+		delete(st.locks, string(args.Lock.FH))
+	case ok && string(held.OH) != string(args.Lock.OH):
+		stat = NLM4Denied
+	default:
+		st.locks[string(args.Lock.FH)] = args.Lock
+	}
+
+	return xdr.Write(w, struct {
+		Cookie []byte
+		Stat   uint32
+	}{args.Cookie, stat})
+}
+
+func TestShare(t *testing.T) {
+	s := NewServer(NewMemFS())
+	s.Register(NLMProg, NLMVers, newFakeNLM().serve)
+
+	v, err := DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+	writeFile(t, v, "/file", "data")
+
+	// a copy that others must not write meanwhile
+	res, err := v.Share("/file", ShareAccessRead, ShareDenyWrite)
+	if err != nil {
+		t.Fatalf("share: %s", err)
+	}
+
+	// another client, as an SMB client of the filer would be
+	_, fh, _ := v.Lookup("/file")
+	other := NewLockManagerWithClient(v.Client, rpc.AuthNull)
+	if _, err = other.ShareByFh(fh, ShareAccessWrite, ShareDenyNone); !IsNLMDenied(err) {
+		t.Fatalf("conflicting share: got %v, want NLM4_DENIED", err)
+	}
+	if !errors.Is(err, os.ErrPermission) {
+		t.Errorf("denied share is not os.ErrPermission")
+	}
+	if _, err = other.ShareByFh(fh, ShareAccessRead, ShareDenyNone); err != nil {
+		t.Errorf("reading share: %s", err)
+	}
+
+	if err = res.Unshare(); err != nil {
+		t.Fatalf("unshare: %s", err)
+	}
+	if _, err = other.ShareByFh(fh, ShareAccessWrite, ShareDenyNone); err != nil {
+		t.Errorf("share after unshare: %s", err)
+	}
+}
+
+func TestAppendRecord(t *testing.T) {
+	s := NewServer(NewMemFS())
+	s.Register(NLMProg, NLMVers, newFakeNLM().serve)
+
+	// clients on two hosts, each with its own connection
+	var targets []*Target
+	for i := 0; i < 2; i++ {
+		v, err := DialLoopback(s).Mount("/", rpc.AuthNull)
+		if err != nil {
+			t.Fatalf("mount: %s", err)
+		}
+		defer v.Close()
+		targets = append(targets, v)
+	}
+
+	const records = 20
+	var wg sync.WaitGroup
+	for i, v := range targets {
+		wg.Add(1)
+		go func(v *Target, rec string) {
+			defer wg.Done()
+			for j := 0; j < records; j++ {
+				if err := v.AppendRecord("/log", []byte(rec)); err != nil {
+					t.Errorf("append: %s", err)
+					return
+				}
+			}
+		}(v, strings.Repeat(string(rune('a'+i)), 10)+"\n")
+	}
+	wg.Wait()
+
+	f, err := targets[0].Open("/log")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2*records {
+		t.Fatalf("got %d records, want %d", len(lines), 2*records)
+	}
+	for _, line := range lines {
+		if line != strings.Repeat(line[:1], 10) {
+			t.Fatalf("torn record %q", line)
+		}
+	}
+}
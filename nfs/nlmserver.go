@@ -0,0 +1,700 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/util"
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+// More NLM procedures, those a server answers beyond the ones LockManager
+// calls
+const (
+	NLMProc4Granted = 5
+	NLMProc4NMLock  = 22
+)
+
+// NSM procedures, version 1
+const (
+	SMProcNull   = 0
+	SMProcStat   = 1
+	SMProcNotify = 6
+)
+
+// LockOptions are how a Server serves NLM and NSM, see SetLocking
+type LockOptions struct {
+	// Grace is the time after SetLocking during which only reclaims of
+	// locks and shares are granted, for clients to take back those they
+	// held before the server restarted
+	Grace time.Duration
+
+	// Name and State are the host name and the NSM state number the server
+	// tells clients in SM_NOTIFY and SM_STAT, the host name and 1 if unset.
+	// The state is odd, and is to be raised by 2 on every restart by
+	// whoever keeps it across them.
+	Name  string
+	State int32
+
+	// DialClient dials the NLM service of the client of caller name at
+	// addr, to grant it the locks it waits for.  If nil it is looked up
+	// from the portmapper of the host of addr.
+	DialClient func(caller string, addr net.Addr) (*rpc.Client, error)
+}
+
+// SetLocking sets how the server serves the NLM and NSM programs, which it
+// does from an in-process table of locks and shares.  Blocking locks that
+// conflict are queued and granted by an NLM_GRANTED callback once they can
+// be, SM_NOTIFY and NLM_FREE_ALL from a client that restarted release what
+// it held.  Servers start with zero options.  It is to be set before the
+// server serves calls.
+func (s *Server) SetLocking(opts LockOptions) {
+	if opts.Name == "" {
+		opts.Name, _ = os.Hostname()
+	}
+	if opts.State == 0 {
+		opts.State = 1
+	}
+
+	s.locks = &lockTable{
+		LockOptions: opts,
+		grace:       time.Now().Add(opts.Grace),
+		files:       make(map[string]*lockFile),
+		clients:     make(map[string]net.Addr),
+	}
+}
+
+// LockClients returns the caller names of the clients that took locks or
+// shares, until they restart and free them, those to send SM_NOTIFY to, see
+// NotifyClients, if the server restarts
+func (s *Server) LockClients() []string {
+	t := s.locks
+	t.Lock()
+	defer t.Unlock()
+
+	names := make([]string, 0, len(t.clients))
+	for name := range t.clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// NotifyClients sends SM_NOTIFY to the status monitors of hosts, the clients
+// that held locks before the server restarted, for them to reclaim those
+// during the grace period.  It returns the first error, after notifying the
+// others.
+func (s *Server) NotifyClients(hosts ...string) error {
+	type notifyArgs struct {
+		rpc.Header
+		MonName string
+		State   int32
+	}
+
+	var first error
+	for _, host := range hosts {
+		client, err := DialService(host, rpc.Mapping{Prog: StatdProg, Vers: StatdVers, Prot: rpc.IPProtoTCP}, false)
+		if err == nil {
+			_, err = client.Call(&notifyArgs{
+				rpc.Header{
+					Rpcvers: 2,
+					Prog:    StatdProg,
+					Vers:    StatdVers,
+					Proc:    SMProcNotify,
+					Cred:    rpc.AuthNull,
+					Verf:    rpc.AuthNull,
+				},
+				s.locks.Name,
+				s.locks.State,
+			})
+			client.Close()
+		}
+		if err != nil {
+			util.Errorf("nsm: notify %s: %s", host, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+
+	return first
+}
+
+// lockOwner is the owner of a lock or share, a process of a client
+type lockOwner struct {
+	caller string
+	oh     string
+}
+
+// heldLock is a lock granted on a range, of length 0 up to the end of file
+type heldLock struct {
+	owner     lockOwner
+	svid      int32
+	exclusive bool
+	offset    uint64
+	length    uint64
+}
+
+func (l *heldLock) end() uint64 {
+	if l.length == 0 || l.offset+l.length < l.offset {
+		return ^uint64(0)
+	}
+	return l.offset + l.length
+}
+
+func (l *heldLock) overlaps(o *heldLock) bool {
+	return l.offset < o.end() && o.offset < l.end()
+}
+
+// conflicts tells whether l keeps o from being granted
+func (l *heldLock) conflicts(o *heldLock) bool {
+	return l.owner != o.owner && l.overlaps(o) && (l.exclusive || o.exclusive)
+}
+
+type heldShare struct {
+	owner        lockOwner
+	access, mode uint32
+}
+
+// lockWaiter is a blocking lock queued until it can be granted
+type lockWaiter struct {
+	heldLock
+	fh     []byte
+	cookie []byte
+	addr   net.Addr
+}
+
+type lockFile struct {
+	locks   []*heldLock
+	shares  []*heldShare
+	waiters []*lockWaiter
+}
+
+type lockTable struct {
+	LockOptions
+	grace time.Time
+
+	sync.Mutex
+	files map[string]*lockFile
+
+	// the last address of each client, by caller name
+	clients map[string]net.Addr
+}
+
+// file returns the locks of fh, made if make is set
+func (t *lockTable) file(fh []byte, make bool) *lockFile {
+	f := t.files[string(fh)]
+	if f == nil && make {
+		f = new(lockFile)
+		t.files[string(fh)] = f
+	}
+	return f
+}
+
+// tidy drops the entry of fh once it holds nothing, the caller holds the
+// lock
+func (t *lockTable) tidy(fh []byte) {
+	if f := t.files[string(fh)]; f != nil && len(f.locks) == 0 && len(f.shares) == 0 && len(f.waiters) == 0 {
+		delete(t.files, string(fh))
+	}
+}
+
+// conflict returns the lock keeping l from being granted, nil if there is
+// none
+func (f *lockFile) conflict(l *heldLock) *heldLock {
+	for _, held := range f.locks {
+		if held.conflicts(l) {
+			return held
+		}
+	}
+	return nil
+}
+
+// unlock releases the range of l held by its owner, splitting the locks it
+// is in the middle of
+func (f *lockFile) unlock(l *heldLock) {
+	var kept []*heldLock
+	for _, held := range f.locks {
+		if held.owner != l.owner || !held.overlaps(l) {
+			kept = append(kept, held)
+			continue
+		}
+		if held.offset < l.offset {
+			left := *held
+			left.length = l.offset - held.offset
+			kept = append(kept, &left)
+		}
+		if end := l.end(); end < held.end() {
+			right := *held
+			right.offset = end
+			if held.length != 0 {
+				right.length = held.end() - end
+			}
+			kept = append(kept, &right)
+		}
+	}
+	f.locks = kept
+}
+
+// lock grants l, replacing the locks its owner held on its range
+func (f *lockFile) lock(l *heldLock) {
+	f.unlock(l)
+	f.locks = append(f.locks, l)
+}
+
+// wake grants the waiters of fh that no longer conflict, and calls them
+// back, the caller holds the lock
+func (t *lockTable) wake(fh []byte) {
+	f := t.file(fh, false)
+	if f == nil {
+		return
+	}
+
+	var waiting []*lockWaiter
+	for _, w := range f.waiters {
+		if f.conflict(&w.heldLock) != nil {
+			waiting = append(waiting, w)
+			continue
+		}
+		l := w.heldLock
+		f.lock(&l)
+		go t.granted(w)
+	}
+	f.waiters = waiting
+}
+
+// granted tells the client of w its lock was granted, and releases the lock
+// if it cannot be told, for it to ask again
+func (t *lockTable) granted(w *lockWaiter) {
+	type grantedArgs struct {
+		rpc.Header
+		Cookie    []byte
+		Exclusive bool
+		Lock      nlmLock
+	}
+
+	dial := t.DialClient
+	if dial == nil {
+		dial = func(caller string, addr net.Addr) (*rpc.Client, error) {
+			host := remoteIP(addr)
+			if host == nil {
+				return nil, os.ErrNotExist
+			}
+			return DialService(host.String(), rpc.Mapping{Prog: NLMProg, Vers: NLMVers, Prot: rpc.IPProtoTCP}, false)
+		}
+	}
+
+	client, err := dial(w.owner.caller, w.addr)
+	if err == nil {
+		var res io.ReadSeeker
+		res, err = client.Call(&grantedArgs{
+			rpc.Header{
+				Rpcvers: 2,
+				Prog:    NLMProg,
+				Vers:    NLMVers,
+				Proc:    NLMProc4Granted,
+				Cred:    rpc.AuthNull,
+				Verf:    rpc.AuthNull,
+			},
+			w.cookie,
+			w.exclusive,
+			nlmLock{w.owner.caller, w.fh, []byte(w.owner.oh), w.svid, w.offset, w.length},
+		})
+		client.Close()
+
+		var reply struct {
+			Cookie []byte
+			Stat   uint32
+		}
+		if err == nil {
+			err = xdr.Read(res, &reply)
+		}
+		if err == nil && reply.Stat != NLM4Granted {
+			err = &NLMError{Proc: NLMProc4Granted, Stat: reply.Stat}
+		}
+	}
+	if err == nil {
+		return
+	}
+
+	util.Debugf("nlm: granted(%s, %x): %s, released", w.owner.caller, w.fh, err)
+	t.Lock()
+	defer t.Unlock()
+	if f := t.file(w.fh, false); f != nil {
+		f.unlock(&w.heldLock)
+		t.wake(w.fh)
+		t.tidy(w.fh)
+	}
+}
+
+// freeAll releases what the client of caller name holds and waits for, as
+// when it restarted
+func (t *lockTable) freeAll(caller string) {
+	t.Lock()
+	defer t.Unlock()
+
+	for key, f := range t.files {
+		var locks []*heldLock
+		for _, l := range f.locks {
+			if l.owner.caller != caller {
+				locks = append(locks, l)
+			}
+		}
+		var shares []*heldShare
+		for _, s := range f.shares {
+			if s.owner.caller != caller {
+				shares = append(shares, s)
+			}
+		}
+		var waiters []*lockWaiter
+		for _, w := range f.waiters {
+			if w.owner.caller != caller {
+				waiters = append(waiters, w)
+			}
+		}
+		f.locks, f.shares, f.waiters = locks, shares, waiters
+
+		t.wake([]byte(key))
+		t.tidy([]byte(key))
+	}
+	delete(t.clients, caller)
+}
+
+// inGrace tells whether a request that is no reclaim is to be refused
+func (t *lockTable) inGrace(reclaim bool) bool {
+	return !reclaim && time.Now().Before(t.grace)
+}
+
+// nlmStatus maps an error of the backend to an nlm4_stats
+func nlmStatus(err error) uint32 {
+	switch nfsStatus(err) {
+	case NFS3ErrStale, NFS3ErrBadHandle, NFS3ErrNoEnt:
+		return NLM4StaleFH
+	case NFS3ErrROFS:
+		return NLM4ROFS
+	}
+	return NLM4Failed
+}
+
+// lockGrant checks a call of NLM or NSM, of the handle in fhs if it has one,
+// against the export table as those of NFS are, and returns the nlm4_stats
+// to refuse it with, NLM4Granted if it may be served
+func (s *Server) lockGrant(call *rpc.ServerCall, fhs ...[]byte) (uint32, error) {
+	_, status, err := s.grant(call, fhs...)
+	if err != nil || status == NFS3Ok {
+		return NLM4Granted, err
+	}
+
+	util.Debugf("server: lock call %d from %s: %s", call.Proc, call.RemoteAddr, StatusName(status))
+	return nlmStatus(NFS3Error(status)), nil
+}
+
+func (s *Server) serveNLM(call *rpc.ServerCall, w io.Writer) error {
+	t := s.locks
+
+	type res struct {
+		Cookie []byte
+		Stat   uint32
+	}
+
+	switch call.Proc {
+	case NLMProc4Null:
+		return nil
+
+	case NLMProc4Test:
+		var a struct {
+			Cookie    []byte
+			Exclusive bool
+			Lock      nlmLock
+		}
+		if err := xdr.Read(call.Args, &a); err != nil {
+			return rpc.ErrGarbageArgs
+		}
+		if stat, err := s.lockGrant(call, a.Lock.FH); stat != NLM4Granted || err != nil {
+			return refused(w, err, res{a.Cookie, stat})
+		}
+		if _, err := s.backend.GetAttr(a.Lock.FH); err != nil {
+			return xdr.Write(w, res{a.Cookie, nlmStatus(err)})
+		}
+
+		l := lockOf(a.Lock, a.Exclusive)
+		t.Lock()
+		var held *heldLock
+		if f := t.file(a.Lock.FH, false); f != nil {
+			held = f.conflict(l)
+		}
+		t.Unlock()
+
+		if held == nil {
+			return xdr.Write(w, res{a.Cookie, NLM4Granted})
+		}
+		return xdr.Write(w, struct {
+			Cookie    []byte
+			Stat      uint32
+			Exclusive bool
+			Svid      int32
+			OH        []byte
+			Offset    uint64
+			Len       uint64
+		}{a.Cookie, NLM4Denied, held.exclusive, held.svid, []byte(held.owner.oh), held.offset, held.length})
+
+	case NLMProc4Lock, NLMProc4NMLock:
+		var a struct {
+			Cookie    []byte
+			Block     bool
+			Exclusive bool
+			Lock      nlmLock
+			Reclaim   bool
+			State     int32
+		}
+		if err := xdr.Read(call.Args, &a); err != nil {
+			return rpc.ErrGarbageArgs
+		}
+		if stat, err := s.lockGrant(call, a.Lock.FH); stat != NLM4Granted || err != nil {
+			return refused(w, err, res{a.Cookie, stat})
+		}
+		if t.inGrace(a.Reclaim) {
+			return xdr.Write(w, res{a.Cookie, NLM4DeniedGracePeriod})
+		}
+		if _, err := s.backend.GetAttr(a.Lock.FH); err != nil {
+			return xdr.Write(w, res{a.Cookie, nlmStatus(err)})
+		}
+
+		l := lockOf(a.Lock, a.Exclusive)
+		t.Lock()
+		defer t.Unlock()
+
+		if call.Proc == NLMProc4Lock {
+			t.clients[l.owner.caller] = call.RemoteAddr
+		}
+		f := t.file(a.Lock.FH, true)
+		if f.conflict(l) == nil {
+			f.lock(l)
+			return xdr.Write(w, res{a.Cookie, NLM4Granted})
+		}
+		if !a.Block {
+			t.tidy(a.Lock.FH)
+			return xdr.Write(w, res{a.Cookie, NLM4Denied})
+		}
+
+		// queued once, however many times the client asks
+		for _, q := range f.waiters {
+			if q.heldLock == *l {
+				return xdr.Write(w, res{a.Cookie, NLM4Blocked})
+			}
+		}
+		f.waiters = append(f.waiters, &lockWaiter{heldLock: *l, fh: a.Lock.FH, cookie: a.Cookie, addr: call.RemoteAddr})
+		return xdr.Write(w, res{a.Cookie, NLM4Blocked})
+
+	case NLMProc4Cancel:
+		var a struct {
+			Cookie    []byte
+			Block     bool
+			Exclusive bool
+			Lock      nlmLock
+		}
+		if err := xdr.Read(call.Args, &a); err != nil {
+			return rpc.ErrGarbageArgs
+		}
+		if stat, err := s.lockGrant(call, a.Lock.FH); stat != NLM4Granted || err != nil {
+			return refused(w, err, res{a.Cookie, stat})
+		}
+
+		l := lockOf(a.Lock, a.Exclusive)
+		t.Lock()
+		defer t.Unlock()
+
+		if f := t.file(a.Lock.FH, false); f != nil {
+			var waiting []*lockWaiter
+			for _, q := range f.waiters {
+				if q.heldLock != *l {
+					waiting = append(waiting, q)
+				}
+			}
+			f.waiters = waiting
+			t.tidy(a.Lock.FH)
+		}
+		return xdr.Write(w, res{a.Cookie, NLM4Granted})
+
+	case NLMProc4Unlock:
+		var a struct {
+			Cookie []byte
+			Lock   nlmLock
+		}
+		if err := xdr.Read(call.Args, &a); err != nil {
+			return rpc.ErrGarbageArgs
+		}
+		if stat, err := s.lockGrant(call, a.Lock.FH); stat != NLM4Granted || err != nil {
+			return refused(w, err, res{a.Cookie, stat})
+		}
+
+		t.Lock()
+		defer t.Unlock()
+
+		if f := t.file(a.Lock.FH, false); f != nil {
+			f.unlock(lockOf(a.Lock, false))
+			t.wake(a.Lock.FH)
+			t.tidy(a.Lock.FH)
+		}
+		return xdr.Write(w, res{a.Cookie, NLM4Granted})
+
+	case NLMProc4Share, NLMProc4Unshare:
+		var a struct {
+			Cookie  []byte
+			Share   nlmShare
+			Reclaim bool
+		}
+		if err := xdr.Read(call.Args, &a); err != nil {
+			return rpc.ErrGarbageArgs
+		}
+
+		stat, err := s.lockGrant(call, a.Share.FH)
+		if err != nil {
+			return err
+		}
+		if stat == NLM4Granted {
+			stat = t.share(call, a.Share, a.Reclaim)
+		}
+		if stat == NLM4Granted && call.Proc == NLMProc4Share {
+			if _, err := s.backend.GetAttr(a.Share.FH); err != nil {
+				t.unshare(a.Share)
+				stat = nlmStatus(err)
+			}
+		}
+		return xdr.Write(w, struct {
+			Cookie   []byte
+			Stat     uint32
+			Sequence int32
+		}{a.Cookie, stat, 0})
+
+	case NLMProc4FreeAll:
+		var a struct {
+			Name  string
+			State int32
+		}
+		if err := xdr.Read(call.Args, &a); err != nil {
+			return rpc.ErrGarbageArgs
+		}
+		if stat, err := s.lockGrant(call); stat != NLM4Granted || err != nil {
+			return err
+		}
+		t.freeAll(a.Name)
+		return nil
+	}
+
+	return rpc.ErrProcUnavail
+}
+
+// refused writes res, the reply of a call lockGrant refused, unless it was
+// refused with err
+func refused(w io.Writer, err error, res interface{}) error {
+	if err != nil {
+		return err
+	}
+	return xdr.Write(w, res)
+}
+
+func lockOf(l nlmLock, exclusive bool) *heldLock {
+	return &heldLock{
+		owner:     lockOwner{l.CallerName, string(l.OH)},
+		svid:      l.Svid,
+		exclusive: exclusive,
+		offset:    l.Offset,
+		length:    l.Len,
+	}
+}
+
+// share takes, or for UNSHARE releases, the share sh, and returns the
+// nlm4_stats of the reply
+func (t *lockTable) share(call *rpc.ServerCall, sh nlmShare, reclaim bool) uint32 {
+	if call.Proc == NLMProc4Unshare {
+		t.unshare(sh)
+		return NLM4Granted
+	}
+	if t.inGrace(reclaim) {
+		return NLM4DeniedGracePeriod
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	owner := lockOwner{sh.CallerName, string(sh.OH)}
+	f := t.file(sh.FH, true)
+	var kept []*heldShare
+	for _, held := range f.shares {
+		if held.owner == owner {
+			continue
+		}
+		if held.mode&sh.Access != 0 || sh.Mode&held.access != 0 {
+			t.tidy(sh.FH)
+			return NLM4Denied
+		}
+		kept = append(kept, held)
+	}
+	f.shares = append(kept, &heldShare{owner: owner, access: sh.Access, mode: sh.Mode})
+	t.clients[sh.CallerName] = call.RemoteAddr
+
+	return NLM4Granted
+}
+
+func (t *lockTable) unshare(sh nlmShare) {
+	t.Lock()
+	defer t.Unlock()
+
+	owner := lockOwner{sh.CallerName, string(sh.OH)}
+	if f := t.file(sh.FH, false); f != nil {
+		var kept []*heldShare
+		for _, held := range f.shares {
+			if held.owner != owner {
+				kept = append(kept, held)
+			}
+		}
+		f.shares = kept
+		t.tidy(sh.FH)
+	}
+}
+
+func (s *Server) serveNSM(call *rpc.ServerCall, w io.Writer) error {
+	t := s.locks
+
+	switch call.Proc {
+	case SMProcNull:
+		return nil
+
+	case SMProcStat:
+		if _, err := readString(call.Args); err != nil {
+			return rpc.ErrGarbageArgs
+		}
+		// stat_succ, the name is one the server can monitor
+		return xdr.Write(w, struct {
+			Result uint32
+			State  int32
+		}{0, t.State})
+
+	case SMProcNotify:
+		var a struct {
+			MonName string
+			State   int32
+		}
+		if err := xdr.Read(call.Args, &a); err != nil {
+			return rpc.ErrGarbageArgs
+		}
+		if stat, err := s.lockGrant(call); stat != NLM4Granted || err != nil {
+			return err
+		}
+		util.Debugf("nsm: %s restarted, state %d", a.MonName, a.State)
+		t.freeAll(a.MonName)
+		return nil
+	}
+
+	return rpc.ErrProcUnavail
+}
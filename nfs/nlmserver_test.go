@@ -0,0 +1,190 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+func TestServerLocks(t *testing.T) {
+	s := NewServer(NewMemFS())
+
+	// blocked locks are granted to the NLM service of the client
+	granted := make(chan nlmLock, 1)
+	callback := rpc.NewServer()
+	callback.Register(NLMProg, NLMVers, func(call *rpc.ServerCall, w io.Writer) error {
+		var a struct {
+			Cookie    []byte
+			Exclusive bool
+			Lock      nlmLock
+		}
+		if call.Proc != NLMProc4Granted || xdr.Read(call.Args, &a) != nil {
+			return rpc.ErrGarbageArgs
+		}
+		granted <- a.Lock
+		return xdr.Write(w, struct {
+			Cookie []byte
+			Stat   uint32
+		}{a.Cookie, NLM4Granted})
+	})
+	s.SetLocking(LockOptions{
+		DialClient: func(caller string, addr net.Addr) (*rpc.Client, error) {
+			return callback.Pipe(), nil
+		},
+	})
+
+	v, err := DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	writeFile(t, v, "/file", "data")
+	_, fh, _ := v.Lookup("/file")
+
+	a := NewLockManagerWithClient(v.Client, rpc.NewAuthUnix("a", 0, 0).Auth())
+	b := NewLockManagerWithClient(v.Client, rpc.NewAuthUnix("b", 0, 0).Auth())
+
+	lock, err := a.LockByFh(fh, 0, 100, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.LockByFh(fh, 50, 10, false, false); !IsNLMDenied(err) {
+		t.Errorf("conflicting lock: %v", err)
+	}
+	if _, err = b.LockByFh(fh, 100, 0, true, false); err != nil {
+		t.Errorf("lock past the range: %v", err)
+	}
+
+	// unlocking the middle of a lock leaves both ends locked
+	mid := &ByteRangeLock{l: a, fh: fh, offset: 40, length: 20}
+	if err = mid.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.LockByFh(fh, 45, 10, true, false); err != nil {
+		t.Errorf("lock of the unlocked middle: %v", err)
+	}
+	if _, err = b.LockByFh(fh, 10, 10, true, false); !IsNLMDenied(err) {
+		t.Errorf("lock of a locked end: %v", err)
+	}
+
+	// a blocking lock of b, granted once a unlocks
+	type lockArgs struct {
+		rpc.Header
+		Cookie    []byte
+		Block     bool
+		Exclusive bool
+		Lock      nlmLock
+		Reclaim   bool
+		State     int32
+	}
+	want := nlmLock{b.caller, fh, b.owner, b.svid, 0, 40}
+	if err = b.lockCall(&lockArgs{Header: b.header(NLMProc4Lock), Block: true, Exclusive: true, Lock: want}, NLMProc4Lock); err == nil {
+		t.Fatal("blocking lock granted while a holds it")
+	} else if e, ok := err.(*NLMError); !ok || e.Stat != NLM4Blocked {
+		t.Fatalf("blocking lock: %v", err)
+	}
+	if err = lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-granted:
+		if got.CallerName != "b" || got.Offset != 0 || got.Len != 40 {
+			t.Errorf("granted %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked lock not granted")
+	}
+	if _, err = a.LockByFh(fh, 0, 10, false, false); !IsNLMDenied(err) {
+		t.Errorf("lock of a range granted to b: %v", err)
+	}
+
+	if names := s.LockClients(); len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Errorf("clients = %v", names)
+	}
+
+	// b restarts, and its status monitor tells
+	_, err = v.Call(&struct {
+		rpc.Header
+		MonName string
+		State   int32
+	}{rpc.Header{Rpcvers: 2, Prog: StatdProg, Vers: StatdVers, Proc: SMProcNotify, Cred: rpc.AuthNull, Verf: rpc.AuthNull}, "b", 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.LockByFh(fh, 0, 0, true, false); err != nil {
+		t.Errorf("lock once b restarted: %v", err)
+	}
+}
+
+func TestServerLockGrace(t *testing.T) {
+	s := NewServer(NewMemFS())
+	s.SetLocking(LockOptions{Grace: time.Hour})
+
+	v, err := DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	writeFile(t, v, "/file", "data")
+
+	_, err = v.Share("/file", ShareAccessRead, ShareDenyWrite)
+	if e, ok := err.(*NLMError); !ok || e.Stat != NLM4DeniedGracePeriod || !e.Temporary() {
+		t.Errorf("share in the grace period: %v", err)
+	}
+}
+
+func TestServerLocksExports(t *testing.T) {
+	s := NewServer(NewMemFS())
+	s.SetLocking(LockOptions{})
+	if err := s.SetExports(ServerExport{Path: "/", Clients: []string{"127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := serveTCP(t, s)().Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	writeFile(t, v, "/file", "data")
+	_, fh, _ := v.Lookup("/file")
+
+	a := NewLockManagerWithClient(v.Client, rpc.NewAuthUnix("a", 0, 0).Auth())
+	if _, err = a.LockByFh(fh, 0, 0, true, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// a client over a pipe, of no address, is allowed by no export
+	other := s.Pipe()
+	defer other.Close()
+	if _, err = NewLockManagerWithClient(other, rpc.NewAuthUnix("c", 0, 0).Auth()).LockByFh(fh, 0, 0, false, false); err == nil {
+		t.Error("lock from a client not allowed")
+	}
+	_, err = other.Call(&struct {
+		rpc.Header
+		Name  string
+		State int32
+	}{rpc.Header{Rpcvers: 2, Prog: NLMProg, Vers: NLMVers, Proc: NLMProc4FreeAll, Cred: rpc.AuthNull, Verf: rpc.AuthNull}, "a", 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.Call(&struct {
+		rpc.Header
+		MonName string
+		State   int32
+	}{rpc.Header{Rpcvers: 2, Prog: StatdProg, Vers: StatdVers, Proc: SMProcNotify, Cred: rpc.AuthNull, Verf: rpc.AuthNull}, "a", 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewLockManagerWithClient(v.Client, rpc.NewAuthUnix("b", 0, 0).Auth())
+	if _, err = b.LockByFh(fh, 0, 10, true, false); !IsNLMDenied(err) {
+		t.Errorf("locks of a freed by a client not allowed: %v", err)
+	}
+}
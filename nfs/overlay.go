@@ -0,0 +1,700 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"io"
+	"os"
+	_path "path"
+	"sort"
+	"strings"
+)
+
+// Whiteouts, as in OCI image layers: an empty file .wh.<name> in a directory
+// of the upper layer hides <name> of the lower one, and .wh..wh..opq hides
+// the whole lower directory.  Names with WhiteoutPrefix cannot be used in an
+// Overlay.
+const (
+	WhiteoutPrefix = ".wh."
+	OpaqueWhiteout = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+)
+
+// Overlay is a view of two trees, a writable upper one over a read-only lower
+// one, as overlayfs gives, for staging changes against a read-only export
+// such as a snapshot before committing them elsewhere.  What is in the upper
+// tree hides what is at the same path in the lower one, directories being
+// merged; writes go to the upper tree, files and directories being copied up
+// first, and what is removed from the lower tree is hidden by a whiteout.
+// Paths are relative to the view, slash separated.
+type Overlay struct {
+	Upper *TreeRef
+	Lower *TreeRef
+}
+
+// NewOverlay returns an overlay of upper, which must be an existing
+// directory, over lower
+func NewOverlay(upper, lower *TreeRef) *Overlay {
+	return &Overlay{Upper: upper, Lower: lower}
+}
+
+// clean returns p as an absolute path of the view, or an error for a path
+// through a whiteout
+func (o *Overlay) clean(op, p string) (string, error) {
+	p = _path.Clean("/" + p)
+	for _, name := range strings.Split(p, "/") {
+		if strings.HasPrefix(name, WhiteoutPrefix) {
+			return "", &os.PathError{Op: op, Path: p, Err: os.ErrInvalid}
+		}
+	}
+
+	return p, nil
+}
+
+// statLayer returns the attributes of p in tree l, nil if it is not there
+func statLayer(l *TreeRef, p string) (*Fattr, error) {
+	attr, _, err := l.Target.lstat(_path.Join(l.Path, p))
+	if os.IsNotExist(err) || IsNotDirError(err) {
+		return nil, nil
+	}
+
+	return attr, err
+}
+
+// lowerHidden reports whether p of the lower tree is hidden, by a whiteout of
+// it or of a directory it is in, an opaque directory or an upper entry other
+// than a directory in its path
+func (o *Overlay) lowerHidden(p string) (bool, error) {
+	dir := "/"
+	for _, name := range strings.Split(p, "/")[1:] {
+		if name == "" {
+			break
+		}
+
+		for _, wh := range []string{OpaqueWhiteout, WhiteoutPrefix + name} {
+			attr, err := statLayer(o.Upper, _path.Join(dir, wh))
+			if attr != nil || err != nil {
+				return attr != nil, err
+			}
+		}
+
+		dir = _path.Join(dir, name)
+		if dir == p {
+			break
+		}
+		attr, err := statLayer(o.Upper, dir)
+		if err != nil || (attr != nil && attr.Type != NF3Dir) {
+			return err == nil, err
+		}
+	}
+
+	return false, nil
+}
+
+// lower returns the attributes of p in the lower tree, nil if it is not there
+// or hidden
+func (o *Overlay) lower(p string) (*Fattr, error) {
+	hidden, err := o.lowerHidden(p)
+	if hidden || err != nil {
+		return nil, err
+	}
+
+	return statLayer(o.Lower, p)
+}
+
+// stat returns the attributes of p in the view, and the tree they are from
+func (o *Overlay) stat(op, p string) (*Fattr, *TreeRef, error) {
+	attr, err := statLayer(o.Upper, p)
+	if attr != nil || err != nil {
+		return attr, o.Upper, err
+	}
+
+	if attr, err = o.lower(p); attr != nil || err != nil {
+		return attr, o.Lower, err
+	}
+
+	return nil, nil, &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+}
+
+// Stat returns the attributes of path, from the tree it is in
+func (o *Overlay) Stat(path string) (os.FileInfo, error) {
+	p, err := o.clean("stat", path)
+	if err != nil {
+		return nil, err
+	}
+
+	attr, _, err := o.stat("stat", p)
+	if err != nil {
+		return nil, err
+	}
+
+	return attr, nil
+}
+
+// ReadDir returns the entries of directory path in either tree, minus those
+// whited out, sorted by name
+func (o *Overlay) ReadDir(path string) ([]os.FileInfo, error) {
+	p, err := o.clean("readdir", path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, whiteouts, opaque, err := o.readDir(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if !opaque {
+		lattr, err := o.lower(p)
+		if err != nil {
+			return nil, err
+		}
+		if lattr != nil && lattr.Type == NF3Dir {
+			list, err := o.Lower.Target.ReadDirPlus(_path.Join(o.Lower.Path, p))
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range list {
+				if _, ok := entries[e.FileName]; !ok && !whiteouts[e.FileName] && e.FileName != "." && e.FileName != ".." {
+					entries[e.FileName] = e
+				}
+			}
+		}
+	}
+
+	list := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+
+	return list, nil
+}
+
+// readDir lists directory p of the view in the upper tree, returning its
+// entries, the names whited out and whether it is opaque.  It fails unless p
+// is a directory of the view.
+func (o *Overlay) readDir(p string) (map[string]*EntryPlus, map[string]bool, bool, error) {
+	attr, l, err := o.stat("readdir", p)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if attr.Type != NF3Dir {
+		return nil, nil, false, &os.PathError{Op: "readdir", Path: p, Err: NFS3Error(NFS3ErrNotDir)}
+	}
+
+	entries := make(map[string]*EntryPlus)
+	whiteouts := make(map[string]bool)
+	if l != o.Upper {
+		return entries, whiteouts, false, nil
+	}
+
+	list, err := o.Upper.Target.ReadDirPlus(_path.Join(o.Upper.Path, p))
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	opaque := false
+	for _, e := range list {
+		switch {
+		case e.FileName == "." || e.FileName == "..":
+		case e.FileName == OpaqueWhiteout:
+			opaque = true
+		case strings.HasPrefix(e.FileName, WhiteoutPrefix):
+			whiteouts[e.FileName[len(WhiteoutPrefix):]] = true
+		default:
+			entries[e.FileName] = e
+		}
+	}
+
+	return entries, whiteouts, opaque, nil
+}
+
+// Open opens path for reading, from the tree it is in
+func (o *Overlay) Open(path string) (*File, error) {
+	p, err := o.clean("open", path)
+	if err != nil {
+		return nil, err
+	}
+
+	_, l, err := o.stat("open", p)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.Target.Open(_path.Join(l.Path, p))
+}
+
+// OpenFile opens path for writing, copying it up first, or creates it in the
+// upper tree
+func (o *Overlay) OpenFile(path string, perm os.FileMode) (*File, error) {
+	p, err := o.clean("open", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = o.prepare(p); err != nil {
+		return nil, err
+	}
+
+	return o.Upper.Target.OpenFile(_path.Join(o.Upper.Path, p), perm)
+}
+
+// WriteFile creates or truncates path in the upper tree, and writes data to
+// it
+func (o *Overlay) WriteFile(path string, data []byte, perm os.FileMode) error {
+	p, err := o.clean("write", path)
+	if err != nil {
+		return err
+	}
+
+	if err = o.prepare(p); err != nil {
+		return err
+	}
+
+	m := Mutation{Op: OpCreate, Path: _path.Join(o.Upper.Path, p), Mode: perm, Data: data}
+	return m.Apply(o.Upper.Target)
+}
+
+// prepare gets p ready to be written as a file in the upper tree: copied up
+// if it is in the lower one, its whiteout removed if not
+func (o *Overlay) prepare(p string) error {
+	attr, l, err := o.stat("open", p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if attr != nil && attr.Type == NF3Dir {
+		return &os.PathError{Op: "open", Path: p, Err: NFS3Error(NFS3ErrIsDir)}
+	}
+
+	if attr != nil {
+		if l == o.Lower {
+			return o.copyUp(p)
+		}
+		return nil
+	}
+
+	if err = o.copyUpDir(_path.Dir(p)); err != nil {
+		return err
+	}
+	_, err = o.unwhiteout(p)
+
+	return err
+}
+
+// copyUpDir copies directory p of the view up, failing unless it is one
+func (o *Overlay) copyUpDir(p string) error {
+	attr, _, err := o.stat("copyup", p)
+	if err != nil {
+		return err
+	}
+	if attr.Type != NF3Dir {
+		return &os.PathError{Op: "copyup", Path: p, Err: NFS3Error(NFS3ErrNotDir)}
+	}
+
+	return o.copyUp(p)
+}
+
+// copyUp copies p, and the directories it is in, from the lower tree to the
+// upper one, unless they are there already.  p must be in the view.
+func (o *Overlay) copyUp(p string) error {
+	if p == "/" {
+		return nil
+	}
+
+	attr, err := statLayer(o.Upper, p)
+	if attr != nil || err != nil {
+		return err
+	}
+
+	if err = o.copyUp(_path.Dir(p)); err != nil {
+		return err
+	}
+
+	lattr, err := statLayer(o.Lower, p)
+	if err != nil {
+		return err
+	}
+	if lattr == nil {
+		return &os.PathError{Op: "copyup", Path: p, Err: os.ErrNotExist}
+	}
+
+	from, to := _path.Join(o.Lower.Path, p), _path.Join(o.Upper.Path, p)
+	switch lattr.Type {
+	case NF3Dir:
+		_, err = o.Upper.Target.Mkdir(to, lattr.Mode().Perm())
+	case NF3Lnk:
+		var link string
+		if link, err = o.Lower.Target.Readlink(from); err == nil {
+			_, err = o.Upper.Target.Symlink(link, to)
+		}
+	default:
+		err = copyFileData(o.Lower.Target, from, o.Upper.Target, to, lattr.Mode().Perm())
+	}
+
+	return err
+}
+
+// copyFileData copies file from of src to a new file to of dst
+func copyFileData(src *Target, from string, dst *Target, to string, perm os.FileMode) error {
+	r, err := src.Open(from)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if _, err = dst.CreateTruncate(to, perm, 0); err != nil {
+		return err
+	}
+	w, err := dst.OpenFile(to, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, r)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// whiteout hides p of the lower tree
+func (o *Overlay) whiteout(p string) error {
+	if err := o.copyUp(_path.Dir(p)); err != nil {
+		return err
+	}
+
+	_, err := o.Upper.Target.CreateTruncate(o.whiteoutPath(p), 0644, 0)
+	return err
+}
+
+// unwhiteout removes the whiteout of p, and reports whether there was one
+func (o *Overlay) unwhiteout(p string) (bool, error) {
+	err := o.Upper.Target.Remove(o.whiteoutPath(p))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (o *Overlay) whiteoutPath(p string) string {
+	return _path.Join(o.Upper.Path, _path.Dir(p), WhiteoutPrefix+_path.Base(p))
+}
+
+// Mkdir makes directory path in the upper tree.  A directory made where one
+// of the lower tree was removed is opaque, not to show what was in it.
+func (o *Overlay) Mkdir(path string, perm os.FileMode) error {
+	p, err := o.clean("mkdir", path)
+	if err != nil {
+		return err
+	}
+
+	if _, _, err = o.stat("mkdir", p); err == nil {
+		return &os.PathError{Op: "mkdir", Path: p, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err = o.copyUpDir(_path.Dir(p)); err != nil {
+		return err
+	}
+	whited, err := o.unwhiteout(p)
+	if err != nil {
+		return err
+	}
+
+	to := _path.Join(o.Upper.Path, p)
+	if _, err = o.Upper.Target.Mkdir(to, perm); err != nil {
+		return err
+	}
+	if whited {
+		_, err = o.Upper.Target.CreateTruncate(_path.Join(to, OpaqueWhiteout), 0644, 0)
+	}
+
+	return err
+}
+
+// Symlink makes symlink path pointing to target in the upper tree
+func (o *Overlay) Symlink(target, path string) error {
+	p, err := o.clean("symlink", path)
+	if err != nil {
+		return err
+	}
+
+	if _, _, err = o.stat("symlink", p); err == nil {
+		return &os.PathError{Op: "symlink", Path: p, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err = o.copyUpDir(_path.Dir(p)); err != nil {
+		return err
+	}
+	if _, err = o.unwhiteout(p); err != nil {
+		return err
+	}
+
+	_, err = o.Upper.Target.Symlink(target, _path.Join(o.Upper.Path, p))
+	return err
+}
+
+// Remove removes file path from the view
+func (o *Overlay) Remove(path string) error {
+	return o.remove("remove", path, false)
+}
+
+// RmDir removes empty directory path from the view
+func (o *Overlay) RmDir(path string) error {
+	return o.remove("rmdir", path, true)
+}
+
+func (o *Overlay) remove(op, path string, dir bool) error {
+	p, err := o.clean(op, path)
+	if err != nil {
+		return err
+	}
+	if p == "/" {
+		return &os.PathError{Op: op, Path: p, Err: os.ErrInvalid}
+	}
+
+	attr, l, err := o.stat(op, p)
+	if err != nil {
+		return err
+	}
+	switch {
+	case dir && attr.Type != NF3Dir:
+		return &os.PathError{Op: op, Path: p, Err: NFS3Error(NFS3ErrNotDir)}
+	case !dir && attr.Type == NF3Dir:
+		return &os.PathError{Op: op, Path: p, Err: NFS3Error(NFS3ErrIsDir)}
+	}
+
+	if dir {
+		entries, err := o.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return &os.PathError{Op: op, Path: p, Err: NFS3Error(NFS3ErrNotEmpty)}
+		}
+	}
+
+	if l == o.Upper {
+		// a directory may hold whiteouts
+		if err = o.Upper.Target.RemoveAll(_path.Join(o.Upper.Path, p)); IsNotDirError(err) {
+			err = o.Upper.Target.Remove(_path.Join(o.Upper.Path, p))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	lattr, err := o.lower(p)
+	if lattr == nil || err != nil {
+		return err
+	}
+
+	return o.whiteout(p)
+}
+
+// Rename renames from to to in the upper tree, copying from up first.  As
+// with overlayfs, directories of the lower tree cannot be renamed, and fail
+// with NFS3ERR_XDEV.
+func (o *Overlay) Rename(from, to string) error {
+	pf, err := o.clean("rename", from)
+	if err != nil {
+		return err
+	}
+	pt, err := o.clean("rename", to)
+	if err != nil {
+		return err
+	}
+
+	attr, _, err := o.stat("rename", pf)
+	if err != nil {
+		return err
+	}
+	lattr, err := o.lower(pf)
+	if err != nil {
+		return err
+	}
+	if attr.Type == NF3Dir && lattr != nil {
+		return &os.PathError{Op: "rename", Path: pf, Err: NFS3Error(NFS3ErrXDev)}
+	}
+
+	tattr, tl, err := o.stat("rename", pt)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if tattr != nil && tattr.Type == NF3Dir && tl == o.Lower {
+		return &os.PathError{Op: "rename", Path: pt, Err: NFS3Error(NFS3ErrXDev)}
+	}
+
+	if err = o.copyUp(pf); err != nil {
+		return err
+	}
+	if err = o.copyUpDir(_path.Dir(pt)); err != nil {
+		return err
+	}
+	if _, err = o.unwhiteout(pt); err != nil {
+		return err
+	}
+
+	if err = o.Upper.Target.Rename(_path.Join(o.Upper.Path, pf), _path.Join(o.Upper.Path, pt)); err != nil {
+		return err
+	}
+
+	if lattr == nil {
+		return nil
+	}
+
+	return o.whiteout(pf)
+}
+
+// Changes returns the mutations that make the lower tree look as the view
+// does, in order: what is whited out is removed, then what is in the upper
+// tree is made, files being written whole.
+func (o *Overlay) Changes() ([]Mutation, error) {
+	var muts []Mutation
+	if err := o.changes("/", &muts); err != nil {
+		return nil, err
+	}
+
+	return muts, nil
+}
+
+func (o *Overlay) changes(dir string, muts *[]Mutation) error {
+	entries, whiteouts, opaque, err := o.readDir(dir)
+	if err != nil {
+		return err
+	}
+
+	// what the lower tree has here, to be removed
+	var lower map[string]*EntryPlus
+	if lattr, err := o.lower(dir); err != nil {
+		return err
+	} else if lattr != nil && lattr.Type == NF3Dir {
+		if lower, err = o.lowerEntries(dir); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(lower))
+	for name := range lower {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		e := entries[name]
+		if opaque || whiteouts[name] || (e != nil && (e.IsDir() != lower[name].IsDir() || !e.IsDir())) {
+			if err = o.removals(_path.Join(dir, name), lower[name], muts); err != nil {
+				return err
+			}
+		}
+	}
+
+	names = names[:0]
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p, e := _path.Join(dir, name), entries[name]
+		attr := e.Attr.attr()
+		if attr == nil {
+			if attr, err = statLayer(o.Upper, p); err != nil {
+				return err
+			}
+		}
+
+		switch attr.Type {
+		case NF3Dir:
+			*muts = append(*muts, Mutation{Op: OpMkdir, Path: p, Mode: attr.Mode().Perm()})
+			if err = o.changes(p, muts); err != nil {
+				return err
+			}
+		case NF3Lnk:
+			link, err := o.Upper.Target.Readlink(_path.Join(o.Upper.Path, p))
+			if err != nil {
+				return err
+			}
+			*muts = append(*muts, Mutation{Op: OpSymlink, Path: p, To: link})
+		default:
+			f, err := o.Upper.Target.Open(_path.Join(o.Upper.Path, p))
+			if err != nil {
+				return err
+			}
+			data, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			*muts = append(*muts, Mutation{Op: OpCreate, Path: p, Mode: attr.Mode().Perm(), Data: data})
+		}
+	}
+
+	return nil
+}
+
+// lowerEntries lists directory p of the lower tree
+func (o *Overlay) lowerEntries(p string) (map[string]*EntryPlus, error) {
+	list, err := o.Lower.Target.ReadDirPlus(_path.Join(o.Lower.Path, p))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]*EntryPlus, len(list))
+	for _, e := range list {
+		if e.FileName != "." && e.FileName != ".." {
+			entries[e.FileName] = e
+		}
+	}
+
+	return entries, nil
+}
+
+// removals appends the mutations removing p of the lower tree, and what is
+// in it
+func (o *Overlay) removals(p string, e *EntryPlus, muts *[]Mutation) error {
+	if !e.IsDir() {
+		*muts = append(*muts, Mutation{Op: OpRemove, Path: p})
+		return nil
+	}
+
+	entries, err := o.lowerEntries(p)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err = o.removals(_path.Join(p, name), entries[name], muts); err != nil {
+			return err
+		}
+	}
+	*muts = append(*muts, Mutation{Op: OpRmDir, Path: p})
+
+	return nil
+}
+
+// Commit applies the changes staged in the view to dst, a copy of the lower
+// tree
+func (o *Overlay) Commit(dst *TreeRef) error {
+	muts, err := o.Changes()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range muts {
+		m.Path = _path.Join(dst.Path, m.Path)
+		if err = m.Apply(dst.Target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
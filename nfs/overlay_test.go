@@ -0,0 +1,104 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func overlayNames(t *testing.T, o *Overlay, path string) []string {
+	t.Helper()
+
+	entries, err := o.ReadDir(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	return names
+}
+
+func TestOverlay(t *testing.T) {
+	lower, upper := loopbackTarget(t), loopbackTarget(t)
+
+	for _, dir := range []string{"/etc", "/var", "/var/log"} {
+		if _, err := lower.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, lower, "/etc/hosts", "127.0.0.1 localhost")
+	writeFile(t, lower, "/etc/motd", "hello")
+	writeFile(t, lower, "/var/log/old", "old")
+
+	o := NewOverlay(&TreeRef{Target: upper, Path: "/"}, &TreeRef{Target: lower, Path: "/"})
+
+	if err := o.WriteFile("/etc/motd", []byte("staged"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Remove("/etc/hosts"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.RmDir("/var/log"); err == nil {
+		t.Fatal("removed a directory that is not empty")
+	}
+	if err := o.Remove("/var/log/old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.RmDir("/var/log"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Mkdir("/var/log", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.WriteFile("/var/log/new", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Rename("/etc/motd", "/etc/issue"); err != nil {
+		t.Fatal(err)
+	}
+	var nfsErr *Error
+	if err := o.Rename("/var", "/usr"); !errors.As(err, &nfsErr) || nfsErr.ErrorNum != NFS3ErrXDev {
+		t.Fatalf("rename of a lower directory: %v", err)
+	}
+
+	if names := overlayNames(t, o, "/etc"); !reflect.DeepEqual(names, []string{"issue"}) {
+		t.Fatalf("/etc: %v", names)
+	}
+	if names := overlayNames(t, o, "/var/log"); !reflect.DeepEqual(names, []string{"new"}) {
+		t.Fatalf("/var/log: %v", names)
+	}
+	if _, err := o.Stat("/etc/hosts"); !os.IsNotExist(err) {
+		t.Fatalf("stat of a removed file: %v", err)
+	}
+	if _, err := o.Stat("/etc/.wh.hosts"); err == nil {
+		t.Fatal("whiteout seen in the view")
+	}
+	if got := readAll(t, lower, "/etc/motd"); got != "hello" {
+		t.Fatalf("lower tree written: %q", got)
+	}
+
+	if err := o.Commit(&TreeRef{Target: lower, Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := lower.Lookup("/etc/hosts"); !os.IsNotExist(err) {
+		t.Fatalf("committed /etc/hosts: %v", err)
+	}
+	if _, _, err := lower.Lookup("/var/log/old"); !os.IsNotExist(err) {
+		t.Fatalf("committed /var/log/old: %v", err)
+	}
+	if got := readAll(t, lower, "/etc/issue"); got != "staged" {
+		t.Fatalf("committed /etc/issue: %q", got)
+	}
+	if got := readAll(t, lower, "/var/log/new"); got != "new" {
+		t.Fatalf("committed /var/log/new: %q", got)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	_path "path"
+	"sort"
+	"time"
+)
+
+// PackIndex is the name of the index in a pack directory
+const PackIndex = "index"
+
+// PackOptions have UploadTree pack small files into blobs, one WRITE for many
+// files rather than a CREATE, WRITE and SETATTR each.  The blobs and their
+// index go to directory Dir of the destination tree, and files are read back
+// with OpenPack.  An upload replaces the pack left by the previous one.
+type PackOptions struct {
+	// Below is the size files are packed under
+	Below int64
+
+	// BlobSize is the size blobs are kept under, 64MB by default
+	BlobSize int64
+
+	// Dir is the directory of the pack within the destination tree,
+	// ".pack" by default
+	Dir string
+}
+
+// PackEntry locates a packed file in its blob
+type PackEntry struct {
+	Path   string      `json:"path"`
+	Blob   string      `json:"blob"`
+	Offset uint64      `json:"offset"`
+	Size   uint64      `json:"size"`
+	Mode   os.FileMode `json:"mode"`
+	Mtime  time.Time   `json:"mtime"`
+}
+
+// packer writes the blobs of a pack, and its index once done
+type packer struct {
+	v    *Target
+	opts PackOptions
+	dir  []byte
+
+	blob   *File
+	blobs  int
+	offset uint64
+	index  []PackEntry
+}
+
+func newPacker(v *Target, root string, opts PackOptions) (*packer, error) {
+	if opts.BlobSize <= 0 {
+		opts.BlobSize = 64 << 20
+	}
+	if opts.Dir == "" {
+		opts.Dir = ".pack"
+	}
+
+	dir := _path.Join(root, opts.Dir)
+	fh, err := v.Mkdir(dir, 0755)
+	if errors.Is(err, os.ErrExist) {
+		_, fh, err = v.Lookup(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &packer{v: v, opts: opts, dir: fh}, nil
+}
+
+// add appends local file local, at path in the tree, to the current blob, or
+// to a new one if it would outgrow it
+func (p *packer) add(local, path string, fi os.FileInfo) error {
+	data, err := os.ReadFile(local)
+	if err != nil {
+		return err
+	}
+
+	if p.blob == nil || int64(p.offset)+int64(len(data)) > p.opts.BlobSize {
+		if err = p.next(); err != nil {
+			return err
+		}
+	}
+
+	if _, err = p.blob.Write(data); err != nil {
+		return err
+	}
+	p.index = append(p.index, PackEntry{
+		Path:   path,
+		Blob:   blobName(p.blobs),
+		Offset: p.offset,
+		Size:   uint64(len(data)),
+		Mode:   fi.Mode().Perm(),
+		Mtime:  fi.ModTime().UTC(),
+	})
+	p.offset += uint64(len(data))
+
+	return nil
+}
+
+func blobName(n int) string {
+	return fmt.Sprintf("blob-%06d", n)
+}
+
+// next closes the current blob and starts another
+func (p *packer) next() error {
+	if p.blob != nil {
+		if err := p.blob.Close(); err != nil {
+			return err
+		}
+	}
+
+	p.blobs++
+	fh, err := p.v.CreateByFh(p.dir, blobName(p.blobs), 0644)
+	if err == nil {
+		err = p.v.SetAttrByFh(fh, Sattr3{Size: SetSize{SetIt: true}})
+	}
+	if err != nil {
+		return err
+	}
+	if p.blob, err = p.v.OpenByFh(fh, nil); err != nil {
+		return err
+	}
+	p.offset = 0
+
+	return nil
+}
+
+// close closes the last blob and writes the index, one JSON entry a line
+func (p *packer) close() error {
+	if p.blob != nil {
+		if err := p.blob.Close(); err != nil {
+			return err
+		}
+	}
+
+	fh, err := p.v.CreateByFh(p.dir, PackIndex, 0644)
+	if err == nil {
+		err = p.v.SetAttrByFh(fh, Sattr3{Size: SetSize{SetIt: true}})
+	}
+	if err != nil {
+		return err
+	}
+	f, err := p.v.OpenByFh(fh, nil)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for i := range p.index {
+		if err = enc.Encode(&p.index[i]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// PackReader reads the files of a pack written by UploadTree.  It is not safe
+// for concurrent use.
+type PackReader struct {
+	v       *Target
+	dir     string
+	entries map[string]*PackEntry
+	blobs   map[string][]byte
+}
+
+// OpenPack reads the index of the pack in directory dir of v
+func OpenPack(v *Target, dir string) (*PackReader, error) {
+	f, err := v.Open(_path.Join(dir, PackIndex))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := &PackReader{v: v, dir: dir, entries: make(map[string]*PackEntry), blobs: make(map[string][]byte)}
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		e := new(PackEntry)
+		if err = dec.Decode(e); err != nil {
+			return nil, fmt.Errorf("pack %s: %w", dir, err)
+		}
+		r.entries[e.Path] = e
+	}
+
+	return r, nil
+}
+
+// Files returns the entries of the pack, sorted by path
+func (r *PackReader) Files() []PackEntry {
+	files := make([]PackEntry, 0, len(r.entries))
+	for _, e := range r.entries {
+		files = append(files, *e)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	return files
+}
+
+// ReadFile returns the data of the file packed as path
+func (r *PackReader) ReadFile(path string) ([]byte, error) {
+	e, ok := r.entries[path]
+	if !ok {
+		return nil, fmt.Errorf("pack %s: %s: %w", r.dir, path, os.ErrNotExist)
+	}
+
+	fh, ok := r.blobs[e.Blob]
+	if !ok {
+		var err error
+		if _, fh, err = r.v.Lookup(_path.Join(r.dir, e.Blob)); err != nil {
+			return nil, err
+		}
+		r.blobs[e.Blob] = fh
+	}
+
+	f, err := r.v.OpenByFh(fh, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data := make([]byte, e.Size)
+	n, err := f.readFull(data, e.Offset)
+	if err == nil && n < len(data) {
+		err = fmt.Errorf("pack %s: %s: blob %s cut short", r.dir, path, e.Blob)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
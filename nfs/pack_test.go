@@ -0,0 +1,71 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUploadPack(t *testing.T) {
+	local := t.TempDir()
+	if err := os.Mkdir(filepath.Join(local, "sub"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		path := filepath.Join(local, "sub", fmt.Sprintf("tiny%d", i))
+		if err := os.WriteFile(path, []byte(fmt.Sprintf("file %d", i)), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(local, "big"), []byte(strings.Repeat("x", 200)), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	v := loopbackTarget(t)
+	defer v.Close()
+
+	res, err := UploadTree(local, &TreeRef{v, "/"}, UploadOptions{Pack: &PackOptions{Below: 100, BlobSize: 20}})
+	if err != nil {
+		t.Fatalf("upload: %s", err)
+	}
+	if res.Files != 1 || res.Packed != 10 || res.PackedBytes != 60 {
+		t.Errorf("result: %+v", res)
+	}
+	if _, _, err = v.Lookup("/sub/tiny3"); !os.IsNotExist(err) {
+		t.Errorf("packed file uploaded: %v", err)
+	}
+	// three files a blob
+	if _, _, err = v.Lookup("/.pack/blob-000004"); err != nil {
+		t.Errorf("last blob: %s", err)
+	}
+	if _, _, err = v.Lookup("/.pack/blob-000005"); err == nil {
+		t.Errorf("blobs grew past their size")
+	}
+
+	r, err := OpenPack(v, "/.pack")
+	if err != nil {
+		t.Fatalf("open pack: %s", err)
+	}
+	files := r.Files()
+	if len(files) != 10 || files[3].Path != "sub/tiny3" || files[3].Mode != 0640 {
+		t.Fatalf("files: %+v", files)
+	}
+	for i, e := range files {
+		data, err := r.ReadFile(e.Path)
+		if err != nil {
+			t.Fatalf("read %s: %s", e.Path, err)
+		}
+		if want := fmt.Sprintf("file %d", i); string(data) != want {
+			t.Errorf("%s reads %q, want %q", e.Path, data, want)
+		}
+	}
+	if _, err = r.ReadFile("big"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("read of an unpacked file: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/util"
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+// PathConf is the result of PATHCONF, the POSIX limits of a filesystem
+type PathConf struct {
+	Attr            PostOpAttr
+	LinkMax         uint32
+	NameMax         uint32
+	NoTrunc         bool
+	ChownRestricted bool
+	CaseInsensitive bool
+	CasePreserving  bool
+}
+
+// NameTooLongError is returned, before any call, for a name longer than the
+// filesystem it is created on takes.  It wraps NFS3ERR_NAMETOOLONG, as the
+// server would have answered.
+type NameTooLongError struct {
+	Name    string
+	NameMax uint32
+}
+
+func (e *NameTooLongError) Error() string {
+	return fmt.Sprintf("%q: name of %d bytes, the filesystem takes %d", e.Name, len(e.Name), e.NameMax)
+}
+
+func (e *NameTooLongError) Unwrap() error {
+	return NFS3Error(NFS3ErrNameTooLong)
+}
+
+// IsNameTooLongError reports whether err is a NameTooLongError or an
+// NFS3ERR_NAMETOOLONG from the server
+func IsNameTooLongError(err error) bool {
+	var nfsErr *Error
+	return errors.As(err, &nfsErr) && nfsErr.ErrorNum == NFS3ErrNameTooLong
+}
+
+// PathConf returns the limits of the filesystem of path
+func (v *Target) PathConf(path string) (*PathConf, error) {
+	_, fh, err := v.Lookup(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.PathConfByFh(fh)
+}
+
+// PathConfByFh returns the limits of the filesystem of fh, as the server
+// answers them, and caches them under the fsid of fh
+func (v *Target) PathConfByFh(fh []byte) (*PathConf, error) {
+	type PathConf3Args struct {
+		rpc.Header
+		FH []byte
+	}
+
+	res, err := v.call(&PathConf3Args{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    Nfs3Prog,
+			Vers:    Nfs3Vers,
+			Proc:    NFSProc3PathConf,
+			Cred:    v.auth,
+			Verf:    rpc.AuthNull,
+		},
+		FH: fh,
+	})
+	if err != nil {
+		util.Debugf("pathconf(%x): %s", fh, err.Error())
+		return nil, err
+	}
+
+	pc := new(PathConf)
+	if err = xdr.Read(res, pc); err != nil {
+		return nil, err
+	}
+
+	if pc.Attr.IsSet {
+		v.cache.putAttr(fh, &pc.Attr.Attr)
+		v.pathConfMu.Lock()
+		if v.pathConfs == nil {
+			v.pathConfs = make(map[uint64]*PathConf)
+		}
+		v.pathConfs[pc.Attr.Attr.FSID] = pc
+		v.pathConfMu.Unlock()
+	}
+
+	return pc, nil
+}
+
+// pathConf returns the cached limits of the filesystem of directory fh.
+// Without the attributes of fh in the attribute cache, those of the root are
+// used: a submount of smaller limits then has the server fail the call.  A
+// server without PATHCONF gets limits of zero, which check nothing.
+func (v *Target) pathConf(fh []byte) *PathConf {
+	fsid := v.rootFSID
+	if attr, ok := v.cache.getAttr(fh); ok {
+		fsid = attr.FSID
+	} else {
+		fh = v.root()
+	}
+
+	v.pathConfMu.Lock()
+	pc, ok := v.pathConfs[fsid]
+	v.pathConfMu.Unlock()
+	if ok {
+		return pc
+	}
+
+	pc, err := v.PathConfByFh(fh)
+	if err != nil {
+		util.Debugf("pathconf(%x): %s, names go unchecked", fh, err)
+		pc = &PathConf{}
+	}
+	if !pc.Attr.IsSet || pc.Attr.Attr.FSID != fsid {
+		v.pathConfMu.Lock()
+		if v.pathConfs == nil {
+			v.pathConfs = make(map[uint64]*PathConf)
+		}
+		v.pathConfs[fsid] = pc
+		v.pathConfMu.Unlock()
+	}
+
+	return pc
+}
+
+// checkName fails with a NameTooLongError if name is too long to be created
+// in directory fh
+func (v *Target) checkName(fh []byte, name string) error {
+	// no filesystem takes less than the 14 bytes of POSIX
+	if len(name) <= 14 {
+		return nil
+	}
+
+	if max := v.pathConf(fh).NameMax; max > 0 && uint64(len(name)) > uint64(max) {
+		return &NameTooLongError{Name: name, NameMax: max}
+	}
+
+	return nil
+}
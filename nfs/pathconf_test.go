@@ -0,0 +1,93 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+// pathConfServer answers PATHCONF with pc, and counts the calls
+type pathConfServer struct {
+	*Server
+	pc PathConf
+
+	sync.Mutex
+	calls map[uint32]int
+}
+
+func newPathConfServer(pc PathConf) *pathConfServer {
+	ns := &pathConfServer{Server: NewServer(NewMemFS()), pc: pc, calls: make(map[uint32]int)}
+	ns.Register(Nfs3Prog, Nfs3Vers, func(call *rpc.ServerCall, w io.Writer) error {
+		ns.Lock()
+		ns.calls[call.Proc]++
+		ns.Unlock()
+
+		if call.Proc != NFSProc3PathConf {
+			return ns.serveNFS(call, w)
+		}
+
+		fh, err := readHandle(call.Args)
+		if err != nil {
+			return err
+		}
+		pc := ns.pc
+		pc.Attr = ns.postOpAttr(fh)
+		return xdr.Write(w, struct {
+			Status uint32
+			PathConf
+		}{NFS3Ok, pc})
+	})
+
+	return ns
+}
+
+func (ns *pathConfServer) count(proc uint32) int {
+	ns.Lock()
+	defer ns.Unlock()
+
+	return ns.calls[proc]
+}
+
+func TestNameMax(t *testing.T) {
+	ns := newPathConfServer(PathConf{NameMax: 20, NoTrunc: true, CasePreserving: true})
+	v, err := DialLoopback(ns.Server).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	pc, err := v.PathConf("/")
+	if err != nil || pc.NameMax != 20 {
+		t.Fatalf("pathconf: %+v, %v", pc, err)
+	}
+
+	long := strings.Repeat("n", 21)
+	if _, err = v.Create("/"+long, 0644); !IsNameTooLongError(err) {
+		t.Errorf("create: got %v, want NAMETOOLONG", err)
+	}
+	var nameErr *NameTooLongError
+	if _, err = v.Mkdir("/"+long, 0755); !errors.As(err, &nameErr) || nameErr.Name != long || nameErr.NameMax != 20 {
+		t.Errorf("mkdir: got %v, want the long name", err)
+	}
+	if _, err = v.Create("/"+long[:20], 0644); err != nil {
+		t.Errorf("create of 20 bytes: %s", err)
+	}
+	if err = v.Rename("/"+long[:20], "/"+long); !IsNameTooLongError(err) {
+		t.Errorf("rename: got %v, want NAMETOOLONG", err)
+	}
+
+	if n := ns.count(NFSProc3Mkdir) + ns.count(NFSProc3Rename); n != 0 {
+		t.Errorf("%d MKDIR and RENAME calls reached the server", n)
+	}
+	if n := ns.count(NFSProc3PathConf); n != 1 {
+		t.Errorf("%d PATHCONF calls, want the one cached", n)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Default limits of the walks of paths, see SetPathLimits: half PATH_MAX, the
+// most components a path of it can have, and MAXSYMLINKS of Linux
+const (
+	DefaultMaxPathComponents = 2048
+	DefaultMaxSymlinks       = 40
+)
+
+var (
+	// ErrPathTooDeep is returned, wrapped in a *PathLimitError, for paths of
+	// more components than the target walks
+	ErrPathTooDeep = errors.New("nfs: too many path components")
+
+	// ErrSymlinkLoop is ELOOP: more symlinks to chase resolving a path than
+	// the target follows, or one resolving to itself
+	ErrSymlinkLoop = errors.New("nfs: too many levels of symbolic links")
+)
+
+// PathLimitError is returned by the lookups of paths that run past a limit
+// of the target, before more calls are sent.  It wraps ErrPathTooDeep or
+// ErrSymlinkLoop.
+type PathLimitError struct {
+	Path  string
+	Limit int
+	Err   error
+}
+
+func (e *PathLimitError) Error() string {
+	return fmt.Sprintf("%s: %s, limit %d", e.Path, e.Err, e.Limit)
+}
+
+func (e *PathLimitError) Unwrap() error {
+	return e.Err
+}
+
+// SetPathLimits bounds the walks of paths to components components, and to
+// symlinks symlinks chased, protecting services from pathological paths or
+// symlink mazes of hostile exports: a path of 10,000 components is 10,000
+// LOOKUPs otherwise.  Zero keeps the default, DefaultMaxPathComponents and
+// DefaultMaxSymlinks.
+func (v *Target) SetPathLimits(components, symlinks int) {
+	v.maxComponents, v.maxSymlinks = components, symlinks
+}
+
+func (v *Target) pathLimits() (int, int) {
+	components, symlinks := v.maxComponents, v.maxSymlinks
+	if components <= 0 {
+		components = DefaultMaxPathComponents
+	}
+	if symlinks <= 0 {
+		symlinks = DefaultMaxSymlinks
+	}
+	return components, symlinks
+}
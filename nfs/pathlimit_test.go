@@ -0,0 +1,62 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+func TestPathLimits(t *testing.T) {
+	v, err := DialLoopback(NewServer(NewMemFS())).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	if _, err = v.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, v, "/dir/file", "data")
+	for link, target := range map[string]string{"/c1": "c2", "/c2": "/c3", "/c3": "dir", "/l1": "/l2", "/l2": "l1"} {
+		if _, err = v.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var perr *PathLimitError
+	if _, _, err = v.Lookup("/l1/file"); !errors.Is(err, ErrSymlinkLoop) || !errors.As(err, &perr) || perr.Limit != DefaultMaxSymlinks {
+		t.Errorf("symlink loop: %v", err)
+	}
+	if fi, fh, err := v.Lookup("/c1/file"); err != nil {
+		t.Errorf("chain of symlinks: %v", err)
+	} else if _, fileFh, _ := v.Lookup("/dir/file"); !sameHandle(fh, fileFh) || fi.Size() != 4 {
+		t.Error("chain of symlinks resolved elsewhere")
+	}
+
+	// Lookup follows the last component, Lstat does not
+	if fi, _, err := v.Lookup("/c1"); err != nil || !fi.IsDir() {
+		t.Errorf("lookup /c1: %v, %v", fi, err)
+	}
+	if fi, _, err := v.Lstat("/c1"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("lstat /c1: %v, %v", fi, err)
+	}
+	if target, err := v.Readlink("/c1"); err != nil || target != "c2" {
+		t.Errorf("readlink /c1: %q, %v", target, err)
+	}
+
+	v.SetPathLimits(3, 2)
+	if _, _, err = v.Lookup("/c1/file"); !errors.Is(err, ErrSymlinkLoop) {
+		t.Errorf("chain of symlinks past the limit: %v", err)
+	}
+	if _, _, err = v.Lookup(strings.Repeat("/d", 4)); !errors.Is(err, ErrPathTooDeep) {
+		t.Errorf("path past the limit: %v", err)
+	}
+	if _, _, err = v.Lookup("/./dir/file/"); err != nil {
+		t.Errorf("path within the limit: %v", err)
+	}
+}
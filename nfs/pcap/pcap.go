@@ -0,0 +1,490 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+// Package pcap turns a packet capture of ONC RPC traffic, NFSv3 and its
+// side protocols, into the exchanges of a recording, so that a session
+// captured at a site can be replayed with rpc.NewReplayTransport as a test,
+// without the filer it ran against.
+//
+//	capture, err := pcap.Read(f)
+//	rpc.WriteRecording(golden, capture.Exchanges)
+//
+// Captures are read in the libpcap format, as tcpdump -w writes them; pcapng
+// files are to be converted first, with editcap -F pcap.  TCP streams are
+// reassembled, also when the capture starts after the handshake; UDP
+// datagrams are a message each, IP fragments are not reassembled.
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// Options filter the exchanges of a capture
+type Options struct {
+	// Progs are the RPC programs kept, all of them if empty
+	Progs []uint32
+}
+
+// Capture is what was read of a capture
+type Capture struct {
+	// Exchanges are the calls answered in the capture and their replies, in
+	// the order the replies were captured
+	Exchanges []rpc.Exchange `json:"-"`
+
+	Packets int `json:"packets"`
+
+	// Skipped are the packets of neither TCP nor UDP over IP, and IP
+	// fragments
+	Skipped int `json:"skipped"`
+
+	// Unanswered are the calls kept with no reply in the capture
+	Unanswered int `json:"unanswered"`
+
+	// Gaps are the times data of a TCP stream was missing, truncated by the
+	// snap length or dropped by the capture, and messages were lost
+	Gaps int `json:"gaps"`
+}
+
+// pcap magic numbers, of microsecond and nanosecond timestamps, and of pcapng
+const (
+	magicMicro = 0xa1b2c3d4
+	magicNano  = 0xa1b23c4d
+	magicNG    = 0x0a0d0d0a
+)
+
+// link types, of the global header
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLoop     = 108
+	linkSLL      = 113
+	linkIPv4     = 228
+	linkIPv6     = 229
+	linkSLL2     = 276
+)
+
+// maxFragment is the largest record fragment taken for one, larger ones
+// tell that the stream is not at a record mark
+const maxFragment = 1 << 26
+
+// maxRecord is the largest record reassembled from fragments, one growing
+// past it is dropped and the stream realigned, lest a capture exhaust memory
+const maxRecord = 1 << 26
+
+// Read reads the exchanges of all programs in a capture
+func Read(r io.Reader) (*Capture, error) {
+	return ReadWithOptions(r, Options{})
+}
+
+// ReadWithOptions reads the exchanges of a capture kept by opts
+func ReadWithOptions(r io.Reader, opts Options) (*Capture, error) {
+	br := bufio.NewReader(r)
+
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, fmt.Errorf("pcap: header: %w", err)
+	}
+
+	var order binary.ByteOrder
+	switch {
+	case binary.LittleEndian.Uint32(hdr) == magicMicro || binary.LittleEndian.Uint32(hdr) == magicNano:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr) == magicMicro || binary.BigEndian.Uint32(hdr) == magicNano:
+		order = binary.BigEndian
+	case binary.BigEndian.Uint32(hdr) == magicNG:
+		return nil, errors.New("pcap: pcapng capture, convert it with editcap -F pcap")
+	default:
+		return nil, errors.New("pcap: not a capture")
+	}
+	link := order.Uint32(hdr[20:]) & 0x0fffffff
+
+	c := &converter{
+		opts:    opts,
+		capture: new(Capture),
+		streams: make(map[string]*stream),
+		calls:   make(map[string][]byte),
+	}
+
+	rec := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(br, rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("pcap: packet %d: %w", c.capture.Packets+1, err)
+		}
+
+		incl, orig := order.Uint32(rec[8:]), order.Uint32(rec[12:])
+		if incl > maxFragment {
+			return nil, fmt.Errorf("pcap: packet %d: length %d", c.capture.Packets+1, incl)
+		}
+		data := make([]byte, incl)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, fmt.Errorf("pcap: packet %d: %w", c.capture.Packets+1, err)
+		}
+
+		c.capture.Packets++
+		c.packet(link, data, orig > incl, order)
+	}
+
+	c.capture.Unanswered = len(c.calls)
+	for _, s := range c.streams {
+		c.capture.Gaps += s.gaps
+	}
+	return c.capture, nil
+}
+
+type converter struct {
+	opts    Options
+	capture *Capture
+
+	// streams are the TCP streams by flow
+	streams map[string]*stream
+
+	// calls are the calls waiting for their reply, by flow and xid
+	calls map[string][]byte
+}
+
+// flow names the direction of a conversation
+func flow(src, dst net.IP, sport, dport uint16) string {
+	return net.JoinHostPort(src.String(), strconv.Itoa(int(sport))) + ">" +
+		net.JoinHostPort(dst.String(), strconv.Itoa(int(dport)))
+}
+
+// packet handles a captured frame of link, truncated if the snap length cut
+// it short
+func (c *converter) packet(link uint32, data []byte, truncated bool, order binary.ByteOrder) {
+	var ipv int
+	switch link {
+	case linkNull, linkLoop:
+		// the address family, in the byte order of the capturing host
+		if len(data) < 4 {
+			break
+		}
+		family := order.Uint32(data)
+		if link == linkLoop {
+			family = binary.BigEndian.Uint32(data)
+		}
+		switch family {
+		case 2:
+			ipv = 4
+		case 10, 24, 28, 30:
+			ipv = 6
+		}
+		data = data[4:]
+	case linkEthernet:
+		if len(data) < 14 {
+			break
+		}
+		etype, off := binary.BigEndian.Uint16(data[12:]), 14
+		for (etype == 0x8100 || etype == 0x88a8) && len(data) >= off+4 {
+			etype, off = binary.BigEndian.Uint16(data[off+2:]), off+4
+		}
+		ipv, data = etherIP(etype), data[off:]
+	case linkSLL:
+		if len(data) < 16 {
+			break
+		}
+		ipv, data = etherIP(binary.BigEndian.Uint16(data[14:])), data[16:]
+	case linkSLL2:
+		if len(data) < 20 {
+			break
+		}
+		ipv, data = etherIP(binary.BigEndian.Uint16(data)), data[20:]
+	case linkRaw, linkIPv4, linkIPv6:
+		if len(data) > 0 {
+			ipv = int(data[0] >> 4)
+		}
+	}
+
+	var src, dst net.IP
+	var proto uint8
+	var payload int
+	switch {
+	case ipv == 4 && len(data) >= 20 && data[0]>>4 == 4:
+		ihl := int(data[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(data[2:]))
+		if frag := binary.BigEndian.Uint16(data[6:]); frag&0x3fff != 0 || ihl < 20 || total < ihl {
+			// more fragments, or a fragment offset
+			c.capture.Skipped++
+			return
+		}
+		src, dst, proto, payload = net.IP(data[12:16]), net.IP(data[16:20]), data[9], total-ihl
+		if len(data) > total {
+			data = data[:total]
+		}
+		if len(data) < ihl {
+			c.capture.Skipped++
+			return
+		}
+		data = data[ihl:]
+	case ipv == 6 && len(data) >= 40 && data[0]>>4 == 6:
+		payload = int(binary.BigEndian.Uint16(data[4:]))
+		src, dst, proto = net.IP(data[8:24]), net.IP(data[24:40]), data[6]
+		if len(data) > 40+payload {
+			data = data[:40+payload]
+		}
+		data = data[40:]
+	default:
+		c.capture.Skipped++
+		return
+	}
+
+	switch {
+	case proto == 6 && len(data) >= 20:
+		off := int(data[12]>>4) * 4
+		if off < 20 || off > len(data) {
+			c.capture.Skipped++
+			return
+		}
+		sport, dport := binary.BigEndian.Uint16(data), binary.BigEndian.Uint16(data[2:])
+		seq, flags := binary.BigEndian.Uint32(data[4:]), data[13]
+		key := flow(src, dst, sport, dport)
+
+		s := c.streams[key]
+		if s == nil {
+			s = &stream{pending: make(map[uint32][]byte)}
+			c.streams[key] = s
+		}
+		// the length the segment had, before any truncation
+		length := payload - off
+		if !truncated {
+			length = len(data) - off
+		}
+		s.segment(seq, flags, data[off:], length, func(msg []byte) {
+			c.message(key, flow(dst, src, dport, sport), msg)
+		})
+		if flags&0x05 != 0 {
+			// FIN or RST
+			c.capture.Gaps += s.gaps
+			delete(c.streams, key)
+		}
+	case proto == 17 && len(data) >= 8:
+		if truncated {
+			c.capture.Gaps++
+			return
+		}
+		sport, dport := binary.BigEndian.Uint16(data), binary.BigEndian.Uint16(data[2:])
+		c.message(flow(src, dst, sport, dport), flow(dst, src, dport, sport), data[8:])
+	default:
+		c.capture.Skipped++
+	}
+}
+
+// etherIP returns the IP version of an ethertype, 0 for others
+func etherIP(etype uint16) int {
+	switch etype {
+	case 0x0800:
+		return 4
+	case 0x86dd:
+		return 6
+	}
+	return 0
+}
+
+// message handles an RPC message sent over key, the flow back being reverse
+func (c *converter) message(key, reverse string, msg []byte) {
+	if len(msg) < 8 {
+		return
+	}
+	xid := strconv.FormatUint(uint64(binary.BigEndian.Uint32(msg)), 16)
+
+	switch binary.BigEndian.Uint32(msg[4:]) {
+	case 0:
+		// xid, mtype, rpcvers, prog, vers, proc, and two empty auths
+		if len(msg) < 40 || binary.BigEndian.Uint32(msg[8:]) != 2 || !c.kept(binary.BigEndian.Uint32(msg[12:])) {
+			return
+		}
+		c.calls[key+" "+xid] = append([]byte(nil), msg...)
+	case 1:
+		call, ok := c.calls[reverse+" "+xid]
+		if !ok {
+			return
+		}
+		delete(c.calls, reverse+" "+xid)
+		c.capture.Exchanges = append(c.capture.Exchanges, rpc.Exchange{Call: call, Reply: append([]byte(nil), msg...)})
+	}
+}
+
+// kept tells whether the options keep calls to prog
+func (c *converter) kept(prog uint32) bool {
+	if len(c.opts.Progs) == 0 {
+		return true
+	}
+	for _, p := range c.opts.Progs {
+		if p == prog {
+			return true
+		}
+	}
+	return false
+}
+
+// maxPending is how many segments past a hole in a stream wait for it to be
+// filled, by a retransmission captured late, before the data of the hole is
+// taken for lost
+const maxPending = 256
+
+// stream reassembles the messages of a direction of a TCP connection
+type stream struct {
+	// synced is whether next is known, once a segment went by
+	synced bool
+	next   uint32
+
+	// pending are the segments past next, by sequence number
+	pending map[uint32][]byte
+
+	// aligned is whether buf starts at a record mark, it does not once
+	// data was lost or when the capture started mid stream
+	aligned bool
+	buf     []byte
+	record  []byte
+
+	gaps int
+}
+
+// before tells whether sequence number a comes before b, modulo 2^32
+func before(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// segment takes the data of a segment, length bytes long before the
+// capture truncated it to data, emitting the messages completed
+func (s *stream) segment(seq uint32, flags uint8, data []byte, length int, emit func([]byte)) {
+	if flags&0x02 != 0 {
+		// SYN
+		s.synced, s.aligned, s.next = true, true, seq+1
+		s.buf, s.record = nil, nil
+		return
+	}
+	if !s.synced {
+		s.synced, s.next = true, seq
+	}
+
+	if len(data) < length {
+		// what follows the data captured is lost
+		if seq == s.next {
+			s.append(data, emit)
+		}
+		s.lose(seq + uint32(length))
+		return
+	}
+
+	if before(seq, s.next) {
+		d := s.next - seq
+		if int(d) >= len(data) {
+			return
+		}
+		data, seq = data[d:], s.next
+	}
+	if seq != s.next {
+		if len(data) > len(s.pending[seq]) {
+			s.pending[seq] = append([]byte(nil), data...)
+		}
+		if len(s.pending) > maxPending {
+			first := seq
+			for p := range s.pending {
+				if before(p, first) {
+					first = p
+				}
+			}
+			s.lose(first)
+			s.drain(emit)
+		}
+		return
+	}
+
+	s.append(data, emit)
+	s.drain(emit)
+}
+
+// drain appends the pending segments next has reached
+func (s *stream) drain(emit func([]byte)) {
+	for progress := true; progress; {
+		progress = false
+		for seq, data := range s.pending {
+			if before(s.next, seq) {
+				continue
+			}
+			delete(s.pending, seq)
+			if d := s.next - seq; int(d) < len(data) {
+				s.append(data[d:], emit)
+				progress = true
+			}
+		}
+	}
+}
+
+// lose skips the data up to next, lost
+func (s *stream) lose(next uint32) {
+	util.Debugf("pcap: %d bytes of a stream lost", next-s.next)
+	s.next, s.aligned, s.buf, s.record = next, false, nil, nil
+	s.gaps++
+}
+
+// append adds data at next, and emits the messages it completes
+func (s *stream) append(data []byte, emit func([]byte)) {
+	s.next += uint32(len(data))
+	s.buf = append(s.buf, data...)
+
+	for {
+		if !s.aligned && !s.align() {
+			return
+		}
+		if len(s.buf) < 4 {
+			return
+		}
+		hdr := binary.BigEndian.Uint32(s.buf)
+		n := int(hdr & 0x7fffffff)
+		if n > maxFragment {
+			s.aligned, s.record = false, nil
+			continue
+		}
+		if len(s.buf) < 4+n {
+			return
+		}
+		if len(s.record)+n > maxRecord {
+			util.Debugf("pcap: record of more than %d bytes dropped", maxRecord)
+			s.aligned, s.record = false, nil
+			s.gaps++
+			continue
+		}
+		s.record = append(s.record, s.buf[4:4+n]...)
+		s.buf = s.buf[4+n:]
+		if hdr&0x80000000 != 0 {
+			emit(s.record)
+			s.record = nil
+		}
+	}
+}
+
+// align finds the first record mark in buf that looks like one of a whole
+// call or reply, dropping what comes before it
+func (s *stream) align() bool {
+	// the mark, xid, mtype, and rpcvers or reply_stat
+	const look = 16
+	for i := 0; i+look <= len(s.buf); i++ {
+		b := s.buf[i:]
+		hdr := binary.BigEndian.Uint32(b)
+		if hdr&0x80000000 == 0 || hdr&0x7fffffff < 12 || hdr&0x7fffffff > maxFragment {
+			continue
+		}
+		mtype, next := binary.BigEndian.Uint32(b[8:]), binary.BigEndian.Uint32(b[12:])
+		if (mtype == 0 && next == 2) || (mtype == 1 && next <= 1) {
+			s.buf, s.aligned = b, true
+			return true
+		}
+	}
+	if len(s.buf) > look {
+		s.buf = s.buf[len(s.buf)-look:]
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs"
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+// capture writes a pcap of Ethernet frames
+type capture struct {
+	bytes.Buffer
+}
+
+func newCapture() *capture {
+	c := new(capture)
+	binary.Write(c, binary.LittleEndian, []uint32{magicMicro, 2 | 4<<16, 0, 0, 65535, linkEthernet})
+	return c
+}
+
+func (c *capture) frame(proto uint8, src, dst byte, l4 []byte) {
+	ip := make([]byte, 20)
+	ip[0], ip[8], ip[9] = 0x45, 64, proto
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+len(l4)))
+	copy(ip[12:], []byte{10, 0, 0, src})
+	copy(ip[16:], []byte{10, 0, 0, dst})
+
+	frame := append(make([]byte, 12), 0x08, 0x00)
+	frame = append(append(frame, ip...), l4...)
+	binary.Write(c, binary.LittleEndian, []uint32{0, 0, uint32(len(frame)), uint32(len(frame))})
+	c.Write(frame)
+}
+
+func (c *capture) tcp(src, dst byte, seq uint32, data []byte) {
+	hdr := make([]byte, 20)
+	binary.BigEndian.PutUint16(hdr, 800+uint16(src))
+	binary.BigEndian.PutUint16(hdr[2:], 800+uint16(dst))
+	binary.BigEndian.PutUint32(hdr[4:], seq)
+	hdr[12], hdr[13] = 5<<4, 0x18
+	c.frame(6, src, dst, append(hdr, data...))
+}
+
+func (c *capture) udp(src, dst byte, data []byte) {
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint16(hdr, 800+uint16(src))
+	binary.BigEndian.PutUint16(hdr[2:], 800+uint16(dst))
+	binary.BigEndian.PutUint16(hdr[4:], uint16(8+len(data)))
+	c.frame(17, src, dst, append(hdr, data...))
+}
+
+// sender sends records of a direction in segments of 100 bytes, swapping
+// some and sending some twice, as captures show them
+type sender struct {
+	c        *capture
+	src, dst byte
+	seq      uint32
+	held     []byte
+	heldSeq  uint32
+	n        int
+}
+
+func (s *sender) record(msg []byte) {
+	b := make([]byte, 4, 4+len(msg))
+	binary.BigEndian.PutUint32(b, uint32(len(msg))|0x80000000)
+	b = append(b, msg...)
+	for len(b) > 0 {
+		n := 100
+		if n > len(b) {
+			n = len(b)
+		}
+		s.segment(b[:n])
+		b = b[n:]
+	}
+	s.flush()
+}
+
+func (s *sender) segment(data []byte) {
+	s.n++
+	switch {
+	case s.n%7 == 0 && s.held == nil:
+		s.held, s.heldSeq = append([]byte(nil), data...), s.seq
+	case s.n%5 == 0:
+		s.c.tcp(s.src, s.dst, s.seq, data)
+		s.c.tcp(s.src, s.dst, s.seq, data)
+	default:
+		s.c.tcp(s.src, s.dst, s.seq, data)
+	}
+	s.seq += uint32(len(data))
+}
+
+func (s *sender) flush() {
+	if s.held != nil {
+		s.c.tcp(s.src, s.dst, s.heldSeq, s.held)
+		s.held = nil
+	}
+}
+
+func TestRead(t *testing.T) {
+	s := nfs.NewServer(nfs.NewMemFS())
+	v0, err := nfs.DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	if _, err := v0.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	v0.Close()
+
+	var golden bytes.Buffer
+	cconn, sconn := net.Pipe()
+	go s.ServeConn(sconn)
+	rec := rpc.NewRecordingTransport(rpc.NewStreamTransport(cconn), &golden)
+	v, err := (&nfs.Mount{Client: rpc.NewClientTransport(rec)}).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	want, err := v.ReadDirPlus("/")
+	if err != nil {
+		t.Fatalf("readdirplus: %s", err)
+	}
+	v.Close()
+	ex, err := rpc.LoadRecording(&golden)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+
+	// the capture starts mid record, after the handshake
+	c := newCapture()
+	c.tcp(1, 2, 1000, []byte{0, 0, 0, 9, 1, 2, 3})
+	calls := &sender{c: c, src: 1, dst: 2, seq: 1007}
+	replies := &sender{c: c, src: 2, dst: 1, seq: 5000}
+	for _, e := range ex {
+		calls.record(e.Call)
+		replies.record(e.Reply)
+	}
+	// a call over UDP, answered, and one not
+	c.udp(1, 3, ex[0].Call)
+	c.udp(3, 1, ex[0].Reply)
+	c.udp(1, 3, ex[1].Call)
+
+	capture, err := Read(bytes.NewReader(c.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(capture.Exchanges[:len(ex)], ex) || len(capture.Exchanges) != len(ex)+1 {
+		t.Fatalf("%d exchanges, %d recorded", len(capture.Exchanges), len(ex))
+	}
+	if capture.Unanswered != 1 || capture.Gaps != 0 {
+		t.Errorf("capture %+v", capture)
+	}
+
+	mounts, err := ReadWithOptions(bytes.NewReader(c.Bytes()), Options{Progs: []uint32{nfs.MountProg}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(mounts.Exchanges); n == 0 || n >= len(ex) {
+		t.Errorf("%d exchanges of the MOUNT program, of %d", n, len(ex))
+	}
+
+	// replayed from the recording written
+	var out bytes.Buffer
+	if err = rpc.WriteRecording(&out, capture.Exchanges); err != nil {
+		t.Fatal(err)
+	}
+	if ex, err = rpc.LoadRecording(&out); err != nil {
+		t.Fatal(err)
+	}
+	v, err = (&nfs.Mount{Client: rpc.NewClientTransport(rpc.NewReplayTransport(ex))}).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("replayed mount: %s", err)
+	}
+	defer v.Close()
+	got, err := v.ReadDirPlus("/")
+	if err != nil {
+		t.Fatalf("replayed readdirplus: %s", err)
+	}
+	if len(got) != len(want) {
+		t.Errorf("replayed %d entries, recorded %d", len(got), len(want))
+	}
+
+	if _, err = Read(bytes.NewReader([]byte("not a capture at all..."))); err == nil {
+		t.Error("read of no capture")
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// ErrPoolClosed is returned by Get on a closed Pool
+var ErrPoolClosed = errors.New("nfs: pool closed")
+
+// DefaultPoolMaxIdle is how many idle targets a Pool keeps per key unless
+// told otherwise
+const DefaultPoolMaxIdle = 2
+
+// PoolOptions tune a Pool
+type PoolOptions struct {
+	// MaxIdle is how many idle targets are kept per server, export and
+	// credential, DefaultPoolMaxIdle if zero and none if negative
+	MaxIdle int
+
+	// IdleTimeout closes targets left idle for longer, and MaxLifetime
+	// those mounted longer ago, zero for no limit
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+
+	// HealthCheckAfter has a target idle for longer checked with a GETATTR
+	// of its root before it is handed out again, zero to always check
+	HealthCheckAfter time.Duration
+
+	// Scheduler, if set, schedules the calls of all targets of the pool,
+	// each server and export a tenant of its own
+	Scheduler *Scheduler
+
+	// Priv dials from privileged ports
+	Priv bool
+
+	// Dial mounts export of server as auth, DialMount and Mount if nil
+	Dial func(server, export string, auth rpc.Auth) (*Target, error)
+}
+
+// PoolStats counts what a Pool did
+type PoolStats struct {
+	Open      int    // targets mounted now, idle or in use
+	Idle      int    // targets idle now
+	Dialed    uint64 // targets mounted over the life of the pool
+	Reused    uint64 // Gets served by an idle target
+	Closed    uint64 // targets closed, expired, unhealthy or in excess
+	Unhealthy uint64 // idle targets that failed their health check
+}
+
+// Pool keeps mounted targets for reuse, keyed by server, export and
+// credential, for services that talk to the filers of many customers.
+// Targets are mounted on first use, handed out by Get to one user at a time
+// and handed back with Put, as database/sql does with connections.
+type Pool struct {
+	opts PoolOptions
+
+	sync.Mutex
+	idle   map[string][]*pooledTarget
+	inUse  map[*Target]*pooledTarget
+	stats  PoolStats
+	closed bool
+}
+
+type pooledTarget struct {
+	*Target
+	key      string
+	created  time.Time
+	returned time.Time
+}
+
+// NewPool returns an empty pool
+func NewPool(opts PoolOptions) *Pool {
+	if opts.MaxIdle == 0 {
+		opts.MaxIdle = DefaultPoolMaxIdle
+	}
+
+	return &Pool{
+		opts:  opts,
+		idle:  make(map[string][]*pooledTarget),
+		inUse: make(map[*Target]*pooledTarget),
+	}
+}
+
+func poolKey(server, export string, auth rpc.Auth) string {
+	return fmt.Sprintf("%s\x00%s\x00%d:%x", server, export, auth.Flavor, auth.Body)
+}
+
+// expired reports whether pt is past its lifetime or idle timeout
+func (p *Pool) expired(pt *pooledTarget, now time.Time) bool {
+	if p.opts.MaxLifetime > 0 && now.Sub(pt.created) > p.opts.MaxLifetime {
+		return true
+	}
+
+	return p.opts.IdleTimeout > 0 && now.Sub(pt.returned) > p.opts.IdleTimeout
+}
+
+// Get returns a target mounted from export of server as auth, idle in the
+// pool or mounted anew.  Credentials match byte for byte: reuse one
+// rpc.Auth per user, rather than a new AUTH_UNIX with a new stamp each
+// time.
+func (p *Pool) Get(server, export string, auth rpc.Auth) (*Target, error) {
+	key := poolKey(server, export, auth)
+	for {
+		pt, err := p.takeIdle(key)
+		if err != nil {
+			return nil, err
+		}
+		if pt == nil {
+			break
+		}
+
+		if time.Since(pt.returned) >= p.opts.HealthCheckAfter {
+			if _, err = pt.getAttr(pt.root()); err != nil {
+				util.Debugf("pool: %s:%s unhealthy: %s", server, export, err)
+				p.discard(pt, true)
+				continue
+			}
+		}
+
+		return pt.Target, nil
+	}
+
+	v, err := p.dial(server, export, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		v.Close()
+		return nil, ErrPoolClosed
+	}
+	if p.opts.Scheduler != nil {
+		v.SetScheduler(p.opts.Scheduler, server+":"+export)
+	}
+	p.inUse[v] = &pooledTarget{Target: v, key: key, created: time.Now()}
+	p.stats.Dialed++
+
+	return v, nil
+}
+
+// takeIdle moves the most recently returned live target of key in use
+func (p *Pool) takeIdle(key string) (*pooledTarget, error) {
+	p.Lock()
+	if p.closed {
+		p.Unlock()
+		return nil, ErrPoolClosed
+	}
+
+	var expired []*pooledTarget
+	var pt *pooledTarget
+	now := time.Now()
+	idle := p.idle[key]
+	for len(idle) > 0 {
+		pt, idle = idle[len(idle)-1], idle[:len(idle)-1]
+		if !p.expired(pt, now) {
+			break
+		}
+		expired = append(expired, pt)
+		pt = nil
+	}
+	p.idle[key] = idle
+	if pt != nil {
+		p.inUse[pt.Target] = pt
+		p.stats.Reused++
+	}
+	p.Unlock()
+
+	for _, e := range expired {
+		p.closeTarget(e)
+	}
+
+	return pt, nil
+}
+
+func (p *Pool) dial(server, export string, auth rpc.Auth) (*Target, error) {
+	if p.opts.Dial != nil {
+		return p.opts.Dial(server, export, auth)
+	}
+
+	m, err := DialMount(server, p.opts.Priv)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := m.Mount(export, auth)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// Put hands v, from Get, back to the pool.  Targets beyond MaxIdle, past
+// their lifetime or from a closed pool are closed.
+func (p *Pool) Put(v *Target) {
+	p.Lock()
+	pt, ok := p.inUse[v]
+	if !ok {
+		p.Unlock()
+		util.Errorf("pool: put of a target not from the pool")
+		return
+	}
+	delete(p.inUse, v)
+
+	pt.returned = time.Now()
+	if p.closed || p.expired(pt, pt.returned) || len(p.idle[pt.key]) >= p.opts.MaxIdle {
+		p.Unlock()
+		p.closeTarget(pt)
+		return
+	}
+	p.idle[pt.key] = append(p.idle[pt.key], pt)
+	p.Unlock()
+}
+
+// Discard closes v, from Get, instead of handing it back, e.g. after an
+// error that left it unusable
+func (p *Pool) Discard(v *Target) {
+	p.Lock()
+	pt, ok := p.inUse[v]
+	delete(p.inUse, v)
+	p.Unlock()
+
+	if ok {
+		p.discard(pt, false)
+	}
+}
+
+func (p *Pool) discard(pt *pooledTarget, unhealthy bool) {
+	p.Lock()
+	delete(p.inUse, pt.Target)
+	if unhealthy {
+		p.stats.Unhealthy++
+	}
+	p.Unlock()
+
+	p.closeTarget(pt)
+}
+
+// closeTarget closes a target no longer in the pool, and the mount it came
+// from
+func (p *Pool) closeTarget(pt *pooledTarget) {
+	p.Lock()
+	p.stats.Closed++
+	p.Unlock()
+
+	if err := pt.Close(); err != nil && err != ErrClosed {
+		util.Debugf("pool: close(%s): %s", pt.dirPath, err)
+	}
+	if m := pt.mount; m != nil && m.Client != pt.Client {
+		m.Close()
+	}
+}
+
+// Prune closes the idle targets past their idle timeout or lifetime, which
+// Get and Put otherwise only notice for the keys they are called with
+func (p *Pool) Prune() {
+	p.Lock()
+	now := time.Now()
+	var expired []*pooledTarget
+	for key, idle := range p.idle {
+		live := idle[:0]
+		for _, pt := range idle {
+			if p.expired(pt, now) {
+				expired = append(expired, pt)
+			} else {
+				live = append(live, pt)
+			}
+		}
+		p.idle[key] = live
+	}
+	p.Unlock()
+
+	for _, pt := range expired {
+		p.closeTarget(pt)
+	}
+}
+
+// Stats returns the counts of the pool
+func (p *Pool) Stats() PoolStats {
+	p.Lock()
+	defer p.Unlock()
+
+	stats := p.stats
+	for _, idle := range p.idle {
+		stats.Idle += len(idle)
+	}
+	stats.Open = stats.Idle + len(p.inUse)
+
+	return stats
+}
+
+// Close closes the idle targets, and has the ones in use closed as they are
+// put back
+func (p *Pool) Close() error {
+	p.Lock()
+	p.closed = true
+	var idle []*pooledTarget
+	for _, pts := range p.idle {
+		idle = append(idle, pts...)
+	}
+	p.idle = make(map[string][]*pooledTarget)
+	p.Unlock()
+
+	for _, pt := range idle {
+		p.closeTarget(pt)
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+func loopbackPool(opts PoolOptions) *Pool {
+	s := NewServer(NewMemFS())
+	opts.Dial = func(server, export string, auth rpc.Auth) (*Target, error) {
+		return DialLoopback(s).Mount(export, auth)
+	}
+
+	return NewPool(opts)
+}
+
+func TestPoolReuse(t *testing.T) {
+	p := loopbackPool(PoolOptions{MaxIdle: 1})
+	defer p.Close()
+
+	alice := rpc.NewAuthUnix("host", 1000, 1000).Auth()
+	bob := rpc.NewAuthUnix("host", 1001, 1001).Auth()
+
+	a1, err := p.Get("filer", "/", alice)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	a2, err := p.Get("filer", "/", alice)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if a1 == a2 {
+		t.Fatalf("a target in use handed out twice")
+	}
+	p.Put(a1)
+	p.Put(a2)
+
+	if stats := p.Stats(); stats.Open != 1 || stats.Idle != 1 || stats.Closed != 1 {
+		t.Errorf("past MaxIdle: %+v", stats)
+	}
+
+	if a3, _ := p.Get("filer", "/", alice); a3 != a1 {
+		t.Errorf("idle target not reused")
+	} else {
+		p.Put(a3)
+	}
+
+	// another credential is another key
+	b, err := p.Get("filer", "/", bob)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if b == a1 {
+		t.Errorf("target shared across credentials")
+	}
+	p.Put(b)
+
+	if stats := p.Stats(); stats.Dialed != 3 || stats.Reused != 1 {
+		t.Errorf("stats: %+v", stats)
+	}
+}
+
+func TestPoolExpiry(t *testing.T) {
+	p := loopbackPool(PoolOptions{IdleTimeout: time.Millisecond})
+	defer p.Close()
+
+	v, err := p.Get("filer", "/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	p.Put(v)
+	time.Sleep(5 * time.Millisecond)
+
+	p.Prune()
+	if stats := p.Stats(); stats.Open != 0 || stats.Closed != 1 {
+		t.Errorf("idle target not pruned: %+v", stats)
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	p := loopbackPool(PoolOptions{})
+	defer p.Close()
+
+	v, err := p.Get("filer", "/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	p.Put(v)
+
+	// the connection dies while idle
+	v.ForceClose()
+
+	w, err := p.Get("filer", "/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if w == v {
+		t.Fatalf("dead target handed out")
+	}
+	p.Put(w)
+
+	if stats := p.Stats(); stats.Unhealthy != 1 || stats.Dialed != 2 {
+		t.Errorf("stats: %+v", stats)
+	}
+}
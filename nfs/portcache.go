@@ -0,0 +1,175 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// Side programs of an NFSv3 server, looked up along with MOUNT and NFS
+const (
+	NLMProg   = 100021
+	NLMVers   = 4
+	StatdProg = 100024
+	StatdVers = 1
+)
+
+// DefaultPortCacheTTL is how long a port looked up from the portmapper is
+// reused
+const DefaultPortCacheTTL = 5 * time.Minute
+
+type portKey struct {
+	host             string
+	prog, vers, prot uint32
+}
+
+type portEntry struct {
+	port    int
+	expires time.Time
+}
+
+var portCache = struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[portKey]portEntry
+}{
+	ttl:     DefaultPortCacheTTL,
+	entries: make(map[portKey]portEntry),
+}
+
+// SetPortCacheTTL sets how long ports looked up from the portmapper are
+// reused.  Zero disables the cache and drops what it holds.
+func SetPortCacheTTL(ttl time.Duration) {
+	portCache.Lock()
+	defer portCache.Unlock()
+
+	portCache.ttl = ttl
+	if ttl == 0 {
+		portCache.entries = make(map[portKey]portEntry)
+	}
+}
+
+func newPortKey(host string, m rpc.Mapping) portKey {
+	return portKey{host, m.Prog, m.Vers, m.Prot}
+}
+
+func cachedPort(host string, m rpc.Mapping) (int, bool) {
+	portCache.Lock()
+	defer portCache.Unlock()
+
+	k := newPortKey(host, m)
+	e, ok := portCache.entries[k]
+	if !ok {
+		return 0, false
+	}
+	if time.Now().After(e.expires) {
+		delete(portCache.entries, k)
+		return 0, false
+	}
+
+	return e.port, true
+}
+
+func cachePort(host string, m rpc.Mapping, port int) {
+	portCache.Lock()
+	defer portCache.Unlock()
+
+	// unregistered services are not cached, they may be starting up
+	if portCache.ttl == 0 || port == 0 {
+		return
+	}
+
+	portCache.entries[newPortKey(host, m)] = portEntry{port, time.Now().Add(portCache.ttl)}
+}
+
+// forgetPort drops a cached port, e.g. once it can not be connected to as the
+// service may have restarted elsewhere
+func forgetPort(host string, m rpc.Mapping) {
+	portCache.Lock()
+	defer portCache.Unlock()
+
+	delete(portCache.entries, newPortKey(host, m))
+}
+
+// lookupPort returns the port of a service on host, from the cache or the
+// portmapper at addr, an address of host.  The cache is keyed by host, as the
+// caller named it, as ResolvePorts keys it.
+func lookupPort(host, addr string, m rpc.Mapping) (int, error) {
+	if port, ok := cachedPort(host, m); ok {
+		return port, nil
+	}
+
+	pm, err := rpc.DialPortmapper("tcp", addr)
+	if err != nil {
+		util.Errorf("Failed to connect to portmapper: %s", err)
+		return 0, err
+	}
+	defer pm.Close()
+
+	port, err := pm.Lookup(m)
+	if err != nil {
+		return 0, err
+	}
+
+	cachePort(host, m, port)
+	return port, nil
+}
+
+// ResolvePorts looks up the ports of services on addr concurrently, over a
+// single portmapper connection, and caches them.  A port is 0 if its service
+// is not registered or could not be looked up, the error returned is the
+// first lookup failure.
+func ResolvePorts(addr string, mappings ...rpc.Mapping) ([]int, error) {
+	res := make([]int, len(mappings))
+	errs := make([]error, len(mappings))
+
+	var pm *rpc.Portmapper
+	var wg sync.WaitGroup
+	for i, m := range mappings {
+		if port, ok := cachedPort(addr, m); ok {
+			res[i] = port
+			continue
+		}
+
+		if pm == nil {
+			var err error
+			if pm, err = rpc.DialPortmapper("tcp", addr); err != nil {
+				util.Errorf("Failed to connect to portmapper: %s", err)
+				return res, err
+			}
+			defer pm.Close()
+		}
+
+		wg.Add(1)
+		go func(i int, m rpc.Mapping) {
+			defer wg.Done()
+
+			res[i], errs[i] = pm.Lookup(m)
+			if errs[i] == nil {
+				cachePort(addr, m, res[i])
+			}
+		}(i, m)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return res, err
+		}
+	}
+
+	return res, nil
+}
+
+// mountMappings are the services resolved together when dialing MOUNT
+var mountMappings = []rpc.Mapping{
+	{Prog: MountProg, Vers: MountVers, Prot: rpc.IPProtoTCP},
+	{Prog: Nfs3Prog, Vers: Nfs3Vers, Prot: rpc.IPProtoTCP},
+	{Prog: NLMProg, Vers: NLMVers, Prot: rpc.IPProtoTCP},
+	{Prog: StatdProg, Vers: StatdVers, Prot: rpc.IPProtoTCP},
+}
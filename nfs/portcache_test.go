@@ -0,0 +1,86 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPortCache(t *testing.T) {
+	defer SetPortCacheTTL(DefaultPortCacheTTL)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	// cached ports are dialed without asking the portmapper, which is not
+	// running here
+	cachePort("127.0.0.1", mountMappings[0], port)
+	cachePort("127.0.0.1", mountMappings[1], port+1)
+	got, err := ResolvePorts("127.0.0.1", mountMappings[:2]...)
+	if err != nil || got[0] != port || got[1] != port+1 {
+		t.Fatalf("resolve from cache: %v, %v", got, err)
+	}
+	client, err := DialService("127.0.0.1", mountMappings[0], false)
+	if err != nil {
+		t.Fatalf("dial from cache: %s", err)
+	}
+	client.Close()
+
+	SetPortCacheTTL(time.Millisecond)
+	cachePort("127.0.0.1", mountMappings[0], port)
+	time.Sleep(2 * time.Millisecond)
+	if _, ok := cachedPort("127.0.0.1", mountMappings[0]); ok {
+		t.Fatal("expected the port to expire")
+	}
+
+	SetPortCacheTTL(0)
+	cachePort("127.0.0.1", mountMappings[0], port)
+	if _, ok := cachedPort("127.0.0.1", mountMappings[0]); ok {
+		t.Fatal("expected nothing cached with the cache disabled")
+	}
+}
+
+func TestPortCacheRetryDial(t *testing.T) {
+	SetDialRetryBudget(time.Second)
+	defer SetDialRetryBudget(0)
+
+	// retries dial the addresses of the host, the cache is of its name
+	addrs, err := resolve("localhost")
+	if err != nil {
+		t.Skip(err)
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(addrs[0], "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	cachePort("localhost", mountMappings[0], l.Addr().(*net.TCPAddr).Port)
+	defer forgetPort("localhost", mountMappings[0])
+	client, err := DialService("localhost", mountMappings[0], false)
+	if err != nil {
+		t.Fatalf("dial from cache: %s", err)
+	}
+	client.Close()
+}
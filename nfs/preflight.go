@@ -0,0 +1,254 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// AccessMask is a set of the ACCESS3 bits
+type AccessMask uint32
+
+const (
+	AccessRead    AccessMask = ACCESS3_READ
+	AccessLookup  AccessMask = ACCESS3_LOOKUP
+	AccessModify  AccessMask = ACCESS3_MODIFY
+	AccessExtend  AccessMask = ACCESS3_EXTEND
+	AccessDelete  AccessMask = ACCESS3_DELETE
+	AccessExecute AccessMask = ACCESS3_EXECUTE
+
+	// AccessWrite is what writing files, or entries of directories, takes
+	AccessWrite = AccessModify | AccessExtend | AccessDelete
+)
+
+var accessNames = []struct {
+	bit  AccessMask
+	name string
+}{
+	{AccessRead, "read"},
+	{AccessLookup, "lookup"},
+	{AccessModify, "modify"},
+	{AccessExtend, "extend"},
+	{AccessDelete, "delete"},
+	{AccessExecute, "execute"},
+}
+
+// String returns the names of the bits of m, as "read|lookup"
+func (m AccessMask) String() string {
+	var names []string
+	for _, a := range accessNames {
+		if m&a.bit != 0 {
+			names = append(names, a.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// MarshalText encodes m by names, for reports to be read by people
+func (m AccessMask) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// Probes of AccessCheck
+const (
+	ProbeStat   = "stat"
+	ProbeAccess = "access"
+	ProbeRead   = "read"
+	ProbeWrite  = "write"
+)
+
+// AccessCheck is a probe of VerifyAccess and its outcome
+type AccessCheck struct {
+	Probe  string `json:"probe"`
+	OK     bool   `json:"ok"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// AccessReport is what VerifyAccess found a path allows
+type AccessReport struct {
+	Path    string        `json:"path"`
+	Type    string        `json:"type,omitempty"`
+	Want    AccessMask    `json:"want"`
+	Granted AccessMask    `json:"granted"`
+	Checks  []AccessCheck `json:"checks"`
+}
+
+// OK reports whether every probe passed
+func (r *AccessReport) OK() bool {
+	return r.Err() == nil
+}
+
+// Err returns the reasons of the probes that failed, nil if none did
+func (r *AccessReport) Err() error {
+	var failed []string
+	for _, c := range r.Checks {
+		if !c.OK {
+			failed = append(failed, c.Probe+": "+c.Reason)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%s: %s", r.Path, strings.Join(failed, "; "))
+}
+
+func (r *AccessReport) check(probe string, err error) bool {
+	c := AccessCheck{Probe: probe, OK: err == nil}
+	if err != nil {
+		c.Reason = err.Error()
+		util.Debugf("verify access(%s): %s: %s", r.Path, probe, err)
+	}
+	r.Checks = append(r.Checks, c)
+
+	return c.OK
+}
+
+// errProbed stops a listing after its first page
+var errProbed = errors.New("probed")
+
+// VerifyAccess checks that path allows want, for services to fail on start
+// with a reason rather than on their first write: a read-only export, one
+// mounted with the wrong credentials, root squashed, or full.  Beyond ACCESS,
+// which servers answer from the mode bits and may not know of a read-only
+// export or quotas, it tries what want is for: reading a byte of a file or a
+// page of a directory for AccessRead, a WRITE of nothing to a file, or the
+// creation of a file in a directory, named as CreateTemp names them and
+// removed right after, for AccessModify, AccessExtend and AccessDelete.
+// It returns the report with its Err.
+func (v *Target) VerifyAccess(path string, want AccessMask) (*AccessReport, error) {
+	r := &AccessReport{Path: path, Want: want, Checks: []AccessCheck{}}
+
+	attr, fh, err := v.GetAttr(path)
+	if !r.check(ProbeStat, err) {
+		return r, r.Err()
+	}
+	r.Type = typeToJSON[attr.Type]
+
+	_, granted, err := v.access(fh, path, uint32(want))
+	if err == nil {
+		r.Granted = AccessMask(granted) & want
+		if denied := want &^ r.Granted; denied != 0 {
+			err = fmt.Errorf("server denies %s", denied)
+		}
+	}
+	r.check(ProbeAccess, err)
+
+	if want&AccessRead != 0 {
+		r.check(ProbeRead, v.probeRead(fh, attr))
+	}
+	if want&AccessWrite != 0 {
+		r.check(ProbeWrite, v.probeWrite(fh, attr))
+	}
+
+	return r, r.Err()
+}
+
+func (v *Target) probeRead(fh []byte, attr *Fattr) error {
+	switch attr.Type {
+	case NF3Dir:
+		err := v.ReadDirPlusPagesByFh(fh, func([]EntryPlus) error { return errProbed })
+		if err == errProbed {
+			err = nil
+		}
+		return err
+	case NF3Reg:
+		_, err := v.ReadRanges(fh, []Range{{Offset: 0, Length: 1}})
+		return err
+	}
+
+	return nil
+}
+
+func (v *Target) probeWrite(fh []byte, attr *Fattr) error {
+	switch attr.Type {
+	case NF3Dir:
+		// a crash before the remove leaves it to SweepTemp
+		name := fmt.Sprintf("%saccess-%x", TempPrefix, time.Now().UnixNano())
+		if _, err := v.CreateByFh(fh, name, 0600); err != nil {
+			return err
+		}
+		return v.remove(fh, name)
+	case NF3Reg:
+		f := &File{Target: v, fsinfo: v.fsinfo, fh: fh}
+		_, err := f.writeAt(nil, nil, 0, 2)
+		if err == io.ErrShortWrite {
+			// nothing written, as asked
+			err = nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// PermissionPreflightError is returned, before anything is changed, by the
+// long operations of a target checking ACCESS first, see SetAccessPreflight,
+// when the server denies bits they need.  It wraps NFS3ERR_ACCES, as the
+// server would have answered midway.
+type PermissionPreflightError struct {
+	Path    string
+	Want    AccessMask
+	Missing AccessMask
+}
+
+func (e *PermissionPreflightError) Error() string {
+	return fmt.Sprintf("%s: server denies %s of %s", e.Path, e.Missing, e.Want)
+}
+
+func (e *PermissionPreflightError) Unwrap() error {
+	return NFS3Error(NFS3ErrAcces)
+}
+
+// SetAccessPreflight has RemoveAll and UploadTree check with ACCESS that the
+// directories they start at allow what they are to do, and fail with a
+// *PermissionPreflightError up front rather than midway through a tree of a
+// million files.  ACCESS tells what the mode bits and ACLs allow, it may not
+// know of a read-only export or of quotas, see VerifyAccess for those.
+func (v *Target) SetAccessPreflight(on bool) {
+	v.accessPreflight = on
+}
+
+// CheckAccess checks with ACCESS that path allows want, and fails with a
+// *PermissionPreflightError listing the bits the server denies
+func (v *Target) CheckAccess(path string, want AccessMask) error {
+	_, fh, err := v.Lookup(path)
+	if err != nil {
+		return err
+	}
+
+	return v.checkAccess(fh, path, want)
+}
+
+func (v *Target) checkAccess(fh []byte, path string, want AccessMask) error {
+	_, granted, err := v.access(fh, path, uint32(want))
+	if err != nil {
+		return err
+	}
+
+	if missing := want &^ AccessMask(granted); missing != 0 {
+		util.Debugf("access preflight(%s): %s denied", path, missing)
+		return &PermissionPreflightError{Path: path, Want: want, Missing: missing}
+	}
+
+	return nil
+}
+
+// preflightAccess is checkAccess if the target checks ACCESS first
+func (v *Target) preflightAccess(fh []byte, path string, want AccessMask) error {
+	if !v.accessPreflight {
+		return nil
+	}
+
+	return v.checkAccess(fh, path, want)
+}
@@ -0,0 +1,123 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+func TestVerifyAccess(t *testing.T) {
+	s := NewServer(NewMemFS())
+	readOnly := false
+	s.Register(Nfs3Prog, Nfs3Vers, func(call *rpc.ServerCall, w io.Writer) error {
+		if readOnly && (call.Proc == NFSProc3Create || call.Proc == NFSProc3Write) {
+			return writeFailure(w, call.Proc, NFS3ErrROFS)
+		}
+		return s.serveNFS(call, w)
+	})
+	v, err := DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	writeFile(t, v, "/file", "data")
+
+	for _, path := range []string{"/", "/file"} {
+		r, err := v.VerifyAccess(path, AccessRead|AccessWrite)
+		if err != nil || len(r.Checks) != 4 || r.Granted != AccessRead|AccessWrite {
+			t.Errorf("%s: %+v %v", path, r, err)
+		}
+	}
+	if entries, err := v.ReadDirPlus("/"); err != nil || len(entries) != 1 {
+		t.Errorf("probe left %d entries, %v", len(entries), err)
+	}
+
+	readOnly = true
+	for _, path := range []string{"/", "/file"} {
+		r, err := v.VerifyAccess(path, AccessRead|AccessModify)
+		if err == nil || r.OK() {
+			t.Fatalf("%s: read-only export verified", path)
+		}
+		if c := r.Checks[3]; c.Probe != ProbeWrite || !strings.Contains(c.Reason, "read-only") {
+			t.Errorf("%s: %+v", path, c)
+		}
+		if r, err = v.VerifyAccess(path, AccessRead); err != nil {
+			t.Errorf("%s: read: %v", path, err)
+		}
+	}
+
+	if r, err := v.VerifyAccess("/missing", AccessRead); err == nil || r.Checks[0].Probe != ProbeStat {
+		t.Errorf("missing: %+v", r)
+	}
+	if s := (AccessRead | AccessDelete).String(); s != "read|delete" {
+		t.Errorf("mask %q", s)
+	}
+}
+
+func TestAccessPreflight(t *testing.T) {
+	s := NewServer(NewMemFS())
+	var denied uint32
+	s.Register(Nfs3Prog, Nfs3Vers, func(call *rpc.ServerCall, w io.Writer) error {
+		if call.Proc != NFSProc3Access || denied == 0 {
+			return s.serveNFS(call, w)
+		}
+		var a struct {
+			FH     []byte
+			Access uint32
+		}
+		if err := xdr.Read(call.Args, &a); err != nil {
+			return rpc.ErrGarbageArgs
+		}
+		return xdr.Write(w, struct {
+			Status uint32
+			Attr   PostOpAttr
+			Access uint32
+		}{NFS3Ok, PostOpAttr{}, a.Access &^ denied})
+	})
+	v, err := DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	if _, err = v.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, v, "/dir/file", "data")
+
+	// checked only once asked for
+	denied = ACCESS3_DELETE
+	v.SetAccessPreflight(true)
+	err = v.RemoveAll("/dir")
+	var perr *PermissionPreflightError
+	if !errors.As(err, &perr) || perr.Path != "/" || perr.Missing != AccessDelete {
+		t.Fatalf("remove all: %v", err)
+	}
+	if !errors.Is(err, os.ErrPermission) {
+		t.Errorf("%v is no permission error", err)
+	}
+	if _, _, err = v.Lookup("/dir/file"); err != nil {
+		t.Errorf("preflight removed: %v", err)
+	}
+
+	denied = ACCESS3_EXTEND
+	if _, err = UploadTree(t.TempDir(), &TreeRef{Target: v, Path: "/dir"}, UploadOptions{}); !errors.As(err, &perr) || perr.Missing != AccessExtend {
+		t.Errorf("upload: %v", err)
+	}
+	if err = v.CheckAccess("/dir", AccessRead); err != nil {
+		t.Errorf("check of a bit granted: %v", err)
+	}
+
+	v.SetAccessPreflight(false)
+	denied = ACCESS3_DELETE
+	if err = v.RemoveAll("/dir"); err != nil {
+		t.Errorf("remove all without preflight: %v", err)
+	}
+}
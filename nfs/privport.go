@@ -0,0 +1,119 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// PrivPortPolicy is what a dial asking for a privileged port does when the
+// process cannot bind one, see SetPrivPortPolicy
+type PrivPortPolicy int
+
+const (
+	// PrivPortRequire fails the dial, the default
+	PrivPortRequire PrivPortPolicy = iota
+
+	// PrivPortFallback dials from an unprivileged port instead, which
+	// exports marked insecure accept
+	PrivPortFallback
+)
+
+// PrivPortWarning describes a dial that fell back to an unprivileged port
+type PrivPortWarning struct {
+	Addr string
+	Port int
+
+	// Err is why no privileged port could be bound
+	Err error
+}
+
+func (w *PrivPortWarning) String() string {
+	return fmt.Sprintf("cannot bind a privileged port (%s), dialing %s from an unprivileged one",
+		w.Err, net.JoinHostPort(w.Addr, strconv.Itoa(w.Port)))
+}
+
+var privPort struct {
+	sync.Mutex
+	policy PrivPortPolicy
+	warn   func(*PrivPortWarning)
+}
+
+// SetPrivPortPolicy sets what dials asking for a privileged port do when the
+// process may not bind one, as it runs neither as root nor with
+// CAP_NET_BIND_SERVICE.  With PrivPortFallback, warn is called for each dial
+// falling back; if nil, the warning is logged.
+func SetPrivPortPolicy(policy PrivPortPolicy, warn func(*PrivPortWarning)) {
+	privPort.Lock()
+	defer privPort.Unlock()
+
+	privPort.policy = policy
+	privPort.warn = warn
+}
+
+var privPortProbe struct {
+	sync.Once
+	err error
+}
+
+// CanBindPrivPort reports whether the process may bind a port below 1024, and
+// if not why.  Rather than guess from the uid, capabilities or the platform,
+// it binds one on the loopback once and remembers the outcome.
+func CanBindPrivPort() (bool, error) {
+	privPortProbe.Do(func() { privPortProbe.err = probePrivPort() })
+	return privPortProbe.err == nil, privPortProbe.err
+}
+
+// canBindPrivPort is CanBindPrivPort, replaced by tests
+var canBindPrivPort = CanBindPrivPort
+
+func probePrivPort() error {
+	var err error
+	for i := 0; i < 16; i++ {
+		var l net.Listener
+		l, err = net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(512+rand.Intn(512))))
+		if err == nil {
+			return l.Close()
+		}
+
+		// taken, which says nothing about the permission
+		if !isAddrInUse(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// usePrivPort returns whether a dial of addr:port asking for a privileged
+// port should use one, or the error failing it under PrivPortRequire
+func usePrivPort(addr string, port int) (bool, error) {
+	ok, err := canBindPrivPort()
+	if ok {
+		return true, nil
+	}
+
+	privPort.Lock()
+	policy, warn := privPort.policy, privPort.warn
+	privPort.Unlock()
+
+	if policy == PrivPortRequire {
+		return false, fmt.Errorf("nfs: cannot bind a privileged port: %w", err)
+	}
+
+	w := &PrivPortWarning{Addr: addr, Port: port, Err: err}
+	if warn != nil {
+		warn(w)
+	} else {
+		util.Errorf("%s", w)
+	}
+
+	return false, nil
+}
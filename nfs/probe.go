@@ -0,0 +1,278 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/util"
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+// largest transfer size ProbeCapabilities tries, whatever FSINFO claims
+const probeMaxTransfer = 16 << 20
+
+// Capabilities are what a server was found to do, by trying, see
+// ProbeCapabilities.  FSINFO and PATHCONF tell what a server claims; filers,
+// gateways and the filesystems under them do not always live up to it.
+type Capabilities struct {
+	ReadDirPlus bool
+	Symlinks    bool
+	HardLinks   bool
+
+	// ExclusiveCreate is whether an exclusive CREATE is retried safely: the
+	// verifier is kept, so that the same create sent again succeeds, and
+	// one of another verifier fails
+	ExclusiveCreate bool
+
+	// TimeGranularity is the step of the mtimes the server keeps, zero if
+	// it could not be set
+	TimeGranularity time.Duration
+
+	// MaxReadSize and MaxWriteSize are the largest READ and WRITE the
+	// server served in full
+	MaxReadSize  uint32
+	MaxWriteSize uint32
+}
+
+// Capabilities returns what ProbeCapabilities found, nil before it ran
+func (v *Target) Capabilities() *Capabilities {
+	v.capsMu.Lock()
+	defer v.capsMu.Unlock()
+
+	return v.caps
+}
+
+// ProbeCapabilities finds out what the server does by trying it in a scratch
+// directory it makes in the root of the target and removes after, so that
+// tools can adapt, falling back to READDIR or copying rather than linking.
+// The result is cached, later calls return it without probing again.  It
+// fails only if the scratch directory can't be made.
+func (v *Target) ProbeCapabilities() (*Capabilities, error) {
+	v.capsMu.Lock()
+	defer v.capsMu.Unlock()
+	if v.caps != nil {
+		return v.caps, nil
+	}
+
+	name := fmt.Sprintf(".nfs-probe-%x", time.Now().UnixNano())
+	dir, err := v.MkdirByParentFh(v.root(), name, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("probe: %w", err)
+	}
+	defer func() {
+		if err := v.RemoveAll("/" + name); err != nil {
+			util.Errorf("probe: remove /%s: %s", name, err)
+		}
+	}()
+
+	caps := &Capabilities{}
+	if _, err = v.ReadDirPlusByFh(dir); err == nil {
+		caps.ReadDirPlus = true
+	} else {
+		util.Debugf("probe: readdirplus: %s", err)
+	}
+
+	file, err := v.CreateByFh(dir, "file", 0600)
+	if err != nil {
+		return nil, fmt.Errorf("probe: %w", err)
+	}
+
+	if err = v.probeSymlink(dir); err == nil {
+		caps.Symlinks = true
+	} else {
+		util.Debugf("probe: symlink: %s", err)
+	}
+	if err = v.probeLink(file, dir); err == nil {
+		caps.HardLinks = true
+	} else {
+		util.Debugf("probe: link: %s", err)
+	}
+
+	caps.ExclusiveCreate = v.probeExclusive(dir)
+	caps.TimeGranularity = v.probeTimes(file)
+	caps.MaxWriteSize, caps.MaxReadSize = v.probeTransfers(file)
+
+	util.Debugf("probe: %+v", caps)
+	v.caps = caps
+
+	return caps, nil
+}
+
+func (v *Target) probeSymlink(dir []byte) error {
+	type Symlink3Args struct {
+		rpc.Header
+		Where  Diropargs3
+		Attr   Sattr3
+		Target string
+	}
+
+	res, err := v.call(&Symlink3Args{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    Nfs3Prog,
+			Vers:    Nfs3Vers,
+			Proc:    NFSProc3Symlink,
+			Cred:    v.auth,
+			Verf:    rpc.AuthNull,
+		},
+		Where:  Diropargs3{FH: dir, Filename: "symlink"},
+		Target: "file",
+	})
+	if err != nil {
+		return err
+	}
+
+	created := new(diropRes)
+	if err = xdr.Read(res, created); err != nil {
+		return err
+	}
+	if !created.FH.IsSet {
+		return nil
+	}
+
+	_, target, err := v.readlinkFh(created.FH.FH)
+	if err == nil && target != "file" {
+		err = fmt.Errorf("symlink reads back as %q", target)
+	}
+
+	return err
+}
+
+func (v *Target) probeLink(file, dir []byte) error {
+	type Link3Args struct {
+		rpc.Header
+		FH   []byte
+		Link Diropargs3
+	}
+
+	_, err := v.call(&Link3Args{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    Nfs3Prog,
+			Vers:    Nfs3Vers,
+			Proc:    NFSProc3Link,
+			Cred:    v.auth,
+			Verf:    rpc.AuthNull,
+		},
+		FH:   file,
+		Link: Diropargs3{FH: dir, Filename: "link"},
+	})
+	if err != nil {
+		return err
+	}
+
+	attr, err := v.getAttr(file)
+	if err == nil && attr.Nlink != 2 {
+		err = fmt.Errorf("link count %d after LINK", attr.Nlink)
+	}
+
+	return err
+}
+
+// createExclusive sends an EXCLUSIVE CREATE of name in dir, with verf
+func (v *Target) createExclusive(dir []byte, name string, verf uint64) error {
+	type Create3Args struct {
+		rpc.Header
+		Where Diropargs3
+		Mode  uint32
+		Verf  uint64
+	}
+
+	_, err := v.call(&Create3Args{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    Nfs3Prog,
+			Vers:    Nfs3Vers,
+			Proc:    NFSProc3Create,
+			Cred:    v.auth,
+			Verf:    rpc.AuthNull,
+		},
+		Where: Diropargs3{FH: dir, Filename: name},
+		Mode:  2,
+		Verf:  verf,
+	})
+
+	return err
+}
+
+func (v *Target) probeExclusive(dir []byte) bool {
+	verf := uint64(time.Now().UnixNano())
+	for i, try := range []struct {
+		verf uint64
+		ok   bool
+	}{{verf, true}, {verf, true}, {verf + 1, false}} {
+		err := v.createExclusive(dir, "exclusive", try.verf)
+		if (err == nil) != try.ok {
+			util.Debugf("probe: exclusive create %d: %v", i, err)
+			return false
+		}
+	}
+
+	return true
+}
+
+// probeTimes sets an mtime of nanoseconds on file, and returns the step of
+// what the server kept of it
+func (v *Target) probeTimes(file []byte) time.Duration {
+	want := NFS3Time{Seconds: 1234567890, Nseconds: 123456789}
+	err := v.SetAttrByFh(file, Sattr3{Mtime: SetTime{SetIt: SetToClientTime, Time: want}})
+	if err != nil {
+		util.Debugf("probe: setattr: %s", err)
+		return 0
+	}
+	attr, err := v.getAttr(file)
+	if err != nil || attr.Mtime.Seconds != want.Seconds {
+		util.Debugf("probe: mtime %+v, %v", attr, err)
+		return 0
+	}
+
+	for step := time.Nanosecond; step < time.Second; step *= 10 {
+		if attr.Mtime.Nseconds == want.Nseconds-want.Nseconds%uint32(step) {
+			return step
+		}
+	}
+
+	return time.Second
+}
+
+// probeTransfers writes and reads file in the largest transfers the server
+// serves in full, from those FSINFO claims down
+func (v *Target) probeTransfers(file []byte) (uint32, uint32) {
+	f := &File{Target: v, fsinfo: v.fsinfo, fh: file}
+
+	var wsize uint32
+	for size := min(v.fsinfo.WTMax, probeMaxTransfer); size >= 512; size /= 2 {
+		fsinfo := *v.fsinfo
+		fsinfo.WTPref = size
+		f.fsinfo, f.curr = &fsinfo, 0
+
+		n, err := f.Write(make([]byte, size))
+		if err == nil && uint32(n) == size && f.curr == uint64(size) {
+			wsize = size
+			break
+		}
+		util.Debugf("probe: write of %d: %d, %v", size, n, err)
+	}
+
+	var rsize uint32
+	for size := min(v.fsinfo.RTMax, probeMaxTransfer); size >= 512; size /= 2 {
+		if size > wsize {
+			if err := v.SetAttrByFh(file, Sattr3{Size: SetSize{SetIt: true, Size: uint64(size)}}); err != nil {
+				continue
+			}
+		}
+
+		n, _, _, err := f.readAt(make([]byte, size), 0)
+		if err == nil && uint32(n) == size {
+			rsize = size
+			break
+		}
+		util.Debugf("probe: read of %d: %d, %v", size, n, err)
+	}
+
+	return wsize, rsize
+}
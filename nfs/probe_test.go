@@ -0,0 +1,55 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeCapabilities(t *testing.T) {
+	v := loopbackTarget(t)
+	defer v.Close()
+
+	// as if FSINFO claimed more than the server takes
+	fsinfo := *v.fsinfo
+	fsinfo.WTMax, fsinfo.RTMax = 4<<20, 4<<20
+	v.fsinfo = &fsinfo
+
+	if v.Capabilities() != nil {
+		t.Fatalf("capabilities before probing")
+	}
+	caps, err := v.ProbeCapabilities()
+	if err != nil {
+		t.Fatalf("probe: %s", err)
+	}
+
+	want := Capabilities{
+		ReadDirPlus: true,
+		Symlinks:    true,
+		HardLinks:   true,
+		// the server keeps the verifier in the times of the file
+		ExclusiveCreate: true,
+		TimeGranularity: time.Nanosecond,
+		MaxReadSize:     DefaultServerFSInfo.RTMax,
+		MaxWriteSize:    DefaultServerFSInfo.WTMax,
+	}
+	if *caps != want {
+		t.Errorf("capabilities %+v, want %+v", *caps, want)
+	}
+	if v.Capabilities() != caps {
+		t.Errorf("capabilities not cached")
+	}
+
+	entries, err := v.ReadDirPlus("/")
+	if err != nil {
+		t.Fatalf("readdirplus: %s", err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.FileName, ".nfs-probe-") {
+			t.Errorf("scratch directory %s left behind", e.FileName)
+		}
+	}
+}
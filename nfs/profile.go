@@ -0,0 +1,158 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+// Profile is a set of quirks of filers met in the field, which a Server
+// mimics once set with SetProfile, to reproduce locally what a client does
+// against them.  Quirks left zero behave as the Server does by default.
+type Profile struct {
+	Name string
+
+	// NoReadDirPlus answers READDIRPLUS with NFS3ERR_NOTSUPP, as servers
+	// with it turned off, or too old for it, do
+	NoReadDirPlus bool
+
+	// RTMax and WTMax cut the largest READ and WRITE FSINFO reports and
+	// the server takes
+	RTMax uint32
+	WTMax uint32
+
+	// JukeboxEvery answers every so many calls NFS3ERR_JUKEBOX, and
+	// JukeboxInFlight those beyond so many in flight, as a filer busy
+	// recalling files from tape or under load does
+	JukeboxEvery    int
+	JukeboxInFlight int
+
+	// NameMax has names cut to so many bytes, rather than refused, as
+	// servers reporting no_trunc false in PATHCONF do
+	NameMax int
+}
+
+// Profiles of common quirks, by name
+var Profiles = map[string]Profile{
+	"no-readdirplus": {Name: "no-readdirplus", NoReadDirPlus: true},
+	"32k-wtmax":      {Name: "32k-wtmax", RTMax: 32 << 10, WTMax: 32 << 10},
+	"jukebox":        {Name: "jukebox", JukeboxEvery: 10, JukeboxInFlight: 16},
+	"truncate-names": {Name: "truncate-names", NameMax: 255},
+}
+
+// SetProfile has the server behave as profile p tells, see Profile.  It is
+// to be set before the server serves calls.
+func (s *Server) SetProfile(p Profile) {
+	s.profile = p
+	if p.RTMax > 0 && p.RTMax < s.fsinfo.RTMax {
+		s.fsinfo.RTMax = p.RTMax
+		s.fsinfo.RTPref = min(s.fsinfo.RTPref, p.RTMax)
+	}
+	if p.WTMax > 0 && p.WTMax < s.fsinfo.WTMax {
+		s.fsinfo.WTMax = p.WTMax
+		s.fsinfo.WTPref = min(s.fsinfo.WTPref, p.WTMax)
+	}
+	if p.NameMax > 0 {
+		s.backend = &truncatingBackend{Backend: s.backend, max: p.NameMax}
+	}
+}
+
+// quirk returns the status the profile answers call proc with instead of
+// serving it, NFS3Ok if none.  done is to be called once the call is served.
+func (s *Server) quirk(proc uint32) (status uint32, done func()) {
+	p := &s.profile
+	inflight := atomic.AddInt32(&s.inflight, 1)
+	done = func() { atomic.AddInt32(&s.inflight, -1) }
+
+	switch {
+	case p.NoReadDirPlus && proc == NFSProc3ReadDirPlus:
+		return NFS3ErrNotSupp, done
+	case p.JukeboxEvery > 0 && atomic.AddUint64(&s.calls, 1)%uint64(p.JukeboxEvery) == 0:
+		return NFS3ErrJukebox, done
+	case p.JukeboxInFlight > 0 && int(inflight) > p.JukeboxInFlight:
+		return NFS3ErrJukebox, done
+	}
+
+	return NFS3Ok, done
+}
+
+// writeFailure writes the reply of a call of proc failed with status before
+// it was served: the status and the resfail body of proc, with no
+// attributes
+func writeFailure(w io.Writer, proc, status uint32) error {
+	var body []interface{}
+	switch proc {
+	case NFSProc3GetAttr:
+	case NFSProc3Rename:
+		body = []interface{}{WccData{}, WccData{}}
+	case NFSProc3Link:
+		body = []interface{}{PostOpAttr{}, WccData{}}
+	case NFSProc3SetAttr, NFSProc3Write, NFSProc3Create, NFSProc3Mkdir, NFSProc3Symlink,
+		NFSProc3MkNod, NFSProc3Remove, NFSProc3RmDir, NFSProc3Commit:
+		body = []interface{}{WccData{}}
+	default:
+		body = []interface{}{PostOpAttr{}}
+	}
+
+	if err := xdr.Write(w, status); err != nil {
+		return err
+	}
+	for _, v := range body {
+		if err := xdr.Write(w, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// truncatingBackend cuts the names of the entries it creates and looks up to
+// max bytes
+type truncatingBackend struct {
+	Backend
+	max int
+}
+
+func (b *truncatingBackend) cut(name string) string {
+	if len(name) > b.max {
+		return name[:b.max]
+	}
+
+	return name
+}
+
+func (b *truncatingBackend) Lookup(dir []byte, name string) ([]byte, error) {
+	return b.Backend.Lookup(dir, b.cut(name))
+}
+
+func (b *truncatingBackend) Create(dir []byte, name string, attr Sattr3, guarded bool) ([]byte, error) {
+	return b.Backend.Create(dir, b.cut(name), attr, guarded)
+}
+
+func (b *truncatingBackend) Mkdir(dir []byte, name string, attr Sattr3) ([]byte, error) {
+	return b.Backend.Mkdir(dir, b.cut(name), attr)
+}
+
+func (b *truncatingBackend) Symlink(dir []byte, name, target string, attr Sattr3) ([]byte, error) {
+	return b.Backend.Symlink(dir, b.cut(name), target, attr)
+}
+
+func (b *truncatingBackend) Link(fh []byte, dir []byte, name string) error {
+	return b.Backend.Link(fh, dir, b.cut(name))
+}
+
+func (b *truncatingBackend) Remove(dir []byte, name string) error {
+	return b.Backend.Remove(dir, b.cut(name))
+}
+
+func (b *truncatingBackend) RmDir(dir []byte, name string) error {
+	return b.Backend.RmDir(dir, b.cut(name))
+}
+
+func (b *truncatingBackend) Rename(fromDir []byte, fromName string, toDir []byte, toName string) error {
+	return b.Backend.Rename(fromDir, b.cut(fromName), toDir, b.cut(toName))
+}
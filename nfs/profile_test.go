@@ -0,0 +1,89 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+func profiledTarget(t *testing.T, p Profile) *Target {
+	s := NewServer(NewMemFS())
+	s.SetProfile(p)
+
+	v, err := DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+
+	return v
+}
+
+func TestProfileNoReadDirPlus(t *testing.T) {
+	v := profiledTarget(t, Profiles["no-readdirplus"])
+	defer v.Close()
+
+	_, err := v.ReadDirPlus("/")
+	var nfsErr *Error
+	if !errors.As(err, &nfsErr) || nfsErr.ErrorNum != NFS3ErrNotSupp {
+		t.Fatalf("readdirplus: got %v, want NFS3ERR_NOTSUPP", err)
+	}
+
+	caps, err := v.ProbeCapabilities()
+	if err != nil || caps.ReadDirPlus {
+		t.Errorf("probe: %+v, %v", caps, err)
+	}
+}
+
+func TestProfileWTMax(t *testing.T) {
+	v := profiledTarget(t, Profiles["32k-wtmax"])
+	defer v.Close()
+
+	if v.fsinfo.WTMax != 32<<10 || v.fsinfo.WTPref > 32<<10 {
+		t.Fatalf("fsinfo %+v", v.fsinfo)
+	}
+	data := strings.Repeat("x", 100<<10)
+	writeFile(t, v, "/file", data)
+	if attr, _, err := v.GetAttr("/file"); err != nil || attr.Size() != int64(len(data)) {
+		t.Errorf("file of %v, %v", attr, err)
+	}
+}
+
+func TestProfileJukebox(t *testing.T) {
+	v := profiledTarget(t, Profile{JukeboxEvery: 3})
+	defer v.Close()
+
+	failed := 0
+	for i := 0; i < 30; i++ {
+		if _, err := v.getAttr(v.root()); err != nil {
+			if !IsTransient(err) {
+				t.Fatalf("getattr: %s, want NFS3ERR_JUKEBOX", err)
+			}
+			failed++
+		}
+	}
+	if failed != 10 {
+		t.Errorf("%d calls of 30 failed, want every third", failed)
+	}
+}
+
+func TestProfileTruncateNames(t *testing.T) {
+	v := profiledTarget(t, Profile{NameMax: 8})
+	defer v.Close()
+
+	pc, err := v.PathConf("/")
+	if err != nil || pc.NameMax != 8 || pc.NoTrunc {
+		t.Fatalf("pathconf %+v, %v", pc, err)
+	}
+
+	if _, err = v.Create("/abcdefgh", 0644); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if _, _, err = v.Lookup("/abcdefghij"); err != nil {
+		t.Errorf("lookup of a longer name: %s", err)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"sync"
+)
+
+// ReadRangesInFlight is how many READs ReadRanges keeps in flight at once
+const ReadRangesInFlight = 16
+
+// Range is a span of a file, see ReadRanges
+type Range struct {
+	Offset uint64
+	Length uint64
+}
+
+// ReadRanges reads the ranges of file fh, which need not be contiguous or in
+// order, such as the grain tables of a VMDK.  Their READs are all sent before
+// the replies come in, rather than one per round trip, which matters over a
+// link of high latency.  It returns the data of each range, short of its
+// length where it runs past the end of the file.
+func (v *Target) ReadRanges(fh []byte, ranges []Range) ([][]byte, error) {
+	f := &File{Target: v, fsinfo: v.fsinfo, fh: fh}
+	chunk := uint64(v.fsinfo.RTPref)
+	if chunk == 0 {
+		chunk = 64 * 1024
+	}
+
+	type read struct {
+		r      int
+		offset uint64
+		p      []byte
+	}
+
+	bufs := make([][]byte, len(ranges))
+	var reads []read
+	for i, rg := range ranges {
+		bufs[i] = make([]byte, rg.Length)
+		for off := uint64(0); off < rg.Length; off += chunk {
+			end := off + chunk
+			if end > rg.Length {
+				end = rg.Length
+			}
+			reads = append(reads, read{i, rg.Offset + off, bufs[i][off:end]})
+		}
+	}
+
+	var mu sync.Mutex
+	var firstErr error
+	// where the file ended in each range, if it did
+	ends := make([]uint64, len(ranges))
+	for i, rg := range ranges {
+		ends[i] = rg.Length
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, ReadRangesInFlight)
+	for _, rd := range reads {
+		slots <- struct{}{}
+
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			<-slots
+			break
+		}
+
+		wg.Add(1)
+		go func(rd read) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			n, err := f.readFull(rd.p, rd.offset)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			if n < len(rd.p) {
+				if end := rd.offset + uint64(n) - ranges[rd.r].Offset; end < ends[rd.r] {
+					ends[rd.r] = end
+				}
+			}
+		}(rd)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	for i := range bufs {
+		bufs[i] = bufs[i][:ends[i]]
+	}
+
+	return bufs, nil
+}
+
+// readFull reads p at offset, in as many READs as the server takes to fill
+// it, and returns less than len(p) only at the end of the file
+func (f *File) readFull(p []byte, offset uint64) (int, error) {
+	filled := 0
+	for filled < len(p) {
+		reserved := f.acquire(len(p) - filled)
+		n, eof, _, err := f.readAt(p[filled:], offset+uint64(filled))
+		f.release(reserved)
+		filled += n
+		if err != nil {
+			return filled, err
+		}
+		if eof || n == 0 {
+			break
+		}
+	}
+
+	return filled, nil
+}
@@ -0,0 +1,84 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+func TestReadRanges(t *testing.T) {
+	s := NewServer(NewMemFS())
+
+	// note how many READs the server sees at once
+	var mu sync.Mutex
+	var inflight, most int
+	s.Register(Nfs3Prog, Nfs3Vers, func(call *rpc.ServerCall, w io.Writer) error {
+		if call.Proc == NFSProc3Read {
+			mu.Lock()
+			if inflight++; inflight > most {
+				most = inflight
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			defer func() {
+				mu.Lock()
+				inflight--
+				mu.Unlock()
+			}()
+		}
+		return s.serveNFS(call, w)
+	})
+
+	v, err := DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	data := make([]byte, 300*1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	writeFile(t, v, "/disk.vmdk", string(data))
+	_, fh, err := v.Lookup("/disk.vmdk")
+	if err != nil {
+		t.Fatalf("lookup: %s", err)
+	}
+
+	ranges := []Range{
+		{Offset: 200 * 1024, Length: 90 * 1024},
+		{Offset: 10, Length: 100},
+		{Offset: 0, Length: 0},
+		{Offset: 290 * 1024, Length: 20 * 1024}, // past the end
+		{Offset: 400 * 1024, Length: 10},        // beyond it
+	}
+	got, err := v.ReadRanges(fh, ranges)
+	if err != nil {
+		t.Fatalf("read ranges: %s", err)
+	}
+
+	for i, rg := range ranges {
+		end := rg.Offset + rg.Length
+		if end > uint64(len(data)) {
+			end = uint64(len(data))
+		}
+		var want []byte
+		if rg.Offset < end {
+			want = data[rg.Offset:end]
+		}
+		if !bytes.Equal(got[i], want) {
+			t.Errorf("range %d: read %d bytes, want %d", i, len(got[i]), len(want))
+		}
+	}
+
+	if most < 2 {
+		t.Errorf("READs sent one at a time")
+	}
+}
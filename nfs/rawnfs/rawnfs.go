@@ -0,0 +1,486 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+// Package rawnfs sends single NFSv3 procedures, RFC 1813 section 3.3, with
+// their arguments and results as typed structs.  Unlike nfs.Target it has no
+// paths, caches, retries or name checks: each method is exactly one call, for
+// composing operations Target does not offer.
+//
+//	v, _ := m.Mount("/export", rpc.AuthNull)
+//	_, root, _ := v.Lookup("/")
+//
+//	nfsd := rpc.Mapping{Prog: nfs.Nfs3Prog, Vers: nfs.Nfs3Vers, Prot: rpc.IPProtoTCP}
+//	client, _ := nfs.DialService("filer", nfsd, false)
+//	c := rawnfs.NewClient(client, rpc.AuthNull)
+//	res, err := c.Lookup(&rawnfs.Lookup3Args{What: nfs.Diropargs3{FH: root, Filename: "file"}})
+//
+// A status other than NFS3_OK is returned as the error of nfs.NFS3Error, the
+// failure results that come with it are not decoded.
+package rawnfs
+
+import (
+	"io"
+
+	"github.com/go-nfs/nfsv3/nfs"
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+// stable_how, for Write3Args.Stable and Write3Res.Committed
+const (
+	Unstable = 0
+	DataSync = 1
+	FileSync = 2
+)
+
+// createmode3, for CreateHow3.Mode
+const (
+	Unchecked = 0
+	Guarded   = 1
+	Exclusive = 2
+)
+
+// Client sends NFSv3 procedures over an rpc client connected to the NFS
+// service, with the credential it was made with
+type Client struct {
+	client *rpc.Client
+	auth   rpc.Auth
+}
+
+// NewClient returns a Client calling over client as auth
+func NewClient(client *rpc.Client, auth rpc.Auth) *Client {
+	return &Client{client: client, auth: auth}
+}
+
+// Close closes the rpc client
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
+type call struct {
+	rpc.Header
+	Args interface{}
+}
+
+// call sends proc with args and decodes the result into res, unless the
+// status is an error
+func (c *Client) call(proc uint32, args interface{}, res interface{}) error {
+	h := rpc.Header{
+		Rpcvers: 2,
+		Prog:    nfs.Nfs3Prog,
+		Vers:    nfs.Nfs3Vers,
+		Proc:    proc,
+		Cred:    c.auth,
+		Verf:    rpc.AuthNull,
+	}
+
+	var r io.ReadSeeker
+	var err error
+	if args == nil {
+		r, err = c.client.Call(&h)
+	} else {
+		r, err = c.client.Call(&call{Header: h, Args: args})
+	}
+	if err != nil {
+		return err
+	}
+
+	if proc == nfs.NFSProc3Null {
+		return nil
+	}
+
+	status, err := xdr.ReadUint32(r)
+	if err != nil {
+		return err
+	}
+	if err = nfs.NFS3Error(status); err != nil {
+		return err
+	}
+
+	if d, ok := res.(interface{ decode(io.Reader) error }); ok {
+		return d.decode(r)
+	}
+
+	return xdr.Read(r, res)
+}
+
+// Null pings the server
+func (c *Client) Null() error {
+	return c.call(nfs.NFSProc3Null, nil, nil)
+}
+
+type GetAttr3Args struct {
+	Object []byte
+}
+
+type GetAttr3Res struct {
+	Attr nfs.Fattr
+}
+
+func (c *Client) GetAttr(args *GetAttr3Args) (*GetAttr3Res, error) {
+	res := new(GetAttr3Res)
+	return res, c.call(nfs.NFSProc3GetAttr, args, res)
+}
+
+type SetAttr3Args struct {
+	Object []byte
+	Attr   nfs.Sattr3
+	Guard  nfs.Guard
+}
+
+type SetAttr3Res struct {
+	Wcc nfs.WccData
+}
+
+func (c *Client) SetAttr(args *SetAttr3Args) (*SetAttr3Res, error) {
+	res := new(SetAttr3Res)
+	return res, c.call(nfs.NFSProc3SetAttr, args, res)
+}
+
+type Lookup3Args struct {
+	What nfs.Diropargs3
+}
+
+type Lookup3Res struct {
+	Object  []byte
+	Attr    nfs.PostOpAttr
+	DirAttr nfs.PostOpAttr
+}
+
+func (c *Client) Lookup(args *Lookup3Args) (*Lookup3Res, error) {
+	res := new(Lookup3Res)
+	return res, c.call(nfs.NFSProc3Lookup, args, res)
+}
+
+type Access3Args struct {
+	Object []byte
+	Access uint32
+}
+
+type Access3Res struct {
+	Attr   nfs.PostOpAttr
+	Access uint32
+}
+
+func (c *Client) Access(args *Access3Args) (*Access3Res, error) {
+	res := new(Access3Res)
+	return res, c.call(nfs.NFSProc3Access, args, res)
+}
+
+type Readlink3Args struct {
+	Symlink []byte
+}
+
+type Readlink3Res struct {
+	Attr nfs.PostOpAttr
+	Data string
+}
+
+func (c *Client) Readlink(args *Readlink3Args) (*Readlink3Res, error) {
+	res := new(Readlink3Res)
+	return res, c.call(nfs.NFSProc3Readlink, args, res)
+}
+
+type Read3Args struct {
+	File   []byte
+	Offset uint64
+	Count  uint32
+}
+
+type Read3Res struct {
+	Attr  nfs.PostOpAttr
+	Count uint32
+	EOF   bool
+	Data  []byte
+}
+
+func (c *Client) Read(args *Read3Args) (*Read3Res, error) {
+	res := new(Read3Res)
+	return res, c.call(nfs.NFSProc3Read, args, res)
+}
+
+// Write3Args writes Data, Count should be its length
+type Write3Args struct {
+	File   []byte
+	Offset uint64
+	Count  uint32
+	Stable uint32
+	Data   []byte
+}
+
+type Write3Res struct {
+	Wcc       nfs.WccData
+	Count     uint32
+	Committed uint32
+	Verf      uint64
+}
+
+func (c *Client) Write(args *Write3Args) (*Write3Res, error) {
+	res := new(Write3Res)
+	return res, c.call(nfs.NFSProc3Write, args, res)
+}
+
+// CreateHow3 is how CREATE treats an existing file: Attr is sent for
+// Unchecked and Guarded, Verf for Exclusive
+type CreateHow3 struct {
+	Mode uint32
+	Attr nfs.Sattr3
+	Verf uint64
+}
+
+type Create3Args struct {
+	Where nfs.Diropargs3
+	How   CreateHow3
+}
+
+// DiropRes3 is the result of the procedures making a directory entry:
+// CREATE, MKDIR, SYMLINK and MKNOD
+type DiropRes3 struct {
+	Object nfs.PostOpFH3
+	Attr   nfs.PostOpAttr
+	DirWcc nfs.WccData
+}
+
+func (c *Client) Create(args *Create3Args) (*DiropRes3, error) {
+	// createhow3 is a union, only the arm of the mode goes on the wire
+	var how interface{}
+	if args.How.Mode == Exclusive {
+		how = &struct {
+			Mode uint32
+			Verf uint64
+		}{args.How.Mode, args.How.Verf}
+	} else {
+		how = &struct {
+			Mode uint32
+			Attr nfs.Sattr3
+		}{args.How.Mode, args.How.Attr}
+	}
+
+	res := new(DiropRes3)
+	return res, c.call(nfs.NFSProc3Create, &struct {
+		Where nfs.Diropargs3
+		How   interface{}
+	}{args.Where, how}, res)
+}
+
+type Mkdir3Args struct {
+	Where nfs.Diropargs3
+	Attr  nfs.Sattr3
+}
+
+func (c *Client) Mkdir(args *Mkdir3Args) (*DiropRes3, error) {
+	res := new(DiropRes3)
+	return res, c.call(nfs.NFSProc3Mkdir, args, res)
+}
+
+type Symlink3Args struct {
+	Where nfs.Diropargs3
+	Attr  nfs.Sattr3
+	Data  string
+}
+
+func (c *Client) Symlink(args *Symlink3Args) (*DiropRes3, error) {
+	res := new(DiropRes3)
+	return res, c.call(nfs.NFSProc3Symlink, args, res)
+}
+
+// Mknod3Args makes a special file of Type: Attr is sent for all of them,
+// Spec only for nfs.NF3Chr and nfs.NF3Blk
+type Mknod3Args struct {
+	Where nfs.Diropargs3
+	Type  uint32
+	Attr  nfs.Sattr3
+	Spec  [2]uint32
+}
+
+func (c *Client) Mknod(args *Mknod3Args) (*DiropRes3, error) {
+	// mknoddata3 is a union on the type
+	var what interface{}
+	switch args.Type {
+	case nfs.NF3Chr, nfs.NF3Blk:
+		what = &struct {
+			Type uint32
+			Attr nfs.Sattr3
+			Spec [2]uint32
+		}{args.Type, args.Attr, args.Spec}
+	case nfs.NF3Sock, nfs.NF3FIFO:
+		what = &struct {
+			Type uint32
+			Attr nfs.Sattr3
+		}{args.Type, args.Attr}
+	default:
+		what = &struct{ Type uint32 }{args.Type}
+	}
+
+	res := new(DiropRes3)
+	return res, c.call(nfs.NFSProc3MkNod, &struct {
+		Where nfs.Diropargs3
+		What  interface{}
+	}{args.Where, what}, res)
+}
+
+type Remove3Args struct {
+	Object nfs.Diropargs3
+}
+
+type Remove3Res struct {
+	DirWcc nfs.WccData
+}
+
+func (c *Client) Remove(args *Remove3Args) (*Remove3Res, error) {
+	res := new(Remove3Res)
+	return res, c.call(nfs.NFSProc3Remove, args, res)
+}
+
+func (c *Client) Rmdir(args *Remove3Args) (*Remove3Res, error) {
+	res := new(Remove3Res)
+	return res, c.call(nfs.NFSProc3RmDir, args, res)
+}
+
+type Rename3Args struct {
+	From nfs.Diropargs3
+	To   nfs.Diropargs3
+}
+
+type Rename3Res struct {
+	FromDirWcc nfs.WccData
+	ToDirWcc   nfs.WccData
+}
+
+func (c *Client) Rename(args *Rename3Args) (*Rename3Res, error) {
+	res := new(Rename3Res)
+	return res, c.call(nfs.NFSProc3Rename, args, res)
+}
+
+type Link3Args struct {
+	File []byte
+	Link nfs.Diropargs3
+}
+
+type Link3Res struct {
+	Attr       nfs.PostOpAttr
+	LinkDirWcc nfs.WccData
+}
+
+func (c *Client) Link(args *Link3Args) (*Link3Res, error) {
+	res := new(Link3Res)
+	return res, c.call(nfs.NFSProc3Link, args, res)
+}
+
+type ReadDir3Args struct {
+	Dir        []byte
+	Cookie     uint64
+	CookieVerf uint64
+	Count      uint32
+}
+
+// Entry3 is an entry of a READDIR reply
+type Entry3 struct {
+	FileId   uint64
+	FileName string
+	Cookie   uint64
+}
+
+type ReadDir3Res struct {
+	DirAttr    nfs.PostOpAttr
+	CookieVerf uint64
+	Entries    []Entry3
+	EOF        bool
+}
+
+func (res *ReadDir3Res) decode(r io.Reader) error {
+	d := xdr.NewReader(r)
+	res.DirAttr.DecodeXDR(d)
+	res.CookieVerf = d.DecodeUint64()
+	for d.DecodeBool() {
+		res.Entries = append(res.Entries, Entry3{
+			FileId:   d.DecodeUint64(),
+			FileName: d.DecodeString(),
+			Cookie:   d.DecodeUint64(),
+		})
+	}
+	res.EOF = d.DecodeBool()
+
+	return d.Err()
+}
+
+func (c *Client) ReadDir(args *ReadDir3Args) (*ReadDir3Res, error) {
+	res := new(ReadDir3Res)
+	return res, c.call(nfs.NFSProc3ReadDir, args, res)
+}
+
+type ReadDirPlus3Args struct {
+	Dir        []byte
+	Cookie     uint64
+	CookieVerf uint64
+	DirCount   uint32
+	MaxCount   uint32
+}
+
+type ReadDirPlus3Res struct {
+	DirAttr    nfs.PostOpAttr
+	CookieVerf uint64
+	Entries    []*nfs.EntryPlus
+	EOF        bool
+}
+
+func (res *ReadDirPlus3Res) decode(r io.Reader) error {
+	d := xdr.NewReader(r)
+	res.DirAttr.DecodeXDR(d)
+	res.CookieVerf = d.DecodeUint64()
+	if err := d.Err(); err != nil {
+		return err
+	}
+
+	var err error
+	res.Entries, res.EOF, err = nfs.DecodeEntryPlusStream(r)
+	return err
+}
+
+func (c *Client) ReadDirPlus(args *ReadDirPlus3Args) (*ReadDirPlus3Res, error) {
+	res := new(ReadDirPlus3Res)
+	return res, c.call(nfs.NFSProc3ReadDirPlus, args, res)
+}
+
+type FSStat3Args struct {
+	Root []byte
+}
+
+func (c *Client) FSStat(args *FSStat3Args) (*nfs.FSStat, error) {
+	res := new(nfs.FSStat)
+	return res, c.call(nfs.NFSProc3FSStat, args, res)
+}
+
+type FSInfo3Args struct {
+	Root []byte
+}
+
+func (c *Client) FSInfo(args *FSInfo3Args) (*nfs.FSInfo, error) {
+	res := new(nfs.FSInfo)
+	return res, c.call(nfs.NFSProc3FSInfo, args, res)
+}
+
+type PathConf3Args struct {
+	Object []byte
+}
+
+func (c *Client) PathConf(args *PathConf3Args) (*nfs.PathConf, error) {
+	res := new(nfs.PathConf)
+	return res, c.call(nfs.NFSProc3PathConf, args, res)
+}
+
+type Commit3Args struct {
+	File   []byte
+	Offset uint64
+	Count  uint32
+}
+
+type Commit3Res struct {
+	Wcc  nfs.WccData
+	Verf uint64
+}
+
+func (c *Client) Commit(args *Commit3Args) (*Commit3Res, error) {
+	res := new(Commit3Res)
+	return res, c.call(nfs.NFSProc3Commit, args, res)
+}
@@ -0,0 +1,90 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package rawnfs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs"
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+func TestClient(t *testing.T) {
+	s := nfs.NewServer(nfs.NewMemFS())
+	v, err := nfs.DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	_, root, err := v.Lookup("/")
+	if err != nil {
+		t.Fatalf("lookup root: %s", err)
+	}
+
+	c := NewClient(s.Pipe(), rpc.AuthNull)
+	defer c.Close()
+
+	if err := c.Null(); err != nil {
+		t.Fatalf("null: %s", err)
+	}
+
+	dir, err := c.Mkdir(&Mkdir3Args{
+		Where: nfs.Diropargs3{FH: root, Filename: "dir"},
+		Attr:  nfs.Sattr3{Mode: nfs.SetMode{SetIt: true, Mode: 0755}},
+	})
+	if err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+
+	file, err := c.Create(&Create3Args{
+		Where: nfs.Diropargs3{FH: dir.Object.FH, Filename: "file"},
+		How:   CreateHow3{Mode: Guarded, Attr: nfs.Sattr3{Mode: nfs.SetMode{SetIt: true, Mode: 0644}}},
+	})
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	fh := file.Object.FH
+
+	data := []byte("hello, world")
+	w, err := c.Write(&Write3Args{File: fh, Offset: 2, Count: uint32(len(data)), Stable: Unstable, Data: data})
+	if err != nil || w.Count != uint32(len(data)) {
+		t.Fatalf("write: %+v, %v", w, err)
+	}
+	if _, err := c.Commit(&Commit3Args{File: fh}); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+
+	r, err := c.Read(&Read3Args{File: fh, Offset: 2, Count: 100})
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if string(r.Data) != string(data) || !r.EOF || r.Attr.Attr.Filesize != 14 {
+		t.Errorf("read %q eof %v, attrs %+v", r.Data, r.EOF, r.Attr)
+	}
+
+	list, err := c.ReadDirPlus(&ReadDirPlus3Args{Dir: dir.Object.FH, DirCount: 512, MaxCount: 4096})
+	if err != nil {
+		t.Fatalf("readdirplus: %s", err)
+	}
+	if len(list.Entries) != 1 || list.Entries[0].FileName != "file" || !list.EOF {
+		t.Errorf("readdirplus: %+v", list)
+	}
+
+	names, err := c.ReadDir(&ReadDir3Args{Dir: dir.Object.FH, Count: 4096})
+	if err != nil {
+		t.Fatalf("readdir: %s", err)
+	}
+	if len(names.Entries) != 1 || names.Entries[0].FileName != "file" || !names.EOF {
+		t.Errorf("readdir: %+v", names)
+	}
+
+	if _, err := c.Remove(&Remove3Args{Object: nfs.Diropargs3{FH: dir.Object.FH, Filename: "file"}}); err != nil {
+		t.Fatalf("remove: %s", err)
+	}
+	if _, err := c.Lookup(&Lookup3Args{What: nfs.Diropargs3{FH: dir.Object.FH, Filename: "file"}}); !os.IsNotExist(err) {
+		t.Errorf("lookup removed file: %v", err)
+	}
+}
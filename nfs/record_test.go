@@ -0,0 +1,76 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+func listNames(t *testing.T, v *Target, dir string) []string {
+	entries, err := v.ReadDirPlus(dir)
+	if err != nil {
+		t.Fatalf("readdirplus %s: %s", dir, err)
+	}
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.FileName)
+	}
+
+	return names
+}
+
+func TestRecordReplay(t *testing.T) {
+	s := NewServer(NewMemFS())
+
+	// populate through a plain loopback, record only the traversal
+	v0, err := DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	if _, err := v0.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	writeFile(t, v0, "/dir/a", "a")
+	writeFile(t, v0, "/dir/b", "b")
+	v0.Close()
+
+	var golden bytes.Buffer
+	cconn, sconn := net.Pipe()
+	go s.ServeConn(sconn)
+
+	rec := rpc.NewRecordingTransport(rpc.NewStreamTransport(cconn), &golden)
+	v, err := (&Mount{Client: rpc.NewClientTransport(rec)}).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	want := listNames(t, v, "/dir")
+	v.Close()
+
+	ex, err := rpc.LoadRecording(&golden)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+
+	replay := rpc.NewReplayTransport(ex)
+	v, err = (&Mount{Client: rpc.NewClientTransport(replay)}).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("replayed mount: %s", err)
+	}
+	defer v.Close()
+
+	if got := listNames(t, v, "/dir"); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed listing %v, recorded %v", got, want)
+	}
+
+	if _, err := v.ReadDirPlus("/dir"); !errors.Is(err, rpc.ErrNotRecorded) {
+		t.Errorf("unrecorded call: %v", err)
+	}
+}
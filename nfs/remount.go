@@ -0,0 +1,133 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// DefaultRemountAfter is how many NFS3ERR_STALE replies in a row to calls on
+// the root handle have a target mount its export again
+const DefaultRemountAfter = 2
+
+// SetRemountAfter sets how many NFS3ERR_STALE replies in a row to calls on
+// the root handle have the target mount its export again.  Servers hand out
+// a new root handle when the export is reloaded with another fsid, e.g. by
+// exportfs -r after an edit of /etc/exports, and every path lookup fails
+// from then on.  The target then runs MNT for its directory again over the
+// mount connection it came from, which must be left open, swaps the new
+// root handle in, drops its cached attributes and retries the call.  Zero
+// disables it.
+func (v *Target) SetRemountAfter(n int) {
+	v.rootMu.Lock()
+	defer v.rootMu.Unlock()
+
+	v.remountAfter = n
+}
+
+// root returns the root handle of the target
+func (v *Target) root() []byte {
+	v.rootMu.RLock()
+	defer v.rootMu.RUnlock()
+
+	return v.fh
+}
+
+// rootOK notes a call other than stale on the root handle, which resets the
+// count of stale replies
+func (v *Target) rootOK(c interface{}) {
+	v.rootMu.RLock()
+	stale := v.staleRoots
+	v.rootMu.RUnlock()
+	if stale == 0 || !sameHandle(callHandle(c), v.root()) {
+		return
+	}
+
+	v.rootMu.Lock()
+	v.staleRoots = 0
+	v.rootMu.Unlock()
+}
+
+// staleRoot notes a NFS3ERR_STALE reply to call c, and mounts the export
+// again if it is the last one allowed on the root handle.  If the root
+// handle changed, because of it or of another call, the handle of c is
+// swapped for the new one and staleRoot reports that c may be retried.
+func (v *Target) staleRoot(c interface{}) bool {
+	fh := callHandle(c)
+	if fh == nil {
+		return false
+	}
+
+	v.rootMu.Lock()
+	switch {
+	case v.prevRoot != nil && sameHandle(fh, v.prevRoot):
+		// a call sent before the remount
+		root := v.fh
+		v.rootMu.Unlock()
+		return setCallHandle(c, fh, root)
+	case !sameHandle(fh, v.fh):
+		v.rootMu.Unlock()
+		return false
+	}
+
+	v.staleRoots++
+	remount := v.remountAfter > 0 && v.staleRoots >= v.remountAfter
+	if remount {
+		v.staleRoots = 0
+	}
+	v.rootMu.Unlock()
+
+	if !remount {
+		return false
+	}
+
+	root, err := v.remount(fh)
+	if err != nil {
+		util.Errorf("remount(%s): %s", v.dirPath, err)
+		return false
+	}
+
+	return setCallHandle(c, fh, root)
+}
+
+// remount runs MNT for the directory of the target again and swaps the root
+// handle it returns for stale, unless another call did already
+func (v *Target) remount(stale []byte) ([]byte, error) {
+	v.remountMu.Lock()
+	defer v.remountMu.Unlock()
+
+	if root := v.root(); !sameHandle(root, stale) {
+		return root, nil
+	}
+
+	m := v.mount
+	if m == nil {
+		return nil, errors.New("target not mounted through a Mount")
+	}
+
+	root, _, err := m.mnt(v.dirPath, v.auth)
+	if err != nil {
+		return nil, err
+	}
+	if sameHandle(root, stale) {
+		return nil, errors.New("server returned the stale root handle again")
+	}
+	util.Debugf("remount(%s): root handle %x, was %x", v.dirPath, root, stale)
+
+	v.rootMu.Lock()
+	v.prevRoot = stale
+	v.fh = root
+	v.rootMu.Unlock()
+	v.cache.purge()
+
+	// the fsid changes with the export more often than not
+	if err = v.pinRoot(nil); err != nil {
+		util.Debugf("remount(%s): getattr: %s", v.dirPath, err)
+	}
+	v.emit(&Event{Type: EventMountRefreshed, Addr: v.RemoteAddr(), OldFH: stale, NewFH: root})
+
+	return root, nil
+}
@@ -0,0 +1,162 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+// reloadServer exports a MemFS under a root handle of its own, which reload
+// changes as exportfs -r does when the fsid of an export changes.  Calls on
+// a former root handle are answered NFS3ERR_STALE.
+type reloadServer struct {
+	*Server
+	real []byte
+
+	sync.Mutex
+	root, stale []byte
+}
+
+func newReloadServer() *reloadServer {
+	fs := NewMemFS()
+	real, _ := fs.Root("/")
+	rs := &reloadServer{Server: NewServer(fs), real: real, root: []byte("export-1")}
+
+	rs.Register(MountProg, MountVers, func(call *rpc.ServerCall, w io.Writer) error {
+		if call.Proc != MountProc3MNT {
+			return rs.serveMount(call, w)
+		}
+		rs.Lock()
+		defer rs.Unlock()
+		return xdr.Write(w, struct {
+			Status  uint32
+			FH      []byte
+			Flavors []uint32
+		}{MNT3Ok, rs.root, nil})
+	})
+	rs.Register(Nfs3Prog, Nfs3Vers, rs.serveNFS)
+
+	return rs
+}
+
+func (rs *reloadServer) reload() {
+	rs.Lock()
+	defer rs.Unlock()
+
+	rs.stale = rs.root
+	rs.root = []byte("export-2")
+}
+
+// serveNFS maps the root handle, which all calls but NULL start with when
+// they operate on the root
+func (rs *reloadServer) serveNFS(call *rpc.ServerCall, w io.Writer) error {
+	args, err := io.ReadAll(call.Args)
+	if err != nil {
+		return err
+	}
+	call.Args = bytes.NewReader(args)
+	if call.Proc == NFSProc3Null {
+		return rs.Server.serveNFS(call, w)
+	}
+
+	fh, err := xdr.ReadOpaque(bytes.NewReader(args))
+	if err != nil {
+		return rpc.ErrGarbageArgs
+	}
+
+	rs.Lock()
+	root, stale := rs.root, rs.stale
+	rs.Unlock()
+
+	switch {
+	case bytes.Equal(fh, stale):
+		return xdr.Write(w, uint32(NFS3ErrStale))
+	case bytes.Equal(fh, root):
+		var buf bytes.Buffer
+		xdr.Write(&buf, rs.real)
+		buf.Write(args[4+(len(fh)+3)&^3:])
+		call.Args = &buf
+	}
+
+	return rs.Server.serveNFS(call, w)
+}
+
+func TestRemountAfterReload(t *testing.T) {
+	rs := newReloadServer()
+	v, err := DialLoopback(rs.Server).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+	writeFile(t, v, "/file", "data")
+
+	rs.reload()
+
+	// once may be a fluke
+	if _, _, err = v.Lookup("/file"); !IsStaleError(err) {
+		t.Fatalf("first lookup: got %v, want NFS3ERR_STALE", err)
+	}
+
+	// twice is not, the export is mounted again and the call retried
+	if _, _, err = v.Lookup("/file"); err != nil {
+		t.Fatalf("lookup after reload: %s", err)
+	}
+	if !bytes.Equal(v.root(), []byte("export-2")) {
+		t.Errorf("root handle %q, want the new one", v.root())
+	}
+}
+
+func TestRemountDisabled(t *testing.T) {
+	rs := newReloadServer()
+	v, err := DialLoopback(rs.Server).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+	v.SetRemountAfter(0)
+	writeFile(t, v, "/file", "data")
+
+	rs.reload()
+	for i := 0; i < 3; i++ {
+		if _, _, err = v.Lookup("/file"); !IsStaleError(err) {
+			t.Fatalf("lookup: got %v, want NFS3ERR_STALE", err)
+		}
+	}
+}
+
+func TestRemountScheduled(t *testing.T) {
+	rs := newReloadServer()
+	v, err := DialLoopback(rs.Server).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+	v.SetRemountAfter(1)
+	writeFile(t, v, "/file", "data")
+
+	// the remount, and the retry, take the one slot the stale call had
+	v.SetScheduler(NewScheduler(1), "")
+	rs.reload()
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := v.Lookup("/file")
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("lookup after reload: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lookup after reload blocked")
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	_path "path"
+	"sort"
+	"strings"
+
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// DefaultRemovePasses is how many times RemoveAll lists a directory whose
+// entries change while it empties it
+const DefaultRemovePasses = 3
+
+// RemoveOptions tune RemoveAllWithOptions
+type RemoveOptions struct {
+	// Passes bounds the listings of each directory, and the removals of a
+	// directory others add entries to meanwhile, DefaultRemovePasses if 0
+	Passes int
+}
+
+// RemoveFailure is an entry RemoveAll could not remove, with why
+type RemoveFailure struct {
+	Path string `json:"path"`
+	Err  string `json:"error"`
+
+	err error
+}
+
+// RemoveReport is what RemoveAllWithOptions did
+type RemoveReport struct {
+	Removed int `json:"removed"`
+
+	// Vanished are the entries removed by others before RemoveAll got to
+	// them, and Relisted the directories listed again as entries came or
+	// could not be removed
+	Vanished int `json:"vanished"`
+	Relisted int `json:"relisted"`
+
+	// Failed are the entries left, once the passes were spent, by path
+	Failed []RemoveFailure `json:"failed,omitempty"`
+}
+
+// RemoveAllError is returned by RemoveAll for the entries of a tree it could
+// not remove, those of Failed, having removed what it could.  It wraps the
+// error of the first of them with none left below it, the directories above
+// being left as they were not empty.
+type RemoveAllError struct {
+	Path   string
+	Failed []RemoveFailure
+}
+
+// cause returns the first failure with none below it, Failed being sorted
+func (e *RemoveAllError) cause() RemoveFailure {
+	for i, f := range e.Failed {
+		if i+1 == len(e.Failed) || !strings.HasPrefix(e.Failed[i+1].Path, f.Path+"/") {
+			return f
+		}
+	}
+	return RemoveFailure{}
+}
+
+func (e *RemoveAllError) Error() string {
+	f := e.cause()
+	return fmt.Sprintf("%s: %d entries not removed, %s: %s", e.Path, len(e.Failed), f.Path, f.Err)
+}
+
+func (e *RemoveAllError) Unwrap() error {
+	return e.cause().err
+}
+
+// RemoveAll removes path and everything below it, see RemoveAllWithOptions
+func (v *Target) RemoveAll(path string) error {
+	_, err := v.RemoveAllWithOptions(path, RemoveOptions{})
+	return err
+}
+
+// RemoveAllWithOptions removes path and everything below it, on a tree others
+// may change meanwhile, as shared exports are: entries removed by others are
+// passed over, a directory that is not empty once emptied, entries having
+// come, is listed and emptied again, up to opts.Passes times, and entries
+// that cannot be removed are left while the others are removed.  Those left
+// are listed in the report, and returned as a *RemoveAllError.  Failures of
+// the transport, ErrCrossFilesystem and a *PermissionPreflightError stop it
+// instead.
+func (v *Target) RemoveAllWithOptions(path string, opts RemoveOptions) (*RemoveReport, error) {
+	if opts.Passes <= 0 {
+		opts.Passes = DefaultRemovePasses
+	}
+	r := &removal{v: v, passes: opts.Passes, report: &RemoveReport{}, failed: make(map[string]error)}
+
+	_, _, deleteDir, parentDirfh, err := v.lookupInner(context.Background(), v.root(), path, false, nil)
+	if err != nil {
+		return r.report, err
+	}
+	if err = v.preflightAccess(parentDirfh, _path.Dir(path), AccessLookup|AccessDelete); err != nil {
+		return r.report, err
+	}
+
+	// Easy path.  This is a directory and it's empty.  If not a dir or not an
+	// empty dir, this will throw an error.
+	err = v.rmDir(parentDirfh, deleteDir)
+	if err == nil {
+		r.report.Removed++
+		return r.report, nil
+	}
+	if os.IsNotExist(err) {
+		return r.report, nil
+	}
+
+	// Collect the not a dir error.
+	if IsNotDirError(err) {
+		return r.report, err
+	}
+
+	attr, deleteDirfh, _, _, err := v.lstatInner(context.Background(), parentDirfh, deleteDir)
+	if os.IsNotExist(err) {
+		r.report.Vanished++
+		return r.report, nil
+	} else if err != nil {
+		return r.report, err
+	}
+	if err = v.checkFilesystem(path, attr); err != nil {
+		return r.report, err
+	}
+	if err = v.preflightAccess(deleteDirfh, path, AccessRead|AccessLookup|AccessDelete); err != nil {
+		return r.report, err
+	}
+
+	if err = r.removeDir(parentDirfh, deleteDir, path, deleteDirfh, attr); err != nil {
+		if !entryError(err) {
+			return r.report, err
+		}
+		r.fail(path, err)
+	}
+	if len(r.failed) == 0 {
+		return r.report, nil
+	}
+
+	for p, err := range r.failed {
+		r.report.Failed = append(r.report.Failed, RemoveFailure{Path: p, Err: err.Error(), err: err})
+	}
+	sort.Slice(r.report.Failed, func(i, j int) bool { return r.report.Failed[i].Path < r.report.Failed[j].Path })
+
+	return r.report, &RemoveAllError{Path: path, Failed: r.report.Failed}
+}
+
+// entryError tells the errors of an entry that leave the others to remove:
+// statuses of the server, rather than failures of the transport
+func entryError(err error) bool {
+	var nfsErr *Error
+	return errors.As(err, &nfsErr) || errors.Is(err, os.ErrPermission) || errors.Is(err, os.ErrExist) ||
+		errors.Is(err, os.ErrNotExist)
+}
+
+// raced tells the errors of an entry, or of a listing, others changing the
+// tree meanwhile account for, worth another pass
+func raced(err error) bool {
+	var nfsErr *Error
+	if errors.As(err, &nfsErr) {
+		switch nfsErr.ErrorNum {
+		case NFS3ErrNotEmpty, NFS3ErrIsDir, NFS3ErrNotDir, NFS3ErrStale, NFS3ErrBadCookie:
+			return true
+		}
+	}
+	return errors.Is(err, os.ErrExist) || IsChangedError(err)
+}
+
+// removal is a run of RemoveAllWithOptions
+type removal struct {
+	v      *Target
+	passes int
+	report *RemoveReport
+
+	// failed are the entries not removed, by path, until they are
+	failed map[string]error
+}
+
+func (r *removal) fail(path string, err error) {
+	util.Debugf("remove all: %s: %s", path, err)
+	r.failed[path] = err
+}
+
+// stuck tells whether entries below path could not be removed, which no
+// other pass will change
+func (r *removal) stuck(path string) bool {
+	for p := range r.failed {
+		if strings.HasPrefix(p, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// forget drops what failed of path and below, gone
+func (r *removal) forget(path string) {
+	for p := range r.failed {
+		if p == path || strings.HasPrefix(p, path+"/") {
+			delete(r.failed, p)
+		}
+	}
+}
+
+// removeDir empties directory name of parent, at path, and removes it.  Its
+// handle and attributes are looked up unless given.
+func (r *removal) removeDir(parent []byte, name, path string, fh []byte, attr *Fattr) error {
+	for pass := 1; ; pass++ {
+		if fh == nil {
+			var err error
+			if attr, fh, _, err = r.v.lookup(context.Background(), parent, name); os.IsNotExist(err) {
+				r.report.Vanished++
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+		if err := r.v.checkFilesystem(path, attr); err != nil {
+			return err
+		}
+
+		// a directory removed, or replaced, meanwhile is for RMDIR to tell
+		if err := r.dir(fh, path); err != nil && !IsStaleError(err) && !os.IsNotExist(err) {
+			return err
+		}
+
+		err := r.v.rmDir(parent, name)
+		switch {
+		case err == nil:
+			r.report.Removed++
+			r.forget(path)
+			return nil
+		case os.IsNotExist(err):
+			r.report.Vanished++
+			r.forget(path)
+			return nil
+		case (IsNotEmptyError(err) || errors.Is(err, os.ErrExist)) && pass < r.passes && !r.stuck(path):
+			r.report.Relisted++
+			fh = nil
+			continue
+		}
+		return err
+	}
+}
+
+// dir removes the entries of directory fh, at path, listing it again while
+// some could not be as others changed them, up to the passes.  It returns
+// the errors that stop the removal, the entries left are failed.
+func (r *removal) dir(fh []byte, path string) error {
+	for pass := 1; ; pass++ {
+		entries, err := r.v.ReadDirPlusByFh(fh)
+		if err != nil {
+			if raced(err) && !IsStaleError(err) && pass < r.passes {
+				// the listing changed under the cookies
+				r.report.Relisted++
+				continue
+			}
+			return err
+		}
+
+		left := false
+		for _, entry := range entries {
+			// skip "." and ".."
+			if entry.FileName == "." || entry.FileName == ".." {
+				continue
+			}
+
+			p := _path.Join(path, entry.FileName)
+			if err = r.entry(fh, p, entry); err == nil {
+				continue
+			} else if !entryError(err) {
+				util.Errorf("error deleting %s: %s", p, err.Error())
+				return err
+			}
+			r.fail(p, err)
+			left = left || (raced(err) && !r.stuck(p))
+		}
+
+		if !left || pass >= r.passes {
+			return nil
+		}
+		r.report.Relisted++
+	}
+}
+
+// entry removes entry of directory fh, at path
+func (r *removal) entry(fh []byte, path string, entry *EntryPlus) error {
+	if entry.Attr.IsSet && entry.Attr.Attr.Type == NF3Dir {
+		var dirfh []byte
+		if entry.Handle.IsSet {
+			dirfh = entry.Handle.FH
+		}
+		return r.removeDir(fh, entry.FileName, path, dirfh, entry.Attr.attr())
+	}
+
+	var nfsErr *Error
+	err := r.v.remove(fh, entry.FileName)
+	switch {
+	case err == nil:
+		r.report.Removed++
+		r.forget(path)
+	case os.IsNotExist(err):
+		r.report.Vanished++
+		r.forget(path)
+	case errors.As(err, &nfsErr) && nfsErr.ErrorNum == NFS3ErrIsDir:
+		// the entry was replaced by a directory, or listed without its
+		// attributes
+		return r.removeDir(fh, entry.FileName, path, nil, nil)
+	default:
+		return err
+	}
+
+	return nil
+}
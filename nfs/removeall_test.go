@@ -0,0 +1,85 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+func TestRemoveAllRaces(t *testing.T) {
+	fs := NewMemFS()
+	s := NewServer(fs)
+
+	// others add an entry to sub once it is emptied, remove b before the
+	// client does, and stuck may not be removed
+	rmdirs := 0
+	s.Register(Nfs3Prog, Nfs3Vers, func(call *rpc.ServerCall, w io.Writer) error {
+		if call.Proc != NFSProc3Remove && call.Proc != NFSProc3RmDir {
+			return s.serveNFS(call, w)
+		}
+		args, _ := ioutil.ReadAll(call.Args)
+		call.Args = bytes.NewReader(args)
+		var a Diropargs3
+		if err := xdr.Read(bytes.NewReader(args), &a); err != nil {
+			return rpc.ErrGarbageArgs
+		}
+		switch {
+		case a.Filename == "sub":
+			if rmdirs++; rmdirs == 1 {
+				dir, _ := fs.Lookup(a.FH, "sub")
+				fs.Create(dir, "late", Sattr3{}, false)
+			}
+		case a.Filename == "b":
+			fs.Remove(a.FH, "b")
+		case a.Filename == "stuck":
+			return writeFailure(w, call.Proc, NFS3ErrAcces)
+		}
+		return s.serveNFS(call, w)
+	})
+
+	v, err := DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	for _, dir := range []string{"/tree", "/tree/sub", "/tree/keep"} {
+		if _, err = v.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"/tree/a", "/tree/b", "/tree/sub/c", "/tree/keep/stuck", "/tree/keep/d"} {
+		writeFile(t, v, file, "data")
+	}
+
+	r, err := v.RemoveAllWithOptions("/tree", RemoveOptions{})
+	var rerr *RemoveAllError
+	if !errors.As(err, &rerr) || !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("remove all: %v", err)
+	}
+	var paths []string
+	for _, f := range r.Failed {
+		paths = append(paths, f.Path)
+	}
+	if len(paths) != 3 || paths[0] != "/tree" || paths[1] != "/tree/keep" || paths[2] != "/tree/keep/stuck" {
+		t.Errorf("failed %v", paths)
+	}
+	if r.Vanished != 1 || r.Relisted == 0 {
+		t.Errorf("report %+v", r)
+	}
+	if entries, err := v.ReadDirPlus("/tree"); err != nil || len(entries) != 1 || entries[0].FileName != "keep" {
+		t.Errorf("left %v, %v", entries, err)
+	}
+
+	if err = v.RemoveAll("/tree/missing"); err != nil {
+		t.Errorf("remove all of a missing entry: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// bounds of the exponential backoff between dial attempts
+const (
+	minDialBackoff = 100 * time.Millisecond
+	maxDialBackoff = 5 * time.Second
+)
+
+var dialRetry struct {
+	sync.Mutex
+	budget time.Duration
+}
+
+// SetDialRetryBudget sets how long connecting to a server, portmapper lookup
+// included, is retried for when it fails with a network error.  Each attempt
+// resolves the host name again and moves on to its next address, so a mount
+// follows a filer address that moves during failover.  Zero, the default,
+// makes a single attempt.
+func SetDialRetryBudget(budget time.Duration) {
+	dialRetry.Lock()
+	defer dialRetry.Unlock()
+
+	dialRetry.budget = budget
+}
+
+// retryDial calls dial with the addresses of host, round-robin, until it
+// succeeds, fails with an error other than a network one, or the retry budget
+// runs out.
+func retryDial(host string, dial func(addr string) error) error {
+	dialRetry.Lock()
+	budget := dialRetry.budget
+	dialRetry.Unlock()
+
+	if budget == 0 {
+		return dial(host)
+	}
+
+	deadline := time.Now().Add(budget)
+	backoff := minDialBackoff
+	for attempt := 0; ; attempt++ {
+		addrs, err := resolve(host)
+		if err == nil {
+			err = dial(addrs[attempt%len(addrs)])
+			if err == nil {
+				return nil
+			}
+		}
+
+		if _, ok := err.(net.Error); !ok {
+			return err
+		}
+
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+		if time.Now().Add(sleep).After(deadline) {
+			return err
+		}
+
+		util.Debugf("dial %s: %s, retrying in %s", host, err, sleep)
+		time.Sleep(sleep)
+
+		if backoff *= 2; backoff > maxDialBackoff {
+			backoff = maxDialBackoff
+		}
+	}
+}
+
+// resolve returns the addresses of host, or host itself if it is an address
+func resolve(host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+
+	return addrs, nil
+}
@@ -0,0 +1,49 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRetryDial(t *testing.T) {
+	defer SetDialRetryBudget(0)
+
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	calls := 0
+	err := retryDial("127.0.0.1", func(addr string) error {
+		calls++
+		return refused
+	})
+	if err != refused || calls != 1 {
+		t.Fatalf("expected a single attempt without a budget, got %d: %v", calls, err)
+	}
+
+	SetDialRetryBudget(10 * time.Second)
+	calls = 0
+	err = retryDial("127.0.0.1", func(addr string) error {
+		if calls++; calls < 3 {
+			return refused
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("expected success on the third attempt, got %d: %v", calls, err)
+	}
+
+	// only network errors are retried
+	calls = 0
+	fatal := errors.New("MNT3ERR_ACCES")
+	err = retryDial("127.0.0.1", func(addr string) error {
+		calls++
+		return fatal
+	})
+	if err != fatal || calls != 1 {
+		t.Fatalf("expected no retry of %v, got %d: %v", fatal, calls, err)
+	}
+}
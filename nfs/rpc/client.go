@@ -4,8 +4,8 @@
 package rpc
 
 import (
-	"bufio"
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"math/rand"
@@ -48,10 +48,36 @@ func init() {
 var DefaultReadTimeout = time.Second * 5
 
 type Client struct {
-	*tcpTransport
+	transport Transport
+	timeout   time.Duration
 	sync.Mutex
+
+	retransmits uint64
+	window      *Window
+
+	// calls waiting for their reply, keyed by xid
+	pending map[uint32]chan io.ReadSeeker
+	// set once the connection is unusable
+	err error
+	// closed when the reader of the transport exits, nil until it starts
+	readDone chan struct{}
+
+	tlsConfig *tls.Config
+
+	// shorthand credentials handed out by the server in AUTH_SHORT
+	// verifiers, keyed by the full credential they stand for
+	shortCreds map[string]Auth
 }
 
+// ErrTimeout is returned by calls that did not get a reply in time
+var ErrTimeout error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "rpc: call timed out" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
 func DialTCP(network string, ldr *net.TCPAddr, addr string) (*Client, error) {
 	a, err := net.ResolveTCPAddr(network, addr)
 	if err != nil {
@@ -63,13 +89,257 @@ func DialTCP(network string, ldr *net.TCPAddr, addr string) (*Client, error) {
 		return nil, err
 	}
 
-	t := &tcpTransport{
-		r:       bufio.NewReader(conn),
-		wc:      conn,
-		timeout: DefaultReadTimeout,
+	return NewClient(conn), nil
+}
+
+// DialTLS is DialTCP over TLS, for servers behind a TLS terminator such as
+// stunnel or haproxy.  Client certificates are taken from config.
+func DialTLS(network string, ldr *net.TCPAddr, addr string, config *tls.Config) (*Client, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	var d net.Dialer
+	if ldr != nil {
+		d.LocalAddr = ldr
+	}
+	conn, err := tls.DialWithDialer(&d, network, addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewClient(conn)
+	c.tlsConfig = config
+
+	return c, nil
+}
+
+// TLSConfig returns the configuration of a client dialed with DialTLS, or nil
+func (c *Client) TLSConfig() *tls.Config {
+	return c.tlsConfig
+}
+
+// NewClient returns a client sending calls over conn, which carries rpc
+// records as on a TCP stream.  It allows wrapping the connection, see
+// CompressConn.
+func NewClient(conn net.Conn) *Client {
+	return NewClientTransport(NewStreamTransport(conn))
+}
+
+// NewClientTransport returns a client sending calls over t
+func NewClientTransport(t Transport) *Client {
+	return &Client{
+		transport: t,
+		timeout:   DefaultReadTimeout,
+	}
+}
+
+// Transport returns the transport the client sends calls over
+func (c *Client) Transport() Transport {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.transport
+}
+
+// Redial replaces the transport of the client with t, after closing the
+// current one and failing the calls pending on it, so that a client whose
+// connection was lost can be used again.  Calls that failed are not resent.
+func (c *Client) Redial(t Transport) {
+	c.Lock()
+	old, done := c.transport, c.readDone
+	c.Unlock()
+
+	old.Close()
+	if done != nil {
+		<-done
+	}
+
+	c.Lock()
+	c.transport = t
+	c.err = nil
+	c.readDone = nil
+	c.Unlock()
+}
+
+// SetTimeout sets how long a call may take, zero means forever
+func (c *Client) SetTimeout(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.timeout = d
+}
+
+// deadline returns the earlier of d and the client timeout from now.  A
+// zero result means no deadline at all.
+func (c *Client) deadline(d time.Time) time.Time {
+	c.Lock()
+	timeout := c.timeout
+	c.Unlock()
+
+	if timeout != 0 {
+		td := time.Now().Add(timeout)
+		if d.IsZero() || td.Before(d) {
+			d = td
+		}
+	}
+
+	return d
+}
+
+// Write sends buf as a single record, without waiting for a reply
+func (c *Client) Write(buf []byte) (int, error) {
+	if err := c.Transport().Send(buf, c.deadline(time.Time{})); err != nil {
+		return 0, err
+	}
+
+	return len(buf), nil
+}
+
+func (c *Client) Close() error {
+	return c.Transport().Close()
+}
+
+// RemoteAddr returns the address of the server end of the connection
+func (c *Client) RemoteAddr() net.Addr {
+	return c.Transport().RemoteAddr()
+}
+
+// LocalAddr returns the address of the client end of the connection
+func (c *Client) LocalAddr() net.Addr {
+	return c.Transport().LocalAddr()
+}
+
+// SetWindow replaces the window limiting the calls in flight, see
+// NewFixedWindow and NewAdaptiveWindow.
+func (c *Client) SetWindow(w *Window) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.window = w
+}
+
+// Window returns the window limiting the calls in flight
+func (c *Client) Window() *Window {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.window == nil {
+		c.window = NewFixedWindow(DefaultMaxInFlight)
+	}
+
+	return c.window
+}
+
+// readLoop hands each reply to the call waiting for its xid.  Replies nobody
+// waits for, e.g. for calls that timed out, are dropped.  When the connection
+// fails all pending calls fail with it.
+func (c *Client) readLoop(t Transport, done chan struct{}) {
+	defer close(done)
+
+	for {
+		res, err := t.Recv()
+		if err == nil {
+			var xid uint32
+			if xid, err = xdr.ReadUint32(res); err == nil {
+				res.Seek(0, io.SeekStart)
+
+				c.Lock()
+				ch, ok := c.pending[xid]
+				delete(c.pending, xid)
+				c.Unlock()
+
+				if ok {
+					ch <- res
+				} else {
+					util.Debugf("rpc: dropping reply for unknown xid %x", xid)
+				}
+				continue
+			}
+		}
+
+		c.Lock()
+		c.err = err
+		for xid, ch := range c.pending {
+			delete(c.pending, xid)
+			close(ch)
+		}
+		c.Unlock()
+		return
+	}
+}
+
+// roundTrip sends a marshalled call and waits for its reply
+func (c *Client) roundTrip(xid uint32, buf []byte, deadline time.Time) (io.ReadSeeker, error) {
+	w := c.Window()
+	deadline = c.deadline(deadline)
+
+	if err := w.acquire(deadline); err != nil {
+		return nil, err
+	}
+
+	ch := make(chan io.ReadSeeker, 1)
+	c.Lock()
+	if c.err != nil {
+		err := c.err
+		c.Unlock()
+		w.release(0, false)
+		return nil, err
+	}
+	if c.readDone == nil {
+		c.readDone = make(chan struct{})
+		go c.readLoop(c.transport, c.readDone)
+	}
+	t := c.transport
+	if c.pending == nil {
+		c.pending = make(map[uint32]chan io.ReadSeeker)
+	}
+	c.pending[xid] = ch
+	c.Unlock()
+
+	start := time.Now()
+	if err := t.Send(buf, deadline); err != nil {
+		c.Lock()
+		delete(c.pending, xid)
+		c.Unlock()
+		w.release(0, false)
+		return nil, err
+	}
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
 	}
 
-	return &Client{t, sync.Mutex{}}, nil
+	select {
+	case res, ok := <-ch:
+		w.release(time.Since(start), false)
+		if !ok {
+			c.Lock()
+			err := c.err
+			c.Unlock()
+			return nil, err
+		}
+		return res, nil
+
+	case <-timeout:
+		c.Lock()
+		delete(c.pending, xid)
+		c.Unlock()
+		w.release(time.Since(start), true)
+		return nil, ErrTimeout
+	}
 }
 
 type message struct {
@@ -78,119 +348,239 @@ type message struct {
 	Body    interface{}
 }
 
+// Retransmits returns the number of calls that were resent by this client
+func (c *Client) Retransmits() uint64 {
+	return atomic.LoadUint64(&c.retransmits)
+}
+
 func (c *Client) Call(call interface{}) (io.ReadSeeker, error) {
-	c.Lock()
-	defer c.Unlock()
+	return c.CallDeadline(call, time.Time{})
+}
+
+// CallDeadline is like Call, but gives up waiting for the reply once deadline
+// has passed, if that is sooner than the transport timeout.  A zero deadline
+// means the transport timeout alone applies.
+//
+// Calls may be made concurrently; they are pipelined on the connection, up
+// to the limit of the client's Window.
+func (c *Client) CallDeadline(call interface{}, deadline time.Time) (io.ReadSeeker, error) {
 	retries := 5
 
+	var hdr *Header
+	if h, ok := call.(interface{ RPCHeader() *Header }); ok {
+		hdr = h.RPCHeader()
+	}
+
 	msg := &message{
 		Xid:  atomic.AddUint32(&xid, 1),
 		Body: call,
 	}
 
-retry:
-	w := new(bytes.Buffer)
-	if err := xdr.Write(w, msg); err != nil {
-		return nil, err
+marshal:
+	// send the shorthand of the credential if the server gave us one
+	var cred Auth
+	short := false
+	if hdr != nil {
+		cred = hdr.Cred
+		if sc, ok := c.shortCred(cred); ok {
+			hdr.Cred = sc
+			short = true
+		}
 	}
 
-	if _, err := c.Write(w.Bytes()); err != nil {
-		return nil, err
+	w := new(bytes.Buffer)
+	err := xdr.Write(w, msg)
+	if short {
+		hdr.Cred = cred
 	}
-
-	res, err := c.recv()
 	if err != nil {
 		return nil, err
 	}
 
-	xid, err := xdr.ReadUint32(res)
+retry:
+	res, err := c.roundTrip(msg.Xid, w.Bytes(), deadline)
 	if err != nil {
 		return nil, err
 	}
 
-	if xid != msg.Xid {
-		// emulate Linux behaviour for xid mismatch
-		if retries > 0 {
-			util.Debugf("Retrying on xid mismatch")
-			retries--
-			goto retry
-		}
-		return nil, fmt.Errorf("xid did not match, expected: %x, received: %x", msg.Xid, xid)
+	res, verf, err := decodeReply(msg.Xid, res)
+	if hdr != nil {
+		fillReplyError(err, hdr)
+		c.updateShortCred(cred, verf, err)
 	}
 
-	mtype, err := xdr.ReadUint32(res)
-	if err != nil {
-		return nil, err
+	// a server may forget shorthands at any time, the full credential
+	// has to be sent again
+	if e, ok := err.(*AuthError); ok && short && e.Status == AuthRejectedCred {
+		util.Debugf("rpc: shorthand credential rejected, resending the full one")
+		msg.Xid = atomic.AddUint32(&xid, 1)
+		goto marshal
 	}
 
-	if mtype != 1 {
-		return nil, fmt.Errorf("message as not a reply: %d", mtype)
+	// emulate Linux behaviour for GARBAGE_ARGS
+	if err == ErrGarbageArgs && retries > 0 {
+		util.Debugf("Retrying on GARBAGE_ARGS per linux semantics")
+		retries--
+		atomic.AddUint64(&c.retransmits, 1)
+		goto retry
 	}
 
-	status, err := xdr.ReadUint32(res)
-	if err != nil {
-		return nil, err
+	return res, err
+}
+
+// shortCred returns the shorthand the server gave for cred, if any
+func (c *Client) shortCred(cred Auth) (Auth, bool) {
+	if cred.Flavor == AuthFlavorNull {
+		return Auth{}, false
 	}
 
-	switch status {
-	case MsgAccepted:
+	c.Lock()
+	defer c.Unlock()
 
-		// padding
-		_, err = xdr.ReadUint32(res)
-		if err != nil {
-			panic(err.Error())
-		}
+	sc, ok := c.shortCreds[authKey(cred)]
+	return sc, ok
+}
 
-		opaque_len, err := xdr.ReadUint32(res)
-		if err != nil {
-			panic(err.Error())
+// updateShortCred keeps track of the shorthand for cred from the reply
+// verifier verf, or forgets it when it was rejected.
+func (c *Client) updateShortCred(cred Auth, verf Auth, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := err.(*AuthError); ok && e.Status == AuthRejectedCred {
+		delete(c.shortCreds, authKey(cred))
+		return
+	}
+
+	if err != nil || verf.Flavor != AuthFlavorShort || cred.Flavor == AuthFlavorNull {
+		return
+	}
+
+	if c.shortCreds == nil {
+		c.shortCreds = make(map[string]Auth)
+	}
+	c.shortCreds[authKey(cred)] = Auth{Flavor: AuthFlavorShort, Body: verf.Body}
+}
+
+func authKey(a Auth) string {
+	return fmt.Sprintf("%d:%x", a.Flavor, a.Body)
+}
+
+// fillReplyError completes the errors of DecodeReply with what is known
+// about the call
+func fillReplyError(err error, h *Header) {
+	switch e := err.(type) {
+	case *AuthError:
+		e.Flavor = h.Cred.Flavor
+	case *ProgMismatchError:
+		e.Prog, e.Vers = h.Prog, h.Vers
+	}
+}
+
+// maxAuthBytes is the longest body an auth or verifier may have, RFC 5531
+// section 8.2
+const maxAuthBytes = 400
+
+// DecodeReply checks the reply header in res, which must be the reply to the
+// call with the given xid, and returns res positioned at the results of the
+// procedure.  Malformed replies are errors, never panics.
+//
+// Calls the server did not execute fail with ErrGarbageArgs, an
+// *AcceptError, *ProgMismatchError, *RPCMismatchError or *AuthError.  The
+// program and credential of the call are not known here, so the Prog, Vers
+// and Flavor fields of those errors are left for the caller to fill in.
+func DecodeReply(xid uint32, res io.ReadSeeker) (io.ReadSeeker, error) {
+	res, _, err := decodeReply(xid, res)
+	return res, err
+}
+
+// decodeReply is DecodeReply, also returning the verifier of an accepted
+// reply
+func decodeReply(xid uint32, res io.ReadSeeker) (io.ReadSeeker, Auth, error) {
+	var hdr struct {
+		Xid    uint32
+		Mtype  uint32
+		Status uint32
+	}
+	if err := xdr.Read(res, &hdr); err != nil {
+		return nil, Auth{}, err
+	}
+
+	if hdr.Xid != xid {
+		return nil, Auth{}, fmt.Errorf("xid did not match, expected: %x, received: %x", xid, hdr.Xid)
+	}
+
+	if hdr.Mtype != 1 {
+		return nil, Auth{}, fmt.Errorf("message as not a reply: %d", hdr.Mtype)
+	}
+
+	switch hdr.Status {
+	case MsgAccepted:
+		var verf Auth
+		if err := xdr.Read(res, &verf); err != nil {
+			return nil, Auth{}, err
+		}
+		if len(verf.Body) > maxAuthBytes {
+			return nil, Auth{}, fmt.Errorf("rpc: verifier of %d bytes is too long", len(verf.Body))
+		}
+		if !knownVerifier(verf.Flavor) {
+			return nil, Auth{}, fmt.Errorf("rpc: reply verifier has unknown flavor %d", verf.Flavor)
 		}
 
-		_, err = res.Seek(int64(opaque_len), io.SeekCurrent)
+		acceptStatus, err := xdr.ReadUint32(res)
 		if err != nil {
-			panic(err.Error())
+			return nil, Auth{}, err
 		}
 
-		acceptStatus, _ := xdr.ReadUint32(res)
-
 		switch acceptStatus {
 		case Success:
-			return res, nil
-		case ProgUnavail:
-			return nil, fmt.Errorf("rpc: PROG_UNAVAIL - server does not recognize the program number")
-		case ProgMismatch:
-			return nil, fmt.Errorf("rpc: PROG_MISMATCH - program version does not exist on the server")
-		case ProcUnavail:
-			return nil, fmt.Errorf("rpc: PROC_UNAVAIL - unrecognized procedure number")
+			return res, verf, nil
 		case GarbageArgs:
-			// emulate Linux behaviour for GARBAGE_ARGS
-			if retries > 0 {
-				util.Debugf("Retrying on GARBAGE_ARGS per linux semantics")
-				retries--
-				goto retry
+			return nil, Auth{}, ErrGarbageArgs
+		case ProgMismatch:
+			var v struct{ Low, High uint32 }
+			if err := xdr.Read(res, &v); err != nil {
+				return nil, Auth{}, err
 			}
-
-			return nil, fmt.Errorf("rpc: GARBAGE_ARGS - rpc arguments cannot be XDR decoded")
-		case SystemErr:
-			return nil, fmt.Errorf("rpc: SYSTEM_ERR - unknown error on server")
+			return nil, Auth{}, &ProgMismatchError{Low: v.Low, High: v.High}
 		default:
-			return nil, fmt.Errorf("rpc: unknown accepted status error: %d", acceptStatus)
+			return nil, Auth{}, &AcceptError{Status: acceptStatus}
 		}
 
 	case MsgDenied:
-		rejectStatus, _ := xdr.ReadUint32(res)
+		rejectStatus, err := xdr.ReadUint32(res)
+		if err != nil {
+			return nil, Auth{}, err
+		}
+
 		switch rejectStatus {
 		case RpcMismatch:
-			return nil, fmt.Errorf("rejectedStatus RPC Mismatch: %+v", call)
+			var v struct{ Low, High uint32 }
+			if err := xdr.Read(res, &v); err != nil {
+				return nil, Auth{}, err
+			}
+			return nil, Auth{}, &RPCMismatchError{Low: v.Low, High: v.High}
 		case RpcAuthError:
-			return nil, fmt.Errorf("rejectedStatus RPC Auth Error: %+v", call)
+			e := new(AuthError)
+			if e.Status, err = xdr.ReadUint32(res); err != nil {
+				return nil, Auth{}, err
+			}
+			return nil, Auth{}, e
 		default:
-			return nil, fmt.Errorf("rejectedStatus was not valid: %d: %+v", rejectStatus, call)
+			return nil, Auth{}, fmt.Errorf("rejectedStatus was not valid: %d", rejectStatus)
 		}
 
 	default:
-		return nil, fmt.Errorf("rejectedStatus was not valid: %d", status)
+		return nil, Auth{}, fmt.Errorf("rejectedStatus was not valid: %d", hdr.Status)
+	}
+}
+
+// knownVerifier reports whether a server may answer with a verifier of flavor
+func knownVerifier(flavor uint32) bool {
+	switch flavor {
+	case AuthFlavorNull, AuthFlavorUnix, AuthFlavorShort, AuthFlavorDH, AuthFlavorRPCSecGSS:
+		return true
 	}
 
-	panic("unreachable")
+	return false
 }
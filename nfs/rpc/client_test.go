@@ -0,0 +1,283 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+type testCall struct {
+	Header
+	Value uint32
+}
+
+// serveReversed reads n calls, then answers them in reverse order, echoing
+// the argument of each call.
+func serveReversed(t *testing.T, conn net.Conn, n int) {
+	r := bufio.NewReader(conn)
+
+	type call struct{ xid, value uint32 }
+	var calls []call
+	for i := 0; i < n; i++ {
+		var hdr uint32
+		if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+			t.Errorf("reading record: %s", err)
+			return
+		}
+		buf := make([]byte, hdr&0x7fffffff)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Errorf("reading record: %s", err)
+			return
+		}
+
+		// xid, msgtype, rpcvers, prog, vers, proc, cred, verf
+		var msg struct {
+			Xid     uint32
+			Msgtype uint32
+			Header
+			Value uint32
+		}
+		if err := xdr.Read(bytes.NewReader(buf), &msg); err != nil {
+			t.Errorf("decoding call: %s", err)
+			return
+		}
+		calls = append(calls, call{msg.Xid, msg.Value})
+	}
+
+	for i := len(calls) - 1; i >= 0; i-- {
+		w := new(bytes.Buffer)
+		xdr.Write(w, []uint32{calls[i].xid, 1, MsgAccepted, 0, 0, Success, calls[i].value})
+		// drop the array length
+		reply := w.Bytes()[4:]
+
+		hdr := make([]byte, 4)
+		binary.BigEndian.PutUint32(hdr, uint32(len(reply))|0x80000000)
+		conn.Write(append(hdr, reply...))
+	}
+}
+
+func TestClientPipelining(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	const n = 4
+	c := NewClient(cconn)
+	c.SetWindow(NewFixedWindow(n))
+
+	go serveReversed(t, sconn, n)
+
+	var wg sync.WaitGroup
+	for i := uint32(0); i < n; i++ {
+		wg.Add(1)
+		go func(i uint32) {
+			defer wg.Done()
+
+			res, err := c.Call(&testCall{Header: Header{Rpcvers: 2, Cred: AuthNull, Verf: AuthNull}, Value: i})
+			if err != nil {
+				t.Errorf("call %d: %s", i, err)
+				return
+			}
+
+			v, err := xdr.ReadUint32(res)
+			if err != nil || v != i {
+				t.Errorf("call %d: got reply %d, %v", i, v, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestClientTimeout(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	// swallow calls, never reply
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := sconn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	c := NewClient(cconn)
+	c.SetTimeout(50 * time.Millisecond)
+	_, err := c.Call(&testCall{Header: Header{Rpcvers: 2, Cred: AuthNull, Verf: AuthNull}})
+	if err != ErrTimeout {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+}
+
+func TestAdaptiveWindow(t *testing.T) {
+	w := NewAdaptiveWindow(1, 8)
+
+	// fast, steady replies grow the window
+	for i := 0; i < 100; i++ {
+		w.acquire(time.Time{})
+		w.release(time.Millisecond, false)
+	}
+	if w.Limit() != 8 {
+		t.Fatalf("expected window to grow to 8, got %d", w.Limit())
+	}
+
+	// congestion halves it
+	w.acquire(time.Time{})
+	w.release(time.Millisecond, true)
+	if w.Limit() != 4 {
+		t.Fatalf("expected window to halve to 4, got %d", w.Limit())
+	}
+
+	// and so does latency well above the baseline
+	time.Sleep(2 * time.Millisecond)
+	w.acquire(time.Time{})
+	w.release(10*time.Millisecond, false)
+	if w.Limit() != 2 {
+		t.Fatalf("expected window to halve to 2, got %d", w.Limit())
+	}
+}
+
+func TestCompressConn(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	go func() {
+		conn, err := AcceptCompression(sconn)
+		if err != nil {
+			t.Errorf("accept: %s", err)
+			return
+		}
+		serveReversed(t, conn, 1)
+	}()
+
+	conn, err := CompressConn(cconn)
+	if err != nil {
+		t.Fatalf("negotiating compression: %s", err)
+	}
+
+	c := NewClient(conn)
+	res, err := c.Call(&testCall{Header: Header{Rpcvers: 2, Cred: AuthNull, Verf: AuthNull}, Value: 42})
+	if err != nil {
+		t.Fatalf("call: %s", err)
+	}
+
+	if v, err := xdr.ReadUint32(res); err != nil || v != 42 {
+		t.Fatalf("got reply %d, %v", v, err)
+	}
+}
+
+func TestReplyErrors(t *testing.T) {
+	s := NewServer()
+	s.Register(100, 3, func(call *ServerCall, w io.Writer) error {
+		if call.Cred.Flavor != AuthFlavorUnix {
+			return &AuthError{Status: AuthTooWeak}
+		}
+		return nil
+	})
+
+	c := s.Pipe()
+	defer c.Close()
+
+	_, err := c.Call(&testCall{Header: Header{Rpcvers: 2, Prog: 100, Vers: 4, Cred: AuthNull, Verf: AuthNull}})
+	if e, ok := err.(*ProgMismatchError); !ok || *e != (ProgMismatchError{100, 4, 3, 3}) {
+		t.Fatalf("expected a program mismatch, got %#v", err)
+	}
+
+	_, err = c.Call(&testCall{Header: Header{Rpcvers: 2, Prog: 100, Vers: 3, Cred: AuthNull, Verf: AuthNull}})
+	if e, ok := err.(*AuthError); !ok || *e != (AuthError{AuthFlavorNull, AuthTooWeak}) {
+		t.Fatalf("expected an auth error, got %#v", err)
+	}
+
+	_, err = c.Call(&testCall{Header: Header{Rpcvers: 2, Prog: 100, Vers: 3, Cred: NewAuthUnix("test", 0, 0).Auth(), Verf: AuthNull}})
+	if err != nil {
+		t.Fatalf("call: %s", err)
+	}
+}
+
+func TestAuthShort(t *testing.T) {
+	var fullCreds, shortCreds int
+	valid := true
+
+	s := NewServer()
+	s.Register(100, 1, func(call *ServerCall, w io.Writer) error {
+		switch call.Cred.Flavor {
+		case AuthFlavorUnix:
+			fullCreds++
+			call.ReplyVerf = Auth{Flavor: AuthFlavorShort, Body: []byte("shrt")}
+		case AuthFlavorShort:
+			if !valid || string(call.Cred.Body) != "shrt" {
+				return &AuthError{Status: AuthRejectedCred}
+			}
+			shortCreds++
+		}
+		return nil
+	})
+
+	c := s.Pipe()
+	defer c.Close()
+
+	cred := NewAuthUnix("test", 1000, 1000).Auth()
+	call := func() {
+		if _, err := c.Call(&testCall{Header: Header{Rpcvers: 2, Prog: 100, Vers: 1, Cred: cred, Verf: AuthNull}}); err != nil {
+			t.Fatalf("call: %s", err)
+		}
+	}
+
+	call()
+	call()
+	if fullCreds != 1 || shortCreds != 1 {
+		t.Fatalf("expected the shorthand to be used, full %d short %d", fullCreds, shortCreds)
+	}
+
+	// the server forgot the shorthand
+	valid = false
+	call()
+	if fullCreds != 2 {
+		t.Fatalf("expected the full credential to be resent, full %d", fullCreds)
+	}
+}
+
+func TestAuthUnixFields(t *testing.T) {
+	a := NewAuthUnix(string(bytes.Repeat([]byte("h"), 300)), 1000, 100)
+	a.SetPID(4242)
+
+	parsed, err := ParseAuthUnix(a.Auth())
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	if parsed.Stamp != 4242 || len(parsed.Machinename) != MaxMachineNameLen || parsed.Uid != 1000 || parsed.Gid != 100 {
+		t.Fatalf("unexpected credential: %+v", parsed)
+	}
+}
+
+func TestRecordTooLarge(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	// a fragment, then one taking the record past the largest
+	go func() {
+		var b bytes.Buffer
+		binary.Write(&b, binary.BigEndian, uint32(10))
+		b.Write(make([]byte, 10))
+		binary.Write(&b, binary.BigEndian, uint32(0x80000000|maxRecord))
+		cconn.Write(b.Bytes())
+	}()
+
+	if _, err := NewStreamTransport(sconn).Recv(); err != ErrRecordTooLarge {
+		t.Fatalf("got %v", err)
+	}
+}
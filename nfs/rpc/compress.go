@@ -0,0 +1,151 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package rpc
+
+import (
+	"bufio"
+	"compress/flate"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// Compression algorithms that can be negotiated between two endpoints of this
+// package.  Plain NFS peers know nothing about this, so compression is only
+// useful when both ends run this code, e.g. across a WAN link between a client
+// and a gateway.
+const (
+	CompressionNone    = 0
+	CompressionDeflate = 1
+)
+
+// The handshake opens with a magic that a regular rpc peer would read as a
+// record mark for a non-final fragment of over 1GB, which no sane client
+// sends, so a server can tell a negotiating peer apart from a plain one.
+var compressMagic = [4]byte{'N', 'F', 'S', 'Z'}
+
+// ErrCompressionRefused is returned by CompressConn when the peer does not
+// support any of the offered algorithms.
+var ErrCompressionRefused = errors.New("rpc: peer refused compression")
+
+// CompressConn negotiates compression with the server end of conn, offering
+// the algorithms in algs in order of preference, and returns a conn that
+// compresses everything written to and read from it.
+func CompressConn(conn net.Conn, algs ...byte) (net.Conn, error) {
+	if len(algs) == 0 {
+		algs = []byte{CompressionDeflate}
+	}
+
+	hello := append(compressMagic[:], byte(len(algs)))
+	if _, err := conn.Write(append(hello, algs...)); err != nil {
+		return nil, err
+	}
+
+	var reply [1]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return nil, err
+	}
+
+	switch reply[0] {
+	case CompressionNone:
+		return nil, ErrCompressionRefused
+	case CompressionDeflate:
+		return newDeflateConn(conn, conn), nil
+	default:
+		return nil, errors.New("rpc: peer chose an unknown compression algorithm")
+	}
+}
+
+// AcceptCompression is the server side of CompressConn.  Peers that do not
+// start with the handshake are passed through unchanged, so a server can call
+// it on every accepted connection.
+func AcceptCompression(conn net.Conn) (net.Conn, error) {
+	r := bufio.NewReader(conn)
+	magic, err := r.Peek(len(compressMagic))
+	if err != nil || string(magic) != string(compressMagic[:]) {
+		// let the rpc layer deal with short reads
+		return &bufferedConn{conn, r}, nil
+	}
+	r.Discard(len(compressMagic))
+
+	n, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	algs := make([]byte, n)
+	if _, err = io.ReadFull(r, algs); err != nil {
+		return nil, err
+	}
+
+	var chosen byte = CompressionNone
+	for _, a := range algs {
+		if a == CompressionDeflate {
+			chosen = a
+			break
+		}
+	}
+
+	if _, err = conn.Write([]byte{chosen}); err != nil {
+		return nil, err
+	}
+	if chosen == CompressionNone {
+		return nil, ErrCompressionRefused
+	}
+
+	return newDeflateConn(conn, r), nil
+}
+
+// bufferedConn is a conn whose first bytes have already been read into r
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// deflateConn compresses the stream in both directions.  Every Write is
+// flushed, which ends it on a byte boundary, so that a record is never held
+// back waiting for more data.
+type deflateConn struct {
+	net.Conn
+	r io.ReadCloser
+
+	wlock sync.Mutex
+	w     *flate.Writer
+}
+
+func newDeflateConn(conn net.Conn, r io.Reader) *deflateConn {
+	// BestSpeed, rpc records are small and latency matters more than ratio
+	w, _ := flate.NewWriter(conn, flate.BestSpeed)
+
+	return &deflateConn{
+		Conn: conn,
+		r:    flate.NewReader(r),
+		w:    w,
+	}
+}
+
+func (c *deflateConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *deflateConn) Write(p []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return n, c.w.Flush()
+}
+
+func (c *deflateConn) Close() error {
+	c.r.Close()
+	return c.Conn.Close()
+}
@@ -0,0 +1,84 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package rpc
+
+import "fmt"
+
+// auth_stat values of an AUTH_ERROR rejection, RFC 5531 section 9
+const (
+	AuthOk           = 0
+	AuthBadCred      = 1
+	AuthRejectedCred = 2
+	AuthBadVerf      = 3
+	AuthRejectedVerf = 4
+	AuthTooWeak      = 5
+	AuthInvalidResp  = 6
+	AuthFailed       = 7
+)
+
+var authStatToName = map[uint32]string{
+	AuthOk:           "AUTH_OK",
+	AuthBadCred:      "AUTH_BADCRED",
+	AuthRejectedCred: "AUTH_REJECTEDCRED",
+	AuthBadVerf:      "AUTH_BADVERF",
+	AuthRejectedVerf: "AUTH_REJECTEDVERF",
+	AuthTooWeak:      "AUTH_TOOWEAK",
+	AuthInvalidResp:  "AUTH_INVALIDRESP",
+	AuthFailed:       "AUTH_FAILED",
+}
+
+// AuthError is returned when the server rejects the credentials of a call
+type AuthError struct {
+	// Flavor is the flavor of the rejected credential
+	Flavor uint32
+	Status uint32
+}
+
+func (e *AuthError) Error() string {
+	name, ok := authStatToName[e.Status]
+	if !ok {
+		name = fmt.Sprintf("auth_stat %d", e.Status)
+	}
+
+	return fmt.Sprintf("rpc: AUTH_ERROR - %s for credential flavor %d", name, e.Flavor)
+}
+
+// RPCMismatchError is returned when the server does not speak rpc version 2
+type RPCMismatchError struct {
+	Low, High uint32
+}
+
+func (e *RPCMismatchError) Error() string {
+	return fmt.Sprintf("rpc: RPC_MISMATCH - server supports rpc versions %d to %d", e.Low, e.High)
+}
+
+// ProgMismatchError is returned when the server does not offer the version
+// of the program that was called
+type ProgMismatchError struct {
+	Prog, Vers uint32
+	Low, High  uint32
+}
+
+func (e *ProgMismatchError) Error() string {
+	return fmt.Sprintf("rpc: PROG_MISMATCH - program %d version %d not supported, server has versions %d to %d", e.Prog, e.Vers, e.Low, e.High)
+}
+
+// AcceptError is returned for accepted calls the server could not execute,
+// other than those answered with GARBAGE_ARGS or PROG_MISMATCH
+type AcceptError struct {
+	Status uint32
+}
+
+func (e *AcceptError) Error() string {
+	switch e.Status {
+	case ProgUnavail:
+		return "rpc: PROG_UNAVAIL - server does not recognize the program number"
+	case ProcUnavail:
+		return "rpc: PROC_UNAVAIL - unrecognized procedure number"
+	case SystemErr:
+		return "rpc: SYSTEM_ERR - unknown error on server"
+	default:
+		return fmt.Sprintf("rpc: unknown accepted status error: %d", e.Status)
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package rpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func FuzzDecodeReply(f *testing.F) {
+	words := func(w ...uint32) []byte {
+		b := new(bytes.Buffer)
+		binary.Write(b, binary.BigEndian, w)
+		return b.Bytes()
+	}
+
+	f.Add(words(1, 1, MsgAccepted, AuthFlavorNull, 0, Success, 42))
+	f.Add(words(1, 1, MsgAccepted, AuthFlavorUnix, 4, 0, GarbageArgs))
+	f.Add(words(1, 1, MsgAccepted, AuthFlavorNull, 0xffffffff))
+	f.Add(words(1, 1, MsgDenied, RpcAuthError, 1))
+
+	f.Fuzz(func(t *testing.T, reply []byte) {
+		DecodeReply(1, bytes.NewReader(reply))
+	})
+}
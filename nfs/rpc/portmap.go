@@ -6,6 +6,9 @@ package rpc
 import (
 	"fmt"
 	"io"
+	"net"
+	"strconv"
+	"strings"
 
 	"github.com/go-nfs/nfsv3/nfs/xdr"
 )
@@ -26,6 +29,16 @@ const (
 	IPProtoUDP = 17
 )
 
+// RPCBIND
+// RFC 1833 Section 2
+
+const (
+	RpcbVers3 = 3
+	RpcbVers4 = 4
+
+	RpcbProcGetAddr = 3
+)
+
 type Header struct {
 	Rpcvers uint32
 	Prog    uint32
@@ -35,6 +48,12 @@ type Header struct {
 	Verf    Auth
 }
 
+// RPCHeader returns h.  Since the header is embedded in every call struct,
+// this lets the call's header be recovered from an opaque call value.
+func (h *Header) RPCHeader() *Header {
+	return h
+}
+
 type Mapping struct {
 	Prog uint32
 	Vers uint32
@@ -42,6 +61,16 @@ type Mapping struct {
 	Port uint32
 }
 
+// RPCB is the rpcb struct of RFC 1833, naming a service by netid and
+// universal address rather than protocol number and port
+type RPCB struct {
+	Prog  uint32
+	Vers  uint32
+	Netid string
+	Addr  string
+	Owner string
+}
+
 type Portmapper struct {
 	*Client
 	host string
@@ -77,6 +106,62 @@ func (p *Portmapper) Unsetport(mapping Mapping) (bool, error) {
 	return xdr.ReadBoolean(res)
 }
 
+// GetAddr asks rpcbind version vers (3 or 4) for the universal address of a
+// service.  It returns an empty string if the service is not registered.
+func (p *Portmapper) GetAddr(vers uint32, rpcb RPCB) (string, error) {
+	res, err := p.Call(struct {
+		Header
+		RPCB
+	}{
+		Header: Header{
+			Rpcvers: 2,
+			Prog:    PmapProg,
+			Vers:    vers,
+			Proc:    RpcbProcGetAddr,
+			Cred:    AuthNull,
+			Verf:    AuthNull,
+		},
+		RPCB: rpcb,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	uaddr, err := xdr.ReadOpaque(res)
+	return string(uaddr), err
+}
+
+// Lookup returns the port of a service, or 0 if it is not registered.  It
+// asks with RPCBPROC_GETADDR first, which servers on IPv6 and those with the
+// version 2 interface disabled require, and falls back to PMAPPROC_GETPORT
+// for servers that only speak portmap.
+func (p *Portmapper) Lookup(mapping Mapping) (int, error) {
+	rpcb := RPCB{
+		Prog:  mapping.Prog,
+		Vers:  mapping.Vers,
+		Netid: netid(mapping.Prot, p.host),
+	}
+
+	for _, vers := range []uint32{RpcbVers4, RpcbVers3} {
+		uaddr, err := p.GetAddr(vers, rpcb)
+		if err != nil {
+			if isUnsupported(err) {
+				continue
+			}
+			return 0, err
+		}
+
+		if uaddr == "" {
+			return 0, nil
+		}
+
+		_, port, err := ParseUaddr(uaddr)
+		return port, err
+	}
+
+	return p.Getport(mapping)
+}
+
 func (p *Portmapper) call(proc uint32, mapping Mapping) (io.ReadSeeker, error) {
 	return p.Call(struct {
 		Header
@@ -94,10 +179,70 @@ func (p *Portmapper) call(proc uint32, mapping Mapping) (io.ReadSeeker, error) {
 	})
 }
 
+// isUnsupported reports whether err says the server lacks the version or
+// procedure called
+func isUnsupported(err error) bool {
+	switch e := err.(type) {
+	case *ProgMismatchError:
+		return true
+	case *AcceptError:
+		return e.Status == ProcUnavail || e.Status == ProgUnavail
+	}
+
+	return false
+}
+
+// netid returns the rpcbind netid for protocol prot to host
+func netid(prot uint32, host string) string {
+	id := "tcp"
+	if prot == IPProtoUDP {
+		id = "udp"
+	}
+
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		id += "6"
+	}
+
+	return id
+}
+
+// ParseUaddr splits a universal address, RFC 5665 section 5.2.3, into its
+// host and port.  For IP the port is given by the last two dotted fields.
+func ParseUaddr(uaddr string) (string, int, error) {
+	i := strings.LastIndexByte(uaddr, '.')
+	if i < 0 {
+		return "", 0, fmt.Errorf("rpc: malformed universal address %q", uaddr)
+	}
+	j := strings.LastIndexByte(uaddr[:i], '.')
+	if j < 0 {
+		return "", 0, fmt.Errorf("rpc: malformed universal address %q", uaddr)
+	}
+
+	hi, err := strconv.ParseUint(uaddr[j+1:i], 10, 8)
+	if err != nil {
+		return "", 0, fmt.Errorf("rpc: malformed universal address %q", uaddr)
+	}
+	lo, err := strconv.ParseUint(uaddr[i+1:], 10, 8)
+	if err != nil {
+		return "", 0, fmt.Errorf("rpc: malformed universal address %q", uaddr)
+	}
+
+	return uaddr[:j], int(hi<<8 | lo), nil
+}
+
+// NewPortmapper returns a Portmapper for host talking over client
+func NewPortmapper(client *Client, host string) *Portmapper {
+	return &Portmapper{client, host}
+}
+
 func DialPortmapper(net, host string) (*Portmapper, error) {
-	client, err := DialTCP(net, nil, fmt.Sprintf("%s:%d", host, PmapPort))
+	client, err := DialTCP(net, nil, joinHostPort(host, PmapPort))
 	if err != nil {
 		return nil, err
 	}
 	return &Portmapper{client, host}, nil
 }
+
+func joinHostPort(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
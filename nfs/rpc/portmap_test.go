@@ -0,0 +1,77 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package rpc
+
+import (
+	"io"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+func TestParseUaddr(t *testing.T) {
+	for _, tc := range []struct {
+		uaddr string
+		host  string
+		port  int
+	}{
+		{"10.0.0.1.8.1", "10.0.0.1", 2049},
+		{"fe80::1.0.111", "fe80::1", 111},
+		{"::.3.235", "::", 1003},
+	} {
+		host, port, err := ParseUaddr(tc.uaddr)
+		if err != nil || host != tc.host || port != tc.port {
+			t.Errorf("%q: got %s %d %v", tc.uaddr, host, port, err)
+		}
+	}
+
+	for _, uaddr := range []string{"", "1.2", "host.1.256", "host.x.1"} {
+		if _, _, err := ParseUaddr(uaddr); err == nil {
+			t.Errorf("%q: expected an error", uaddr)
+		}
+	}
+}
+
+func TestPortmapperLookup(t *testing.T) {
+	getport := func(call *ServerCall, w io.Writer) error {
+		if call.Proc != PmapProcGetPort {
+			return ErrProcUnavail
+		}
+		return xdr.Write(w, uint32(2049))
+	}
+	getaddr := func(call *ServerCall, w io.Writer) error {
+		var rpcb RPCB
+		if call.Proc != RpcbProcGetAddr || xdr.Read(call.Args, &rpcb) != nil {
+			return ErrGarbageArgs
+		}
+		if rpcb.Netid != "tcp6" {
+			return xdr.Write(w, "")
+		}
+		return xdr.Write(w, "::1.8.2")
+	}
+
+	// portmap only
+	s := NewServer()
+	s.Register(PmapProg, PmapVers, getport)
+	pm := &Portmapper{s.Pipe(), "127.0.0.1"}
+	defer pm.Close()
+	if port, err := pm.Lookup(Mapping{Prog: 100003, Vers: 3, Prot: IPProtoTCP}); err != nil || port != 2049 {
+		t.Fatalf("portmap lookup: %d, %v", port, err)
+	}
+
+	// rpcbind with the version 2 interface disabled
+	s = NewServer()
+	s.Register(PmapProg, RpcbVers4, getaddr)
+	pm = &Portmapper{s.Pipe(), "::1"}
+	defer pm.Close()
+	if port, err := pm.Lookup(Mapping{Prog: 100003, Vers: 3, Prot: IPProtoTCP}); err != nil || port != 2050 {
+		t.Fatalf("rpcbind lookup: %d, %v", port, err)
+	}
+
+	pm = &Portmapper{s.Pipe(), "127.0.0.1"}
+	defer pm.Close()
+	if port, err := pm.Lookup(Mapping{Prog: 100003, Vers: 3, Prot: IPProtoTCP}); err != nil || port != 0 {
+		t.Fatalf("expected an unregistered service, got %d, %v", port, err)
+	}
+}
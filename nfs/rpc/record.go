@@ -0,0 +1,260 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrNotRecorded is returned by a replay transport for a call that has no
+// matching exchange left in the recording
+var ErrNotRecorded = errors.New("rpc: call not in recording")
+
+// Exchange is a call record and the reply record it got
+type Exchange struct {
+	Call  []byte `json:"call"`
+	Reply []byte `json:"reply"`
+}
+
+// recordingTransport copies every completed exchange going through a
+// transport to a golden file, one JSON object per line
+type recordingTransport struct {
+	Transport
+
+	mu      sync.Mutex
+	w       io.Writer
+	pending map[uint32][]byte
+	err     error
+}
+
+// NewRecordingTransport returns a transport forwarding to t and writing every
+// call and its reply to w as a line of JSON, in the order the replies arrive.
+// LoadRecording reads them back for NewReplayTransport.
+func NewRecordingTransport(t Transport, w io.Writer) Transport {
+	return &recordingTransport{
+		Transport: t,
+		w:         w,
+		pending:   make(map[uint32][]byte),
+	}
+}
+
+func (t *recordingTransport) Send(record []byte, deadline time.Time) error {
+	if len(record) >= 4 {
+		t.mu.Lock()
+		t.pending[binary.BigEndian.Uint32(record)] = append([]byte(nil), record...)
+		t.mu.Unlock()
+	}
+
+	return t.Transport.Send(record, deadline)
+}
+
+func (t *recordingTransport) Recv() (io.ReadSeeker, error) {
+	r, err := t.Transport.Recv()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(reply) >= 4 {
+		xid := binary.BigEndian.Uint32(reply)
+
+		t.mu.Lock()
+		if call, ok := t.pending[xid]; ok {
+			delete(t.pending, xid)
+			if t.err == nil {
+				t.err = t.write(Exchange{Call: call, Reply: reply})
+			}
+		}
+		t.mu.Unlock()
+	}
+
+	return bytes.NewReader(reply), nil
+}
+
+func (t *recordingTransport) write(e Exchange) error {
+	return writeExchange(t.w, e)
+}
+
+func writeExchange(w io.Writer, e Exchange) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// WriteRecording writes exchanges as a recording transport does, for
+// recordings made otherwise than by recording a Client
+func WriteRecording(w io.Writer, ex []Exchange) error {
+	for _, e := range ex {
+		if err := writeExchange(w, e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes the underlying transport and reports the first error writing
+// the recording, if any
+func (t *recordingTransport) Close() error {
+	err := t.Transport.Close()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return t.err
+	}
+
+	return err
+}
+
+// LoadRecording reads the exchanges written by a recording transport
+func LoadRecording(r io.Reader) ([]Exchange, error) {
+	var ex []Exchange
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<30)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+
+		var e Exchange
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("recording line %d: %w", line, err)
+		}
+
+		if _, ok := callKey(e.Call); !ok || len(e.Reply) < 4 {
+			return nil, fmt.Errorf("recording line %d: short record", line)
+		}
+
+		ex = append(ex, e)
+	}
+
+	return ex, sc.Err()
+}
+
+// callKey returns what identifies a call across sessions: the program,
+// version, procedure and arguments.  The xid and the credentials (AUTH_UNIX
+// carries a stamp) differ from run to run and are left out.
+func callKey(call []byte) (string, bool) {
+	// xid, mtype, rpcvers, prog, vers, proc
+	off := 24
+	if len(call) < off {
+		return "", false
+	}
+	key := call[12:off]
+
+	// cred and verf
+	for i := 0; i < 2; i++ {
+		if len(call) < off+8 {
+			return "", false
+		}
+		n := int(binary.BigEndian.Uint32(call[off+4:]))
+		if n < 0 || n > len(call) {
+			return "", false
+		}
+		off += 8 + (n+3)&^3
+		if len(call) < off {
+			return "", false
+		}
+	}
+
+	return string(key) + string(call[off:]), true
+}
+
+// replayTransport answers calls from a recording, without any server
+type replayTransport struct {
+	mu      sync.Mutex
+	calls   map[string][][]byte
+	replies chan []byte
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewReplayTransport returns a transport answering each call with the reply
+// recorded for the same call, so a Client can run a recorded session again
+// without the server it was recorded against.  Identical calls get their
+// recorded replies in order, each reply is used once; calls past the end of
+// the recording fail with ErrNotRecorded.
+func NewReplayTransport(ex []Exchange) Transport {
+	t := &replayTransport{
+		calls:   make(map[string][][]byte),
+		replies: make(chan []byte, len(ex)),
+		done:    make(chan struct{}),
+	}
+
+	for _, e := range ex {
+		if key, ok := callKey(e.Call); ok {
+			t.calls[key] = append(t.calls[key], e.Reply)
+		}
+	}
+
+	return t
+}
+
+func (t *replayTransport) Send(record []byte, deadline time.Time) error {
+	key, ok := callKey(record)
+	if !ok {
+		return ErrNotRecorded
+	}
+
+	t.mu.Lock()
+	replies := t.calls[key]
+	if len(replies) == 0 {
+		t.mu.Unlock()
+		return ErrNotRecorded
+	}
+	t.calls[key] = replies[1:]
+	t.mu.Unlock()
+
+	// answer with the xid of this call rather than the recorded one
+	reply := append([]byte(nil), replies[0]...)
+	copy(reply, record[:4])
+
+	select {
+	case t.replies <- reply:
+		return nil
+	case <-t.done:
+		return net.ErrClosed
+	}
+}
+
+func (t *replayTransport) Recv() (io.ReadSeeker, error) {
+	select {
+	case reply := <-t.replies:
+		return bytes.NewReader(reply), nil
+	case <-t.done:
+		return nil, io.EOF
+	}
+}
+
+func (t *replayTransport) Close() error {
+	t.once.Do(func() { close(t.done) })
+	return nil
+}
+
+func (t *replayTransport) LocalAddr() net.Addr  { return replayAddr{} }
+func (t *replayTransport) RemoteAddr() net.Addr { return replayAddr{} }
+
+type replayAddr struct{}
+
+func (replayAddr) Network() string { return "replay" }
+func (replayAddr) String() string  { return "replay" }
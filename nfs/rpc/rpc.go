@@ -5,12 +5,31 @@ package rpc
 
 import (
 	"bytes"
+	"fmt"
 	"math/rand"
+	"os"
 	"time"
 
 	"github.com/go-nfs/nfsv3/nfs/xdr"
 )
 
+// Auth flavors, RFC 5531 Section 8.2
+const (
+	AuthFlavorNull      = 0
+	AuthFlavorUnix      = 1
+	AuthFlavorShort     = 2
+	AuthFlavorDH        = 3
+	AuthFlavorRPCSecGSS = 6
+)
+
+// Pseudo-flavors for Kerberos V5 over RPCSEC_GSS, as listed by MOUNT and
+// SECINFO, RFC 2623 section 2.2
+const (
+	AuthFlavorKRB5  = 390003
+	AuthFlavorKRB5I = 390004
+	AuthFlavorKRB5P = 390005
+)
+
 type Auth struct {
 	Flavor uint32
 	Body   []byte
@@ -37,12 +56,72 @@ func NewAuthUnix(machinename string, uid, gid uint32) *AuthUnix {
 	}
 }
 
+// MaxMachineNameLen is the longest machinename AUTH_UNIX allows, longer
+// names are truncated when the credential is encoded
+const MaxMachineNameLen = 255
+
+// The ids of the nobody user, which servers map unknown or squashed users to
+const (
+	NobodyUID = 65534
+	NobodyGID = 65534
+)
+
+// NewAuthUnixFromOS returns an AUTH_UNIX credential for the user running the
+// process, naming the host it runs on.  On platforms without unix users, such
+// as Windows, the credential is nobody's.  The stamp is the process id, which
+// some filers log to tell clients on the same host apart.
+func NewAuthUnixFromOS() (*AuthUnix, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	uid, gid := osUser()
+	a := NewAuthUnix(hostname, uid, gid)
+	a.SetPID(os.Getpid())
+
+	return a, nil
+}
+
+// SetMachineName sets the machinename sent in the credential
+func (a *AuthUnix) SetMachineName(name string) {
+	a.Machinename = name
+}
+
+// SetStamp sets the arbitrary id the credential carries
+func (a *AuthUnix) SetStamp(stamp uint32) {
+	a.Stamp = stamp
+}
+
+// SetPID uses the process id pid as the stamp of the credential
+func (a *AuthUnix) SetPID(pid int) {
+	a.Stamp = uint32(pid)
+}
+
 // Auth converts a into an Auth opaque struct
 func (a AuthUnix) Auth() Auth {
+	if len(a.Machinename) > MaxMachineNameLen {
+		a.Machinename = a.Machinename[:MaxMachineNameLen]
+	}
+
 	w := new(bytes.Buffer)
 	xdr.Write(w, a)
 	return Auth{
-		1,
+		AuthFlavorUnix,
 		w.Bytes(),
 	}
 }
+
+// ParseAuthUnix decodes the body of an AUTH_UNIX credential
+func ParseAuthUnix(a Auth) (*AuthUnix, error) {
+	if a.Flavor != AuthFlavorUnix {
+		return nil, fmt.Errorf("rpc: auth flavor %d is not AUTH_UNIX", a.Flavor)
+	}
+
+	au := new(AuthUnix)
+	if err := xdr.Read(bytes.NewReader(a.Body), au); err != nil {
+		return nil, err
+	}
+
+	return au, nil
+}
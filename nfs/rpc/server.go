@@ -0,0 +1,217 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package rpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/util"
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+// Errors a Handler returns to select the accept status of the reply.  An
+// *AuthError rejects the call, ErrDrop sends no reply at all, any other error
+// is answered with SYSTEM_ERR.
+var (
+	ErrProcUnavail = errors.New("rpc: procedure unavailable")
+	ErrGarbageArgs = errors.New("rpc: garbage arguments")
+	ErrDrop        = errors.New("rpc: reply dropped")
+)
+
+// ServerCall is a call as received by a Server
+type ServerCall struct {
+	Header
+	Xid uint32
+
+	// Args holds the encoded arguments of the procedure
+	Args io.Reader
+
+	// RemoteAddr is the address of the client, as far as the transport
+	// knows it
+	RemoteAddr net.Addr
+
+	// ReplyVerf is the verifier sent with the reply, AUTH_NULL unless the
+	// handler sets it, e.g. to an AUTH_SHORT shorthand for the credential
+	ReplyVerf Auth
+}
+
+// Handler serves the calls to one version of a program.  It writes the
+// results of the procedure to w.
+type Handler func(call *ServerCall, w io.Writer) error
+
+type progVers struct {
+	prog, vers uint32
+}
+
+// Server dispatches rpc calls to the handlers registered for their program
+// and version.
+type Server struct {
+	sync.RWMutex
+	handlers map[progVers]Handler
+}
+
+// NewServer returns a server without any programs
+func NewServer() *Server {
+	return &Server{handlers: make(map[progVers]Handler)}
+}
+
+// Register has calls to version vers of program prog served by h
+func (s *Server) Register(prog, vers uint32, h Handler) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.handlers[progVers{prog, vers}] = h
+}
+
+// Serve accepts connections on l and serves each of them, until accepting
+// fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves the calls arriving on the stream conn, until it fails
+func (s *Server) ServeConn(conn net.Conn) {
+	s.ServeTransport(NewStreamTransport(conn))
+}
+
+// ServeTransport serves the calls arriving on t, until it fails.  Calls are
+// served concurrently, replies are sent as soon as they are ready.
+func (s *Server) ServeTransport(t Transport) {
+	defer t.Close()
+
+	for {
+		rec, err := t.Recv()
+		if err != nil {
+			if err != io.EOF {
+				util.Debugf("rpc server: %s", err)
+			}
+			return
+		}
+
+		go func() {
+			reply := s.dispatch(rec, t.RemoteAddr())
+			if reply == nil {
+				return
+			}
+
+			if err := t.Send(reply, time.Time{}); err != nil {
+				util.Debugf("rpc server: sending reply: %s", err)
+				t.Close()
+			}
+		}()
+	}
+}
+
+// Pipe returns a client connected to the server over an in-memory pipe, for
+// exercising the whole stack without sockets.  Closing the client ends the
+// connection.
+func (s *Server) Pipe() *Client {
+	cconn, sconn := net.Pipe()
+	go s.ServeConn(sconn)
+
+	return NewClient(cconn)
+}
+
+// dispatch decodes a call, runs its handler and returns the encoded reply, or
+// nil when the record should be dropped.
+func (s *Server) dispatch(rec io.Reader, addr net.Addr) []byte {
+	var msg struct {
+		Xid     uint32
+		Msgtype uint32
+		Header
+	}
+	if err := xdr.Read(rec, &msg); err != nil || msg.Msgtype != 0 {
+		util.Debugf("rpc server: dropping malformed call")
+		return nil
+	}
+
+	w := new(bytes.Buffer)
+	writeWords(w, msg.Xid, 1)
+	if msg.Rpcvers != 2 {
+		writeWords(w, MsgDenied, RpcMismatch, 2, 2)
+		return w.Bytes()
+	}
+
+	s.RLock()
+	h, ok := s.handlers[progVers{msg.Prog, msg.Vers}]
+	var low, high uint32
+	found := false
+	if !ok {
+		for pv := range s.handlers {
+			if pv.prog != msg.Prog {
+				continue
+			}
+			if !found || pv.vers < low {
+				low = pv.vers
+			}
+			if !found || pv.vers > high {
+				high = pv.vers
+			}
+			found = true
+		}
+	}
+	s.RUnlock()
+
+	if !ok {
+		// accepted, with a null verifier
+		writeWords(w, MsgAccepted, AuthFlavorNull, 0)
+		if found {
+			writeWords(w, ProgMismatch, low, high)
+		} else {
+			writeWords(w, ProgUnavail)
+		}
+		return w.Bytes()
+	}
+
+	call := &ServerCall{
+		Header:     msg.Header,
+		Xid:        msg.Xid,
+		Args:       rec,
+		RemoteAddr: addr,
+	}
+
+	res := new(bytes.Buffer)
+	err := h(call, res)
+	if err == ErrDrop {
+		return nil
+	}
+	if e, ok := err.(*AuthError); ok {
+		writeWords(w, MsgDenied, RpcAuthError, e.Status)
+		return w.Bytes()
+	}
+
+	writeWords(w, MsgAccepted)
+	xdr.Write(w, call.ReplyVerf)
+	switch err {
+	case nil:
+		writeWords(w, Success)
+		w.Write(res.Bytes())
+	case ErrProcUnavail:
+		writeWords(w, ProcUnavail)
+	case ErrGarbageArgs:
+		writeWords(w, GarbageArgs)
+	default:
+		util.Debugf("rpc server: prog %d proc %d: %s", msg.Prog, msg.Proc, err)
+		writeWords(w, SystemErr)
+	}
+
+	return w.Bytes()
+}
+
+func writeWords(w io.Writer, words ...uint32) {
+	binary.Write(w, binary.BigEndian, words)
+}
@@ -4,69 +4,97 @@
 package rpc
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
 	"sync"
 	"time"
 )
 
+// maxRecord is the largest record a stream transport receives, its fragments
+// together, well above the largest READ or WRITE
+const maxRecord = 1 << 24
+
+// ErrRecordTooLarge is returned by the Recv of a stream transport, which
+// fails, when a record is larger than it takes
+var ErrRecordTooLarge = errors.New("rpc: record too large")
+
+// tcpTransport carries records over a stream using record marking (RFC 5531
+// section 11).  Besides TCP it serves any stream conn, e.g. TLS or a pipe.
 type tcpTransport struct {
-	r       io.Reader
-	wc      net.Conn
-	timeout time.Duration
+	r  io.Reader
+	wc net.Conn
 
 	rlock, wlock sync.Mutex
 }
 
-// Get the response from the conn, buffer the contents, and return a reader to
-// it.
-func (t *tcpTransport) recv() (io.ReadSeeker, error) {
+// NewStreamTransport returns a transport using record marking over conn
+func NewStreamTransport(conn net.Conn) Transport {
+	return &tcpTransport{
+		r:  bufio.NewReader(conn),
+		wc: conn,
+	}
+}
+
+// Get the next record from the conn, buffer the contents, and return a reader
+// to it.  Records may be split into several fragments, the last of which has
+// the top bit of its header set.  A record of more than maxRecord bytes is
+// not read, and the stream left misaligned, so the conn is to be closed.
+func (t *tcpTransport) Recv() (io.ReadSeeker, error) {
 	t.rlock.Lock()
 	defer t.rlock.Unlock()
-	if t.timeout != 0 {
-		deadline := time.Now().Add(t.timeout)
-		t.wc.SetReadDeadline(deadline)
-	}
 
-	var hdr uint32
-	if err := binary.Read(t.r, binary.BigEndian, &hdr); err != nil {
-		return nil, err
-	}
+	var buf []byte
+	for {
+		var hdr uint32
+		if err := binary.Read(t.r, binary.BigEndian, &hdr); err != nil {
+			return nil, err
+		}
 
-	buf := make([]byte, hdr&0x7fffffff)
-	if _, err := io.ReadFull(t.r, buf); err != nil {
-		return nil, err
-	}
+		n := int(hdr & 0x7fffffff)
+		if len(buf)+n > maxRecord {
+			return nil, ErrRecordTooLarge
+		}
+		frag := make([]byte, n)
+		if _, err := io.ReadFull(t.r, frag); err != nil {
+			return nil, err
+		}
+		if buf == nil {
+			buf = frag
+		} else {
+			buf = append(buf, frag...)
+		}
 
-	return bytes.NewReader(buf), nil
+		if hdr&0x80000000 != 0 {
+			return bytes.NewReader(buf), nil
+		}
+	}
 }
 
-func (t *tcpTransport) Write(buf []byte) (int, error) {
+func (t *tcpTransport) Send(buf []byte, deadline time.Time) error {
 	t.wlock.Lock()
 	defer t.wlock.Unlock()
 
 	var hdr uint32 = uint32(len(buf)) | 0x80000000
 	b := make([]byte, 4)
 	binary.BigEndian.PutUint32(b, hdr)
-	if t.timeout != 0 {
-		deadline := time.Now().Add(t.timeout)
-		t.wc.SetWriteDeadline(deadline)
-	}
-	n, err := t.wc.Write(append(b, buf...))
+	t.wc.SetWriteDeadline(deadline)
+	_, err := t.wc.Write(append(b, buf...))
 
-	return n, err
+	return err
 }
 
 func (t *tcpTransport) Close() error {
 	return t.wc.Close()
 }
 
-func (t *tcpTransport) SetTimeout(d time.Duration) {
-	t.timeout = d
-	if d == 0 {
-		var zeroTime time.Time
-		t.wc.SetDeadline(zeroTime)
-	}
+func (t *tcpTransport) RemoteAddr() net.Addr {
+	return t.wc.RemoteAddr()
+}
+
+func (t *tcpTransport) LocalAddr() net.Addr {
+	return t.wc.LocalAddr()
 }
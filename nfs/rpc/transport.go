@@ -0,0 +1,77 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package rpc
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"time"
+)
+
+// Transport moves whole rpc records between a client and a server.  The
+// Client calls Send and Recv concurrently, but never Send or Recv
+// concurrently with itself.
+//
+// NewStreamTransport covers stream conns (TCP, TLS, pipes) and
+// NewDatagramTransport datagram conns (UDP); other transports can be plugged
+// in with NewClientTransport.
+type Transport interface {
+	// Send writes a single record, giving up at deadline unless it is zero
+	Send(record []byte, deadline time.Time) error
+
+	// Recv blocks until the next record arrives and returns it
+	Recv() (io.ReadSeeker, error)
+
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// udpMaxRecord is the largest record a datagram transport can receive
+const udpMaxRecord = 65536
+
+// udpTransport sends one record per datagram, without record marking
+type udpTransport struct {
+	net.Conn
+}
+
+// NewDatagramTransport returns a transport sending one record per datagram
+// over conn.  The Client does not retransmit calls lost on the way, they fail
+// with ErrTimeout.
+func NewDatagramTransport(conn net.Conn) Transport {
+	return &udpTransport{conn}
+}
+
+func (t *udpTransport) Send(buf []byte, deadline time.Time) error {
+	t.SetWriteDeadline(deadline)
+	_, err := t.Write(buf)
+
+	return err
+}
+
+func (t *udpTransport) Recv() (io.ReadSeeker, error) {
+	buf := make([]byte, udpMaxRecord)
+	n, err := t.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(buf[:n]), nil
+}
+
+// DialUDP connects to an rpc service over UDP
+func DialUDP(network string, ldr *net.UDPAddr, addr string) (*Client, error) {
+	a, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUDP(a.Network(), ldr, a)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClientTransport(NewDatagramTransport(conn)), nil
+}
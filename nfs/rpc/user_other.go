@@ -0,0 +1,19 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+//go:build !windows
+
+package rpc
+
+import "os"
+
+// osUser returns the uid and gid of the process, those of nobody on
+// platforms without unix users
+func osUser() (uint32, uint32) {
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid < 0 || gid < 0 {
+		return NobodyUID, NobodyGID
+	}
+
+	return uint32(uid), uint32(gid)
+}
@@ -0,0 +1,12 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+//go:build windows
+
+package rpc
+
+// osUser returns the ids Windows users are known by to NFS servers, nobody's
+// Windows accounts have no uid or gid.
+func osUser() (uint32, uint32) {
+	return NobodyUID, NobodyGID
+}
@@ -0,0 +1,184 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package rpc
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultMaxInFlight is the size of the fixed window new clients start with
+var DefaultMaxInFlight = 16
+
+// How far latency may rise above the observed minimum before the adaptive
+// window treats it as queueing on the server.
+const windowLatencyTolerance = 2
+
+// How often the adaptive window forgets its latency baseline, so that it
+// follows a server whose unloaded latency changes.
+const windowBaselineReset = time.Minute
+
+// Window limits the number of calls a Client has in flight at once.
+//
+// A fixed window never changes.  An adaptive window follows an AIMD scheme:
+// it grows by about one call per round trip while latency stays close to the
+// lowest latency observed, and halves (at most once per round trip) on
+// timeouts, on latency rising well above that baseline, or when told to by
+// Backoff, e.g. after the server returned NFS3ERR_JUKEBOX.
+type Window struct {
+	sync.Mutex
+	wake chan struct{}
+
+	inflight int
+	limit    float64
+	min, max float64
+	adaptive bool
+
+	minRTT       time.Duration
+	baselineAt   time.Time
+	lastDecrease time.Time
+}
+
+// NewFixedWindow returns a window allowing n calls in flight
+func NewFixedWindow(n int) *Window {
+	if n < 1 {
+		n = 1
+	}
+
+	return &Window{
+		wake:  make(chan struct{}),
+		limit: float64(n),
+		min:   float64(n),
+		max:   float64(n),
+	}
+}
+
+// NewAdaptiveWindow returns a window that tunes itself between min and max
+// calls in flight, starting at min.
+func NewAdaptiveWindow(min, max int) *Window {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+
+	return &Window{
+		wake:     make(chan struct{}),
+		limit:    float64(min),
+		min:      float64(min),
+		max:      float64(max),
+		adaptive: true,
+	}
+}
+
+// Limit returns the current number of calls allowed in flight
+func (w *Window) Limit() int {
+	w.Lock()
+	defer w.Unlock()
+
+	return int(w.limit)
+}
+
+// InFlight returns the number of calls currently in flight
+func (w *Window) InFlight() int {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.inflight
+}
+
+// Backoff signals congestion observed above the rpc layer
+func (w *Window) Backoff() {
+	w.Lock()
+	defer w.Unlock()
+
+	w.decrease()
+}
+
+// acquire waits for a free slot, giving up at deadline unless it is zero
+func (w *Window) acquire(deadline time.Time) error {
+	for {
+		w.Lock()
+		if w.inflight < int(w.limit) {
+			w.inflight++
+			w.Unlock()
+			return nil
+		}
+		wake := w.wake
+		w.Unlock()
+
+		if deadline.IsZero() {
+			<-wake
+			continue
+		}
+
+		t := time.NewTimer(time.Until(deadline))
+		select {
+		case <-wake:
+			t.Stop()
+		case <-t.C:
+			return ErrTimeout
+		}
+	}
+}
+
+// release frees a slot and feeds the outcome of the call to the controller
+func (w *Window) release(rtt time.Duration, congested bool) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.inflight--
+	defer w.signal()
+
+	if !w.adaptive {
+		return
+	}
+
+	if congested {
+		w.decrease()
+		return
+	}
+
+	now := time.Now()
+	if w.minRTT == 0 || rtt < w.minRTT || now.Sub(w.baselineAt) > windowBaselineReset {
+		w.minRTT = rtt
+		w.baselineAt = now
+	}
+
+	if rtt > windowLatencyTolerance*w.minRTT {
+		w.decrease()
+		return
+	}
+
+	w.limit += 1 / w.limit
+	if w.limit > w.max {
+		w.limit = w.max
+	}
+}
+
+// decrease halves the limit, once per round trip at most.  The caller holds
+// the lock.
+func (w *Window) decrease() {
+	if !w.adaptive {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(w.lastDecrease) < w.minRTT {
+		return
+	}
+	w.lastDecrease = now
+
+	w.limit /= 2
+	if w.limit < w.min {
+		w.limit = w.min
+	}
+}
+
+// signal wakes up all waiters, the caller holds the lock
+func (w *Window) signal() {
+	close(w.wake)
+	w.wake = make(chan struct{})
+}
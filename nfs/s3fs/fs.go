@@ -0,0 +1,854 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package s3fs
+
+import (
+	"encoding/binary"
+	"os"
+	_path "path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs"
+)
+
+// Tags of the objects FS keeps the attributes of files in, those S3 has no
+// place for.  Objects without them, those put by other S3 clients, are
+// files of mode 0644 owned by root, modified when they were put.
+const (
+	TagType  = "nfs-type"
+	TagMode  = "nfs-mode"
+	TagUID   = "nfs-uid"
+	TagGID   = "nfs-gid"
+	TagMtime = "nfs-mtime"
+	TagCtime = "nfs-ctime"
+)
+
+// values of TagType, files have none
+const (
+	typeDir     = "directory"
+	typeSymlink = "symlink"
+)
+
+// FS is an nfs.Backend presenting the objects of a Store, under a prefix,
+// as files: the key "a/b/c" is file c in directory a/b.  Directories are
+// the prefixes of keys, and an empty object of the key of the prefix, as
+// "a/b/", for those made through FS, so that they exist while empty.  A key
+// both a file and a prefix is served as the file.
+//
+// Objects are written whole: the WRITEs to a file are held in memory until
+// it is committed, when the object is put, so that a file is as large as the
+// memory of the process at most.  Stable WRITEs are committed by the server
+// before they are answered, each puts the object again, clients writing
+// large files should write unstable and commit once.  Handles are those of the paths looked up
+// since FS was made, and stale for clients across its restarts.  Hard links
+// are not supported, unset FSF3Link in the FSINFO of the server.
+type FS struct {
+	store  Store
+	prefix string
+
+	sync.Mutex
+	paths  map[uint64]string
+	ids    map[string]uint64
+	nextID uint64
+
+	// files written and not committed, by id
+	dirty map[uint64]*dirtyFile
+}
+
+type dirtyFile struct {
+	data []byte
+	tags map[string]string
+}
+
+const rootID = 1
+
+// NewFS returns a backend serving the objects of store below prefix, the
+// whole store if it is ""
+func NewFS(store Store, prefix string) *FS {
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		prefix += "/"
+	}
+
+	return &FS{
+		store:  store,
+		prefix: prefix,
+		paths:  map[uint64]string{rootID: ""},
+		ids:    map[string]uint64{"": rootID},
+		nextID: rootID + 1,
+		dirty:  make(map[uint64]*dirtyFile),
+	}
+}
+
+// objectKey is the key of the file of path, dirKey that of the directory
+func (fs *FS) objectKey(path string) string {
+	return fs.prefix + path
+}
+
+func (fs *FS) dirKey(path string) string {
+	if path == "" {
+		return fs.prefix
+	}
+	return fs.prefix + path + "/"
+}
+
+// id returns the fileid of path, the same for as long as it is there
+func (fs *FS) id(path string) uint64 {
+	fs.Lock()
+	defer fs.Unlock()
+
+	id, ok := fs.ids[path]
+	if !ok {
+		id = fs.nextID
+		fs.nextID++
+		fs.ids[path], fs.paths[id] = id, path
+	}
+
+	return id
+}
+
+func handle(id uint64) []byte {
+	fh := make([]byte, 8)
+	binary.BigEndian.PutUint64(fh, id)
+	return fh
+}
+
+// resolve returns the id and path of fh
+func (fs *FS) resolve(fh []byte) (uint64, string, error) {
+	if len(fh) != 8 {
+		return 0, "", nfs.NFS3Error(nfs.NFS3ErrBadHandle)
+	}
+	id := binary.BigEndian.Uint64(fh)
+
+	fs.Lock()
+	defer fs.Unlock()
+
+	path, ok := fs.paths[id]
+	if !ok {
+		return 0, "", nfs.NFS3Error(nfs.NFS3ErrStale)
+	}
+
+	return id, path, nil
+}
+
+// forget drops the fileid of path, of an entry removed
+func (fs *FS) forget(path string) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if id, ok := fs.ids[path]; ok {
+		delete(fs.ids, path)
+		delete(fs.paths, id)
+		delete(fs.dirty, id)
+	}
+}
+
+// moved has the handles of from, and of all below it, follow a rename to to
+func (fs *FS) moved(from, to string) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	for id, path := range fs.paths {
+		if path == from || strings.HasPrefix(path, from+"/") {
+			moved := to + path[len(from):]
+			delete(fs.ids, path)
+			fs.paths[id] = moved
+			fs.ids[moved] = id
+		}
+	}
+}
+
+// entry returns the path of name in directory dir
+func (fs *FS) entry(dir []byte, name string) (string, error) {
+	switch {
+	case name == "" || name == "." || name == ".." || strings.Contains(name, "/"):
+		return "", nfs.NFS3Error(nfs.NFS3ErrInval)
+	case len(name) > 255:
+		return "", nfs.NFS3Error(nfs.NFS3ErrNameTooLong)
+	}
+
+	_, path, err := fs.resolve(dir)
+	if err != nil {
+		return "", err
+	}
+	attr, err := fs.stat(path)
+	if err != nil {
+		return "", err
+	}
+	if attr.Type != nfs.NF3Dir {
+		return "", nfs.NFS3Error(nfs.NFS3ErrNotDir)
+	}
+
+	return _path.Join(path, name), nil
+}
+
+// node is what the store has of a path
+type node struct {
+	typ      uint32
+	size     int64
+	modified time.Time
+	tags     map[string]string
+}
+
+// lookup returns the node of path, os.ErrNotExist if there is none
+func (fs *FS) lookup(path string) (*node, error) {
+	fs.Lock()
+	d := fs.dirty[fs.ids[path]]
+	if d != nil {
+		n := &node{typ: nfs.NF3Reg, size: int64(len(d.data)), tags: copyTags(d.tags)}
+		fs.Unlock()
+		return n, nil
+	}
+	fs.Unlock()
+
+	if path != "" {
+		o, err := fs.store.Head(fs.objectKey(path))
+		if err == nil {
+			n := &node{typ: nfs.NF3Reg, size: o.Size, modified: o.Modified, tags: o.Tags}
+			if o.Tags[TagType] == typeSymlink {
+				n.typ = nfs.NF3Lnk
+			}
+			return n, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	n := &node{typ: nfs.NF3Dir}
+	if fs.dirKey(path) == "" {
+		// the root of the store, which has no object
+		return n, nil
+	}
+	o, err := fs.store.Head(fs.dirKey(path))
+	switch {
+	case err == nil:
+		n.modified, n.tags = o.Modified, o.Tags
+		return n, nil
+	case !os.IsNotExist(err):
+		return nil, err
+	case path == "":
+		return n, nil
+	}
+
+	// a prefix of keys only
+	objects, prefixes, err := fs.store.List(fs.dirKey(path), "/")
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 && len(prefixes) == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	return n, nil
+}
+
+// stat returns the attributes of path
+func (fs *FS) stat(path string) (*nfs.Fattr, error) {
+	n, err := fs.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.attr(path, n), nil
+}
+
+func tagUint(tags map[string]string, tag string, base int, def uint64) uint64 {
+	if v, err := strconv.ParseUint(tags[tag], base, 64); err == nil {
+		return v
+	}
+	return def
+}
+
+func tagTime(tags map[string]string, tag string, def time.Time) nfs.NFS3Time {
+	if ns, err := strconv.ParseInt(tags[tag], 10, 64); err == nil {
+		return nfs.NewNFS3Time(time.Unix(0, ns))
+	}
+	return nfs.NewNFS3Time(def)
+}
+
+func (fs *FS) attr(path string, n *node) *nfs.Fattr {
+	mode := uint64(0644)
+	nlink := uint32(1)
+	switch n.typ {
+	case nfs.NF3Dir:
+		mode, nlink = 0755, 2
+	case nfs.NF3Lnk:
+		mode = 0777
+	}
+
+	attr := &nfs.Fattr{
+		Type:     n.typ,
+		FileMode: uint32(tagUint(n.tags, TagMode, 8, mode)),
+		Nlink:    nlink,
+		UID:      uint32(tagUint(n.tags, TagUID, 10, 0)),
+		GID:      uint32(tagUint(n.tags, TagGID, 10, 0)),
+		Filesize: uint64(n.size),
+		Used:     uint64(n.size),
+		FSID:     1,
+		Fileid:   fs.id(path),
+		Mtime:    tagTime(n.tags, TagMtime, n.modified),
+	}
+	attr.Ctime = tagTime(n.tags, TagCtime, attr.Mtime.Time())
+	attr.Atime = attr.Mtime
+
+	return attr
+}
+
+// newTags returns the tags of a node of type typ made with attr
+func newTags(typ string, mode uint32, attr nfs.Sattr3) map[string]string {
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	tags := map[string]string{TagMtime: now, TagCtime: now}
+	if typ != "" {
+		tags[TagType] = typ
+	}
+	if attr.Mode.SetIt {
+		mode = attr.Mode.Mode
+	}
+	tags[TagMode] = strconv.FormatUint(uint64(mode&nfs.ModeMask), 8)
+
+	applyTags(tags, attr)
+	return tags
+}
+
+// applyTags sets the attributes of attr other than its size in tags
+func applyTags(tags map[string]string, attr nfs.Sattr3) {
+	now := time.Now()
+	if attr.Mode.SetIt {
+		tags[TagMode] = strconv.FormatUint(uint64(attr.Mode.Mode&nfs.ModeMask), 8)
+	}
+	if attr.UID.SetIt {
+		tags[TagUID] = strconv.FormatUint(uint64(attr.UID.UID), 10)
+	}
+	if attr.GID.SetIt {
+		tags[TagGID] = strconv.FormatUint(uint64(attr.GID.UID), 10)
+	}
+	switch attr.Mtime.SetIt {
+	case nfs.SetToServerTime:
+		tags[TagMtime] = strconv.FormatInt(now.UnixNano(), 10)
+	case nfs.SetToClientTime:
+		tags[TagMtime] = strconv.FormatInt(attr.Mtime.Time.Time().UnixNano(), 10)
+	}
+	tags[TagCtime] = strconv.FormatInt(now.UnixNano(), 10)
+}
+
+// touch sets the mtime and ctime of tags to now
+func touch(tags map[string]string) {
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	tags[TagMtime], tags[TagCtime] = now, now
+}
+
+func (fs *FS) Root(dirpath string) ([]byte, error) {
+	path := strings.Trim(_path.Clean("/"+dirpath), "/")
+	attr, err := fs.stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if attr.Type != nfs.NF3Dir {
+		return nil, nfs.NFS3Error(nfs.NFS3ErrNotDir)
+	}
+
+	return handle(attr.Fileid), nil
+}
+
+func (fs *FS) GetAttr(fh []byte) (*nfs.Fattr, error) {
+	_, path, err := fs.resolve(fh)
+	if err != nil {
+		return nil, err
+	}
+
+	attr, err := fs.stat(path)
+	if os.IsNotExist(err) {
+		// removed by another client of the store
+		return nil, nfs.NFS3Error(nfs.NFS3ErrStale)
+	}
+	return attr, err
+}
+
+func (fs *FS) SetAttr(fh []byte, attr nfs.Sattr3) error {
+	id, path, err := fs.resolve(fh)
+	if err != nil {
+		return err
+	}
+	n, err := fs.lookup(path)
+	if err != nil {
+		return err
+	}
+
+	if n.typ == nfs.NF3Dir {
+		if attr.Size.SetIt {
+			return nfs.NFS3Error(nfs.NFS3ErrInval)
+		}
+		if fs.dirKey(path) == "" {
+			return nfs.NFS3Error(nfs.NFS3ErrNotSupp)
+		}
+		if n.tags == nil {
+			// a prefix only, to be made a directory to hold them
+			return fs.store.Put(fs.dirKey(path), nil, newTags(typeDir, 0755, attr))
+		}
+		applyTags(n.tags, attr)
+		return fs.store.PutTags(fs.dirKey(path), n.tags)
+	}
+
+	if attr.Size.SetIt && n.typ != nfs.NF3Reg {
+		return nfs.NFS3Error(nfs.NFS3ErrInval)
+	}
+
+	fs.Lock()
+	defer fs.Unlock()
+
+	d := fs.dirty[id]
+	if d == nil && !attr.Size.SetIt {
+		if n.tags == nil {
+			n.tags = make(map[string]string)
+		}
+		applyTags(n.tags, attr)
+		return fs.store.PutTags(fs.objectKey(path), n.tags)
+	}
+
+	if d, err = fs.load(id, path); err != nil {
+		return err
+	}
+	if attr.Size.SetIt {
+		d.resize(attr.Size.Size)
+		touch(d.tags)
+	}
+	applyTags(d.tags, attr)
+
+	return fs.flush(id, path)
+}
+
+func (fs *FS) Lookup(dir []byte, name string) ([]byte, error) {
+	path, err := fs.entry(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fs.lookup(path); err != nil {
+		return nil, err
+	}
+
+	return handle(fs.id(path)), nil
+}
+
+func (fs *FS) Readlink(fh []byte) (string, error) {
+	_, path, err := fs.resolve(fh)
+	if err != nil {
+		return "", err
+	}
+	n, err := fs.lookup(path)
+	if err != nil {
+		return "", err
+	}
+	if n.typ != nfs.NF3Lnk {
+		return "", nfs.NFS3Error(nfs.NFS3ErrInval)
+	}
+
+	target, err := fs.store.Get(fs.objectKey(path), 0, -1)
+	return string(target), err
+}
+
+func (fs *FS) Read(fh []byte, offset uint64, count uint32) ([]byte, bool, error) {
+	id, path, err := fs.resolve(fh)
+	if err != nil {
+		return nil, false, err
+	}
+
+	fs.Lock()
+	if d := fs.dirty[id]; d != nil {
+		defer fs.Unlock()
+
+		size := uint64(len(d.data))
+		if offset >= size {
+			return nil, true, nil
+		}
+		end := offset + uint64(count)
+		if end > size {
+			end = size
+		}
+		return append([]byte(nil), d.data[offset:end]...), end == size, nil
+	}
+	fs.Unlock()
+
+	data, err := fs.store.Get(fs.objectKey(path), int64(offset), int64(count))
+	if os.IsNotExist(err) {
+		if n, serr := fs.lookup(path); serr == nil && n.typ == nfs.NF3Dir {
+			err = nfs.NFS3Error(nfs.NFS3ErrIsDir)
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	// a short read is the end of the object, a full one may be
+	return data, len(data) < int(count), nil
+}
+
+// load returns the dirty file of id, read from the store if it is not, the
+// caller holds the lock
+func (fs *FS) load(id uint64, path string) (*dirtyFile, error) {
+	if d := fs.dirty[id]; d != nil {
+		return d, nil
+	}
+
+	o, err := fs.store.Head(fs.objectKey(path))
+	if err != nil {
+		return nil, err
+	}
+	if o.Tags[TagType] != "" {
+		return nil, nfs.NFS3Error(nfs.NFS3ErrInval)
+	}
+	data, err := fs.store.Get(fs.objectKey(path), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &dirtyFile{data: data, tags: o.Tags}
+	if d.tags == nil {
+		d.tags = make(map[string]string)
+	}
+	fs.dirty[id] = d
+
+	return d, nil
+}
+
+func (d *dirtyFile) resize(size uint64) {
+	if size <= uint64(len(d.data)) {
+		d.data = d.data[:size]
+	} else {
+		d.data = append(d.data, make([]byte, size-uint64(len(d.data)))...)
+	}
+}
+
+// flush puts the dirty file of id, the caller holds the lock
+func (fs *FS) flush(id uint64, path string) error {
+	d := fs.dirty[id]
+	if d == nil {
+		return nil
+	}
+
+	if err := fs.store.Put(fs.objectKey(path), d.data, d.tags); err != nil {
+		return err
+	}
+	delete(fs.dirty, id)
+
+	return nil
+}
+
+func (fs *FS) Write(fh []byte, offset uint64, data []byte) (int, error) {
+	id, path, err := fs.resolve(fh)
+	if err != nil {
+		return 0, err
+	}
+
+	fs.Lock()
+	defer fs.Unlock()
+
+	d, err := fs.load(id, path)
+	if err != nil {
+		return 0, err
+	}
+	if end := offset + uint64(len(data)); end > uint64(len(d.data)) {
+		d.resize(end)
+	}
+	copy(d.data[offset:], data)
+	touch(d.tags)
+
+	return len(data), nil
+}
+
+func (fs *FS) Commit(fh []byte) error {
+	id, path, err := fs.resolve(fh)
+	if err != nil {
+		return err
+	}
+
+	fs.Lock()
+	defer fs.Unlock()
+
+	return fs.flush(id, path)
+}
+
+func (fs *FS) Create(dir []byte, name string, attr nfs.Sattr3, guarded bool) ([]byte, error) {
+	path, err := fs.entry(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := fs.lookup(path)
+	switch {
+	case err == nil && (guarded || n.typ != nfs.NF3Reg):
+		return nil, os.ErrExist
+	case err == nil:
+		fh := handle(fs.id(path))
+		return fh, fs.SetAttr(fh, attr)
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	var data []byte
+	if attr.Size.SetIt {
+		data = make([]byte, attr.Size.Size)
+	}
+	if err = fs.store.Put(fs.objectKey(path), data, newTags("", 0644, attr)); err != nil {
+		return nil, err
+	}
+
+	return handle(fs.id(path)), nil
+}
+
+func (fs *FS) Mkdir(dir []byte, name string, attr nfs.Sattr3) ([]byte, error) {
+	path, err := fs.entry(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = fs.lookup(path); err == nil {
+		return nil, os.ErrExist
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err = fs.store.Put(fs.dirKey(path), nil, newTags(typeDir, 0755, attr)); err != nil {
+		return nil, err
+	}
+
+	return handle(fs.id(path)), nil
+}
+
+func (fs *FS) Symlink(dir []byte, name, target string, attr nfs.Sattr3) ([]byte, error) {
+	path, err := fs.entry(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = fs.lookup(path); err == nil {
+		return nil, os.ErrExist
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err = fs.store.Put(fs.objectKey(path), []byte(target), newTags(typeSymlink, 0777, attr)); err != nil {
+		return nil, err
+	}
+
+	return handle(fs.id(path)), nil
+}
+
+func (fs *FS) Link(fh []byte, dir []byte, name string) error {
+	return nfs.NFS3Error(nfs.NFS3ErrNotSupp)
+}
+
+func (fs *FS) Remove(dir []byte, name string) error {
+	path, err := fs.entry(dir, name)
+	if err != nil {
+		return err
+	}
+
+	n, err := fs.lookup(path)
+	if err != nil {
+		return err
+	}
+	if n.typ == nfs.NF3Dir {
+		return nfs.NFS3Error(nfs.NFS3ErrIsDir)
+	}
+
+	if err = fs.store.Delete(fs.objectKey(path)); err != nil {
+		return err
+	}
+	fs.forget(path)
+
+	return nil
+}
+
+func (fs *FS) RmDir(dir []byte, name string) error {
+	path, err := fs.entry(dir, name)
+	if err != nil {
+		return err
+	}
+
+	n, err := fs.lookup(path)
+	if err != nil {
+		return err
+	}
+	if n.typ != nfs.NF3Dir {
+		return nfs.NFS3Error(nfs.NFS3ErrNotDir)
+	}
+	if err = fs.empty(path); err != nil {
+		return err
+	}
+
+	if err = fs.store.Delete(fs.dirKey(path)); err != nil {
+		return err
+	}
+	fs.forget(path)
+
+	return nil
+}
+
+// empty fails unless directory path holds nothing but its own object
+func (fs *FS) empty(path string) error {
+	objects, prefixes, err := fs.store.List(fs.dirKey(path), "/")
+	if err != nil {
+		return err
+	}
+	if len(prefixes) > 0 || len(objects) > 1 || (len(objects) == 1 && objects[0].Key != fs.dirKey(path)) {
+		return nfs.NFS3Error(nfs.NFS3ErrNotEmpty)
+	}
+
+	return nil
+}
+
+func (fs *FS) Rename(fromDir []byte, fromName string, toDir []byte, toName string) error {
+	from, err := fs.entry(fromDir, fromName)
+	if err != nil {
+		return err
+	}
+	to, err := fs.entry(toDir, toName)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		return nil
+	}
+
+	n, err := fs.lookup(from)
+	if err != nil {
+		return err
+	}
+	old, err := fs.lookup(to)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	case n.typ == nfs.NF3Dir && old.typ != nfs.NF3Dir:
+		return nfs.NFS3Error(nfs.NFS3ErrNotDir)
+	case n.typ != nfs.NF3Dir && old.typ == nfs.NF3Dir:
+		return nfs.NFS3Error(nfs.NFS3ErrIsDir)
+	case old.typ == nfs.NF3Dir:
+		if err = fs.empty(to); err != nil {
+			return err
+		}
+	}
+
+	// objects are copied, and written files first put
+	fs.Lock()
+	for id, d := range fs.dirty {
+		if p := fs.paths[id]; d != nil && (p == from || strings.HasPrefix(p, from+"/")) {
+			if err = fs.flush(id, p); err != nil {
+				fs.Unlock()
+				return err
+			}
+		}
+	}
+	fs.Unlock()
+
+	if n.typ != nfs.NF3Dir {
+		err = fs.move(fs.objectKey(from), fs.objectKey(to))
+	} else if strings.HasPrefix(to, from+"/") {
+		// a directory may not be moved below itself
+		err = nfs.NFS3Error(nfs.NFS3ErrInval)
+	} else {
+		err = fs.moveDir(from, to)
+	}
+	if err != nil {
+		return err
+	}
+
+	fs.forget(to)
+	fs.moved(from, to)
+
+	return nil
+}
+
+// move copies the object of key from to key to, then deletes it
+func (fs *FS) move(from, to string) error {
+	o, err := fs.store.Head(from)
+	if err != nil {
+		return err
+	}
+	data, err := fs.store.Get(from, 0, -1)
+	if err != nil {
+		return err
+	}
+	if o.Tags == nil {
+		o.Tags = make(map[string]string)
+	}
+	o.Tags[TagCtime] = strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err = fs.store.Put(to, data, o.Tags); err != nil {
+		return err
+	}
+
+	return fs.store.Delete(from)
+}
+
+// moveDir moves every object below directory from to directory to
+func (fs *FS) moveDir(from, to string) error {
+	objects, _, err := fs.store.List(fs.dirKey(from), "")
+	if err != nil {
+		return err
+	}
+
+	fromKey, toKey := fs.dirKey(from), fs.dirKey(to)
+	for _, o := range objects {
+		if err = fs.move(o.Key, toKey+o.Key[len(fromKey):]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fs *FS) ReadDir(dir []byte) ([]string, error) {
+	_, path, err := fs.resolve(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := fs.dirKey(path)
+	objects, prefixes, err := fs.store.List(prefix, "/")
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, o := range objects {
+		add(o.Key[len(prefix):])
+	}
+	for _, p := range prefixes {
+		add(strings.TrimSuffix(p[len(prefix):], "/"))
+	}
+
+	// sorted, so that cookies stay put while the directory is unchanged
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// FSStat reports a filesystem of 1PiB, and 2^40 files, free: object stores
+// have no limit to tell
+func (fs *FS) FSStat(fh []byte) (*nfs.FSStat, error) {
+	if _, _, err := fs.resolve(fh); err != nil {
+		return nil, err
+	}
+
+	const bytes, files = 1 << 50, 1 << 40
+	return &nfs.FSStat{
+		TBytes: bytes,
+		FBytes: bytes,
+		ABytes: bytes,
+		TFiles: files,
+		FFiles: files,
+		AFiles: files,
+	}, nil
+}
@@ -0,0 +1,122 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package s3fs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs"
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+func TestFS(t *testing.T) {
+	store := NewMemStore()
+	// put by another client, with no tags
+	if err := store.Put("export/docs/readme", []byte("put over s3"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := nfs.DialLoopback(nfs.NewServer(NewFS(store, "/export/"))).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	read := func(path string) string {
+		f, err := v.Open(path)
+		if err != nil {
+			t.Fatalf("open %s: %s", path, err)
+		}
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatalf("read %s: %s", path, err)
+		}
+		return string(data)
+	}
+
+	if got := read("/docs/readme"); got != "put over s3" {
+		t.Errorf("readme = %q", got)
+	}
+	fi, _, err := v.Lookup("/docs")
+	if err != nil || !fi.IsDir() {
+		t.Fatalf("docs: %v %v", fi, err)
+	}
+
+	if _, err = v.Mkdir("/a", 0750); err != nil {
+		t.Fatal(err)
+	}
+	f, err := v.OpenFile("/a/f", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("over nfs")); err != nil {
+		t.Fatal(err)
+	}
+	// a FILE_SYNC write is put before it is acknowledged, not at COMMIT
+	if data, err := store.Get("export/a/f", 0, -1); err != nil || string(data) != "over nfs" {
+		t.Errorf("a/f after a stable write = %q, %v", data, err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// committed files are objects, with their attributes in tags
+	if data, err := store.Get("export/a/f", 0, -1); err != nil || string(data) != "over nfs" {
+		t.Errorf("a/f = %q, %v", data, err)
+	}
+	o, err := store.Head("export/a/")
+	if err != nil || o.Tags[TagType] != "directory" || o.Tags[TagMode] != "750" {
+		t.Errorf("a: %+v %v", o, err)
+	}
+	if fi, _, err = v.Lookup("/a/f"); err != nil || fi.Mode().Perm() != 0600 || fi.Size() != 8 {
+		t.Errorf("a/f: %v %v", fi, err)
+	}
+
+	if _, err = v.Symlink("f", "/a/l"); err != nil {
+		t.Fatal(err)
+	}
+	if err = v.RmDir("/a"); err == nil {
+		t.Error("rmdir of a non-empty directory")
+	}
+
+	if err = v.Rename("/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := read("/b/f"); got != "over nfs" {
+		t.Errorf("b/f = %q", got)
+	}
+	if _, err = store.Head("export/a/f"); !os.IsNotExist(err) {
+		t.Errorf("a/f left: %v", err)
+	}
+	if o, err = store.Head("export/b/l"); err != nil || o.Tags[TagType] != "symlink" {
+		t.Errorf("b/l: %+v %v", o, err)
+	}
+
+	entries, err := v.ReadDirPlus("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.FileName)
+	}
+	if len(names) != 2 || names[0] != "b" || names[1] != "docs" {
+		t.Errorf("entries = %v", names)
+	}
+
+	for _, p := range []string{"/b/f", "/b/l"} {
+		if err = v.Remove(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = v.RmDir("/b"); err != nil {
+		t.Fatal(err)
+	}
+	if objects, _, _ := store.List("export/b", ""); len(objects) != 0 {
+		t.Errorf("b left: %v", objects)
+	}
+}
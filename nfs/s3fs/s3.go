@@ -0,0 +1,385 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package s3fs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// S3Store is a Store of a bucket of S3, or of an object store speaking its
+// API, addressed path-style, as endpoint/bucket/key, and signed with
+// Signature Version 4
+type S3Store struct {
+	Endpoint string
+	Region   string
+	Bucket   string
+
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	// Client sends the requests, http.DefaultClient if nil
+	Client *http.Client
+}
+
+// NewS3Store returns the store of bucket at endpoint, as
+// "https://s3.eu-west-1.amazonaws.com", in region
+func NewS3Store(endpoint, region, bucket, accessKey, secretKey string) *S3Store {
+	return &S3Store{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Region:    region,
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+	}
+}
+
+// s3Error is the error body of S3
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+// S3Error is an error S3 answered a request with
+type S3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// uriEncode escapes s as SigV4 has it, keeping slashes if path
+func uriEncode(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', path && c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds the Authorization of Signature Version 4 to req, of a body of
+// SHA-256 payloadHash, signing its host and all its headers
+func sign(req *http.Request, payloadHash, accessKey, secretKey, region string, t time.Time) {
+	t = t.UTC()
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, uriEncode(k, false)+"="+uriEncode(v, false))
+		}
+	}
+
+	canonical := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, true),
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+// do sends a signed request of method for key, with query and headers,
+// and returns the response.  Those not a success are os.ErrNotExist,
+// os.ErrPermission, or an *S3Error.
+func (s *S3Store) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + s.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, true)
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	sum := sha256.Sum256(body)
+	sign(req, hex.EncodeToString(sum[:]), s.AccessKey, s.SecretKey, s.Region, time.Now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	util.Debugf("s3 %s %s", method, u)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return nil, os.ErrNotExist
+		case http.StatusForbidden:
+			return nil, os.ErrPermission
+		}
+		e := &S3Error{Status: resp.StatusCode, Code: resp.Status}
+		var body s3Error
+		if data, err := ioutil.ReadAll(resp.Body); err == nil && xml.Unmarshal(data, &body) == nil {
+			e.Code, e.Message = body.Code, body.Message
+		}
+		return nil, e
+	}
+
+	return resp, nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3Store) List(prefix, delimiter string) ([]Object, []string, error) {
+	var objects []Object
+	var prefixes []string
+
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, c := range result.Contents {
+			objects = append(objects, Object{Key: c.Key, Size: c.Size, Modified: c.LastModified})
+		}
+		for _, p := range result.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+
+		if !result.IsTruncated {
+			return objects, prefixes, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+type tagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	TagSet  struct {
+		Tag []struct {
+			Key   string
+			Value string
+		}
+	}
+}
+
+func (s *S3Store) Head(key string) (*Object, error) {
+	resp, err := s.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	o := &Object{Key: key, Size: resp.ContentLength, Tags: make(map[string]string)}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		o.Modified = t
+	}
+
+	// tags are not sent with the object but asked for, if it has any
+	if n, _ := strconv.Atoi(resp.Header.Get("X-Amz-Tagging-Count")); n == 0 && resp.Header.Get("X-Amz-Tagging-Count") != "" {
+		return o, nil
+	}
+	resp, err = s.do(http.MethodGet, key, url.Values{"tagging": {""}}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var t tagging
+	if err = xml.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return nil, err
+	}
+	for _, tag := range t.TagSet.Tag {
+		o.Tags[tag.Key] = tag.Value
+	}
+
+	return o, nil
+}
+
+func (s *S3Store) Get(key string, offset, length int64) ([]byte, error) {
+	header := http.Header{}
+	switch {
+	case length == 0:
+		return nil, nil
+	case length > 0:
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	case offset > 0:
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := s.do(http.MethodGet, key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// past the end
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return nil, nil
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func encodeTags(tags map[string]string) string {
+	q := url.Values{}
+	for k, v := range tags {
+		q.Set(k, v)
+	}
+	return q.Encode()
+}
+
+func (s *S3Store) Put(key string, data []byte, tags map[string]string) error {
+	header := http.Header{}
+	if len(tags) > 0 {
+		header.Set("X-Amz-Tagging", encodeTags(tags))
+	}
+
+	resp, err := s.do(http.MethodPut, key, nil, header, data)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	return err
+}
+
+func (s *S3Store) PutTags(key string, tags map[string]string) error {
+	var t tagging
+	for k, v := range tags {
+		t.TagSet.Tag = append(t.TagSet.Tag, struct {
+			Key   string
+			Value string
+		}{k, v})
+	}
+	sort.Slice(t.TagSet.Tag, func(i, j int) bool { return t.TagSet.Tag[i].Key < t.TagSet.Tag[j].Key })
+
+	body, err := xml.Marshal(&t)
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(body)
+	header := http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}}
+
+	resp, err := s.do(http.MethodPut, key, url.Values{"tagging": {""}}, header, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func (s *S3Store) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
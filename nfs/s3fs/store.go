@@ -0,0 +1,171 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package s3fs
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Object is an object of a Store
+type Object struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+
+	// Tags are those of the object, as Head returns them; List leaves
+	// them out
+	Tags map[string]string
+}
+
+// Store is an object store, the few calls of the S3 API FS is served by
+type Store interface {
+	// List returns the objects of the keys starting with prefix, and the
+	// prefixes of those with delimiter after it, as ListObjectsV2 does.
+	// All keys with prefix are listed if delimiter is "".
+	List(prefix, delimiter string) ([]Object, []string, error)
+
+	// Head returns the object of key with its tags, os.ErrNotExist if there
+	// is none
+	Head(key string) (*Object, error)
+
+	// Get returns length bytes of key from offset, less past its end, all
+	// of them if length is negative
+	Get(key string, offset, length int64) ([]byte, error)
+
+	// Put stores data as key with tags, replacing what was there
+	Put(key string, data []byte, tags map[string]string) error
+
+	// PutTags replaces the tags of key
+	PutTags(key string, tags map[string]string) error
+
+	// Delete removes key, which need not exist
+	Delete(key string) error
+}
+
+// MemStore is a Store in memory, for tests
+type MemStore struct {
+	sync.Mutex
+	objects map[string]*memObject
+}
+
+type memObject struct {
+	data     []byte
+	modified time.Time
+	tags     map[string]string
+}
+
+// NewMemStore returns an empty store
+func NewMemStore() *MemStore {
+	return &MemStore{objects: make(map[string]*memObject)}
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	c := make(map[string]string, len(tags))
+	for k, v := range tags {
+		c[k] = v
+	}
+	return c
+}
+
+func (s *MemStore) List(prefix, delimiter string) ([]Object, []string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var objects []Object
+	var prefixes []string
+	seen := make(map[string]bool)
+	for key, o := range s.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				p := key[:len(prefix)+i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					prefixes = append(prefixes, p)
+				}
+				continue
+			}
+		}
+		objects = append(objects, Object{Key: key, Size: int64(len(o.data)), Modified: o.modified})
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	sort.Strings(prefixes)
+
+	return objects, prefixes, nil
+}
+
+func (s *MemStore) Head(key string) (*Object, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	o, ok := s.objects[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return &Object{Key: key, Size: int64(len(o.data)), Modified: o.modified, Tags: copyTags(o.tags)}, nil
+}
+
+func (s *MemStore) Get(key string, offset, length int64) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	o, ok := s.objects[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	size := int64(len(o.data))
+	if offset >= size {
+		return nil, nil
+	}
+	end := size
+	if length >= 0 && offset+length < size {
+		end = offset + length
+	}
+
+	return append([]byte(nil), o.data[offset:end]...), nil
+}
+
+func (s *MemStore) Put(key string, data []byte, tags map[string]string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.objects[key] = &memObject{
+		data:     append([]byte(nil), data...),
+		modified: time.Now(),
+		tags:     copyTags(tags),
+	}
+
+	return nil
+}
+
+func (s *MemStore) PutTags(key string, tags map[string]string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	o, ok := s.objects[key]
+	if !ok {
+		return os.ErrNotExist
+	}
+	o.tags = copyTags(tags)
+
+	return nil
+}
+
+func (s *MemStore) Delete(key string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.objects, key)
+	return nil
+}
@@ -0,0 +1,365 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Priority is the class of the calls of an operation, see WithPriority
+type Priority int
+
+const (
+	// PriorityInteractive is for calls someone waits on, the default
+	PriorityInteractive Priority = iota
+
+	// PriorityBackground is for bulk work, scrubs, verifications, that
+	// can wait: background calls go after interactive ones, and get fewer
+	// slots as the latency of interactive calls rises
+	PriorityBackground
+
+	numPriorities
+)
+
+type priorityKey struct{}
+
+// WithPriority tags the operations run with ctx, such as LookupContext,
+// with priority p, over the priority of the target
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// SetPriority sets the priority of the calls of the target not tagged with
+// WithPriority, so a target mounted for a scrub can run in the background
+// of one serving restores
+func (v *Target) SetPriority(p Priority) {
+	v.prio = p
+}
+
+// priority is the priority of a call made with ctx
+func (v *Target) priority(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return p
+	}
+
+	return v.prio
+}
+
+// Background calls are cut to half their slots whenever the average latency
+// of interactive calls is more than backgroundBackoff times its baseline,
+// the lowest average seen over the last baselineWindow, and win back a slot
+// per interactive call below it
+const (
+	backgroundBackoff = 2
+	baselineWindow    = time.Minute
+)
+
+// Scheduler bounds the calls in flight across the targets sharing it, and
+// shares them out fairly between tenants, so that one tenant's recursive
+// delete does not starve another's restore in a service talking to many
+// filers.  Every target set to use it names its tenant; calls wait in one
+// FIFO per tenant, and free slots go round robin to the tenants with calls
+// waiting, as many in a row as their weight.
+//
+// Interactive calls go before background ones, and background calls are
+// held back as the latency of interactive calls rises, see Priority.
+type Scheduler struct {
+	sync.Mutex
+	limit    int
+	inflight int
+	tenants  map[string]*tenant
+
+	// tenants with calls waiting, served round robin from next
+	active []*tenant
+	next   int
+
+	// background calls in flight and allowed
+	bgInflight int
+	bgLimit    int
+
+	// average interactive latency and its baseline
+	latency    time.Duration
+	baseline   time.Duration
+	baselineAt time.Time
+}
+
+type tenant struct {
+	name     string
+	weight   int
+	limit    int
+	inflight int
+	credit   int
+	waiters  [numPriorities][]*schedWaiter
+	active   bool
+}
+
+type schedWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// NewScheduler returns a scheduler allowing limit calls in flight in all
+func NewScheduler(limit int) *Scheduler {
+	if limit < 1 {
+		limit = 1
+	}
+
+	return &Scheduler{limit: limit, bgLimit: limit, tenants: make(map[string]*tenant)}
+}
+
+// SetTenantLimit caps the calls tenant has in flight, zero for no cap but
+// that of the scheduler
+func (s *Scheduler) SetTenantLimit(name string, limit int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.tenant(name).limit = limit
+	s.dispatch()
+}
+
+// SetTenantWeight sets how many calls tenant gets in a row when its turn
+// comes, 1 by default
+func (s *Scheduler) SetTenantWeight(name string, weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.tenant(name).weight = weight
+}
+
+// InFlight returns the number of calls in flight through the scheduler
+func (s *Scheduler) InFlight() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.inflight
+}
+
+// BackgroundLimit returns how many background calls may be in flight now
+func (s *Scheduler) BackgroundLimit() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.bgLimit
+}
+
+// tenant returns the state of tenant name, the caller holds the lock
+func (s *Scheduler) tenant(name string) *tenant {
+	t, ok := s.tenants[name]
+	if !ok {
+		t = &tenant{name: name, weight: 1}
+		s.tenants[name] = t
+	}
+
+	return t
+}
+
+func (t *tenant) open() bool {
+	return t.limit == 0 || t.inflight < t.limit
+}
+
+func (t *tenant) waiting() bool {
+	for _, w := range t.waiters {
+		if len(w) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// free reports whether a call of class p may go now, the caller holds the
+// lock
+func (s *Scheduler) free(p Priority) bool {
+	return s.inflight < s.limit && (p == PriorityInteractive || s.bgInflight < s.bgLimit)
+}
+
+// acquire waits for a slot for a call of tenant name and priority p, until
+// deadline if set
+func (s *Scheduler) acquire(name string, p Priority, deadline time.Time) error {
+	s.Lock()
+	t := s.tenant(name)
+	if s.free(p) && t.open() && len(t.waiters[p]) == 0 {
+		s.grant(t, p)
+		s.Unlock()
+		return nil
+	}
+
+	w := &schedWaiter{ready: make(chan struct{})}
+	t.waiters[p] = append(t.waiters[p], w)
+	if !t.active {
+		t.active = true
+		s.active = append(s.active, t)
+	}
+	s.Unlock()
+
+	if deadline.IsZero() {
+		<-w.ready
+		return nil
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+		return nil
+	case <-timer.C:
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if w.granted {
+		return nil
+	}
+	for i, o := range t.waiters[p] {
+		if o == w {
+			t.waiters[p] = append(t.waiters[p][:i], t.waiters[p][i+1:]...)
+			break
+		}
+	}
+
+	return context.DeadlineExceeded
+}
+
+// grant counts a call of tenant t going, the caller holds the lock
+func (s *Scheduler) grant(t *tenant, p Priority) {
+	s.inflight++
+	t.inflight++
+	if p == PriorityBackground {
+		s.bgInflight++
+	}
+}
+
+// release frees the slot of a call of tenant name and priority p, which
+// took rtt
+func (s *Scheduler) release(name string, p Priority, rtt time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.inflight--
+	s.tenant(name).inflight--
+	if p == PriorityBackground {
+		s.bgInflight--
+	} else {
+		s.observe(rtt)
+	}
+	s.dispatch()
+}
+
+// observe adjusts the background limit to the latency of an interactive
+// call, the caller holds the lock
+func (s *Scheduler) observe(rtt time.Duration) {
+	if s.latency == 0 {
+		s.latency = rtt
+	} else {
+		s.latency = (7*s.latency + rtt) / 8
+	}
+
+	now := time.Now()
+	if s.baseline == 0 || s.latency < s.baseline || now.Sub(s.baselineAt) > baselineWindow {
+		s.baseline = s.latency
+		s.baselineAt = now
+	}
+
+	if s.latency > backgroundBackoff*s.baseline {
+		if s.bgLimit /= 2; s.bgLimit < 1 {
+			s.bgLimit = 1
+		}
+	} else if s.bgLimit < s.limit {
+		s.bgLimit++
+	}
+}
+
+// dispatch grants the free slots to waiting calls, the caller holds the
+// lock
+func (s *Scheduler) dispatch() {
+	for {
+		p := PriorityInteractive
+		t := s.pick(p)
+		if t == nil {
+			p = PriorityBackground
+			t = s.pick(p)
+		}
+		if t == nil {
+			return
+		}
+
+		w := t.waiters[p][0]
+		t.waiters[p] = t.waiters[p][1:]
+		w.granted = true
+		close(w.ready)
+		s.grant(t, p)
+	}
+}
+
+// pick returns the tenant whose turn it is among those with calls of
+// priority p waiting and below their limit, nil if there is none or no
+// slot for p
+func (s *Scheduler) pick(p Priority) *tenant {
+	if !s.free(p) {
+		return nil
+	}
+
+	active := s.active[:0]
+	for _, t := range s.active {
+		if t.waiting() {
+			active = append(active, t)
+		} else {
+			t.active = false
+			t.credit = 0
+		}
+	}
+	s.active = active
+
+	for i := 0; i < len(s.active); i++ {
+		if s.next >= len(s.active) {
+			s.next = 0
+		}
+		t := s.active[s.next]
+		if !t.open() || len(t.waiters[p]) == 0 {
+			t.credit = 0
+			s.next++
+			continue
+		}
+
+		if t.credit == 0 {
+			t.credit = t.weight
+		}
+		if t.credit--; t.credit == 0 {
+			s.next++
+		}
+		return t
+	}
+
+	return nil
+}
+
+// SetScheduler has the calls of the target scheduled by s as those of
+// tenant.  A nil s removes the limits.
+func (v *Target) SetScheduler(s *Scheduler, tenant string) {
+	v.sched = s
+	v.tenant = tenant
+}
+
+// schedule waits for the scheduler of the target, if any, to let a call of
+// priority p through, and returns the function to call once it is done
+func (v *Target) schedule(p Priority, deadline time.Time) (func(), error) {
+	s, tenant := v.sched, v.tenant
+	if s == nil {
+		return func() {}, nil
+	}
+
+	if err := s.acquire(tenant, p, deadline); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	return func() { s.release(tenant, p, time.Since(start)) }, nil
+}
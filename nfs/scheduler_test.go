@@ -0,0 +1,200 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+// queued waits for tenant to have n calls waiting
+func queued(s *Scheduler, tenant string, n int) {
+	for {
+		s.Lock()
+		waiting := len(s.tenant(tenant).waiters[PriorityInteractive])
+		s.Unlock()
+		if waiting == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSchedulerFair(t *testing.T) {
+	s := NewScheduler(1)
+	if err := s.acquire("delete", PriorityInteractive, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a recursive delete has its calls queued before a restore shows up
+	order := make(chan string, 8)
+	call := func(tenant string) {
+		s.acquire(tenant, PriorityInteractive, time.Time{})
+		order <- tenant
+		s.release(tenant, PriorityInteractive, 0)
+	}
+	for i := 0; i < 5; i++ {
+		go call("delete")
+		queued(s, "delete", i+1)
+	}
+	go call("restore")
+	queued(s, "restore", 1)
+
+	s.release("delete", PriorityInteractive, 0)
+	var got []string
+	for i := 0; i < 6; i++ {
+		got = append(got, <-order)
+	}
+	if got[1] != "restore" {
+		t.Errorf("order %v, want the restore served second", got)
+	}
+	if s.InFlight() != 0 {
+		t.Errorf("%d calls left in flight", s.InFlight())
+	}
+}
+
+func TestSchedulerLimits(t *testing.T) {
+	s := NewScheduler(4)
+	s.SetTenantLimit("a", 1)
+
+	if err := s.acquire("a", PriorityInteractive, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.acquire("b", PriorityInteractive, time.Now().Add(10*time.Millisecond)); err != nil {
+		t.Fatalf("other tenant: %s", err)
+	}
+	if err := s.acquire("a", PriorityInteractive, time.Now().Add(10*time.Millisecond)); err != context.DeadlineExceeded {
+		t.Fatalf("over the tenant limit: got %v, want a timeout", err)
+	}
+
+	// the waiter that timed out is gone, the next one gets the slot
+	s.release("a", PriorityInteractive, 0)
+	if err := s.acquire("a", PriorityInteractive, time.Now().Add(10*time.Millisecond)); err != nil {
+		t.Fatalf("after release: %s", err)
+	}
+}
+
+func TestSchedulerTarget(t *testing.T) {
+	// note the most calls the server sees at once
+	srv := NewServer(NewMemFS())
+	var mu sync.Mutex
+	var cur, max int
+	srv.Register(Nfs3Prog, Nfs3Vers, func(call *rpc.ServerCall, w io.Writer) error {
+		mu.Lock()
+		if cur++; cur > max {
+			max = cur
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		defer func() {
+			mu.Lock()
+			cur--
+			mu.Unlock()
+		}()
+		return srv.serveNFS(call, w)
+	})
+
+	v, err := DialLoopback(srv).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+	writeFile(t, v, "/file", "data")
+
+	s := NewScheduler(2)
+	v.SetScheduler(s, "tenant")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := v.GetAttrByFh(v.root()); err != nil {
+				t.Errorf("getattr: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if max > 2 {
+		t.Errorf("%d calls in flight at once, want at most 2", max)
+	}
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	s := NewScheduler(1)
+	s.acquire("agent", PriorityInteractive, time.Time{})
+
+	// a scrub queued first still goes after a restore
+	order := make(chan Priority, 2)
+	call := func(p Priority) {
+		s.acquire("agent", p, time.Time{})
+		order <- p
+		s.release("agent", p, 0)
+	}
+	go call(PriorityBackground)
+	for {
+		s.Lock()
+		n := len(s.tenant("agent").waiters[PriorityBackground])
+		s.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	go call(PriorityInteractive)
+	queued(s, "agent", 1)
+
+	s.release("agent", PriorityInteractive, 0)
+	if p := <-order; p != PriorityInteractive {
+		t.Errorf("background call served first")
+	}
+	<-order
+}
+
+func TestSchedulerBackoff(t *testing.T) {
+	s := NewScheduler(8)
+	for i := 0; i < 8; i++ {
+		s.observe(time.Millisecond)
+	}
+	if s.BackgroundLimit() != 8 {
+		t.Fatalf("background limit %d at baseline latency, want 8", s.BackgroundLimit())
+	}
+
+	// interactive latency rises, background traffic yields
+	for i := 0; i < 8; i++ {
+		s.observe(20 * time.Millisecond)
+	}
+	if s.BackgroundLimit() != 1 {
+		t.Errorf("background limit %d under load, want 1", s.BackgroundLimit())
+	}
+
+	// and comes back once it is over
+	for i := 0; i < 64; i++ {
+		s.observe(time.Millisecond)
+	}
+	if s.BackgroundLimit() != 8 {
+		t.Errorf("background limit %d after load, want 8", s.BackgroundLimit())
+	}
+}
+
+func TestWithPriority(t *testing.T) {
+	v := loopbackTarget(t)
+	defer v.Close()
+
+	ctx := WithPriority(context.Background(), PriorityBackground)
+	if v.priority(ctx) != PriorityBackground || v.priority(context.Background()) != PriorityInteractive {
+		t.Errorf("context priority not honored")
+	}
+
+	v.SetPriority(PriorityBackground)
+	if v.priority(context.Background()) != PriorityBackground {
+		t.Errorf("target priority not honored")
+	}
+}
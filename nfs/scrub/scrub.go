@@ -0,0 +1,282 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+// Package scrub reads every file of a tree on an NFS target, recording
+// checksums, to catch the silent corruption of cold archives: a file whose
+// data changed while its attributes did not, or that can't be read at all.
+package scrub
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	_path "path"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs"
+	"github.com/go-nfs/nfsv3/nfs/backup"
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// Options tune a scrub run
+type Options struct {
+	// Rate caps the bytes read per second, zero for no cap, so a scrub can
+	// crawl through an archive without weighing on the filer
+	Rate int64
+}
+
+// ProblemKind tells what a scrub found wrong with a file
+type ProblemKind int
+
+const (
+	// Unreadable files, or directories, failed to read
+	Unreadable ProblemKind = iota
+
+	// Drift is a file whose data no longer matches the checksum of the
+	// previous run although its size, mtime and ctime did not move
+	Drift
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case Unreadable:
+		return "unreadable"
+	case Drift:
+		return "checksum drift"
+	}
+
+	return fmt.Sprintf("ProblemKind(%d)", int(k))
+}
+
+// Problem is a file a scrub found wrong
+type Problem struct {
+	Path string
+	Kind ProblemKind
+
+	// Err is why an Unreadable file could not be read
+	Err error
+
+	// Want and Got are the checksums of a Drift
+	Want, Got string
+}
+
+func (p Problem) String() string {
+	if p.Kind == Unreadable {
+		return fmt.Sprintf("%s: %s: %s", p.Path, p.Kind, p.Err)
+	}
+
+	return fmt.Sprintf("%s: %s: %s, was %s", p.Path, p.Kind, p.Got, p.Want)
+}
+
+// Result is the outcome of a scrub run
+type Result struct {
+	// Manifest records the checksums of the run, to be saved and handed
+	// to the next one
+	Manifest *backup.Manifest
+
+	// Files and Bytes count what was read, Verified the files whose
+	// checksum matched that of the previous run
+	Files    int
+	Bytes    uint64
+	Verified int
+
+	Problems []Problem
+}
+
+// Run scrubs the tree at root of v, comparing with the manifest of a
+// previous run, or of a backup taken with checksums, if prev is set.  Files
+// changed since, as their attributes tell, are checksummed afresh.  Files
+// that fail are reported in the result, and keep the checksum they had in
+// the new manifest, the run only fails if ctx is done or root can't be
+// listed.
+//
+// Scrubs are bulk work, run them on a target set to PriorityBackground when
+// it is shared with interactive users.
+func Run(ctx context.Context, v *nfs.Target, root string, prev *backup.Manifest, opts Options) (*Result, error) {
+	_, fh, err := v.Lookup(root)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &scrub{
+		ctx:  ctx,
+		v:    v,
+		prev: prev,
+		opts: opts,
+		res:  &Result{Manifest: backup.NewManifest(root)},
+		pace: newPacer(opts.Rate),
+	}
+	if s.prev == nil {
+		s.prev = backup.NewManifest(root)
+	}
+
+	if err = s.walk(fh, root, ""); err != nil {
+		return nil, err
+	}
+
+	return s.res, nil
+}
+
+type scrub struct {
+	ctx  context.Context
+	v    *nfs.Target
+	prev *backup.Manifest
+	opts Options
+	res  *Result
+	pace *pacer
+}
+
+func (s *scrub) problem(p Problem) {
+	util.Errorf("scrub: %s", p)
+	s.res.Problems = append(s.res.Problems, p)
+}
+
+// walk scrubs the entries of directory fh, at path on the target and rel in
+// the manifest
+func (s *scrub) walk(fh []byte, path, rel string) error {
+	entries, err := s.v.ReadDirPlusByFh(fh)
+	if err != nil {
+		if rel == "" {
+			return err
+		}
+		s.problem(Problem{Path: rel, Kind: Unreadable, Err: err})
+		return nil
+	}
+
+	for _, e := range entries {
+		if err = s.ctx.Err(); err != nil {
+			return err
+		}
+		if e.FileName == "." || e.FileName == ".." {
+			continue
+		}
+
+		epath := _path.Join(path, e.FileName)
+		erel := _path.Join(rel, e.FileName)
+
+		attr, efh := &e.Attr.Attr, e.Handle.FH
+		if !e.Attr.IsSet || !e.Handle.IsSet {
+			fi, lfh, err := s.v.Lookup(epath)
+			if err != nil {
+				s.problem(Problem{Path: erel, Kind: Unreadable, Err: err})
+				continue
+			}
+			attr, efh = fi.(*nfs.Fattr), lfh
+		}
+
+		switch attr.Type {
+		case nfs.NF3Dir:
+			s.res.Manifest.Entries[erel] = backup.NewEntry(erel, attr)
+			if err = s.walk(efh, epath, erel); err != nil {
+				return err
+			}
+		case nfs.NF3Reg:
+			s.file(efh, attr, erel)
+		}
+	}
+
+	return nil
+}
+
+// file checksums a regular file and checks it against the previous run
+func (s *scrub) file(fh []byte, attr *nfs.Fattr, rel string) {
+	e := backup.NewEntry(rel, attr)
+	s.res.Manifest.Entries[rel] = e
+
+	old, ok := s.prev.Entries[rel]
+	unchanged := ok && !old.Changed(attr)
+
+	sum, n, err := s.checksum(fh, attr)
+	s.res.Bytes += uint64(n)
+	if err != nil {
+		s.problem(Problem{Path: rel, Kind: Unreadable, Err: err})
+		if unchanged {
+			e.Checksum = old.Checksum
+		}
+		return
+	}
+	s.res.Files++
+
+	if uint64(n) != attr.Filesize {
+		// changed while read, the next run will tell
+		util.Debugf("scrub: %s changed size while read", rel)
+		return
+	}
+	e.Checksum = sum
+
+	switch {
+	case !unchanged || old.Checksum == "":
+	case old.Checksum == sum:
+		s.res.Verified++
+	default:
+		s.problem(Problem{Path: rel, Kind: Drift, Want: old.Checksum, Got: sum})
+	}
+}
+
+func (s *scrub) checksum(fh []byte, attr *nfs.Fattr) (string, int64, error) {
+	f, err := s.v.OpenByFh(fh, attr)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, &pacedReader{s.ctx, f, s.pace})
+	if err != nil {
+		return "", n, err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// pacer keeps reads to rate bytes per second on average since it started
+type pacer struct {
+	rate  int64
+	start time.Time
+	bytes int64
+}
+
+func newPacer(rate int64) *pacer {
+	return &pacer{rate: rate, start: time.Now()}
+}
+
+// wait accounts for n bytes read, sleeping as long as they are ahead of the
+// rate
+func (p *pacer) wait(ctx context.Context, n int) error {
+	if p.rate <= 0 {
+		return nil
+	}
+
+	p.bytes += int64(n)
+	due := p.start.Add(time.Duration(float64(p.bytes) / float64(p.rate) * float64(time.Second)))
+	d := time.Until(due)
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type pacedReader struct {
+	ctx  context.Context
+	r    io.Reader
+	pace *pacer
+}
+
+func (r *pacedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if perr := r.pace.wait(r.ctx, n); perr != nil && err == nil {
+		err = perr
+	}
+
+	return n, err
+}
@@ -0,0 +1,121 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package scrub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs"
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+// rotFS flips the bits of the files in rot and fails reads of those in bad,
+// leaving their attributes alone, as failing disks under a filer would
+type rotFS struct {
+	*nfs.MemFS
+	rot, bad map[string]bool
+}
+
+func (fs *rotFS) Read(fh []byte, offset uint64, count uint32) ([]byte, bool, error) {
+	if fs.bad[string(fh)] {
+		return nil, false, nfs.NFS3Error(nfs.NFS3ErrIO)
+	}
+
+	data, eof, err := fs.MemFS.Read(fh, offset, count)
+	if fs.rot[string(fh)] {
+		rotten := append([]byte(nil), data...)
+		for i := range rotten {
+			rotten[i] ^= 0xff
+		}
+		data = rotten
+	}
+
+	return data, eof, err
+}
+
+func writeFile(t *testing.T, v *nfs.Target, path, data string) []byte {
+	f, err := v.OpenFile(path, 0644)
+	if err != nil {
+		t.Fatalf("create %s: %s", path, err)
+	}
+	if _, err = f.Write([]byte(data)); err != nil {
+		t.Fatalf("write %s: %s", path, err)
+	}
+	f.Close()
+
+	_, fh, err := v.Lookup(path)
+	if err != nil {
+		t.Fatalf("lookup %s: %s", path, err)
+	}
+
+	return fh
+}
+
+func TestScrub(t *testing.T) {
+	fs := &rotFS{MemFS: nfs.NewMemFS(), rot: make(map[string]bool), bad: make(map[string]bool)}
+	v, err := nfs.DialLoopback(nfs.NewServer(fs)).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	if _, err = v.Mkdir("/archive", 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	a := writeFile(t, v, "/archive/a", "alpha")
+	b := writeFile(t, v, "/archive/b", "bravo")
+	writeFile(t, v, "/archive/c", "charlie")
+
+	first, err := Run(context.Background(), v, "/archive", nil, Options{})
+	if err != nil {
+		t.Fatalf("first run: %s", err)
+	}
+	if first.Files != 3 || first.Bytes != 17 || len(first.Problems) != 0 {
+		t.Fatalf("first run: %+v", first)
+	}
+
+	fs.rot[string(a)] = true
+	fs.bad[string(b)] = true
+	second, err := Run(context.Background(), v, "/archive", first.Manifest, Options{})
+	if err != nil {
+		t.Fatalf("second run: %s", err)
+	}
+	if second.Verified != 1 || len(second.Problems) != 2 {
+		t.Fatalf("second run: %+v", second)
+	}
+	for _, p := range second.Problems {
+		var nfsErr *nfs.Error
+		switch {
+		case p.Path == "a" && p.Kind == Drift:
+		case p.Path == "b" && p.Kind == Unreadable && errors.As(p.Err, &nfsErr) && nfsErr.ErrorNum == nfs.NFS3ErrIO:
+		default:
+			t.Errorf("unexpected problem %s", p)
+		}
+	}
+
+	// the unreadable file keeps its checksum for the next run
+	if second.Manifest.Entries["b"].Checksum != first.Manifest.Entries["b"].Checksum {
+		t.Errorf("checksum of the unreadable file lost")
+	}
+}
+
+func TestScrubRate(t *testing.T) {
+	v, err := nfs.DialLoopback(nfs.NewServer(nfs.NewMemFS())).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+	writeFile(t, v, "/file", string(make([]byte, 1000)))
+
+	start := time.Now()
+	if _, err = Run(context.Background(), v, "/", nil, Options{Rate: 10000}); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Errorf("1000 bytes at 10000 bytes/s read in %s", d)
+	}
+}
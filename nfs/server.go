@@ -0,0 +1,1029 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/util"
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+// Backend is a filesystem exported by a Server.  File handles are opaque to
+// the server, but must be at most 64 bytes long.
+//
+// Errors are sent to the client as nfsstat3 values: an *Error (see
+// NFS3Error) carries its own status, os.ErrNotExist, os.ErrExist and
+// os.ErrPermission map to NOENT, EXIST and ACCES, anything else to IO.
+type Backend interface {
+	// Root returns the handle of the exported directory dirpath
+	Root(dirpath string) ([]byte, error)
+
+	GetAttr(fh []byte) (*Fattr, error)
+	SetAttr(fh []byte, attr Sattr3) error
+	Lookup(dir []byte, name string) ([]byte, error)
+	Readlink(fh []byte) (string, error)
+
+	// Read returns up to count bytes at offset, and whether the end of the
+	// file was reached
+	Read(fh []byte, offset uint64, count uint32) ([]byte, bool, error)
+	Write(fh []byte, offset uint64, data []byte) (int, error)
+	Commit(fh []byte) error
+
+	// Create makes a regular file in dir.  An existing file is an error only
+	// if guarded is set, otherwise attr is applied to it.
+	Create(dir []byte, name string, attr Sattr3, guarded bool) ([]byte, error)
+	Mkdir(dir []byte, name string, attr Sattr3) ([]byte, error)
+	Symlink(dir []byte, name, target string, attr Sattr3) ([]byte, error)
+	Link(fh []byte, dir []byte, name string) error
+	Remove(dir []byte, name string) error
+	RmDir(dir []byte, name string) error
+	Rename(fromDir []byte, fromName string, toDir []byte, toName string) error
+
+	// ReadDir returns the names of the entries of dir, without . and ..
+	ReadDir(dir []byte) ([]string, error)
+	FSStat(fh []byte) (*FSStat, error)
+}
+
+// FSStat is the result of FSSTAT, the space and file counts of a filesystem
+type FSStat struct {
+	Attr     PostOpAttr
+	TBytes   uint64
+	FBytes   uint64
+	ABytes   uint64
+	TFiles   uint64
+	FFiles   uint64
+	AFiles   uint64
+	Invarsec uint32
+}
+
+// FSINFO properties, RFC 1813 section 3.3.19
+const (
+	FSF3Link        = 0x0001
+	FSF3Symlink     = 0x0002
+	FSF3Homogeneous = 0x0008
+	FSF3CanSetTime  = 0x0010
+)
+
+// DefaultServerFSInfo is what a Server reports in FSINFO unless changed with
+// SetFSInfo
+var DefaultServerFSInfo = FSInfo{
+	RTMax:      1 << 20,
+	RTPref:     1 << 16,
+	RTMult:     4096,
+	WTMax:      1 << 20,
+	WTPref:     1 << 16,
+	WTMult:     4096,
+	DTPref:     1 << 16,
+	Size:       1<<63 - 1,
+	TimeDelta:  NFS3Time{Seconds: 0, Nseconds: 1},
+	Properties: FSF3Link | FSF3Symlink | FSF3Homogeneous | FSF3CanSetTime,
+}
+
+// maximum handle size in NFSv3
+const fhSize3 = 64
+
+// Server serves the MOUNT, NFS, NLM and NSM programs from a Backend.  It is an
+// rpc.Server, so it can Serve a listener or hand out in-memory clients with
+// Pipe, see DialLoopback.
+type Server struct {
+	*rpc.Server
+
+	backend Backend
+	fsinfo  FSInfo
+	exports []string
+	flavors []uint32
+
+	// export table, and the backend binding handles to its exports, see
+	// SetExports
+	table []*export
+	bound *boundBackend
+
+	// write verifier, changes when the server restarts
+	verf uint64
+
+	// quirks to mimic, and the calls counted for them, see SetProfile
+	profile  Profile
+	calls    uint64
+	inflight int32
+
+	// network to mimic, see SetShaping
+	shaper *shaper
+
+	// duplicate request cache, see SetDRC
+	drc *drc
+
+	// locks and shares of NLM, see SetLocking
+	locks *lockTable
+}
+
+// NewServer returns a server exporting backend, under the export paths given
+// ("/" if there are none).
+func NewServer(backend Backend, exports ...string) *Server {
+	if len(exports) == 0 {
+		exports = []string{"/"}
+	}
+
+	s := &Server{
+		Server:  rpc.NewServer(),
+		backend: backend,
+		fsinfo:  DefaultServerFSInfo,
+		exports: exports,
+		flavors: []uint32{rpc.AuthFlavorUnix, rpc.AuthFlavorNull},
+		verf:    uint64(time.Now().UnixNano()),
+	}
+
+	s.SetDRC(DefaultDRCSize, DefaultDRCTTL)
+	s.SetLocking(LockOptions{})
+
+	s.Register(MountProg, MountVers, s.serveMount)
+	s.Register(Nfs3Prog, Nfs3Vers, s.serveNFS)
+	s.Register(NLMProg, NLMVers, s.serveNLM)
+	s.Register(StatdProg, StatdVers, s.serveNSM)
+
+	return s
+}
+
+// SetFSInfo sets the limits the server reports in FSINFO
+func (s *Server) SetFSInfo(fsinfo FSInfo) {
+	s.fsinfo = fsinfo
+}
+
+// SetAuthFlavors sets the auth flavors the MNT reply lists as accepted, in
+// order of preference.  They are advertised only, calls are not checked
+// against them unless the server has an export table, see SetExports.
+func (s *Server) SetAuthFlavors(flavors ...uint32) {
+	s.flavors = flavors
+}
+
+// DialLoopback returns a Mount connected to s over an in-memory pipe, so the
+// whole stack, from xdr and record marking to dispatch, can be exercised
+// without sockets.  Targets mounted from it share its connection.
+func DialLoopback(s *Server) *Mount {
+	return &Mount{Client: s.Pipe()}
+}
+
+func (s *Server) serveMount(call *rpc.ServerCall, w io.Writer) error {
+	switch call.Proc {
+	case MountProc3Null:
+		return nil
+
+	case MountProc3MNT:
+		dirpath, err := readString(call.Args)
+		if err != nil {
+			return rpc.ErrGarbageArgs
+		}
+		clean, ok := mountPath(dirpath)
+		if !ok {
+			util.Debugf("server: mnt(%s) from %s: refused, ..", dirpath, call.RemoteAddr)
+			return xdr.Write(w, uint32(MNT3ErrAcces))
+		}
+		dirpath = clean
+
+		flavors := s.flavors
+		var x *export
+		if s.table != nil {
+			var status uint32
+			x, status = s.mountExport(call, dirpath)
+			if status != MNT3Ok {
+				util.Debugf("server: mnt(%s) from %s: refused", dirpath, call.RemoteAddr)
+				return xdr.Write(w, status)
+			}
+			if len(x.Flavors) > 0 {
+				flavors = x.Flavors
+			}
+		}
+
+		fh, err := s.backend.Root(dirpath)
+		if err != nil {
+			util.Debugf("server: mnt(%s): %s", dirpath, err)
+			return xdr.Write(w, mountStatus(err))
+		}
+		if s.table != nil {
+			s.bound.bind(fh, x)
+		}
+
+		return xdr.Write(w, struct {
+			Status  uint32
+			FH      []byte
+			Flavors []uint32
+		}{MNT3Ok, fh, flavors})
+
+	case MountProc3UMNT:
+		if _, err := readString(call.Args); err != nil {
+			return rpc.ErrGarbageArgs
+		}
+		return nil
+
+	case MountProc3Export:
+		// exports list of exportnode, each with the clients of the export
+		// table as its groups
+		for i, dir := range s.exports {
+			xdr.Write(w, struct {
+				Follows bool
+				Dir     string
+			}{true, dir})
+			if s.table != nil {
+				for _, c := range s.table[i].Clients {
+					xdr.Write(w, struct {
+						Follows bool
+						Name    string
+					}{true, c})
+				}
+			}
+			xdr.Write(w, false)
+		}
+		return xdr.Write(w, false)
+	}
+
+	return rpc.ErrProcUnavail
+}
+
+// mountStatus maps a backend error to a mountstat3
+func mountStatus(err error) uint32 {
+	switch status := nfsStatus(err); status {
+	case NFS3ErrPerm, NFS3ErrNoEnt, NFS3ErrIO, NFS3ErrAcces, NFS3ErrNotDir, NFS3ErrInval, NFS3ErrNameTooLong, NFS3ErrNotSupp, NFS3ErrServerFault:
+		return status
+	default:
+		return MNT3ErrServerFault
+	}
+}
+
+// nfsStatus maps a backend error to an nfsstat3
+func nfsStatus(err error) uint32 {
+	if err == nil {
+		return NFS3Ok
+	}
+
+	if e, ok := err.(*Error); ok {
+		return e.ErrorNum
+	}
+
+	switch {
+	case os.IsNotExist(err):
+		return NFS3ErrNoEnt
+	case os.IsExist(err):
+		return NFS3ErrExist
+	case os.IsPermission(err):
+		return NFS3ErrAcces
+	}
+
+	return NFS3ErrIO
+}
+
+func readString(r io.Reader) (string, error) {
+	var s string
+	err := xdr.Read(r, &s)
+	return s, err
+}
+
+// postOpAttr returns the attributes of fh, if the backend can tell
+func (s *Server) postOpAttr(fh []byte) PostOpAttr {
+	attr, err := s.backend.GetAttr(fh)
+	if err != nil {
+		return PostOpAttr{}
+	}
+
+	return PostOpAttr{IsSet: true, Attr: *attr}
+}
+
+// preOpAttr returns the wcc data of fh before a change, to be completed by
+// wccData
+func (s *Server) preOpAttr(fh []byte) WccData {
+	var wcc WccData
+	if attr, err := s.backend.GetAttr(fh); err == nil {
+		wcc.Before.IsSet = true
+		wcc.Before.Size = attr.Filesize
+		wcc.Before.MTime = attr.Mtime
+		wcc.Before.CTime = attr.Ctime
+	}
+
+	return wcc
+}
+
+func (s *Server) wccData(fh []byte, wcc WccData) WccData {
+	wcc.After = s.postOpAttr(fh)
+	return wcc
+}
+
+func (s *Server) serveNFS(call *rpc.ServerCall, w io.Writer) error {
+	w, shaped := s.shape(call, w)
+	defer shaped()
+
+	if call.Proc == NFSProc3Null {
+		return nil
+	}
+	if s.drc != nil && nonIdempotent(call.Proc) {
+		return s.drc.serve(call, w, s.serveProc)
+	}
+
+	return s.serveProc(call, w)
+}
+
+// serveProc serves a call of an NFS procedure
+func (s *Server) serveProc(call *rpc.ServerCall, w io.Writer) error {
+	h, ok := nfsHandlers[call.Proc]
+	if !ok {
+		return rpc.ErrProcUnavail
+	}
+
+	args := call.Args
+	var fhs [][]byte
+	if s.table != nil {
+		var err error
+		if fhs, args, err = callHandles(call.Proc, args); err != nil {
+			return rpc.ErrGarbageArgs
+		}
+	}
+
+	g, status, err := s.grant(call, fhs...)
+	switch {
+	case err != nil:
+		return err
+	case status == NFS3Ok && g != nil && g.readOnly && modifying(call.Proc):
+		status = NFS3ErrROFS
+	}
+	if status != NFS3Ok {
+		util.Debugf("server: %s from %s: %s", ProcName(call.Proc), call.RemoteAddr, StatusName(status))
+		return writeFailure(w, call.Proc, status)
+	}
+
+	quirk, done := s.quirk(call.Proc)
+	defer done()
+	if quirk != NFS3Ok {
+		util.Debugf("server: %s: %s, as profiled", ProcName(call.Proc), StatusName(quirk))
+		return writeFailure(w, call.Proc, quirk)
+	}
+
+	if g != nil {
+		args = &grantedArgs{Reader: args, grant: g}
+	}
+	status, res, err := h(s, args)
+	if err != nil {
+		return rpc.ErrGarbageArgs
+	}
+
+	if status != NFS3Ok {
+		util.Debugf("server: %s: %s", ProcName(call.Proc), StatusName(status))
+	}
+
+	if err = xdr.Write(w, status); err != nil {
+		return err
+	}
+	if seq, ok := res.(xdrSeq); ok {
+		for _, v := range seq {
+			if err = xdr.Write(w, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if res == nil {
+		return nil
+	}
+
+	return xdr.Write(w, res)
+}
+
+// xdrSeq is a result written as the plain sequence of its elements, for
+// results holding xdr optional-data lists
+type xdrSeq []interface{}
+
+// nfsHandler decodes the arguments of a procedure from args and returns the
+// status and the result to send, the resok or resfail body depending on
+// status.  An error means the arguments could not be decoded.
+type nfsHandler func(s *Server, args io.Reader) (uint32, interface{}, error)
+
+var nfsHandlers map[uint32]nfsHandler
+
+func init() {
+	nfsHandlers = map[uint32]nfsHandler{
+		NFSProc3GetAttr:     serveGetAttr,
+		NFSProc3SetAttr:     serveSetAttr,
+		NFSProc3Lookup:      serveLookup,
+		NFSProc3Access:      serveAccess,
+		NFSProc3Readlink:    serveReadlink,
+		NFSProc3Read:        serveRead,
+		NFSProc3Write:       serveWrite,
+		NFSProc3Create:      serveCreate,
+		NFSProc3Mkdir:       serveMkdir,
+		NFSProc3Symlink:     serveSymlink,
+		NFSProc3MkNod:       serveMkNod,
+		NFSProc3Remove:      serveRemove,
+		NFSProc3RmDir:       serveRmDir,
+		NFSProc3Rename:      serveRename,
+		NFSProc3Link:        serveLink,
+		NFSProc3ReadDir:     serveReadDir,
+		NFSProc3ReadDirPlus: serveReadDirPlus,
+		NFSProc3FSStat:      serveFSStat,
+		NFSProc3FSInfo:      serveFSInfo,
+		NFSProc3PathConf:    servePathConf,
+		NFSProc3Commit:      serveCommit,
+	}
+}
+
+func readHandle(r io.Reader) ([]byte, error) {
+	var fh []byte
+	if err := xdr.Read(r, &fh); err != nil {
+		return nil, err
+	}
+
+	if len(fh) > fhSize3 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return fh, nil
+}
+
+func serveGetAttr(s *Server, args io.Reader) (uint32, interface{}, error) {
+	fh, err := readHandle(args)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	attr, err := s.backend.GetAttr(fh)
+	if err != nil {
+		return nfsStatus(err), nil, nil
+	}
+
+	return NFS3Ok, attr, nil
+}
+
+func serveSetAttr(s *Server, args io.Reader) (uint32, interface{}, error) {
+	var a struct {
+		FH    []byte
+		Attr  Sattr3
+		Guard Guard
+	}
+	if err := xdr.Read(args, &a); err != nil {
+		return 0, nil, err
+	}
+
+	wcc := s.preOpAttr(a.FH)
+	if a.Guard.Check && (!wcc.Before.IsSet || wcc.Before.CTime != a.Guard.Ctime) {
+		return NFS3ErrNotSync, s.wccData(a.FH, wcc), nil
+	}
+
+	if a.Attr.Size.SetIt && a.Attr.Size.Size > s.fsinfo.Size {
+		return NFS3ErrFBig, s.wccData(a.FH, wcc), nil
+	}
+	if squashedChown(args, a.Attr) {
+		return NFS3ErrPerm, s.wccData(a.FH, wcc), nil
+	}
+
+	err := s.backend.SetAttr(a.FH, a.Attr)
+	return nfsStatus(err), s.wccData(a.FH, wcc), nil
+}
+
+func serveLookup(s *Server, args io.Reader) (uint32, interface{}, error) {
+	var a Diropargs3
+	if err := xdr.Read(args, &a); err != nil {
+		return 0, nil, err
+	}
+
+	fh, err := s.backend.Lookup(a.FH, a.Filename)
+	if err != nil {
+		return nfsStatus(err), s.postOpAttr(a.FH), nil
+	}
+
+	return NFS3Ok, struct {
+		FH      []byte
+		Attr    PostOpAttr
+		DirAttr PostOpAttr
+	}{fh, s.postOpAttr(fh), s.postOpAttr(a.FH)}, nil
+}
+
+func serveAccess(s *Server, args io.Reader) (uint32, interface{}, error) {
+	var a struct {
+		FH     []byte
+		Access uint32
+	}
+	if err := xdr.Read(args, &a); err != nil {
+		return 0, nil, err
+	}
+
+	attr := s.postOpAttr(a.FH)
+	if !attr.IsSet {
+		return NFS3ErrStale, attr, nil
+	}
+
+	// permissions are up to the backend, grant whatever was asked for but
+	// changes under a read-only export
+	if g := callGrant(args); g != nil && g.readOnly {
+		a.Access &^= ACCESS3_MODIFY | ACCESS3_EXTEND | ACCESS3_DELETE
+	}
+	return NFS3Ok, struct {
+		Attr   PostOpAttr
+		Access uint32
+	}{attr, a.Access}, nil
+}
+
+func serveReadlink(s *Server, args io.Reader) (uint32, interface{}, error) {
+	fh, err := readHandle(args)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	target, err := s.backend.Readlink(fh)
+	if err != nil {
+		return nfsStatus(err), s.postOpAttr(fh), nil
+	}
+
+	return NFS3Ok, struct {
+		Attr   PostOpAttr
+		Target string
+	}{s.postOpAttr(fh), target}, nil
+}
+
+func serveRead(s *Server, args io.Reader) (uint32, interface{}, error) {
+	var a struct {
+		FH     []byte
+		Offset uint64
+		Count  uint32
+	}
+	if err := xdr.Read(args, &a); err != nil {
+		return 0, nil, err
+	}
+
+	if a.Count > s.fsinfo.RTMax {
+		a.Count = s.fsinfo.RTMax
+	}
+
+	data, eof, err := s.backend.Read(a.FH, a.Offset, a.Count)
+	if err != nil {
+		return nfsStatus(err), s.postOpAttr(a.FH), nil
+	}
+
+	return NFS3Ok, struct {
+		Attr  PostOpAttr
+		Count uint32
+		EOF   bool
+		Data  []byte
+	}{s.postOpAttr(a.FH), uint32(len(data)), eof, data}, nil
+}
+
+func serveWrite(s *Server, args io.Reader) (uint32, interface{}, error) {
+	var a struct {
+		FH       []byte
+		Offset   uint64
+		Count    uint32
+		How      uint32
+		Contents []byte
+	}
+	if err := xdr.Read(args, &a); err != nil {
+		return 0, nil, err
+	}
+
+	if a.Count < uint32(len(a.Contents)) {
+		a.Contents = a.Contents[:a.Count]
+	}
+
+	wcc := s.preOpAttr(a.FH)
+	if a.Count > s.fsinfo.WTMax {
+		return NFS3ErrInval, s.wccData(a.FH, wcc), nil
+	}
+	if a.Offset > s.fsinfo.Size || uint64(len(a.Contents)) > s.fsinfo.Size-a.Offset {
+		return NFS3ErrFBig, s.wccData(a.FH, wcc), nil
+	}
+
+	n, err := s.backend.Write(a.FH, a.Offset, a.Contents)
+	if err != nil {
+		return nfsStatus(err), s.wccData(a.FH, wcc), nil
+	}
+
+	// stable writes are committed before they are acknowledged, backends
+	// may hold what is written until a COMMIT
+	how := a.How
+	if how > FileSync {
+		how = FileSync
+	}
+	if how != Unstable {
+		if err = s.backend.Commit(a.FH); err != nil {
+			return nfsStatus(err), s.wccData(a.FH, wcc), nil
+		}
+	}
+
+	return NFS3Ok, struct {
+		Wcc   WccData
+		Count uint32
+		How   uint32
+		Verf  uint64
+	}{s.wccData(a.FH, wcc), uint32(n), how, s.verf}, nil
+}
+
+// diropRes is the result of the procedures creating an object
+type diropRes struct {
+	FH     PostOpFH3
+	Attr   PostOpAttr
+	DirWcc WccData
+}
+
+func (s *Server) diropRes(dir []byte, wcc WccData, fh []byte, err error) (uint32, interface{}, error) {
+	if err != nil {
+		return nfsStatus(err), s.wccData(dir, wcc), nil
+	}
+
+	return NFS3Ok, &diropRes{
+		FH:     PostOpFH3{IsSet: true, FH: fh},
+		Attr:   s.postOpAttr(fh),
+		DirWcc: s.wccData(dir, wcc),
+	}, nil
+}
+
+func serveCreate(s *Server, args io.Reader) (uint32, interface{}, error) {
+	var a struct {
+		Where Diropargs3
+		Mode  uint32
+	}
+	if err := xdr.Read(args, &a); err != nil {
+		return 0, nil, err
+	}
+
+	var attr Sattr3
+	switch a.Mode {
+	case 0, 1:
+		if err := xdr.Read(args, &attr); err != nil {
+			return 0, nil, err
+		}
+	case 2:
+		// the verifier is kept in the atime and mtime of the file, until
+		// the client sets them, to tell a retransmission from a conflict
+		var verf uint64
+		if err := xdr.Read(args, &verf); err != nil {
+			return 0, nil, err
+		}
+		attr.Atime = SetTime{SetIt: SetToClientTime, Time: NFS3Time{Seconds: uint32(verf >> 32)}}
+		attr.Mtime = SetTime{SetIt: SetToClientTime, Time: NFS3Time{Seconds: uint32(verf)}}
+	default:
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+
+	wcc := s.preOpAttr(a.Where.FH)
+	if attr.Size.SetIt && attr.Size.Size > s.fsinfo.Size {
+		return NFS3ErrFBig, s.wccData(a.Where.FH, wcc), nil
+	}
+	if _, err := s.backend.Lookup(a.Where.FH, a.Where.Filename); err != nil {
+		// a new file, not one the attributes are applied to
+		own(args, &attr)
+	}
+	fh, err := s.backend.Create(a.Where.FH, a.Where.Filename, attr, a.Mode != 0)
+	if os.IsExist(err) && a.Mode == 2 {
+		// the file this very create made, if the verifier matches
+		if efh, lerr := s.backend.Lookup(a.Where.FH, a.Where.Filename); lerr == nil {
+			if eattr, gerr := s.backend.GetAttr(efh); gerr == nil && eattr.Type == NF3Reg &&
+				eattr.Atime == attr.Atime.Time && eattr.Mtime == attr.Mtime.Time {
+				fh, err = efh, nil
+			}
+		}
+	}
+	return s.diropRes(a.Where.FH, wcc, fh, err)
+}
+
+func serveMkdir(s *Server, args io.Reader) (uint32, interface{}, error) {
+	var a struct {
+		Where Diropargs3
+		Attr  Sattr3
+	}
+	if err := xdr.Read(args, &a); err != nil {
+		return 0, nil, err
+	}
+
+	wcc := s.preOpAttr(a.Where.FH)
+	own(args, &a.Attr)
+	fh, err := s.backend.Mkdir(a.Where.FH, a.Where.Filename, a.Attr)
+	return s.diropRes(a.Where.FH, wcc, fh, err)
+}
+
+func serveSymlink(s *Server, args io.Reader) (uint32, interface{}, error) {
+	var a struct {
+		Where  Diropargs3
+		Attr   Sattr3
+		Target string
+	}
+	if err := xdr.Read(args, &a); err != nil {
+		return 0, nil, err
+	}
+
+	wcc := s.preOpAttr(a.Where.FH)
+	own(args, &a.Attr)
+	fh, err := s.backend.Symlink(a.Where.FH, a.Where.Filename, a.Target, a.Attr)
+	return s.diropRes(a.Where.FH, wcc, fh, err)
+}
+
+func serveMkNod(s *Server, args io.Reader) (uint32, interface{}, error) {
+	var a Diropargs3
+	if err := xdr.Read(args, &a); err != nil {
+		return 0, nil, err
+	}
+
+	return NFS3ErrNotSupp, s.wccData(a.FH, s.preOpAttr(a.FH)), nil
+}
+
+func serveRemove(s *Server, args io.Reader) (uint32, interface{}, error) {
+	var a Diropargs3
+	if err := xdr.Read(args, &a); err != nil {
+		return 0, nil, err
+	}
+
+	wcc := s.preOpAttr(a.FH)
+	err := s.backend.Remove(a.FH, a.Filename)
+	return nfsStatus(err), s.wccData(a.FH, wcc), nil
+}
+
+func serveRmDir(s *Server, args io.Reader) (uint32, interface{}, error) {
+	var a Diropargs3
+	if err := xdr.Read(args, &a); err != nil {
+		return 0, nil, err
+	}
+
+	wcc := s.preOpAttr(a.FH)
+	err := s.backend.RmDir(a.FH, a.Filename)
+	return nfsStatus(err), s.wccData(a.FH, wcc), nil
+}
+
+func serveRename(s *Server, args io.Reader) (uint32, interface{}, error) {
+	var a struct {
+		From Diropargs3
+		To   Diropargs3
+	}
+	if err := xdr.Read(args, &a); err != nil {
+		return 0, nil, err
+	}
+
+	fromWcc := s.preOpAttr(a.From.FH)
+	toWcc := s.preOpAttr(a.To.FH)
+	err := s.backend.Rename(a.From.FH, a.From.Filename, a.To.FH, a.To.Filename)
+
+	return nfsStatus(err), struct {
+		FromDirWcc WccData
+		ToDirWcc   WccData
+	}{s.wccData(a.From.FH, fromWcc), s.wccData(a.To.FH, toWcc)}, nil
+}
+
+func serveLink(s *Server, args io.Reader) (uint32, interface{}, error) {
+	var a struct {
+		FH   []byte
+		Link Diropargs3
+	}
+	if err := xdr.Read(args, &a); err != nil {
+		return 0, nil, err
+	}
+
+	wcc := s.preOpAttr(a.Link.FH)
+	err := s.backend.Link(a.FH, a.Link.FH, a.Link.Filename)
+
+	return nfsStatus(err), struct {
+		Attr   PostOpAttr
+		DirWcc WccData
+	}{s.postOpAttr(a.FH), s.wccData(a.Link.FH, wcc)}, nil
+}
+
+// cookieVerf returns the verifier of the listing of dir, its mtime
+func cookieVerf(attr *PostOpAttr) uint64 {
+	if !attr.IsSet {
+		return 0
+	}
+
+	return uint64(attr.Attr.Mtime.Seconds)<<32 | uint64(attr.Attr.Mtime.Nseconds)
+}
+
+// readDirPage returns the names of dir from cookie on, as READDIR and
+// READDIRPLUS number them: the cookie of an entry is its index plus one.
+func (s *Server) readDirPage(fh []byte, cookie, verf uint64) (PostOpAttr, []string, uint32) {
+	attr := s.postOpAttr(fh)
+	names, err := s.backend.ReadDir(fh)
+	if err != nil {
+		return attr, nil, nfsStatus(err)
+	}
+
+	if cookie > uint64(len(names)) {
+		return attr, nil, NFS3ErrBadCookie
+	}
+	if cookie != 0 && verf != 0 && verf != cookieVerf(&attr) {
+		return attr, nil, NFS3ErrBadCookie
+	}
+
+	return attr, names[cookie:], NFS3Ok
+}
+
+// xdrSize returns the encoded size of an opaque or string of n bytes
+func xdrSize(n int) uint32 {
+	return uint32(4 + (n+3)&^3)
+}
+
+func serveReadDir(s *Server, args io.Reader) (uint32, interface{}, error) {
+	var a struct {
+		FH         []byte
+		Cookie     uint64
+		CookieVerf uint64
+		Count      uint32
+	}
+	if err := xdr.Read(args, &a); err != nil {
+		return 0, nil, err
+	}
+
+	attr, names, status := s.readDirPage(a.FH, a.Cookie, a.CookieVerf)
+	if status != NFS3Ok {
+		return status, attr, nil
+	}
+
+	type entry3 struct {
+		Follows  bool
+		FileId   uint64
+		FileName string
+		Cookie   uint64
+	}
+
+	res := xdrSeq{attr, cookieVerf(&attr)}
+
+	// dir attributes, verifier, end of list and eof
+	size := 4 + 84 + 8 + 4 + 4
+	n := 0
+	eof := true
+	for i, name := range names {
+		fh, err := s.backend.Lookup(a.FH, name)
+		if err != nil {
+			continue
+		}
+		fattr, err := s.backend.GetAttr(fh)
+		if err != nil {
+			continue
+		}
+
+		size += 4 + 8 + int(xdrSize(len(name))) + 8
+		if uint32(size) > a.Count {
+			eof = false
+			break
+		}
+
+		res = append(res, &entry3{true, fattr.Fileid, name, a.Cookie + uint64(i) + 1})
+		n++
+	}
+	if !eof && n == 0 {
+		return NFS3ErrTooSmall, attr, nil
+	}
+
+	return NFS3Ok, append(res, false, eof), nil
+}
+
+func serveReadDirPlus(s *Server, args io.Reader) (uint32, interface{}, error) {
+	var a struct {
+		FH         []byte
+		Cookie     uint64
+		CookieVerf uint64
+		DirCount   uint32
+		MaxCount   uint32
+	}
+	if err := xdr.Read(args, &a); err != nil {
+		return 0, nil, err
+	}
+
+	attr, names, status := s.readDirPage(a.FH, a.Cookie, a.CookieVerf)
+	if status != NFS3Ok {
+		return status, attr, nil
+	}
+
+	type entryPlus3 struct {
+		Follows bool
+		Entry   EntryPlus
+	}
+
+	res := xdrSeq{attr, cookieVerf(&attr)}
+
+	size := 4 + 84 + 8 + 4 + 4
+	dirSize := 0
+	n := 0
+	eof := true
+	for i, name := range names {
+		fh, err := s.backend.Lookup(a.FH, name)
+		if err != nil {
+			continue
+		}
+		fattr, err := s.backend.GetAttr(fh)
+		if err != nil {
+			continue
+		}
+
+		nameSize := 8 + int(xdrSize(len(name))) + 8
+		dirSize += nameSize
+		size += 4 + nameSize + 4 + 84 + 4 + int(xdrSize(len(fh)))
+		if uint32(size) > a.MaxCount || uint32(dirSize) > a.DirCount {
+			eof = false
+			break
+		}
+
+		res = append(res, &entryPlus3{true, EntryPlus{
+			FileId:   fattr.Fileid,
+			FileName: name,
+			Cookie:   a.Cookie + uint64(i) + 1,
+			Attr:     PostOpAttr{IsSet: true, Attr: *fattr},
+			Handle:   PostOpFH3{IsSet: true, FH: fh},
+		}})
+		n++
+	}
+	if !eof && n == 0 {
+		return NFS3ErrTooSmall, attr, nil
+	}
+
+	return NFS3Ok, append(res, false, eof), nil
+}
+
+func serveFSStat(s *Server, args io.Reader) (uint32, interface{}, error) {
+	fh, err := readHandle(args)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	fsstat, err := s.backend.FSStat(fh)
+	if err != nil {
+		return nfsStatus(err), s.postOpAttr(fh), nil
+	}
+	fsstat.Attr = s.postOpAttr(fh)
+
+	return NFS3Ok, fsstat, nil
+}
+
+func serveFSInfo(s *Server, args io.Reader) (uint32, interface{}, error) {
+	fh, err := readHandle(args)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	fsinfo := s.fsinfo
+	fsinfo.Attr = s.postOpAttr(fh)
+	if !fsinfo.Attr.IsSet {
+		return NFS3ErrStale, fsinfo.Attr, nil
+	}
+
+	return NFS3Ok, &fsinfo, nil
+}
+
+func servePathConf(s *Server, args io.Reader) (uint32, interface{}, error) {
+	fh, err := readHandle(args)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	attr := s.postOpAttr(fh)
+	if !attr.IsSet {
+		return NFS3ErrStale, attr, nil
+	}
+
+	nameMax, noTrunc := uint32(255), true
+	if n := s.profile.NameMax; n > 0 {
+		nameMax, noTrunc = uint32(n), false
+	}
+
+	return NFS3Ok, struct {
+		Attr            PostOpAttr
+		LinkMax         uint32
+		NameMax         uint32
+		NoTrunc         bool
+		ChownRestricted bool
+		CaseInsensitive bool
+		CasePreserving  bool
+	}{attr, 32000, nameMax, noTrunc, true, false, true}, nil
+}
+
+func serveCommit(s *Server, args io.Reader) (uint32, interface{}, error) {
+	var a struct {
+		FH     []byte
+		Offset uint64
+		Count  uint32
+	}
+	if err := xdr.Read(args, &a); err != nil {
+		return 0, nil, err
+	}
+
+	wcc := s.preOpAttr(a.FH)
+	if err := s.backend.Commit(a.FH); err != nil {
+		return nfsStatus(err), s.wccData(a.FH, wcc), nil
+	}
+
+	return NFS3Ok, struct {
+		Wcc  WccData
+		Verf uint64
+	}{s.wccData(a.FH, wcc), s.verf}, nil
+}
+
+// handleID encodes id as an 8 byte handle, for backends that number their
+// files
+func handleID(id uint64) []byte {
+	fh := make([]byte, 8)
+	binary.BigEndian.PutUint64(fh, id)
+	return fh
+}
+
+// parseHandleID is the reverse of handleID
+func parseHandleID(fh []byte) (uint64, bool) {
+	if len(fh) != 8 {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint64(fh), true
+}
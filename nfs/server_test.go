@@ -0,0 +1,203 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+// loopbackTarget mounts a fresh in-memory filesystem over a pipe
+func loopbackTarget(t *testing.T) *Target {
+	m := DialLoopback(NewServer(NewMemFS()))
+
+	v, err := m.Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+
+	return v
+}
+
+func TestLoopback(t *testing.T) {
+	v := loopbackTarget(t)
+	defer v.Close()
+
+	if _, err := v.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+
+	f, err := v.OpenFile("/dir/file", 0644)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	data := bytes.Repeat([]byte("0123456789"), 20000)
+	if _, err = f.Write(data); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+
+	f, err = v.Open("/dir/file")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read back %d bytes, wrote %d", len(got), len(data))
+	}
+
+	// enough entries to need several READDIRPLUS calls
+	for i := 0; i < 100; i++ {
+		if _, err = v.Create("/dir/f"+string(rune('a'+i%26))+string(rune('a'+i/26)), 0644); err != nil {
+			t.Fatalf("create: %s", err)
+		}
+	}
+	entries, err := v.ReadDirPlus("/dir")
+	if err != nil {
+		t.Fatalf("readdirplus: %s", err)
+	}
+	if len(entries) != 101 {
+		t.Fatalf("expected 101 entries, got %d", len(entries))
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.FileName
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Fatalf("entries listed out of order or twice: %v", names)
+	}
+
+	if err = v.Rename("/dir/file", "/moved"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+	attr, _, err := v.GetAttr("/moved")
+	if err != nil || attr.Size() != int64(len(data)) {
+		t.Fatalf("getattr after rename: %v, %v", attr, err)
+	}
+
+	if err = v.RmDir("/dir"); !IsNotEmptyError(err) {
+		t.Fatalf("expected NOTEMPTY removing a full directory, got %v", err)
+	}
+	if err = v.RemoveAll("/dir"); err != nil {
+		t.Fatalf("removeall: %s", err)
+	}
+	if _, _, err = v.Lookup("/dir"); !os.IsNotExist(err) {
+		t.Fatalf("expected the directory to be gone, got %v", err)
+	}
+}
+
+func TestRemoveAny(t *testing.T) {
+	v := loopbackTarget(t)
+	defer v.Close()
+
+	_, err := v.Mkdir("/dir", 0755)
+	if err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	writeFile(t, v, "/dir/file", "data")
+
+	var nerr *NotEmptyError
+	if err = v.RemoveAny("/dir"); !errors.As(err, &nerr) || nerr.Path != "/dir" || !IsNotEmptyError(err) {
+		t.Fatalf("remove of a full directory: %v", err)
+	}
+	for _, path := range []string{"/dir/file", "/dir/"} {
+		if err = v.RemoveAny(path); err != nil {
+			t.Fatalf("remove %s: %s", path, err)
+		}
+		if _, _, err = v.Lookup(path); !os.IsNotExist(err) {
+			t.Errorf("%s left: %v", path, err)
+		}
+	}
+	if err = v.RemoveAny("/dir"); !os.IsNotExist(err) {
+		t.Errorf("remove of a missing entry: %v", err)
+	}
+	if err = v.RemoveAny("/"); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("remove of the root: %v", err)
+	}
+}
+
+func TestLookupChild(t *testing.T) {
+	v := loopbackTarget(t)
+	defer v.Close()
+
+	dirFh, err := v.Mkdir("/dir", 0755)
+	if err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	writeFile(t, v, "/dir/file", "data")
+
+	fh, attr, dirAttr, err := v.LookupChild(dirFh, "file")
+	if err != nil {
+		t.Fatalf("lookup child: %s", err)
+	}
+	if _, want, _ := v.Lookup("/dir/file"); !bytes.Equal(fh, want) {
+		t.Errorf("handle 0x%x, want 0x%x", fh, want)
+	}
+	if attr.Filesize != 4 || dirAttr.Type != NF3Dir {
+		t.Errorf("attrs %+v, dir attrs %+v", attr, dirAttr)
+	}
+
+	if _, _, _, err := v.LookupChild(dirFh, "missing"); !os.IsNotExist(err) {
+		t.Errorf("missing child: %v", err)
+	}
+}
+
+func TestMountExports(t *testing.T) {
+	m := DialLoopback(NewServer(NewMemFS(), "/a", "/b"))
+	defer m.Close()
+
+	exports, err := m.Exports()
+	if err != nil {
+		t.Fatalf("export: %s", err)
+	}
+	if len(exports) != 2 || exports[0].Dir != "/a" || exports[1].Dir != "/b" {
+		t.Fatalf("unexpected exports %v", exports)
+	}
+}
+
+func TestMountAuthFlavors(t *testing.T) {
+	unix := rpc.NewAuthUnix("client", 1000, 1000).Auth()
+
+	s := NewServer(NewMemFS())
+	s.SetAuthFlavors(rpc.AuthFlavorKRB5, rpc.AuthFlavorKRB5I)
+	if _, err := DialLoopback(s).Mount("/", unix); err == nil || !strings.Contains(err.Error(), "kerberos") {
+		t.Fatalf("expected a kerberos error mounting a krb5 export, got %v", err)
+	}
+
+	s = NewServer(NewMemFS())
+	s.SetAuthFlavors(rpc.AuthFlavorNull)
+	if _, err := DialLoopback(s).Mount("/", unix); err == nil {
+		t.Fatal("expected the mount to fail rather than fall back to AUTH_NULL")
+	}
+
+	// and a krb5 export fails even so
+	s.SetAuthFlavors(rpc.AuthFlavorKRB5, rpc.AuthFlavorNull)
+	m := DialLoopback(s)
+	m.SetAuthFallback(true)
+	if _, err := m.Mount("/", unix); err == nil || !strings.Contains(err.Error(), "kerberos") {
+		t.Fatalf("expected a kerberos error, got %v", err)
+	}
+
+	s.SetAuthFlavors(rpc.AuthFlavorNull)
+	v, err := m.Mount("/", unix)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+	if v.auth.Flavor != rpc.AuthFlavorNull {
+		t.Fatalf("expected a fallback to AUTH_NULL, got flavor %d", v.auth.Flavor)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+// Latency is a distribution of the time a call takes to be answered, beyond
+// serving it: uniform between Min and Max, plus Tail for a TailRatio of the
+// calls, as the long tail of a loaded filer, for hedging to cut
+type Latency struct {
+	Min, Max  time.Duration
+	TailRatio float64
+	Tail      time.Duration
+}
+
+// Shaping is the network a Server mimics once set with SetShaping, to tell
+// how readahead, nconnect or hedging fare over a WAN without one.  Fields
+// left zero add no delay.
+type Shaping struct {
+	// Latency delays every NFS call, but those of the procedures in
+	// ProcLatency, which delays them instead
+	Latency     Latency
+	ProcLatency map[uint32]Latency
+
+	// Upload and Download are the bandwidth of the link in bytes per
+	// second, of calls and of replies.  Calls in flight share it: they
+	// cross the link one after the other, as over a single pipe.
+	Upload, Download int64
+
+	// Seed makes the delays drawn the same from one run to the next
+	Seed int64
+}
+
+// Some networks, by name
+var Shapings = map[string]Shaping{
+	"lan": {Latency: Latency{Min: 100 * time.Microsecond, Max: 300 * time.Microsecond}},
+	"metro": {
+		Latency:  Latency{Min: 2 * time.Millisecond, Max: 4 * time.Millisecond},
+		Upload:   100 << 20,
+		Download: 100 << 20,
+	},
+	"wan": {
+		Latency:  Latency{Min: 40 * time.Millisecond, Max: 60 * time.Millisecond, TailRatio: 0.01, Tail: 500 * time.Millisecond},
+		Upload:   10 << 20,
+		Download: 10 << 20,
+	},
+}
+
+// SetShaping has the calls of the server delayed as sh tells, see Shaping.
+// It is to be set before the server serves calls.
+func (s *Server) SetShaping(sh Shaping) {
+	s.shaper = &shaper{
+		Shaping:  sh,
+		rand:     rand.New(rand.NewSource(sh.Seed)),
+		upload:   &link{rate: sh.Upload},
+		download: &link{rate: sh.Download},
+	}
+}
+
+type shaper struct {
+	Shaping
+
+	mu   sync.Mutex
+	rand *rand.Rand
+
+	upload, download *link
+}
+
+// delay returns the latency drawn for a call of proc
+func (sh *shaper) delay(proc uint32) time.Duration {
+	l, ok := sh.ProcLatency[proc]
+	if !ok {
+		l = sh.Latency
+	}
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	d := l.Min
+	if l.Max > l.Min {
+		d += time.Duration(sh.rand.Int63n(int64(l.Max - l.Min)))
+	}
+	if l.TailRatio > 0 && sh.rand.Float64() < l.TailRatio {
+		d += l.Tail
+	}
+
+	return d
+}
+
+// link is a pipe of rate bytes per second, which transfers cross in turn
+type link struct {
+	rate int64
+
+	mu   sync.Mutex
+	free time.Time
+}
+
+// cross waits for n bytes to cross the link, after those before them
+func (l *link) cross(n int) {
+	if l.rate <= 0 || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.free.Before(now) {
+		l.free = now
+	}
+	l.free = l.free.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	until := l.free
+	l.mu.Unlock()
+
+	time.Sleep(time.Until(until))
+}
+
+// countingWriter counts the bytes of a reply
+type countingWriter struct {
+	io.Writer
+	n int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += n
+	return n, err
+}
+
+// shape delays call as the shaping of the server tells, its arguments
+// crossing the link and the latency drawn before it is served, and returns
+// the writer of its reply and the func to call once the reply is written,
+// which waits for it to cross back
+func (s *Server) shape(call *rpc.ServerCall, w io.Writer) (io.Writer, func()) {
+	sh := s.shaper
+	if sh == nil {
+		return w, func() {}
+	}
+
+	if args, ok := call.Args.(interface{ Len() int }); ok {
+		sh.upload.cross(args.Len())
+	}
+	time.Sleep(sh.delay(call.Proc))
+
+	cw := &countingWriter{Writer: w}
+	return cw, func() { sh.download.cross(cw.n) }
+}
@@ -0,0 +1,67 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+func TestShaping(t *testing.T) {
+	s := NewServer(NewMemFS())
+	s.SetShaping(Shaping{
+		ProcLatency: map[uint32]Latency{
+			NFSProc3GetAttr: {Min: 20 * time.Millisecond, Max: 30 * time.Millisecond},
+		},
+		Download: 4 << 20,
+	})
+	v, err := DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	const size = 256 << 10
+	f, err := v.OpenFile("/data", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write(bytes.Repeat([]byte{'x'}, size)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	_, fh, err := v.Lookup("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err = v.getAttr(fh); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("getattr took %s", d)
+	}
+
+	// two reads in flight share the link: 512KiB at 4MiB/s
+	start = time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := v.ReadRanges(fh, []Range{{Offset: 0, Length: size}}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if d := time.Since(start); d < 125*time.Millisecond {
+		t.Errorf("reads took %s", d)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"fmt"
+	"os"
+	_path "path"
+	"sort"
+	"time"
+)
+
+// Where filers expose read-only snapshots of an export, relative to its root
+const (
+	// NetApp ONTAP, also reachable from every directory
+	NetAppSnapshotDir = ".snapshot"
+	// ZFS, at the root of each dataset
+	ZFSSnapshotDir = ".zfs/snapshot"
+)
+
+// Snapshot is a snapshot of the export found by Snapshots
+type Snapshot struct {
+	Name string
+	// Dir is the snapshot directory it lives in, NetAppSnapshotDir or
+	// ZFSSnapshotDir
+	Dir  string
+	Attr *Fattr
+}
+
+// Root returns the path of the export root within the snapshot
+func (s Snapshot) Root() string {
+	return _path.Join("/", s.Dir, s.Name)
+}
+
+// Path maps a path of the live filesystem to its counterpart in the snapshot
+func (s Snapshot) Path(live string) string {
+	return _path.Join(s.Root(), live)
+}
+
+// Snapshots lists the NetApp and ZFS snapshots of the export, oldest first.
+// Snapshot directories are usually hidden from listings but not from LOOKUP,
+// they are looked for by name.  An export without any returns none.
+func (v *Target) Snapshots() ([]Snapshot, error) {
+	var snaps []Snapshot
+	for _, dir := range []string{NetAppSnapshotDir, ZFSSnapshotDir} {
+		entries, err := v.ReadDirPlus(dir)
+		if err != nil {
+			if os.IsNotExist(err) || IsNotDirError(err) {
+				continue
+			}
+			return nil, fmt.Errorf("snapshots: %s: %w", dir, err)
+		}
+
+		for _, e := range entries {
+			if e.FileName == "." || e.FileName == ".." || !e.IsDir() {
+				continue
+			}
+			snaps = append(snaps, Snapshot{Name: e.FileName, Dir: dir, Attr: e.Attr.attr()})
+		}
+	}
+
+	sort.SliceStable(snaps, func(i, j int) bool {
+		return snapTime(snaps[i]).Before(snapTime(snaps[j]))
+	})
+
+	return snaps, nil
+}
+
+// Snapshot returns the snapshot of the export called name
+func (v *Target) Snapshot(name string) (Snapshot, error) {
+	snaps, err := v.Snapshots()
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	for _, s := range snaps {
+		if s.Name == name {
+			return s, nil
+		}
+	}
+
+	return Snapshot{}, fmt.Errorf("snapshot %q: %w", name, os.ErrNotExist)
+}
+
+// DiffSnapshots compares path between snapshots a and b and returns how it
+// changed from a to b.  Paths in the changes are relative to path.
+func (v *Target) DiffSnapshots(path string, a, b Snapshot) ([]Change, error) {
+	return Diff(&TreeRef{v, a.Path(path)}, &TreeRef{v, b.Path(path)})
+}
+
+// snapTime is when a snapshot was taken, as far as its root's ctime tells
+func snapTime(s Snapshot) time.Time {
+	if s.Attr == nil {
+		return time.Time{}
+	}
+
+	return s.Attr.ChangeTime()
+}
@@ -0,0 +1,63 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"testing"
+)
+
+func writeFile(t *testing.T, v *Target, path, data string) {
+	f, err := v.OpenFile(path, 0644)
+	if err != nil {
+		t.Fatalf("create %s: %s", path, err)
+	}
+	if _, err = f.Write([]byte(data)); err != nil {
+		t.Fatalf("write %s: %s", path, err)
+	}
+	f.Close()
+}
+
+func TestSnapshots(t *testing.T) {
+	v := loopbackTarget(t)
+	defer v.Close()
+
+	// lay out what a filer would show
+	for _, dir := range []string{"/.snapshot", "/.snapshot/s1", "/.snapshot/s1/d", "/.snapshot/s2", "/.snapshot/s2/d"} {
+		if _, err := v.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("mkdir %s: %s", dir, err)
+		}
+	}
+	writeFile(t, v, "/.snapshot/s1/d/x", "old")
+	writeFile(t, v, "/.snapshot/s1/d/y", "gone")
+	writeFile(t, v, "/.snapshot/s2/d/x", "newer")
+	writeFile(t, v, "/.snapshot/s2/d/z", "added")
+
+	snaps, err := v.Snapshots()
+	if err != nil {
+		t.Fatalf("snapshots: %s", err)
+	}
+	if len(snaps) != 2 || snaps[0].Name != "s1" || snaps[1].Name != "s2" {
+		t.Fatalf("unexpected snapshots %+v", snaps)
+	}
+	if p := snaps[0].Path("/d/x"); p != "/.snapshot/s1/d/x" {
+		t.Fatalf("unexpected snapshot path %s", p)
+	}
+
+	changes, err := v.DiffSnapshots("/d", snaps[0], snaps[1])
+	if err != nil {
+		t.Fatalf("diff: %s", err)
+	}
+	want := []struct {
+		op   ChangeOp
+		path string
+	}{{ChangeModified, "x"}, {ChangeRemoved, "y"}, {ChangeAdded, "z"}}
+	if len(changes) != len(want) {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+	for i, c := range changes {
+		if c.Op != want[i].op || c.Path != want[i].path {
+			t.Fatalf("change %d: expected %v %s, got %v %s", i, want[i].op, want[i].path, c.Op, c.Path)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/util"
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+// the rquota protocol, which rquotad serves next to the NFS server
+const (
+	RquotaProg = 100011
+	RquotaVers = 1
+
+	RquotaProcGetQuota = 1
+)
+
+// getquota_rslt statuses
+const (
+	rquotaOK      = 1
+	rquotaNoQuota = 2
+	rquotaEPerm   = 3
+)
+
+// ErrNoQuota is returned by Quota when the user has no quota on the export
+var ErrNoQuota = errors.New("nfs: no quota")
+
+// Quota is the disk quota of a user on an export, as rquotad reports it.
+// Block counts are in units of BSize bytes.
+type Quota struct {
+	BSize      uint32
+	Active     bool
+	BHardLimit uint32
+	BSoftLimit uint32
+	CurBlocks  uint32
+	FHardLimit uint32
+	FSoftLimit uint32
+	CurFiles   uint32
+	BTimeLeft  uint32
+	FTimeLeft  uint32
+}
+
+// Headroom returns how many bytes the user may still write before reaching
+// the hard limit, or the soft one if there is no hard limit, and false if
+// neither limits the space
+func (q *Quota) Headroom() (uint64, bool) {
+	limit := q.BHardLimit
+	if limit == 0 {
+		limit = q.BSoftLimit
+	}
+	if !q.Active || limit == 0 {
+		return 0, false
+	}
+	if q.CurBlocks >= limit {
+		return 0, true
+	}
+
+	return uint64(limit-q.CurBlocks) * uint64(q.BSize), true
+}
+
+// InsufficientSpaceError is returned, before anything is written, for data
+// that would not fit in the space left on the filesystem or in the quota of
+// the user.  It wraps NFS3ERR_NOSPC or NFS3ERR_DQUOT, as the server would
+// have answered.
+type InsufficientSpaceError struct {
+	Path      string
+	Required  uint64
+	Available uint64
+
+	// Quota is whether the user's quota, rather than the free space of the
+	// filesystem, is what runs short
+	Quota bool
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	what := "space left"
+	if e.Quota {
+		what = "quota left"
+	}
+
+	return fmt.Sprintf("%s: %d bytes required, %d bytes of %s", e.Path, e.Required, e.Available, what)
+}
+
+func (e *InsufficientSpaceError) Unwrap() error {
+	if e.Quota {
+		return NFS3Error(NFS3ErrDQuot)
+	}
+
+	return NFS3Error(NFS3ErrNoSpc)
+}
+
+// FSStat returns the space and files used and free on the filesystem of path
+func (v *Target) FSStat(path string) (*FSStat, error) {
+	_, fh, err := v.Lookup(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.FSStatByFh(fh)
+}
+
+// FSStatByFh returns the space and files used and free on the filesystem of fh
+func (v *Target) FSStatByFh(fh []byte) (*FSStat, error) {
+	type FSStatArgs struct {
+		rpc.Header
+		FH []byte
+	}
+
+	res, err := v.call(&FSStatArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    Nfs3Prog,
+			Vers:    Nfs3Vers,
+			Proc:    NFSProc3FSStat,
+			Cred:    v.auth,
+			Verf:    rpc.AuthNull,
+		},
+		FH: fh,
+	})
+	if err != nil {
+		util.Debugf("fsstat(%x): %s", fh, err)
+		return nil, err
+	}
+
+	fsstat := new(FSStat)
+	if err = xdr.Read(res, fsstat); err != nil {
+		return nil, err
+	}
+
+	return fsstat, nil
+}
+
+// Quota asks rquotad of the server for the quota on the export of the user
+// the target is mounted as, with AUTH_UNIX.  The program is tried on the NFS
+// connection first, which servers of this package answer, then where the
+// portmapper says.  ErrNoQuota is returned if the user has none.
+func (v *Target) Quota() (*Quota, error) {
+	au, err := rpc.ParseAuthUnix(v.auth)
+	if err != nil {
+		return nil, fmt.Errorf("quota: needs an AUTH_UNIX credential: %w", err)
+	}
+
+	q, err := v.getQuota(v.Client, au.Uid)
+	var acceptErr *rpc.AcceptError
+	if !errors.As(err, &acceptErr) || acceptErr.Status != rpc.ProgUnavail {
+		return q, err
+	}
+
+	raddr, ok := v.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, err
+	}
+	m := rpc.Mapping{Prog: RquotaProg, Vers: RquotaVers, Prot: rpc.IPProtoTCP}
+	client, err := DialService(raddr.IP.String(), m, false)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	return v.getQuota(client, au.Uid)
+}
+
+func (v *Target) getQuota(client *rpc.Client, uid uint32) (*Quota, error) {
+	type GetQuotaArgs struct {
+		rpc.Header
+		Path string
+		UID  uint32
+	}
+
+	res, err := client.Call(&GetQuotaArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    RquotaProg,
+			Vers:    RquotaVers,
+			Proc:    RquotaProcGetQuota,
+			Cred:    v.auth,
+			Verf:    rpc.AuthNull,
+		},
+		Path: v.dirPath,
+		UID:  uid,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := xdr.ReadUint32(res)
+	if err != nil {
+		return nil, err
+	}
+
+	switch status {
+	case rquotaOK:
+		q := new(Quota)
+		if err = xdr.Read(res, q); err != nil {
+			return nil, err
+		}
+		return q, nil
+	case rquotaNoQuota:
+		return nil, ErrNoQuota
+	case rquotaEPerm:
+		return nil, fmt.Errorf("quota of uid %d: %w", uid, NFS3Error(NFS3ErrPerm))
+	default:
+		return nil, fmt.Errorf("quota of uid %d: unknown status %d", uid, status)
+	}
+}
+
+// CheckSpace fails with an *InsufficientSpaceError unless required bytes fit
+// in the space available on the filesystem of path, and in the quota of the
+// user if rquotad reports one.  It is meant to fail a large copy fast, before
+// it fills the filesystem halfway; the space may still run out if others
+// write meanwhile.
+func (v *Target) CheckSpace(path string, required uint64) error {
+	fsstat, err := v.FSStat(path)
+	if err != nil {
+		return err
+	}
+	if required > fsstat.ABytes {
+		return &InsufficientSpaceError{Path: path, Required: required, Available: fsstat.ABytes}
+	}
+
+	q, err := v.Quota()
+	if err != nil {
+		// quotas are optional, most servers run no rquotad
+		util.Debugf("checkspace(%s): quota: %s", path, err)
+		return nil
+	}
+	if left, ok := q.Headroom(); ok && required > left {
+		return &InsufficientSpaceError{Path: path, Required: required, Available: left, Quota: true}
+	}
+
+	return nil
+}
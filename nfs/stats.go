@@ -0,0 +1,156 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"sync"
+	"time"
+)
+
+// ProcStats holds the counters of a single NFS procedure
+type ProcStats struct {
+	Calls  uint64
+	Errors uint64
+
+	// Latency is the accumulated round trip time of all calls
+	Latency time.Duration
+}
+
+// AvgLatency returns the mean round trip time of the procedure
+func (p ProcStats) AvgLatency() time.Duration {
+	if p.Calls == 0 {
+		return 0
+	}
+
+	return p.Latency / time.Duration(p.Calls)
+}
+
+// Stats is a point in time snapshot of a Target's client side counters,
+// roughly what nfsstat -c reports for a kernel mount.
+type Stats struct {
+	// Since is when the counters were last reset (or the Target created)
+	Since time.Time
+
+	// Procs is keyed by procedure number, see ProcName
+	Procs map[uint32]ProcStats
+
+	// StatusErrors counts failed replies by nfsstat3 value
+	StatusErrors map[uint32]uint64
+
+	// RPCErrors counts calls that failed below the NFS layer (transport
+	// errors, rpc rejections)
+	RPCErrors uint64
+
+	Retransmits  uint64
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+// Calls returns the total number of calls across all procedures
+func (s *Stats) Calls() uint64 {
+	var n uint64
+	for _, p := range s.Procs {
+		n += p.Calls
+	}
+
+	return n
+}
+
+// AvgLatency returns the mean round trip time across all procedures
+func (s *Stats) AvgLatency() time.Duration {
+	var total ProcStats
+	for _, p := range s.Procs {
+		total.Calls += p.Calls
+		total.Latency += p.Latency
+	}
+
+	return total.AvgLatency()
+}
+
+type statsCollector struct {
+	sync.Mutex
+	retransmits func() uint64
+
+	s Stats
+	// client retransmits at the last reset
+	retransBase uint64
+}
+
+func newStatsCollector(retransmits func() uint64) *statsCollector {
+	c := &statsCollector{retransmits: retransmits}
+	c.reset()
+	return c
+}
+
+func (c *statsCollector) reset() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.s = Stats{
+		Since:        time.Now(),
+		Procs:        make(map[uint32]ProcStats),
+		StatusErrors: make(map[uint32]uint64),
+	}
+	c.retransBase = c.retransmits()
+}
+
+// record accounts for a single call.  rpcErr is set when the call failed
+// before an nfsstat3 could be decoded, otherwise status is the reply status.
+func (c *statsCollector) record(proc uint32, latency time.Duration, status uint32, rpcErr error) {
+	c.Lock()
+	defer c.Unlock()
+
+	p := c.s.Procs[proc]
+	p.Calls++
+	p.Latency += latency
+	if rpcErr != nil {
+		p.Errors++
+		c.s.RPCErrors++
+	} else if status != NFS3Ok {
+		p.Errors++
+		c.s.StatusErrors[status]++
+	}
+	c.s.Procs[proc] = p
+}
+
+func (c *statsCollector) addRead(n int) {
+	c.Lock()
+	c.s.BytesRead += uint64(n)
+	c.Unlock()
+}
+
+func (c *statsCollector) addWritten(n int) {
+	c.Lock()
+	c.s.BytesWritten += uint64(n)
+	c.Unlock()
+}
+
+func (c *statsCollector) snapshot() *Stats {
+	c.Lock()
+	defer c.Unlock()
+
+	s := c.s
+	s.Procs = make(map[uint32]ProcStats, len(c.s.Procs))
+	for k, v := range c.s.Procs {
+		s.Procs[k] = v
+	}
+	s.StatusErrors = make(map[uint32]uint64, len(c.s.StatusErrors))
+	for k, v := range c.s.StatusErrors {
+		s.StatusErrors[k] = v
+	}
+	s.Retransmits = c.retransmits() - c.retransBase
+
+	return &s
+}
+
+// Stats returns a snapshot of the counters accumulated since the Target was
+// created or since the last ResetStats.
+func (v *Target) Stats() *Stats {
+	return v.stats.snapshot()
+}
+
+// ResetStats zeroes all counters
+func (v *Target) ResetStats() {
+	v.stats.reset()
+}
@@ -0,0 +1,47 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStatsCollector(t *testing.T) {
+	c := newStatsCollector(func() uint64 { return 0 })
+
+	c.record(NFSProc3Lookup, 2*time.Millisecond, NFS3Ok, nil)
+	c.record(NFSProc3Lookup, 4*time.Millisecond, NFS3ErrNoEnt, nil)
+	c.record(NFSProc3Read, 6*time.Millisecond, 0, errors.New("broken pipe"))
+	c.addRead(10)
+	c.addWritten(20)
+
+	s := c.snapshot()
+	if s.Calls() != 3 {
+		t.Fatalf("expected 3 calls, got %d", s.Calls())
+	}
+
+	lookup := s.Procs[NFSProc3Lookup]
+	if lookup.Calls != 2 || lookup.Errors != 1 || lookup.AvgLatency() != 3*time.Millisecond {
+		t.Fatalf("unexpected lookup stats: %+v", lookup)
+	}
+
+	if s.StatusErrors[NFS3ErrNoEnt] != 1 || s.RPCErrors != 1 {
+		t.Fatalf("unexpected error counts: %+v %d", s.StatusErrors, s.RPCErrors)
+	}
+
+	if s.BytesRead != 10 || s.BytesWritten != 20 {
+		t.Fatalf("unexpected byte counts: %d %d", s.BytesRead, s.BytesWritten)
+	}
+
+	if s.AvgLatency() != 4*time.Millisecond {
+		t.Fatalf("unexpected avg latency: %s", s.AvgLatency())
+	}
+
+	c.reset()
+	if s = c.snapshot(); s.Calls() != 0 || s.BytesRead != 0 {
+		t.Fatalf("expected zeroed stats after reset: %+v", s)
+	}
+}
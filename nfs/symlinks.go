@@ -0,0 +1,52 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	_path "path"
+	"strings"
+)
+
+// SymlinkPolicy is what UploadTree and SyncTree do with symbolic links
+type SymlinkPolicy int
+
+const (
+	// SymlinkSkip leaves links out, listing them as skipped
+	SymlinkSkip SymlinkPolicy = iota
+
+	// SymlinkPreserve makes links pointing where the source ones do
+	SymlinkPreserve
+
+	// SymlinkFollow copies what links point to in their stead.  Links
+	// dangling, or to a directory they are within, are skipped.
+	SymlinkFollow
+
+	// SymlinkRewrite is SymlinkPreserve, with absolute targets within the
+	// source tree rewritten to point to the same place in the destination
+	// tree, so that they stay valid there
+	SymlinkRewrite
+)
+
+// maxFollow is how many links in a row SymlinkFollow goes through
+const maxFollow = 8
+
+// rewriteLink returns target, if it is an absolute path below from, as the
+// same path below to
+func rewriteLink(target, from, to string) string {
+	if !_path.IsAbs(target) || !_path.IsAbs(from) {
+		return target
+	}
+
+	clean, from := _path.Clean(target), _path.Clean(from)
+	switch {
+	case clean == from:
+		return to
+	case from == "/":
+		return _path.Join(to, clean)
+	case strings.HasPrefix(clean, from+"/"):
+		return _path.Join(to, clean[len(from):])
+	default:
+		return target
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRewriteLink(t *testing.T) {
+	for _, c := range []struct{ target, from, to, want string }{
+		{"/src/a/b", "/src", "/dst", "/dst/a/b"},
+		{"/src", "/src", "/dst", "/dst"},
+		{"/srcx/a", "/src", "/dst", "/srcx/a"},
+		{"a/b", "/src", "/dst", "a/b"},
+		{"/a", "/", "/dst", "/dst/a"},
+	} {
+		if got := rewriteLink(c.target, c.from, c.to); got != c.want {
+			t.Errorf("rewriteLink(%q, %q, %q) = %q, want %q", c.target, c.from, c.to, got, c.want)
+		}
+	}
+}
+
+func TestUploadSymlinks(t *testing.T) {
+	local, outside := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(local, "f"), []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "o"), []byte("out"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range map[string]string{
+		"abs":      filepath.Join(local, "f"),
+		"rel":      "f",
+		"out":      filepath.Join(outside, "o"),
+		"loop":     ".",
+		"dangling": "nope",
+	} {
+		if err := os.Symlink(target, filepath.Join(local, name)); err != nil {
+			t.Skipf("symlink: %s", err)
+		}
+	}
+
+	v := loopbackTarget(t)
+	defer v.Close()
+	for _, dir := range []string{"/preserve", "/rewrite", "/follow"} {
+		if _, err := v.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := UploadTree(local, &TreeRef{v, "/preserve"}, UploadOptions{Symlinks: SymlinkPreserve})
+	if err != nil {
+		t.Fatalf("preserve: %s", err)
+	}
+	if res.Files != 1 || res.Links != 5 {
+		t.Errorf("preserve: %+v", res)
+	}
+	if got, _ := v.Readlink("/preserve/abs"); got != filepath.ToSlash(filepath.Join(local, "f")) {
+		t.Errorf("preserved link to %q", got)
+	}
+
+	if _, err = UploadTree(local, &TreeRef{v, "/rewrite"}, UploadOptions{Symlinks: SymlinkRewrite}); err != nil {
+		t.Fatalf("rewrite: %s", err)
+	}
+	for link, want := range map[string]string{"abs": "/rewrite/f", "rel": "f", "out": filepath.ToSlash(filepath.Join(outside, "o"))} {
+		if got, _ := v.Readlink("/rewrite/" + link); got != want {
+			t.Errorf("rewritten %s to %q, want %q", link, got, want)
+		}
+	}
+
+	res, err = UploadTree(local, &TreeRef{v, "/follow"}, UploadOptions{Symlinks: SymlinkFollow})
+	if err != nil {
+		t.Fatalf("follow: %s", err)
+	}
+	if res.Files != 4 || res.Links != 0 || !reflect.DeepEqual(res.Skipped, []string{"dangling", "loop"}) {
+		t.Errorf("follow: %+v", res)
+	}
+	if got := readAll(t, v, "/follow/out"); got != "out" {
+		t.Errorf("followed to %q", got)
+	}
+}
+
+func TestSyncSymlinks(t *testing.T) {
+	src := loopbackTarget(t)
+	defer src.Close()
+	dst := loopbackTarget(t)
+	defer dst.Close()
+
+	for _, dir := range []string{"/t", "/t/sub"} {
+		if _, err := src.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, src, "/t/sub/f", "file")
+	for link, target := range map[string]string{"/t/abs": "/t/sub/f", "/t/d": "sub", "/t/sub/up": ".."} {
+		if _, err := src.Symlink(target, link); err != nil {
+			t.Fatalf("symlink: %s", err)
+		}
+	}
+	for _, dir := range []string{"/m", "/f"} {
+		if _, err := dst.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := SyncOptions{Symlinks: SymlinkRewrite}
+	res, err := SyncTreeWithOptions(&TreeRef{src, "/t"}, &TreeRef{dst, "/m"}, nil, opts)
+	if err != nil {
+		t.Fatalf("rewrite: %s", err)
+	}
+	if res.Links != 3 {
+		t.Errorf("rewrite: %+v", res)
+	}
+	if got, _ := dst.Readlink("/m/abs"); got != "/m/sub/f" {
+		t.Errorf("rewritten to %q", got)
+	}
+	res, err = SyncTreeWithOptions(&TreeRef{src, "/t"}, &TreeRef{dst, "/m"}, res.State, opts)
+	if err != nil {
+		t.Fatalf("second rewrite: %s", err)
+	}
+	if res.Links != 0 || res.Unchanged != 4 {
+		t.Errorf("second rewrite: %+v", res)
+	}
+
+	res, err = SyncTreeWithOptions(&TreeRef{src, "/t"}, &TreeRef{dst, "/f"}, nil, SyncOptions{Symlinks: SymlinkFollow})
+	if err != nil {
+		t.Fatalf("follow: %s", err)
+	}
+	if res.Files != 3 || res.Links != 0 || !reflect.DeepEqual(res.Skipped, []string{"d/up", "sub/up"}) {
+		t.Errorf("follow: %+v", res)
+	}
+	if got := readAll(t, dst, "/f/d/f"); got != "file" {
+		t.Errorf("followed to %q", got)
+	}
+}
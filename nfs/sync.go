@@ -0,0 +1,582 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	_path "path"
+	"sort"
+	"strings"
+
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// FileKey identifies a file of a server across runs, by filesystem and
+// fileid, whatever its path
+type FileKey struct {
+	FSID   uint64 `json:"fsid"`
+	FileID uint64 `json:"fileid"`
+}
+
+// SyncState is what SyncTree remembers of a source tree between runs: the
+// path of each of its entries, by FileKey, so that an entry moved since is
+// told from one removed and another added
+type SyncState struct {
+	Paths map[FileKey]string
+}
+
+// NewSyncState returns the state of a tree never synced
+func NewSyncState() *SyncState {
+	return &SyncState{Paths: make(map[FileKey]string)}
+}
+
+type syncStateEntry struct {
+	FileKey
+	Path string `json:"path"`
+}
+
+// LoadSyncState reads a state written by Save
+func LoadSyncState(r io.Reader) (*SyncState, error) {
+	var entries []syncStateEntry
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	st := NewSyncState()
+	for _, e := range entries {
+		st.Paths[e.FileKey] = e.Path
+	}
+
+	return st, nil
+}
+
+// Save writes st to w as JSON, entries sorted by path
+func (st *SyncState) Save(w io.Writer) error {
+	entries := make([]syncStateEntry, 0, len(st.Paths))
+	for key, path := range st.Paths {
+		entries = append(entries, syncStateEntry{key, path})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
+
+// SyncRename is an entry moved on the destination rather than copied again
+type SyncRename struct {
+	From, To string
+}
+
+// SyncOptions tune SyncTree
+type SyncOptions struct {
+	// Symlinks is what to do with symbolic links, skip them by default
+	Symlinks SymlinkPolicy
+
+	// LinkFrom and LinkTo are, for SymlinkRewrite, the absolute paths the
+	// source and destination trees are seen at by the links: targets below
+	// LinkFrom are rewritten below LinkTo.  They default to the paths of
+	// the trees on their targets, as if the exports were mounted at the
+	// root.  SymlinkFollow resolves absolute targets through LinkFrom too.
+	LinkFrom, LinkTo string
+
+	// ACLs replicates the POSIX ACLs of files and directories when both
+	// servers serve the NFSACL sideband, see GetACL
+	ACLs bool
+}
+
+// ACLError is an ACL that could not be replicated, the destination server
+// refusing it or not having all its users and groups
+type ACLError struct {
+	Path string
+	ACL  *POSIXACL
+	Err  error
+}
+
+func (e *ACLError) Error() string {
+	return fmt.Sprintf("acl of %s: %s", e.Path, e.Err)
+}
+
+func (e *ACLError) Unwrap() error {
+	return e.Err
+}
+
+// SyncResult is the outcome of SyncTree.  Paths are relative to the roots of
+// the trees.
+type SyncResult struct {
+	// Files and Dirs count what was copied or made, Bytes the data copied,
+	// Unchanged the files left alone as their size and mtime match
+	Files     int
+	Dirs      int
+	Bytes     uint64
+	Unchanged int
+
+	// Links counts the symbolic links made, see SyncOptions.Symlinks
+	Links int
+
+	// ACLs counts the ACLs set, ACLErrors are those that could not be.
+	// ACLsSkipped is whether ACLs were asked for but one of the servers
+	// has no NFSACL sideband.
+	ACLs        int
+	ACLErrors   []*ACLError
+	ACLsSkipped bool
+
+	// Renamed are the entries the source moved since the previous run,
+	// moved likewise on the destination
+	Renamed []SyncRename
+
+	// Removed are the entries of the destination missing from the source,
+	// removed with everything below them
+	Removed []string
+
+	// Skipped are the entries neither files, directories nor links made
+	// or followed, which are not synced
+	Skipped []string
+
+	// State is the state of the source as of this run, to be saved and
+	// handed to the next
+	State *SyncState
+}
+
+// SyncTree makes tree dst, which must exist, a copy of tree src, on the same
+// or another target.  Files are copied when missing from dst or when their
+// size or mtime differ, and entries dst has but src has not are removed.
+// Given the state of the previous run, entries whose (fsid, fileid) are now
+// at another path of src are renamed on dst, data and attributes alike,
+// instead of removed and copied again; prev may be nil for a first run.  An
+// entry whose source path got reused, or with several hard links, is copied
+// as if new.  Symbolic links are skipped.
+func SyncTree(src, dst *TreeRef, prev *SyncState) (*SyncResult, error) {
+	return SyncTreeWithOptions(src, dst, prev, SyncOptions{})
+}
+
+// SyncTreeWithOptions is SyncTree, tuned by opts
+func SyncTreeWithOptions(src, dst *TreeRef, prev *SyncState, opts SyncOptions) (*SyncResult, error) {
+	root, sfh, err := src.Target.GetAttr(src.Path)
+	if err != nil {
+		return nil, err
+	}
+	_, dfh, err := dst.Target.Lookup(dst.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if prev == nil {
+		prev = NewSyncState()
+	}
+	if opts.LinkFrom == "" {
+		opts.LinkFrom = src.Path
+	}
+	if opts.LinkTo == "" {
+		opts.LinkTo = dst.Path
+	}
+	s := &syncer{
+		src:     src,
+		dst:     dst,
+		prev:    prev,
+		opts:    opts,
+		byPath:  make(map[string]*syncEntry),
+		links:   make(map[FileKey]int),
+		walking: make(map[FileKey]bool),
+		res:     &SyncResult{State: NewSyncState()},
+	}
+
+	if err = s.list(sfh, FileKey{FSID: root.FSID, FileID: root.Fileid}, ""); err != nil {
+		return nil, err
+	}
+	if opts.ACLs {
+		s.acls = s.aclsSupported(sfh, dfh)
+		s.res.ACLsSkipped = !s.acls
+	}
+	for _, e := range s.entries {
+		if err = s.sync(e); err != nil {
+			return nil, fmt.Errorf("sync %s: %w", e.path, err)
+		}
+		if s.acls && (e.attr.Type == NF3Dir || e.attr.Type == NF3Reg) {
+			if err = s.syncACL(e); err != nil {
+				return nil, fmt.Errorf("sync %s: %w", e.path, err)
+			}
+		}
+	}
+	if err = s.prune(dfh, ""); err != nil {
+		return nil, err
+	}
+
+	return s.res, nil
+}
+
+type syncer struct {
+	src, dst *TreeRef
+	prev     *SyncState
+	opts     SyncOptions
+	res      *SyncResult
+
+	// whether both servers have ACLs to replicate
+	acls bool
+
+	// the entries of src in pre-order, by path, and how many paths each
+	// file has
+	entries []*syncEntry
+	byPath  map[string]*syncEntry
+	links   map[FileKey]int
+
+	// the directories of src being listed, to not follow links into loops
+	walking map[FileKey]bool
+
+	// renames done on dst, in order, as from and to paths
+	renames [][2]string
+}
+
+type syncEntry struct {
+	path string
+	fh   []byte
+	attr *Fattr
+	key  FileKey
+}
+
+// list collects the entries of directory fh of src, key, at path, and below
+func (s *syncer) list(fh []byte, key FileKey, path string) error {
+	s.walking[key] = true
+	defer delete(s.walking, key)
+
+	entries, err := listDiffEntries(s.src.Target, fh)
+	if err != nil {
+		return fmt.Errorf("sync: readdir %s: %w", path, err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		de := entries[name]
+		e := &syncEntry{
+			path: _path.Join(path, name),
+			fh:   de.fh,
+			attr: de.attr,
+			key:  FileKey{FSID: de.attr.FSID, FileID: de.attr.Fileid},
+		}
+		if e.attr.Type == NF3Lnk && s.opts.Symlinks == SymlinkFollow {
+			s.follow(e)
+		}
+		s.entries = append(s.entries, e)
+		s.byPath[e.path] = e
+		s.links[e.key]++
+
+		if e.attr.Type == NF3Dir {
+			if err = s.list(e.fh, e.key, e.path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// follow turns link e into what it points to, unless it dangles or points to
+// a directory being listed
+func (s *syncer) follow(e *syncEntry) {
+	fh, attr, dir := e.fh, e.attr, _path.Join(s.src.Path, _path.Dir(e.path))
+	for i := 0; attr.Type == NF3Lnk; i++ {
+		_, target, err := s.src.Target.readlinkFh(fh)
+		if err != nil || i == maxFollow {
+			util.Debugf("sync %s: not following: %v", e.path, err)
+			return
+		}
+
+		path := rewriteLink(target, s.opts.LinkFrom, s.src.Path)
+		if !_path.IsAbs(path) {
+			path = _path.Join(dir, path)
+		}
+		lattr, lfh, err := s.src.Target.lstat(path)
+		if err != nil {
+			util.Debugf("sync %s: not following: %s", e.path, err)
+			return
+		}
+		fh, attr, dir = lfh, lattr, _path.Dir(path)
+	}
+
+	key := FileKey{FSID: attr.FSID, FileID: attr.Fileid}
+	if attr.Type == NF3Dir && s.walking[key] {
+		util.Debugf("sync %s: not following a loop", e.path)
+		return
+	}
+	e.fh, e.attr, e.key = fh, attr, key
+}
+
+// synced reports whether entry e of src is brought over to dst
+func (s *syncer) synced(e *syncEntry) bool {
+	switch e.attr.Type {
+	case NF3Dir, NF3Reg:
+		return true
+	case NF3Lnk:
+		return s.opts.Symlinks == SymlinkPreserve || s.opts.Symlinks == SymlinkRewrite
+	default:
+		return false
+	}
+}
+
+func (s *syncer) dstPath(path string) string {
+	return _path.Join(s.dst.Path, path)
+}
+
+// sync brings entry e over to dst, its parent being there already
+func (s *syncer) sync(e *syncEntry) error {
+	if !s.synced(e) {
+		s.res.Skipped = append(s.res.Skipped, e.path)
+		return nil
+	}
+	s.res.State.Paths[e.key] = e.path
+
+	if err := s.moved(e); err != nil {
+		return err
+	}
+
+	if e.attr.Type == NF3Lnk {
+		return s.syncLink(e)
+	}
+
+	full := s.dstPath(e.path)
+	attr, _, err := s.dst.Target.lstat(full)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	case attr.Type != e.attr.Type:
+		if err = s.removeDst(full, attr); err != nil {
+			return err
+		}
+	case e.attr.Type == NF3Dir:
+		return nil
+	case attr.Filesize == e.attr.Filesize && attr.Mtime == e.attr.Mtime:
+		s.res.Unchanged++
+		return nil
+	}
+
+	if e.attr.Type == NF3Dir {
+		_, err = s.dst.Target.Mkdir(full, e.attr.Mode().Perm())
+		if err == nil {
+			s.res.Dirs++
+		}
+		return err
+	}
+
+	return s.copyFile(e, full)
+}
+
+// syncLink makes a link on dst like link e, unless there is one already
+func (s *syncer) syncLink(e *syncEntry) error {
+	_, target, err := s.src.Target.readlinkFh(e.fh)
+	if err != nil {
+		return err
+	}
+	if s.opts.Symlinks == SymlinkRewrite {
+		target = rewriteLink(target, s.opts.LinkFrom, s.opts.LinkTo)
+	}
+
+	full := s.dstPath(e.path)
+	attr, fh, err := s.dst.Target.lstat(full)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	case attr.Type == NF3Lnk:
+		if _, have, err := s.dst.Target.readlinkFh(fh); err == nil && have == target {
+			s.res.Unchanged++
+			return nil
+		}
+		fallthrough
+	default:
+		if err = s.removeDst(full, attr); err != nil {
+			return err
+		}
+	}
+
+	if _, err = s.dst.Target.Symlink(target, full); err != nil {
+		return err
+	}
+	s.res.Links++
+
+	return nil
+}
+
+// aclsSupported reports whether the servers of the trees, rooted at sfh and
+// dfh, both serve the NFSACL sideband
+func (s *syncer) aclsSupported(sfh, dfh []byte) bool {
+	for _, side := range []struct {
+		v  *Target
+		fh []byte
+	}{{s.src.Target, sfh}, {s.dst.Target, dfh}} {
+		if _, err := side.v.GetACLByFh(side.fh); IsACLUnsupportedError(err) {
+			util.Debugf("sync: not replicating ACLs: %s", err)
+			return false
+		}
+	}
+
+	return true
+}
+
+// syncACL sets the ACL of e on its copy, unless it has it already.  ACLs that
+// can't be read or set are reported rather than failing the sync.
+func (s *syncer) syncACL(e *syncEntry) error {
+	acl, err := s.src.Target.GetACLByFh(e.fh)
+	if err != nil {
+		s.res.ACLErrors = append(s.res.ACLErrors, &ACLError{Path: e.path, Err: err})
+		return nil
+	}
+
+	_, fh, err := s.dst.Target.lstat(s.dstPath(e.path))
+	if err != nil {
+		return err
+	}
+	if have, err := s.dst.Target.GetACLByFh(fh); err == nil && have.Equal(acl) {
+		return nil
+	}
+
+	if err = s.dst.Target.SetACLByFh(fh, acl); err != nil {
+		util.Errorf("sync %s: setting the acl: %s", e.path, err)
+		s.res.ACLErrors = append(s.res.ACLErrors, &ACLError{Path: e.path, ACL: acl, Err: err})
+		return nil
+	}
+	s.res.ACLs++
+
+	return nil
+}
+
+// removeDst removes entry full of dst, with attributes attr
+func (s *syncer) removeDst(full string, attr *Fattr) error {
+	if attr.Type == NF3Dir {
+		return s.dst.Target.RemoveAll(full)
+	}
+
+	return s.dst.Target.Remove(full)
+}
+
+// moved renames on dst the entry that was at another path of src in the
+// previous run to where e is now, unless something else took either place
+func (s *syncer) moved(e *syncEntry) error {
+	old, ok := s.prev.Paths[e.key]
+	if !ok || s.links[e.key] > 1 {
+		return nil
+	}
+	if _, reused := s.byPath[old]; reused {
+		return nil
+	}
+
+	// where the entry is on dst now, its parents may have moved already
+	from := s.current(old)
+	if from == e.path {
+		return nil
+	}
+
+	attr, _, err := s.dst.Target.lstat(s.dstPath(from))
+	if err != nil || attr.Type != e.attr.Type {
+		return nil
+	}
+	if _, _, err = s.dst.Target.lstat(s.dstPath(e.path)); err == nil {
+		return nil
+	}
+
+	if err = s.dst.Target.Rename(s.dstPath(from), s.dstPath(e.path)); err != nil {
+		return err
+	}
+	s.renames = append(s.renames, [2]string{from, e.path})
+	s.res.Renamed = append(s.res.Renamed, SyncRename{From: old, To: e.path})
+
+	return nil
+}
+
+// current returns where path of dst is after the renames done so far
+func (s *syncer) current(path string) string {
+	for _, r := range s.renames {
+		if path == r[0] {
+			path = r[1]
+		} else if strings.HasPrefix(path, r[0]+"/") {
+			path = r[1] + path[len(r[0]):]
+		}
+	}
+
+	return path
+}
+
+// copyFile copies the data, permissions and mtime of file e to full on dst
+func (s *syncer) copyFile(e *syncEntry, full string) error {
+	fh, err := s.dst.Target.CreateTruncate(full, e.attr.Mode().Perm(), 0)
+	if err != nil {
+		return err
+	}
+
+	sf, err := s.src.Target.OpenByFh(e.fh, e.attr)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+
+	df, err := s.dst.Target.OpenByFh(fh, nil)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(df, sf)
+	if cerr := df.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	s.res.Files++
+	s.res.Bytes += uint64(n)
+
+	return s.dst.Target.SetAttrByFh(fh, Sattr3{
+		Mode:  SetMode{SetIt: true, Mode: uint32(e.attr.Mode().Perm())},
+		Mtime: SetTime{SetIt: SetToClientTime, Time: e.attr.Mtime},
+	})
+}
+
+// prune removes the entries of directory fh of dst, at path, and below, that
+// src has not
+func (s *syncer) prune(fh []byte, path string) error {
+	entries, err := listDiffEntries(s.dst.Target, fh)
+	if err != nil {
+		return fmt.Errorf("sync: readdir %s: %w", path, err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		de := entries[name]
+		epath := _path.Join(path, name)
+
+		if e, ok := s.byPath[epath]; ok && s.synced(e) {
+			if de.attr.Type == NF3Dir && e.attr.Type == NF3Dir {
+				if err = s.prune(de.fh, epath); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if de.attr.Type == NF3Dir {
+			err = s.dst.Target.RemoveAll(s.dstPath(epath))
+		} else {
+			err = s.dst.Target.remove(fh, name)
+		}
+		if err != nil {
+			return fmt.Errorf("sync: remove %s: %w", epath, err)
+		}
+		s.res.Removed = append(s.res.Removed, epath)
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestSyncTreeRenames(t *testing.T) {
+	src := loopbackTarget(t)
+	defer src.Close()
+	dst := loopbackTarget(t)
+	defer dst.Close()
+
+	for _, dir := range []string{"/a", "/a/sub"} {
+		if _, err := src.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, src, "/a/x", "xxxx")
+	writeFile(t, src, "/a/sub/y", "yyyy")
+	writeFile(t, src, "/b", "bbbb")
+
+	res, err := SyncTree(&TreeRef{src, "/"}, &TreeRef{dst, "/"}, nil)
+	if err != nil {
+		t.Fatalf("first sync: %s", err)
+	}
+	if res.Files != 3 || res.Dirs != 2 || len(res.Renamed) != 0 {
+		t.Errorf("first sync: %+v", res)
+	}
+	battr, _, err := dst.GetAttr("/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the state goes through a file between runs
+	buf := new(bytes.Buffer)
+	if err = res.State.Save(buf); err != nil {
+		t.Fatal(err)
+	}
+	state, err := LoadSyncState(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range [][2]string{{"/a", "/c"}, {"/b", "/c/sub/b2"}} {
+		if err = src.Rename(r[0], r[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = src.Remove("/c/x"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, src, "/d", "dd")
+
+	res, err = SyncTree(&TreeRef{src, "/"}, &TreeRef{dst, "/"}, state)
+	if err != nil {
+		t.Fatalf("second sync: %s", err)
+	}
+	renamed := []SyncRename{{"a", "c"}, {"b", "c/sub/b2"}}
+	if !reflect.DeepEqual(res.Renamed, renamed) {
+		t.Errorf("renamed %v, want %v", res.Renamed, renamed)
+	}
+	if res.Files != 1 || res.Bytes != 2 || res.Unchanged != 2 || !reflect.DeepEqual(res.Removed, []string{"c/x"}) {
+		t.Errorf("second sync: %+v", res)
+	}
+
+	changes, err := Diff(&TreeRef{src, "/"}, &TreeRef{dst, "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("trees differ after sync: %+v", changes)
+	}
+
+	// moved, not copied
+	moved, _, err := dst.GetAttr("/c/sub/b2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Fileid != battr.Fileid {
+		t.Errorf("/b copied to /c/sub/b2 rather than renamed")
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+//go:build !windows && !plan9
+
+package nfs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// localPermissions is whether local files carry unix permission bits worth
+// comparing to the server's
+const localPermissions = true
+
+// isAddrInUse reports whether binding a local port failed because another
+// socket holds it
+func isAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
+
+// isConnLost reports whether err is the connection being reset or closed by
+// the server
+func isConnLost(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// localOwner returns the owner and group of a local file
+func localOwner(fi os.FileInfo) (uint32, uint32, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+
+	return uint32(st.Uid), uint32(st.Gid), true
+}
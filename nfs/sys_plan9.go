@@ -0,0 +1,34 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+//go:build plan9
+
+package nfs
+
+import (
+	"os"
+	"strings"
+)
+
+// localPermissions is whether local files carry unix permission bits worth
+// comparing to the server's
+const localPermissions = true
+
+// Plan 9 errors are strings, matched by what the network stack says
+
+// isAddrInUse reports whether binding a local port failed because another
+// socket holds it
+func isAddrInUse(err error) bool {
+	return strings.Contains(err.Error(), "address in use")
+}
+
+// isConnLost reports whether err is the connection being reset or hung up
+func isConnLost(err error) bool {
+	return strings.Contains(err.Error(), "connection reset") || strings.Contains(err.Error(), "hungup")
+}
+
+// localOwner returns the owner and group of a local file, which Plan 9 names
+// rather than numbers
+func localOwner(fi os.FileInfo) (uint32, uint32, bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,41 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+//go:build windows
+
+package nfs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Winsock errors, which package syscall does not name
+const (
+	wsaeacces       = syscall.Errno(10013)
+	wsaeaddrinuse   = syscall.Errno(10048)
+	wsaeconnaborted = syscall.Errno(10053)
+	wsaeconnreset   = syscall.Errno(10054)
+)
+
+// localPermissions is whether local files carry unix permission bits worth
+// comparing to the server's.  Windows only reports read-only or not.
+const localPermissions = false
+
+// isAddrInUse reports whether binding a local port failed because another
+// socket holds it, or because the port is in a range Windows reserves
+func isAddrInUse(err error) bool {
+	return errors.Is(err, wsaeaddrinuse) || errors.Is(err, wsaeacces)
+}
+
+// isConnLost reports whether err is the connection being reset or aborted
+func isConnLost(err error) bool {
+	return errors.Is(err, wsaeconnreset) || errors.Is(err, wsaeconnaborted)
+}
+
+// localOwner returns the owner and group of a local file, which Windows files
+// do not have in unix terms
+func localOwner(fi os.FileInfo) (uint32, uint32, bool) {
+	return 0, 0, false
+}
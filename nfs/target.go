@@ -4,11 +4,17 @@
 package nfs
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	_path "path"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-nfs/nfsv3/nfs/rpc"
 	"github.com/go-nfs/nfsv3/nfs/util"
@@ -22,9 +28,100 @@ type Target struct {
 	fh      []byte
 	dirPath string
 	fsinfo  *FSInfo
+
+	auditHook  AuditHook
+	ids        IDResolver
+	beforeHook OpHook
+	afterHook  OpHook
+	stats      *statsCollector
+	cache      *attrCache
+	dataCache  *DataCache
+	budget     *MemoryBudget
+
+	// additional connections, see NConnect, swapped whole under connsMu
+	connsMu sync.Mutex
+	conns   []*rpc.Client
+	policy  NConnectPolicy
+	next    uint32
+
+	// supplies the credential of each call, if set
+	creds CredentialProvider
+
+	// the mount the target came from, unmounted on Close
+	mount *Mount
+
+	// files opened and not closed yet
+	handles handleTracker
+
+	// the fsid of the root, and whether to keep to it, see SetOneFilesystem
+	rootFSID uint64
+	oneFS    bool
+
+	// whether long operations check ACCESS first, see SetAccessPreflight
+	accessPreflight bool
+
+	// bound the walks of paths, see SetPathLimits
+	maxComponents, maxSymlinks int
+
+	// guards fh, which changes on a remount, see SetRemountAfter
+	rootMu       sync.RWMutex
+	remountMu    sync.Mutex
+	prevRoot     []byte
+	staleRoots   int
+	remountAfter int
+
+	// shares calls out with other targets, see SetScheduler
+	sched  *Scheduler
+	tenant string
+	prio   Priority
+
+	// sends slow reads again, see SetHedging
+	hedgeMu sync.Mutex
+	hedge   *hedger
+
+	// the limits of the filesystems seen, by fsid, see PathConf
+	pathConfMu sync.Mutex
+	pathConfs  map[uint64]*PathConf
+
+	// what the server was found to do, see ProbeCapabilities
+	capsMu sync.Mutex
+	caps   *Capabilities
+
+	// the lock manager of the server, see LockManager
+	nlmMu sync.Mutex
+	nlm   *LockManager
+
+	// where events go and whether lost connections are dialed again, see
+	// SetEventHandler; reconnectMu serializes the dialing
+	eventMu      sync.Mutex
+	eventHandler EventHandler
+	reconnect    bool
+	reconnectMu  sync.Mutex
+	connStates   map[*rpc.Client]*connState
+	writeVerf    uint64
+	writeVerfSet bool
+
+	// uncommitted bytes kept per file, see SetWriteBehind
+	writeBehind int64
+
+	// calls in flight, drained by Close
+	callMu       sync.Mutex
+	closed       bool
+	inflight     int
+	drained      chan struct{}
+	closeTimeout time.Duration
 }
 
 func NewTarget(addr string, auth rpc.Auth, fh []byte, dirpath string, priv bool) (*Target, error) {
+	return newTarget(addr, auth, fh, dirpath, priv, nil)
+}
+
+// NewTargetTLS is NewTarget over TLS, see DialServiceTLS
+func NewTargetTLS(addr string, auth rpc.Auth, fh []byte, dirpath string, priv bool, config *tls.Config) (*Target, error) {
+	return newTarget(addr, auth, fh, dirpath, priv, config)
+}
+
+func newTarget(addr string, auth rpc.Auth, fh []byte, dirpath string, priv bool, config *tls.Config) (*Target, error) {
 	m := rpc.Mapping{
 		Prog: Nfs3Prog,
 		Vers: Nfs3Vers,
@@ -32,7 +129,7 @@ func NewTarget(addr string, auth rpc.Auth, fh []byte, dirpath string, priv bool)
 		Port: 0,
 	}
 
-	client, err := DialService(addr, m, priv)
+	client, err := DialServiceTLS(addr, m, priv, config)
 	if err != nil {
 		return nil, err
 	}
@@ -42,11 +139,14 @@ func NewTarget(addr string, auth rpc.Auth, fh []byte, dirpath string, priv bool)
 
 func NewTargetWithClient(client *rpc.Client, auth rpc.Auth, fh []byte, dirpath string) (*Target, error) {
 	vol := &Target{
-		Client:  client,
-		auth:    auth,
-		fh:      fh,
-		dirPath: dirpath,
+		Client:       client,
+		auth:         auth,
+		fh:           fh,
+		dirPath:      dirpath,
+		closeTimeout: DefaultCloseTimeout,
+		remountAfter: DefaultRemountAfter,
 	}
+	vol.stats = newStatsCollector(vol.retransmits)
 
 	fsinfo, err := vol.FSInfo()
 	if err != nil {
@@ -56,26 +156,83 @@ func NewTargetWithClient(client *rpc.Client, auth rpc.Auth, fh []byte, dirpath s
 	vol.fsinfo = fsinfo
 	util.Debugf("%s fsinfo=%#v", dirpath, fsinfo)
 
+	if err = vol.pinRoot(fsinfo.Attr.attr()); err != nil {
+		return nil, err
+	}
+
 	return vol, nil
 }
 
 // wraps the Call function to check status and decode errors
 func (v *Target) call(c interface{}) (io.ReadSeeker, error) {
-	res, err := v.Call(c)
-	if err != nil {
+	return v.callContext(context.Background(), c)
+}
+
+// callContext is call with the deadline of ctx, see rpc.Client.CallDeadline,
+// and its priority, see WithPriority
+func (v *Target) callContext(ctx context.Context, c interface{}) (io.ReadSeeker, error) {
+	deadline, _ := ctx.Deadline()
+
+	var proc uint32
+	if h, ok := c.(interface{ RPCHeader() *rpc.Header }); ok {
+		proc = h.RPCHeader().Proc
+	}
+
+	if err := v.begin(); err != nil {
 		return nil, err
 	}
+	defer v.end()
+
+	for {
+		res, status, err := v.callOnce(ctx, c, proc, deadline)
+		if err == nil {
+			v.rootOK(c)
+			return res, nil
+		}
+
+		// the export may have been reloaded under a new root handle,
+		// mounted again out of the slot of the scheduler the call had
+		if status != NFS3ErrStale || !v.staleRoot(c) {
+			return nil, err
+		}
+	}
+}
+
+// callOnce sends c in a slot of the scheduler, and returns its reply and its
+// status, released before any retry
+func (v *Target) callOnce(ctx context.Context, c interface{}, proc uint32, deadline time.Time) (io.ReadSeeker, uint32, error) {
+	done, err := v.schedule(v.priority(ctx), deadline)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer done()
+
+	if err := v.credential(c); err != nil {
+		return nil, 0, err
+	}
+
+	client := v.pick(c)
+	gen := v.connGen(client)
+	start := time.Now()
+	res, err := v.send(client, proc, c, deadline)
+	if err != nil {
+		v.stats.record(proc, time.Since(start), 0, err)
+		v.connLost(client, gen, err)
+		return nil, 0, err
+	}
 
 	status, err := xdr.ReadUint32(res)
+	v.stats.record(proc, time.Since(start), status, err)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	if err = NFS3Error(status); err != nil {
-		return nil, err
+	// the server is overloaded, have the client send less at a time
+	if status == NFS3ErrJukebox {
+		client.Window().Backoff()
 	}
 
-	return res, nil
+	return res, status, NFS3Error(status)
 }
 
 func (v *Target) FSInfo() (*FSInfo, error) {
@@ -93,7 +250,7 @@ func (v *Target) FSInfo() (*FSInfo, error) {
 			Cred:    v.auth,
 			Verf:    rpc.AuthNull,
 		},
-		FsRoot: v.fh,
+		FsRoot: v.root(),
 	})
 
 	if err != nil {
@@ -121,13 +278,51 @@ func sameHandle(a []byte, b []byte) bool {
 	return true
 }
 
-// Lookup returns attributes and the file handle to a given dirent
+// Lookup returns attributes and the file handle to a given dirent.  The
+// symlinks along the path are followed, the last component included, as
+// stat(2) does.
 func (v *Target) Lookup(p string) (os.FileInfo, []byte, error) {
-	fattr, fh, _, _, err := v.lookupInner(v.fh, p, true, nil)
+	return v.LookupContext(context.Background(), p)
+}
+
+// LookupContext is like Lookup, but the whole path walk is bounded by the
+// deadline of ctx.  If the deadline passes, or ctx is cancelled between two
+// components, a *LookupTimeoutError naming the pending component is returned.
+func (v *Target) LookupContext(ctx context.Context, p string) (os.FileInfo, []byte, error) {
+	fattr, fh, _, _, err := v.lookupInner(ctx, v.root(), p, true, nil)
 	return fattr, fh, err
 }
 
-func (v *Target) lookupInner(fh []byte, p string, lookupLast bool, lookupOrigin []byte) (*Fattr, []byte, string, []byte, error) {
+// Lstat is like Lookup, but a symlink last is not followed, as lstat(2)
+// does, its own attributes and handle are returned.
+func (v *Target) Lstat(p string) (os.FileInfo, []byte, error) {
+	return v.lstat(p)
+}
+
+// lstat is Lstat, with the attributes as they are
+func (v *Target) lstat(p string) (*Fattr, []byte, error) {
+	fattr, fh, _, _, err := v.lstatInner(context.Background(), v.root(), p)
+	if err == nil && fattr == nil {
+		// the root, not looked up
+		fattr, err = v.GetAttrFh(fh)
+	}
+	return fattr, fh, err
+}
+
+func (v *Target) lookupInner(ctx context.Context, fh []byte, p string, lookupLast bool, lookupOrigin []byte) (*Fattr, []byte, string, []byte, error) {
+	return v.walk(ctx, fh, p, lookupLast, true, lookupOrigin, new(int))
+}
+
+// lstatInner is lookupInner of the last component itself, a symlink there
+// not followed
+func (v *Target) lstatInner(ctx context.Context, fh []byte, p string) (*Fattr, []byte, string, []byte, error) {
+	return v.walk(ctx, fh, p, true, false, nil, new(int))
+}
+
+// walk is lookupInner, following a symlink last only if followLast, chased
+// counting the symlinks followed by the lookup so far, those of the targets
+// of symlinks included
+func (v *Target) walk(ctx context.Context, fh []byte, p string, lookupLast, followLast bool, lookupOrigin []byte, chased *int) (*Fattr, []byte, string, []byte, error) {
 	var (
 		err   error
 		fattr *Fattr
@@ -135,6 +330,18 @@ func (v *Target) lookupInner(fh []byte, p string, lookupLast bool, lookupOrigin
 
 	// desecend down a path heirarchy to get the last elem's fh
 	dirents := strings.Split(p, "/")
+	maxComponents, maxSymlinks := v.pathLimits()
+	if len(dirents) > maxComponents {
+		n := 0
+		for _, dirent := range dirents {
+			if dirent != "" && dirent != "." {
+				n++
+			}
+		}
+		if n > maxComponents {
+			return nil, nil, "", nil, &PathLimitError{Path: p, Limit: maxComponents, Err: ErrPathTooDeep}
+		}
+	}
 	var dirent string
 	var prevFh []byte
 	for i := 0; i < len(dirents); {
@@ -151,41 +358,63 @@ func (v *Target) lookupInner(fh []byte, p string, lookupLast bool, lookupOrigin
 			util.Debugf("root -> 0x%x", fh)
 			continue
 		}
-		fattr, fh, _, err = v.lookup(prevFh, dirent)
+		if err = ctx.Err(); err != nil {
+			return nil, nil, "", nil, &LookupTimeoutError{Path: p, Component: dirent, Err: err}
+		}
+		fattr, fh, _, err = v.lookup(ctx, prevFh, dirent)
 		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil, nil, "", nil, &LookupTimeoutError{Path: p, Component: dirent, Err: err}
+			}
 			return nil, nil, "", nil, err
 		}
-		if fattr.FileMode&0o170000 == 0o120000 {
-			if lookupOrigin != nil && sameHandle(fh, lookupOrigin) {
-				return nil, nil, "", nil, fmt.Errorf("recursed symlink")
+		// symlinks are followed, the last component only if followLast;
+		// some servers tell them by the type left in the mode only
+		if (i < len(dirents) || followLast) && (fattr.Type == NF3Lnk || ModeType(fattr.FileMode) == NF3Lnk) {
+			if (lookupOrigin != nil && sameHandle(fh, lookupOrigin)) || *chased >= maxSymlinks {
+				return nil, nil, "", nil, &PathLimitError{Path: p, Limit: maxSymlinks, Err: ErrSymlinkLoop}
 			}
 			// symlink
+			*chased++
 			_, target, err := v.readlinkFh(fh)
 			if err != nil {
 				return nil, nil, "", nil, err
 			}
-			// reparse
-			_, fh, _, _, err = v.lookupInner(v.fh, target, true, fh)
+			// reparse, from the directory of the symlink unless absolute
+			from := prevFh
+			if strings.HasPrefix(target, "/") {
+				from = v.root()
+			}
+			fattr, fh, _, _, err = v.walk(ctx, from, target, true, true, fh, chased)
+			if err != nil {
+				return nil, nil, "", nil, err
+			}
 		}
 	}
 
 	return fattr, fh, dirent, prevFh, nil
 }
 
-// lookup returns the same as above, but by fh and name
-func (v *Target) lookup(fh []byte, name string) (*Fattr, []byte, *Fattr, error) {
+// lookup returns the same as above, but by fh and name.  The deadline of ctx
+// bounds the call.
+func (v *Target) lookup(ctx context.Context, fh []byte, name string) (*Fattr, []byte, *Fattr, error) {
 	type Lookup3Args struct {
 		rpc.Header
 		What Diropargs3
 	}
 
-	type LookupOk struct {
-		FH      []byte
-		Attr    PostOpAttr
-		DirAttr PostOpAttr
+	if cfh, ok := v.cache.getDirent(fh, name); ok {
+		if attr, ok := v.cache.getAttr(cfh); ok {
+			dirAttr, ok := v.cache.getAttr(fh)
+			if !ok {
+				dirAttr = new(Fattr)
+			}
+			util.Debugf("lookup(%s): cached FH 0x%x", name, cfh)
+			return attr, cfh, dirAttr, nil
+		}
 	}
 
-	res, err := v.call(&Lookup3Args{
+	res, err := v.callContext(ctx, &Lookup3Args{
 		Header: rpc.Header{
 			Rpcvers: 2,
 			Prog:    Nfs3Prog,
@@ -205,17 +434,38 @@ func (v *Target) lookup(fh []byte, name string) (*Fattr, []byte, *Fattr, error)
 		return nil, nil, nil, err
 	}
 
-	lookupres := new(LookupOk)
+	lookupres := new(lookupOk)
 	if err := xdr.Read(res, lookupres); err != nil {
 		util.Errorf("lookup(%s) failed to parse return: %s", name, err)
 		util.Debugf("lookup partial decode: %+v", *lookupres)
 		return nil, nil, nil, err
 	}
 
+	if lookupres.DirAttr.IsSet {
+		v.cache.putAttr(fh, &lookupres.DirAttr.Attr)
+	}
+	if lookupres.Attr.IsSet {
+		v.cache.putAttr(lookupres.FH, &lookupres.Attr.Attr)
+		v.cache.putDirent(fh, name, lookupres.FH)
+	}
+
 	util.Debugf("lookup(%s): FH 0x%x, attr: %+v", name, lookupres.FH, lookupres.Attr.Attr)
 	return &lookupres.Attr.Attr, lookupres.FH, &lookupres.DirAttr.Attr, nil
 }
 
+// LookupChild looks name up in the directory parentFh with a single LOOKUP,
+// for callers keeping their own tree of handles instead of walking paths.
+// It returns the child's handle, its attributes and those of the directory;
+// attributes the server did not return are zero.  Symlinks are not followed.
+func (v *Target) LookupChild(parentFh []byte, name string) ([]byte, *Fattr, *Fattr, error) {
+	attr, fh, dirAttr, err := v.lookup(context.Background(), parentFh, name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return fh, attr, dirAttr, nil
+}
+
 // Access file
 func (v *Target) Access(path string, mode uint32) (uint32, error) {
 
@@ -266,6 +516,10 @@ func (v *Target) access(fh []byte, path string, access uint32) (*Fattr, uint32,
 		return nil, 0, err
 	}
 
+	if accessres.Attr.IsSet {
+		v.cache.putAttr(fh, &accessres.Attr.Attr)
+	}
+
 	util.Debugf("access(%s): access %d, attr: %+v", path, accessres.Access, accessres.Attr)
 
 	return &accessres.Attr.Attr, accessres.Access, nil
@@ -282,6 +536,43 @@ func (v *Target) ReadDirPlus(dir string) ([]*EntryPlus, error) {
 }
 
 func (v *Target) ReadDirPlusByFh(fh []byte) ([]*EntryPlus, error) {
+	entries, _, _, err := v.readDirPlus(fh)
+	return entries, err
+}
+
+// ReadDirPlusPagesByFh lists directory fh a page at a time, calling fn with
+// the entries of each page as the server sends them, and stops at the first
+// error fn returns.  The entries of every page are decoded into the same
+// slice, which saves the allocations of listing directories of millions of
+// entries, but means fn must copy what it keeps of them.
+func (v *Target) ReadDirPlusPagesByFh(fh []byte, fn func(page []EntryPlus) error) error {
+	_, _, err := v.readDirPlusPages(fh, true, fn)
+	return err
+}
+
+// readDirPlus lists directory fh, and returns the cookie verifier of the
+// listing and the attributes of the directory if the server sent them.  The
+// listing fails if the verifier changes from one page to the next.
+func (v *Target) readDirPlus(fh []byte) ([]*EntryPlus, uint64, *Fattr, error) {
+	var entries []*EntryPlus
+	verf, dirAttr, err := v.readDirPlusPages(fh, false, func(page []EntryPlus) error {
+		// the entries of a page are allocated together, and the pointers
+		// keep the page alive
+		for i := range page {
+			entries = append(entries, &page[i])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	return entries, verf, dirAttr, nil
+}
+
+// readDirPlusPages lists directory fh, calling fn with each page, decoded
+// into the slice of the page before if reuse is set and a new one otherwise
+func (v *Target) readDirPlusPages(fh []byte, reuse bool, fn func(page []EntryPlus) error) (uint64, *Fattr, error) {
 	cookie := uint64(0)
 	cookieVerf := uint64(0)
 	eof := false
@@ -295,17 +586,8 @@ func (v *Target) ReadDirPlusByFh(fh []byte) ([]*EntryPlus, error) {
 		MaxCount   uint32
 	}
 
-	type DirListPlus3 struct {
-		IsSet bool      `xdr:"union"`
-		Entry EntryPlus `xdr:"unioncase=1"`
-	}
-
-	type DirListOK struct {
-		DirAttrs   PostOpAttr
-		CookieVerf uint64
-	}
-
-	var entries []*EntryPlus
+	var page []EntryPlus
+	var dirAttr *Fattr
 	for !eof {
 		res, err := v.call(&ReadDirPlus3Args{
 			Header: rpc.Header{
@@ -325,7 +607,7 @@ func (v *Target) ReadDirPlusByFh(fh []byte) ([]*EntryPlus, error) {
 
 		if err != nil {
 			util.Debugf("readdir(%x): %s", fh, err.Error())
-			return nil, err
+			return 0, nil, err
 		}
 
 		// The dir list entries are so-called "optional-data".  We need to check
@@ -333,39 +615,93 @@ func (v *Target) ReadDirPlusByFh(fh []byte) ([]*EntryPlus, error) {
 		// an encoding used to flatten a linked list into an array where the
 		// Follows field is set when the next idx has data. See
 		// https://tools.ietf.org/html/rfc4506.html#section-4.19 for details.
-		dirlistOK := new(DirListOK)
+		dirlistOK := new(dirListOK)
 		if err = xdr.Read(res, dirlistOK); err != nil {
 			util.Errorf("readdir failed to parse result (%x): %s", fh, err.Error())
 			util.Debugf("partial dirlist: %+v", dirlistOK)
-			return nil, err
+			return 0, nil, err
 		}
 
-		for {
-			var item DirListPlus3
-			if err = xdr.Read(res, &item); err != nil {
-				util.Errorf("readdir failed to parse directory entry, aborting")
-				util.Debugf("partial dirent: %+v", item)
-				return nil, err
-			}
+		if dirlistOK.DirAttrs.IsSet {
+			dirAttr = &dirlistOK.DirAttrs.Attr
+			v.cache.putAttr(fh, dirAttr)
+		}
 
-			if !item.IsSet {
-				break
-			}
+		// the directory changed under us, the cookies may be meaningless
+		if cookie != 0 && dirlistOK.CookieVerf != cookieVerf {
+			return 0, nil, &ChangedError{FH: fh, What: "cookieverf", Old: cookieVerf, New: dirlistOK.CookieVerf}
+		}
 
-			cookie = item.Entry.Cookie
-			entries = append(entries, &item.Entry)
+		if !reuse {
+			page = nil
+		}
+		page, eof, err = decodeEntryPlusPage(res, page[:0])
+		if err != nil {
+			util.Errorf("readdir failed to parse directory entries (%x): %s", fh, err.Error())
+			return 0, nil, err
 		}
 
-		if err = xdr.Read(res, &eof); err != nil {
-			util.Errorf("readdir failed to determine presence of more data to read, aborting")
-			return nil, err
+		// a server that neither ends the listing nor moves on would keep us
+		// here forever
+		if !eof && (len(page) == 0 || page[len(page)-1].Cookie == cookie) {
+			return 0, nil, fmt.Errorf("readdir(%x): server returned no progress at cookie %d", fh, cookie)
+		}
+
+		for i := range page {
+			entry := &page[i]
+			cookie = entry.Cookie
+
+			if entry.Handle.IsSet && entry.Attr.IsSet {
+				v.cache.putAttr(entry.Handle.FH, &entry.Attr.Attr)
+				v.cache.putDirent(fh, entry.FileName, entry.Handle.FH)
+			}
+		}
+		if err = fn(page); err != nil {
+			return 0, nil, err
 		}
 
 		util.Debugf("No EOF for dirents so calling back for more")
 		cookieVerf = dirlistOK.CookieVerf
 	}
 
-	return entries, nil
+	return cookieVerf, dirAttr, nil
+}
+
+// DecodeEntryPlusStream decodes the entries of a READDIRPLUS reply, the
+// list of entryplus3 and the eof flag that follows it, from r.
+func DecodeEntryPlusStream(r io.Reader) ([]*EntryPlus, bool, error) {
+	page, eof, err := decodeEntryPlusPage(r, nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	entries := make([]*EntryPlus, len(page))
+	for i := range page {
+		entries[i] = &page[i]
+	}
+
+	return entries, eof, nil
+}
+
+// decodeEntryPlusPage decodes the entries of a READDIRPLUS reply as
+// DecodeEntryPlusStream does, appending them to page by value
+func decodeEntryPlusPage(r io.Reader, page []EntryPlus) ([]EntryPlus, bool, error) {
+	d := xdr.NewReader(r)
+	for d.DecodeBool() {
+		page = append(page, EntryPlus{})
+		entry := &page[len(page)-1]
+		if err := d.Decode(entry); err != nil {
+			util.Debugf("partial dirent: %+v", entry)
+			return nil, false, err
+		}
+	}
+
+	eof := d.DecodeBool()
+	if err := d.Err(); err != nil {
+		return nil, false, err
+	}
+
+	return page, eof, nil
 }
 
 func (v *Target) Mkdir(path string, perm os.FileMode) ([]byte, error) {
@@ -380,6 +716,10 @@ func (v *Target) Mkdir(path string, perm os.FileMode) ([]byte, error) {
 
 // Creates a directory of the given name and returns its handle
 func (v *Target) MkdirByParentFh(fh []byte, name string, perm os.FileMode) ([]byte, error) {
+	if err := v.checkName(fh, name); err != nil {
+		return nil, err
+	}
+
 	type MkdirArgs struct {
 		rpc.Header
 		Where Diropargs3
@@ -408,13 +748,15 @@ func (v *Target) MkdirByParentFh(fh []byte, name string, perm os.FileMode) ([]by
 		Attrs: Sattr3{
 			Mode: SetMode{
 				SetIt: true,
-				Mode:  uint32(perm.Perm()),
+				Mode:  ModeBits(perm),
 			},
 		},
 	}
-	res, err := v.call(args)
+	ev := v.opBegin(AuditEvent{Proc: NFSProc3Mkdir, FH: fh, Name: name})
+	res, err := v.callOp(ev, args)
 
 	if err != nil {
+		v.opEnd(ev, err)
 		util.Debugf("mkdir(%+v %s): %s", fh, name, err.Error())
 		util.Debugf("mkdir args (%+v)", args)
 		return nil, err
@@ -422,21 +764,40 @@ func (v *Target) MkdirByParentFh(fh []byte, name string, perm os.FileMode) ([]by
 
 	mkdirres := new(MkdirOk)
 	if err := xdr.Read(res, mkdirres); err != nil {
+		v.opEnd(ev, err)
 		util.Errorf("mkdir(%+v %s) failed to parse return: %s", fh, name, err)
 		util.Debugf("mkdir(%s) partial response: %+v", mkdirres)
 		return nil, err
 	}
 
+	v.cache.wcc(fh, &mkdirres.DirWcc)
+	if mkdirres.FH.IsSet && mkdirres.Attr.IsSet {
+		v.cache.putAttr(mkdirres.FH.FH, &mkdirres.Attr.Attr)
+		v.cache.putDirent(fh, name, mkdirres.FH.FH)
+	}
+
+	ev.Attr = mkdirres.DirWcc.After.attr()
+	ev.ObjFH = mkdirres.FH.FH
+	ev.ObjAttr = mkdirres.Attr.attr()
+	v.opEnd(ev, nil)
+
 	util.Debugf("mkdir(%+v %s): created successfully: %+v", fh, name, mkdirres.FH.FH)
 	return mkdirres.FH.FH, nil
 }
 
 // Create a file with name the given mode
 func (v *Target) CreateTruncate(path string, perm os.FileMode, size uint64) ([]byte, error) {
-	_, _, newFile, fh, err := v.lookupInner(v.fh, path, false, nil)
+	if err := v.checkFileSize(0, size); err != nil {
+		return nil, err
+	}
+
+	_, _, newFile, fh, err := v.lookupInner(context.Background(), v.root(), path, false, nil)
 	if err != nil {
 		return nil, err
 	}
+	if err = v.checkName(fh, newFile); err != nil {
+		return nil, err
+	}
 
 	type How struct {
 		// 0 : UNCHECKED (default)
@@ -457,7 +818,8 @@ func (v *Target) CreateTruncate(path string, perm os.FileMode, size uint64) ([]b
 		DirWcc WccData
 	}
 
-	res, err := v.call(&Create3Args{
+	ev := v.opBegin(AuditEvent{Proc: NFSProc3Create, FH: fh, Name: newFile})
+	res, err := v.callOp(ev, &Create3Args{
 		Header: rpc.Header{
 			Rpcvers: 2,
 			Prog:    Nfs3Prog,
@@ -474,7 +836,7 @@ func (v *Target) CreateTruncate(path string, perm os.FileMode, size uint64) ([]b
 			Attr: Sattr3{
 				Mode: SetMode{
 					SetIt: true,
-					Mode:  uint32(perm.Perm()),
+					Mode:  ModeBits(perm),
 				},
 				Size: SetSize{
 					SetIt: true,
@@ -485,14 +847,23 @@ func (v *Target) CreateTruncate(path string, perm os.FileMode, size uint64) ([]b
 	})
 
 	if err != nil {
+		v.opEnd(ev, err)
 		util.Debugf("create(%s): %s", path, err.Error())
 		return nil, err
 	}
 
 	status := new(Create3Res)
 	if err = xdr.Read(res, status); err != nil {
+		v.opEnd(ev, err)
 		return nil, err
 	}
+	v.cache.wcc(fh, &status.DirWcc)
+	v.cache.removeDirent(fh, newFile)
+
+	ev.Attr = status.DirWcc.After.attr()
+	ev.ObjFH = status.FH.FH
+	ev.ObjAttr = status.Attr.attr()
+	v.opEnd(ev, nil)
 
 	util.Debugf("create(%s): created successfully", path)
 	return status.FH.FH, nil
@@ -500,7 +871,7 @@ func (v *Target) CreateTruncate(path string, perm os.FileMode, size uint64) ([]b
 
 // Create a file with name the given mode
 func (v *Target) Create(path string, perm os.FileMode) ([]byte, error) {
-	_, _, newFile, fh, err := v.lookupInner(v.fh, path, false, nil)
+	_, _, newFile, fh, err := v.lookupInner(context.Background(), v.root(), path, false, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -530,6 +901,10 @@ func (v *Target) GetAttrFh(fh []byte) (*Fattr, error) {
 		Attr Fattr
 	}
 
+	if attr, ok := v.cache.getAttr(fh); ok {
+		return attr, nil
+	}
+
 	res, err := v.call(&GetAttrArgs{
 		Header: rpc.Header{
 			Rpcvers: 2,
@@ -552,12 +927,17 @@ func (v *Target) GetAttrFh(fh []byte) (*Fattr, error) {
 		util.Debugf("getattr raw res: %+v", res)
 		return nil, err
 	}
+	v.cache.putAttr(fh, &getAttrRes.Attr)
 
 	return &getAttrRes.Attr, nil
 }
 
 // Create a file with name the given mode
 func (v *Target) CreateByFh(fh []byte, name string, perm os.FileMode) ([]byte, error) {
+	if err := v.checkName(fh, name); err != nil {
+		return nil, err
+	}
+
 	type How struct {
 		// 0 : UNCHECKED (default)
 		// 1 : GUARDED
@@ -577,7 +957,8 @@ func (v *Target) CreateByFh(fh []byte, name string, perm os.FileMode) ([]byte, e
 		DirWcc WccData
 	}
 
-	res, err := v.call(&Create3Args{
+	ev := v.opBegin(AuditEvent{Proc: NFSProc3Create, FH: fh, Name: name})
+	res, err := v.callOp(ev, &Create3Args{
 		Header: rpc.Header{
 			Rpcvers: 2,
 			Prog:    Nfs3Prog,
@@ -594,20 +975,29 @@ func (v *Target) CreateByFh(fh []byte, name string, perm os.FileMode) ([]byte, e
 			Attr: Sattr3{
 				Mode: SetMode{
 					SetIt: true,
-					Mode:  uint32(perm.Perm()),
+					Mode:  ModeBits(perm),
 				},
 			},
 		},
 	})
 
 	if err != nil {
+		v.opEnd(ev, err)
 		return nil, err
 	}
 
 	status := new(Create3Res)
 	if err = xdr.Read(res, status); err != nil {
+		v.opEnd(ev, err)
 		return nil, err
 	}
+	v.cache.wcc(fh, &status.DirWcc)
+	v.cache.removeDirent(fh, name)
+
+	ev.Attr = status.DirWcc.After.attr()
+	ev.ObjFH = status.FH.FH
+	ev.ObjAttr = status.Attr.attr()
+	v.opEnd(ev, nil)
 
 	util.Debugf("create(%+v %s): created successfully", fh, name)
 	return status.FH.FH, nil
@@ -631,7 +1021,12 @@ func (v *Target) remove(fh []byte, deleteFile string) error {
 		Object Diropargs3
 	}
 
-	_, err := v.call(&RemoveArgs{
+	type RemoveOk struct {
+		DirWcc WccData
+	}
+
+	ev := v.opBegin(AuditEvent{Proc: NFSProc3Remove, FH: fh, Name: deleteFile})
+	res, err := v.callOp(ev, &RemoveArgs{
 		Header: rpc.Header{
 			Rpcvers: 2,
 			Prog:    Nfs3Prog,
@@ -647,10 +1042,21 @@ func (v *Target) remove(fh []byte, deleteFile string) error {
 	})
 
 	if err != nil {
+		v.opEnd(ev, err)
 		util.Debugf("remove(%s): %s", deleteFile, err.Error())
 		return err
 	}
 
+	v.cache.removeDirent(fh, deleteFile)
+	removeres := new(RemoveOk)
+	if err = xdr.Read(res, removeres); err != nil {
+		v.cache.invalidate(fh)
+	} else {
+		v.cache.wcc(fh, &removeres.DirWcc)
+		ev.Attr = removeres.DirWcc.After.attr()
+	}
+	v.opEnd(ev, nil)
+
 	return nil
 }
 
@@ -665,6 +1071,57 @@ func (v *Target) RmDir(path string) error {
 	return v.rmDir(fh, deletedir)
 }
 
+// NotEmptyError is returned by RemoveAny for a directory holding entries,
+// as os.Remove fails with ENOTEMPTY.  It wraps the NFS3ERR_NOTEMPTY of the
+// server.
+type NotEmptyError struct {
+	Path string
+	Err  error
+}
+
+func (e *NotEmptyError) Error() string {
+	return "remove " + e.Path + ": directory not empty"
+}
+
+func (e *NotEmptyError) Unwrap() error {
+	return e.Err
+}
+
+// RemoveAny removes path whatever it is, with RMDIR for a directory and
+// REMOVE otherwise, as os.Remove does, for code written against a local
+// filesystem.  A directory holding entries fails with a *NotEmptyError.
+func (v *Target) RemoveAny(path string) error {
+	dir, name := _path.Split(_path.Clean(path))
+	if name == "" || name == "." || name == ".." {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrInvalid}
+	}
+	_, fh, err := v.Lookup(dir)
+	if err != nil {
+		return err
+	}
+	attr, _, _, err := v.lookup(context.Background(), fh, name)
+	if err != nil {
+		return err
+	}
+
+	// the entry may be replaced meanwhile, the server tells by the status
+	if attr.Type == NF3Dir {
+		if err = v.rmDir(fh, name); IsNotDirError(err) {
+			err = v.remove(fh, name)
+		}
+	} else {
+		var nfsErr *Error
+		if err = v.remove(fh, name); errors.As(err, &nfsErr) && nfsErr.ErrorNum == NFS3ErrIsDir {
+			err = v.rmDir(fh, name)
+		}
+	}
+	if IsNotEmptyError(err) {
+		return &NotEmptyError{Path: path, Err: err}
+	}
+
+	return err
+}
+
 // delete the named directory from the parent directory (fh)
 func (v *Target) rmDir(fh []byte, name string) error {
 	type RmDir3Args struct {
@@ -672,7 +1129,12 @@ func (v *Target) rmDir(fh []byte, name string) error {
 		Object Diropargs3
 	}
 
-	_, err := v.call(&RmDir3Args{
+	type RmDir3Ok struct {
+		DirWcc WccData
+	}
+
+	ev := v.opBegin(AuditEvent{Proc: NFSProc3RmDir, FH: fh, Name: name})
+	res, err := v.callOp(ev, &RmDir3Args{
 		Header: rpc.Header{
 			Rpcvers: 2,
 			Prog:    Nfs3Prog,
@@ -688,102 +1150,40 @@ func (v *Target) rmDir(fh []byte, name string) error {
 	})
 
 	if err != nil {
+		v.opEnd(ev, err)
 		util.Debugf("rmdir(%s): %s", name, err.Error())
 		return err
 	}
 
-	util.Debugf("rmdir(%s): deleted successfully", name)
-	return nil
-}
-
-func (v *Target) RemoveAll(path string) error {
-	_, _, deleteDir, parentDirfh, err := v.lookupInner(v.fh, path, false, nil)
-	if err != nil {
-		return err
-	}
-
-	// Easy path.  This is a directory and it's empty.  If not a dir or not an
-	// empty dir, this will throw an error.
-	err = v.rmDir(parentDirfh, deleteDir)
-	if err == nil || os.IsNotExist(err) {
-		return nil
-	}
-
-	// Collect the not a dir error.
-	if IsNotDirError(err) {
-		return err
-	}
-
-	_, deleteDirfh, _, _, err := v.lookupInner(parentDirfh, deleteDir, true, nil)
-	if err != nil {
-		return err
-	}
-
-	if err = v.removeAll(deleteDirfh); err != nil {
-		return err
-	}
-
-	// Delete the directory we started at.
-	if err = v.rmDir(parentDirfh, deleteDir); err != nil {
-		return err
+	v.cache.removeDirent(fh, name)
+	rmdirres := new(RmDir3Ok)
+	if err = xdr.Read(res, rmdirres); err != nil {
+		v.cache.invalidate(fh)
+	} else {
+		v.cache.wcc(fh, &rmdirres.DirWcc)
+		ev.Attr = rmdirres.DirWcc.After.attr()
 	}
+	v.opEnd(ev, nil)
 
+	util.Debugf("rmdir(%s): deleted successfully", name)
 	return nil
 }
 
-// removeAll removes the deleteDir recursively
-func (v *Target) removeAll(deleteDirfh []byte) error {
-
-	// BFS the dir tree recursively.  If dir, recurse, then delete the dir and
-	// all files.
-
-	// This is a directory, get all of its Entries
-	entries, err := v.ReadDirPlusByFh(deleteDirfh)
-	if err != nil {
-		return err
-	}
-
-	for _, entry := range entries {
-		// skip "." and ".."
-		if entry.FileName == "." || entry.FileName == ".." {
-			continue
-		}
-
-		// If directory, recurse, then nuke it.  It should be empty when we get
-		// back.
-		if entry.Attr.Attr.Type == NF3Dir {
-			if entry.Handle.IsSet {
-				if err = v.removeAll(entry.Handle.FH); err != nil {
-					return err
-				}
-			}
-
-			err = v.rmDir(deleteDirfh, entry.FileName)
-		} else {
-
-			// nuke all files
-			err = v.remove(deleteDirfh, entry.FileName)
-		}
-
-		if err != nil {
-			util.Errorf("error deleting %s: %s", entry.FileName, err.Error())
-			return err
-		}
+func (v *Target) GetAttrByFh(fh []byte) (*Fattr, error) {
+	if attr, ok := v.cache.getAttr(fh); ok {
+		return attr, nil
 	}
 
-	return nil
+	return v.getAttr(fh)
 }
 
-func (v *Target) GetAttrByFh(fh []byte) (*Fattr, error) {
+// getAttr asks the server for the attributes of fh, bypassing the cache
+func (v *Target) getAttr(fh []byte) (*Fattr, error) {
 	type GetAttr3Args struct {
 		rpc.Header
 		FH []byte
 	}
 
-	type GetAttr3ResOk struct {
-		Attr Fattr
-	}
-
 	res, err := v.call(&GetAttr3Args{
 		Header: rpc.Header{
 			Rpcvers: 2,
@@ -805,6 +1205,7 @@ func (v *Target) GetAttrByFh(fh []byte) (*Fattr, error) {
 	if err = xdr.Read(res, fattr); err != nil {
 		return nil, err
 	}
+	v.cache.putAttr(fh, fattr)
 
 	return fattr, nil
 }
@@ -817,6 +1218,12 @@ type Guard struct {
 }
 
 func (v *Target) SetAttrByFh(fh []byte, fattr Sattr3) error {
+	if fattr.Size.SetIt {
+		if err := v.checkFileSize(0, fattr.Size.Size); err != nil {
+			return err
+		}
+	}
+
 	type SetAttr3Args struct {
 		rpc.Header
 		FH    []byte
@@ -828,7 +1235,8 @@ func (v *Target) SetAttrByFh(fh []byte, fattr Sattr3) error {
 		WccData WccData
 	}
 
-	res, err := v.call(&SetAttr3Args{
+	ev := v.opBegin(AuditEvent{Proc: NFSProc3SetAttr, FH: fh})
+	res, err := v.callOp(ev, &SetAttr3Args{
 		Header: rpc.Header{
 			Rpcvers: 2,
 			Prog:    Nfs3Prog,
@@ -843,29 +1251,63 @@ func (v *Target) SetAttrByFh(fh []byte, fattr Sattr3) error {
 			Check: false,
 		},
 	})
+	if v.dataCache != nil {
+		v.dataCache.invalidate(fh)
+	}
 
 	if err != nil {
+		v.opEnd(ev, err)
 		util.Debugf("setattr: %s", err.Error())
 		return err
 	}
 
 	wccData := new(WccData)
 	if err = xdr.Read(res, wccData); err != nil {
+		v.opEnd(ev, err)
+		v.cache.invalidate(fh)
 		return err
 	}
+	v.cache.wcc(fh, wccData)
+
+	ev.Attr = wccData.After.attr()
+	v.opEnd(ev, nil)
 
 	return nil
 }
 
+// Chtimes sets the access and modification times of path, as os.Chtimes
+// does: a zero time leaves that time as it is
+func (v *Target) Chtimes(path string, atime, mtime time.Time) error {
+	_, fh, err := v.Lookup(path)
+	if err != nil {
+		return err
+	}
+
+	return v.ChtimesByFh(fh, atime, mtime)
+}
+
+// ChtimesByFh is Chtimes of fh
+func (v *Target) ChtimesByFh(fh []byte, atime, mtime time.Time) error {
+	var sattr Sattr3
+	if !atime.IsZero() {
+		sattr.Atime = SetTimeTo(atime)
+	}
+	if !mtime.IsZero() {
+		sattr.Mtime = SetTimeTo(mtime)
+	}
+
+	return v.SetAttrByFh(fh, sattr)
+}
+
 func (v *Target) Rename(fromPath string, toPath string) error {
-	_, _, fromName, fromFh, err := v.lookupInner(v.fh, fromPath, true, nil)
+	_, _, fromName, fromFh, err := v.lstatInner(context.Background(), v.root(), fromPath)
 	if err != nil {
 		return err
 	}
 	if fromFh == nil {
 		return fmt.Errorf("fromName cannot be a root directory")
 	}
-	_, _, toName, toFh, err := v.lookupInner(v.fh, toPath, false, nil)
+	_, _, toName, toFh, err := v.lookupInner(context.Background(), v.root(), toPath, false, nil)
 	if err != nil {
 		return err
 	}
@@ -876,6 +1318,10 @@ func (v *Target) Rename(fromPath string, toPath string) error {
 }
 
 func (v *Target) RenameByFh(fromFh []byte, fromName string, toFh []byte, toName string) error {
+	if err := v.checkName(toFh, toName); err != nil {
+		return err
+	}
+
 	type Rename3Args struct {
 		rpc.Header
 		From Diropargs3
@@ -887,7 +1333,8 @@ func (v *Target) RenameByFh(fromFh []byte, fromName string, toFh []byte, toName
 		ToDirWcc   WccData
 	}
 
-	res, err := v.call(&Rename3Args{
+	ev := v.opBegin(AuditEvent{Proc: NFSProc3Rename, FH: fromFh, Name: fromName, ToFH: toFh, ToName: toName})
+	res, err := v.callOp(ev, &Rename3Args{
 		Header: rpc.Header{
 			Rpcvers: 2,
 			Prog:    Nfs3Prog,
@@ -907,22 +1354,104 @@ func (v *Target) RenameByFh(fromFh []byte, fromName string, toFh []byte, toName
 	})
 
 	if err != nil {
+		v.opEnd(ev, err)
 		util.Debugf("rename(%+v %s): %s", fromFh, fromName, err.Error())
 		return err
 	}
 
+	v.cache.removeDirent(fromFh, fromName)
+	v.cache.removeDirent(toFh, toName)
 	status := new(Rename3Res)
 	if err = xdr.Read(res, status); err != nil {
+		v.opEnd(ev, err)
+		v.cache.invalidate(fromFh)
+		v.cache.invalidate(toFh)
 		return err
 	}
+	v.cache.wcc(fromFh, &status.FromDirWcc)
+	v.cache.wcc(toFh, &status.ToDirWcc)
+
+	ev.Attr = status.FromDirWcc.After.attr()
+	ev.ToAttr = status.ToDirWcc.After.attr()
+	v.opEnd(ev, nil)
 
 	util.Debugf("rename(%+v %s): successfully renamed to (%+v %s)", fromFh, fromName, toFh, toName)
 	return nil
 }
 
+// Link makes newPath a hard link to the file at path
+func (v *Target) Link(path string, newPath string) error {
+	_, fh, err := v.Lookup(path)
+	if err != nil {
+		return err
+	}
+	_, _, name, dirFh, err := v.lookupInner(context.Background(), v.root(), newPath, false, nil)
+	if err != nil {
+		return err
+	}
+	if dirFh == nil {
+		return fmt.Errorf("newPath cannot be a root directory")
+	}
+	return v.LinkByFh(fh, dirFh, name)
+}
+
+// LinkByFh makes name in directory dirFh a hard link to file fh
+func (v *Target) LinkByFh(fh []byte, dirFh []byte, name string) error {
+	if err := v.checkName(dirFh, name); err != nil {
+		return err
+	}
+
+	type Link3Args struct {
+		rpc.Header
+		FH   []byte
+		Link Diropargs3
+	}
+
+	type Link3Res struct {
+		Attr   PostOpAttr
+		DirWcc WccData
+	}
+
+	ev := v.opBegin(AuditEvent{Proc: NFSProc3Link, FH: fh, ToFH: dirFh, ToName: name})
+	res, err := v.callOp(ev, &Link3Args{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    Nfs3Prog,
+			Vers:    Nfs3Vers,
+			Proc:    NFSProc3Link,
+			Cred:    v.auth,
+			Verf:    rpc.AuthNull,
+		},
+		FH:   fh,
+		Link: Diropargs3{FH: dirFh, Filename: name},
+	})
+
+	if err != nil {
+		v.opEnd(ev, err)
+		util.Debugf("link(%x %s): %s", dirFh, name, err.Error())
+		return err
+	}
+
+	// the link count of fh changed
+	v.cache.invalidate(fh)
+	status := new(Link3Res)
+	if err = xdr.Read(res, status); err != nil {
+		v.opEnd(ev, err)
+		v.cache.invalidate(dirFh)
+		return err
+	}
+	v.cache.wcc(dirFh, &status.DirWcc)
+
+	ev.Attr = status.Attr.attr()
+	ev.ToAttr = status.DirWcc.After.attr()
+	v.opEnd(ev, nil)
+
+	return nil
+}
+
 // Readlink reads a symbolic link and returns the target
 func (v *Target) Readlink(path string) (string, error) {
-	_, fh, err := v.Lookup(path)
+	_, fh, err := v.Lstat(path)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,236 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// MutationOp is the kind of a Mutation
+type MutationOp string
+
+const (
+	// OpMkdir makes directory Path with Mode
+	OpMkdir MutationOp = "mkdir"
+
+	// OpCreate creates file Path with Mode, or truncates it, and writes
+	// Data to it
+	OpCreate MutationOp = "create"
+
+	// OpWrite writes Data at Offset of file Path, created with Mode if
+	// missing
+	OpWrite MutationOp = "write"
+
+	// OpRemove removes file Path, OpRmDir directory Path
+	OpRemove MutationOp = "remove"
+	OpRmDir  MutationOp = "rmdir"
+
+	// OpRename renames Path to To
+	OpRename MutationOp = "rename"
+
+	// OpSymlink makes symlink Path pointing to To
+	OpSymlink MutationOp = "symlink"
+)
+
+// Mutation is a change to a tree, by path, which can be applied to any
+// target holding a copy of it
+type Mutation struct {
+	Op     MutationOp  `json:"op"`
+	Path   string      `json:"path"`
+	To     string      `json:"to,omitempty"`
+	Mode   os.FileMode `json:"mode,omitempty"`
+	Offset uint64      `json:"offset,omitempty"`
+	Data   []byte      `json:"data,omitempty"`
+}
+
+// Apply makes the change to v.  So that mutations may be applied again after
+// a failure, a directory that exists already, an entry removed already, a
+// rename whose source is gone but whose destination exists and a symlink
+// made already are not errors.
+func (m *Mutation) Apply(v *Target) error {
+	var err error
+	switch m.Op {
+	case OpMkdir:
+		if _, err = v.Mkdir(m.Path, m.Mode); os.IsExist(err) {
+			err = nil
+		}
+	case OpCreate:
+		if _, err = v.CreateTruncate(m.Path, m.Mode, 0); err == nil {
+			err = m.write(v)
+		}
+	case OpWrite:
+		err = m.write(v)
+	case OpRemove:
+		if err = v.Remove(m.Path); os.IsNotExist(err) {
+			err = nil
+		}
+	case OpRmDir:
+		if err = v.RmDir(m.Path); os.IsNotExist(err) {
+			err = nil
+		}
+	case OpRename:
+		if err = v.Rename(m.Path, m.To); os.IsNotExist(err) {
+			if _, _, lerr := v.Lookup(m.To); lerr == nil {
+				err = nil
+			}
+		}
+	case OpSymlink:
+		if _, err = v.Symlink(m.To, m.Path); os.IsExist(err) {
+			if to, lerr := v.Readlink(m.Path); lerr == nil && to == m.To {
+				err = nil
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown mutation %q", m.Op)
+	}
+
+	return err
+}
+
+// write writes Data at Offset of Path
+func (m *Mutation) write(v *Target) error {
+	if len(m.Data) == 0 {
+		return nil
+	}
+
+	f, err := v.OpenFile(m.Path, m.Mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Seek(int64(m.Offset), io.SeekStart); err == nil {
+		_, err = f.Write(m.Data)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// TeePolicy is what a TeeTarget does when a mutation fails on the mirror
+type TeePolicy int
+
+const (
+	// TeeFailFast returns a *MirrorError
+	TeeFailFast TeePolicy = iota
+
+	// TeeQueue keeps the mutation, and those after it, for Reconcile
+	TeeQueue
+)
+
+// MirrorError is returned by a TeeTarget for a mutation applied to the
+// primary but not to the mirror
+type MirrorError struct {
+	Mutation Mutation
+	Err      error
+}
+
+func (e *MirrorError) Error() string {
+	return fmt.Sprintf("mirror %s %s: %s", e.Mutation.Op, e.Mutation.Path, e.Err)
+}
+
+func (e *MirrorError) Unwrap() error {
+	return e.Err
+}
+
+// TeeTarget applies mutations to two targets holding the same tree, a
+// primary and a mirror, for simple dual-write replication of small trees
+// such as configuration.  Mutations are applied one at a time, to the
+// primary first; a failure there is returned and the mirror left alone.
+// Reads are for the primary.
+type TeeTarget struct {
+	Primary *Target
+	Mirror  *Target
+
+	policy  TeePolicy
+	mu      sync.Mutex
+	pending []Mutation
+}
+
+// NewTeeTarget returns a TeeTarget writing to primary and mirror, handling
+// failures on the mirror as policy says
+func NewTeeTarget(primary, mirror *Target, policy TeePolicy) *TeeTarget {
+	return &TeeTarget{Primary: primary, Mirror: mirror, policy: policy}
+}
+
+func (t *TeeTarget) Mkdir(path string, perm os.FileMode) error {
+	return t.Apply(Mutation{Op: OpMkdir, Path: path, Mode: perm})
+}
+
+// WriteFile creates or truncates path and writes data to it
+func (t *TeeTarget) WriteFile(path string, data []byte, perm os.FileMode) error {
+	return t.Apply(Mutation{Op: OpCreate, Path: path, Mode: perm, Data: data})
+}
+
+func (t *TeeTarget) Remove(path string) error {
+	return t.Apply(Mutation{Op: OpRemove, Path: path})
+}
+
+func (t *TeeTarget) RmDir(path string) error {
+	return t.Apply(Mutation{Op: OpRmDir, Path: path})
+}
+
+func (t *TeeTarget) Rename(from, to string) error {
+	return t.Apply(Mutation{Op: OpRename, Path: from, To: to})
+}
+
+// Apply applies m to the primary, then to the mirror.  With TeeQueue, while
+// mutations are queued new ones are queued behind them, to keep the mirror
+// in order.
+func (t *TeeTarget) Apply(m Mutation) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := m.Apply(t.Primary); err != nil {
+		return err
+	}
+
+	if len(t.pending) > 0 {
+		t.pending = append(t.pending, m)
+		return nil
+	}
+
+	if err := m.Apply(t.Mirror); err != nil {
+		if t.policy == TeeFailFast {
+			return &MirrorError{Mutation: m, Err: err}
+		}
+
+		util.Errorf("mirror %s %s: %s, queued", m.Op, m.Path, err)
+		t.pending = append(t.pending, m)
+	}
+
+	return nil
+}
+
+// Pending returns the mutations queued for the mirror
+func (t *TeeTarget) Pending() []Mutation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]Mutation(nil), t.pending...)
+}
+
+// Reconcile applies the queued mutations to the mirror, in order, and stops
+// at the first that fails with a *MirrorError
+func (t *TeeTarget) Reconcile() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for len(t.pending) > 0 {
+		m := t.pending[0]
+		if err := m.Apply(t.Mirror); err != nil {
+			return &MirrorError{Mutation: m, Err: err}
+		}
+		t.pending = t.pending[1:]
+	}
+	t.pending = nil
+
+	return nil
+}
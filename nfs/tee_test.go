@@ -0,0 +1,84 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// readAll returns the contents of path on v
+func readAll(t *testing.T, v *Target, path string) string {
+	f, err := v.Open(path)
+	if err != nil {
+		t.Fatalf("open %s: %s", path, err)
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("read %s: %s", path, err)
+	}
+
+	return string(data)
+}
+
+func TestTeeTarget(t *testing.T) {
+	primary := loopbackTarget(t)
+	defer primary.Close()
+	mirror := loopbackTarget(t)
+	defer mirror.Close()
+
+	tee := NewTeeTarget(primary, mirror, TeeFailFast)
+	if err := tee.Mkdir("/etc", 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	if err := tee.WriteFile("/etc/app.conf", []byte("a=1\n"), 0644); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := tee.Rename("/etc/app.conf", "/etc/app.yaml"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+	for _, v := range []*Target{primary, mirror} {
+		if got := readAll(t, v, "/etc/app.yaml"); got != "a=1\n" {
+			t.Errorf("read %q", got)
+		}
+	}
+
+	// the mirror is missing a directory the primary has
+	if _, err := primary.Mkdir("/only", 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	var mirrorErr *MirrorError
+	if err := tee.WriteFile("/only/x", []byte("x"), 0644); !errors.As(err, &mirrorErr) || !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("write to the mirror without the directory: %v", err)
+	}
+
+	// queued, and kept in order until reconciled
+	tee = NewTeeTarget(primary, mirror, TeeQueue)
+	if err := tee.WriteFile("/only/y", []byte("y"), 0644); err != nil {
+		t.Fatalf("queued write: %s", err)
+	}
+	if err := tee.WriteFile("/etc/app.yaml", []byte("a=2\n"), 0644); err != nil {
+		t.Fatalf("write behind the queue: %s", err)
+	}
+	if n := len(tee.Pending()); n != 2 {
+		t.Fatalf("%d mutations pending, want 2", n)
+	}
+	if got := readAll(t, mirror, "/etc/app.yaml"); got != "a=1\n" {
+		t.Errorf("mirror written out of order: %q", got)
+	}
+
+	if _, err := mirror.Mkdir("/only", 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	if err := tee.Reconcile(); err != nil {
+		t.Fatalf("reconcile: %s", err)
+	}
+	if got := readAll(t, mirror, "/only/y") + readAll(t, mirror, "/etc/app.yaml"); got != "ya=2\n" {
+		t.Errorf("mirror after reconcile: %q", got)
+	}
+}
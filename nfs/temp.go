@@ -0,0 +1,276 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	_path "path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// TempPrefix starts the names of the files CreateTemp makes, and so those
+// WriteFileAtomic writes through, for SweepTemp to tell them from others.  It
+// is not .nfs, the prefix of files clients rename open files to when they
+// are removed, which must be left alone.
+const TempPrefix = ".go-nfs-tmp-"
+
+// DefaultTempMaxAge is how old temporary files are before SweepTemp removes
+// them, unless set in JanitorOptions
+const DefaultTempMaxAge = 24 * time.Hour
+
+// CreateTemp makes a new file in directory dir, readable and writable by its
+// owner only, and returns it and its path, as os.CreateTemp does.  Its name
+// is TempPrefix and pattern, of which the last "*" is replaced by a random
+// string, appended if there is none.  The file is made with an exclusive
+// CREATE, so that two clients never get the same one.
+func (v *Target) CreateTemp(dir, pattern string) (*File, string, error) {
+	_, dirFh, err := v.GetAttr(dir)
+	if err != nil {
+		return nil, "", err
+	}
+
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+
+	for try := 0; ; try++ {
+		var b [8]byte
+		if _, err = rand.Read(b[:]); err != nil {
+			return nil, "", err
+		}
+		name := TempPrefix + prefix + hex.EncodeToString(b[:4]) + suffix
+
+		err = v.createExclusive(dirFh, name, binary.BigEndian.Uint64(b[:]))
+		v.cache.invalidate(dirFh)
+		if os.IsExist(err) && try < 100 {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		_, fh, _, err := v.lookup(context.Background(), dirFh, name)
+		if err != nil {
+			return nil, "", err
+		}
+
+		// the server may keep the verifier in the times of a file made
+		// exclusively, which would make it look old to SweepTemp
+		if err = v.SetAttrByFh(fh, Sattr3{
+			Mode:  SetMode{SetIt: true, Mode: 0600},
+			Atime: SetTimeToServer(),
+			Mtime: SetTimeToServer(),
+		}); err != nil {
+			v.remove(dirFh, name)
+			return nil, "", err
+		}
+
+		path := _path.Join(dir, name)
+		f := &File{Target: v, fsinfo: v.fsinfo, fh: fh}
+		v.handles.track(f, path)
+
+		return f, path, nil
+	}
+}
+
+// WriteFileAtomic writes data to file path, through a temporary file renamed
+// over it, so that readers see either the old content or the new one, never
+// a part of it.  A crash before the rename leaves the temporary file behind,
+// see SweepTemp.
+func (v *Target) WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir, name := _path.Split(path)
+	f, tmp, err := v.CreateTemp(dir, name+".*")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = v.SetAttrByFh(f.fh, Sattr3{Mode: SetMode{SetIt: true, Mode: ModeBits(perm)}})
+	}
+	if err == nil {
+		err = v.Rename(tmp, path)
+	}
+	if err != nil {
+		v.Remove(tmp)
+	}
+
+	return err
+}
+
+// JanitorOptions tune SweepTemp
+type JanitorOptions struct {
+	// MaxAge is how long since a temporary file was written before it is
+	// removed, DefaultTempMaxAge if zero.  Ages are told by the mtimes of the
+	// server and the clock of the client, which should agree.
+	MaxAge time.Duration
+
+	// Prefixes are those of the names of temporary files, TempPrefix if
+	// none, for those of other tools too, such as ".~tmp~"
+	Prefixes []string
+
+	// DryRun reports the files that would be removed without removing them
+	DryRun bool
+}
+
+// SweepReport is the outcome of SweepTemp, see WriteJSON
+type SweepReport struct {
+	Root     string    `json:"root"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	DryRun   bool      `json:"dry_run"`
+	Dirs     int       `json:"dirs"`
+	Removed  []string  `json:"removed"`
+	Bytes    uint64    `json:"bytes"`
+}
+
+// WriteJSON writes the report to w as indented JSON
+func (r *SweepReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// SweepTemp removes the temporary files below root older than MaxAge, those
+// of writes that never completed, as a crashed WriteFileAtomic leaves.
+// Symlinks are not followed.  It stops at the first error.
+func (v *Target) SweepTemp(root string, opts JanitorOptions) (*SweepReport, error) {
+	if opts.MaxAge == 0 {
+		opts.MaxAge = DefaultTempMaxAge
+	}
+	if len(opts.Prefixes) == 0 {
+		opts.Prefixes = []string{TempPrefix}
+	}
+
+	r := &SweepReport{Root: root, Started: time.Now(), DryRun: opts.DryRun, Removed: []string{}}
+	_, fh, err := v.GetAttr(root)
+	if err == nil {
+		err = v.sweepDir(fh, _path.Clean("/"+root), r, &opts)
+	}
+	sort.Strings(r.Removed)
+	r.Finished = time.Now()
+
+	return r, err
+}
+
+func (v *Target) sweepDir(fh []byte, dir string, r *SweepReport, opts *JanitorOptions) error {
+	r.Dirs++
+	entries, err := listDiffEntries(v, fh)
+	if err != nil {
+		return err
+	}
+
+	for name, e := range entries {
+		path := _path.Join(dir, name)
+		switch {
+		case e.attr.Type == NF3Dir:
+			if err = v.sweepDir(e.fh, path, r, opts); err != nil {
+				return err
+			}
+		case e.attr.Type != NF3Reg || !isTempName(name, opts.Prefixes):
+		case r.Started.Sub(e.attr.ModTime()) < opts.MaxAge:
+		default:
+			if !opts.DryRun {
+				if err = v.remove(fh, name); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			util.Debugf("sweep: removed %s", path)
+			r.Removed = append(r.Removed, path)
+			r.Bytes += e.attr.Filesize
+		}
+	}
+
+	return nil
+}
+
+func isTempName(name string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Janitor runs SweepTemp on a schedule, for long running services to clean
+// up after the crashes of others
+type Janitor struct {
+	// Reports and Errors deliver the outcome of each sweep.  Those not
+	// drained before the next sweep are dropped.
+	Reports chan *SweepReport
+	Errors  chan error
+
+	v        *Target
+	root     string
+	interval time.Duration
+	opts     JanitorOptions
+
+	done chan struct{}
+	once sync.Once
+}
+
+// NewJanitor returns a janitor sweeping root every interval, the first time
+// right away
+func (v *Target) NewJanitor(root string, interval time.Duration, opts JanitorOptions) *Janitor {
+	j := &Janitor{
+		Reports:  make(chan *SweepReport, 1),
+		Errors:   make(chan error, 1),
+		v:        v,
+		root:     root,
+		interval: interval,
+		opts:     opts,
+		done:     make(chan struct{}),
+	}
+	go j.run()
+
+	return j
+}
+
+// Close stops the janitor
+func (j *Janitor) Close() error {
+	j.once.Do(func() { close(j.done) })
+	return nil
+}
+
+func (j *Janitor) run() {
+	t := time.NewTicker(j.interval)
+	defer t.Stop()
+
+	for {
+		r, err := j.v.SweepTemp(j.root, j.opts)
+		if err != nil {
+			util.Errorf("sweep %s: %s", j.root, err)
+			select {
+			case j.Errors <- err:
+			default:
+			}
+		}
+		select {
+		case j.Reports <- r:
+		default:
+		}
+
+		select {
+		case <-j.done:
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSweepTemp(t *testing.T) {
+	v := loopbackTarget(t)
+	if _, err := v.Mkdir("/app", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.WriteFileAtomic("/app/config", []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, v, "/app/config"); got != "v1" {
+		t.Errorf("config = %q", got)
+	}
+
+	// a write that crashed a while ago, another in progress
+	f, stale, err := v.CreateTemp("/app", "config.*.part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if name := stale[len("/app/"):]; !strings.HasPrefix(name, TempPrefix+"config.") || !strings.HasSuffix(name, ".part") {
+		t.Errorf("temp name %q", name)
+	}
+	if err = v.Chtimes(stale, time.Time{}, time.Now().Add(-48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	f, fresh, err := v.CreateTemp("/app", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	writeFile(t, v, "/app/"+TempPrefix[1:], "not ours")
+
+	r, err := v.SweepTemp("/", JanitorOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.Removed, []string{stale}) || r.Dirs != 2 {
+		t.Errorf("dry run: %+v", r)
+	}
+	if _, _, err = v.Lookup(stale); err != nil {
+		t.Errorf("dry run removed %s: %v", stale, err)
+	}
+
+	j := v.NewJanitor("/app", time.Hour, JanitorOptions{})
+	defer j.Close()
+	select {
+	case r = <-j.Reports:
+	case err = <-j.Errors:
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.Removed, []string{stale}) {
+		t.Errorf("removed %v", r.Removed)
+	}
+	for path, want := range map[string]bool{stale: false, fresh: true, "/app/config": true} {
+		if _, _, err = v.Lookup(path); (err == nil) != want {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+}
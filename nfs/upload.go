@@ -0,0 +1,683 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	_path "path"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// OwnerMode is how UploadTree carries the ownership of local files over
+type OwnerMode int
+
+const (
+	// OwnerNone leaves files owned by whoever the target was mounted as
+	OwnerNone OwnerMode = iota
+
+	// OwnerSetAttr sets the owner and group of each entry with SETATTR
+	// once written, which takes a server that trusts the mount credential
+	// as root
+	OwnerSetAttr
+
+	// OwnerCredentials creates and writes each entry with an AUTH_UNIX
+	// credential of its owner, for servers that squash root.  Entries
+	// whose owner may not create them are created as the mount
+	// credential and fall back to OwnerSetAttr.
+	OwnerCredentials
+)
+
+// UploadOptions tune UploadTree
+type UploadOptions struct {
+	Owner OwnerMode
+
+	// Preflight sums the sizes of the local files first, and fails with an
+	// *InsufficientSpaceError before writing anything if they do not fit
+	// in the space or quota left, see CheckSpace
+	Preflight bool
+
+	// RemovePartial removes a file the space or quota ran out writing,
+	// rather than leave it truncated, see PartialFileError
+	RemovePartial bool
+
+	// Dedup, if set, is consulted with the digest of each file before it
+	// is uploaded.  A file whose content is on the target already is made
+	// a hard link to it instead, leaving its permissions and mtime as the
+	// content already had them.  Files uploaded are added to it.
+	Dedup ContentIndex
+
+	// Symlinks is what to do with symbolic links, skip them by default
+	Symlinks SymlinkPolicy
+
+	// LinkFrom and LinkTo are, for SymlinkRewrite, the absolute paths the
+	// source and destination trees are seen at by the links: targets below
+	// LinkFrom are rewritten below LinkTo.  They default to the local
+	// directory and the path of the destination tree.
+	LinkFrom, LinkTo string
+
+	// DirFanout, if set, has all the directories made before any file is
+	// written, breadth first, DirFanout at a time, which cuts the time to
+	// restore trees of millions of directories.  Zero makes each directory
+	// as the walk reaches it.
+	DirFanout int
+
+	// Pack, if set, packs small files into blobs, for trees of many tiny
+	// files
+	Pack *PackOptions
+}
+
+// PartialFileError is returned when the space or quota runs out while a file
+// is uploaded, so that a sync engine knows how far it got and can try again
+// later.  It wraps the NFS3ERR_NOSPC or NFS3ERR_DQUOT of the server.
+type PartialFileError struct {
+	Path    string
+	Written uint64
+	Size    uint64
+
+	// Removed is whether the partial file was removed, see RemovePartial
+	Removed bool
+
+	Err error
+}
+
+func (e *PartialFileError) Error() string {
+	state := "left truncated"
+	if e.Removed {
+		state = "removed"
+	}
+
+	return fmt.Sprintf("%s: %d bytes of %d written, %s: %s", e.Path, e.Written, e.Size, state, e.Err)
+}
+
+func (e *PartialFileError) Unwrap() error {
+	return e.Err
+}
+
+// OwnerRecord is the ownership an entry was meant to have but could not be
+// given, because the server refused or squashed it.  A list of them is the
+// sidecar of an upload, for a later privileged pass to apply with FixOwners.
+type OwnerRecord struct {
+	Path string `json:"path"`
+	UID  uint32 `json:"uid"`
+	GID  uint32 `json:"gid"`
+}
+
+// UploadResult is the outcome of UploadTree
+type UploadResult struct {
+	Files int
+	Dirs  int
+	Bytes uint64
+
+	// Linked are the files made hard links to identical content rather
+	// than uploaded, see UploadOptions.Dedup, and LinkedBytes their size
+	Linked      int
+	LinkedBytes uint64
+
+	// Packed are the files packed into blobs, see UploadOptions.Pack, and
+	// PackedBytes their size
+	Packed      int
+	PackedBytes uint64
+
+	// Links counts the symbolic links made, see UploadOptions.Symlinks
+	Links int
+
+	// Skipped are the local entries neither files, directories nor links
+	// made or followed, which are not uploaded
+	Skipped []string
+
+	// Unowned are the entries whose ownership could not be set, with
+	// OwnerSetAttr or OwnerCredentials
+	Unowned []OwnerRecord
+
+	// Collisions are the groups of local entries whose names differ only by
+	// case, copied over one another on a case insensitive destination,
+	// where the last one wins
+	Collisions [][]string
+}
+
+// WriteOwners writes the Unowned sidecar to w as JSON, see LoadOwners
+func (r *UploadResult) WriteOwners(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r.Unowned)
+}
+
+// LoadOwners reads a sidecar written by WriteOwners
+func LoadOwners(r io.Reader) ([]OwnerRecord, error) {
+	var owners []OwnerRecord
+	if err := json.NewDecoder(r).Decode(&owners); err != nil {
+		return nil, err
+	}
+
+	return owners, nil
+}
+
+// FixOwners sets the ownership recorded in owners on the entries of tree
+// dst, typically through a mount whose credential the server does not
+// squash.  It returns the records it could not apply, and the first error.
+func FixOwners(dst *TreeRef, owners []OwnerRecord) ([]OwnerRecord, error) {
+	var left []OwnerRecord
+	var first error
+	for _, o := range owners {
+		err := setOwner(dst.Target, _path.Join(dst.Path, o.Path), o.UID, o.GID)
+		if err != nil {
+			left = append(left, o)
+			if first == nil {
+				first = fmt.Errorf("%s: %w", o.Path, err)
+			}
+		}
+	}
+
+	return left, first
+}
+
+func setOwner(v *Target, path string, uid, gid uint32) error {
+	_, fh, err := v.lstat(path)
+	if err != nil {
+		return err
+	}
+
+	return v.SetAttrByFh(fh, Sattr3{UID: SetUID{SetIt: true, UID: uid}, GID: SetUID{SetIt: true, UID: gid}})
+}
+
+// UploadTree copies the local directory local into tree dst, which must
+// exist, creating or overwriting its entries.  Permissions and modification
+// times are carried over, and ownership as opts tells.  Symlinks and special
+// files are skipped.
+func UploadTree(local string, dst *TreeRef, opts UploadOptions) (*UploadResult, error) {
+	v := dst.Target
+	_, fh, err := v.Lookup(dst.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = v.preflightAccess(fh, dst.Path, AccessLookup|AccessModify|AccessExtend); err != nil {
+		return nil, err
+	}
+	if opts.Preflight {
+		size, err := localSize(local)
+		if err != nil {
+			return nil, err
+		}
+		if err = v.CheckSpace(dst.Path, size); err != nil {
+			return nil, err
+		}
+	}
+
+	u := &uploader{v: v, local: local, root: dst.Path, opts: opts, result: &UploadResult{}}
+	if u.opts.LinkFrom == "" {
+		if u.opts.LinkFrom, err = filepath.Abs(local); err != nil {
+			return nil, err
+		}
+		u.opts.LinkFrom = filepath.ToSlash(u.opts.LinkFrom)
+	}
+	if u.opts.LinkTo == "" {
+		u.opts.LinkTo = dst.Path
+	}
+	u.foldCase = v.pathConf(fh).CaseInsensitive
+	if opts.Owner == OwnerCredentials {
+		hostname, _ := os.Hostname()
+		u.creds = &ownerCreds{
+			prev:    v.creds,
+			machine: hostname,
+			byEntry: make(map[string]rpc.Auth),
+			byFH:    make(map[string]rpc.Auth),
+		}
+		v.SetCredentialProvider(u.creds)
+		defer v.SetCredentialProvider(u.creds.prev)
+	}
+
+	if opts.DirFanout > 0 {
+		if err = u.fanout(local, fh); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Pack != nil {
+		if u.pack, err = newPacker(v, dst.Path, *opts.Pack); err != nil {
+			return nil, err
+		}
+	}
+	if err = u.dir(local, fh, ""); err != nil {
+		return nil, err
+	}
+	if u.pack != nil {
+		if err = u.pack.close(); err != nil {
+			return nil, err
+		}
+	}
+
+	return u.result, nil
+}
+
+// localSize sums the sizes of the regular files under local, what UploadTree
+// writes of it
+func localSize(local string) (uint64, error) {
+	var size uint64
+	err := filepath.WalkDir(local, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += uint64(fi.Size())
+
+		return nil
+	})
+
+	return size, err
+}
+
+type uploader struct {
+	v      *Target
+	local  string
+	root   string
+	opts   UploadOptions
+	creds  *ownerCreds
+	result *UploadResult
+
+	// whether the destination is case insensitive
+	foldCase bool
+
+	// the directories made ahead of the walk, by path, see DirFanout
+	made map[string]madeDir
+
+	pack *packer
+}
+
+// owner is the ownership of a local entry, when it is to be carried over
+type owner struct {
+	uid, gid uint32
+}
+
+func (u *uploader) owner(fi os.FileInfo) *owner {
+	if u.opts.Owner == OwnerNone {
+		return nil
+	}
+
+	uid, gid, ok := localOwner(fi)
+	if !ok {
+		return nil
+	}
+
+	return &owner{uid, gid}
+}
+
+// dir uploads the entries of local directory local into directory fh, at
+// rel within the tree
+func (u *uploader) dir(local string, fh []byte, rel string) error {
+	entries, err := os.ReadDir(local)
+	if err != nil {
+		return err
+	}
+
+	if u.foldCase {
+		names := make([]string, len(entries))
+		for i, e := range entries {
+			names[i] = e.Name()
+		}
+		for _, group := range CaseCollisions(names) {
+			for i := range group {
+				group[i] = _path.Join(rel, group[i])
+			}
+			util.Errorf("upload: %v differ only by case, the destination is case insensitive", group)
+			u.result.Collisions = append(u.result.Collisions, group)
+		}
+	}
+
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			return err
+		}
+
+		path := _path.Join(rel, e.Name())
+		lpath := filepath.Join(local, e.Name())
+		switch {
+		case fi.IsDir():
+			err = u.uploadDir(lpath, fh, path, fi)
+		case fi.Mode().IsRegular():
+			err = u.uploadFile(lpath, fh, path, fi)
+		case fi.Mode()&os.ModeSymlink != 0 && u.opts.Symlinks != SymlinkSkip:
+			err = u.uploadLink(lpath, fh, path)
+		default:
+			u.result.Skipped = append(u.result.Skipped, path)
+		}
+		if err != nil {
+			return fmt.Errorf("upload %s: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+func (u *uploader) uploadDir(local string, parent []byte, path string, fi os.FileInfo) error {
+	own := u.owner(fi)
+	var err error
+	made, ok := u.made[path]
+	if !ok {
+		made.fh, made.asOwner, err = u.create(parent, _path.Base(path), own, func() ([]byte, error) {
+			return u.v.MkdirByParentFh(parent, _path.Base(path), fi.Mode())
+		})
+		if err != nil {
+			return err
+		}
+	}
+	fh, asOwner := made.fh, made.asOwner
+	u.result.Dirs++
+
+	if err = u.dir(local, fh, path); err != nil {
+		return err
+	}
+
+	// last, so that writing the entries does not move the mtime
+	return u.finish(fh, path, fi, nil, own, asOwner)
+}
+
+func (u *uploader) uploadFile(local string, parent []byte, path string, fi os.FileInfo) error {
+	if u.pack != nil && fi.Size() < u.opts.Pack.Below {
+		if err := u.pack.add(local, path, fi); err != nil {
+			return err
+		}
+		u.result.Packed++
+		u.result.PackedBytes += uint64(fi.Size())
+		return nil
+	}
+
+	var sum ContentSum
+	if u.opts.Dedup != nil {
+		var err error
+		if sum, err = hashLocal(local); err != nil {
+			return err
+		}
+		if linked, err := u.link(sum, parent, path, fi); linked || err != nil {
+			return err
+		}
+	}
+
+	own := u.owner(fi)
+	fh, asOwner, err := u.create(parent, _path.Base(path), own, func() ([]byte, error) {
+		return u.v.CreateByFh(parent, _path.Base(path), fi.Mode())
+	})
+	if err != nil {
+		return err
+	}
+
+	lf, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+
+	f, err := u.v.OpenByFh(fh, nil)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, lf)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if IsNoSpaceError(err) {
+		return u.partial(parent, path, uint64(n), uint64(fi.Size()), err)
+	}
+	if err != nil {
+		return err
+	}
+	u.result.Files++
+	u.result.Bytes += uint64(n)
+
+	// an existing file longer than the local one is cut to size
+	size := uint64(n)
+	if err = u.finish(fh, path, fi, &size, own, asOwner); err != nil || u.opts.Dedup == nil {
+		return err
+	}
+
+	if err = u.opts.Dedup.Add(sum, _path.Join(u.root, path)); err != nil {
+		util.Errorf("upload %s: adding content %s: %s", path, sum, err)
+	}
+
+	return nil
+}
+
+// uploadLink makes a link like local link local, or uploads what it points
+// to, as the policy says
+func (u *uploader) uploadLink(local string, parent []byte, path string) error {
+	if u.opts.Symlinks == SymlinkFollow {
+		return u.follow(local, parent, path)
+	}
+
+	target, err := os.Readlink(local)
+	if err != nil {
+		return err
+	}
+	target = filepath.ToSlash(target)
+	if u.opts.Symlinks == SymlinkRewrite {
+		target = rewriteLink(target, u.opts.LinkFrom, u.opts.LinkTo)
+	}
+
+	name := _path.Base(path)
+	_, err = u.v.SymlinkByFh(parent, name, target)
+	if errors.Is(err, os.ErrExist) {
+		if err = u.v.remove(parent, name); err != nil {
+			return err
+		}
+		_, err = u.v.SymlinkByFh(parent, name, target)
+	}
+	if err == nil {
+		u.result.Links++
+	}
+
+	return err
+}
+
+// follow uploads what local link local points to, unless it dangles or
+// points to a directory it is within
+func (u *uploader) follow(local string, parent []byte, path string) error {
+	fi, err := os.Stat(local)
+	if err != nil {
+		util.Debugf("upload %s: not following: %s", path, err)
+		u.result.Skipped = append(u.result.Skipped, path)
+		return nil
+	}
+
+	switch {
+	case fi.Mode().IsRegular():
+		return u.uploadFile(local, parent, path, fi)
+	case fi.IsDir():
+		real, err := filepath.EvalSymlinks(local)
+		if err != nil {
+			return err
+		}
+		for dir := filepath.Dir(local); ; dir = filepath.Dir(dir) {
+			if r, err := filepath.EvalSymlinks(dir); err == nil && r == real {
+				util.Debugf("upload %s: not following a loop to %s", path, real)
+				u.result.Skipped = append(u.result.Skipped, path)
+				return nil
+			}
+			if dir == u.local || dir == filepath.Dir(dir) {
+				break
+			}
+		}
+		return u.uploadDir(local, parent, path, fi)
+	default:
+		u.result.Skipped = append(u.result.Skipped, path)
+		return nil
+	}
+}
+
+// partial returns the error of file path of directory parent, of which the
+// space ran out after written bytes of size, after removing it if asked
+func (u *uploader) partial(parent []byte, path string, written, size uint64, err error) error {
+	perr := &PartialFileError{Path: path, Written: written, Size: size, Err: err}
+	if !u.opts.RemovePartial {
+		return perr
+	}
+
+	if rerr := u.v.remove(parent, _path.Base(path)); rerr != nil {
+		util.Errorf("upload %s: removing the partial file: %s", path, rerr)
+	} else {
+		perr.Removed = true
+	}
+
+	return perr
+}
+
+// create makes an entry of directory parent with mk, as its owner if asked
+// and allowed.  An entry that exists already is reused.
+func (u *uploader) create(parent []byte, name string, own *owner, mk func() ([]byte, error)) ([]byte, bool, error) {
+	asOwner := u.creds != nil && own != nil
+	if asOwner {
+		u.creds.setEntry(parent, name, own)
+	}
+
+	fh, err := mk()
+	if asOwner {
+		u.creds.clearEntry(parent, name)
+		if errors.Is(err, os.ErrPermission) {
+			// the owner may not write here, create it as ourselves
+			asOwner = false
+			fh, err = mk()
+		}
+	}
+
+	if errors.Is(err, os.ErrExist) {
+		_, fh, _, err = u.v.lookup(context.Background(), parent, name)
+		asOwner = false
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if asOwner {
+		u.creds.setHandle(fh, own)
+	}
+
+	return fh, asOwner, nil
+}
+
+// finish sets the permissions, mtime, size if any and ownership of entry
+// fh, and records the ownership it could not set
+func (u *uploader) finish(fh []byte, path string, fi os.FileInfo, size *uint64, own *owner, asOwner bool) error {
+	if asOwner {
+		defer u.creds.clearHandle(fh)
+	}
+
+	sattr := Sattr3{
+		Mode:  SetMode{SetIt: true, Mode: uint32(fi.Mode().Perm())},
+		Mtime: SetTimeTo(fi.ModTime()),
+	}
+	if size != nil {
+		sattr.Size = SetSize{SetIt: true, Size: *size}
+	}
+
+	chown := own != nil && !asOwner
+	if chown {
+		sattr.UID = SetUID{SetIt: true, UID: own.uid}
+		sattr.GID = SetUID{SetIt: true, UID: own.gid}
+	}
+
+	err := u.v.SetAttrByFh(fh, sattr)
+	if chown && errors.Is(err, os.ErrPermission) {
+		util.Debugf("upload %s: owner %d:%d refused", path, own.uid, own.gid)
+		sattr.UID, sattr.GID = SetUID{}, SetUID{}
+		err = u.v.SetAttrByFh(fh, sattr)
+	}
+	if err != nil || own == nil {
+		return err
+	}
+
+	// servers that squash may succeed without applying the owner
+	attr, err := u.v.GetAttrByFh(fh)
+	if err != nil {
+		return err
+	}
+	if attr.UID != own.uid || attr.GID != own.gid {
+		u.result.Unowned = append(u.result.Unowned, OwnerRecord{Path: path, UID: own.uid, GID: own.gid})
+	}
+
+	return nil
+}
+
+// ownerCreds is the CredentialProvider of an upload with OwnerCredentials:
+// calls creating an entry, and calls on entries created so, carry the
+// credential of the entry's owner.  Other calls go to the provider set
+// before, or use the mount credential.
+type ownerCreds struct {
+	prev    CredentialProvider
+	machine string
+
+	sync.Mutex
+	byEntry map[string]rpc.Auth
+	byFH    map[string]rpc.Auth
+}
+
+func entryKey(dir []byte, name string) string {
+	return string(dir) + "\x00" + name
+}
+
+func (c *ownerCreds) auth(own *owner) rpc.Auth {
+	return rpc.NewAuthUnix(c.machine, own.uid, own.gid).Auth()
+}
+
+func (c *ownerCreds) setEntry(dir []byte, name string, own *owner) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.byEntry[entryKey(dir, name)] = c.auth(own)
+}
+
+func (c *ownerCreds) clearEntry(dir []byte, name string) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.byEntry, entryKey(dir, name))
+}
+
+func (c *ownerCreds) setHandle(fh []byte, own *owner) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.byFH[string(fh)] = c.auth(own)
+}
+
+func (c *ownerCreds) clearHandle(fh []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.byFH, string(fh))
+}
+
+func (c *ownerCreds) Credential(req *CredentialRequest) (rpc.Auth, error) {
+	c.Lock()
+	var auth rpc.Auth
+	var ok bool
+	if req.Name != "" {
+		// a call in a directory is about the entry, not the directory
+		auth, ok = c.byEntry[entryKey(req.FH, req.Name)]
+	} else {
+		auth, ok = c.byFH[string(req.FH)]
+	}
+	c.Unlock()
+
+	switch {
+	case ok:
+		return auth, nil
+	case c.prev != nil:
+		return c.prev.Credential(req)
+	default:
+		return req.Default, nil
+	}
+}
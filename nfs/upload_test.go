@@ -0,0 +1,237 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+	"github.com/go-nfs/nfsv3/nfs/xdr"
+)
+
+// squashFS refuses to change ownership while squash is set, as servers that
+// squash root do
+type squashFS struct {
+	*MemFS
+	squash bool
+}
+
+func (fs *squashFS) SetAttr(fh []byte, attr Sattr3) error {
+	if fs.squash && (attr.UID.SetIt || attr.GID.SetIt) {
+		return os.ErrPermission
+	}
+
+	return fs.MemFS.SetAttr(fh, attr)
+}
+
+// ownedTree writes a local tree owned by uid 1234, which takes root
+func ownedTree(t *testing.T) string {
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner of files takes root")
+	}
+
+	dir := t.TempDir()
+	for path, data := range map[string]string{"a": "alpha", "sub/b": "bravo"} {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"a", "sub", "sub/b"} {
+		if err := os.Chown(filepath.Join(dir, path), 1234, 1234); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestUploadSquashed(t *testing.T) {
+	local := ownedTree(t)
+
+	fs := &squashFS{MemFS: NewMemFS(), squash: true}
+	v, err := DialLoopback(NewServer(fs)).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	res, err := UploadTree(local, &TreeRef{v, "/"}, UploadOptions{Owner: OwnerSetAttr})
+	if err != nil {
+		t.Fatalf("upload: %s", err)
+	}
+	if res.Files != 2 || res.Dirs != 1 || res.Bytes != 10 {
+		t.Errorf("result: %+v", res)
+	}
+
+	f, err := v.Open("/sub/b")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "bravo" {
+		t.Errorf("uploaded data: %q", data)
+	}
+	attr, _, _ := v.GetAttr("/sub/b")
+	if attr.FileMode&0777 != 0640 {
+		t.Errorf("mode: %o", attr.FileMode)
+	}
+
+	if len(res.Unowned) != 3 {
+		t.Fatalf("unowned: got %v, want the 3 entries", res.Unowned)
+	}
+
+	// a privileged pass, later
+	fs.squash = false
+	left, err := FixOwners(&TreeRef{v, "/"}, res.Unowned)
+	if err != nil || len(left) != 0 {
+		t.Fatalf("fix owners: %v, %v", left, err)
+	}
+	if attr, _, _ = v.GetAttr("/sub"); attr.UID != 1234 || attr.GID != 1234 {
+		t.Errorf("owner after fix: %d:%d", attr.UID, attr.GID)
+	}
+}
+
+func TestUploadCredentials(t *testing.T) {
+	local := ownedTree(t)
+
+	// note the uid of every CREATE and MKDIR reaching the server
+	s := NewServer(NewMemFS())
+	var mu sync.Mutex
+	var uids []uint32
+	s.Register(Nfs3Prog, Nfs3Vers, func(call *rpc.ServerCall, w io.Writer) error {
+		if call.Proc == NFSProc3Create || call.Proc == NFSProc3Mkdir {
+			if au, err := rpc.ParseAuthUnix(call.Cred); err == nil {
+				mu.Lock()
+				uids = append(uids, au.Uid)
+				mu.Unlock()
+			}
+		}
+		return s.serveNFS(call, w)
+	})
+
+	v, err := DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	if _, err = UploadTree(local, &TreeRef{v, "/"}, UploadOptions{Owner: OwnerCredentials}); err != nil {
+		t.Fatalf("upload: %s", err)
+	}
+
+	if len(uids) != 3 {
+		t.Fatalf("creates: got %v, want 3 as uid 1234", uids)
+	}
+	for _, uid := range uids {
+		if uid != 1234 {
+			t.Errorf("created as uid %d, want 1234", uid)
+		}
+	}
+	if v.creds != nil {
+		t.Errorf("credential provider left installed")
+	}
+}
+
+func TestUploadPreflight(t *testing.T) {
+	local := t.TempDir()
+	if err := os.WriteFile(filepath.Join(local, "big"), make([]byte, 10000), 0644); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+
+	// rquotad leaves uid 1000 four 1k blocks
+	s := NewServer(NewMemFS())
+	s.Register(RquotaProg, RquotaVers, func(call *rpc.ServerCall, w io.Writer) error {
+		var args struct {
+			Path string
+			UID  uint32
+		}
+		if err := xdr.Read(call.Args, &args); err != nil {
+			return rpc.ErrGarbageArgs
+		}
+		if args.UID != 1000 {
+			return xdr.Write(w, uint32(rquotaNoQuota))
+		}
+		return xdr.Write(w, &struct {
+			Status uint32
+			Quota  Quota
+		}{rquotaOK, Quota{BSize: 1024, Active: true, BHardLimit: 100, CurBlocks: 96}})
+	})
+
+	v, err := DialLoopback(s).Mount("/", rpc.NewAuthUnix("host", 1000, 1000).Auth())
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	_, err = UploadTree(local, &TreeRef{v, "/"}, UploadOptions{Preflight: true})
+	var spaceErr *InsufficientSpaceError
+	if !errors.As(err, &spaceErr) || !spaceErr.Quota || spaceErr.Required != 10000 || spaceErr.Available != 4096 {
+		t.Fatalf("upload over quota: %v", err)
+	}
+	var nfsErr *Error
+	if !errors.As(err, &nfsErr) || nfsErr.ErrorNum != NFS3ErrDQuot {
+		t.Errorf("%v does not wrap NFS3ERR_DQUOT", err)
+	}
+	if _, _, err := v.Lookup("/big"); !os.IsNotExist(err) {
+		t.Errorf("preflight failure wrote anyway: %v", err)
+	}
+
+	// uid 0 has no quota, only the free space counts
+	v.auth = rpc.NewAuthUnix("host", 0, 0).Auth()
+	if _, err = UploadTree(local, &TreeRef{v, "/"}, UploadOptions{Preflight: true}); err != nil {
+		t.Fatalf("upload without quota: %s", err)
+	}
+}
+
+// fullFS runs out of space once it holds limit bytes written
+type fullFS struct {
+	*MemFS
+	limit, used int
+}
+
+func (fs *fullFS) Write(fh []byte, offset uint64, data []byte) (int, error) {
+	if fs.used+len(data) > fs.limit {
+		return 0, NFS3Error(NFS3ErrNoSpc)
+	}
+	fs.used += len(data)
+
+	return fs.MemFS.Write(fh, offset, data)
+}
+
+func TestUploadRemovePartial(t *testing.T) {
+	local := t.TempDir()
+	if err := os.WriteFile(filepath.Join(local, "big"), make([]byte, 100000), 0644); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+
+	s := NewServer(&fullFS{MemFS: NewMemFS(), limit: 40000})
+	s.SetProfile(Profiles["32k-wtmax"])
+	v, err := DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	_, err = UploadTree(local, &TreeRef{v, "/"}, UploadOptions{RemovePartial: true})
+	var perr *PartialFileError
+	if !errors.As(err, &perr) || perr.Written != 32<<10 || perr.Size != 100000 || !perr.Removed {
+		t.Fatalf("upload to a full filesystem: %v", err)
+	}
+	if !IsNoSpaceError(err) {
+		t.Errorf("%v does not wrap NFS3ERR_NOSPC", err)
+	}
+	if _, _, err := v.Lookup("/big"); !os.IsNotExist(err) {
+		t.Errorf("partial file left: %v", err)
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	_path "path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Kinds of Mismatch found by Verify
+const (
+	MismatchMissingLocal  = "missing_local"
+	MismatchMissingRemote = "missing_remote"
+	MismatchType          = "type"
+	MismatchSize          = "size"
+	MismatchMode          = "mode"
+	MismatchMtime         = "mtime"
+	MismatchChecksum      = "checksum"
+)
+
+// VerifyOptions tune what Verify compares
+type VerifyOptions struct {
+	// Checksum compares the data of regular files by SHA-256, reading
+	// every file on both sides
+	Checksum bool
+
+	// IgnoreMode and IgnoreMtime skip comparing permissions and times.
+	// Permissions are never compared on Windows, which has none to speak of.
+	IgnoreMode  bool
+	IgnoreMtime bool
+
+	// MtimeTolerance is how far apart modification times may be, for local
+	// filesystems with a coarser resolution than the server's
+	MtimeTolerance time.Duration
+}
+
+// Mismatch is a difference found by Verify
+type Mismatch struct {
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	Local  string `json:"local,omitempty"`
+	Remote string `json:"remote,omitempty"`
+}
+
+// VerifyReport is the outcome of Verify, meant to be kept as proof of a
+// restore, see WriteJSON
+type VerifyReport struct {
+	Local      string     `json:"local"`
+	Remote     string     `json:"remote"`
+	Started    time.Time  `json:"started"`
+	Finished   time.Time  `json:"finished"`
+	Files      int        `json:"files"`
+	Dirs       int        `json:"dirs"`
+	Bytes      uint64     `json:"bytes"`
+	Mismatches []Mismatch `json:"mismatches"`
+}
+
+// OK reports whether the trees matched
+func (r *VerifyReport) OK() bool {
+	return len(r.Mismatches) == 0
+}
+
+// WriteJSON writes the report to w as indented JSON
+func (r *VerifyReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// Verify compares the local directory local to the remote tree, entry by
+// entry, for existence, type, size, permissions, modification time and, if
+// asked, content.  Differences are reported in the returned report, an error
+// is only returned if the trees could not be walked.
+func Verify(local string, remote *TreeRef, opts VerifyOptions) (*VerifyReport, error) {
+	r := &VerifyReport{Local: local, Remote: remote.Path, Started: time.Now()}
+
+	_, fh, err := remote.Target.Lookup(remote.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	vf := &verifier{v: remote.Target, opts: opts, report: r}
+	if err = vf.verifyDir(local, fh, ""); err != nil {
+		return nil, err
+	}
+
+	r.Finished = time.Now()
+	return r, nil
+}
+
+type verifier struct {
+	v      *Target
+	opts   VerifyOptions
+	report *VerifyReport
+}
+
+func (vf *verifier) mismatch(path, kind string, local, remote interface{}) {
+	m := Mismatch{Path: path, Kind: kind}
+	if local != nil {
+		m.Local = fmt.Sprint(local)
+	}
+	if remote != nil {
+		m.Remote = fmt.Sprint(remote)
+	}
+	vf.report.Mismatches = append(vf.report.Mismatches, m)
+}
+
+func (vf *verifier) verifyDir(local string, fh []byte, rel string) error {
+	vf.report.Dirs++
+
+	infos, err := ioutil.ReadDir(local)
+	if err != nil {
+		return err
+	}
+	localEntries := make(map[string]os.FileInfo, len(infos))
+	for _, fi := range infos {
+		localEntries[fi.Name()] = fi
+	}
+
+	remoteEntries, err := listDiffEntries(vf.v, fh)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(localEntries)+len(remoteEntries))
+	for name := range localEntries {
+		names = append(names, name)
+	}
+	for name := range remoteEntries {
+		if _, ok := localEntries[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := _path.Join(rel, name)
+		fi, inLocal := localEntries[name]
+		re, inRemote := remoteEntries[name]
+
+		switch {
+		case !inLocal:
+			vf.mismatch(path, MismatchMissingLocal, nil, fileType(re.attr.Type))
+			continue
+		case !inRemote:
+			vf.mismatch(path, MismatchMissingRemote, localType(fi), nil)
+			continue
+		}
+
+		lt, rt := localType(fi), fileType(re.attr.Type)
+		if lt != rt {
+			vf.mismatch(path, MismatchType, lt, rt)
+			continue
+		}
+
+		if err = vf.verifyEntry(filepath.Join(local, name), fi, &re, path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (vf *verifier) verifyEntry(local string, fi os.FileInfo, re *diffEntry, path string) error {
+	if !vf.opts.IgnoreMode && localPermissions && fi.Mode().Perm() != os.FileMode(re.attr.FileMode).Perm() && fi.Mode()&os.ModeSymlink == 0 {
+		vf.mismatch(path, MismatchMode, fi.Mode().Perm(), os.FileMode(re.attr.FileMode).Perm())
+	}
+
+	if fi.IsDir() {
+		return vf.verifyDir(local, re.fh, path)
+	}
+
+	if !vf.opts.IgnoreMtime && fi.Mode().IsRegular() {
+		d := fi.ModTime().Sub(re.attr.ModTime())
+		if d < 0 {
+			d = -d
+		}
+		if d > vf.opts.MtimeTolerance {
+			vf.mismatch(path, MismatchMtime, fi.ModTime().UTC().Format(time.RFC3339Nano), re.attr.ModTime().UTC().Format(time.RFC3339Nano))
+		}
+	}
+
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	vf.report.Files++
+	vf.report.Bytes += re.attr.Filesize
+	if uint64(fi.Size()) != re.attr.Filesize {
+		vf.mismatch(path, MismatchSize, fi.Size(), re.attr.Filesize)
+		return nil
+	}
+
+	if vf.opts.Checksum {
+		lsum, err := hashLocalFile(local)
+		if err != nil {
+			return err
+		}
+		rsum, err := hashFile(vf.v, re)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(lsum, rsum) {
+			vf.mismatch(path, MismatchChecksum, fmt.Sprintf("%x", lsum), fmt.Sprintf("%x", rsum))
+		}
+	}
+
+	return nil
+}
+
+func hashLocalFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// localType and fileType name the type of an entry on either side
+func localType(fi os.FileInfo) string {
+	switch m := fi.Mode(); {
+	case m.IsRegular():
+		return "file"
+	case m.IsDir():
+		return "dir"
+	case m&os.ModeSymlink != 0:
+		return "symlink"
+	default:
+		return "special"
+	}
+}
+
+func fileType(t uint32) string {
+	switch t {
+	case NF3Reg:
+		return "file"
+	case NF3Dir:
+		return "dir"
+	case NF3Lnk:
+		return "symlink"
+	default:
+		return "special"
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	v := loopbackTarget(t)
+	defer v.Close()
+
+	if _, err := v.Mkdir("/tree", 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	writeFile(t, v, "/tree/a", "alpha")
+	writeFile(t, v, "/tree/b", "bravo")
+
+	// restore it locally, times and modes included
+	local, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(local)
+	for name, data := range map[string]string{"a": "alpha", "b": "bravo"} {
+		attr, _, err := v.GetAttr("/tree/" + name)
+		if err != nil {
+			t.Fatalf("getattr: %s", err)
+		}
+		path := filepath.Join(local, name)
+		if err = ioutil.WriteFile(path, []byte(data), attr.Mode().Perm()); err != nil {
+			t.Fatal(err)
+		}
+		os.Chmod(path, attr.Mode().Perm())
+		os.Chtimes(path, attr.ModTime(), attr.ModTime())
+	}
+
+	opts := VerifyOptions{Checksum: true, IgnoreMode: true}
+	r, err := Verify(local, &TreeRef{v, "/tree"}, opts)
+	if err != nil {
+		t.Fatalf("verify: %s", err)
+	}
+	if !r.OK() || r.Files != 2 || r.Bytes != 10 {
+		t.Fatalf("expected a match, got %+v", r)
+	}
+
+	// same size and time, different data, and a file left out
+	ioutil.WriteFile(filepath.Join(local, "a"), []byte("ALPHA"), 0644)
+	attr, _, _ := v.GetAttr("/tree/a")
+	os.Chtimes(filepath.Join(local, "a"), attr.ModTime(), attr.ModTime())
+	os.Remove(filepath.Join(local, "b"))
+
+	if r, err = Verify(local, &TreeRef{v, "/tree"}, opts); err != nil {
+		t.Fatalf("verify: %s", err)
+	}
+	if len(r.Mismatches) != 2 || r.Mismatches[0].Kind != MismatchChecksum || r.Mismatches[1].Kind != MismatchMissingLocal {
+		t.Fatalf("unexpected mismatches %+v", r.Mismatches)
+	}
+
+	buf := new(bytes.Buffer)
+	if err = r.WriteJSON(buf); err != nil {
+		t.Fatal(err)
+	}
+	var back VerifyReport
+	if err = json.Unmarshal(buf.Bytes(), &back); err != nil || len(back.Mismatches) != 2 {
+		t.Fatalf("report did not round trip: %v", err)
+	}
+}
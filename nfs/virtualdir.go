@@ -0,0 +1,329 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	_path "path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VirtualDir is a read-only namespace made of several trees, of one or more
+// exports, each mounted at a path of it as a mount table would, without a
+// kernel.  A path goes to the mount with the longest prefix of it, and the
+// directories leading to mount points are made up.  It implements fs.FS,
+// fs.StatFS and fs.ReadDirFS, so gateways can serve several exports as one
+// tree.
+type VirtualDir struct {
+	mu     sync.Mutex
+	mounts map[string]*virtualMount
+}
+
+type virtualMount struct {
+	mu   sync.Mutex
+	tree *TreeRef
+	open func() (*TreeRef, error)
+}
+
+// NewVirtualDir returns a VirtualDir with nothing mounted
+func NewVirtualDir() *VirtualDir {
+	return &VirtualDir{mounts: make(map[string]*virtualMount)}
+}
+
+// virtualPath returns p, slash separated and maybe absolute, as an fs path
+func virtualPath(p string) string {
+	p = strings.TrimPrefix(_path.Clean("/"+p), "/")
+	if p == "" {
+		return "."
+	}
+
+	return p
+}
+
+// Mount mounts tree at path at, which must not be a mount point already
+func (d *VirtualDir) Mount(at string, tree *TreeRef) error {
+	return d.mount(at, &virtualMount{tree: tree})
+}
+
+// MountLazy mounts at path at the tree open returns, open being called the
+// first time a path below is used, so that exports are only mounted once
+// needed, which includes listing the directory it is in.  An error of open is
+// returned for that path, and open called again next time.
+func (d *VirtualDir) MountLazy(at string, open func() (*TreeRef, error)) error {
+	return d.mount(at, &virtualMount{open: open})
+}
+
+func (d *VirtualDir) mount(at string, m *virtualMount) error {
+	at = virtualPath(at)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.mounts[at]; ok {
+		return fmt.Errorf("mount %s: %w", at, os.ErrExist)
+	}
+	d.mounts[at] = m
+
+	return nil
+}
+
+// Unmount removes the mount at path at
+func (d *VirtualDir) Unmount(at string) error {
+	at = virtualPath(at)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.mounts[at]; !ok {
+		return fmt.Errorf("unmount %s: %w", at, os.ErrNotExist)
+	}
+	delete(d.mounts, at)
+
+	return nil
+}
+
+// Resolve returns the target name goes to and the path on it, mounting it if
+// it is mounted lazily
+func (d *VirtualDir) Resolve(name string) (*Target, string, error) {
+	name = virtualPath(name)
+	at, m := d.route(name)
+	if m == nil {
+		return nil, "", &fs.PathError{Op: "resolve", Path: name, Err: fs.ErrNotExist}
+	}
+
+	tree, err := m.get()
+	if err != nil {
+		return nil, "", &fs.PathError{Op: "mount", Path: at, Err: err}
+	}
+
+	rel := name
+	if at != "." {
+		rel = strings.TrimPrefix(name[len(at):], "/")
+	}
+
+	return tree.Target, _path.Join(tree.Path, rel), nil
+}
+
+// route returns the mount with the longest prefix of name, and where it is
+func (d *VirtualDir) route(name string) (string, *virtualMount) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for p := name; ; p = _path.Dir(p) {
+		if m, ok := d.mounts[p]; ok {
+			return p, m
+		}
+		if p == "." {
+			return "", nil
+		}
+	}
+}
+
+// below returns the names of the directories leading to mount points right
+// below directory name
+func (d *VirtualDir) below(name string) map[string]bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	names := make(map[string]bool)
+	for at := range d.mounts {
+		rel := at
+		if name != "." {
+			if !strings.HasPrefix(at, name+"/") {
+				continue
+			}
+			rel = at[len(name)+1:]
+		} else if at == "." {
+			continue
+		}
+		names[strings.SplitN(rel, "/", 2)[0]] = true
+	}
+
+	return names
+}
+
+func (m *virtualMount) get() (*TreeRef, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.tree == nil {
+		tree, err := m.open()
+		if err != nil {
+			return nil, err
+		}
+		m.tree = tree
+	}
+
+	return m.tree, nil
+}
+
+func (d *VirtualDir) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	v, path, err := d.Resolve(name)
+	if err == nil {
+		var info fs.FileInfo
+		if info, err = fs.Stat(v.FS(), virtualPath(path)); err == nil {
+			return &virtualInfo{FileInfo: info, name: _path.Base(name)}, nil
+		}
+	}
+
+	// directories leading to mount points are there whatever is mounted
+	// above them
+	if name == "." || len(d.below(name)) > 0 {
+		return &virtualInfo{name: _path.Base(name)}, nil
+	}
+
+	return nil, err
+}
+
+func (d *VirtualDir) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	below := d.below(name)
+
+	var entries []fs.DirEntry
+	v, path, err := d.Resolve(name)
+	if err == nil {
+		entries, err = fs.ReadDir(v.FS(), virtualPath(path))
+	}
+	if err != nil && (len(below) == 0 || !errors.Is(err, fs.ErrNotExist)) {
+		return nil, err
+	}
+
+	merged := entries[:0]
+	for _, e := range entries {
+		if !below[e.Name()] {
+			merged = append(merged, e)
+		}
+	}
+	for n := range below {
+		info, err := d.Stat(_path.Join(name, n))
+		if err != nil {
+			return nil, err
+		}
+		merged = append(merged, info.(*virtualInfo))
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Name() < merged[j].Name() })
+
+	return merged, nil
+}
+
+func (d *VirtualDir) Open(name string) (fs.File, error) {
+	info, err := d.Stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if info.IsDir() {
+		return &virtualDirFile{d: d, name: name, info: info}, nil
+	}
+
+	v, path, err := d.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.FS().Open(virtualPath(path))
+}
+
+// virtualInfo is an entry of a VirtualDir, named as it is there.  Without
+// FileInfo it is a directory leading to a mount point.
+type virtualInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (fi *virtualInfo) Name() string { return fi.name }
+
+func (fi *virtualInfo) Size() int64 {
+	if fi.FileInfo == nil {
+		return 0
+	}
+	return fi.FileInfo.Size()
+}
+
+func (fi *virtualInfo) Mode() fs.FileMode {
+	if fi.FileInfo == nil {
+		return fs.ModeDir | 0555
+	}
+	return fi.FileInfo.Mode()
+}
+
+func (fi *virtualInfo) ModTime() time.Time {
+	if fi.FileInfo == nil {
+		return time.Time{}
+	}
+	return fi.FileInfo.ModTime()
+}
+
+func (fi *virtualInfo) IsDir() bool                { return fi.Mode().IsDir() }
+func (fi *virtualInfo) Type() fs.FileMode          { return fi.Mode().Type() }
+func (fi *virtualInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+func (fi *virtualInfo) Sys() interface{} {
+	if fi.FileInfo == nil {
+		return nil
+	}
+	return fi.FileInfo.Sys()
+}
+
+// virtualDirFile is a directory of a VirtualDir, listed on the first ReadDir
+type virtualDirFile struct {
+	d    *VirtualDir
+	name string
+	info fs.FileInfo
+
+	entries []fs.DirEntry
+	listed  bool
+}
+
+func (f *virtualDirFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *virtualDirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+}
+
+func (f *virtualDirFile) Close() error {
+	return nil
+}
+
+func (f *virtualDirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.listed {
+		entries, err := f.d.ReadDir(f.name)
+		if err != nil {
+			return nil, err
+		}
+		f.entries, f.listed = entries, true
+	}
+
+	if n <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	if n > len(f.entries) {
+		n = len(f.entries)
+	}
+	entries := f.entries[:n:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,67 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestVirtualDir(t *testing.T) {
+	home, projects := loopbackTarget(t), loopbackTarget(t)
+
+	if _, err := home.Mkdir("/alice", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, home, "/alice/notes", "home")
+	writeFile(t, home, "/readme", "root")
+	if _, err := projects.Mkdir("/nfs", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, projects, "/nfs/main.go", "package main")
+
+	opened := 0
+	d := NewVirtualDir()
+	if err := d.Mount("/", &TreeRef{Target: home, Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.MountLazy("/src/go", func() (*TreeRef, error) {
+		opened++
+		return &TreeRef{Target: projects, Path: "/nfs"}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Mount("src/go", nil); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("mount over a mount point: %v", err)
+	}
+
+	if err := fstest.TestFS(d, "readme", "alice/notes", "src/go/main.go"); err != nil {
+		t.Fatal(err)
+	}
+	if opened != 1 {
+		t.Fatalf("lazy mount opened %d times", opened)
+	}
+
+	if data, err := fs.ReadFile(d, "src/go/main.go"); err != nil || string(data) != "package main" {
+		t.Fatalf("read src/go/main.go: %q, %v", data, err)
+	}
+
+	v, path, err := d.Resolve("/src/go/main.go")
+	if err != nil || v != projects || path != "/nfs/main.go" {
+		t.Fatalf("resolve: %v %q %v", v == projects, path, err)
+	}
+
+	if err := d.Unmount("/"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(d, "readme"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("stat readme after unmount: %v", err)
+	}
+	entries, err := fs.ReadDir(d, ".")
+	if err != nil || len(entries) != 1 || entries[0].Name() != "src" || !entries[0].IsDir() {
+		t.Fatalf("readdir of the made up root: %v, %v", entries, err)
+	}
+}
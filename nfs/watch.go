@@ -0,0 +1,363 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"fmt"
+	"os"
+	_path "path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WatchOp is the kind of change reported by a Watcher
+type WatchOp int
+
+const (
+	WatchCreate WatchOp = iota + 1
+	WatchRemove
+	WatchModify
+	WatchRename
+)
+
+func (op WatchOp) String() string {
+	switch op {
+	case WatchCreate:
+		return "CREATE"
+	case WatchRemove:
+		return "REMOVE"
+	case WatchModify:
+		return "MODIFY"
+	case WatchRename:
+		return "RENAME"
+	default:
+		return fmt.Sprintf("WatchOp(%d)", int(op))
+	}
+}
+
+// WatchEvent is a change seen by a Watcher
+type WatchEvent struct {
+	Op   WatchOp
+	Path string
+	// OldPath is the path the entry was renamed from, for WatchRename
+	OldPath string
+	// Attr are the attributes of the entry, nil for WatchRemove
+	Attr *Fattr
+}
+
+// watchEntry is what a Watcher remembers of a directory entry
+type watchEntry struct {
+	fileid       uint64
+	size         uint64
+	mtime, ctime NFS3Time
+	attr         *Fattr
+}
+
+type watchedPath struct {
+	fh      []byte
+	attr    *Fattr
+	entries map[string]watchEntry
+}
+
+// Watcher reports changes to watched paths.  NFSv3 has no change
+// notification, so it polls: the attributes of each watched path are fetched
+// every interval, and when a directory's mtime or ctime moved it is listed
+// again with READDIRPLUS and diffed against the previous listing.  An entry
+// that disappears and reappears under another name with the same fileid is
+// reported as renamed.
+//
+// Files modified in place do not touch their directory, see SetRelist to
+// catch those too.
+type Watcher struct {
+	// Events and Errors deliver what the watcher finds.  They must be
+	// drained, the watcher waits on them.
+	Events chan WatchEvent
+	Errors chan error
+
+	v        *Target
+	interval time.Duration
+
+	sync.Mutex
+	paths    map[string]*watchedPath
+	relist   bool
+	coalesce time.Duration
+
+	done chan struct{}
+	once sync.Once
+}
+
+// NewWatcher returns a watcher polling every interval, with nothing watched
+func (v *Target) NewWatcher(interval time.Duration) *Watcher {
+	w := &Watcher{
+		Events:   make(chan WatchEvent, 64),
+		Errors:   make(chan error, 1),
+		v:        v,
+		interval: interval,
+		paths:    make(map[string]*watchedPath),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+
+	return w
+}
+
+// SetRelist has watched directories listed on every poll rather than only
+// when their attributes change, so that files modified in place are reported
+// as WatchModify.  This costs a READDIRPLUS per directory per poll.
+func (w *Watcher) SetRelist(relist bool) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.relist = relist
+}
+
+// SetCoalesce has events held back for d and merged per path before they are
+// delivered, e.g. a file created and modified shows as a single WatchCreate,
+// one created and removed again not at all.  Zero delivers the events of
+// each poll as it completes.
+func (w *Watcher) SetCoalesce(d time.Duration) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.coalesce = d
+}
+
+// Add starts watching path, a directory or a file.  Changes are reported
+// relative to the state at the time of Add.
+func (w *Watcher) Add(path string) error {
+	path = _path.Clean("/" + path)
+	_, fh, err := w.v.Lookup(path)
+	if err != nil {
+		return err
+	}
+
+	p := &watchedPath{fh: fh}
+	if _, err = w.refresh(path, p, true); err != nil {
+		return err
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	w.paths[path] = p
+	return nil
+}
+
+// Remove stops watching path
+func (w *Watcher) Remove(path string) {
+	w.Lock()
+	defer w.Unlock()
+
+	delete(w.paths, _path.Clean("/"+path))
+}
+
+// Close stops the watcher
+func (w *Watcher) Close() error {
+	w.once.Do(func() { close(w.done) })
+	return nil
+}
+
+func (w *Watcher) run() {
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+
+	var pending []WatchEvent
+	lastFlush := time.Now()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-t.C:
+		}
+
+		pending = coalesceEvents(pending, w.poll())
+
+		w.Lock()
+		coalesce := w.coalesce
+		w.Unlock()
+
+		if len(pending) == 0 || time.Since(lastFlush) < coalesce {
+			continue
+		}
+
+		for _, ev := range pending {
+			select {
+			case w.Events <- ev:
+			case <-w.done:
+				return
+			}
+		}
+		pending = nil
+		lastFlush = time.Now()
+	}
+}
+
+// poll refreshes every watched path and returns the changes seen
+func (w *Watcher) poll() []WatchEvent {
+	w.Lock()
+	paths := make(map[string]*watchedPath, len(w.paths))
+	for path, p := range w.paths {
+		paths[path] = p
+	}
+	w.Unlock()
+
+	var events []WatchEvent
+	for path, p := range paths {
+		evs, err := w.refresh(path, p, false)
+		if err != nil {
+			if IsStaleError(err) || os.IsNotExist(err) {
+				events = append(events, WatchEvent{Op: WatchRemove, Path: path})
+				w.Remove(path)
+				continue
+			}
+
+			select {
+			case w.Errors <- fmt.Errorf("watch %s: %w", path, err):
+			case <-w.done:
+				return nil
+			}
+			continue
+		}
+
+		events = append(events, evs...)
+	}
+
+	return events
+}
+
+// refresh fetches the attributes of p, and its listing when needed, and
+// returns what changed.  initial only records the state.
+func (w *Watcher) refresh(path string, p *watchedPath, initial bool) ([]WatchEvent, error) {
+	attr, err := w.v.getAttr(p.fh)
+	if err != nil {
+		return nil, err
+	}
+
+	old := p.attr
+	p.attr = attr
+	changed := old == nil || old.Mtime != attr.Mtime || old.Ctime != attr.Ctime || old.Filesize != attr.Filesize
+
+	if attr.Type != NF3Dir {
+		if changed && !initial {
+			return []WatchEvent{{Op: WatchModify, Path: path, Attr: attr}}, nil
+		}
+		return nil, nil
+	}
+
+	w.Lock()
+	relist := w.relist
+	w.Unlock()
+
+	if !changed && !relist {
+		return nil, nil
+	}
+
+	list, err := w.v.ReadDirPlusByFh(p.fh)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]watchEntry, len(list))
+	for _, e := range list {
+		if e.FileName == "." || e.FileName == ".." {
+			continue
+		}
+
+		we := watchEntry{fileid: e.FileId}
+		if e.Attr.IsSet {
+			we.size = e.Attr.Attr.Filesize
+			we.mtime = e.Attr.Attr.Mtime
+			we.ctime = e.Attr.Attr.Ctime
+			we.attr = e.Attr.attr()
+		}
+		entries[e.FileName] = we
+	}
+
+	prev := p.entries
+	p.entries = entries
+	if initial {
+		return nil, nil
+	}
+
+	return diffEntries(path, prev, entries), nil
+}
+
+// diffEntries returns the changes between two listings of dir
+func diffEntries(dir string, prev, cur map[string]watchEntry) []WatchEvent {
+	var events []WatchEvent
+
+	// entries gone, by fileid, to pair them with new ones as renames
+	removed := make(map[uint64]string)
+	for name, e := range prev {
+		if _, ok := cur[name]; !ok {
+			removed[e.fileid] = name
+		}
+	}
+
+	names := make([]string, 0, len(cur))
+	for name := range cur {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		e := cur[name]
+		path := _path.Join(dir, name)
+
+		old, ok := prev[name]
+		switch {
+		case !ok:
+			if from, ok := removed[e.fileid]; ok {
+				delete(removed, e.fileid)
+				events = append(events, WatchEvent{Op: WatchRename, Path: path, OldPath: _path.Join(dir, from), Attr: e.attr})
+			} else {
+				events = append(events, WatchEvent{Op: WatchCreate, Path: path, Attr: e.attr})
+			}
+		case old.fileid != e.fileid:
+			// replaced by another object
+			events = append(events, WatchEvent{Op: WatchModify, Path: path, Attr: e.attr})
+		case old.size != e.size || old.mtime != e.mtime || old.ctime != e.ctime:
+			events = append(events, WatchEvent{Op: WatchModify, Path: path, Attr: e.attr})
+		}
+	}
+
+	for _, name := range removed {
+		events = append(events, WatchEvent{Op: WatchRemove, Path: _path.Join(dir, name)})
+	}
+
+	return events
+}
+
+// coalesceEvents merges events into pending, keeping a single event per path
+func coalesceEvents(pending, events []WatchEvent) []WatchEvent {
+	for _, ev := range events {
+		i := -1
+		for j := range pending {
+			if pending[j].Path == ev.Path && pending[j].Op != WatchRename {
+				i = j
+				break
+			}
+		}
+		if i < 0 || ev.Op == WatchRename {
+			pending = append(pending, ev)
+			continue
+		}
+
+		prev := &pending[i]
+		switch {
+		case prev.Op == WatchCreate && ev.Op == WatchRemove:
+			// never seen, drop it
+			pending = append(pending[:i], pending[i+1:]...)
+		case prev.Op == WatchCreate:
+			prev.Attr = ev.Attr
+		case prev.Op == WatchRemove && ev.Op == WatchCreate:
+			*prev = WatchEvent{Op: WatchModify, Path: ev.Path, Attr: ev.Attr}
+		default:
+			*prev = ev
+		}
+	}
+
+	return pending
+}
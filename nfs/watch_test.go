@@ -0,0 +1,84 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"testing"
+	"time"
+)
+
+func nextEvent(t *testing.T, w *Watcher) WatchEvent {
+	select {
+	case ev := <-w.Events:
+		return ev
+	case err := <-w.Errors:
+		t.Fatalf("watch: %s", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	return WatchEvent{}
+}
+
+func TestWatcher(t *testing.T) {
+	v := loopbackTarget(t)
+	defer v.Close()
+
+	if _, err := v.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+
+	w := v.NewWatcher(5 * time.Millisecond)
+	defer w.Close()
+	w.SetRelist(true)
+	if err := w.Add("/dir"); err != nil {
+		t.Fatalf("add: %s", err)
+	}
+
+	f, err := v.OpenFile("/dir/a", 0644)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if ev := nextEvent(t, w); ev.Op != WatchCreate || ev.Path != "/dir/a" {
+		t.Fatalf("expected the create, got %v %s", ev.Op, ev.Path)
+	}
+
+	if _, err = f.Write([]byte("data")); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	f.Close()
+	if ev := nextEvent(t, w); ev.Op != WatchModify || ev.Path != "/dir/a" || ev.Attr.Size() != 4 {
+		t.Fatalf("expected the write, got %v %s", ev.Op, ev.Path)
+	}
+
+	if err = v.Rename("/dir/a", "/dir/b"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+	if ev := nextEvent(t, w); ev.Op != WatchRename || ev.Path != "/dir/b" || ev.OldPath != "/dir/a" {
+		t.Fatalf("expected the rename, got %v %s %s", ev.Op, ev.OldPath, ev.Path)
+	}
+
+	if err = v.Remove("/dir/b"); err != nil {
+		t.Fatalf("remove: %s", err)
+	}
+	if ev := nextEvent(t, w); ev.Op != WatchRemove || ev.Path != "/dir/b" {
+		t.Fatalf("expected the remove, got %v %s", ev.Op, ev.Path)
+	}
+}
+
+func TestCoalesceEvents(t *testing.T) {
+	pending := coalesceEvents(nil, []WatchEvent{
+		{Op: WatchCreate, Path: "/a"},
+		{Op: WatchCreate, Path: "/b"},
+		{Op: WatchRemove, Path: "/c"},
+	})
+	pending = coalesceEvents(pending, []WatchEvent{
+		{Op: WatchModify, Path: "/a"},
+		{Op: WatchRemove, Path: "/b"},
+		{Op: WatchCreate, Path: "/c"},
+	})
+
+	if len(pending) != 2 || pending[0].Op != WatchCreate || pending[0].Path != "/a" || pending[1].Op != WatchModify || pending[1].Path != "/c" {
+		t.Fatalf("unexpected events %+v", pending)
+	}
+}
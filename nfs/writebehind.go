@@ -0,0 +1,201 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/go-nfs/nfsv3/nfs/util"
+)
+
+// stable_how of WRITE, RFC 1813 section 3.3.7
+const (
+	Unstable = 0
+	DataSync = 1
+	FileSync = 2
+)
+
+// maxReplays is how many times uncommitted data is written again for the
+// server rebooting, before a commit gives up
+const maxReplays = 3
+
+// uncommittedWrite is data written unstable, kept until a COMMIT
+type uncommittedWrite struct {
+	offset uint64
+	data   []byte
+}
+
+// SetWriteBehind has files write unstable, as the linux client does, keeping
+// up to max bytes of each file written but not committed.  The file is
+// committed when it holds more, and on Close.  Should the write verifier
+// change in between, the server rebooted and may have lost the data: it is
+// written again from what was kept and committed anew, after
+// EventServerRebootDetected.  The data kept is accounted against the
+// MemoryBudget, and committed early when the budget has no room for more.
+// Zero, the default, writes FILE_SYNC.
+func (v *Target) SetWriteBehind(max int) {
+	atomic.StoreInt64(&v.writeBehind, int64(max))
+}
+
+// writeBehindSize returns the bytes kept per file, see SetWriteBehind
+func (v *Target) writeBehindSize() int {
+	return int(atomic.LoadInt64(&v.writeBehind))
+}
+
+// keep notes p, just written unstable at offset, until it is committed.  If
+// the verifier changed since the data kept was written, it is all written
+// again.
+func (f *File) keep(p []byte, offset uint64, res *writeRes) error {
+	changed := len(f.uncommitted) > 0 && res.WriteVerf != f.verf
+
+	// the server may commit right away
+	if res.How != FileSync {
+		f.uncommitted = append(f.uncommitted, uncommittedWrite{offset, append([]byte(nil), p...)})
+		f.uncommittedSize += len(p)
+	}
+	f.settle()
+
+	if !changed {
+		f.verf = res.WriteVerf
+	} else {
+		util.Errorf("write(%x): write verifier changed, writing %d uncommitted bytes again", f.fh, f.uncommittedSize)
+		if err := f.replay(); err != nil {
+			return err
+		}
+	}
+
+	if f.uncommittedSize > f.writeBehindSize() {
+		return f.commit()
+	}
+
+	return nil
+}
+
+// hold accounts n bytes about to be written unstable, and kept, against the
+// memory budget.  When the budget has no room for them, what the file kept
+// is committed first, lest it wait on its own data.
+func (f *File) hold(n int) error {
+	if f.budget == nil {
+		return nil
+	}
+	if f.budget.TryAcquire(int64(n)) {
+		f.held += int64(n)
+		return nil
+	}
+
+	if len(f.uncommitted) > 0 {
+		if err := f.commit(); err != nil {
+			return err
+		}
+	}
+	f.held += f.acquire(n)
+
+	return nil
+}
+
+// settle gives back what of the budget held is not kept, written short,
+// committed right away by the server or not written at all
+func (f *File) settle() {
+	if kept := int64(f.uncommittedSize); f.held > kept {
+		f.release(f.held - kept)
+		f.held = kept
+	}
+}
+
+// replay writes all uncommitted data again, until the server does not reboot
+// in the middle of it
+func (f *File) replay() error {
+	for i := 0; i < maxReplays; i++ {
+		verf, same, err := f.rewrite()
+		if err != nil {
+			return err
+		}
+		if same {
+			f.verf = verf
+			return nil
+		}
+	}
+
+	return fmt.Errorf("write(%x): write verifier keeps changing, %d bytes may be lost", f.fh, f.uncommittedSize)
+}
+
+// rewrite writes all uncommitted data again, and returns the verifier of the
+// first reply and whether all the others had the same
+func (f *File) rewrite() (uint64, bool, error) {
+	var verf uint64
+	first, same := true, true
+	for _, w := range f.uncommitted {
+		for off := 0; off < len(w.data); {
+			res, err := f.writeAt(nil, w.data[off:], w.offset+uint64(off), Unstable)
+			if err != nil {
+				return 0, false, err
+			}
+
+			if first {
+				verf, first = res.WriteVerf, false
+			} else if res.WriteVerf != verf {
+				same = false
+			}
+			off += int(res.Count)
+		}
+	}
+
+	return verf, same, nil
+}
+
+// commit commits the file, and writes the uncommitted data again for as long
+// as the server reboots in between
+func (f *File) commit() error {
+	for i := 0; ; i++ {
+		verf, err := f.commitOnce()
+		if err != nil {
+			return err
+		}
+
+		if len(f.uncommitted) == 0 || verf == f.verf {
+			break
+		}
+		if i == maxReplays {
+			return fmt.Errorf("commit(%x): write verifier keeps changing, %d bytes may be lost", f.fh, f.uncommittedSize)
+		}
+
+		util.Errorf("commit(%x): write verifier changed, writing %d uncommitted bytes again", f.fh, f.uncommittedSize)
+		if err = f.replay(); err != nil {
+			return err
+		}
+	}
+
+	f.uncommitted = nil
+	f.uncommittedSize = 0
+	f.release(f.held)
+	f.held = 0
+
+	return nil
+}
+
+// flush commits the files still open with data written behind, for Close,
+// and returns the first error
+func (v *Target) flush() error {
+	v.handles.Lock()
+	var files []*File
+	for f := range v.handles.open {
+		if len(f.uncommitted) > 0 {
+			files = append(files, f)
+		}
+	}
+	v.handles.Unlock()
+
+	var first error
+	for _, f := range files {
+		if err := f.commit(); err != nil {
+			util.Errorf("close(%s): commit(%x): %s, %d bytes may be lost", v.dirPath, f.fh, err, f.uncommittedSize)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+
+	return first
+}
@@ -0,0 +1,118 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package nfs
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/go-nfs/nfsv3/nfs/rpc"
+)
+
+func TestWriteBehindReplay(t *testing.T) {
+	s := NewServer(NewMemFS())
+
+	var mu sync.Mutex
+	calls := make(map[uint32]int)
+	s.Register(Nfs3Prog, Nfs3Vers, func(call *rpc.ServerCall, w io.Writer) error {
+		mu.Lock()
+		calls[call.Proc]++
+		mu.Unlock()
+		return s.serveNFS(call, w)
+	})
+
+	v, err := DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	defer v.Close()
+
+	var events []EventType
+	v.SetEventHandler(func(ev *Event) { events = append(events, ev.Type) })
+	v.SetWriteBehind(1 << 20)
+
+	f, err := v.OpenFile("/file", 0644)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	for _, p := range []string{"hello, ", "world"} {
+		if _, err := f.Write([]byte(p)); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+	}
+
+	// the server reboots and loses what was not committed
+	if err := v.SetAttrByFh(f.fh, Sattr3{Size: SetSize{SetIt: true, Size: 0}}); err != nil {
+		t.Fatalf("truncate: %s", err)
+	}
+	s.verf++
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+
+	if calls[NFSProc3Write] != 4 || calls[NFSProc3Commit] != 2 {
+		t.Errorf("%d writes and %d commits, want 4 and 2", calls[NFSProc3Write], calls[NFSProc3Commit])
+	}
+	if len(events) != 1 || events[0] != EventServerRebootDetected {
+		t.Errorf("events %v", events)
+	}
+
+	r, err := v.Open("/file")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer r.Close()
+	if data, err := ioutil.ReadAll(r); err != nil || string(data) != "hello, world" {
+		t.Errorf("read back %q, %v", data, err)
+	}
+}
+
+func TestWriteBehindBudgetAndClose(t *testing.T) {
+	s := NewServer(NewMemFS())
+
+	var mu sync.Mutex
+	commits := 0
+	s.Register(Nfs3Prog, Nfs3Vers, func(call *rpc.ServerCall, w io.Writer) error {
+		if call.Proc == NFSProc3Commit {
+			mu.Lock()
+			commits++
+			mu.Unlock()
+		}
+		return s.serveNFS(call, w)
+	})
+
+	v, err := DialLoopback(s).Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatalf("mount: %s", err)
+	}
+	b := NewMemoryBudget(16)
+	v.SetMemoryBudget(b)
+	v.SetWriteBehind(1 << 20)
+
+	f, err := v.OpenFile("/file", 0644)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := f.Write([]byte("0123456789")); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+	}
+
+	// the budget holds one write only, the file commits to take the next
+	if commits != 2 || b.Used() != 10 {
+		t.Errorf("%d commits, %d bytes of the budget used, want 2 and 10", commits, b.Used())
+	}
+
+	// the file left open is committed, not lost
+	if err = v.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+	if commits != 3 || b.Used() != 0 {
+		t.Errorf("after close, %d commits, %d bytes of the budget used, want 3 and 0", commits, b.Used())
+	}
+}
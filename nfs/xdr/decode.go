@@ -4,16 +4,49 @@
 package xdr
 
 import (
+	"errors"
 	"io"
 
 	xdr "github.com/rasky/go-xdr/xdr2"
 )
 
+// ErrTooLong is returned when a length read from the stream exceeds the data
+// left in it
+var ErrTooLong = errors.New("xdr: length exceeds remaining data")
+
+// lener is implemented by readers that know how much data they hold, such as
+// bytes.Reader.  Lengths decoded from them are bounded by it, so that a
+// corrupt or hostile length cannot make the decoder allocate gigabytes.
+type lener interface {
+	Len() int
+}
+
+// Read decodes val from r, with its own decoder if it is a Decoder and by
+// reflection otherwise
 func Read(r io.Reader, val interface{}) error {
+	if dec, ok := val.(Decoder); ok {
+		return NewReader(r).Decode(dec)
+	}
+
+	if l, ok := r.(lener); ok {
+		// zero would mean no limit
+		_, err := xdr.UnmarshalLimited(r, val, uint(l.Len())+1)
+		return err
+	}
+
 	_, err := xdr.Unmarshal(r, val)
 	return err
 }
 
+// checkLength fails if r is known to hold less than n bytes
+func checkLength(r io.Reader, n uint64) error {
+	if l, ok := r.(lener); ok && n > uint64(l.Len()) {
+		return ErrTooLong
+	}
+
+	return nil
+}
+
 func ReadUint32(r io.Reader) (uint32, error) {
 	var n uint32
 	if err := Read(r, &n); err != nil {
@@ -37,12 +70,21 @@ func ReadOpaque(r io.Reader) ([]byte, error) {
 		return nil, err
 	}
 
-	buf := make([]byte, length)
-	if _, err = r.Read(buf); err != nil {
+	if err = checkLength(r, uint64(length)); err != nil {
 		return nil, err
 	}
+	if length > 1<<31-1 {
+		// its padded length would overflow
+		return nil, ErrTooLong
+	}
 
-	return buf, nil
+	// the data is padded to a multiple of four bytes
+	buf := make([]byte, (length+3)&^3)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	return buf[:length], nil
 }
 
 func ReadUint32List(r io.Reader) ([]uint32, error) {
@@ -51,6 +93,10 @@ func ReadUint32List(r io.Reader) ([]uint32, error) {
 		return nil, err
 	}
 
+	if err = checkLength(r, uint64(length)*4); err != nil {
+		return nil, err
+	}
+
 	buf := make([]uint32, length)
 
 	for i := 0; i < int(length); i++ {
@@ -6,6 +6,7 @@ package xdr
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
 	"testing"
 
 	"github.com/go-nfs/nfsv3/nfs/util"
@@ -66,3 +67,11 @@ func TestByteSlice(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestReadOpaqueTooLong(t *testing.T) {
+	// from a reader that cannot tell how much it holds
+	r := io.MultiReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4}))
+	if _, err := ReadOpaque(r); err != ErrTooLong {
+		t.Fatalf("got %v", err)
+	}
+}
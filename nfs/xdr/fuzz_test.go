@@ -0,0 +1,19 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package xdr
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzReadOpaque(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 3, 'a', 'b', 'c', 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ReadOpaque(bytes.NewReader(data))
+		ReadUint32List(bytes.NewReader(data))
+	})
+}
@@ -0,0 +1,123 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+//
+package xdr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Decoder is implemented by types that decode themselves, which Read then
+// does instead of walking them by reflection.  The hottest replies, READ,
+// WRITE, LOOKUP and the entries of READDIRPLUS, have hand-written decoders:
+// reflection and the boxing of every field into an interface dominate the
+// cost of decoding them.
+type Decoder interface {
+	DecodeXDR(r *Reader)
+}
+
+// Reader decodes XDR primitives from a stream.  The first error is kept and
+// all reads after it return zero values, so that a decoder can read a whole
+// structure and check Err once.
+type Reader struct {
+	r   io.Reader
+	buf [8]byte
+	err error
+}
+
+// NewReader returns a Reader decoding from r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Err returns the first error met
+func (d *Reader) Err() error {
+	return d.err
+}
+
+// Decode decodes dec from the stream, and returns the first error met
+func (d *Reader) Decode(dec Decoder) error {
+	dec.DecodeXDR(d)
+	return d.err
+}
+
+func (d *Reader) read(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if _, err := io.ReadFull(d.r, d.buf[:n]); err != nil {
+		d.err = err
+		return nil
+	}
+
+	return d.buf[:n]
+}
+
+func (d *Reader) DecodeUint32() uint32 {
+	b := d.read(4)
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *Reader) DecodeUint64() uint64 {
+	b := d.read(8)
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(b)
+}
+
+// DecodeBool decodes a bool, and the discriminant of the unions that hang
+// off one, failing on anything but 0 or 1 as the reflective decoder does
+func (d *Reader) DecodeBool() bool {
+	switch v := d.DecodeUint32(); v {
+	case 0:
+		return false
+	case 1:
+		return true
+	default:
+		if d.err == nil {
+			d.err = fmt.Errorf("xdr: bool not 0 or 1: %d", v)
+		}
+		return false
+	}
+}
+
+// DecodeOpaque decodes variable-length opaque data, bounded as ReadOpaque
+// is by the data left in the stream.  Empty data decodes to nil, as with
+// the reflective decoder.
+func (d *Reader) DecodeOpaque() []byte {
+	length := d.DecodeUint32()
+	if d.err != nil || length == 0 {
+		return nil
+	}
+
+	if err := checkLength(d.r, uint64(length)); err != nil {
+		d.err = err
+		return nil
+	}
+	if length > 1<<31-1 {
+		d.err = ErrTooLong
+		return nil
+	}
+
+	buf := make([]byte, (length+3)&^3)
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		d.err = err
+		return nil
+	}
+
+	return buf[:length:length]
+}
+
+func (d *Reader) DecodeString() string {
+	return string(d.DecodeOpaque())
+}
+